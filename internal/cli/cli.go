@@ -0,0 +1,176 @@
+// Package cli implements the sqlfs command, e.g. `sqlfs mount` and
+// `sqlfs fsck`, on top of internal/store.
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+const defaultDBURL = "postgres://roacher@localhost:26257/sqlfs?sslmode=disable&connect_timeout=5"
+
+// errUsage is returned by commands when they are invoked with invalid
+// arguments. The usage of the command is printed in that case.
+var errUsage = errors.New("invalid usage")
+
+// command is a subcommand of the sqlfs binary, e.g. `sqlfs mount`.
+type command struct {
+	name  string
+	args  string // Positional arguments, shown in the usage.
+	short string // One-line description.
+	flags *flag.FlagSet
+	run   func(args []string) error
+
+	// Configuration file and profile giving defaults to the flags.
+	config, profile *string
+}
+
+func (c *command) usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n", os.Args[0], c.name, c.args)
+	fmt.Fprintf(os.Stderr, "%s\n\nFlags:\n", c.short)
+	c.flags.PrintDefaults()
+}
+
+// newCommand creates a command with an empty flag set.
+func newCommand(name, args, short string) *command {
+	c := &command{
+		name:  name,
+		args:  args,
+		short: short,
+		flags: flag.NewFlagSet(name, flag.ExitOnError),
+	}
+	c.flags.Usage = c.usage
+	c.config, c.profile = configFlags(c.flags)
+	return c
+}
+
+func commands() []*command {
+	cmds := []*command{
+		newMountCommand(),
+		newInitCommand(),
+		newFsckCommand(),
+		newGCCommand(),
+		newStatsCommand(),
+		newExportCommand(),
+		newImportCommand(),
+		newSyncCommand(),
+		newBackupCommand(),
+		newRestoreCommand(),
+		newMigrateCommand(),
+		newRmCommand(),
+		newDuCommand(),
+		newTreeCommand(),
+		newStatCommand(),
+		newChflagsCommand(),
+		newACLCommand(),
+		newPolicyCommand(),
+		newSnapshotCommand(),
+		newCopyCommand(),
+		newScrubCommand(),
+		newFindCommand(),
+		newSearchCommand(),
+		newServeCommand(),
+		newCtlCommand(),
+		newMaintenanceCommand(),
+		newReplicateCommand(),
+		newLogCommand(),
+		newTierCommand(),
+		newBenchCommand(),
+		newSystemdGeneratorCommand(),
+	}
+	return cmds
+}
+
+func usage(cmds []*command) {
+	fmt.Fprintf(os.Stderr, "Usage: %s COMMAND [flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s COMMAND -h' for the flags of a command.\n", os.Args[0])
+}
+
+// dbFlag registers the flag used to select the database on `fs`, and those
+// giving its password and TLS settings.
+func dbFlag(fs *flag.FlagSet) *string {
+	dbSecretFlags(fs)
+	dbTLSFlags(fs)
+	return fs.String("db", defaultDBURL, "database connection URL")
+}
+
+// openDB connects to the database at `url` and ensures that it is reachable.
+// The database may not hold a file system yet, so its settings are the
+// default ones.
+func openDB(url string) (*store.DB, error) {
+	conn, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	db := store.NewDB(conn)
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openFileSystemDB connects to the database at `url` and ensures that it
+// holds a file system using the current schema.
+func openFileSystemDB(url string) (*store.DB, error) {
+	c, err := dbConnector(url)
+	if err != nil {
+		return nil, err
+	}
+	return store.OpenFileSystem(c)
+}
+
+// Main runs the sqlfs command line, e.g. `sqlfs mount MOUNTPOINT`, with
+// the arguments of the process.
+func Main() {
+	cmds := commands()
+	// Generators are run with their directories as only arguments.
+	if filepath.Base(os.Args[0]) == systemdGeneratorName {
+		os.Args = append([]string{os.Args[0], "systemd-generator"}, os.Args[1:]...)
+	}
+	if len(os.Args) < 2 {
+		usage(cmds)
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	for _, c := range cmds {
+		if c.name != name {
+			continue
+		}
+		_ = c.flags.Parse(os.Args[2:]) // Exits on error.
+		if err := applyConfig(c, cmds, *c.config, *c.profile); err != nil {
+			log.Fatal(err)
+		}
+		if err := resolveDBCredentials(c.flags); err != nil {
+			log.Fatal(err)
+		}
+		if err := resolveDBTLS(c.flags); err != nil {
+			log.Fatal(err)
+		}
+		if err := c.run(c.flags.Args()); err != nil {
+			if err == errUsage {
+				c.usage()
+				os.Exit(2)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if name != "-h" && name != "-help" && name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+	}
+	usage(cmds)
+	os.Exit(2)
+}
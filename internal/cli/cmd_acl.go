@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+// newACLCommand reads and changes ACLs directly in the database. Linux only
+// passes the ACL attributes to FUSE file systems that negotiate ACL
+// support, which the FUSE version in use cannot, so setfacl(1) and
+// getfacl(1) fail with EOPNOTSUPP on the mount.
+func newACLCommand() *command {
+	c := newCommand("acl", "PATH", "Print or set the POSIX ACL of a file or directory.")
+	db := dbFlag(c.flags)
+	dflt := c.flags.Bool("d", false, "operate on the default ACL of a directory, inherited by new entries")
+	set := c.flags.String("set", "", "replace the ACL, e.g. u::rw-,u:alice:rw-,g::r--,o::--- (the mask is computed if missing)")
+	remove := c.flags.Bool("remove", false, "remove the ACL")
+	c.run = func(args []string) error {
+		if len(args) != 1 || *set != "" && *remove {
+			return errUsage
+		}
+		var acl store.PosixACL
+		if *set != "" {
+			var err error
+			if acl, err = store.ParseACLText(*set); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return errUsage
+			}
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if *set != "" || *remove {
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+		}
+		if !conn.XattrsEnabled {
+			return errors.New("the database has no xattrs table, run `sqlfs init` first")
+		}
+
+		ctx := context.Background()
+		n, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		name := store.ACLAccessXattr
+		if *dflt {
+			if !n.IsDirectory() {
+				return errors.Errorf("%s is not a directory", args[0])
+			}
+			name = store.ACLDefaultXattr
+		}
+
+		if *set == "" && !*remove {
+			stored, err := store.GetACL(ctx, conn, n.Inode, name)
+			if err != nil {
+				return err
+			}
+			if stored == nil && !*dflt {
+				stored = store.ACLFromMode(n.Mode)
+			}
+			if stored != nil {
+				fmt.Println(stored)
+			}
+			return nil
+		}
+		// The permissions of the mode follow the access ACL, and are kept
+		// as they are when it is removed.
+		if name == store.ACLAccessXattr && acl != nil {
+			n.Mode = n.Mode&^os.ModePerm | acl.Perm()
+			n.Ctime = time.Now()
+			if err := store.UpdateNode(ctx, conn, n); err != nil {
+				return err
+			}
+		}
+		return store.PutACL(ctx, conn, n.Inode, name, acl)
+	}
+	return c
+}
@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+// newBackupCommand writes a consistent backup of the file system to a file,
+// see backup.go, or verifies a chain of backups.
+func newBackupCommand() *command {
+	c := newCommand("backup", "[verify BACKUP...]", "Write a consistent, compressed backup of the file system to a file (CockroachDB only), or verify backups.")
+	db := dbFlag(c.flags)
+	output := c.flags.String("o", "", "path of the backup file to write, e.g. fs.sqlfsbak")
+	since := c.flags.String("since", "", "path of a previous backup: only write the data blocks changed since, in an incremental backup")
+	resume := c.flags.Bool("resume", false, "resume the interrupted backup at -o, reading the database at the same time as before")
+	c.run = func(args []string) error {
+		if len(args) > 0 && args[0] == "verify" {
+			return verifyBackups(args[1:])
+		}
+		if len(args) != 0 || *output == "" || *resume && *since != "" {
+			return errUsage
+		}
+		ctx := context.Background()
+		if *resume {
+			f, err := os.OpenFile(*output, os.O_RDWR, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			h, stats, err := store.ResumeBackup(ctx, *db, f)
+			if err != nil {
+				return err
+			}
+			printBackupStats(h, stats)
+			return nil
+		}
+
+		var base *store.BackupHeader
+		if *since != "" {
+			r, h, err := store.OpenBackup(*since)
+			if err != nil {
+				return err
+			}
+			complete, err := r.Complete()
+			_ = r.Close()
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", *since)
+			}
+			if !complete {
+				return errors.Errorf("%s is incomplete, resume it first", *since)
+			}
+			base = h
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h, stats, err := store.WriteBackup(ctx, *db, f, base)
+		if err != nil {
+			if h != nil {
+				fmt.Fprintf(os.Stderr, "The backup was interrupted, run again with -resume to complete it.\n")
+			}
+			return err
+		}
+		printBackupStats(h, stats)
+		return nil
+	}
+	return c
+}
+
+func printBackupStats(h *store.BackupHeader, stats store.BackupStats) {
+	fmt.Printf("%s as of %s: %d inodes, %d entries, %d extended attributes, %d blocks (%s).\n",
+		backupKind(h), h.Time.Format("2006-01-02 15:04:05 MST"), stats.Inodes, stats.Entries, stats.Xattrs,
+		stats.Blocks, store.HumanBytes(uint64(stats.Bytes)))
+}
+
+func backupKind(h *store.BackupHeader) string {
+	if h.Base != "" {
+		return "Incremental backup"
+	}
+	return "Full backup"
+}
+
+// verifyBackups reads the backups at `paths` whole and checks that they
+// form a chain that can be restored.
+func verifyBackups(paths []string) error {
+	if len(paths) == 0 {
+		return errUsage
+	}
+	headers, err := store.CheckBackupChain(paths, true)
+	if err != nil {
+		return err
+	}
+	for i, h := range headers {
+		fmt.Printf("%s: %s as of %s\n", paths[i], backupKind(h), h.Time.Format("2006-01-02 15:04:05 MST"))
+	}
+	fmt.Println("The backups are intact and can be restored in this order.")
+	return nil
+}
+
+// newRestoreCommand loads backups written by `sqlfs backup` into an empty
+// database.
+func newRestoreCommand() *command {
+	c := newCommand("restore", "BACKUP [INCREMENTAL...]", "Load a full backup, and the incremental backups based on it, into an empty database.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		conn, err := openDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		stats, err := store.RestoreBackups(context.Background(), conn, args)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %d inodes, %d entries, %d extended attributes and %d blocks (%s).\n",
+			stats.Inodes, stats.Entries, stats.Xattrs, stats.Blocks, store.HumanBytes(uint64(stats.Bytes)))
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newBenchCommand() *command {
+	c := newCommand("bench", "", "Measure the throughput and latency of standard workloads on the file system.")
+	db := dbFlag(c.flags)
+	target := c.flags.String("target", "both", "where to run the workloads: storage (the SQL layer directly), mount (through a temporary FUSE mount) or both")
+	workloads := c.flags.String("workloads", "all", "comma-separated workloads to run: seqwrite, seqread, randwrite, randread (4K), create, stat, delete, or all")
+	size := store.ByteSize(64 << 20)
+	c.flags.Var(&size, "size", "size of the file of the sequential and random workloads")
+	ioSize := store.ByteSize(128 << 10)
+	c.flags.Var(&ioSize, "io-size", "size of the sequential reads and writes")
+	jobs := c.flags.Int("jobs", 4, "number of concurrent workers of the random and metadata workloads")
+	runtime := c.flags.Duration("runtime", 10*time.Second, "how long each random workload runs")
+	files := c.flags.Int("files", 1000, "number of files the metadata workloads create, stat and delete")
+	asJSON := c.flags.Bool("json", false, "print one JSON object per result")
+	c.run = func(args []string) error {
+		if len(args) != 0 || *jobs < 1 || *files < 1 || size < 1 || ioSize < 1 || *runtime <= 0 {
+			return errUsage
+		}
+		var storage, mount bool
+		switch *target {
+		case "storage":
+			storage = true
+		case "mount":
+			mount = true
+		case "both":
+			storage, mount = true, true
+		default:
+			return errors.Errorf("unknown target %q, expected storage, mount or both", *target)
+		}
+		selected, err := store.ParseBenchWorkloads(*workloads)
+		if err != nil {
+			return err
+		}
+		cfg := store.BenchConfig{
+			Workloads: selected,
+			Size:      int64(size),
+			IOSize:    int(ioSize),
+			Jobs:      *jobs,
+			Runtime:   *runtime,
+			Files:     *files,
+		}
+		report := func(r store.BenchResult) error {
+			if !*asJSON {
+				fmt.Println(r)
+				return nil
+			}
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.CheckWritableFormat(); err != nil {
+			return err
+		}
+
+		// The workloads run in a scratch directory at the root, removed
+		// once they are done.
+		ctx := context.Background()
+		root, err := store.ResolvePath(ctx, conn, "/")
+		if err != nil {
+			return err
+		}
+		scratch := fmt.Sprintf(".sqlfs-bench-%d", os.Getpid())
+		dir, err := store.CreateNode(ctx, conn, root, scratch, os.ModeDir|0755, uint32(os.Getuid()), uint32(os.Getgid()))
+		if err != nil {
+			return errors.Wrapf(err, "failed to create /%s", scratch)
+		}
+		defer func() {
+			if _, err := store.RemoveTree(ctx, conn, root.Inode, scratch); err != nil {
+				log.Printf("failed to remove /%s: %s\n", scratch, err)
+			}
+		}()
+
+		if storage {
+			sub, err := store.CreateNode(ctx, conn, dir, "storage", os.ModeDir|0755, uint32(os.Getuid()), uint32(os.Getgid()))
+			if err != nil {
+				return err
+			}
+			if err := store.RunBench(store.StorageTarget{Ctx: ctx, DB: conn, Dir: sub}, "storage", cfg, report); err != nil {
+				return err
+			}
+		}
+		if mount {
+			if _, err := store.CreateNode(ctx, conn, dir, "mount", os.ModeDir|0755, uint32(os.Getuid()), uint32(os.Getgid())); err != nil {
+				return err
+			}
+			return benchMount(conn, "/"+scratch+"/mount", cfg, report)
+		}
+		return nil
+	}
+	return c
+}
+
+// benchMount mounts the directory `subdir` of the file system at a
+// temporary mountpoint with the default options, and runs the workloads in
+// it.
+func benchMount(conn *store.DB, subdir string, cfg store.BenchConfig, report func(store.BenchResult) error) error {
+	f, err := store.New(conn.DB, store.WithSubdir(subdir))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mountpoint, err := ioutil.TempDir("", "sqlfs-bench")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountpoint)
+
+	ready := make(chan error, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Serve(mountpoint, func(err error) { ready <- err })
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			return errors.Wrap(err, "failed to mount")
+		}
+	case err := <-done:
+		return errors.Wrap(err, "failed to mount")
+	}
+
+	err = store.RunBench(store.MountTarget(mountpoint), "mount", cfg, report)
+	if unmountErr := f.Unmount(mountpoint, 10*time.Second); unmountErr != nil {
+		log.Printf("failed to unmount %s: %s\n", mountpoint, unmountErr)
+		return err
+	}
+	if serveErr := <-done; err == nil {
+		err = serveErr
+	}
+	return err
+}
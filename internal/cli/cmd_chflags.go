@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+// newChflagsCommand changes flags directly in the database. The FUSE
+// version in use has no ioctl support, so this is how the flags are set
+// on Linux, where chattr(1) cannot reach the file system; mounts pick up
+// the change on the next stat.
+func newChflagsCommand() *command {
+	c := newCommand("chflags", "FLAGS PATH...", "Set or clear the immutable and append-only flags of files, e.g. uchg or nouappnd.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) < 2 {
+			return errUsage
+		}
+		if _, err := store.ParseFlags(args[0], 0); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.CheckWritableFormat(); err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		for _, path := range args[1:] {
+			n, err := store.ResolvePath(ctx, conn, path)
+			if err != nil {
+				return err
+			}
+			n.Flags, _ = store.ParseFlags(args[0], n.Flags)
+			n.Ctime = time.Now()
+			if err := store.UpdateNode(ctx, conn, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+// newCopyCommand copies files and trees within the database. Contents are
+// copied rather than shared, and the FUSE version in use has no ioctl
+// support, so cp --reflink reads and writes the files through the mount.
+func newCopyCommand() *command {
+	c := newCommand("copy", "SRC DST", "Copy a file or directory tree within the database, in a single transaction.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.CheckWritableFormat(); err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		src, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		dst := path.Clean("/" + args[1])
+		if dst == "/" {
+			return errors.New("cannot copy over the root directory")
+		}
+		parent, err := store.ResolvePath(ctx, conn, path.Dir(dst))
+		if err != nil {
+			return err
+		}
+		if !parent.IsDirectory() {
+			return errors.Errorf("%s is not a directory", path.Dir(dst))
+		}
+		count, err := store.CopyTree(ctx, conn, src, parent.Inode, path.Base(dst))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Copied %d inode(s).\n", count)
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ctlCommands maps the commands of `sqlfs ctl` to admin API endpoints.
+var ctlCommands = map[string]struct {
+	method, path string
+}{
+	"status":      {http.MethodGet, "/status"},
+	"stats":       {http.MethodGet, "/stats"},
+	"ops":         {http.MethodGet, "/ops"},
+	"gc":          {http.MethodPost, "/gc"},
+	"drop-caches": {http.MethodPost, "/invalidate"},
+	"flush":       {http.MethodPost, "/flush"},
+	"log-level":   {http.MethodPost, "/log-level"},
+	"throttle":    {http.MethodPost, "/throttle"},
+	"read-only":   {http.MethodPost, "/read-only"},
+	"snapshot":    {http.MethodPost, "/snapshot"},
+	"unmount":     {http.MethodPost, "/unmount"},
+}
+
+func newCtlCommand() *command {
+	c := newCommand("ctl", "COMMAND [ARG]", "Control a running mount through its control socket. COMMAND is one of "+
+		"status, stats, ops, gc, drop-caches, flush, log-level (debug or info), throttle (LIMITS or off), read-only (on or off), snapshot (NAME) or unmount.")
+	socket := c.flags.String("socket", "", "control socket of the mount, as given to `sqlfs mount -control-socket`")
+	dryRun := c.flags.Bool("dry-run", false, "only report what gc would remove")
+	c.run = func(args []string) error {
+		if len(args) == 0 || len(args) > 2 || *socket == "" {
+			return errUsage
+		}
+		cmd, ok := ctlCommands[args[0]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown control command %q\n", args[0])
+			return errUsage
+		}
+		query := url.Values{}
+		switch {
+		case args[0] == "log-level" && len(args) == 2:
+			query.Set("level", args[1])
+		case args[0] == "throttle" && len(args) == 2:
+			query.Set("limits", args[1])
+		case args[0] == "read-only" && len(args) == 2:
+			query.Set("enabled", args[1])
+		case args[0] == "snapshot" && len(args) == 2:
+			query.Set("name", args[1])
+		case len(args) == 2:
+			return errUsage
+		case args[0] == "gc" && *dryRun:
+			query.Set("dry_run", "1")
+		}
+
+		client := &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", *socket)
+				},
+			},
+		}
+		u := url.URL{Scheme: "http", Host: "sqlfs", Path: cmd.path, RawQuery: query.Encode()}
+		req, err := http.NewRequest(cmd.method, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, body, "", "  "); err != nil {
+			out.Write(body)
+		}
+		fmt.Print(out.String())
+		return nil
+	}
+	return c
+}
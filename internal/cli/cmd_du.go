@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newDuCommand() *command {
+	c := newCommand("du", "PATH", "Summarize the space used below a directory.")
+	db := dbFlag(c.flags)
+	summarize := c.flags.Bool("s", false, "only print the total")
+	human := c.flags.Bool("h", false, "print sizes in human readable format")
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		dir, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		format := func(size uint64) string {
+			if *human {
+				return store.HumanBytes(size)
+			}
+			return strconv.FormatUint(size, 10)
+		}
+		if !dir.IsDirectory() {
+			fmt.Printf("%s\t%s\n", format(dir.Size), args[0])
+			return nil
+		}
+
+		usage, err := store.DiskUsage(ctx, conn, dir.Inode)
+		if err != nil {
+			return err
+		}
+		var total uint64
+		for _, u := range usage {
+			total += u.Size
+			if !*summarize {
+				fmt.Printf("%s\t%s\n", format(u.Size), path.Join(args[0], u.Name))
+			}
+		}
+		fmt.Printf("%s\t%s\n", format(total), args[0])
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,176 @@
+package cli
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newExportCommand() *command {
+	c := newCommand("export", "", "Write the contents of the file system to a tar or zip archive.")
+	db := dbFlag(c.flags)
+	output := c.flags.String("o", "-", "path of the archive to write, or - for stdout. "+
+		"The format is picked from the extension: .tar, .tar.gz, .tgz or .zip")
+	format := c.flags.String("format", "", "archive format (tar, tar.gz or zip), overrides the extension of -o")
+	subdir := c.flags.String("subdir", "/", "path of the directory in the tree to export")
+	c.run = func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		f := *format
+		if f == "" {
+			f = archiveFormat(*output)
+		}
+		if f != "tar" && f != "tar.gz" && f != "zip" {
+			fmt.Fprintf(os.Stderr, "unknown archive format %q\n", f)
+			return errUsage
+		}
+
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		root, err := store.ResolvePath(ctx, conn, *subdir)
+		if err != nil {
+			return err
+		}
+		if !root.IsDirectory() {
+			return errors.Errorf("%s is not a directory", *subdir)
+		}
+
+		var w io.Writer = os.Stdout
+		if *output != "-" {
+			out, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			w = out
+		}
+		switch f {
+		case "tar":
+			err = exportTar(ctx, conn, root, w)
+		case "tar.gz":
+			gw := gzip.NewWriter(w)
+			if err = exportTar(ctx, conn, root, gw); err == nil {
+				err = gw.Close()
+			}
+		case "zip":
+			err = exportZip(ctx, conn, root, w)
+		}
+		if err != nil {
+			return err
+		}
+		if *output != "-" {
+			fmt.Fprintf(os.Stderr, "Exported %s to %s.\n", *subdir, *output)
+		}
+		return nil
+	}
+	return c
+}
+
+// archiveFormat guesses the archive format from the name of the output file.
+// Tar is used for stdout and unknown extensions.
+func archiveFormat(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	}
+	return "tar"
+}
+
+// exportTar writes every node below the directory `root` into a tar archive.
+// Modes, ownership, timestamps, symlinks and hard links are preserved.
+//
+// TODO(imjching): Export extended attributes as PAX records once they are
+// stored by the file system.
+func exportTar(ctx context.Context, db *store.DB, root *store.FileNode, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	// Inodes that were already written, used to detect hard links.
+	seen := make(map[uint64]string)
+	err := store.WalkTree(ctx, db, root, "", func(p string, n *store.FileNode) error {
+		hdr, err := tar.FileInfoHeader(n.FileInfo(), n.SymlinkTarget)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create header for %q", p)
+		}
+		hdr.Name = p
+		if n.IsDirectory() {
+			hdr.Name += "/"
+		}
+		hdr.Uid = int(n.Uid)
+		hdr.Gid = int(n.Gid)
+		hdr.AccessTime = n.Atime
+		hdr.ChangeTime = n.Ctime
+		hdr.Format = tar.FormatPAX // Needed for access and change times.
+		if first, ok := seen[n.Inode]; ok && !n.IsDirectory() {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		}
+		seen[n.Inode] = p
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			return nil
+		}
+		return errors.Wrapf(store.CopyData(ctx, db, n, tw), "failed to read %q", p)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// exportZip writes every node below the directory `root` into a zip archive.
+// Zip archives cannot hold ownership or hard links, so hard links are
+// stored as separate copies.
+func exportZip(ctx context.Context, db *store.DB, root *store.FileNode, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := store.WalkTree(ctx, db, root, "", func(p string, n *store.FileNode) error {
+		if !n.IsRegular() && !n.IsDirectory() && !n.IsSymlink() {
+			return nil // Devices, pipes and sockets cannot be stored.
+		}
+		hdr, err := zip.FileInfoHeader(n.FileInfo())
+		if err != nil {
+			return errors.Wrapf(err, "failed to create header for %q", p)
+		}
+		hdr.Name = p
+		if n.IsDirectory() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case n.IsSymlink():
+			_, err = io.WriteString(fw, n.SymlinkTarget)
+			return err
+		case n.IsRegular():
+			return errors.Wrapf(store.CopyData(ctx, db, n, fw), "failed to read %q", p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
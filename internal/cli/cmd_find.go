@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newFindCommand() *command {
+	c := newCommand("find", "PATH", "Search for files using predicates evaluated by the database.")
+	db := dbFlag(c.flags)
+	predicates := findFlags(c.flags)
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		f, err := predicates.Filter(time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return errUsage
+		}
+
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		dir, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		nodes, err := store.FindNodes(ctx, conn, dir.Inode, f)
+		if err != nil {
+			return err
+		}
+		for _, n := range nodes {
+			fmt.Println(path.Join(args[0], n.Name))
+		}
+		return nil
+	}
+	return c
+}
+
+// findFlags defines the flags of the predicates of `sqlfs find` in `flags`.
+func findFlags(flags *flag.FlagSet) *store.FindPredicates {
+	var p store.FindPredicates
+	flags.StringVar(&p.Name, "name", "", "only match entries whose name matches this glob")
+	flags.StringVar(&p.Type, "type", "", "only match entries of this type: f (file), d (directory) or l (symlink)")
+	flags.StringVar(&p.Size, "size", "", "only match files larger (+N) or smaller (-N) than N bytes, e.g. +10M")
+	flags.StringVar(&p.Mtime, "mtime", "", "only match entries modified more (+N) or less (-N) than N days ago")
+	return &p
+}
@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newFsckCommand() *command {
+	c := newCommand("fsck", "", "Check the consistency of the file system and optionally repair it.")
+	db := dbFlag(c.flags)
+	repair := c.flags.Bool("repair", false, "repair the problems that were found")
+	c.run = func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if *repair {
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+		}
+
+		problems, err := runFsck(context.Background(), conn, *repair)
+		if err != nil {
+			return err
+		}
+		if problems == 0 {
+			fmt.Println("No problems found.")
+			return nil
+		}
+		if *repair {
+			fmt.Printf("Repaired %d problem(s).\n", problems)
+			return nil
+		}
+		return errors.Errorf("found %d problem(s), run with -repair to fix them", problems)
+	}
+	return c
+}
+
+// runFsck checks the file system for inconsistencies, and returns the number
+// of problems found. If `repair` is true, the problems are fixed as they are
+// found.
+func runFsck(ctx context.Context, db *store.DB, repair bool) (int, error) {
+	problems := 0
+
+	// Entries that point to missing inodes, or that live in missing
+	// directories.
+	entries, err := store.ListDanglingEntries(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		problems++
+		fmt.Printf("dangling entry %q in parent %d (inode %d)\n", e.Name, e.Parent, e.Inode)
+		if repair {
+			if err := store.RemoveEntry(ctx, db, e.Parent, e.Name); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	// Inodes that are not referenced by any entry. These are removed along
+	// with their data.
+	orphans, err := store.ListOrphanedInodes(ctx, db)
+	if err != nil {
+		return problems, err
+	}
+	for _, inode := range orphans {
+		problems++
+		fmt.Printf("orphaned inode %d\n", inode)
+		if repair {
+			if err := store.RemoveInode(ctx, db, inode); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	blocks, err := store.CountOrphanedDataBlocks(ctx, db)
+	if err != nil {
+		return problems, err
+	}
+	if blocks > 0 {
+		problems++
+		fmt.Printf("%d orphaned data block(s)\n", blocks)
+		if repair {
+			if _, err := store.RemoveOrphanedDataBlocks(ctx, db); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	// Files whose data was written by an operation spanning several
+	// transactions that did not complete, as every complete write bumps the
+	// generation. Bumping it makes mounts drop the blocks they cached.
+	var torn []uint64
+	err = store.ListUngeneratedFiles(ctx, db, func(inode uint64) error {
+		problems++
+		fmt.Printf("inode %d has data but no generation, it was written by an interrupted operation\n", inode)
+		torn = append(torn, inode)
+		return nil
+	})
+	if err != nil {
+		return problems, err
+	}
+	if repair {
+		for _, inode := range torn {
+			if err := store.BumpGeneration(ctx, db, inode); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	// Link counts and sizes stored in the inodes must match the tree and
+	// the data blocks.
+	links, err := store.CountLinks(ctx, db)
+	if err != nil {
+		return problems, err
+	}
+	extents, err := store.DataExtents(ctx, db)
+	if err != nil {
+		return problems, err
+	}
+	var toUpdate []*store.FileNode
+	err = store.ListAllNodes(ctx, db, func(n *store.FileNode) error {
+		dirty := false
+		if nlink, ok := links[n.Inode]; ok && !n.IsDirectory() && n.Nlink != nlink {
+			problems++
+			fmt.Printf("inode %d has link count %d, expected %d\n", n.Inode, n.Nlink, nlink)
+			n.Nlink = nlink
+			dirty = true
+		}
+		// Files may end with a hole, but must not have data past their size.
+		if n.IsRegular() && n.Size < extents[n.Inode] {
+			problems++
+			fmt.Printf("inode %d has size %d, but has data up to %d\n", n.Inode, n.Size, extents[n.Inode])
+			n.Size = extents[n.Inode]
+			dirty = true
+		}
+		if dirty {
+			toUpdate = append(toUpdate, n)
+		}
+		return nil
+	})
+	if err != nil {
+		return problems, err
+	}
+	if repair {
+		for _, n := range toUpdate {
+			if err := store.UpdateNode(ctx, db, n); err != nil {
+				return problems, err
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newGCCommand() *command {
+	c := newCommand("gc", "", "Remove inodes and data blocks that are no longer referenced.")
+	db := dbFlag(c.flags)
+	dryRun := c.flags.Bool("dry-run", false, "only report what would be removed")
+	c.run = func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if !*dryRun {
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+		}
+
+		res, err := store.CollectGarbage(context.Background(), conn, *dryRun)
+		if err != nil {
+			return err
+		}
+		verb := "Removed"
+		if *dryRun {
+			verb = "Would remove"
+		}
+		fmt.Printf("%s %d orphaned inode(s) and %d orphaned data block(s).\n", verb, res.Inodes, res.Blocks)
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,186 @@
+package cli
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newImportCommand() *command {
+	c := newCommand("import", "DIR-OR-TAR", "Load a local directory or a tar archive into the file system.")
+	db := dbFlag(c.flags)
+	dest := c.flags.String("dest", "/", "path of the directory in the tree to import into")
+	batchSize := c.flags.Int("batch-size", 500, "number of files and directories written per transaction")
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.CheckWritableFormat(); err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		destNode, err := store.ResolvePath(ctx, conn, *dest)
+		if err != nil {
+			return err
+		}
+		if !destNode.IsDirectory() {
+			return errors.Errorf("%s is not a directory", *dest)
+		}
+
+		fi, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		}
+		im := store.NewImporter(ctx, conn, destNode.Inode, *batchSize)
+		if fi.IsDir() {
+			err = importDir(im, args[0])
+		} else {
+			err = importTarFile(im, args[0])
+		}
+		if err == nil {
+			err = im.Commit()
+		}
+		if err != nil {
+			im.Rollback()
+			return err
+		}
+		fmt.Printf("Imported %d node(s) and %d byte(s) into %s.\n", im.Nodes, im.Bytes, *dest)
+		return nil
+	}
+	return c
+}
+
+// importDir imports the local directory tree rooted at `root`. Hard links
+// within the local tree are imported as separate files.
+func importDir(im *store.Importer, root string) error {
+	return filepath.Walk(root, func(local string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, local)
+		if err != nil {
+			return err
+		}
+		p := filepath.ToSlash(rel)
+		n := store.NodeFromFileInfo(fi)
+
+		switch {
+		case fi.IsDir():
+			return im.AddDir(p, n)
+		case n.IsSymlink():
+			target, err := os.Readlink(local)
+			if err != nil {
+				return err
+			}
+			n.SymlinkTarget = target
+			return im.AddFile(p, n, nil)
+		case n.IsRegular():
+			f, err := os.Open(local)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return im.AddFile(p, n, f)
+		}
+		return im.AddFile(p, n, nil)
+	})
+}
+
+// importTarFile imports the tar archive at `name`, which may be compressed
+// with gzip.
+func importTarFile(im *store.Importer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	return importTar(im, tar.NewReader(r))
+}
+
+func importTar(im *store.Importer, tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p := path.Clean(hdr.Name)
+		if path.IsAbs(p) || p == ".." || len(p) > 2 && p[:3] == "../" {
+			return errors.Errorf("refusing to import %q outside of the destination", hdr.Name)
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			// Archives do not always contain entries for every directory.
+			if err := importTarParents(im, p); err != nil {
+				return err
+			}
+		}
+
+		n := store.NodeFromFileInfo(hdr.FileInfo())
+		n.Uid = uint32(hdr.Uid)
+		n.Gid = uint32(hdr.Gid)
+		if !hdr.AccessTime.IsZero() {
+			n.Atime = hdr.AccessTime
+		}
+		if !hdr.ChangeTime.IsZero() {
+			n.Ctime = hdr.ChangeTime
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = im.AddDir(p, n)
+		case tar.TypeLink:
+			err = im.AddLink(p, path.Clean(hdr.Linkname))
+		case tar.TypeSymlink:
+			n.SymlinkTarget = hdr.Linkname
+			err = im.AddFile(p, n, nil)
+		case tar.TypeReg:
+			err = im.AddFile(p, n, tr)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			err = im.AddFile(p, n, nil)
+		default:
+			continue // Skip PAX headers and other metadata entries.
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// importTarParents creates the missing parent directories of `p`.
+func importTarParents(im *store.Importer, p string) error {
+	dir := path.Dir(p)
+	if _, ok := im.Dirs[dir]; ok {
+		return nil
+	}
+	if err := importTarParents(im, dir); err != nil {
+		return err
+	}
+	return im.AddDir(dir, &store.FileNode{Mode: os.ModeDir | 0755})
+}
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newInitCommand() *command {
+	c := newCommand("init", "", "Create the file system tables in the database.")
+	db := dbFlag(c.flags)
+	var size store.ByteSize
+	c.flags.Var(&size, "block-size", "size of the data blocks, e.g. 256K to store big files in fewer rows (default 1K)")
+	caseFold := c.flags.Bool("case-insensitive", false, "match names regardless of case while preserving it, as on macOS (cannot be undone)")
+	normalize := c.flags.String("normalize", "", "store and look up names in this Unicode normalization form: nfc, nfd or none, so that names from macOS (NFD) and Linux (NFC) clients match")
+	windowsNames := c.flags.Bool("windows-names", false, "reject names that Windows cannot represent, for trees served to Windows clients")
+	var inline store.ByteSize
+	c.flags.Var(&inline, "inline-data", "store the contents of files up to this size, e.g. 4K, in their inode rather than in data blocks, saving a query per small file (cannot be undone)")
+	shards := c.flags.Int("block-shards", 0, "hash shard the data blocks into this many buckets, so that writing a large file does not overload a single range (CockroachDB only, 0 disables)")
+	regions := c.flags.String("regions", "", "comma-separated regions of a multi-region CockroachDB cluster, the first one primary: the tree and inodes become GLOBAL tables and the data blocks REGIONAL BY ROW")
+	tiering := c.flags.Bool("tiering", false, "also create the tiered_files table used by `sqlfs tier`")
+	journal := c.flags.Bool("journal", false, "also create the ops_log table used by `sqlfs mount -journal`")
+	snapshots := c.flags.Bool("snapshots", false, "also create the snapshots table, so that snapshots can be taken through .sqlfs/snapshot (CockroachDB only)")
+	checksums := c.flags.Bool("checksums", false, "store a CRC-32C checksum of every data block, verified on reads and by `sqlfs scrub` (CockroachDB only)")
+	fileHashes := c.flags.Bool("file-hashes", false, "also create the file_hashes table, which keeps the SHA-256 of files read from user.sqlfs.sha256 until they change")
+	contentIndex := c.flags.Bool("content-index", false, "also create the full-text index used by `sqlfs search` (requires TSVECTOR support)")
+	c.run = func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		form, err := store.ParseNormForm(*normalize)
+		if err != nil {
+			return err
+		}
+		var regionList []string
+		if *regions != "" {
+			if regionList, err = store.ParseRegions(*regions); err != nil {
+				return err
+			}
+		}
+		conn, err := openDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		if err := store.CreateSchema(ctx, conn.DB); err != nil {
+			return err
+		}
+		if size != 0 {
+			if err := store.SetBlockSize(ctx, conn, int64(size)); err != nil {
+				return err
+			}
+		}
+		if inline != 0 {
+			if err := store.EnableInlineData(ctx, conn, int64(inline)); err != nil {
+				return err
+			}
+		}
+		if *shards != 0 {
+			if err := store.ShardDataBlocks(ctx, conn, *shards); err != nil {
+				return err
+			}
+		}
+		if regionList != nil {
+			if err := store.SetMultiRegion(ctx, conn, regionList); err != nil {
+				return err
+			}
+		}
+		if *normalize != "" {
+			if err := store.SetNameNormalization(ctx, conn, form); err != nil {
+				return err
+			}
+		}
+		if *windowsNames {
+			if err := store.SetWindowsNames(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if *caseFold {
+			if err := store.SetCaseInsensitive(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if *checksums {
+			if err := store.EnableChecksums(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if *tiering {
+			if err := store.CreateTiering(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if *journal {
+			if err := store.CreateJournal(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if *snapshots {
+			if err := store.CreateSnapshots(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if *fileHashes {
+			if err := store.CreateFileHashes(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if *contentIndex {
+			if err := store.CreateContentIndex(ctx, conn); err != nil {
+				return err
+			}
+		}
+		fmt.Println("File system initialized.")
+		return nil
+	}
+	return c
+}
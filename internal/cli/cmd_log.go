@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+// How often `sqlfs log tail -f` polls for new entries.
+const logFollowInterval = time.Second
+
+func newLogCommand() *command {
+	c := newCommand("log", "tail", "Show the operations journal of mounts started with -journal (see `sqlfs init -journal`).")
+	db := dbFlag(c.flags)
+	lines := c.flags.Int("n", 20, "number of most recent entries to show")
+	follow := c.flags.Bool("f", false, "keep printing new entries as they are recorded")
+	asJSON := c.flags.Bool("json", false, "print one JSON object per entry")
+	c.run = func(args []string) error {
+		if len(args) != 1 || args[0] != "tail" || *lines < 0 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		entries, err := store.ListJournal(ctx, conn, 0, *lines, true)
+		if err != nil {
+			return err
+		}
+		var last int64
+		for {
+			for _, e := range entries {
+				if err := printJournalEntry(e, *asJSON); err != nil {
+					return err
+				}
+				last = e.ID
+			}
+			if !*follow {
+				return nil
+			}
+			time.Sleep(logFollowInterval)
+			if entries, err = store.ListJournal(ctx, conn, last, 1000, false); err != nil {
+				return err
+			}
+		}
+	}
+	return c
+}
+
+func printJournalEntry(e store.JournalEntry, asJSON bool) error {
+	if asJSON {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	args := ""
+	if len(e.Args) > 0 {
+		data, err := json.Marshal(e.Args)
+		if err != nil {
+			return err
+		}
+		args = " " + string(data)
+	}
+	fmt.Printf("%s %s uid=%d pid=%d %s inode=%d parent=%d name=%q%s\n",
+		e.Time.Format(time.RFC3339Nano), e.MountID, e.Uid, e.Pid, e.Op, e.Inode, e.Parent, e.Name, args)
+	return nil
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+// newMaintenanceCommand makes every mount of the file system read-only
+// through the read_only setting, which mounts poll. The file system itself
+// can still be changed directly in the database, e.g. by `sqlfs migrate`.
+func newMaintenanceCommand() *command {
+	c := newCommand("maintenance", "[on|off]", "Make all mounts of the file system read-only, or writable again.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) > 1 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		if len(args) == 1 {
+			var value string
+			switch args[0] {
+			case "on":
+				value = "true"
+			case "off":
+				value = "false"
+			default:
+				return errUsage
+			}
+			if err := store.PutSetting(ctx, conn, store.SettingReadOnly, value); err != nil {
+				return err
+			}
+		}
+		value, err := store.GetSetting(ctx, conn, store.SettingReadOnly)
+		if err != nil {
+			return err
+		}
+		if value == "true" {
+			fmt.Println("Maintenance mode is on: mounts refuse writes once they poll the setting (every -maintenance-poll).")
+		} else {
+			fmt.Println("Maintenance mode is off.")
+		}
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newMigrateCommand() *command {
+	c := newCommand("migrate", "", "Upgrade a database created by an older version to the current schema.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		conn, err := openDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		legacy, err := store.HasLegacyInodes(ctx, conn)
+		if err != nil {
+			return err
+		}
+		generations, err := store.HasGenerations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if !legacy && generations {
+			fmt.Println("The database already uses the current schema.")
+			return nil
+		}
+		if legacy {
+			count, err := store.MigrateLegacyInodes(ctx, conn)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Converted %d inode(s) from JSON to typed columns.\n", count)
+		}
+		if err := store.AddGenerations(ctx, conn); err != nil {
+			return err
+		}
+		fmt.Println("Added generation numbers to the inodes.")
+		return nil
+	}
+	return c
+}
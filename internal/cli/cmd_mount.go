@@ -0,0 +1,526 @@
+package cli
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+type mountFlags struct {
+	db        *string
+	atimeMode *string
+	subdir    *string
+	daemon    *bool
+	pidfile   *string
+	logFile   *string
+	adminAddr *string
+	ctlSocket *string
+
+	shutdownTimeout *time.Duration
+	noAutoRemount   *bool
+	skipCheck       *bool
+	maintenancePoll *time.Duration
+	opTimeout       *time.Duration
+	maxStatements   *int
+	queueTimeout    *time.Duration
+	breakerFailures *int
+	breakerCooldown *time.Duration
+	rateOps         *float64
+	rateUIDOps      *float64
+	rateBytes       store.ByteSize
+	injectFaults    *string
+	injectSeed      *int64
+
+	fastLookup   *bool
+	prefetchAttr *bool
+	negativeTTL  *time.Duration
+	dirOrder     *string
+	batchCreates *time.Duration
+	coalesce     *bool
+	indexContent *bool
+	writeLeases  *bool
+	exclusive    *bool
+	gcInterval   *time.Duration
+	scrubEvery   *time.Duration
+	scrubRate    *float64
+	scrubReplica *string
+	leaseTTL     *time.Duration
+	journal      *bool
+	objectStore  *string
+	asOf         *string
+	readahead    *int
+	warmPaths    *string
+	heatMap      *string
+	warmAttrTTL  *time.Duration
+	directIO     *bool
+	secLabel     *string
+	noAppleDbl   *bool
+	noStatusDir  *bool
+	noQueryFile  *bool
+	noSnapshots  *bool
+	verifySums   *bool
+	maxNameLen   *int
+	idMapFile    *string
+	uids, gids   store.IDMap
+	fileMode     store.PermFlag
+	dirMode      store.PermFlag
+	umask        store.PermFlag
+	maxPathLen   *int
+	blockCache   store.ByteSize
+	asyncWrites  store.ByteSize
+
+	// FUSE mount options.
+	allowOther         *bool
+	allowRoot          *bool
+	defaultPermissions *bool
+	maxReadahead       store.ByteSize
+	asyncRead          *bool
+	writebackCache     *bool
+}
+
+func newMountCommand() *command {
+	c := newCommand("mount", "MOUNTPOINT", "Mount the file system stored in the database.")
+	f := &mountFlags{
+		db:        dbFlag(c.flags),
+		atimeMode: c.flags.String("atime-mode", "relatime", "access time update mode: strict, relatime or noatime"),
+		subdir:    c.flags.String("subdir", "/", "path of the directory in the tree to expose as the mount root"),
+		daemon:    c.flags.Bool("daemon", false, "run in the background once the file system is mounted"),
+		pidfile:   c.flags.String("pidfile", "", "write the process ID to this file once the file system is mounted"),
+		logFile:   c.flags.String("log-file", "", "file that logs are appended to when running with -daemon"),
+		adminAddr: c.flags.String("admin-addr", "", "serve the JSON admin API on this loopback address, e.g. localhost:7070, or unix:PATH (disabled if empty)"),
+		ctlSocket: c.flags.String("control-socket", "", "serve the admin API on this Unix socket for `sqlfs ctl` (disabled if empty)"),
+
+		shutdownTimeout: c.flags.Duration("shutdown-timeout", 10*time.Second, "how long to wait for operations in flight before unmounting"),
+		opTimeout:       c.flags.Duration("op-timeout", 30*time.Second, "abort the queries of a file system operation and fail it with EIO after this long (0 disables the timeout)"),
+		skipCheck:       c.flags.Bool("skip-check", false, "mount even if the quick consistency check finds the file system damaged"),
+		noAutoRemount:   c.flags.Bool("no-auto-remount", false, "exit instead of remounting when the FUSE connection is lost"),
+		maintenancePoll: c.flags.Duration("maintenance-poll", 10*time.Second, "how often to check whether `sqlfs maintenance` made the file system read-only (0 disables the check)"),
+		maxStatements:   c.flags.Int("max-db-statements", 0, "maximum number of SQL statements run concurrently; others wait up to -db-queue-timeout (0 disables the limit)"),
+		queueTimeout:    c.flags.Duration("db-queue-timeout", 5*time.Second, "how long a SQL statement waits for one of -max-db-statements before failing"),
+		breakerFailures: c.flags.Int("db-breaker-failures", 20, "fail operations with EIO for -db-breaker-cooldown after this many consecutive SQL statements time out or lose their connection (0 disables the circuit breaker)"),
+		breakerCooldown: c.flags.Duration("db-breaker-cooldown", 10*time.Second, "how long operations fail fast once the circuit breaker opens"),
+		rateOps:         c.flags.Float64("rate-limit-ops", 0, "delay FUSE operations beyond this many per second (0 disables the limit)"),
+		rateUIDOps:      c.flags.Float64("rate-limit-uid-ops", 0, "delay the FUSE operations of each user beyond this many per second (0 disables the limit)"),
+		injectFaults:    c.flags.String("inject-faults", "", "TESTING ONLY: make SQL statements fail or slow down according to these comma-separated rules KIND:RATE[:PATTERN], e.g. serialization:0.1:UPSERT INTO data_blocks or latency=50ms:1 (see faults.go)"),
+		injectSeed:      c.flags.Int64("inject-seed", 1, "seed of the random choices of -inject-faults, so that a run can be replayed"),
+
+		fastLookup:   c.flags.Bool("fast-lookup", false, "prefetch whole directories into an entry cache on lookups"),
+		negativeTTL:  c.flags.Duration("negative-ttl", 0, "remember names found missing for this long, e.g. 1s, unless they are created through this mount (0 disables the cache)"),
+		batchCreates: c.flags.Duration("batch-creates", 0, "keep small new files in memory for up to this long, e.g. 10ms, and create them together in one transaction (speeds up extracting archives; 0 disables batching)"),
+		coalesce:     c.flags.Bool("coalesce-appends", false, "keep small writes at the end of files in memory until they fill a block, for up to 1s, so that logs written line by line take a transaction per block rather than per line"),
+		dirOrder:     c.flags.String("dir-order", "name", "order in which directories are listed: name or inode"),
+		prefetchAttr: c.flags.Bool("prefetch-attrs", false, "load the attributes of all entries of a directory when it is listed, so that stating them takes no further queries (helps rsync and ls -l)"),
+		indexContent: c.flags.Bool("index-content", false, "maintain the full-text index used by `sqlfs search` (see `sqlfs init -content-index`)"),
+		asOf:         c.flags.String("as-of", "", "mount a read-only view of the file system as of this time, e.g. '2024-01-01 00:00' or -1h (CockroachDB only)"),
+		objectStore:  c.flags.String("object-store", "", "object store holding the files moved by `sqlfs tier`, e.g. s3://bucket/prefix, instead of the one it recorded"),
+		writeLeases:  c.flags.Bool("write-leases", false, "take a lease on each file before writing to it, so that mounts of the file system on several hosts take turns (see -lease-ttl)"),
+		exclusive:    c.flags.Bool("exclusive", false, "refuse to mount if another mount holds the file system with -exclusive, and make later read-write mounts fail until this one exits"),
+		gcInterval:   c.flags.Duration("gc-interval", 0, "remove orphaned inodes and data blocks this often, on the one mount elected leader among those sharing the file system (0 disables background garbage collection)"),
+		scrubEvery:   c.flags.Duration("scrub-interval", 0, "verify the checksums of all data blocks this often, on the mount elected leader, as `sqlfs scrub` does (0 disables background scrubbing)"),
+		scrubRate:    c.flags.Float64("scrub-rate", 100, "number of data blocks verified per second by -scrub-interval"),
+		scrubReplica: c.flags.String("scrub-replica", "", "URL of a secondary database kept up to date by `sqlfs replicate`, from which -scrub-interval repairs damaged blocks"),
+		leaseTTL:     c.flags.Duration("lease-ttl", 15*time.Second, "how long the write lease of a file, the -exclusive lease or the leadership of -gc-interval outlives a mount that stopped renewing it"),
+		journal:      c.flags.Bool("journal", false, "record every mutating operation in the ops_log table (see `sqlfs init -journal`)"),
+		directIO:     c.flags.Bool("direct-io", false, "bypass the kernel page cache, so that reads see the writes of other mounts right away (slower, and breaks shared mmap on older kernels)"),
+		secLabel:     c.flags.String("security-label", "", "SELinux context reported for every file instead of the stored security.selinux attributes, e.g. system_u:object_r:httpd_sys_content_t:s0"),
+		noAppleDbl:   c.flags.Bool("no-apple-double", false, "hide AppleDouble (._*) files and refuse to create them, keeping resource forks and Finder info in extended attributes"),
+		noStatusDir:  c.flags.Bool("no-status-dir", false, "do not expose the read-only "+store.StatusDirName+" status directory at the root of the mount"),
+		noQueryFile:  c.flags.Bool("no-query-file", false, "do not expose the "+store.QueryFileName+" file at the root of the mount, which searches the tree with the predicates of `sqlfs find`"),
+		noSnapshots:  c.flags.Bool("no-snapshots-dir", false, "do not expose the snapshots taken with `sqlfs snapshot` in a read-only "+store.SnapshotsDirName+" directory at the root of the mount"),
+		verifySums:   c.flags.Bool("verify-checksums", true, "fail reads of data blocks that do not match their checksum with EIO (see `sqlfs init -checksums`); disable to copy what is left of damaged files"),
+		idMapFile:    c.flags.String("id-map-file", "", "file of ID mappings, with lines such as `u 1000 2000 1` (see -map-uid)"),
+		maxNameLen:   c.flags.Int("max-name-len", store.DefaultMaxNameLen, "longest file name accepted, in bytes"),
+		maxPathLen:   c.flags.Int("max-path-len", 0, fmt.Sprintf("longest path accepted when creating or renaming, in bytes, e.g. %d (0 disables the check, which costs a query)", store.DefaultMaxPathLen)),
+		readahead:    c.flags.Int("readahead-blocks", 64, "number of blocks to prefetch for sequential reads (0 disables readahead)"),
+		warmPaths:    c.flags.String("warm-paths", "", "comma-separated paths of the mount, e.g. /etc,/usr/lib, whose attributes are preloaded after mounting and whose files fill the block cache (see -block-cache-size), so that a known hot set starts warm"),
+		heatMap:      c.flags.String("heat-map", "", "file recording the files and directories the mount accesses most, which the next mount with this flag preloads like -warm-paths"),
+		warmAttrTTL:  c.flags.Duration("warm-attr-ttl", time.Minute, "how long attributes preloaded by -warm-paths or -heat-map are kept, unless they change through this mount"),
+
+		allowOther:         c.flags.Bool("allow-other", false, "allow other users to access the file system"),
+		allowRoot:          c.flags.Bool("allow-root", false, "allow root to access the file system"),
+		defaultPermissions: c.flags.Bool("default-permissions", false, "let the kernel enforce access control based on file modes"),
+		asyncRead:          c.flags.Bool("async-read", false, "allow multiple outstanding read requests for the same handle"),
+		writebackCache:     c.flags.Bool("writeback-cache", false, "let the kernel buffer small writes in its page cache and send them in larger batches"),
+	}
+	f.maxReadahead = 1 << 20
+	c.flags.Var(&f.maxReadahead, "max-readahead", "maximum number of bytes the kernel may prefetch for sequential reads, capped by the kernel (0 disables kernel readahead)")
+	c.flags.Var(&f.uids, "map-uid", "present the stored user IDs STORED:LOCAL[:COUNT] as other IDs, and store them back on chown and create (repeatable)")
+	c.flags.Var(&f.gids, "map-gid", "same as -map-uid for group IDs")
+	c.flags.Var(&f.fileMode, "default-file-mode", "permissions of the files created through the mount, e.g. 0640, instead of the ones requested")
+	c.flags.Var(&f.dirMode, "default-dir-mode", "permissions of the directories created through the mount, e.g. 0750, instead of the ones requested")
+	c.flags.Var(&f.umask, "umask", "permission bits to clear from every file and directory created through the mount, e.g. 027")
+	c.flags.Var(&f.blockCache, "block-cache-size", "memory budget of the shared data block cache, e.g. 64M (0 disables the cache)")
+	c.flags.Var(&f.rateBytes, "rate-limit-bytes", "delay reads and writes beyond this many bytes per second, e.g. 50M (0 disables the limit)")
+	c.flags.Var(&f.asyncWrites, "async-writes", "commit writes in the background, queuing up to this much data, e.g. 64M (0 commits each write before returning)")
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if *f.daemon && !isDaemonChild() {
+			return startDaemon(*f.logFile)
+		}
+		err := runMount(f, args[0])
+		if err != nil {
+			// No-op if the parent was already notified.
+			notifyDaemonParent(err)
+		}
+		return err
+	}
+	return c
+}
+
+// fsOptions returns the options of the file system selected through
+// flags, except those that need the database.
+func (f *mountFlags) fsOptions() ([]store.Option, error) {
+	if *f.allowOther && *f.allowRoot {
+		return nil, fuse.ErrCannotCombineAllowOtherAndAllowRoot
+	}
+	if err := f.checkPlatform(); err != nil {
+		return nil, err
+	}
+	opts := []store.Option{
+		store.WithSubdir(*f.subdir),
+		store.WithAtimeMode(*f.atimeMode),
+		store.WithDirOrder(*f.dirOrder),
+		store.WithReadahead(*f.readahead),
+		store.WithMaxNameLen(*f.maxNameLen),
+		store.WithMaxPathLen(*f.maxPathLen),
+		store.WithQuiesceTimeout(*f.shutdownTimeout),
+		store.WithOpTimeout(*f.opTimeout),
+		store.WithNegativeCache(*f.negativeTTL),
+		store.WithCreateBatching(*f.batchCreates),
+		store.WithBlockCache(int64(f.blockCache)),
+		store.WithRateLimits(*f.rateOps, int64(f.rateBytes), *f.rateUIDOps),
+		store.WithWarmAttrTTL(*f.warmAttrTTL),
+	}
+	if *f.asOf != "" {
+		if *f.journal || *f.indexContent {
+			return nil, errors.New("-journal and -index-content cannot be used with -as-of")
+		}
+		// Historical views are read-only.
+		opts = append(opts, store.WithReadOnly())
+	} else {
+		// Historical views cannot change, nor have snapshots of their own.
+		if *f.maintenancePoll > 0 {
+			opts = append(opts, store.WithMaintenancePoll(*f.maintenancePoll))
+		}
+		if !*f.noSnapshots {
+			opts = append(opts, store.WithSnapshotsDir(*f.db))
+		}
+	}
+	if !*f.noStatusDir {
+		opts = append(opts, store.WithStatusDir())
+	}
+	if !*f.noQueryFile {
+		opts = append(opts, store.WithQueryFile())
+	}
+	if *f.fastLookup {
+		opts = append(opts, store.WithFastLookup())
+	}
+	if *f.prefetchAttr {
+		opts = append(opts, store.WithAttrPrefetch())
+	}
+	if *f.coalesce {
+		if f.asyncWrites > 0 {
+			return nil, errors.New("-coalesce-appends cannot be used with -async-writes, which already merges appends")
+		}
+		opts = append(opts, store.WithAppendCoalescing())
+	}
+	if f.asyncWrites > 0 {
+		opts = append(opts, store.WithAsyncWrites(int64(f.asyncWrites)))
+	}
+	if *f.directIO {
+		if *f.writebackCache {
+			return nil, errors.New("-writeback-cache cannot be used with -direct-io")
+		}
+		opts = append(opts, store.WithDirectIO())
+	}
+	if *f.secLabel != "" {
+		opts = append(opts, store.WithSecurityLabel(*f.secLabel))
+	}
+	if *f.noAppleDbl {
+		opts = append(opts, store.WithoutAppleDouble())
+	}
+	if !*f.verifySums {
+		opts = append(opts, store.WithoutChecksumVerification())
+	}
+	if *f.idMapFile != "" {
+		opts = append(opts, store.WithIDMapFile(*f.idMapFile))
+	}
+	if len(f.uids) > 0 {
+		opts = append(opts, store.WithUIDMap(f.uids.String()))
+	}
+	if len(f.gids) > 0 {
+		opts = append(opts, store.WithGIDMap(f.gids.String()))
+	}
+	if mode, ok := f.fileMode.Value(); ok {
+		opts = append(opts, store.WithFileMode(mode))
+	}
+	if mode, ok := f.dirMode.Value(); ok {
+		opts = append(opts, store.WithDirMode(mode))
+	}
+	if mode, ok := f.umask.Value(); ok {
+		opts = append(opts, store.WithUmask(mode))
+	}
+	if *f.warmPaths != "" {
+		paths, err := parseWarmPaths(*f.warmPaths)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, store.WithWarmPaths(paths...))
+	}
+	if *f.heatMap != "" {
+		opts = append(opts, store.WithHeatMap(*f.heatMap))
+	}
+	if *f.objectStore != "" {
+		opts = append(opts, store.WithObjectStore(*f.objectStore))
+	}
+	if *f.journal {
+		opts = append(opts, store.WithJournal())
+	}
+	if *f.indexContent {
+		opts = append(opts, store.WithContentIndex())
+	}
+	if *f.writeLeases {
+		opts = append(opts, store.WithWriteLeases())
+	}
+	if *f.exclusive {
+		opts = append(opts, store.WithExclusive())
+	}
+	if *f.writeLeases || *f.exclusive || *f.gcInterval > 0 || *f.scrubEvery > 0 {
+		if *f.leaseTTL <= 0 {
+			return nil, errors.New("-lease-ttl must be positive")
+		}
+		opts = append(opts, store.WithLeaseTTL(*f.leaseTTL))
+	}
+	if *f.gcInterval > 0 {
+		opts = append(opts, store.WithBackgroundGC(*f.gcInterval))
+	}
+	if *f.scrubEvery > 0 {
+		if *f.scrubRate <= 0 {
+			return nil, errors.New("-scrub-rate must be positive")
+		}
+		// The replica is added once opened.
+		if *f.scrubReplica == "" {
+			opts = append(opts, store.WithBackgroundScrub(*f.scrubEvery, *f.scrubRate, nil))
+		}
+	}
+
+	var options []fuse.MountOption
+	if *f.allowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if *f.allowRoot {
+		options = append(options, fuse.AllowRoot()) // FreeBSD ignores this.
+	}
+	if *f.defaultPermissions {
+		options = append(options, fuse.DefaultPermissions()) // FreeBSD ignores this.
+	}
+	// The kernel prefetches nothing unless a maximum is negotiated. Writes
+	// are always accepted up to the largest size the FUSE library supports
+	// (128K on Linux), so that the kernel sends as few of them as possible.
+	if f.maxReadahead > 0 {
+		options = append(options, fuse.MaxReadahead(uint32(f.maxReadahead)))
+	}
+	if *f.asyncRead {
+		options = append(options, fuse.AsyncRead())
+	}
+	if *f.writebackCache {
+		options = append(options, fuse.WritebackCache())
+	}
+	return append(opts, store.WithMountOptions(options...)), nil
+}
+
+// Reference: https://github.com/bazil/fuse/blob/master/examples/hellofs/hello.go
+func runMount(f *mountFlags, mountpoint string) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	opts, err := f.fsOptions()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errUsage
+	}
+
+	var connector driver.Connector
+	if *f.asOf != "" {
+		connector, err = store.NewHistoricalConnector(*f.db, *f.asOf)
+	} else {
+		connector, err = dbConnector(*f.db)
+	}
+	if err != nil {
+		return err
+	}
+	if *f.injectFaults != "" {
+		faults, err := store.ParseFaultRules(*f.injectFaults, *f.injectSeed)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return errUsage
+		}
+		log.Printf("WARNING: injecting faults into SQL statements (%s).\n", *f.injectFaults)
+		// Under the budget, so that injected failures count towards the
+		// circuit breaker.
+		connector = &store.FaultConnector{Connector: connector, Faults: faults}
+		opts = append(opts, store.WithFaultInjector(faults))
+	}
+	budget := store.NewQueryBudget(*f.maxStatements, *f.queueTimeout, *f.breakerFailures, *f.breakerCooldown)
+	opts = append(opts, store.WithQueryBudget(budget))
+	db, err := store.OpenFileSystem(&store.BudgetConnector{Connector: connector, Budget: budget})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.CheckWritableFormat(); err != nil {
+		log.Printf("%s, mounting read-only.\n", err)
+	}
+	// Historical views cannot be damaged further.
+	if *f.asOf == "" && !*f.skipCheck {
+		warnings, err := store.QuickCheck(context.Background(), db)
+		if err != nil {
+			return errors.Errorf("the file system appears damaged (%s), refusing to mount; "+
+				"run `sqlfs fsck`, or mount with -skip-check", err)
+		}
+		for _, w := range warnings {
+			log.Printf("WARNING: the file system may be damaged: %s. Run `sqlfs fsck` to check it.\n", w)
+		}
+	}
+	if *f.scrubEvery > 0 && *f.scrubReplica != "" {
+		replica, err := openDB(*f.scrubReplica)
+		if err != nil {
+			return err
+		}
+		defer replica.Close()
+		opts = append(opts, store.WithBackgroundScrub(*f.scrubEvery, *f.scrubRate, replica.DB))
+	}
+
+	fsys, err := store.New(db.DB, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fsys.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	// Unmount requests from the control socket, with their reason.
+	stopCh := make(chan string, 1)
+	go func() {
+		for {
+			var reason string
+			select {
+			case sig := <-sigCh:
+				reason = sig.String()
+			case reason = <-stopCh:
+			}
+			log.Printf("Received %s, unmounting...\n", reason)
+			if err := sdNotify("STOPPING=1"); err != nil {
+				log.Println(err)
+			}
+			if err := fsys.Unmount(mountpoint, *f.shutdownTimeout); err != nil {
+				log.Println(err)
+			} else {
+				log.Println("Unmounting completed.")
+				return
+			}
+		}
+	}()
+	// Set while the file system is mounted, which it is not between losing
+	// the FUSE connection and remounting.
+	var live int32
+	if *f.adminAddr != "" || *f.ctlSocket != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mounted := func() bool { return atomic.LoadInt32(&live) != 0 }
+		admin := store.NewAdminServer(fsys, mountpoint, mounted, func() {
+			select {
+			case stopCh <- "unmount request":
+			default: // Already unmounting.
+			}
+		})
+		if *f.adminAddr != "" {
+			l, err := listenAdmin(*f.adminAddr)
+			if err != nil {
+				return err
+			}
+			go admin.Serve(ctx, l)
+		}
+		if *f.ctlSocket != "" {
+			l, err := listenControlSocket(*f.ctlSocket)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(*f.ctlSocket)
+			go admin.Serve(ctx, l)
+		}
+	}
+
+	// Set once the file system has been mounted for the first time.
+	var mounted int32
+	onReady := func(mountErr error) {
+		if mountErr == nil {
+			atomic.StoreInt32(&live, 1)
+			// Tells systemd that the service is up, or that it remounted.
+			if err := sdNotify("READY=1\nSTATUS=Mounted at " + mountpoint); err != nil {
+				log.Println(err)
+			}
+		}
+		if mountErr != nil || !atomic.CompareAndSwapInt32(&mounted, 0, 1) {
+			notifyDaemonParent(mountErr)
+			return
+		}
+		if *f.pidfile != "" {
+			if err := writePidfile(*f.pidfile); err != nil {
+				log.Printf("failed to write pidfile: %s\n", err)
+			}
+		}
+		notifyDaemonParent(nil)
+	}
+	if *f.pidfile != "" {
+		defer os.Remove(*f.pidfile)
+	}
+
+	for {
+		err := fsys.Serve(mountpoint, onReady)
+		atomic.StoreInt32(&live, 0)
+		if *f.noAutoRemount || atomic.LoadInt32(&mounted) == 0 || fsys.Draining() ||
+			!connectionLost(mountpoint, err) {
+			return err
+		}
+		log.Printf("Lost the FUSE connection (%v), remounting...\n", err)
+		if err := sdNotify("STATUS=Lost the FUSE connection, remounting"); err != nil {
+			log.Println(err)
+		}
+		if err := waitForRemount(mountpoint, fsys); err != nil {
+			return err
+		}
+		if fsys.Draining() {
+			return nil
+		}
+	}
+}
+
+// parseWarmPaths parses the comma-separated paths of `sqlfs mount
+// -warm-paths`, relative to the mount root.
+func parseWarmPaths(value string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			return nil, errors.Errorf("invalid warm paths %q", value)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newPolicyCommand() *command {
+	c := newCommand("policy", "PATH", "Print or set the storage policy of a directory, inherited by its subtree.")
+	db := dbFlag(c.flags)
+	set := c.flags.String("set", "", "replace the policy of the directory, e.g. compress=zstd,tier=s3,replicate=us-west1")
+	clearPolicy := c.flags.Bool("clear", false, "remove the policy of the directory, so that it inherits that of its parent")
+	apply := c.flags.Bool("apply", false, "move the data blocks of the files below PATH to the region of their replicate policy (multi-region CockroachDB only)")
+	c.run = func(args []string) error {
+		if len(args) != 1 || *set != "" && *clearPolicy {
+			return errUsage
+		}
+		var p store.StoragePolicy
+		if *set != "" {
+			var err error
+			if p, err = store.ParsePolicy(*set); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return errUsage
+			}
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if *set != "" || *clearPolicy || *apply {
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+		}
+		if !conn.XattrsEnabled {
+			return errors.New("the database has no xattrs table, run `sqlfs init` first")
+		}
+
+		ctx := context.Background()
+		n, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		if (*set != "" || *clearPolicy) && !n.IsDirectory() {
+			return errors.Errorf("%s is not a directory", args[0])
+		}
+		if *set != "" || *clearPolicy {
+			if err := store.PutPolicy(ctx, conn, n.Inode, p); err != nil {
+				return err
+			}
+		}
+
+		effective, err := store.EffectivePolicy(ctx, conn, n.Inode)
+		if err != nil {
+			return err
+		}
+		if !*apply {
+			own, err := store.GetPolicy(ctx, conn, n.Inode)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("policy: %s\neffective: %s\n", own, effective)
+			return nil
+		}
+		if !n.IsDirectory() {
+			moved, err := applyPolicy(ctx, conn, n, effective)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Moved %d block(s).\n", moved)
+			return nil
+		}
+
+		// The policy of each directory, keyed by its path below PATH.
+		policies := map[string]store.StoragePolicy{".": effective}
+		var moved int64
+		err = store.WalkTree(ctx, conn, n, ".", func(p string, child *store.FileNode) error {
+			inherited := policies[path.Dir(p)]
+			if child.IsDirectory() {
+				own, err := store.GetPolicy(ctx, conn, child.Inode)
+				if err != nil {
+					return err
+				}
+				policies[p] = inherited.Inherit(own)
+				return nil
+			}
+			count, err := applyPolicy(ctx, conn, child, inherited)
+			moved += count
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved %d block(s).\n", moved)
+		return nil
+	}
+	return c
+}
+
+// applyPolicy homes the blocks of the regular file `n` in the region of the
+// policy `p`, if any, and returns the number of blocks moved.
+func applyPolicy(ctx context.Context, db *store.DB, n *store.FileNode, p store.StoragePolicy) (int64, error) {
+	region, ok := p["replicate"]
+	if !ok || !n.IsRegular() {
+		return 0, nil
+	}
+	return store.SetBlockRegion(ctx, db, n.Inode, region)
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newReplicateCommand() *command {
+	c := newCommand("replicate", "", "Continuously copy the file system to a standby database, using a CockroachDB changefeed.")
+	db := dbFlag(c.flags)
+	to := c.flags.String("to", "", "connection URL of the secondary database")
+	cursorFile := c.flags.String("cursor-file", "", "file recording the last replicated timestamp, to resume after a restart")
+	c.run = func(args []string) error {
+		if len(args) != 0 || *to == "" {
+			return errUsage
+		}
+		src, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := openDB(*to)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigCh
+			log.Println("Stopping replication...")
+			cancel()
+		}()
+
+		r, err := store.NewReplicator(ctx, src, dst)
+		if err != nil {
+			return err
+		}
+		var cursor string
+		if *cursorFile != "" {
+			data, err := ioutil.ReadFile(*cursorFile)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			cursor = strings.TrimSpace(string(data))
+		}
+		if cursor == "" {
+			log.Println("Copying all rows, then following changes...")
+		} else {
+			log.Printf("Resuming replication after %s...\n", cursor)
+		}
+
+		return r.Run(ctx, cursor, store.LogResolved(func(ts string) error {
+			if *cursorFile == "" {
+				return nil
+			}
+			return ioutil.WriteFile(*cursorFile, []byte(ts+"\n"), 0644)
+		}))
+	}
+	return c
+}
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newRmCommand() *command {
+	c := newCommand("rm", "PATH", "Remove a file or directory directly from the database.")
+	db := dbFlag(c.flags)
+	recursive := c.flags.Bool("r", false, "remove directories and their contents recursively")
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.CheckWritableFormat(); err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		n, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		if n.Inode == store.RootInode {
+			fmt.Fprintln(os.Stderr, "refusing to remove the root directory")
+			return errUsage
+		}
+		if n.IsDirectory() && !*recursive {
+			count, err := store.CountNodesInDir(ctx, conn, n.Inode)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return errors.Errorf("%s is a non-empty directory, use -r to remove it", args[0])
+			}
+		}
+
+		removed, err := store.RemoveTree(ctx, conn, n.Parent, n.Name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d entries.\n", removed)
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+// newScrubCommand verifies the checksums of all data blocks, a batch at a
+// time, so that blocks damaged at rest are found before they are read.
+func newScrubCommand() *command {
+	c := newCommand("scrub", "", "Verify the checksums of all data blocks and report the damaged ones.")
+	db := dbFlag(c.flags)
+	batchSize := c.flags.Int("batch-size", 1000, "number of blocks read per query")
+	pause := c.flags.Duration("pause", 0, "how long to wait between batches, to limit the load on the database")
+	c.run = func(args []string) error {
+		if len(args) != 0 || *batchSize <= 0 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if !conn.BlockChecksums {
+			return errors.New("the data blocks have no checksums, run `sqlfs init -checksums` first")
+		}
+
+		ctx := context.Background()
+		var after store.BlockKey
+		var damaged int
+		for {
+			corrupt, last, _, err := store.ScrubBlocks(ctx, conn, after, *batchSize)
+			if err != nil {
+				return err
+			}
+			for _, b := range corrupt {
+				p, err := store.NodePath(ctx, conn, b.Inode)
+				if err == sql.ErrNoRows {
+					p = "(unlinked)"
+				} else if err != nil {
+					return err
+				}
+				fmt.Printf("%s: block %d of inode %d is damaged\n", p, b.Index, b.Inode)
+			}
+			damaged += len(corrupt)
+			if last == (store.BlockKey{}) {
+				break
+			}
+			after = last
+			time.Sleep(*pause)
+		}
+		if damaged > 0 {
+			return errors.Errorf("%d damaged block(s) found", damaged)
+		}
+		fmt.Println("Verified all blocks, none damaged.")
+		return nil
+	}
+	return c
+}
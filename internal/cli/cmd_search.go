@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newSearchCommand() *command {
+	c := newCommand("search", "QUERY", "Search file contents using the full-text index.")
+	db := dbFlag(c.flags)
+	limit := c.flags.Int("limit", 100, "maximum number of results")
+	rebuild := c.flags.Bool("reindex", false, "rebuild the index from all files before searching")
+	c.run = func(args []string) error {
+		if len(args) == 0 || *limit <= 0 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		if *rebuild {
+			var inodes []uint64
+			err := store.ListAllNodes(ctx, conn, func(n *store.FileNode) error {
+				if n.IsRegular() {
+					inodes = append(inodes, n.Inode)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, inode := range inodes {
+				if err := store.IndexContent(ctx, conn, inode); err != nil {
+					return err
+				}
+			}
+		}
+
+		results, err := store.SearchContent(ctx, conn, strings.Join(args, " "), *limit)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			fmt.Println(r.Path)
+		}
+		return nil
+	}
+	return c
+}
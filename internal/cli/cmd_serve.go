@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newServeCommand() *command {
+	c := newCommand("serve", "PROTOCOL", "Serve the file system without FUSE. PROTOCOL is sftp, nfs, 9p or http.")
+	db := dbFlag(c.flags)
+	subdir := c.flags.String("subdir", "/", "path of the directory in the tree to expose as the root")
+	listen := c.flags.String("listen", "", "address to listen on, or unix:PATH for a Unix socket (default localhost:2049 for nfs, localhost:564 for 9p, localhost:8080 for http)")
+	index := c.flags.Bool("index", false, "list the entries of directories over http")
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if args[0] != "http" {
+			// The other protocols let clients write.
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+		}
+
+		root, err := store.ResolvePath(context.Background(), conn, *subdir)
+		if err != nil {
+			return err
+		}
+		if !root.IsDirectory() {
+			return fmt.Errorf("%s is not a directory", *subdir)
+		}
+
+		switch args[0] {
+		case "sftp":
+			// Speaks SFTP on stdin and stdout. OpenSSH runs this as a
+			// subsystem and handles authentication.
+			return store.NewSFTPServer(conn, *subdir, os.Stdin, os.Stdout).Serve()
+		case "nfs":
+			// Clients are trusted, so only listen on trusted networks.
+			l, err := listenOn(*listen, "localhost:2049")
+			if err != nil {
+				return err
+			}
+			log.Printf("Serving NFS on %s\n", l.Addr())
+			return store.NewNFSServer(conn, root, *subdir).Serve(l)
+		case "9p":
+			l, err := listenOn(*listen, "localhost:564")
+			if err != nil {
+				return err
+			}
+			log.Printf("Serving 9P2000.L on %s\n", l.Addr())
+			return store.NewP9Server(conn, root).Serve(l)
+		case "http":
+			l, err := listenOn(*listen, "localhost:8080")
+			if err != nil {
+				return err
+			}
+			log.Printf("Serving HTTP on %s\n", l.Addr())
+			return http.Serve(l, store.NewHTTPServer(conn, root, *index))
+		}
+		fmt.Fprintf(os.Stderr, "unknown protocol %q\n", args[0])
+		return errUsage
+	}
+	return c
+}
+
+// listenOn listens on `addr`, or on `def` if it is empty. Addresses of the
+// form unix:PATH refer to Unix sockets.
+func listenOn(addr, def string) (net.Listener, error) {
+	if addr == "" {
+		addr = def
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenControlSocket listens on the Unix socket `path`, which only the
+// current user may connect to. A stale socket left by a previous process is
+// replaced, but not one that a running process still listens on.
+func listenControlSocket(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			_ = conn.Close()
+			return nil, errors.Errorf("%s is in use by another process", path)
+		}
+		if !connRefused(err) {
+			return nil, err
+		}
+		_ = os.Remove(path)
+	}
+	// The socket is created with the permissions left by the umask, so
+	// that no one else can connect before it is chmod'ed below either.
+	mask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// listenAdmin listens on `addr` for the admin API. The API has no
+// authentication, so only loopback addresses and Unix sockets, which only
+// the current user may connect to, are accepted.
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return listenControlSocket(strings.TrimPrefix(addr, "unix:"))
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.Errorf("the admin API has no authentication, listen on a loopback address or unix:PATH instead of %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// connRefused returns true if `err`, returned by net.Dial, reports that no
+// one listens on the address.
+func connRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
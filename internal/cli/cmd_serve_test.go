@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl")
+	l, err := listenControlSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket has permissions %o, want 600", perm)
+	}
+
+	// The socket of a running process is not taken over.
+	if l2, err := listenControlSocket(path); err == nil {
+		l2.Close()
+		t.Error("listened on the socket of a running listener")
+	}
+
+	// That of a process that exited is.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenControlSocket(path)
+	if err != nil {
+		t.Fatalf("failed to replace a stale socket: %v", err)
+	}
+	l.Close()
+}
+
+func TestListenAdmin(t *testing.T) {
+	for _, addr := range []string{":7070", "0.0.0.0:7070", "10.1.2.3:7070", "example.com:7070"} {
+		if l, err := listenAdmin(addr); err == nil {
+			l.Close()
+			t.Errorf("listened on %s", addr)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:0", "localhost:0", "unix:" + filepath.Join(t.TempDir(), "admin")} {
+		l, err := listenAdmin(addr)
+		if err != nil {
+			t.Errorf("failed to listen on %s: %v", addr, err)
+			continue
+		}
+		l.Close()
+	}
+}
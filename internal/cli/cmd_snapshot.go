@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+// newSnapshotCommand manages the snapshots read through the .snapshots
+// directory of mounts (see snapshotdir.go).
+func newSnapshotCommand() *command {
+	c := newCommand("snapshot", "[create NAME|rm NAME]", "List the snapshots of the file system, take one or forget one.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) != 0 && len(args) != 2 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		ok, err := store.TableExists(ctx, conn, "snapshots")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("the database has no snapshots table, run `sqlfs init -snapshots` first")
+		}
+		if len(args) == 2 {
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+			switch args[0] {
+			case "create":
+				s, err := store.CreateSnapshot(ctx, conn, args[1])
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Created snapshot %s at %s, readable until %s unless gc.ttlseconds is raised.\n",
+					s.Name, s.TakenAt, s.Expires.Local().Format(time.RFC3339))
+			case "rm":
+				err := store.RemoveSnapshot(ctx, conn, args[1])
+				if err == sql.ErrNoRows {
+					return errors.Errorf("no snapshot named %q", args[1])
+				}
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Removed snapshot %s.\n", args[1])
+			default:
+				return errUsage
+			}
+			return nil
+		}
+
+		snapshots, err := store.ListSnapshots(ctx, conn)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, s := range snapshots {
+			expiry := "expires " + s.Expires.Local().Format(time.RFC3339)
+			if s.Expired(now) {
+				expiry = "EXPIRED " + s.Expires.Local().Format(time.RFC3339)
+			}
+			fmt.Printf("%s %s %s (%s)\n", s.Created.Local().Format(time.RFC3339), s.TakenAt, s.Name, expiry)
+		}
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newStatCommand() *command {
+	c := newCommand("stat", "PATH", "Print the metadata of a file or directory.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		n, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		blocks, err := store.CountNodeBlocks(ctx, conn, n.Inode)
+		if err != nil {
+			return err
+		}
+
+		name := args[0]
+		if n.IsSymlink() {
+			name += " -> " + n.SymlinkTarget
+		}
+		fmt.Printf("  File: %s\n", name)
+		fmt.Printf("  Size: %-10d Blocks: %-6d Block size: %d\n", n.Size, blocks, conn.BlockSize)
+		fmt.Printf(" Inode: %-10d Links: %-6d Generation: %d\n", n.Inode, n.Nlink, n.Generation)
+		fmt.Printf("Access: %s  Uid: %d  Gid: %d\n", n.Mode, n.Uid, n.Gid)
+		fmt.Printf(" Flags: %s\n", store.FormatFlags(n.Flags))
+		fmt.Printf("Access: %s\n", formatTime(n.Atime))
+		fmt.Printf("Modify: %s\n", formatTime(n.Mtime))
+		fmt.Printf("Change: %s\n", formatTime(n.Ctime))
+		fmt.Printf(" Birth: %s\n", formatTime(n.Crtime))
+		if n.IsRegular() {
+			sum, err := store.FileHash(ctx, conn, n.Inode)
+			switch err {
+			case nil:
+				fmt.Printf("SHA256: %x\n", sum)
+			case store.ErrHashUnavailable:
+				fmt.Println("SHA256: - (tiered)")
+			default:
+				return err
+			}
+		}
+		return nil
+	}
+	return c
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05.000000000 -0700")
+}
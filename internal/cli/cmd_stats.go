@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newStatsCommand() *command {
+	c := newCommand("stats", "", "Print usage statistics of the file system.")
+	db := dbFlag(c.flags)
+	c.run = func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		sb, err := store.GetSuperblock(ctx, conn)
+		if err != nil {
+			return err
+		}
+		entries, err := store.CountTreeEntries(ctx, conn)
+		if err != nil {
+			return err
+		}
+		inodes, err := store.CountInodes(ctx, conn)
+		if err != nil {
+			return err
+		}
+		blocks, err := store.CountDataBlocks(ctx, conn)
+		if err != nil {
+			return err
+		}
+		bytes, err := store.SumDataBytes(ctx, conn)
+		if err != nil {
+			return err
+		}
+		shards, err := store.GetBlockShards(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		var files, dirs, symlinks, others int
+		err = store.ListAllNodes(ctx, conn, func(n *store.FileNode) error {
+			switch {
+			case n.IsRegular():
+				files++
+			case n.IsDirectory():
+				dirs++
+			case n.IsSymlink():
+				symlinks++
+			default:
+				others++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if sb != nil {
+			fmt.Printf("UUID:         %s\n", sb.UUID)
+			fmt.Printf("Created:      %s\n", sb.Created.Local().Format(time.RFC3339))
+			fmt.Printf("Schema:       version %d\n", sb.SchemaVersion)
+			fmt.Printf("Features:     compat %s, ro-compat %s, incompat %s\n", store.FormatFeatures(sb.Compat, nil),
+				store.FormatFeatures(sb.ROCompat, nil), store.FormatFeatures(sb.Incompat, store.IncompatFeatureNames))
+		}
+		fmt.Printf("Entries:      %d\n", entries)
+		fmt.Printf("Inodes:       %d\n", inodes)
+		fmt.Printf("  Files:      %d\n", files)
+		fmt.Printf("  Dirs:       %d\n", dirs)
+		fmt.Printf("  Symlinks:   %d\n", symlinks)
+		fmt.Printf("  Other:      %d\n", others)
+		fmt.Printf("Data blocks:  %d (block size %d)\n", blocks, conn.BlockSize)
+		if shards > 0 {
+			fmt.Printf("Block shards: %d\n", shards)
+		}
+		fmt.Printf("Data bytes:   %d\n", bytes)
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+func newSyncCommand() *command {
+	c := newCommand("sync", "LOCALDIR FSPATH", "Make a directory of the file system match a local directory, writing only the blocks that differ.")
+	db := dbFlag(c.flags)
+	prune := c.flags.Bool("delete", false, "remove the files and directories below FSPATH that are not in LOCALDIR")
+	checksum := c.flags.Bool("checksum", false, "compare the SHA-256 of files whose size and modification time match, instead of skipping them")
+	dryRun := c.flags.Bool("dry-run", false, "only count what would be created, updated and removed")
+	c.run = func(args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		fi, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return errors.Errorf("%s is not a directory", args[0])
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if !*dryRun {
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+		}
+
+		ctx := context.Background()
+		dest, err := store.ResolvePath(ctx, conn, args[1])
+		if err != nil {
+			return err
+		}
+		if !dest.IsDirectory() {
+			return errors.Errorf("%s is not a directory", args[1])
+		}
+		s, err := store.NewSyncer(ctx, conn, dest.Inode, *dryRun, *checksum)
+		if err != nil {
+			return err
+		}
+		if err := s.SyncDir(args[0]); err != nil {
+			return err
+		}
+		if *prune {
+			if err := s.Prune(); err != nil {
+				return err
+			}
+		}
+		st := s.Stats
+		fmt.Printf("Created %d, updated %d (%d block(s) written), removed %d, %d unchanged.\n",
+			st.Created, st.Updated, st.Blocks, st.Removed, st.Unchanged)
+		return nil
+	}
+	return c
+}
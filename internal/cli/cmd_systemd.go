@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+)
+
+// Name under which the binary runs as a systemd generator, when linked into
+// /etc/systemd/system-generators.
+const systemdGeneratorName = "sqlfs-systemd-generator"
+
+func newSystemdGeneratorCommand() *command {
+	c := newCommand("systemd-generator", "DIR [EARLY_DIR LATE_DIR]",
+		"Write a systemd service for each entry of the mount table, started at boot.")
+	table := c.flags.String("mounts", defaultMountTable, "mount table, with lines such as `/srv/data -db URL -allow-other`")
+	bin := c.flags.String("bin", "", "path of the sqlfs binary the services run (the running one if empty)")
+	c.run = func(args []string) error {
+		// systemd passes three directories to generators, and units belong
+		// in the first one.
+		if len(args) != 1 && len(args) != 3 {
+			return errUsage
+		}
+		entries, err := readMountTable(*table)
+		if os.IsNotExist(err) && len(args) == 3 {
+			return nil // Nothing to mount at boot.
+		}
+		if err != nil {
+			return err
+		}
+		if *bin == "" {
+			if *bin, err = os.Executable(); err != nil {
+				return err
+			}
+		}
+		if err := writeServiceUnits(*table, *bin, args[0], entries); err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			fmt.Printf("Wrote %d service(s) to %s, run `systemctl daemon-reload` to load them.\n", len(entries), args[0])
+		}
+		return nil
+	}
+	return c
+}
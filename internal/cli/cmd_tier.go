@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newTierCommand() *command {
+	c := newCommand("tier", "", "Move the contents of large files that are no longer modified to an object store.")
+	db := dbFlag(c.flags)
+	storeURL := c.flags.String("store", "", "object store, e.g. s3://bucket/prefix?endpoint=https://host or file:///dir, recorded for the readers of the file system (default: the recorded one)")
+	olderThan := c.flags.Duration("older-than", 24*time.Hour, "only move files not modified for this long")
+	dryRun := c.flags.Bool("dry-run", false, "only list the files that would be moved")
+	var minSize store.ByteSize = 64 << 20
+	c.flags.Var(&minSize, "min-size", "only move files of at least this size, e.g. 64M")
+	c.run = func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		ctx := context.Background()
+		if *storeURL == "" {
+			if *storeURL, err = store.GetSetting(ctx, conn, store.SettingTierStore); err != nil {
+				return err
+			}
+			if *storeURL == "" {
+				return errUsage
+			}
+		}
+		objects, err := store.OpenObjectStore(*storeURL)
+		if err != nil {
+			return err
+		}
+		if !*dryRun {
+			if err := conn.CheckWritableFormat(); err != nil {
+				return err
+			}
+			// Every reader of the file system finds the store in the
+			// settings.
+			if err := store.SetTierStore(ctx, conn, *storeURL); err != nil {
+				return err
+			}
+		}
+
+		// Objects of removed files are deleted first.
+		orphans, err := store.ListOrphanedObjects(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, t := range orphans {
+			if *dryRun {
+				fmt.Printf("would delete object %s of removed inode %d\n", t.Object, t.Inode)
+				continue
+			}
+			if err := store.RemoveTieredObject(ctx, conn, objects, t); err != nil {
+				return err
+			}
+		}
+
+		nodes, err := store.ListTierCandidates(ctx, conn, uint64(minSize), time.Now().Add(-*olderThan))
+		if err != nil {
+			return err
+		}
+		scheme := strings.SplitN(*storeURL, ":", 2)[0]
+		var moved uint64
+		var kept int
+		for _, n := range nodes {
+			policy, err := store.EffectivePolicy(ctx, conn, n.Inode)
+			if err != nil {
+				return err
+			}
+			if !policy.AllowsTier(scheme) {
+				kept++
+				continue
+			}
+			if *dryRun {
+				fmt.Printf("would move inode %d (%d bytes)\n", n.Inode, n.Size)
+				continue
+			}
+			if err := store.TierFile(ctx, conn, objects, n); err != nil {
+				return err
+			}
+			moved += n.Size
+		}
+		if !*dryRun {
+			fmt.Printf("Moved %d file(s), %d bytes, and deleted %d orphaned object(s).\n", len(nodes)-kept, moved, len(orphans))
+		}
+		if kept > 0 {
+			fmt.Printf("Kept %d file(s) in the database as their tier policy requires.\n", kept)
+		}
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+func newTreeCommand() *command {
+	c := newCommand("tree", "PATH", "List the contents of a directory recursively.")
+	db := dbFlag(c.flags)
+	maxDepth := c.flags.Int("L", 0, "maximum depth to descend (0 means no limit)")
+	c.run = func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		conn, err := openFileSystemDB(*db)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		ctx := context.Background()
+		dir, err := store.ResolvePath(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(args[0])
+		if !dir.IsDirectory() {
+			return nil
+		}
+		nodes, err := store.ListSubtree(ctx, conn, dir.Inode, *maxDepth)
+		if err != nil {
+			return err
+		}
+		var dirs, files int
+		for _, n := range nodes {
+			depth := strings.Count(n.Name, "/")
+			name := n.Name[strings.LastIndex(n.Name, "/")+1:]
+			if n.IsSymlink() {
+				name += " -> " + n.SymlinkTarget
+			}
+			if n.IsDirectory() {
+				dirs++
+			} else {
+				files++
+			}
+			fmt.Printf("%s%s\n", strings.Repeat("    ", depth+1), name)
+		}
+		fmt.Printf("\n%d directories, %d files\n", dirs, files)
+		return nil
+	}
+	return c
+}
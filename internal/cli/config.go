@@ -0,0 +1,311 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Default path of the configuration file, read if it exists.
+const defaultConfigPath = "/etc/sqlfs/config.yaml"
+
+// The configuration file gives default values to the flags of every
+// command, so that deployments do not need long command lines. It is
+// written in a subset of YAML: keys are the names of flags, top-level ones
+// apply to every command having that flag, and those of the profile picked
+// with -profile override them. Flags that can be repeated take a list:
+//
+//	db: postgres://sqlfs@db:26257/sqlfs?sslmode=verify-full
+//	block-cache-size: 256M
+//	profiles:
+//	  backup:
+//	    read-only: true    # comments start with #
+//	    map-uid:
+//	      - 0:1000:1
+//
+// Values may be quoted with " or '. Flags given on the command line take
+// precedence over the file.
+
+// config holds the flag values of the configuration file.
+type config struct {
+	values   map[string][]string
+	profiles map[string]map[string][]string
+}
+
+// configNode is a value of the file: a scalar, a list of scalars or a
+// mapping.
+type configNode struct {
+	line    int
+	scalar  *string
+	list    []string
+	mapping map[string]*configNode
+}
+
+type configLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// readConfig parses the configuration file at `path`.
+func readConfig(path string) (*config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	c, err := parseConfig(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return c, nil
+}
+
+func parseConfig(r io.Reader) (*config, error) {
+	var lines []configLine
+	scanner := bufio.NewScanner(r)
+	for num := 1; scanner.Scan(); num++ {
+		raw := scanner.Text()
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, errors.Errorf("line %d: indent with spaces, not tabs", num)
+		}
+		text = strings.TrimRight(stripConfigComment(text), " \t")
+		if text == "" || text == "---" {
+			continue
+		}
+		lines = append(lines, configLine{num: num, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	c := &config{values: make(map[string][]string), profiles: make(map[string]map[string][]string)}
+	if len(lines) == 0 {
+		return c, nil
+	}
+	root, next, err := parseConfigBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, errors.Errorf("line %d: unexpected indentation", lines[next].num)
+	}
+	if root.mapping == nil {
+		return nil, errors.Errorf("line %d: expected flag: value", root.line)
+	}
+	for key, node := range root.mapping {
+		if key != "profiles" {
+			if c.values[key], err = configValues(key, node); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if node.mapping == nil {
+			return nil, errors.Errorf("line %d: profiles must map names to flags", node.line)
+		}
+		for name, profile := range node.mapping {
+			if profile.mapping == nil {
+				return nil, errors.Errorf("line %d: profile %s must map flags to values", profile.line, name)
+			}
+			values := make(map[string][]string)
+			for key, node := range profile.mapping {
+				if values[key], err = configValues(key, node); err != nil {
+					return nil, err
+				}
+			}
+			c.profiles[name] = values
+		}
+	}
+	return c, nil
+}
+
+// parseConfigBlock parses the mapping or list starting at lines[i], whose
+// lines are indented by `indent`, and returns the index of the line after
+// it.
+func parseConfigBlock(lines []configLine, i, indent int) (*configNode, int, error) {
+	node := &configNode{line: lines[i].num}
+	if lines[i].text == "-" || strings.HasPrefix(lines[i].text, "- ") {
+		for ; i < len(lines) && lines[i].indent == indent; i++ {
+			l := lines[i]
+			if l.text != "-" && !strings.HasPrefix(l.text, "- ") {
+				return nil, 0, errors.Errorf("line %d: expected a list item", l.num)
+			}
+			item, err := unquoteConfig(strings.TrimSpace(l.text[1:]))
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "line %d", l.num)
+			}
+			node.list = append(node.list, item)
+		}
+		return node, i, nil
+	}
+
+	node.mapping = make(map[string]*configNode)
+	for i < len(lines) && lines[i].indent == indent {
+		l := lines[i]
+		colon := strings.Index(l.text, ":")
+		if colon <= 0 || colon+1 < len(l.text) && l.text[colon+1] != ' ' {
+			return nil, 0, errors.Errorf("line %d: expected key: value", l.num)
+		}
+		key := strings.TrimSpace(l.text[:colon])
+		if _, ok := node.mapping[key]; ok {
+			return nil, 0, errors.Errorf("line %d: %s is set twice", l.num, key)
+		}
+		i++
+		if value := strings.TrimSpace(l.text[colon+1:]); value != "" {
+			s, err := unquoteConfig(value)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "line %d", l.num)
+			}
+			node.mapping[key] = &configNode{line: l.num, scalar: &s}
+		} else if i < len(lines) && lines[i].indent > indent {
+			child, next, err := parseConfigBlock(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, 0, err
+			}
+			node.mapping[key], i = child, next
+		} else {
+			empty := ""
+			node.mapping[key] = &configNode{line: l.num, scalar: &empty}
+		}
+		if i < len(lines) && lines[i].indent > indent {
+			return nil, 0, errors.Errorf("line %d: unexpected indentation", lines[i].num)
+		}
+	}
+	return node, i, nil
+}
+
+// configValues returns the values of the flag `key`.
+func configValues(key string, node *configNode) ([]string, error) {
+	switch {
+	case node.scalar != nil:
+		return []string{*node.scalar}, nil
+	case node.list != nil:
+		return node.list, nil
+	}
+	return nil, errors.Errorf("line %d: %s must be a value or a list of values", node.line, key)
+}
+
+// stripConfigComment removes the comment ending `text`, if any.
+func stripConfigComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// unquoteConfig returns the scalar `s` without its quotes.
+func unquoteConfig(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{"):
+		return "", errors.Errorf("flow collections are not supported, use one line per item")
+	}
+	return s, nil
+}
+
+// Profile returns the flag values of the profile `name`, or of the top
+// level if it is empty, with the profile overriding the top level.
+func (c *config) Profile(name string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	for key, v := range c.values {
+		values[key] = v
+	}
+	if name == "" {
+		return values, nil
+	}
+	profile, ok := c.profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.profiles))
+		for n := range c.profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("no profile %q in the configuration file, expected one of: %s", name, strings.Join(names, ", "))
+	}
+	for key, v := range profile {
+		values[key] = v
+	}
+	return values, nil
+}
+
+// configFlags registers the flags selecting the configuration file and
+// profile on `fs`.
+func configFlags(fs *flag.FlagSet) (path, profile *string) {
+	path = fs.String("config", "", "file giving default values to flags (default "+defaultConfigPath+" if it exists)")
+	profile = fs.String("profile", "", "profile of the configuration file to apply")
+	return path, profile
+}
+
+// applyConfig sets the flags of `c` that were not given on the command line
+// to their values in the configuration file `path`, or in the default one
+// if it exists. Keys must be flags of some command in `cmds`.
+func applyConfig(c *command, cmds []*command, path, profile string) error {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath
+	}
+	conf, err := readConfig(path)
+	if os.IsNotExist(errors.Cause(err)) && !explicit && profile == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	values, err := conf.Profile(profile)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	c.flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "config" || key == "profile" {
+			return errors.Errorf("%s: %s cannot be set in the configuration file", path, key)
+		}
+		if c.flags.Lookup(key) == nil {
+			known := false
+			for _, other := range cmds {
+				known = known || other.flags.Lookup(key) != nil
+			}
+			if !known {
+				return errors.Errorf("%s: unknown flag %q", path, key)
+			}
+			continue
+		}
+		if set[key] {
+			continue
+		}
+		for _, v := range values[key] {
+			if err := c.flags.Set(key, v); err != nil {
+				return errors.Wrapf(err, "%s: invalid value %q for %s", path, v, key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package cli
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		text     string
+		values   map[string][]string
+		profiles map[string]map[string][]string
+	}{
+		{"empty", "# nothing\n\n---\n", map[string][]string{}, map[string]map[string][]string{}},
+		{
+			"scalars",
+			"db: postgres://sqlfs@db:26257/sqlfs?sslmode=disable\nread-only: true\nempty:\n",
+			map[string][]string{"db": {"postgres://sqlfs@db:26257/sqlfs?sslmode=disable"}, "read-only": {"true"}, "empty": {""}},
+			map[string]map[string][]string{},
+		},
+		{
+			"comments",
+			"# header\nblock-cache-size: 256M # trailing\nname: a#b\n  # indented comments are ignored too\n",
+			map[string][]string{"block-cache-size": {"256M"}, "name": {"a#b"}},
+			map[string]map[string][]string{},
+		},
+		{
+			"quoting",
+			"a: \"x # not a comment\"\nb: 'it''s'\nc: \"tab\\tquote\\\"\"\nd: ''\n",
+			map[string][]string{"a": {"x # not a comment"}, "b": {"it's"}, "c": {"tab\tquote\""}, "d": {""}},
+			map[string]map[string][]string{},
+		},
+		{
+			"lists",
+			"map-uid:\n  - 0:1000:1\n  - '1:1001:1'\nmap-gid:\n    -   0:1000:1\n",
+			map[string][]string{"map-uid": {"0:1000:1", "1:1001:1"}, "map-gid": {"0:1000:1"}},
+			map[string]map[string][]string{},
+		},
+		{
+			"profiles",
+			"db: a\nprofiles:\n  backup:\n    read-only: true    # comment\n    map-uid:\n      - 0:1000:1\n  other:\n    db: b\n",
+			map[string][]string{"db": {"a"}},
+			map[string]map[string][]string{
+				"backup": {"read-only": {"true"}, "map-uid": {"0:1000:1"}},
+				"other":  {"db": {"b"}},
+			},
+		},
+	} {
+		c, err := parseConfig(strings.NewReader(tc.text))
+		if err != nil {
+			t.Errorf("%s: parseConfig returned %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.values, tc.values) {
+			t.Errorf("%s: values = %q, want %q", tc.name, c.values, tc.values)
+		}
+		if !reflect.DeepEqual(c.profiles, tc.profiles) {
+			t.Errorf("%s: profiles = %q, want %q", tc.name, c.profiles, tc.profiles)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		err  string
+	}{
+		{"db: a\n\tro: true\n", "line 2: indent with spaces"},
+		{"- a\n- b\n", "line 1: expected flag: value"},
+		{"db a\n", "line 1: expected key: value"},
+		{"db:a\n", "line 1: expected key: value"},
+		{"db: a\ndb: b\n", "line 2: db is set twice"},
+		{"db: a\n  ro: true\n", "line 2: unexpected indentation"},
+		{"  db: a\nro: true\n", "line 2: unexpected indentation"},
+		{"map-uid:\n  - a\n  b: c\n", "line 3: expected a list item"},
+		{"map-uid: [a, b]\n", "flow collections are not supported"},
+		{"db: \"unterminated\\\"\n", "line 1"},
+		{"db:\n  host: a\n", "line 2: db must be a value or a list of values"},
+		{"profiles: a\n", "line 1: profiles must map names to flags"},
+		{"profiles:\n  backup: a\n", "line 2: profile backup must map flags to values"},
+		{"profiles:\n  backup:\n    - a\n", "line 3: profile backup must map flags to values"},
+	} {
+		_, err := parseConfig(strings.NewReader(tc.text))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("parseConfig(%q) returned %v, want %q", tc.text, err, tc.err)
+		}
+	}
+}
+
+func TestConfigProfile(t *testing.T) {
+	c, err := parseConfig(strings.NewReader("db: a\nro: false\nprofiles:\n  backup:\n    ro: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.Profile("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"db": {"a"}, "ro": {"true"}}; !reflect.DeepEqual(values, want) {
+		t.Errorf("Profile(backup) = %q, want %q", values, want)
+	}
+	if values, _ := c.Profile(""); values["ro"][0] != "false" {
+		t.Errorf("Profile(\"\") = %q, want the top-level values", values)
+	}
+	if _, err := c.Profile("restore"); err == nil || !strings.Contains(err.Error(), "expected one of: backup") {
+		t.Errorf("Profile(restore) returned %v", err)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	newCommand := func(name string, flags ...string) *command {
+		c := &command{name: name, flags: flag.NewFlagSet(name, flag.ContinueOnError)}
+		for _, f := range flags {
+			c.flags.String(f, "", "")
+		}
+		return c
+	}
+	mount := newCommand("mount", "db", "ro")
+	cmds := []*command{mount, newCommand("backup", "db", "output")}
+
+	for _, tc := range []struct {
+		name string
+		text string
+		args []string
+		want map[string]string
+		err  string
+	}{
+		{"defaults", "db: a\nro: true\n", nil, map[string]string{"db": "a", "ro": "true"}, ""},
+		{"command line wins", "db: a\nro: true\n", []string{"-db", "b"}, map[string]string{"db": "b", "ro": "true"}, ""},
+		// Flags of other commands are ignored, unknown ones rejected.
+		{"other command", "output: x\n", nil, map[string]string{"db": "", "ro": ""}, ""},
+		{"unknown", "db: a\nbogus: x\n", nil, nil, `unknown flag "bogus"`},
+		{"profile flag", "profile: x\n", nil, nil, "profile cannot be set"},
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(tc.text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c := newCommand("mount", "db", "ro")
+		cmds[0] = c
+		if err := c.flags.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		err := applyConfig(c, cmds, path, "")
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: applyConfig returned %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: applyConfig returned %v", tc.name, err)
+			continue
+		}
+		for name, want := range tc.want {
+			if got := c.flags.Lookup(name).Value.String(); got != want {
+				t.Errorf("%s: -%s = %q, want %q", tc.name, name, got, want)
+			}
+		}
+	}
+
+	if err := applyConfig(mount, cmds, filepath.Join(t.TempDir(), "missing.yaml"), ""); err == nil {
+		t.Error("applyConfig succeeded with a missing configuration file given explicitly")
+	}
+}
@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// daemonEnv is set in the environment of the background process started by
+// `sqlfs mount -daemon`. The background process reports the outcome of the
+// mount to its parent through the file descriptor 3.
+const daemonEnv = "SQLFS_DAEMON"
+
+// isDaemonChild returns true if this process is the background process of
+// a daemonized mount.
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// startDaemon runs the current command again as a background process, and
+// waits until it reports that the file system has been mounted.
+func startDaemon(logFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	stderr, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if logFile != "" {
+		stderr, err = os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	defer stderr.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	cmd.ExtraFiles = []*os.File{w} // Becomes fd 3 in the child.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		_ = w.Close()
+		return err
+	}
+	_ = w.Close()
+
+	// The child writes a single line: "ok" on success, or the error.
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		return errors.Errorf("background process exited before mounting")
+	}
+	line = strings.TrimSpace(line)
+	if line != "ok" {
+		return errors.New(line)
+	}
+	fmt.Printf("Mounted in background (pid %d).\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// Ensures that the daemon parent is notified at most once.
+var notifyDaemonOnce sync.Once
+
+// notifyDaemonParent reports the outcome of mounting to the process that
+// started this daemon. It does nothing if this is not a daemon process, or
+// if the parent was already notified.
+func notifyDaemonParent(mountErr error) {
+	if !isDaemonChild() {
+		return
+	}
+	notifyDaemonOnce.Do(func() { writeDaemonStatus(mountErr) })
+}
+
+func writeDaemonStatus(mountErr error) {
+	f := os.NewFile(3, "daemon-parent")
+	defer f.Close()
+	msg := "ok"
+	if mountErr != nil {
+		msg = strings.Replace(mountErr.Error(), "\n", " ", -1)
+	}
+	if _, err := fmt.Fprintln(f, msg); err != nil {
+		log.Printf("failed to notify daemon parent: %s\n", err)
+	}
+}
+
+func writePidfile(path string) error {
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+	return ioutil.WriteFile(path, []byte(pid), 0644)
+}
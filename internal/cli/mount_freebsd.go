@@ -0,0 +1,33 @@
+//go:build freebsd
+// +build freebsd
+
+package cli
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// errDeadMount is the error of accesses to a mount whose FUSE connection
+// died. fusefs returns ENXIO where Linux and OS X return ENOTCONN.
+const errDeadMount = syscall.ENXIO
+
+// checkPlatform returns an error for the flags that fusefs would silently
+// ignore, and for a missing kernel module or mount permission, which
+// mount_fusefs reports with obscure errors.
+func (f *mountFlags) checkPlatform() error {
+	if *f.allowRoot {
+		return errors.New("-allow-root is not supported by fusefs, use -allow-other")
+	}
+	if _, err := os.Stat("/dev/fuse"); os.IsNotExist(err) {
+		return errors.New("/dev/fuse does not exist, load the fusefs module with `kldload fusefs`")
+	}
+	if os.Geteuid() != 0 {
+		if v, err := syscall.SysctlUint32("vfs.usermount"); err == nil && v == 0 {
+			return errors.New("users cannot mount file systems, set the vfs.usermount sysctl to 1 or mount as root")
+		}
+	}
+	return nil
+}
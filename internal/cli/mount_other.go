@@ -0,0 +1,17 @@
+//go:build !freebsd
+// +build !freebsd
+
+package cli
+
+import ()
+import "syscall"
+
+// errDeadMount is the error of accesses to a mount whose FUSE connection
+// died.
+const errDeadMount = syscall.ENOTCONN
+
+// checkPlatform returns an error for the flags that are not supported on
+// this platform.
+func (f *mountFlags) checkPlatform() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/imjching/sql-fs/internal/store"
+	"github.com/pkg/errors"
+)
+
+const (
+	// How long to wait between attempts to remount after losing the FUSE
+	// connection.
+	remountRetryInterval = time.Second
+	// Number of attempts to clear a dead mount before giving up.
+	remountAttempts = 30
+)
+
+// connectionLost returns true if the FUSE connection of the mount at
+// `mountpoint` died rather than the file system being unmounted. `serveErr`
+// is the error the FUSE server stopped with.
+//
+// An aborted connection (e.g. through /sys/fs/fuse/connections or a reload
+// of the kernel module) leaves the mount in place, but every access to it
+// fails with ENOTCONN (ENXIO on FreeBSD). A regular unmount leaves the
+// underlying directory.
+func connectionLost(mountpoint string, serveErr error) bool {
+	if serveErr != nil {
+		return true
+	}
+	_, err := os.Stat(mountpoint)
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == errDeadMount
+	}
+	return false
+}
+
+// waitForRemount clears the dead mount at `mountpoint` so that it can be
+// mounted again. Nodes are identified by their inode, so the kernel
+// rebuilds its view of the tree from lookups on the new connection and no
+// state needs to be carried over. It stops early if the file system is
+// being shut down.
+func waitForRemount(mountpoint string, fsys *store.FS) error {
+	var err error
+	for i := 0; i < remountAttempts; i++ {
+		if fsys.Draining() {
+			return nil
+		}
+		if err = fuse.Unmount(mountpoint); err == nil || !connectionLost(mountpoint, nil) {
+			return nil
+		}
+		log.Printf("Failed to clear the dead mount (attempt %d/%d): %s\n", i+1, remountAttempts, err)
+		time.Sleep(remountRetryInterval)
+	}
+	return errors.Wrapf(err, "could not clear the dead mount at %s", mountpoint)
+}
@@ -0,0 +1,371 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// The password of the database can be kept off the command line, where
+// every user can see it with ps(1), and out of the -db URL:
+//   - -db-password-file reads it from a file, e.g. a Kubernetes secret;
+//   - -db-keyring looks it up in the keyring of the OS, with secret-tool(1)
+//     on Linux and BSDs and security(1) on macOS, under the user of the URL;
+//   - -db-vault-path reads the user and password from HashiCorp Vault, from
+//     a database secrets engine (database/creds/ROLE) or a KV secret with
+//     "username" and "password" fields. VAULT_ADDR and VAULT_TOKEN (or
+//     ~/.vault-token) locate Vault. Leased credentials are renewed for as
+//     long as the command runs, and replaced by new ones once they cannot
+//     be renewed further; connections opened after that use them.
+
+// Flags of the sources of the password, registered by dbFlag.
+const (
+	flagDBPasswordFile = "db-password-file"
+	flagDBKeyring      = "db-keyring"
+	flagDBVaultPath    = "db-vault-path"
+)
+
+// dbSecretFlags registers the flags of the sources of the password on `fs`.
+func dbSecretFlags(fs *flag.FlagSet) {
+	fs.String(flagDBPasswordFile, "", "read the database password from this file")
+	fs.String(flagDBKeyring, "", "look the database password up in the OS keyring under this service name")
+	fs.String(flagDBVaultPath, "", "read the database user and password from this Vault path, e.g. database/creds/sqlfs")
+}
+
+// resolveDBCredentials sets the password given by the secret flags of `fs`,
+// if any, in its -db flag.
+func resolveDBCredentials(fs *flag.FlagSet) error {
+	db := fs.Lookup("db")
+	if db == nil || fs.Lookup(flagDBPasswordFile) == nil {
+		return nil
+	}
+	var sources []string
+	for _, name := range []string{flagDBPasswordFile, flagDBKeyring, flagDBVaultPath} {
+		if fs.Lookup(name).Value.String() != "" {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	if len(sources) > 1 {
+		return errors.Errorf("-%s cannot be used with -%s", sources[0], sources[1])
+	}
+	value := fs.Lookup(sources[0]).Value.String()
+	user := dbURLUser(db.Value.String())
+
+	var password string
+	var err error
+	switch sources[0] {
+	case flagDBPasswordFile:
+		var data []byte
+		data, err = ioutil.ReadFile(value)
+		password = strings.TrimRight(string(data), "\r\n")
+	case flagDBKeyring:
+		password, err = keyringPassword(value, user)
+	case flagDBVaultPath:
+		var creds *vaultCredentials
+		if creds, err = newVaultCredentials(value); err == nil {
+			if creds.username != "" {
+				user = creds.username
+			}
+			password = creds.password
+			dbCredentials = creds
+			go creds.renew()
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the database password with -%s", sources[0])
+	}
+	u, err := withDBCredentials(db.Value.String(), user, password)
+	if err != nil {
+		return err
+	}
+	return db.Value.Set(u)
+}
+
+// dbURLUser returns the user of the connection string `s`.
+func dbURLUser(s string) string {
+	if strings.Contains(s, "://") {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			return u.User.Username()
+		}
+		return ""
+	}
+	for _, field := range strings.Fields(s) {
+		if strings.HasPrefix(field, "user=") {
+			return strings.Trim(strings.TrimPrefix(field, "user="), "'")
+		}
+	}
+	return ""
+}
+
+// withDBCredentials returns the connection string `s`, a URL or key=value
+// pairs, with the given user and password.
+func withDBCredentials(s, user, password string) (string, error) {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid database URL")
+		}
+		u.User = url.UserPassword(user, password)
+		return u.String(), nil
+	}
+	quote := func(v string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+	}
+	return fmt.Sprintf("%s user=%s password=%s", s, quote(user), quote(password)), nil
+}
+
+// keyringPassword looks up the password of `user` for `service` in the
+// keyring of the OS.
+func keyringPassword(service, user string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", user, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "user", user)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Errorf("%s failed: %s %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	password := strings.TrimRight(string(out), "\r\n")
+	if password == "" {
+		return "", errors.Errorf("no password for user %q in the keyring", user)
+	}
+	return password, nil
+}
+
+// dbCredentials are the leased credentials read from Vault, nil if the
+// password does not come from Vault.
+var dbCredentials *vaultCredentials
+
+// vaultCredentials are the database credentials read from a Vault path.
+type vaultCredentials struct {
+	path   string
+	addr   string
+	token  string
+	client *http.Client
+
+	mu        sync.Mutex
+	username  string
+	password  string
+	leaseID   string
+	leaseTime time.Duration
+	renewable bool
+}
+
+// vaultResponse is the part of the responses of Vault used here.
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int64                  `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Errors        []string               `json:"errors"`
+}
+
+func newVaultCredentials(path string) (*vaultCredentials, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		home, _ := os.UserHomeDir()
+		data, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+		if err != nil {
+			return nil, errors.New("VAULT_TOKEN is not set and ~/.vault-token cannot be read")
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	c := &vaultCredentials{
+		path:   strings.Trim(path, "/"),
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if err := c.read(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// request sends a request to the Vault API.
+func (c *vaultCredentials) request(method, path string, body interface{}) (*vaultResponse, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.addr+"/v1/"+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, errors.Wrapf(err, "invalid response of Vault to %s %s (%s)", method, path, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Vault answered %s to %s %s: %s", resp.Status, method, path, strings.Join(r.Errors, "; "))
+	}
+	return &r, nil
+}
+
+// read reads new credentials from the path.
+func (c *vaultCredentials) read() error {
+	r, err := c.request(http.MethodGet, c.path, nil)
+	if err != nil {
+		return err
+	}
+	data := r.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested // KV version 2.
+	}
+	password, _ := data["password"].(string)
+	if password == "" {
+		return errors.Errorf("the Vault secret %s has no password field", c.path)
+	}
+	username, _ := data["username"].(string)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username, c.password = username, password
+	c.leaseID, c.renewable = r.LeaseID, r.Renewable
+	c.leaseTime = time.Duration(r.LeaseDuration) * time.Second
+	return nil
+}
+
+// renewLease extends the lease of the credentials, and returns false if it
+// could not be extended as long as it was.
+func (c *vaultCredentials) renewLease() (bool, error) {
+	c.mu.Lock()
+	leaseID, leaseTime := c.leaseID, c.leaseTime
+	c.mu.Unlock()
+	r, err := c.request(http.MethodPut, "sys/leases/renew", map[string]interface{}{
+		"lease_id":  leaseID,
+		"increment": int64(leaseTime / time.Second),
+	})
+	if err != nil {
+		return false, err
+	}
+	granted := time.Duration(r.LeaseDuration) * time.Second
+	c.mu.Lock()
+	c.leaseTime = granted
+	c.mu.Unlock()
+	return granted >= leaseTime, nil
+}
+
+// renew keeps the credentials valid for as long as the process runs: the
+// lease is renewed when two thirds of it have elapsed, and new credentials
+// are read once it reaches its maximum duration.
+func (c *vaultCredentials) renew() {
+	for {
+		c.mu.Lock()
+		leaseID, leaseTime, renewable := c.leaseID, c.leaseTime, c.renewable
+		c.mu.Unlock()
+		if leaseID == "" || leaseTime <= 0 {
+			return // Static secret.
+		}
+		time.Sleep(leaseTime * 2 / 3)
+		if renewable {
+			extended, err := c.renewLease()
+			if err != nil {
+				log.Printf("failed to renew the lease of the database credentials: %s\n", err)
+			}
+			if err == nil && extended {
+				continue
+			}
+		}
+		if err := c.read(); err != nil {
+			log.Printf("failed to read new database credentials from Vault: %s\n", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		log.Println("Read new database credentials from Vault, new connections use them.")
+	}
+}
+
+// Current returns the user and password to connect with.
+func (c *vaultCredentials) Current() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.username, c.password
+}
+
+// dbConnector returns a connector to the database at `url`. Connections
+// use the current credentials read from Vault, if any, and are replaced
+// once the TLS certificates are rotated.
+func dbConnector(url string) (driver.Connector, error) {
+	var connector driver.Connector
+	connector, err := pq.NewConnector(url)
+	if err != nil {
+		return nil, err
+	}
+	if dbCredentials != nil {
+		connector = &credentialConnector{url: url, creds: dbCredentials}
+	}
+	if certs := newCertWatcher(url); certs != nil {
+		go certs.watch()
+		connector = &certConnector{Connector: connector, certs: certs}
+	}
+	return connector, nil
+}
+
+// credentialConnector opens connections with the credentials in effect when
+// they are opened.
+type credentialConnector struct {
+	url   string
+	creds *vaultCredentials
+}
+
+// Connect implements driver.Connector.
+func (c *credentialConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	user, password := c.creds.Current()
+	if user == "" {
+		user = dbURLUser(c.url)
+	}
+	u, err := withDBCredentials(c.url, user, password)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := pq.NewConnector(u)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// Driver implements driver.Connector.
+func (c *credentialConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
@@ -0,0 +1,195 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sdNotify sends `state`, e.g. "READY=1", to the service manager if the
+// process runs as a systemd service of Type=notify, and does nothing
+// otherwise. See sd_notify(3).
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // Abstract socket.
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "failed to notify systemd")
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, "failed to notify systemd")
+	}
+	return nil
+}
+
+// Default path of the mount table read by `sqlfs systemd-generator`.
+const defaultMountTable = "/etc/sqlfs/mounts"
+
+// mountTableEntry is a line of the mount table: the mountpoint and the
+// flags of `sqlfs mount`, e.g.
+//
+//	/srv/data  -db postgres://sqlfs@db:26257/sqlfs -allow-other
+//
+// Fields are separated by white space and cannot be quoted. Empty lines and
+// lines starting with # are ignored.
+type mountTableEntry struct {
+	mountpoint string
+	flags      []string
+	line       int
+}
+
+// readMountTable parses the mount table at `path`, checking the flags of
+// each entry.
+func readMountTable(path string) ([]mountTableEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []mountTableEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		e := mountTableEntry{mountpoint: filepath.Clean(fields[0]), flags: fields[1:], line: line}
+		if !filepath.IsAbs(e.mountpoint) {
+			return nil, errors.Errorf("%s:%d: the mountpoint %s is not an absolute path", path, line, fields[0])
+		}
+		if err := checkMountFlags(e.flags); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// checkMountFlags returns an error if `args` are not valid flags of `sqlfs
+// mount` for a service.
+func checkMountFlags(args []string) error {
+	c := newMountCommand()
+	c.flags.Init(c.name, flag.ContinueOnError)
+	c.flags.SetOutput(ioutil.Discard)
+	if err := c.flags.Parse(args); err != nil {
+		return err
+	}
+	if c.flags.NArg() != 0 {
+		return errors.Errorf("unexpected argument %q, the mountpoint comes first", c.flags.Arg(0))
+	}
+	var err error
+	c.flags.Visit(func(f *flag.Flag) {
+		if f.Name == "daemon" || f.Name == "pidfile" {
+			err = errors.Errorf("-%s cannot be used as systemd tracks the process", f.Name)
+		}
+	})
+	return err
+}
+
+// escapeUnitPath escapes `path` for use in a unit name, as
+// `systemd-escape --path` does.
+func escapeUnitPath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && (i == 0 || path[i-1] == '/'),
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// quoteUnitArg quotes `arg` for a command line of a unit file, escaping
+// the specifiers and variables systemd would otherwise expand.
+func quoteUnitArg(arg string) string {
+	arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(arg)
+	if arg == "" || strings.ContainsAny(arg, " \t'") {
+		return `"` + arg + `"`
+	}
+	return arg
+}
+
+// serviceUnit returns the name and the contents of the service serving the
+// entry `e` of the mount table `table` with the binary `bin`.
+func serviceUnit(table, bin string, e mountTableEntry) (name, unit string) {
+	args := []string{quoteUnitArg(bin), "mount"}
+	for _, f := range e.flags {
+		args = append(args, quoteUnitArg(f))
+	}
+	args = append(args, quoteUnitArg(e.mountpoint))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by sqlfs from %s:%d.\n", table, e.line)
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=sqlfs file system at %s\n", e.mountpoint)
+	fmt.Fprintf(&b, "Wants=network-online.target\n")
+	fmt.Fprintf(&b, "After=network-online.target\n")
+	fmt.Fprintf(&b, "Before=remote-fs.target umount.target\n")
+	fmt.Fprintf(&b, "Conflicts=umount.target\n")
+	if parent := filepath.Dir(e.mountpoint); parent != "/" {
+		fmt.Fprintf(&b, "RequiresMountsFor=%s\n", quoteUnitArg(parent))
+	}
+	fmt.Fprintf(&b, "\n[Service]\n")
+	// READY=1 is sent once the file system is mounted.
+	fmt.Fprintf(&b, "Type=notify\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	// SIGTERM unmounts once the operations in flight are done.
+	fmt.Fprintf(&b, "KillMode=mixed\n")
+	fmt.Fprintf(&b, "Restart=on-failure\n")
+	fmt.Fprintf(&b, "RestartSec=5s\n")
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=remote-fs.target\n")
+	return "sqlfs-" + escapeUnitPath(e.mountpoint) + ".service", b.String()
+}
+
+// writeServiceUnits writes the services of the entries of the mount table
+// `table` to `dir`, and makes remote-fs.target want them so that they start
+// at boot. Failures are returned once every entry was attempted, so that a
+// bad entry does not keep the others from mounting.
+func writeServiceUnits(table, bin, dir string, entries []mountTableEntry) error {
+	wants := filepath.Join(dir, "remote-fs.target.wants")
+	if err := os.MkdirAll(wants, 0755); err != nil {
+		return err
+	}
+	var failed []string
+	for _, e := range entries {
+		name, unit := serviceUnit(table, bin, e)
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(unit), 0644)
+		if err == nil {
+			link := filepath.Join(wants, name)
+			_ = os.Remove(link)
+			err = os.Symlink(path, link)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", e.mountpoint, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to write units: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The TLS settings of the connection can be given as flags instead of
+// parameters of the -db URL; flags override the URL. The client certificate
+// and key, and the root certificate, are read again by each new connection,
+// so rotating them on disk does not need a remount: the files are checked
+// every certCheckInterval, and once they changed and the new key pair is
+// valid, connections made with the old files are closed as they return to
+// the pool. Connections in use finish their statement or transaction first.
+
+// How often the certificate files are checked for changes.
+const certCheckInterval = 30 * time.Second
+
+// TLS flags, registered by dbFlag, and the parameters of the URL they set.
+var dbTLSParams = []struct{ flag, param, usage string }{
+	{"db-sslmode", "sslmode", "TLS mode of the database connection: disable, require, verify-ca or verify-full"},
+	{"db-sslrootcert", "sslrootcert", "file of the CA certificate verifying the database server"},
+	{"db-sslcert", "sslcert", "file of the client certificate"},
+	{"db-sslkey", "sslkey", "file of the key of the client certificate"},
+}
+
+// dbTLSFlags registers the TLS flags on `fs`.
+func dbTLSFlags(fs *flag.FlagSet) {
+	for _, p := range dbTLSParams {
+		fs.String(p.flag, "", p.usage)
+	}
+}
+
+// resolveDBTLS sets the TLS flags of `fs` given on the command line or in
+// the configuration file as parameters of its -db flag.
+func resolveDBTLS(fs *flag.FlagSet) error {
+	db := fs.Lookup("db")
+	if db == nil || fs.Lookup(dbTLSParams[0].flag) == nil {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, p := range dbTLSParams {
+		if v := fs.Lookup(p.flag).Value.String(); v != "" {
+			params[p.param] = v
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	if mode, ok := params["sslmode"]; ok {
+		switch mode {
+		case "disable", "require", "verify-ca", "verify-full":
+		default:
+			return errors.Errorf("invalid -db-sslmode %q, expected disable, require, verify-ca or verify-full", mode)
+		}
+	}
+	u, err := withDBParams(db.Value.String(), params)
+	if err != nil {
+		return err
+	}
+	return db.Value.Set(u)
+}
+
+// dbURLParam returns the value of the parameter `key` of the connection
+// string `s`.
+func dbURLParam(s, key string) string {
+	if strings.Contains(s, "://") {
+		if u, err := url.Parse(s); err == nil {
+			return u.Query().Get(key)
+		}
+		return ""
+	}
+	for _, field := range strings.Fields(s) {
+		if strings.HasPrefix(field, key+"=") {
+			return strings.Trim(strings.TrimPrefix(field, key+"="), "'")
+		}
+	}
+	return ""
+}
+
+// withDBParams returns the connection string `s`, a URL or key=value pairs,
+// with the given parameters.
+func withDBParams(s string, params map[string]string) (string, error) {
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid database URL")
+		}
+		q := u.Query()
+		for key, v := range params {
+			q.Set(key, v)
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	for _, p := range dbTLSParams {
+		if v, ok := params[p.param]; ok {
+			s += fmt.Sprintf(" %s='%s'", p.param, quote.Replace(v))
+		}
+	}
+	return s, nil
+}
+
+// certWatcher detects that the certificate files of a connection string
+// were rotated.
+type certWatcher struct {
+	cert, key, rootCert string
+
+	generation uint64 // Incremented when the files change.
+	stamps     string
+}
+
+// newCertWatcher returns a watcher of the files of `url`, or nil if it does
+// not use TLS. As the driver does, the client certificate and key default
+// to those in ~/.postgresql.
+func newCertWatcher(url string) *certWatcher {
+	if dbURLParam(url, "sslmode") == "disable" {
+		return nil
+	}
+	w := &certWatcher{
+		cert:     dbURLParam(url, "sslcert"),
+		key:      dbURLParam(url, "sslkey"),
+		rootCert: dbURLParam(url, "sslrootcert"),
+	}
+	if u, err := user.Current(); err == nil {
+		if w.cert == "" {
+			w.cert = filepath.Join(u.HomeDir, ".postgresql", "postgresql.crt")
+		}
+		if w.key == "" {
+			w.key = filepath.Join(u.HomeDir, ".postgresql", "postgresql.key")
+		}
+	}
+	w.stamps = w.stat()
+	return w
+}
+
+// stat returns the modification times and sizes of the files.
+func (w *certWatcher) stat() string {
+	var b strings.Builder
+	for _, path := range []string{w.cert, w.key, w.rootCert} {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%d:%d;", info.ModTime().UnixNano(), info.Size())
+		} else {
+			b.WriteString("-;")
+		}
+	}
+	return b.String()
+}
+
+// validate returns an error if the files cannot be loaded, e.g. when the
+// certificate was replaced but not its key yet.
+func (w *certWatcher) validate() error {
+	if _, err := os.Stat(w.cert); err == nil {
+		if _, err := tls.LoadX509KeyPair(w.cert, w.key); err != nil {
+			return err
+		}
+	}
+	if w.rootCert != "" {
+		data, err := ioutil.ReadFile(w.rootCert)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			return errors.Errorf("no certificate in %s", w.rootCert)
+		}
+	}
+	return nil
+}
+
+// check increments the generation if the files changed and are valid.
+func (w *certWatcher) check() {
+	stamps := w.stat()
+	if stamps == w.stamps {
+		return
+	}
+	if err := w.validate(); err != nil {
+		log.Printf("The database certificates changed but cannot be used yet: %s\n", err)
+		return
+	}
+	w.stamps = stamps
+	atomic.AddUint64(&w.generation, 1)
+	log.Println("The database certificates changed, reconnecting with them.")
+}
+
+// watch checks the files every certCheckInterval.
+func (w *certWatcher) watch() {
+	for range time.Tick(certCheckInterval) {
+		w.check()
+	}
+}
+
+// Generation returns the number of times the files changed.
+func (w *certWatcher) Generation() uint64 {
+	return atomic.LoadUint64(&w.generation)
+}
+
+// certConnector opens connections that are closed once the certificates
+// they were made with are rotated.
+type certConnector struct {
+	driver.Connector
+	certs *certWatcher
+}
+
+// Connect implements driver.Connector.
+func (c *certConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	generation := c.certs.Generation()
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &certConn{Conn: conn, certs: c.certs, generation: generation}, nil
+}
+
+// certConn is a connection made with the generation `generation` of the
+// certificates.
+type certConn struct {
+	driver.Conn
+	certs      *certWatcher
+	generation uint64
+}
+
+func (c *certConn) stale() bool {
+	return c.certs.Generation() != c.generation
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *certConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *certConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *certConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// Ping implements driver.Pinger.
+func (c *certConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements driver.SessionResetter, discarding idle
+// connections made with rotated certificates before they are reused.
+func (c *certConn) ResetSession(ctx context.Context) error {
+	if c.stale() {
+		return driver.ErrBadConn
+	}
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator, so that connections made with
+// rotated certificates are closed instead of returning to the pool.
+func (c *certConn) IsValid() bool {
+	if c.stale() {
+		return false
+	}
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
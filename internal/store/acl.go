@@ -0,0 +1,616 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+// Names of the extended attributes holding POSIX ACLs, in the binary
+// format of the Linux kernel (see acl(5) and linux/posix_acl_xattr.h).
+const (
+	ACLAccessXattr  = "system.posix_acl_access"
+	ACLDefaultXattr = "system.posix_acl_default"
+)
+
+const aclVersion = 2
+
+// Tags of ACL entries.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// Permissions of ACL entries, which are also the bits of access(2) masks.
+const (
+	aclRead    = 4
+	aclWrite   = 2
+	aclExecute = 1
+)
+
+// aclUndefinedID is the ID of the entries that do not name a user or group.
+const aclUndefinedID = 0xffffffff
+
+type aclEntry struct {
+	Tag  uint16
+	Perm uint16
+	ID   uint32
+}
+
+// PosixACL is a POSIX access control list, ordered as the kernel expects:
+// by tag, then by ID.
+type PosixACL []aclEntry
+
+func isACLXattr(name string) bool {
+	return name == ACLAccessXattr || name == ACLDefaultXattr
+}
+
+// parseACL decodes and validates the extended attribute value `b`.
+func parseACL(b []byte) (PosixACL, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 {
+		return nil, errors.New("invalid ACL size")
+	}
+	if v := binary.LittleEndian.Uint32(b); v != aclVersion {
+		return nil, errors.Errorf("unsupported ACL version %d", v)
+	}
+	var acl PosixACL
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		acl = append(acl, aclEntry{
+			Tag:  binary.LittleEndian.Uint16(b),
+			Perm: binary.LittleEndian.Uint16(b[2:]),
+			ID:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return acl, acl.validate()
+}
+
+// validate checks that the ACL has exactly one entry for the owner, the
+// owning group and others, a mask if it has named entries, and no two
+// entries for the same user or group.
+func (a PosixACL) validate() error {
+	counts := make(map[uint16]int)
+	named := make(map[aclEntry]bool)
+	for _, e := range a {
+		if e.Perm&^7 != 0 {
+			return errors.Errorf("invalid ACL permissions %#o", e.Perm)
+		}
+		switch e.Tag {
+		case aclUser, aclGroup:
+			key := aclEntry{Tag: e.Tag, ID: e.ID}
+			if named[key] {
+				return errors.Errorf("duplicate ACL entry for ID %d", e.ID)
+			}
+			named[key] = true
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+		default:
+			return errors.Errorf("invalid ACL tag %#x", e.Tag)
+		}
+		counts[e.Tag]++
+	}
+	if counts[aclUserObj] != 1 || counts[aclGroupObj] != 1 || counts[aclOther] != 1 || counts[aclMask] > 1 {
+		return errors.New("ACL must have one owner, owning group and other entry")
+	}
+	if len(named) > 0 && counts[aclMask] == 0 {
+		return errors.New("ACL with named entries must have a mask")
+	}
+	return nil
+}
+
+// encode returns the extended attribute value of the ACL.
+func (a PosixACL) encode() []byte {
+	sorted := append(PosixACL(nil), a...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Tag != sorted[j].Tag {
+			return sorted[i].Tag < sorted[j].Tag
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	b := make([]byte, 4, 4+8*len(sorted))
+	binary.LittleEndian.PutUint32(b, aclVersion)
+	for _, e := range sorted {
+		var buf [8]byte
+		binary.LittleEndian.PutUint16(buf[:], e.Tag)
+		binary.LittleEndian.PutUint16(buf[2:], e.Perm)
+		binary.LittleEndian.PutUint32(buf[4:], e.ID)
+		b = append(b, buf[:]...)
+	}
+	return b
+}
+
+// ACLFromMode returns the minimal ACL equivalent to the permissions of
+// `mode`.
+func ACLFromMode(mode os.FileMode) PosixACL {
+	return PosixACL{
+		{Tag: aclUserObj, Perm: uint16(mode>>6) & 7, ID: aclUndefinedID},
+		{Tag: aclGroupObj, Perm: uint16(mode>>3) & 7, ID: aclUndefinedID},
+		{Tag: aclOther, Perm: uint16(mode) & 7, ID: aclUndefinedID},
+	}
+}
+
+// find returns the entry with the tag `tag`, which must not be a named
+// user or group, or nil.
+func (a PosixACL) find(tag uint16) *aclEntry {
+	for i := range a {
+		if a[i].Tag == tag {
+			return &a[i]
+		}
+	}
+	return nil
+}
+
+// minimal reports whether the ACL is fully represented by file modes.
+func (a PosixACL) minimal() bool {
+	return len(a) == 3
+}
+
+// group returns the entry shown as the group permissions of the file mode:
+// the mask if there is one, or else the owning group.
+func (a PosixACL) group() *aclEntry {
+	if e := a.find(aclMask); e != nil {
+		return e
+	}
+	return a.find(aclGroupObj)
+}
+
+// Perm returns the permission bits of the file mode matching the ACL.
+func (a PosixACL) Perm() os.FileMode {
+	return os.FileMode(a.find(aclUserObj).Perm)<<6 |
+		os.FileMode(a.group().Perm)<<3 |
+		os.FileMode(a.find(aclOther).Perm)
+}
+
+// chmod returns a copy of the ACL whose entries matching the file mode are
+// set to the permissions of `mode`, as chmod(2) does.
+func (a PosixACL) chmod(mode os.FileMode) PosixACL {
+	b := append(PosixACL(nil), a...)
+	b.find(aclUserObj).Perm = uint16(mode>>6) & 7
+	b.group().Perm = uint16(mode>>3) & 7
+	b.find(aclOther).Perm = uint16(mode) & 7
+	return b
+}
+
+// create returns the access ACL of a node created with `mode` in a
+// directory with the default ACL `a`, and the mode of the node restricted
+// by the ACL (see posix_acl_create_masq in the Linux kernel).
+func (a PosixACL) create(mode os.FileMode) (PosixACL, os.FileMode) {
+	b := append(PosixACL(nil), a...)
+	user, group, other := uint16(mode>>6)&7, uint16(mode>>3)&7, uint16(mode)&7
+	u, g, o := b.find(aclUserObj), b.group(), b.find(aclOther)
+	u.Perm &= user
+	g.Perm &= group
+	o.Perm &= other
+	return b, mode&^os.ModePerm | os.FileMode(u.Perm)<<6 | os.FileMode(g.Perm)<<3 | os.FileMode(o.Perm)
+}
+
+// mapIDs returns a copy of the ACL whose named entries are translated with
+// `uid` and `gid`.
+func (a PosixACL) mapIDs(uid, gid func(uint32) uint32) PosixACL {
+	b := append(PosixACL(nil), a...)
+	for i := range b {
+		switch b[i].Tag {
+		case aclUser:
+			b[i].ID = uid(b[i].ID)
+		case aclGroup:
+			b[i].ID = gid(b[i].ID)
+		}
+	}
+	return b
+}
+
+// allows reports whether the ACL grants the permissions `want` to the user
+// `uid` with the groups `gids`, where `owner` and `group` own the file (see
+// posix_acl_permission in the Linux kernel).
+func (a PosixACL) allows(uid uint32, gids []uint32, owner, group uint32, want uint16) bool {
+	mask := uint16(7)
+	if e := a.find(aclMask); e != nil {
+		mask = e.Perm
+	}
+	if uid == owner {
+		return a.find(aclUserObj).Perm&want == want
+	}
+	for _, e := range a {
+		if e.Tag == aclUser && e.ID == uid {
+			return e.Perm&mask&want == want
+		}
+	}
+	inGroup := false
+	for _, e := range a {
+		var matches bool
+		switch e.Tag {
+		case aclGroupObj:
+			matches = hasID(gids, group)
+		case aclGroup:
+			matches = hasID(gids, e.ID)
+		}
+		if !matches {
+			continue
+		}
+		if e.Perm&mask&want == want {
+			return true
+		}
+		inGroup = true
+	}
+	if inGroup {
+		return false
+	}
+	return a.find(aclOther).Perm&want == want
+}
+
+func hasID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the ACL in the short text form of setfacl(1), e.g.
+// u::rw-,u:1000:r--,g::r--,m::r--,o::---.
+func (a PosixACL) String() string {
+	var parts []string
+	for _, e := range a {
+		var tag, id string
+		switch e.Tag {
+		case aclUserObj:
+			tag = "u"
+		case aclUser:
+			tag, id = "u", strconv.FormatUint(uint64(e.ID), 10)
+		case aclGroupObj:
+			tag = "g"
+		case aclGroup:
+			tag, id = "g", strconv.FormatUint(uint64(e.ID), 10)
+		case aclMask:
+			tag = "m"
+		case aclOther:
+			tag = "o"
+		}
+		perm := []byte("---")
+		for i, c := range "rwx" {
+			if e.Perm&(4>>uint(i)) != 0 {
+				perm[i] = byte(c)
+			}
+		}
+		parts = append(parts, tag+":"+id+":"+string(perm))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseACLText parses the short text form of an ACL. Users and groups can
+// be given by name or ID.
+func ParseACLText(s string) (PosixACL, error) {
+	var acl PosixACL
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 {
+			return nil, errors.Errorf("invalid ACL entry %q", part)
+		}
+		e := aclEntry{ID: aclUndefinedID}
+		for _, c := range fields[2] {
+			switch c {
+			case 'r':
+				e.Perm |= aclRead
+			case 'w':
+				e.Perm |= aclWrite
+			case 'x':
+				e.Perm |= aclExecute
+			case '-':
+			default:
+				return nil, errors.Errorf("invalid permissions in ACL entry %q", part)
+			}
+		}
+		var err error
+		switch fields[0] {
+		case "u", "user":
+			e.Tag = aclUserObj
+			if fields[1] != "" {
+				e.Tag = aclUser
+				e.ID, err = lookupID(fields[1], func(name string) (string, error) {
+					u, err := user.Lookup(name)
+					if err != nil {
+						return "", err
+					}
+					return u.Uid, nil
+				})
+			}
+		case "g", "group":
+			e.Tag = aclGroupObj
+			if fields[1] != "" {
+				e.Tag = aclGroup
+				e.ID, err = lookupID(fields[1], func(name string) (string, error) {
+					g, err := user.LookupGroup(name)
+					if err != nil {
+						return "", err
+					}
+					return g.Gid, nil
+				})
+			}
+		case "m", "mask":
+			e.Tag = aclMask
+		case "o", "other":
+			e.Tag = aclOther
+		default:
+			return nil, errors.Errorf("invalid ACL entry %q", part)
+		}
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, e)
+	}
+	// As setfacl(1) does, compute the mask from the group entries if it
+	// is needed but missing.
+	if acl.find(aclMask) == nil && len(acl) > 3 {
+		m := aclEntry{Tag: aclMask, ID: aclUndefinedID}
+		for _, e := range acl {
+			if e.Tag == aclUser || e.Tag == aclGroup || e.Tag == aclGroupObj {
+				m.Perm |= e.Perm
+			}
+		}
+		acl = append(acl, m)
+	}
+	return acl, acl.validate()
+}
+
+func lookupID(s string, lookup func(string) (string, error)) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(id, 10, 32)
+	return uint32(v), err
+}
+
+// GetACL returns the ACL stored in the extended attribute `name` of
+// `inode`, or nil if there is none.
+func GetACL(ctx context.Context, db *DB, inode uint64, name string) (PosixACL, error) {
+	if !db.XattrsEnabled {
+		return nil, nil
+	}
+	value, err := GetXattr(ctx, db, inode, name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the ACL of inode %d", inode)
+	}
+	acl, err := parseACL(value)
+	return acl, errors.Wrapf(err, "invalid ACL in inode %d", inode)
+}
+
+// PutACL stores `acl` in the extended attribute `name` of `inode`, or
+// removes the attribute if `acl` is nil or, for access ACLs, minimal.
+func PutACL(ctx context.Context, db *DB, inode uint64, name string, acl PosixACL) error {
+	if acl == nil || name == ACLAccessXattr && acl.minimal() {
+		if err := RemoveXattr(ctx, db, inode, name); err != nil && err != errNoXattr {
+			return err
+		}
+		return nil
+	}
+	return SetXattr(ctx, db, inode, name, acl.encode(), 0)
+}
+
+// localACL translates the IDs of the stored ACL attribute `value` for the
+// mount.
+func (fs *fileSystem) localACL(value []byte) ([]byte, error) {
+	acl, err := parseACL(value)
+	if err != nil {
+		return nil, err
+	}
+	return acl.mapIDs(fs.uids.toLocal, fs.gids.toLocal).encode(), nil
+}
+
+// ownedBy reports whether the caller of `hdr` owns the node or is root,
+// and may thus change its ACLs.
+func (n *FileNode) ownedBy(hdr *fuse.Header) bool {
+	unlock := n.lock()
+	defer unlock()
+	return hdr.Uid == 0 || n.fs.uids.toStored(hdr.Uid) == n.Uid
+}
+
+// setACLXattr sets an ACL attribute of the node. The permissions of the
+// file mode follow the access ACL, and minimal access ACLs are only kept
+// as the file mode. An empty value removes the ACL.
+func (n *FileNode) setACLXattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if !n.ownedBy(&req.Header) {
+		return fuse.EPERM
+	}
+	if req.Name == ACLDefaultXattr && !n.IsDirectory() {
+		return fuse.Errno(syscall.EACCES)
+	}
+	var acl PosixACL
+	if len(req.Xattr) > 0 {
+		parsed, err := parseACL(req.Xattr)
+		if err != nil {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		acl = parsed.mapIDs(n.fs.uids.toStored, n.fs.gids.toStored)
+	}
+	if req.Name == ACLDefaultXattr {
+		if err := PutACL(ctx, n.fs.db, n.Inode, req.Name, acl); err != nil {
+			log.Println(err)
+			return errnoFromErr(ctx, err)
+		}
+		return nil
+	}
+
+	unlock := n.lock()
+	defer unlock()
+	if acl != nil {
+		n.setMode(n.Mode&^os.ModePerm | acl.Perm())
+		n.Ctime = time.Now()
+		if err := UpdateNode(ctx, n.fs.db, n); err != nil {
+			log.Println(err)
+			return errnoFromErr(ctx, err)
+		}
+		n.fs.invalidateInode(n.Inode)
+	}
+	if err := PutACL(ctx, n.fs.db, n.Inode, req.Name, acl); err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	return nil
+}
+
+// chmodACL updates the access ACL of `inode`, if it has one, after its
+// mode was changed to `mode`.
+func (fs *fileSystem) chmodACL(ctx context.Context, inode uint64, mode os.FileMode) error {
+	acl, err := GetACL(ctx, fs.db, inode, ACLAccessXattr)
+	if err != nil || acl == nil {
+		return err
+	}
+	return PutACL(ctx, fs.db, inode, ACLAccessXattr, acl.chmod(mode))
+}
+
+// inheritedACL holds the ACLs a new node inherits from its directory.
+type inheritedACL struct {
+	access, dflt PosixACL
+}
+
+// inheritACL applies the default ACL of the directory `dir`, if it has
+// one, to the node `n` about to be created: the mode of `n` is restricted
+// by the ACL, and the returned ACLs must be stored with storeACL once `n`
+// exists.
+func (fs *fileSystem) inheritACL(ctx context.Context, dir uint64, n *FileNode) (*inheritedACL, error) {
+	dflt, err := GetACL(ctx, fs.db, dir, ACLDefaultXattr)
+	if err != nil || dflt == nil {
+		return nil, err
+	}
+	inherited := &inheritedACL{}
+	inherited.access, n.Mode = dflt.create(n.Mode)
+	if n.Mode.IsDir() {
+		inherited.dflt = dflt
+	}
+	return inherited, nil
+}
+
+// storeACL stores the ACLs inherited by the new node `n`.
+func (fs *fileSystem) storeACL(ctx context.Context, n *FileNode, inherited *inheritedACL) error {
+	if inherited == nil {
+		return nil
+	}
+	if err := PutACL(ctx, fs.db, n.Inode, ACLAccessXattr, inherited.access); err != nil {
+		return err
+	}
+	return PutACL(ctx, fs.db, n.Inode, ACLDefaultXattr, inherited.dflt)
+}
+
+// checkAccess returns EACCES unless the caller of `hdr` has the access(2)
+// permissions `want` on `n`, according to its ACL or, if `acl` is nil, its
+// mode. Root is granted everything but executing files without any
+// execute bit.
+func (fs *fileSystem) checkAccess(n *FileNode, acl PosixACL, hdr *fuse.Header, want uint16) error {
+	unlock := n.lock()
+	mode, owner, group := n.Mode, n.Uid, n.Gid
+	unlock()
+	if hdr.Uid == 0 {
+		if want&aclExecute == 0 || mode.IsDir() || mode&0111 != 0 {
+			return nil
+		}
+		return fuse.Errno(syscall.EACCES)
+	}
+	if acl == nil {
+		acl = ACLFromMode(mode)
+	}
+	var gids []uint32
+	for _, gid := range callerGroups(hdr) {
+		gids = append(gids, fs.gids.toStored(gid))
+	}
+	if !acl.allows(fs.uids.toStored(hdr.Uid), gids, owner, group, want) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
+
+// checkOpen enforces the access ACL of `n`, if it has one, on open(2).
+// Nodes without ACLs are left to the kernel, as they were before ACLs
+// were supported (see -default-permissions).
+func (fs *fileSystem) checkOpen(ctx context.Context, n *FileNode, req *fuse.OpenRequest) error {
+	acl, err := GetACL(ctx, fs.db, n.Inode, ACLAccessXattr)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	if acl == nil {
+		return nil
+	}
+	var want uint16
+	switch {
+	case req.Flags.IsReadWrite():
+		want = aclRead | aclWrite
+	case req.Flags.IsWriteOnly():
+		want = aclWrite
+	default:
+		want = aclRead
+	}
+	return fs.checkAccess(n, acl, &req.Header, want)
+}
+
+// Access is called for access(2) and reports the permissions granted by
+// the ACL or mode of the node.
+// Access implements the fuseFS.NodeAccesser interface.
+func (n *FileNode) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	want := uint16(req.Mask & 7)
+	if want == 0 {
+		return nil
+	}
+	acl, err := GetACL(ctx, n.fs.db, n.Inode, ACLAccessXattr)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	if want&aclWrite != 0 {
+		unlock := n.lock()
+		immutable := n.immutable()
+		unlock()
+		if immutable {
+			return fuse.EPERM
+		}
+	}
+	return n.fs.checkAccess(n, acl, &req.Header, want)
+}
+
+// callerGroups returns the group of the caller of `hdr` followed by its
+// supplementary groups, which FUSE does not pass along and are read from
+// /proc on Linux.
+func callerGroups(hdr *fuse.Header) []uint32 {
+	gids := []uint32{hdr.Gid}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", hdr.Pid))
+	if err != nil {
+		return gids
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			if gid, err := strconv.ParseUint(field, 10, 32); err == nil {
+				gids = append(gids, uint32(gid))
+			}
+		}
+		break
+	}
+	return gids
+}
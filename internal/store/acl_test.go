@@ -0,0 +1,209 @@
+package store
+
+import (
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// mustParseACL parses an ACL whose named entries are given by ID.
+func mustParseACL(t *testing.T, s string) PosixACL {
+	t.Helper()
+	acl, err := ParseACLText(s)
+	if err != nil {
+		t.Fatalf("ParseACLText(%q) returned %v", s, err)
+	}
+	return acl
+}
+
+func TestParseACLText(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string // In the form of String, or "" for an error.
+	}{
+		{"u::rw-,g::r--,o::r--", "u::rw-,g::r--,o::r--"},
+		{"user::rwx, group::r-x, other::---", "u::rwx,g::r-x,o::---"},
+		// The mask is computed from the group class if it is missing.
+		{"u::rw-,u:1000:r--,g::--x,o::---", "u::rw-,u:1000:r--,g::--x,o::---,m::r-x"},
+		{"u::rw-,g:2000:rw-,g::r--,m::r--,o::---", "u::rw-,g:2000:rw-,g::r--,m::r--,o::---"},
+		{"u::rw-,g::r--", ""},
+		{"u::rw-,u::r--,g::r--,o::---", ""},
+		{"u::rw-,u:1000:r--,u:1000:rw-,g::r--,o::---", ""},
+		{"u::rwz,g::r--,o::---", ""},
+		{"x::rw-,g::r--,o::---", ""},
+		{"u:rw-,g::r--,o::---", ""},
+	} {
+		acl, err := ParseACLText(tc.text)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("ParseACLText(%q) = %s, want an error", tc.text, acl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseACLText(%q) returned %v", tc.text, err)
+			continue
+		}
+		if got := acl.String(); got != tc.want {
+			t.Errorf("ParseACLText(%q) = %s, want %s", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestACLEncoding(t *testing.T) {
+	acl := mustParseACL(t, "o::r--,g:2000:rw-,u:1001:r--,u:1000:rwx,g::r--,u::rw-,m::rwx")
+	got, err := parseACL(acl.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries are encoded by tag, then by ID, as the kernel expects.
+	if want := "u::rw-,u:1000:rwx,u:1001:r--,g::r--,g:2000:rw-,m::rwx,o::r--"; got.String() != want {
+		t.Errorf("decoded ACL = %s, want %s", got, want)
+	}
+
+	entry := func(tag, perm uint16, id uint32) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint16(b, tag)
+		binary.LittleEndian.PutUint16(b[2:], perm)
+		binary.LittleEndian.PutUint32(b[4:], id)
+		return b
+	}
+	value := func(version uint32, entries ...[]byte) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, version)
+		for _, e := range entries {
+			b = append(b, e...)
+		}
+		return b
+	}
+	owner := entry(aclUserObj, 6, aclUndefinedID)
+	group := entry(aclGroupObj, 4, aclUndefinedID)
+	other := entry(aclOther, 0, aclUndefinedID)
+	for name, b := range map[string][]byte{
+		"truncated":     value(aclVersion, owner, group, other)[:27],
+		"version":       value(1, owner, group, other),
+		"no other":      value(aclVersion, owner, group),
+		"no mask":       value(aclVersion, owner, entry(aclUser, 4, 1000), group, other),
+		"bad tag":       value(aclVersion, owner, group, other, entry(0x40, 4, 1)),
+		"bad perm":      value(aclVersion, entry(aclUserObj, 8, aclUndefinedID), group, other),
+		"duplicate IDs": value(aclVersion, owner, entry(aclGroup, 4, 7), entry(aclGroup, 6, 7), group, entry(aclMask, 6, aclUndefinedID), other),
+	} {
+		if acl, err := parseACL(b); err == nil {
+			t.Errorf("parseACL(%s) = %s, want an error", name, acl)
+		}
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	const owner, group = 500, 600
+	named := "u::rw-,u:1000:rwx,g::r-x,g:2000:rw-,m::r--,o::--x"
+	for _, tc := range []struct {
+		acl  string
+		uid  uint32
+		gids []uint32
+		want uint16
+		ok   bool
+	}{
+		// The mask does not apply to the owner or others.
+		{named, owner, nil, aclRead | aclWrite, true},
+		{named, owner, nil, aclExecute, false},
+		{named, 3000, nil, aclExecute, true},
+		{named, 3000, nil, aclRead, false},
+		// Named users and groups get no more than the mask.
+		{named, 1000, nil, aclRead, true},
+		{named, 1000, nil, aclWrite, false},
+		{named, 1000, []uint32{group}, aclExecute, false},
+		{named, 3000, []uint32{2000}, aclRead, true},
+		{named, 3000, []uint32{2000}, aclWrite, false},
+		// So does the owning group when there is a mask.
+		{named, 3000, []uint32{group}, aclRead, true},
+		{named, 3000, []uint32{group}, aclExecute, false},
+		// A matching group entry that does not grant access denies it,
+		// even though the other entry would grant it.
+		{named, 3000, []uint32{2000, group}, aclExecute, false},
+		// Any matching group entry can grant access.
+		{"u::---,g::r--,g:2000:-w-,m::rw-,o::---", 3000, []uint32{group, 2000}, aclWrite, true},
+		// Without a mask, the owning group entry applies as it is.
+		{"u::rw-,g::rwx,o::r--", 3000, []uint32{group}, aclExecute, true},
+		{"u::rw-,g::---,o::r--", 3000, []uint32{group}, aclRead, false},
+		{"u::rw-,g::---,o::r--", 3000, []uint32{700}, aclRead, true},
+	} {
+		acl := mustParseACL(t, tc.acl)
+		if got := acl.allows(tc.uid, tc.gids, owner, group, tc.want); got != tc.ok {
+			t.Errorf("%s allows(%d, %v, %o) = %t, want %t", tc.acl, tc.uid, tc.gids, tc.want, got, tc.ok)
+		}
+	}
+}
+
+func TestACLChmod(t *testing.T) {
+	for _, tc := range []struct {
+		acl  string
+		perm os.FileMode
+		mode os.FileMode
+		want string
+	}{
+		{"u::rw-,g::r--,o::r--", 0644, 0750, "u::rwx,g::r-x,o::---"},
+		// The group bits of the mode are those of the mask, which chmod
+		// sets instead of the owning group entry.
+		{"u::rw-,u:1000:rwx,g::r--,m::rwx,o::r--", 0674, 0640, "u::rw-,u:1000:rwx,g::r--,m::r--,o::---"},
+	} {
+		acl := mustParseACL(t, tc.acl)
+		if got := acl.Perm(); got != tc.perm {
+			t.Errorf("%s Perm() = %o, want %o", tc.acl, got, tc.perm)
+		}
+		got := acl.chmod(tc.mode)
+		if got.String() != tc.want {
+			t.Errorf("%s chmod(%o) = %s, want %s", tc.acl, tc.mode, got, tc.want)
+		}
+		if got.Perm() != tc.mode {
+			t.Errorf("%s chmod(%o) has mode %o", tc.acl, tc.mode, got.Perm())
+		}
+		if acl.String() != tc.acl {
+			t.Errorf("chmod modified %s into %s", tc.acl, acl)
+		}
+	}
+	if !ACLFromMode(0640).minimal() || mustParseACL(t, "u::rw-,u:1000:r--,g::r--,o::---").minimal() {
+		t.Error("minimal() does not tell ACLs with named entries apart")
+	}
+	if got, want := ACLFromMode(os.ModeDir|0751).String(), "u::rwx,g::r-x,o::--x"; got != want {
+		t.Errorf("ACLFromMode(0751) = %s, want %s", got, want)
+	}
+}
+
+func TestACLCreate(t *testing.T) {
+	for _, tc := range []struct {
+		dflt     string
+		mode     os.FileMode
+		want     string
+		wantMode os.FileMode
+	}{
+		// Named entries are inherited as they are, while the mask, which
+		// stands for the group class, is restricted by the mode.
+		{"u::rwx,u:1000:rwx,g::r-x,g:2000:rwx,m::rwx,o::r-x", 0644,
+			"u::rw-,u:1000:rwx,g::r-x,g:2000:rwx,m::r--,o::r--", 0644},
+		{"u::rwx,u:1000:rwx,g::r-x,m::rwx,o::---", os.ModeDir | 0777,
+			"u::rwx,u:1000:rwx,g::r-x,m::rwx,o::---", os.ModeDir | 0770},
+		// Without a mask, the owning group entry is restricted instead.
+		{"u::rwx,g::rwx,o::---", 0640, "u::rw-,g::r--,o::---", 0640},
+		{"u::r-x,g::r-x,o::r-x", 0666, "u::r--,g::r--,o::r--", 0444},
+	} {
+		dflt := mustParseACL(t, tc.dflt)
+		got, mode := dflt.create(tc.mode)
+		if got.String() != tc.want || mode != tc.wantMode {
+			t.Errorf("%s create(%o) = %s, %o, want %s, %o", tc.dflt, tc.mode, got, mode, tc.want, tc.wantMode)
+		}
+		if dflt.String() != tc.dflt {
+			t.Errorf("create modified the default ACL %s into %s", tc.dflt, dflt)
+		}
+	}
+}
+
+func TestACLMapIDs(t *testing.T) {
+	acl := mustParseACL(t, "u::rw-,u:1000:r--,g::r--,g:1000:r--,m::r--,o::---")
+	got := acl.mapIDs(func(id uint32) uint32 { return id + 1 }, func(id uint32) uint32 { return id + 2 })
+	want := mustParseACL(t, "u::rw-,u:1001:r--,g::r--,g:1002:r--,m::r--,o::---")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mapIDs = %s, want %s", got, want)
+	}
+}
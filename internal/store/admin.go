@@ -0,0 +1,307 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// adminServer exposes the state of a mount over HTTP with JSON bodies, so
+// that orchestration systems can monitor and manage mounts:
+//
+//	GET  /status      mount point, subdirectory, PID, uptime and leadership
+//	GET  /stats       operation counters and cache statistics
+//	GET  /ops         operations in flight
+//	GET  /healthz     liveness of the mount (see health.go)
+//	GET  /readyz      readiness of the mount and its database
+//	POST /gc          remove orphaned inodes and data blocks (?dry_run=1)
+//	POST /invalidate  drop the entry, attribute and block caches
+//	POST /flush       write batched access times and pending index updates
+//	POST /log-level   log every FUSE request with ?level=debug, or stop with ?level=info
+//	POST /throttle    replace the rate limits with ?limits=ops=100,bytes=10M,uid-ops=20 or ?limits=off
+//	POST /read-only   refuse writes with ?enabled=on, or accept them again with ?enabled=off
+//	POST /snapshot    take the snapshot ?name=NAME, as `sqlfs snapshot create` does
+//	POST /unmount     unmount gracefully, as on SIGTERM
+type adminServer struct {
+	fs         *fileSystem
+	mountpoint string
+	subdir     string
+	started    time.Time
+
+	// How long entering maintenance mode waits for operations in flight.
+	quiesceTimeout time.Duration
+
+	// Triggers an unmount.
+	unmount func()
+
+	// Returns true while the file system is mounted, nil if unknown.
+	mounted func() bool
+}
+
+type adminStatus struct {
+	Mountpoint string    `json:"mountpoint"`
+	Subdir     string    `json:"subdir"`
+	Pid        int       `json:"pid"`
+	Started    time.Time `json:"started"`
+	Uptime     float64   `json:"uptime_seconds"`
+	// Whether the mount runs background maintenance, if elected.
+	Leader *bool `json:"leader,omitempty"`
+}
+
+type adminStats struct {
+	Ops        opStats           `json:"ops"`
+	Throttle   *throttleStats    `json:"throttle"`
+	DB         *queryBudgetStats `json:"db"`
+	BlockCache *blockCacheStats  `json:"block_cache"`
+	EntryCache *int              `json:"entry_cache_entries"`
+	AttrCache  *int              `json:"attr_cache_inodes"`
+	Missing    *int              `json:"negative_cache_entries"`
+	Batched    *int              `json:"batched_creates"`
+	Appends    *int64            `json:"coalesced_append_bytes"`
+	Scrub      *scrubStats       `json:"scrub,omitempty"`
+	Faults     []faultStats      `json:"injected_faults,omitempty"`
+	DiskFull   bool              `json:"db_disk_full"`
+}
+
+type adminReadOnly struct {
+	// Set through the admin API.
+	ReadOnly bool `json:"read_only"`
+	// Set in the database with `sqlfs maintenance`.
+	Shared bool `json:"shared_read_only"`
+}
+
+type adminLogLevel struct {
+	Level string `json:"level"`
+}
+
+// NewAdminServer returns the admin API of `f`, mounted at `mountpoint`.
+// `mounted` returns true while the file system is mounted, and `unmount`
+// triggers an unmount.
+func NewAdminServer(f *FS, mountpoint string, mounted func() bool, unmount func()) *adminServer {
+	return &adminServer{
+		fs:             &f.fs,
+		mountpoint:     mountpoint,
+		subdir:         f.subdir,
+		started:        time.Now(),
+		quiesceTimeout: f.fs.quiesceTimeout,
+		unmount:        unmount,
+		mounted:        mounted,
+	}
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.get(a.status))
+	mux.HandleFunc("/stats", a.get(a.stats))
+	mux.HandleFunc("/ops", a.get(a.inFlight))
+	mux.HandleFunc("/healthz", a.health(a.liveness))
+	mux.HandleFunc("/readyz", a.health(a.readiness))
+	mux.HandleFunc("/gc", a.post(a.gc))
+	mux.HandleFunc("/invalidate", a.post(a.invalidate))
+	mux.HandleFunc("/flush", a.post(a.flush))
+	mux.HandleFunc("/log-level", a.post(a.logLevel))
+	mux.HandleFunc("/throttle", a.post(a.setThrottle))
+	mux.HandleFunc("/read-only", a.post(a.readOnly))
+	mux.HandleFunc("/snapshot", a.post(a.snapshot))
+	mux.HandleFunc("/unmount", a.post(a.unmountNow))
+	return mux
+}
+
+// Serve serves the API on `l` until ctx is cancelled.
+func (a *adminServer) Serve(ctx context.Context, l net.Listener) {
+	srv := &http.Server{Handler: a.handler()}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Printf("admin server stopped: %s\n", err)
+	}
+}
+
+type adminHandler func(r *http.Request) (interface{}, error)
+
+func (a *adminServer) get(h adminHandler) http.HandlerFunc {
+	return a.method(http.MethodGet, h)
+}
+
+func (a *adminServer) post(h adminHandler) http.HandlerFunc {
+	return a.method(http.MethodPost, h)
+}
+
+// method adapts `h` to only serve requests with the given method and to
+// encode its result as JSON.
+func (a *adminServer) method(method string, h adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := h(r)
+		if err != nil {
+			log.Printf("admin %s %s: %s\n", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+func (a *adminServer) status(r *http.Request) (interface{}, error) {
+	s := adminStatus{
+		Mountpoint: a.mountpoint,
+		Subdir:     a.subdir,
+		Pid:        os.Getpid(),
+		Started:    a.started,
+		Uptime:     time.Since(a.started).Seconds(),
+	}
+	if a.fs.leader != nil {
+		leading := a.fs.leader.Leading()
+		s.Leader = &leading
+	}
+	return s, nil
+}
+
+func (a *adminServer) stats(r *http.Request) (interface{}, error) {
+	return a.fs.stats(), nil
+}
+
+func (a *adminServer) inFlight(r *http.Request) (interface{}, error) {
+	if a.fs.ops == nil {
+		return []inFlightOp{}, nil
+	}
+	return a.fs.ops.InFlight(), nil
+}
+
+func (a *adminServer) gc(r *http.Request) (interface{}, error) {
+	dryRun := r.URL.Query().Get("dry_run") != ""
+	return CollectGarbage(r.Context(), a.fs.db, dryRun)
+}
+
+func (a *adminServer) snapshot(r *http.Request) (interface{}, error) {
+	return CreateSnapshot(r.Context(), a.fs.db, r.URL.Query().Get("name"))
+}
+
+func (a *adminServer) invalidate(r *http.Request) (interface{}, error) {
+	a.fs.dropCaches()
+	return struct{}{}, nil
+}
+
+func (a *adminServer) flush(r *http.Request) (interface{}, error) {
+	a.fs.flush()
+	return struct{}{}, nil
+}
+
+func (a *adminServer) logLevel(r *http.Request) (interface{}, error) {
+	switch level := r.URL.Query().Get("level"); level {
+	case "debug":
+		a.fs.ops.SetVerbose(true)
+	case "info":
+		a.fs.ops.SetVerbose(false)
+	case "":
+	default:
+		return nil, fmt.Errorf("invalid log level %q (must be debug or info)", level)
+	}
+	if a.fs.ops.Verbose() {
+		return adminLogLevel{"debug"}, nil
+	}
+	return adminLogLevel{"info"}, nil
+}
+
+// setThrottle replaces the rate limits, e.g. to lift them for a bulk job,
+// and returns the limits in effect.
+func (a *adminServer) setThrottle(r *http.Request) (interface{}, error) {
+	if limits := r.URL.Query().Get("limits"); limits != "" {
+		l, err := parseThrottleLimits(limits)
+		if err != nil {
+			return nil, err
+		}
+		a.fs.ops.throttle.SetLimits(l)
+		log.Printf("Rate limits changed to %s.\n", limits)
+	}
+	return a.fs.ops.throttle.Limits(), nil
+}
+
+// readOnly enters or leaves maintenance mode. Once entered, it waits for the
+// operations in flight and writes the pending updates, so that the database
+// is no longer written to by the time it returns.
+func (a *adminServer) readOnly(r *http.Request) (interface{}, error) {
+	m := a.fs.maintenance
+	switch enabled := r.URL.Query().Get("enabled"); enabled {
+	case "on":
+		if m.set(true) {
+			log.Println("Entered maintenance mode, refusing writes.")
+		}
+		a.fs.quiesce(a.quiesceTimeout)
+	case "off":
+		m.set(false)
+		log.Println("Left maintenance mode.")
+	case "":
+	default:
+		return nil, fmt.Errorf("invalid value %q (must be on or off)", enabled)
+	}
+	return adminReadOnly{
+		ReadOnly: atomic.LoadInt32(&m.local) != 0,
+		Shared:   atomic.LoadInt32(&m.shared) != 0,
+	}, nil
+}
+
+func (a *adminServer) unmountNow(r *http.Request) (interface{}, error) {
+	a.unmount()
+	return struct{}{}, nil
+}
+
+// stats returns the counters and cache statistics of the mount.
+func (fs fileSystem) stats() adminStats {
+	var s adminStats
+	if fs.ops != nil {
+		s.Ops = fs.ops.Stats()
+		throttle := fs.ops.throttle.Stats()
+		s.Throttle = &throttle
+	}
+	if fs.budget != nil {
+		budget := fs.budget.Stats()
+		s.DB = &budget
+	}
+	if fs.blocks != nil {
+		stats := fs.blocks.Stats()
+		s.BlockCache = &stats
+	}
+	if fs.entries != nil {
+		n := fs.entries.Len()
+		s.EntryCache = &n
+	}
+	if fs.attrs != nil {
+		n := fs.attrs.Len()
+		s.AttrCache = &n
+	}
+	if fs.missing != nil {
+		n := fs.missing.Len()
+		s.Missing = &n
+	}
+	if fs.creates != nil {
+		n := fs.creates.Len()
+		s.Batched = &n
+	}
+	if fs.appends != nil {
+		n := fs.appends.Bytes()
+		s.Appends = &n
+	}
+	if fs.scrubber != nil {
+		stats := fs.scrubber.Stats()
+		s.Scrub = &stats
+	}
+	s.DiskFull = fs.diskFull.Full()
+	if fs.faults != nil {
+		s.Faults = fs.faults.Stats()
+	}
+	return s
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Extended attributes holding the Finder metadata and the resource fork of
+// files on macOS.
+const (
+	finderInfoXattr   = "com.apple.FinderInfo"
+	resourceForkXattr = "com.apple.ResourceFork"
+)
+
+const (
+	finderInfoSize = 32
+	// Resource forks are written in chunks at increasing positions, and
+	// may be larger than other attributes.
+	maxResourceFork = 16 << 20
+)
+
+// isAppleDouble reports whether `name` is an AppleDouble file, in which
+// macOS keeps the metadata of "name" without the "._" prefix on file
+// systems that do not support extended attributes.
+func isAppleDouble(name string) bool {
+	return strings.HasPrefix(name, "._")
+}
+
+// getResourceFork returns the resource fork of `n` from the position
+// requested on, as macOS reads large forks in chunks.
+func (n *FileNode) getResourceFork(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, err := GetXattr(ctx, n.fs.db, n.Inode, req.Name)
+	if err != nil {
+		return xattrError(ctx, err)
+	}
+	if int(req.Position) >= len(value) {
+		value = nil
+	} else {
+		value = value[req.Position:]
+	}
+	if req.Size != 0 && len(value) > int(req.Size) {
+		value = value[:req.Size]
+	}
+	resp.Xattr = value
+	return nil
+}
+
+// setAppleXattr sets the attributes that macOS gives special meaning: the
+// Finder info is always 32 bytes and is removed when cleared, and
+// resource forks are written in chunks at the position of the request.
+func (n *FileNode) setAppleXattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	switch req.Name {
+	case finderInfoXattr:
+		if len(req.Xattr) != finderInfoSize {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		if isZero(req.Xattr) {
+			err := RemoveXattr(ctx, n.fs.db, n.Inode, req.Name)
+			if err == errNoXattr && req.Flags&xattrReplace == 0 {
+				err = nil
+			}
+			if err != nil {
+				return xattrError(ctx, err)
+			}
+			return nil
+		}
+	case resourceForkXattr:
+		end := int64(req.Position) + int64(len(req.Xattr))
+		if end > maxResourceFork {
+			return fuse.Errno(syscall.E2BIG)
+		}
+		if req.Position > 0 {
+			value, err := GetXattr(ctx, n.fs.db, n.Inode, req.Name)
+			if err != nil && err != sql.ErrNoRows {
+				return xattrError(ctx, err)
+			}
+			if err == sql.ErrNoRows && req.Flags&xattrReplace != 0 {
+				return fuse.ErrNoXattr
+			}
+			if int64(len(value)) < end {
+				value = append(value, make([]byte, end-int64(len(value)))...)
+			}
+			copy(value[req.Position:], req.Xattr)
+			if err := SetXattr(ctx, n.fs.db, n.Inode, req.Name, value, 0); err != nil {
+				return xattrError(ctx, err)
+			}
+			return nil
+		}
+	}
+	if err := SetXattr(ctx, n.fs.db, n.Inode, req.Name, req.Xattr, req.Flags); err != nil {
+		return xattrError(ctx, err)
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
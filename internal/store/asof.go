@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// errHistorical is returned when a transaction is started on a historical
+// connection, as they are read-only.
+var errHistorical = errors.New("historical connections are read-only")
+
+// NewHistoricalConnector connects to the database at `url` and reads it as
+// of `asOf`, which is anything accepted by CockroachDB's AS OF SYSTEM TIME,
+// e.g. '2024-01-01 00:00' or '-1h'.
+//
+// The file system queries run outside of explicit transactions, so each
+// connection of the pool instead opens a historical transaction as soon as
+// it is established and runs every query in it. These transactions are
+// read-only and never conflict with writers, but they fail once the
+// timestamp falls out of the garbage collection window of the tables.
+func NewHistoricalConnector(url, asOf string) (driver.Connector, error) {
+	c, err := pq.NewConnector(url)
+	if err != nil {
+		return nil, err
+	}
+	return &asOfConnector{Connector: c, asOf: asOf}, nil
+}
+
+// asOfConnector opens connections running in a historical transaction.
+type asOfConnector struct {
+	*pq.Connector
+	asOf string
+}
+
+// Connect implements driver.Connector.
+func (c *asOfConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hc := &asOfConn{Conn: conn}
+	if _, err := hc.ExecContext(ctx, "BEGIN AS OF SYSTEM TIME "+pq.QuoteLiteral(c.asOf), nil); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return hc, nil
+}
+
+// asOfConn runs all statements in the historical transaction opened by
+// asOfConnector. A failed statement aborts the transaction, after which the
+// connection is discarded from the pool.
+type asOfConn struct {
+	driver.Conn
+	broken bool
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *asOfConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		c.broken = true
+		return nil, err
+	}
+	return &asOfRows{Rows: rows, conn: c}, nil
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *asOfConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err != nil {
+		c.broken = true
+	}
+	return res, err
+}
+
+// Begin implements driver.Conn.
+func (c *asOfConn) Begin() (driver.Tx, error) {
+	return nil, errHistorical
+}
+
+// IsValid implements driver.Validator.
+func (c *asOfConn) IsValid() bool {
+	return !c.broken
+}
+
+// asOfRows marks its connection as broken if reading rows fails.
+type asOfRows struct {
+	driver.Rows
+	conn *asOfConn
+}
+
+// Next implements driver.Rows.
+func (r *asOfRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		r.conn.broken = true
+	}
+	return err
+}
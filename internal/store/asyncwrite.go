@@ -0,0 +1,245 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+const (
+	// Number of goroutines committing queued writes. Writes to the same
+	// inode are always committed by one of them at a time, in order.
+	asyncWriteWorkers = 4
+
+	// Upper bound on the size of the contiguous writes merged into a single
+	// transaction.
+	asyncWriteBatchSize = 4 << 20
+)
+
+// asyncWriter commits writes to the database in the background, so that
+// write(2) returns as soon as the data is queued. The queued data is bounded
+// by a budget: writers block once it is used up, until enough queued writes
+// are committed.
+//
+// Queued writes are not visible in the database yet, so reads, truncations
+// and unlinks of an inode wait for its writes first. Failed writes are
+// reported by the next fsync(2) or close(2) of the file, like the kernel
+// does for write-back errors.
+type asyncWriter struct {
+	mu   sync.Mutex
+	cond *sync.Cond // Signaled whenever writes are queued or committed.
+
+	budget int64
+	queued int64 // Bytes queued or being committed.
+
+	pending map[uint64]*inodeWrites
+	ready   []uint64 // Inodes with queued writes and no worker.
+	errs    map[uint64]error
+}
+
+// inodeWrites are the writes queued for an inode.
+type inodeWrites struct {
+	n       *FileNode
+	writes  []pendingWrite
+	inReady bool // The inode is in asyncWriter.ready.
+	busy    bool // A worker is committing writes of the inode.
+}
+
+type pendingWrite struct {
+	offset int64
+	data   []byte
+}
+
+func newAsyncWriter(budget int64) *asyncWriter {
+	w := &asyncWriter{
+		budget:  budget,
+		pending: make(map[uint64]*inodeWrites),
+		errs:    make(map[uint64]error),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	for i := 0; i < asyncWriteWorkers; i++ {
+		go w.work()
+	}
+	return w
+}
+
+// Enqueue queues a copy of `data` to be written at `offset` of `n`. It
+// blocks while the budget is used up, unless nothing is queued at all, so
+// that writes larger than the budget still go through.
+func (w *asyncWriter) Enqueue(n *FileNode, offset int64, data []byte) {
+	size := int64(len(data))
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.queued > 0 && w.queued+size > w.budget {
+		w.cond.Wait()
+	}
+	w.queued += size
+	iw, ok := w.pending[n.Inode]
+	if !ok {
+		iw = &inodeWrites{n: n}
+		w.pending[n.Inode] = iw
+	}
+	iw.writes = append(iw.writes, pendingWrite{offset: offset, data: buf})
+	if !iw.busy && !iw.inReady {
+		iw.inReady = true
+		w.ready = append(w.ready, n.Inode)
+	}
+	w.cond.Broadcast()
+}
+
+// Wait blocks until all writes queued for `inode` are committed.
+func (w *asyncWriter) Wait(inode uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.pending[inode] != nil {
+		w.cond.Wait()
+	}
+}
+
+// WaitAll blocks until all queued writes are committed.
+func (w *asyncWriter) WaitAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.pending) > 0 {
+		w.cond.Wait()
+	}
+}
+
+// Err returns and clears the error of the first write of `inode` that failed
+// since the last call.
+func (w *asyncWriter) Err(inode uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.errs[inode]
+	delete(w.errs, inode)
+	return err
+}
+
+// Queued returns the number of bytes waiting to be committed.
+func (w *asyncWriter) Queued() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.queued
+}
+
+func (w *asyncWriter) work() {
+	w.mu.Lock()
+	for {
+		for len(w.ready) == 0 {
+			w.cond.Wait()
+		}
+		inode := w.ready[0]
+		w.ready = w.ready[1:]
+		iw := w.pending[inode]
+		iw.inReady = false
+		iw.busy = true
+		writes := iw.writes
+		iw.writes = nil
+		w.mu.Unlock()
+
+		var size int64
+		var firstErr error
+		for _, pw := range mergeWrites(writes) {
+			size += int64(len(pw.data))
+			if firstErr != nil {
+				continue // Later writes may depend on the failed one.
+			}
+			if err := iw.n.fs.commitWrite(context.Background(), iw.n, pw.offset, pw.data); err != nil {
+				log.Printf("failed to write inode %d: %s\n", inode, err)
+				firstErr = err
+			}
+		}
+
+		w.mu.Lock()
+		w.queued -= size
+		if firstErr != nil && w.errs[inode] == nil {
+			w.errs[inode] = firstErr
+		}
+		iw.busy = false
+		if len(iw.writes) > 0 {
+			iw.inReady = true
+			w.ready = append(w.ready, inode)
+		} else {
+			delete(w.pending, inode)
+		}
+		w.cond.Broadcast()
+	}
+}
+
+// mergeWrites merges the consecutive writes in `writes` that each continue
+// right where the previous one ended, such as the chunks of a large
+// sequential write, up to asyncWriteBatchSize bytes.
+func mergeWrites(writes []pendingWrite) []pendingWrite {
+	var merged []pendingWrite
+	for _, pw := range writes {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.offset+int64(len(last.data)) == pw.offset && len(last.data)+len(pw.data) <= asyncWriteBatchSize {
+				last.data = append(last.data, pw.data...)
+				continue
+			}
+		}
+		merged = append(merged, pw)
+	}
+	return merged
+}
+
+// commitWrite stores `data` at `offset` of `n` and drops the cached state
+// that it makes stale. The times of `n` are set by the caller when the
+// write is received, and must not move later: with the writeback cache,
+// the kernel sets them itself once it has written dirty pages back.
+func (fs fileSystem) commitWrite(ctx context.Context, n *FileNode, offset int64, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	unlock := n.lock()
+	// The lease taken when the write was received may have been released
+	// since, if it was queued for long.
+	err := fs.leaseInode(ctx, n)
+	generation := n.Generation
+	if err == nil {
+		err = writeBlocks(ctx, fs.db, n, offset, data)
+		fs.diskFull.record(err)
+	}
+	// Unless this write was the only change, another mount or node of the
+	// file changed it since it was cached.
+	foreign := n.Generation != generation+1
+	unlock()
+	if err != nil {
+		return err
+	}
+	fs.invalidateInode(n.Inode)
+	end := offset + int64(len(data))
+	if foreign {
+		fs.invalidateBlocks(n.Inode, 0, -1)
+	} else {
+		fs.invalidateBlocks(n.Inode, offset/fs.db.BlockSize, (end+fs.db.BlockSize-1)/fs.db.BlockSize)
+	}
+	fs.indexContent(n.Inode)
+	return nil
+}
+
+// waitWrites blocks until the writes of `inode` queued for the background
+// or kept in memory as appends are committed.
+func (fs fileSystem) waitWrites(inode uint64) {
+	fs.flushAppends(inode)
+	if fs.writes != nil {
+		fs.writes.Wait(inode)
+	}
+}
+
+// syncWrites waits for the queued writes of `inode` and returns the error of
+// the first of them that failed since the last call.
+func (fs fileSystem) syncWrites(inode uint64) error {
+	if err := fs.syncAppends(inode); err != nil {
+		return err
+	}
+	if fs.writes == nil {
+		return nil
+	}
+	fs.writes.Wait(inode)
+	return fs.writes.Err(inode)
+}
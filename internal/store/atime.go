@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// atimeMode controls how the access time of a file is updated on reads.
+// These mirror the strictatime, relatime and noatime mount options on Linux.
+type atimeMode int
+
+const (
+	// atimeStrict updates the access time on every read. Updates are
+	// batched and flushed asynchronously to avoid a write per read.
+	atimeStrict atimeMode = iota
+	// atimeRelative only updates the access time if the previous access time
+	// is earlier than the last modification or change time, or if it is
+	// older than relatimeInterval.
+	atimeRelative
+	// atimeNone never updates the access time.
+	atimeNone
+)
+
+const (
+	// Same threshold used by the Linux kernel for relatime.
+	relatimeInterval = 24 * time.Hour
+
+	// How often batched access time updates are written to the database.
+	atimeFlushInterval = time.Second
+)
+
+func parseAtimeMode(s string) (atimeMode, error) {
+	switch s {
+	case "strict":
+		return atimeStrict, nil
+	case "relatime":
+		return atimeRelative, nil
+	case "noatime":
+		return atimeNone, nil
+	}
+	return 0, fmt.Errorf("invalid atime mode %q (must be strict, relatime or noatime)", s)
+}
+
+// needsUpdate returns true if the access time of `n` should be updated to
+// `now` under the given mode.
+func (m atimeMode) needsUpdate(n *FileNode, now time.Time) bool {
+	switch m {
+	case atimeStrict:
+		return true
+	case atimeRelative:
+		if !n.Atime.After(n.Mtime) || !n.Atime.After(n.Ctime) {
+			return true
+		}
+		return now.Sub(n.Atime) >= relatimeInterval
+	}
+	return false
+}
+
+// atimeUpdater batches access time updates in memory and periodically
+// writes them to the database in the background. Only the latest access
+// time of each inode is kept.
+type atimeUpdater struct {
+	db *DB
+
+	mu      sync.Mutex
+	pending map[uint64]time.Time
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newAtimeUpdater(db *DB) *atimeUpdater {
+	u := &atimeUpdater{
+		db:      db,
+		pending: make(map[uint64]time.Time),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go u.run()
+	return u
+}
+
+// Queue records that `inode` was accessed at `t`.
+func (u *atimeUpdater) Queue(inode uint64, t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if prev, ok := u.pending[inode]; !ok || t.After(prev) {
+		u.pending[inode] = t
+	}
+}
+
+func (u *atimeUpdater) run() {
+	defer close(u.doneCh)
+	ticker := time.NewTicker(atimeFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.flush()
+		case <-u.stopCh:
+			u.flush()
+			return
+		}
+	}
+}
+
+func (u *atimeUpdater) flush() {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[uint64]time.Time)
+	u.mu.Unlock()
+
+	ctx := context.Background()
+	for inode, t := range pending {
+		if err := UpdateNodeAtime(ctx, u.db, inode, t); err != nil {
+			log.Printf("failed to update atime of inode %d: %s\n", inode, err)
+		}
+	}
+}
+
+// Close flushes all pending updates and stops the background goroutine.
+func (u *atimeUpdater) Close() {
+	close(u.stopCh)
+	<-u.doneCh
+}
+
+// touchAtime records a read access of `n` according to the atime mode of the
+// file system.
+func (fs fileSystem) touchAtime(n *FileNode) {
+	if fs.atime == nil || fs.readOnly() {
+		return
+	}
+	now := time.Now()
+	unlock := n.lock()
+	defer unlock()
+	if !fs.atimeMode.needsUpdate(n, now) {
+		return
+	}
+	n.Atime = now
+	fs.atime.Queue(n.Inode, now)
+}
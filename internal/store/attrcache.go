@@ -0,0 +1,150 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How long prefetched attributes are served. This bounds how stale they
+	// can be when another mount modifies the same files.
+	attrCacheTTL = time.Second
+	// Number of inodes above which expired attributes are dropped.
+	attrCacheSize = 100000
+)
+
+// dirAttrs are the attributes of an entry, as prefetched with the other
+// entries of its directory: its node, the bytes stored for it and, for
+// directories, the number of subdirectories, which make up its link count.
+type dirAttrs struct {
+	node    FileNode
+	stored  uint64
+	subdirs int
+}
+
+type cachedAttrs struct {
+	dirAttrs
+	expires time.Time
+}
+
+// attrCache holds the attributes of the entries of directories that were
+// just listed, so that programs that stat every entry they list, such as
+// rsync or `ls -l`, do not take one round trip to the database per entry
+// for the lookup and another for the attributes.
+type attrCache struct {
+	settings *settings // Settings of the names cached.
+
+	mu    sync.Mutex
+	attrs map[uint64]cachedAttrs
+	names map[entryKey]uint64
+}
+
+func newAttrCache(s *settings) *attrCache {
+	return &attrCache{
+		settings: s,
+		attrs:    make(map[uint64]cachedAttrs),
+		names:    make(map[entryKey]uint64),
+	}
+}
+
+// Put caches the attributes of the entries of the directory `parent`.
+func (c *attrCache) Put(parent uint64, entries []dirAttrs) {
+	c.PutFor(parent, entries, attrCacheTTL)
+}
+
+// PutFor caches the attributes of the entries of the directory `parent` for
+// `ttl` instead of attrCacheTTL.
+func (c *attrCache) PutFor(parent uint64, entries []dirAttrs, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.attrs)+len(entries) > attrCacheSize {
+		c.dropExpired(now)
+	}
+	expires := now.Add(ttl)
+	for _, e := range entries {
+		c.attrs[e.node.Inode] = cachedAttrs{dirAttrs: e, expires: expires}
+		c.names[entryKey{parent, c.settings.foldName(e.node.Name)}] = e.node.Inode
+	}
+}
+
+// dropExpired drops the attributes that expired at `now`.
+func (c *attrCache) dropExpired(now time.Time) {
+	for inode, e := range c.attrs {
+		if now.After(e.expires) {
+			delete(c.attrs, inode)
+		}
+	}
+	for key, inode := range c.names {
+		if _, ok := c.attrs[inode]; !ok {
+			delete(c.names, key)
+		}
+	}
+}
+
+// Get returns the cached attributes of `inode`.
+func (c *attrCache) Get(inode uint64) (dirAttrs, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(inode)
+}
+
+func (c *attrCache) get(inode uint64) (dirAttrs, bool) {
+	e, ok := c.attrs[inode]
+	if !ok {
+		return dirAttrs{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.attrs, inode)
+		return dirAttrs{}, false
+	}
+	return e.dirAttrs, true
+}
+
+// Lookup returns a copy of the cached node of the entry `name` in `parent`.
+func (c *attrCache) Lookup(parent uint64, name string) (*FileNode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := entryKey{parent, c.settings.foldName(name)}
+	inode, ok := c.names[key]
+	if !ok {
+		return nil, false
+	}
+	e, ok := c.get(inode)
+	if !ok || e.node.Parent != parent || c.settings.foldName(e.node.Name) != key.name {
+		delete(c.names, key)
+		return nil, false
+	}
+	n := e.node
+	return &n, true
+}
+
+// Invalidate drops the attributes of `inode`.
+func (c *attrCache) Invalidate(inode uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.attrs, inode)
+}
+
+// InvalidateEntry drops the entry `name` in `parent`.
+func (c *attrCache) InvalidateEntry(parent uint64, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.names, entryKey{parent, c.settings.foldName(name)})
+}
+
+// Len returns the number of inodes with cached attributes, including
+// expired ones that have not been dropped yet.
+func (c *attrCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.attrs)
+}
+
+// Purge drops all cached attributes.
+func (c *attrCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attrs = make(map[uint64]cachedAttrs)
+	c.names = make(map[entryKey]uint64)
+}
@@ -0,0 +1,651 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Backups written by `sqlfs backup` hold the settings, tree, inodes,
+// extended attributes and data blocks of a file system, all read as of a
+// single timestamp so that they are consistent without stopping the
+// mounts, and `sqlfs restore` loads them into an empty database. Unlike
+// pg_dump or BACKUP, they do not depend on the tools or version of the
+// database. CockroachDB only, as they rely on AS OF SYSTEM TIME.
+//
+// A backup file is a sequence of gzip members, each a gob stream of
+// backupRecords ending with the backupCursor from which the database is read
+// next. An interrupted backup is resumed by cutting the file after its last
+// complete member and reading the database from that cursor, at the same
+// timestamp, which fails once the timestamp falls out of the garbage
+// collection window of the tables. A backup is complete once its last cursor
+// is at backupDone.
+//
+// Incremental backups hold the metadata in full, but only the data blocks
+// written since the backup they are based on, as told by the MVCC timestamps
+// of the rows, which every writer of the database updates. The keys of the
+// unchanged blocks are listed as well, so that restoring the backup removes
+// the blocks deleted since.
+
+// Version of the backup format written by this binary.
+const backupVersion = 1
+
+// Most rows, and bytes of data blocks, read per query, and so written per
+// gzip member.
+const (
+	backupPageRows  = 1000
+	backupPageBytes = 32 << 20
+)
+
+// Tables backed up, in order, and backupDone once all were.
+const (
+	backupSettings = "settings"
+	backupInodes   = "inodes"
+	backupTree     = "tree"
+	backupXattrs   = "xattrs"
+	backupTiered   = "tiered_files"
+	backupBlocks   = "data_blocks"
+	backupDone     = "done"
+)
+
+var backupStages = []string{backupSettings, backupInodes, backupTree, backupXattrs, backupTiered, backupBlocks, backupDone}
+
+// Optional tables recreated, empty, by restores. The tiered files are
+// backed up, but not the objects they point to.
+var backupOptionalTables = []string{"tiered_files", "ops_log", "snapshots", "file_hashes", "file_text"}
+
+// BackupHeader is the first record of a backup.
+type BackupHeader struct {
+	Version    int
+	Superblock *superblock // nil for file systems without one
+	// HLC timestamp the database is read at, and the time it stands for.
+	AsOf string
+	Time time.Time
+	// AsOf of the backup this one is incremental to, "" for full backups.
+	Base string
+	// Features of the file system that are not settings.
+	Checksums bool
+	Tables    []string
+}
+
+// backupRecord holds a single one of its fields.
+type backupRecord struct {
+	Header  *BackupHeader
+	Setting *backupSetting
+	Inode   *backupInode
+	Entry   *backupEntry
+	Xattr   *backupXattr
+	Tiered  *backupTieredFile
+	Block   *backupBlock
+	Cursor  *backupCursor
+}
+
+type backupSetting struct {
+	Name, Value string
+}
+
+type backupInode struct {
+	Node   FileNode
+	Inline []byte
+}
+
+type backupEntry struct {
+	Parent, Inode uint64
+	Name          string
+}
+
+type backupXattr struct {
+	Inode uint64
+	Name  string
+	Value []byte
+}
+
+type backupTieredFile struct {
+	Inode  uint64
+	Object string
+	Size   int64
+}
+
+// backupBlock is a data block, or only its key if the block is unchanged
+// since the base of an incremental backup.
+type backupBlock struct {
+	Inode     uint64
+	Sequence  int64
+	Data      []byte
+	Unchanged bool
+}
+
+// backupCursor is the position of a backup in the database: the stage it is
+// at and the key of the last row it read in that stage, if any.
+type backupCursor struct {
+	Stage    string
+	Inode    uint64 // or parent, for the tree
+	Name     string
+	Sequence int64
+	Stats    BackupStats
+}
+
+// BackupStats counts the rows written to a backup.
+type BackupStats struct {
+	Inodes, Entries, Xattrs, Blocks int64
+	Bytes                           int64 // of data blocks
+}
+
+// hlcTime returns the time of the HLC timestamp `ts`, e.g.
+// "1546300800000000000.0000000001".
+func hlcTime(ts string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(strings.SplitN(ts, ".", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid timestamp %q", ts)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// backupWriter writes the records of a backup to a file.
+type backupWriter struct {
+	f   *os.File
+	zw  *gzip.Writer
+	enc *gob.Encoder
+}
+
+func newBackupWriter(f *os.File) *backupWriter {
+	zw := gzip.NewWriter(f)
+	return &backupWriter{f: f, zw: zw, enc: gob.NewEncoder(zw)}
+}
+
+// Put writes `r` to the current member.
+func (w *backupWriter) Put(r *backupRecord) error {
+	return w.enc.Encode(r)
+}
+
+// Checkpoint ends the current member with `c` and flushes it to disk, so
+// that the backup can be resumed from `c`.
+func (w *backupWriter) Checkpoint(c backupCursor) error {
+	if err := w.enc.Encode(&backupRecord{Cursor: &c}); err != nil {
+		return err
+	}
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.zw.Reset(w.f)
+	w.enc = gob.NewEncoder(w.zw)
+	return nil
+}
+
+// backupReader reads the records of a backup file.
+type backupReader struct {
+	f   *os.File
+	br  *bufio.Reader
+	zr  *gzip.Reader
+	dec *gob.Decoder
+
+	// Cursor ending the last complete member read, and the offset in the
+	// file right after that member.
+	cursor  *backupCursor
+	end     int64
+	pending *backupCursor
+}
+
+// OpenBackup opens the backup file at `path` and reads its header.
+func OpenBackup(path string) (*backupReader, *BackupHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &backupReader{f: f, br: bufio.NewReader(f)}
+	h, err := r.Header()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return r, h, nil
+}
+
+// Header reads the header of the backup, which comes first.
+func (r *backupReader) Header() (*BackupHeader, error) {
+	rec, err := r.Next()
+	if err == io.EOF || err == nil && rec.Header == nil {
+		return nil, errors.New("not a backup file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.Header.Version != backupVersion {
+		return nil, errors.Errorf("unsupported backup version %d", rec.Header.Version)
+	}
+	return rec.Header, nil
+}
+
+// Next returns the next record of the backup, or io.EOF at the end of the
+// file. Records may come from a truncated member, whose records are only
+// valid if the member completes.
+func (r *backupReader) Next() (*backupRecord, error) {
+	for {
+		if r.dec == nil {
+			var err error
+			if r.zr == nil {
+				r.zr, err = gzip.NewReader(r.br)
+			} else {
+				err = r.zr.Reset(r.br)
+			}
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "damaged backup")
+			}
+			r.zr.Multistream(false)
+			r.dec = gob.NewDecoder(r.zr)
+		}
+		var rec backupRecord
+		err := r.dec.Decode(&rec)
+		if err == io.EOF {
+			// The gzip checksum of the member matched.
+			pos, err := r.f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			r.end = pos - int64(r.br.Buffered())
+			r.cursor, r.pending = r.pending, nil
+			r.dec = nil
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "damaged or truncated backup")
+		}
+		if rec.Cursor != nil {
+			r.pending = rec.Cursor
+		}
+		return &rec, nil
+	}
+}
+
+// Complete reads the rest of the backup and returns whether it is complete.
+func (r *backupReader) Complete() (bool, error) {
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			return r.cursor != nil && r.cursor.Stage == backupDone, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// Close closes the backup file.
+func (r *backupReader) Close() error {
+	return r.f.Close()
+}
+
+// CheckBackupChain checks that the backups at `paths` are a full backup
+// followed by incremental backups each based on the one before, and returns
+// their headers. With `complete`, the backups are read whole, which checks
+// the gzip checksums of their contents, and must be complete.
+func CheckBackupChain(paths []string, complete bool) ([]*BackupHeader, error) {
+	var headers []*BackupHeader
+	for i, path := range paths {
+		r, h, err := OpenBackup(path)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if complete {
+			ok, err = r.Complete()
+		}
+		_ = r.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", path)
+		}
+		if complete && !ok {
+			return nil, errors.Errorf("%s is incomplete, resume it with `sqlfs backup -resume`", path)
+		}
+		if i == 0 && h.Base != "" {
+			return nil, errors.Errorf("%s is an incremental backup, the full backup it is based on must come first", path)
+		}
+		if i > 0 {
+			prev := headers[i-1]
+			if h.Base != prev.AsOf {
+				return nil, errors.Errorf("%s is not based on the backup before it", path)
+			}
+			if h.Superblock != nil && prev.Superblock != nil && h.Superblock.UUID != prev.Superblock.UUID {
+				return nil, errors.Errorf("%s is a backup of another file system", path)
+			}
+		}
+		headers = append(headers, h)
+	}
+	return headers, nil
+}
+
+// backup reads a file system as of a timestamp and writes it to a
+// backupWriter.
+type backup struct {
+	ctx    context.Context
+	db     *DB // historical
+	w      *backupWriter
+	header *BackupHeader
+	cursor backupCursor
+}
+
+// WriteBackup writes a backup of the file system of the database at `url`
+// to `f`, and returns its header. The backup is incremental to the backup
+// with the header `base`, if not nil.
+func WriteBackup(ctx context.Context, url string, f *os.File, base *BackupHeader) (*BackupHeader, BackupStats, error) {
+	c, err := pq.NewConnector(url)
+	if err != nil {
+		return nil, BackupStats{}, err
+	}
+	live, err := OpenFileSystem(c)
+	if err != nil {
+		return nil, BackupStats{}, err
+	}
+	var asOf string
+	err = live.QueryRowContext(ctx, "SELECT cluster_logical_timestamp()::STRING").Scan(&asOf)
+	_ = live.Close()
+	if err != nil {
+		return nil, BackupStats{}, errors.Wrap(err, "failed to read the current timestamp (CockroachDB only)")
+	}
+	t, err := hlcTime(asOf)
+	if err != nil {
+		return nil, BackupStats{}, err
+	}
+	b, err := openBackupSource(ctx, url, asOf)
+	if err != nil {
+		return nil, BackupStats{}, err
+	}
+	defer b.db.Close()
+
+	h := &BackupHeader{Version: backupVersion, AsOf: asOf, Time: t, Checksums: b.db.BlockChecksums}
+	if h.Superblock, err = GetSuperblock(ctx, b.db); err != nil {
+		return nil, BackupStats{}, err
+	}
+	for _, table := range backupOptionalTables {
+		exists, err := TableExists(ctx, b.db, table)
+		if err != nil {
+			return nil, BackupStats{}, errors.Wrap(err, "failed to check the database schema")
+		}
+		if exists {
+			h.Tables = append(h.Tables, table)
+		}
+	}
+	if base != nil {
+		if base.Superblock == nil || h.Superblock == nil || base.Superblock.UUID != h.Superblock.UUID {
+			return nil, BackupStats{}, errors.New("the base backup is of another file system")
+		}
+		h.Base = base.AsOf
+	}
+	b.header = h
+	b.w = newBackupWriter(f)
+	if err := b.w.Put(&backupRecord{Header: h}); err != nil {
+		return nil, BackupStats{}, err
+	}
+	b.cursor = backupCursor{Stage: backupSettings}
+	if err := b.w.Checkpoint(b.cursor); err != nil {
+		return nil, BackupStats{}, err
+	}
+	err = b.run()
+	return h, b.cursor.Stats, err
+}
+
+// ResumeBackup resumes writing the interrupted backup `f`, and returns its
+// header.
+func ResumeBackup(ctx context.Context, url string, f *os.File) (*BackupHeader, BackupStats, error) {
+	r := &backupReader{f: f, br: bufio.NewReader(f)}
+	h, err := r.Header()
+	if err != nil {
+		return nil, BackupStats{}, err
+	}
+	// What follows the last complete member is discarded.
+	for {
+		if _, err := r.Next(); err != nil {
+			break
+		}
+	}
+	if r.cursor == nil {
+		return nil, BackupStats{}, errors.New("the backup has no complete part to resume from, start it over")
+	}
+	if r.cursor.Stage == backupDone {
+		return nil, BackupStats{}, errors.New("the backup is already complete")
+	}
+	if err := f.Truncate(r.end); err != nil {
+		return nil, BackupStats{}, err
+	}
+	if _, err := f.Seek(r.end, io.SeekStart); err != nil {
+		return nil, BackupStats{}, err
+	}
+
+	b, err := openBackupSource(ctx, url, h.AsOf)
+	if err != nil {
+		return nil, BackupStats{}, err
+	}
+	defer b.db.Close()
+	b.header = h
+	b.w = newBackupWriter(f)
+	b.cursor = *r.cursor
+	err = b.run()
+	return h, b.cursor.Stats, err
+}
+
+// openBackupSource opens the database at `url` as of `asOf`.
+func openBackupSource(ctx context.Context, url, asOf string) (*backup, error) {
+	connector, err := NewHistoricalConnector(url, asOf)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenFileSystem(connector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the database as of %s (past the garbage collection window?)", asOf)
+	}
+	return &backup{ctx: ctx, db: db}, nil
+}
+
+// run backs up the stages from the cursor on.
+func (b *backup) run() error {
+	for b.cursor.Stage != backupDone {
+		var err error
+		switch b.cursor.Stage {
+		case backupSettings:
+			err = b.backupSettings()
+		case backupInodes:
+			err = b.pages(backupPageRows, b.backupInodes)
+		case backupTree:
+			err = b.pages(backupPageRows, b.backupTree)
+		case backupXattrs:
+			if b.db.XattrsEnabled {
+				err = b.pages(backupPageRows, b.backupXattrs)
+			}
+		case backupTiered:
+			if b.hasTable("tiered_files") {
+				err = b.pages(backupPageRows, b.backupTieredFiles)
+			}
+		case backupBlocks:
+			rows := int(backupPageBytes / b.db.BlockSize)
+			if rows > backupPageRows {
+				rows = backupPageRows
+			} else if rows < 1 {
+				rows = 1
+			}
+			err = b.pages(rows, b.backupBlocks)
+		default:
+			return errors.Errorf("unknown backup stage %q", b.cursor.Stage)
+		}
+		if err != nil {
+			return err
+		}
+		for i, stage := range backupStages {
+			if stage == b.cursor.Stage {
+				b.cursor = backupCursor{Stage: backupStages[i+1], Stats: b.cursor.Stats}
+				break
+			}
+		}
+		if err := b.w.Checkpoint(b.cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backup) hasTable(name string) bool {
+	for _, table := range b.header.Tables {
+		if table == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pages calls `page` with a limit of `limit` rows until it returns fewer
+// rows, checkpointing after each page.
+func (b *backup) pages(limit int, page func(limit int) (int, error)) error {
+	for {
+		count, err := page(limit)
+		if err != nil {
+			return err
+		}
+		if count < limit {
+			return nil
+		}
+		if err := b.w.Checkpoint(b.cursor); err != nil {
+			return err
+		}
+	}
+}
+
+// query calls `scan` for each row of `q`, and returns the number of rows.
+func (b *backup) query(q string, args []interface{}, scan func(rows *sql.Rows) error) (int, error) {
+	rows, err := b.db.QueryContext(b.ctx, q, args...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to back up %s", b.cursor.Stage)
+	}
+	defer rows.Close()
+	var count int
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+func (b *backup) backupSettings() error {
+	_, err := b.query("SELECT name, value FROM settings ORDER BY name", nil, func(rows *sql.Rows) error {
+		var s backupSetting
+		if err := rows.Scan(&s.Name, &s.Value); err != nil {
+			return err
+		}
+		return b.w.Put(&backupRecord{Setting: &s})
+	})
+	return err
+}
+
+func (b *backup) backupInodes(limit int) (int, error) {
+	q := "SELECT inode, " + inodeColumns
+	if b.db.inlineDataSize > 0 {
+		q += ", inline_data"
+	} else {
+		q += ", NULL::BYTES"
+	}
+	q += " FROM inodes WHERE inode > $1 ORDER BY inode LIMIT $2"
+	return b.query(q, []interface{}{b.cursor.Inode, limit}, func(rows *sql.Rows) error {
+		var i backupInode
+		n := &i.Node
+		dest := append([]interface{}{&n.Inode}, inodeFields(n)...)
+		if err := rows.Scan(append(dest, &i.Inline)...); err != nil {
+			return err
+		}
+		b.cursor.Inode = n.Inode
+		b.cursor.Stats.Inodes++
+		return b.w.Put(&backupRecord{Inode: &i})
+	})
+}
+
+func (b *backup) backupTree(limit int) (int, error) {
+	q := "SELECT parent, name, inode FROM tree WHERE (parent, name) > ($1, $2) ORDER BY parent, name LIMIT $3"
+	return b.query(q, []interface{}{b.cursor.Inode, b.cursor.Name, limit}, func(rows *sql.Rows) error {
+		var e backupEntry
+		if err := rows.Scan(&e.Parent, &e.Name, &e.Inode); err != nil {
+			return err
+		}
+		b.cursor.Inode, b.cursor.Name = e.Parent, e.Name
+		b.cursor.Stats.Entries++
+		return b.w.Put(&backupRecord{Entry: &e})
+	})
+}
+
+func (b *backup) backupXattrs(limit int) (int, error) {
+	q := "SELECT inode, name, value FROM xattrs WHERE (inode, name) > ($1, $2) ORDER BY inode, name LIMIT $3"
+	return b.query(q, []interface{}{b.cursor.Inode, b.cursor.Name, limit}, func(rows *sql.Rows) error {
+		var x backupXattr
+		if err := rows.Scan(&x.Inode, &x.Name, &x.Value); err != nil {
+			return err
+		}
+		b.cursor.Inode, b.cursor.Name = x.Inode, x.Name
+		b.cursor.Stats.Xattrs++
+		return b.w.Put(&backupRecord{Xattr: &x})
+	})
+}
+
+func (b *backup) backupTieredFiles(limit int) (int, error) {
+	q := "SELECT inode, object, size FROM tiered_files WHERE inode > $1 ORDER BY inode LIMIT $2"
+	return b.query(q, []interface{}{b.cursor.Inode, limit}, func(rows *sql.Rows) error {
+		var t backupTieredFile
+		if err := rows.Scan(&t.Inode, &t.Object, &t.Size); err != nil {
+			return err
+		}
+		b.cursor.Inode = t.Inode
+		return b.w.Put(&backupRecord{Tiered: &t})
+	})
+}
+
+// backupBlocks backs up data blocks, verifying their checksums so that
+// damaged blocks are not carried into backups. Incremental backups read the
+// keys of all blocks, but the data of those written since their base only:
+// the MVCC timestamp of a row is that of the transaction that last wrote
+// it, whichever program it came from.
+func (b *backup) backupBlocks(limit int) (int, error) {
+	checksum := "NULL::INT8"
+	if b.db.checkingBlocks() {
+		checksum = "checksum"
+	}
+	args := []interface{}{b.cursor.Inode, b.cursor.Sequence, limit}
+	q := "SELECT inode, sequence, data, true, " + checksum + " FROM data_blocks"
+	if b.header.Base != "" {
+		changed := "crdb_internal_mvcc_timestamp > $4::DECIMAL"
+		q = "SELECT inode, sequence, CASE WHEN " + changed + " THEN data END, " + changed + ", " +
+			checksum + " FROM data_blocks"
+		args = append(args, b.header.Base)
+	}
+	q += " WHERE (inode, sequence) > ($1, $2) ORDER BY inode, sequence LIMIT $3"
+	return b.query(q, args, func(rows *sql.Rows) error {
+		var blk backupBlock
+		var changed bool
+		var sum sql.NullInt64
+		if err := rows.Scan(&blk.Inode, &blk.Sequence, &blk.Data, &changed, &sum); err != nil {
+			return err
+		}
+		blk.Unchanged = !changed
+		if changed {
+			if err := verifyBlock(blk.Inode, blk.Sequence, blk.Data, sum); err != nil {
+				return errors.Wrapf(err, "block %d of inode %d", blk.Sequence-1, blk.Inode)
+			}
+			b.cursor.Stats.Blocks++
+			b.cursor.Stats.Bytes += int64(len(blk.Data))
+		}
+		b.cursor.Inode, b.cursor.Sequence = blk.Inode, blk.Sequence
+		return b.w.Put(&backupRecord{Block: &blk})
+	})
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestBackup writes a backup with the header `h` to `path`: a member
+// with the header, one with a data block, and a last one marking it
+// complete unless `complete` is false.
+func writeTestBackup(t *testing.T, path string, h *BackupHeader, complete bool) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := newBackupWriter(f)
+	steps := []func() error{
+		func() error { return w.Put(&backupRecord{Header: h}) },
+		func() error { return w.Checkpoint(backupCursor{Stage: backupSettings}) },
+		func() error {
+			return w.Put(&backupRecord{Block: &backupBlock{Inode: 2, Sequence: 1, Data: []byte("hello")}})
+		},
+		func() error {
+			return w.Checkpoint(backupCursor{Stage: backupBlocks, Inode: 2, Sequence: 1, Stats: BackupStats{Blocks: 1, Bytes: 5}})
+		},
+	}
+	if complete {
+		steps = append(steps, func() error { return w.Checkpoint(backupCursor{Stage: backupDone}) })
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackupFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "full.backup")
+	h := &BackupHeader{
+		Version:    backupVersion,
+		Superblock: &superblock{UUID: "fs", BlockSize: 1024, ROCompat: defaultROCompat},
+		AsOf:       "1546300800000000000.0000000001",
+		Time:       time.Unix(1546300800, 0),
+		Checksums:  true,
+		Tables:     []string{"snapshots"},
+	}
+	writeTestBackup(t, path, h, true)
+
+	r, got, err := OpenBackup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("header = %+v, want %+v", got, h)
+	}
+	var blocks []*backupBlock
+	var stages []string
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case rec.Block != nil:
+			blocks = append(blocks, rec.Block)
+		case rec.Cursor != nil:
+			stages = append(stages, rec.Cursor.Stage)
+		}
+	}
+	if len(blocks) != 1 || string(blocks[0].Data) != "hello" || blocks[0].Sequence != 1 {
+		t.Errorf("blocks = %+v", blocks)
+	}
+	if want := []string{backupSettings, backupBlocks, backupDone}; !reflect.DeepEqual(stages, want) {
+		t.Errorf("cursors at %q, want %q", stages, want)
+	}
+	if r.cursor == nil || r.cursor.Stage != backupDone {
+		t.Errorf("last complete cursor = %+v", r.cursor)
+	}
+}
+
+// TestBackupTruncated checks that the part of an interrupted backup to
+// resume from is the last complete member.
+func TestBackupTruncated(t *testing.T) {
+	dir := t.TempDir()
+	h := &BackupHeader{Version: backupVersion, AsOf: "1.0"}
+	path := filepath.Join(dir, "partial.backup")
+	writeTestBackup(t, path, h, false)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := OpenBackup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete, err := r.Complete()
+	_ = r.Close()
+	if err != nil || complete {
+		t.Fatalf("Complete() = %t, %v for a backup without its last member", complete, err)
+	}
+	if r.cursor.Stage != backupBlocks || r.cursor.Stats.Blocks != 1 || r.end != fi.Size() {
+		t.Errorf("resuming from %+v at %d of %d bytes", r.cursor, r.end, fi.Size())
+	}
+
+	// Cutting the last member short leaves the one before it to resume
+	// from.
+	end := r.end
+	if err := os.Truncate(path, end-5); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err = OpenBackup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Complete(); err == nil {
+		t.Error("reading a truncated member succeeded")
+	}
+	if r.cursor.Stage != backupSettings || r.end >= end {
+		t.Errorf("resuming from %+v at %d", r.cursor, r.end)
+	}
+
+	// Files that are not backups are refused.
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(other, []byte("not gzip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenBackup(other); err == nil {
+		t.Error("OpenBackup of a file that is not a backup succeeded")
+	}
+	writeTestBackup(t, other, &BackupHeader{Version: backupVersion + 1}, true)
+	if _, _, err := OpenBackup(other); err == nil || !strings.Contains(err.Error(), "unsupported backup version") {
+		t.Errorf("OpenBackup of a newer backup returned %v", err)
+	}
+}
+
+func TestCheckBackupChain(t *testing.T) {
+	dir := t.TempDir()
+	backup := func(name, asOf, base, uuid string, complete bool) string {
+		path := filepath.Join(dir, name)
+		writeTestBackup(t, path, &BackupHeader{
+			Version:    backupVersion,
+			Superblock: &superblock{UUID: uuid},
+			AsOf:       asOf,
+			Base:       base,
+		}, complete)
+		return path
+	}
+	full := backup("full", "1.0", "", "fs", true)
+	incr := backup("incr", "2.0", "1.0", "fs", true)
+	incr2 := backup("incr2", "3.0", "2.0", "fs", true)
+	partial := backup("partial", "3.0", "2.0", "fs", false)
+	unrelated := backup("unrelated", "3.0", "1.5", "fs", true)
+	otherFS := backup("other", "2.0", "1.0", "other", true)
+
+	for _, tc := range []struct {
+		paths    []string
+		complete bool
+		err      string
+	}{
+		{[]string{full}, true, ""},
+		{[]string{full, incr, incr2}, true, ""},
+		{[]string{full, incr, partial}, false, ""},
+		{[]string{full, incr, partial}, true, "incomplete"},
+		{[]string{incr}, false, "full backup it is based on must come first"},
+		{[]string{full, incr2}, false, "not based on the backup before it"},
+		{[]string{full, incr, unrelated}, false, "not based on the backup before it"},
+		{[]string{full, otherFS}, false, "backup of another file system"},
+	} {
+		headers, err := CheckBackupChain(tc.paths, tc.complete)
+		if tc.err == "" {
+			if err != nil || len(headers) != len(tc.paths) {
+				t.Errorf("CheckBackupChain(%d backups) = %d headers, %v", len(tc.paths), len(headers), err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("CheckBackupChain returned %v, want %q", err, tc.err)
+		}
+	}
+}
+
+func TestHLCTime(t *testing.T) {
+	got, err := hlcTime("1546300800000000001.0000000001")
+	if err != nil || !got.Equal(time.Unix(1546300800, 1)) {
+		t.Errorf("hlcTime = %s, %v", got, err)
+	}
+	if _, err := hlcTime("yesterday"); err == nil {
+		t.Error("hlcTime(yesterday) succeeded")
+	}
+}
@@ -0,0 +1,463 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Files created through a batch are kept in memory while they are at
+	// most this large.
+	batchMaxFileSize = 64 << 10
+
+	// A batch is committed once it holds this many files or bytes, without
+	// waiting for the end of the window.
+	batchMaxFiles = 256
+	batchMaxBytes = 8 << 20
+
+	// Number of inode numbers taken from the sequence at once.
+	batchInodes = 64
+)
+
+// errNotBatched is returned by the functions passed to
+// createBatcher.Update when the change cannot be kept in memory.
+var errNotBatched = errors.New("change cannot be batched")
+
+// createBatcher keeps the files created through the mount in memory for a
+// short window, along with what is written to them and the attributes set
+// on them while they stay small, and then commits all of them in a single
+// transaction. Extracting an archive then takes a transaction per batch of
+// files rather than several per file.
+//
+// Batched files are only known to this mount. Operations that could observe
+// their absence from the database, such as listing their directory, reading
+// them or renaming, removing or linking any entry, commit the batch first.
+// As with asynchronous writes, a batch that fails to commit, e.g. because
+// another mount created the same name in the meantime, only loses the files
+// it could not store: the failure is logged and reported by the next
+// fsync(2) of each file.
+type createBatcher struct {
+	db     *DB
+	window time.Duration
+
+	// Held while a batch is committed, so that waiting for a file to be
+	// committed only takes acquiring it.
+	flushMu sync.Mutex
+
+	mu     sync.Mutex
+	files  map[uint64]*batchedFile
+	names  map[entryKey]*batchedFile
+	dirs   map[uint64]int // Number of batched files in each directory.
+	queue  []*batchedFile
+	bytes  int
+	timer  *time.Timer // nil while nothing is queued.
+	inodes []uint64    // Inode numbers allocated ahead of time.
+	errs   map[uint64]error
+}
+
+// batchedFile is a file created through the mount and not committed yet.
+type batchedFile struct {
+	n       *FileNode
+	created time.Time
+	// Contents of the file up to the last byte written. The rest of the
+	// file, up to its size, is a hole.
+	data []byte
+	// The file is being committed, and must not change in memory anymore.
+	committing bool
+}
+
+func newCreateBatcher(db *DB, window time.Duration) *createBatcher {
+	return &createBatcher{
+		db:     db,
+		window: window,
+		files:  make(map[uint64]*batchedFile),
+		names:  make(map[entryKey]*batchedFile),
+		dirs:   make(map[uint64]int),
+		errs:   make(map[uint64]error),
+	}
+}
+
+// allocate returns a new inode number, taking several from the sequence at
+// once so that most creates do not need a round trip.
+func (b *createBatcher) allocate(ctx context.Context) (uint64, error) {
+	b.mu.Lock()
+	if len(b.inodes) > 0 {
+		inode := b.inodes[0]
+		b.inodes = b.inodes[1:]
+		b.mu.Unlock()
+		return inode, nil
+	}
+	b.mu.Unlock()
+
+	q := "SELECT nextval('inode_seq') FROM generate_series(1, $1)"
+	rows, err := b.db.QueryContext(ctx, q, batchInodes)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to allocate inode numbers")
+	}
+	defer rows.Close()
+	var inodes []uint64
+	for rows.Next() {
+		var inode uint64
+		if err := rows.Scan(&inode); err != nil {
+			return 0, err
+		}
+		inodes = append(inodes, inode)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	b.inodes = append(b.inodes, inodes[1:]...)
+	b.mu.Unlock()
+	return inodes[0], nil
+}
+
+// Add queues the new node `n` to be created in the directory of its Parent.
+// It returns true if the batch is full and should be committed right away.
+func (b *createBatcher) Add(n *FileNode, created time.Time) bool {
+	f := &batchedFile{n: n, created: created}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[n.Inode] = f
+	b.names[entryKey{n.Parent, b.db.foldName(n.Name)}] = f
+	b.dirs[n.Parent]++
+	b.queue = append(b.queue, f)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, func() {
+			_ = b.Flush()
+		})
+	}
+	return len(b.queue) >= batchMaxFiles || b.bytes >= batchMaxBytes
+}
+
+// Update calls `f` with the buffered contents of the batched node `n`, while
+// holding the lock of `n`, and keeps the contents it returns. It returns
+// false if `n` is not batched, is being committed, or if `f` returns
+// errNotBatched: the change must then go to the database once the batch is
+// committed.
+func (b *createBatcher) Update(n *FileNode, f func(data []byte) ([]byte, error)) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	file, ok := b.files[n.Inode]
+	if !ok || file.committing {
+		return false, nil
+	}
+	unlock := n.lock()
+	data, err := f(file.data)
+	unlock()
+	if err == errNotBatched {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	b.bytes += len(data) - len(file.data)
+	file.data = data
+	return true, nil
+}
+
+// Lookup returns the batched node of the entry `name` in `parent`.
+func (b *createBatcher) Lookup(parent uint64, name string) (*FileNode, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.names[entryKey{parent, b.db.foldName(name)}]
+	if !ok {
+		return nil, false
+	}
+	return f.n, true
+}
+
+// Size returns the number of bytes buffered for `inode`, and false if it is
+// not batched.
+func (b *createBatcher) Size(inode uint64) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[inode]
+	if !ok {
+		return 0, false
+	}
+	return uint64(len(f.data)), true
+}
+
+// Involves returns true if `inode` is a batched file or a directory holding
+// some.
+func (b *createBatcher) Involves(inode uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.files[inode] != nil || b.dirs[inode] > 0
+}
+
+// Err returns and clears the error that prevented `inode` from being
+// created.
+func (b *createBatcher) Err(inode uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.errs[inode]
+	delete(b.errs, inode)
+	return err
+}
+
+// Len returns the number of files waiting to be committed.
+func (b *createBatcher) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queue)
+}
+
+// Flush commits the queued files, and returns the first error that
+// prevented one of them from being created. The files are committed even if
+// the operation that needs them is interrupted, as they were already
+// reported as created.
+func (b *createBatcher) Flush() error {
+	ctx := context.Background()
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	files := b.queue
+	b.queue = nil
+	b.bytes = 0
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	for _, f := range files {
+		f.committing = true
+	}
+	b.mu.Unlock()
+	if len(files) == 0 {
+		return nil
+	}
+
+	var firstErr error
+	if err := b.commit(ctx, files); err != nil {
+		// Commit the files one by one, so that the one that cannot be
+		// created does not take the others with it.
+		for _, f := range files {
+			if err := b.commit(ctx, []*batchedFile{f}); err != nil {
+				log.Printf("failed to create %q in directory %d: %s\n", f.n.Name, f.n.Parent, err)
+				b.mu.Lock()
+				b.errs[f.n.Inode] = err
+				b.mu.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+
+	b.mu.Lock()
+	for _, f := range files {
+		delete(b.files, f.n.Inode)
+		delete(b.names, entryKey{f.n.Parent, b.db.foldName(f.n.Name)})
+		if b.dirs[f.n.Parent]--; b.dirs[f.n.Parent] == 0 {
+			delete(b.dirs, f.n.Parent)
+		}
+	}
+	b.mu.Unlock()
+	for _, f := range files {
+		fs := f.n.fs
+		fs.invalidateEntry(f.n.Parent, f.n.Name)
+		fs.invalidateInode(f.n.Inode)
+		fs.invalidateBlocks(f.n.Inode, 0, -1)
+		fs.indexContent(f.n.Inode)
+	}
+	return firstErr
+}
+
+// commit creates `files` in one transaction, retried if it conflicts with a
+// concurrent one.
+func (b *createBatcher) commit(ctx context.Context, files []*batchedFile) error {
+	for attempt := 1; ; attempt++ {
+		err := b.commitOnce(ctx, files)
+		if err == nil || attempt == maxInodeTxAttempts || !retryableConflict(err) {
+			return err
+		}
+	}
+}
+
+func (b *createBatcher) commitOnce(ctx context.Context, files []*batchedFile) error {
+	tx, err := b.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	generations := make([]uint64, len(files))
+	touched := make(map[uint64]time.Time)
+	for i, f := range files {
+		n := f.n.snapshot()
+		q := "INSERT INTO tree(inode, parent, name) VALUES ($1, $2, $3)"
+		if _, err := tx.ExecContext(ctx, q, n.Inode, n.Parent, n.Name); err != nil {
+			_ = tx.Rollback()
+			return errors.Wrapf(err, "failed to insert %q into directory %d", n.Name, n.Parent)
+		}
+		if err := putInode(ctx, tx, &n); err != nil {
+			_ = tx.Rollback()
+			return errors.Wrapf(err, "failed to insert inode %d", n.Inode)
+		}
+		if len(f.data) > 0 {
+			if err := writeBlocksTx(ctx, tx, &n, 0, f.data); err != nil {
+				_ = tx.Rollback()
+				return errors.Wrapf(err, "failed to write inode %d", n.Inode)
+			}
+		}
+		generations[i] = n.Generation
+		if f.created.After(touched[n.Parent]) {
+			touched[n.Parent] = f.created
+		}
+	}
+	for dir, now := range touched {
+		if err := touchDir(ctx, tx, dir, now); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i, f := range files {
+		unlock := f.n.lock()
+		if f.n.Generation < generations[i] {
+			f.n.Generation = generations[i]
+		}
+		unlock()
+	}
+	return nil
+}
+
+// batchCreate queues the creation of `n` in the directory `parent`, and
+// commits the batch if it is full.
+func (fs fileSystem) batchCreate(ctx context.Context, parent uint64, n *FileNode) error {
+	if err := fs.db.validName(n.Name); err != nil {
+		return err
+	}
+	inode, err := fs.creates.allocate(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	n.Name = fs.db.normName(n.Name)
+	n.Inode = inode
+	n.Parent = parent
+	n.Mtime = now
+	n.Ctime = now
+	if fs.creates.Add(n, now) {
+		fs.flushCreates()
+	}
+	return nil
+}
+
+// batchedEntry returns the node of the entry `name` in `parent` if its
+// creation is batched.
+func (fs fileSystem) batchedEntry(parent uint64, name string) (*FileNode, bool) {
+	if fs.creates == nil {
+		return nil, false
+	}
+	return fs.creates.Lookup(parent, name)
+}
+
+// batchedSize returns the number of bytes buffered for `inode` if its
+// creation is batched.
+func (fs fileSystem) batchedSize(inode uint64) (uint64, bool) {
+	if fs.creates == nil {
+		return 0, false
+	}
+	return fs.creates.Size(inode)
+}
+
+// flushCreates commits the batched creates, if any.
+func (fs fileSystem) flushCreates() {
+	if fs.creates != nil {
+		// The files of the batch report their own failures.
+		_ = fs.creates.Flush()
+	}
+}
+
+// settleCreates commits the batched creates if `inode` is one of them or a
+// directory holding some, before it is read from or changed in the
+// database.
+func (fs fileSystem) settleCreates(inode uint64) {
+	if fs.creates != nil && fs.creates.Involves(inode) {
+		_ = fs.creates.Flush()
+	}
+}
+
+// syncCreate commits the creation of `inode` if it is batched, and returns
+// the error that prevented it from being created since the last call.
+func (fs fileSystem) syncCreate(inode uint64) error {
+	if fs.creates == nil {
+		return nil
+	}
+	fs.settleCreates(inode)
+	return fs.creates.Err(inode)
+}
+
+// batchWrite keeps the write `req` to `n` in memory if the creation of `n`
+// is batched and it stays small enough. Otherwise, the batch is committed
+// first and false is returned, so that the write goes to the database.
+func (fs fileSystem) batchWrite(n *FileNode, req *fuse.WriteRequest) (bool, error) {
+	if fs.creates == nil {
+		return false, nil
+	}
+	end := req.Offset + int64(len(req.Data))
+	batched, err := fs.creates.Update(n, func(data []byte) ([]byte, error) {
+		if n.immutable() || n.appendOnly() && uint64(req.Offset) < n.Size {
+			return nil, fuse.EPERM
+		}
+		if end > batchMaxFileSize {
+			return nil, errNotBatched
+		}
+		if int64(len(data)) < end {
+			grown := make([]byte, end)
+			copy(grown, data)
+			data = grown
+		}
+		copy(data[req.Offset:], req.Data)
+		if uint64(end) > n.Size {
+			n.Size = uint64(end)
+		}
+		now := time.Now()
+		n.Mtime = now
+		n.Ctime = now
+		return data, nil
+	})
+	if err != nil || batched {
+		return batched, err
+	}
+	fs.settleCreates(n.Inode)
+	return false, nil
+}
+
+// batchSetattr is batchWrite for Setattr.
+func (fs fileSystem) batchSetattr(n *FileNode, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (bool, error) {
+	if fs.creates == nil {
+		return false, nil
+	}
+	batched, err := fs.creates.Update(n, func(data []byte) ([]byte, error) {
+		if err := n.checkSetattr(req); err != nil {
+			return nil, err
+		}
+		if req.Valid.Size() && req.Size > batchMaxFileSize {
+			return nil, errNotBatched
+		}
+		n.applySetattr(req, resp)
+		if req.Valid.Size() {
+			if uint64(len(data)) > req.Size {
+				data = data[:req.Size]
+			}
+			n.Size = req.Size
+		}
+		return data, nil
+	})
+	if err != nil || batched {
+		return batched, err
+	}
+	// Also commits the batch before the times of a directory holding
+	// batched files are set, as committing them touches it.
+	fs.settleCreates(n.Inode)
+	return false, nil
+}
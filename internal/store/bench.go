@@ -0,0 +1,406 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Workloads of `sqlfs bench`, in the order they run. The sequential
+// workloads lay out the data file the random ones use, and the metadata
+// workloads operate on the files created by the first of them.
+var benchWorkloads = []string{"seqwrite", "seqread", "randwrite", "randread", "create", "stat", "delete"}
+
+// Size of the reads and writes of the random workloads.
+const benchRandomIOSize = 4 << 10
+
+// BenchConfig are the parameters of the workloads.
+type BenchConfig struct {
+	Workloads map[string]bool
+	Size      int64         // Size of the data file.
+	IOSize    int           // Size of the sequential reads and writes.
+	Jobs      int           // Number of concurrent workers.
+	Runtime   time.Duration // Duration of each random workload.
+	Files     int           // Number of files of the metadata workloads.
+}
+
+// ParseBenchWorkloads parses a comma-separated list of workloads, or "all".
+func ParseBenchWorkloads(s string) (map[string]bool, error) {
+	selected := make(map[string]bool)
+	for _, w := range strings.Split(s, ",") {
+		w = strings.TrimSpace(w)
+		if w == "all" {
+			for _, name := range benchWorkloads {
+				selected[name] = true
+			}
+			continue
+		}
+		known := false
+		for _, name := range benchWorkloads {
+			known = known || name == w
+		}
+		if !known {
+			return nil, errors.Errorf("unknown workload %q, expected all or some of %s", w, strings.Join(benchWorkloads, ","))
+		}
+		selected[w] = true
+	}
+	return selected, nil
+}
+
+// benchFile is a file opened by a benchmark.
+type benchFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// benchTarget is where the workloads run: the files of a directory, either
+// stored through the SQL layer directly or through a mount.
+type benchTarget interface {
+	Create(name string) (benchFile, error)
+	Open(name string) (benchFile, error)
+	Stat(name string) error
+	Remove(name string) error
+}
+
+// StorageTarget runs the workloads against the SQL layer, with the same
+// operations `sqlfs serve` uses, which excludes FUSE and the caches of
+// mounts.
+type StorageTarget struct {
+	Ctx context.Context
+	DB  *DB
+	Dir *FileNode
+}
+
+func (t StorageTarget) Create(name string) (benchFile, error) {
+	n, err := CreateNode(t.Ctx, t.DB, t.Dir, name, 0644, uint32(os.Getuid()), uint32(os.Getgid()))
+	if err != nil {
+		return nil, err
+	}
+	return &storageFile{t: t, n: n}, nil
+}
+
+// Open looks the file up anew, so that concurrent workers do not share its
+// node.
+func (t StorageTarget) Open(name string) (benchFile, error) {
+	n, err := lookupNode(t.Ctx, t.DB, t.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &storageFile{t: t, n: n}, nil
+}
+
+func (t StorageTarget) Stat(name string) error {
+	_, err := lookupNode(t.Ctx, t.DB, t.Dir, name)
+	return err
+}
+
+func (t StorageTarget) Remove(name string) error {
+	return removeNode(t.Ctx, t.DB, t.Dir, name, false)
+}
+
+type storageFile struct {
+	t StorageTarget
+	n *FileNode
+}
+
+func (f *storageFile) ReadAt(p []byte, off int64) (int, error) {
+	data, err := readData(f.t.Ctx, f.t.DB, f.n, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *storageFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := WriteData(f.t.Ctx, f.t.DB, f.n, off, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync does nothing, as every write is committed before it returns.
+func (f *storageFile) Sync() error { return nil }
+
+func (f *storageFile) Close() error { return nil }
+
+// MountTarget runs the workloads in a directory of a mounted file system.
+type MountTarget string
+
+func (t MountTarget) Create(name string) (benchFile, error) {
+	return os.OpenFile(filepath.Join(string(t), name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (t MountTarget) Open(name string) (benchFile, error) {
+	return os.OpenFile(filepath.Join(string(t), name), os.O_RDWR, 0)
+}
+
+func (t MountTarget) Stat(name string) error {
+	_, err := os.Stat(filepath.Join(string(t), name))
+	return err
+}
+
+func (t MountTarget) Remove(name string) error {
+	return os.Remove(filepath.Join(string(t), name))
+}
+
+// BenchResult is the outcome of a workload on a target.
+type BenchResult struct {
+	Target    string  `json:"target"`
+	Workload  string  `json:"workload"`
+	Ops       int     `json:"ops"`
+	Bytes     int64   `json:"bytes"`
+	Seconds   float64 `json:"seconds"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	MBPerSec  float64 `json:"mb_per_sec"`
+	P50Millis float64 `json:"p50_ms"`
+	P99Millis float64 `json:"p99_ms"`
+	MaxMillis float64 `json:"max_ms"`
+}
+
+func (r BenchResult) String() string {
+	return fmt.Sprintf("%-8s %-10s %8d ops %10.1f ops/s %9.2f MB/s   latency p50 %8.2fms p99 %8.2fms max %8.2fms",
+		r.Target, r.Workload, r.Ops, r.OpsPerSec, r.MBPerSec, r.P50Millis, r.P99Millis, r.MaxMillis)
+}
+
+// benchRecorder collects the latencies of the operations of a workload.
+type benchRecorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	bytes     int64
+}
+
+// time runs the operation `op`, which transfers `bytes` bytes, and records
+// its latency if it succeeds.
+func (r *benchRecorder) time(bytes int, op func() error) error {
+	start := time.Now()
+	if err := op(); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	r.mu.Lock()
+	r.latencies = append(r.latencies, elapsed)
+	r.bytes += int64(bytes)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *benchRecorder) result(target, workload string, elapsed time.Duration) BenchResult {
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	res := BenchResult{
+		Target:   target,
+		Workload: workload,
+		Ops:      len(r.latencies),
+		Bytes:    r.bytes,
+		Seconds:  elapsed.Seconds(),
+	}
+	if elapsed > 0 {
+		res.OpsPerSec = float64(res.Ops) / elapsed.Seconds()
+		res.MBPerSec = float64(res.Bytes) / (1 << 20) / elapsed.Seconds()
+	}
+	if len(r.latencies) > 0 {
+		percentile := func(p float64) float64 {
+			d := r.latencies[int(p*float64(len(r.latencies)-1))]
+			return float64(d) / float64(time.Millisecond)
+		}
+		res.P50Millis = percentile(0.5)
+		res.P99Millis = percentile(0.99)
+		res.MaxMillis = percentile(1)
+	}
+	return res
+}
+
+// benchParallel runs `fn` in `jobs` goroutines and returns the first error.
+func benchParallel(jobs int, fn func(job int) error) error {
+	errs := make([]error, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func(job int) {
+			defer wg.Done()
+			errs[job] = fn(job)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name of the file of the data workloads in the target directory.
+const benchDataFile = "data"
+
+// RunBench runs the selected workloads on `t`, named `target` in the
+// results, and calls `report` with the result of each.
+func RunBench(t benchTarget, target string, cfg BenchConfig, report func(BenchResult) error) error {
+	w := cfg.Workloads
+	run := func(workload string, fn func(rec *benchRecorder) error) error {
+		rec := &benchRecorder{}
+		start := time.Now()
+		if err := fn(rec); err != nil {
+			return errors.Wrapf(err, "%s failed on %s", workload, target)
+		}
+		if !w[workload] {
+			return nil // Only run to prepare the following workloads.
+		}
+		return report(rec.result(target, workload, time.Since(start)))
+	}
+
+	if w["seqwrite"] || w["seqread"] || w["randwrite"] || w["randread"] {
+		buf := make([]byte, cfg.IOSize)
+		rand.Read(buf)
+		err := run("seqwrite", func(rec *benchRecorder) error {
+			f, err := t.Create(benchDataFile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			for off := int64(0); off < cfg.Size; off += int64(len(buf)) {
+				chunk := buf
+				if rest := cfg.Size - off; rest < int64(len(chunk)) {
+					chunk = chunk[:rest]
+				}
+				if err := rec.time(len(chunk), func() error {
+					_, err := f.WriteAt(chunk, off)
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return f.Sync()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if w["seqread"] {
+		err := run("seqread", func(rec *benchRecorder) error {
+			f, err := t.Open(benchDataFile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			buf := make([]byte, cfg.IOSize)
+			for off := int64(0); off < cfg.Size; off += int64(len(buf)) {
+				chunk := buf
+				if rest := cfg.Size - off; rest < int64(len(chunk)) {
+					chunk = chunk[:rest]
+				}
+				if err := rec.time(len(chunk), func() error {
+					_, err := f.ReadAt(chunk, off)
+					if err == io.EOF {
+						err = nil
+					}
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, workload := range []string{"randwrite", "randread"} {
+		if !w[workload] {
+			continue
+		}
+		write := workload == "randwrite"
+		err := run(workload, func(rec *benchRecorder) error {
+			deadline := time.Now().Add(cfg.Runtime)
+			blocks := cfg.Size / benchRandomIOSize
+			if blocks == 0 {
+				return errors.Errorf("the data file must be at least %d bytes", benchRandomIOSize)
+			}
+			return benchParallel(cfg.Jobs, func(job int) error {
+				f, err := t.Open(benchDataFile)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(job)))
+				buf := make([]byte, benchRandomIOSize)
+				rng.Read(buf)
+				for time.Now().Before(deadline) {
+					off := rng.Int63n(blocks) * benchRandomIOSize
+					err := rec.time(len(buf), func() error {
+						if write {
+							_, err := f.WriteAt(buf, off)
+							return err
+						}
+						_, err := f.ReadAt(buf, off)
+						if err == io.EOF {
+							err = nil
+						}
+						return err
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return f.Sync()
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !w["create"] && !w["stat"] && !w["delete"] {
+		return nil
+	}
+	// Each worker handles the files whose index is its number modulo the
+	// number of workers.
+	forFiles := func(rec *benchRecorder, op func(name string) error) error {
+		return benchParallel(cfg.Jobs, func(job int) error {
+			for i := job; i < cfg.Files; i += cfg.Jobs {
+				name := fmt.Sprintf("file-%d", i)
+				if err := rec.time(0, func() error { return op(name) }); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	err := run("create", func(rec *benchRecorder) error {
+		return forFiles(rec, func(name string) error {
+			f, err := t.Create(name)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if w["stat"] {
+		if err := run("stat", func(rec *benchRecorder) error { return forFiles(rec, t.Stat) }); err != nil {
+			return err
+		}
+	}
+	if w["delete"] {
+		if err := run("delete", func(rec *benchRecorder) error { return forFiles(rec, t.Remove) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type BlockKey struct {
+	Inode uint64
+	Index int64
+}
+
+type cachedBlock struct {
+	key  BlockKey
+	data []byte
+}
+
+// Number of counters of an epochTable, shared by the inodes with the same
+// remainder.
+const invalidationEpochs = 256
+
+// epochTable counts the invalidations of the blocks of inodes, so that
+// blocks read from the database, or anything derived from them, can be
+// discarded if their inode was invalidated while they were read. Inodes
+// sharing a counter only cost spurious discards.
+type epochTable struct {
+	counts [invalidationEpochs]uint64
+	all    uint64
+}
+
+// Get returns the epoch of `inode`, which changes whenever the blocks of
+// the inode are invalidated.
+func (t *epochTable) Get(inode uint64) uint64 {
+	// Both counters only grow, so their sum changes if either does.
+	return atomic.LoadUint64(&t.counts[inode%invalidationEpochs]) + atomic.LoadUint64(&t.all)
+}
+
+// Advance advances the epoch of `inode`.
+func (t *epochTable) Advance(inode uint64) {
+	atomic.AddUint64(&t.counts[inode%invalidationEpochs], 1)
+}
+
+// AdvanceAll advances the epochs of all inodes.
+func (t *epochTable) AdvanceAll() {
+	atomic.AddUint64(&t.all, 1)
+}
+
+// blockCache is an LRU cache of data blocks keyed by inode and
+// block index, bounded by the total size of the cached blocks. Writes and
+// truncations must invalidate the blocks they touch, as must any mechanism
+// that learns about changes made by other mounts.
+//
+// Blocks read from the database are only cached if their inode was not
+// invalidated while they were read, as they may predate the write that
+// invalidated it: every invalidation advances the epoch of the inode, which
+// readers take before their query, see Read.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	lru      *list.List // Most recently used at the front.
+	// Elements of lru, grouped by inode so that whole files can be dropped.
+	blocks map[uint64]map[int64]*list.Element
+
+	epochs epochTable
+
+	hits, misses uint64
+}
+
+// blockCacheStats describes the contents and efficiency of a blockCache.
+type blockCacheStats struct {
+	Blocks   int    `json:"blocks"`
+	Bytes    int64  `json:"bytes"`
+	Capacity int64  `json:"capacity"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[uint64]map[int64]*list.Element),
+	}
+}
+
+// Get returns the cached block `index` of `inode`.
+func (c *blockCache) Get(inode uint64, index int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[inode][index]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).data, true
+}
+
+// Epoch returns the invalidation epoch of `inode`, which changes whenever
+// blocks of the inode are invalidated.
+func (c *blockCache) Epoch(inode uint64) uint64 {
+	return c.epochs.Get(inode)
+}
+
+// PutBlocks caches `blocks` of `inode`, unless the inode was invalidated
+// since it was at `epoch`.
+func (c *blockCache) PutBlocks(inode uint64, epoch uint64, blocks map[int64][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epochs.Get(inode) != epoch {
+		return
+	}
+	for index, data := range blocks {
+		c.put(inode, index, data)
+	}
+}
+
+// put caches `data` as the block `index` of `inode`, evicting the least
+// recently used blocks if the cache is full. Must be called with c.mu held.
+func (c *blockCache) put(inode uint64, index int64, data []byte) {
+	if int64(len(data)) > c.capacity {
+		return
+	}
+	if e, ok := c.blocks[inode][index]; ok {
+		c.remove(e)
+	}
+	byIndex, ok := c.blocks[inode]
+	if !ok {
+		byIndex = make(map[int64]*list.Element)
+		c.blocks[inode] = byIndex
+	}
+	byIndex[index] = c.lru.PushFront(&cachedBlock{key: BlockKey{inode, index}, data: data})
+	c.used += int64(len(data))
+	for c.used > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// InvalidateBlocks drops the blocks of `inode` in the range [first, last).
+func (c *blockCache) InvalidateBlocks(inode uint64, first, last int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epochs.Advance(inode)
+	for index, e := range c.blocks[inode] {
+		if index >= first && index < last {
+			c.remove(e)
+		}
+	}
+}
+
+// InvalidateInode drops all blocks of `inode`.
+func (c *blockCache) InvalidateInode(inode uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epochs.Advance(inode)
+	for _, e := range c.blocks[inode] {
+		c.remove(e)
+	}
+}
+
+// Purge drops all cached blocks.
+func (c *blockCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epochs.AdvanceAll()
+	c.lru.Init()
+	c.blocks = make(map[uint64]map[int64]*list.Element)
+	c.used = 0
+}
+
+// Stats returns the current size and hit rate of the cache.
+func (c *blockCache) Stats() blockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return blockCacheStats{
+		Blocks:   c.lru.Len(),
+		Bytes:    c.used,
+		Capacity: c.capacity,
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
+
+// remove drops the element `e`. Must be called with c.mu held.
+func (c *blockCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*cachedBlock)
+	c.used -= int64(len(b.data))
+	byIndex := c.blocks[b.key.Inode]
+	delete(byIndex, b.key.Index)
+	if len(byIndex) == 0 {
+		delete(c.blocks, b.key.Inode)
+	}
+}
+
+// Read returns the blocks [first, first+count) of `inode`, from the cache
+// when possible. The blocks missing from the cache are read with `fetch`,
+// all those between the first and last miss at once, and cached unless the
+// inode is invalidated in the meantime.
+func (c *blockCache) Read(inode uint64, first, count int64, fetch func(first, count int64) (map[int64][]byte, error)) (map[int64][]byte, error) {
+	blocks := make(map[int64][]byte, count)
+	missFirst, missLast := int64(-1), int64(-1)
+	for i := first; i < first+count; i++ {
+		if b, ok := c.Get(inode, i); ok {
+			blocks[i] = b
+			continue
+		}
+		if missFirst < 0 {
+			missFirst = i
+		}
+		missLast = i + 1
+	}
+	if missFirst < 0 {
+		return blocks, nil
+	}
+
+	epoch := c.Epoch(inode)
+	fetched, err := fetch(missFirst, missLast-missFirst)
+	if err != nil {
+		return nil, err
+	}
+	c.PutBlocks(inode, epoch, fetched)
+	for i, b := range fetched {
+		if _, ok := blocks[i]; !ok {
+			blocks[i] = b
+		}
+	}
+	return blocks, nil
+}
+
+// readBlocks returns the blocks [first, first+count) of `inode`, from the
+// block cache when possible. Blocks fetched from the database are added to
+// the cache.
+func (fs fileSystem) readBlocks(ctx context.Context, inode uint64, first, count int64) (map[int64][]byte, error) {
+	fetch := func(first, count int64) (map[int64][]byte, error) {
+		return ReadBlocks(ctx, fs.db, inode, first, count)
+	}
+	if fs.blocks == nil {
+		return fetch(first, count)
+	}
+	return fs.blocks.Read(inode, first, count, fetch)
+}
+
+// blockEpoch returns the epoch of the blocks of `inode`, which changes
+// whenever they are invalidated.
+func (fs fileSystem) blockEpoch(inode uint64) uint64 {
+	return fs.epochs.Get(inode)
+}
+
+// invalidateBlocks drops the cached blocks [first, last) of `inode`, or all
+// of its blocks if `last` is negative, and advances its epoch so that the
+// blocks being read are not kept either. The cached stored size of `inode`
+// is dropped as well.
+func (fs fileSystem) invalidateBlocks(inode uint64, first, last int64) {
+	fs.epochs.Advance(inode)
+	if fs.usage != nil {
+		fs.usage.Invalidate(inode)
+	}
+	if fs.attrs != nil {
+		fs.attrs.Invalidate(inode)
+	}
+	if fs.blocks == nil {
+		return
+	}
+	if last < 0 {
+		fs.blocks.InvalidateInode(inode)
+		return
+	}
+	fs.blocks.InvalidateBlocks(inode, first, last)
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// readStale reads the block 0 of inode 1 through `c`, with a write of
+// `fresh` committed and invalidated while the stale contents are fetched,
+// as happens when a write races with a read of the same file.
+func readStale(t *testing.T, c *blockCache, invalidate func()) {
+	t.Helper()
+	fetch := func(first, count int64) (map[int64][]byte, error) {
+		blocks := map[int64][]byte{0: []byte("stale")}
+		invalidate()
+		return blocks, nil
+	}
+	blocks, err := c.Read(1, 0, 1, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blocks[0], []byte("stale")) {
+		t.Fatalf("read %q, want the fetched block", blocks[0])
+	}
+}
+
+func TestBlockCacheReadRacingInvalidation(t *testing.T) {
+	for name, invalidate := range map[string]func(c *blockCache){
+		"blocks": func(c *blockCache) { c.InvalidateBlocks(1, 0, 1) },
+		"inode":  func(c *blockCache) { c.InvalidateInode(1) },
+		"purge":  func(c *blockCache) { c.Purge() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newBlockCache(1 << 20)
+			readStale(t, c, func() { invalidate(c) })
+			if b, ok := c.Get(1, 0); ok {
+				t.Fatalf("cached %q, fetched before an invalidation", b)
+			}
+
+			// Blocks read without a concurrent write are cached.
+			fetch := func(first, count int64) (map[int64][]byte, error) {
+				return map[int64][]byte{0: []byte("fresh")}, nil
+			}
+			if _, err := c.Read(1, 0, 1, fetch); err != nil {
+				t.Fatal(err)
+			}
+			if b, ok := c.Get(1, 0); !ok || !bytes.Equal(b, []byte("fresh")) {
+				t.Fatalf("cached %q, %v, want the fetched block", b, ok)
+			}
+		})
+	}
+}
+
+func TestBlockCacheReadOtherInodeInvalidated(t *testing.T) {
+	c := newBlockCache(1 << 20)
+	// Inode 2 does not share the epoch of inode 1.
+	readStale(t, c, func() { c.InvalidateInode(2) })
+	if _, ok := c.Get(1, 0); !ok {
+		t.Fatal("block not cached after invalidating another inode")
+	}
+}
+
+func TestBlockCacheConcurrentReadsAndWrites(t *testing.T) {
+	c := newBlockCache(1 << 20)
+	var mu sync.Mutex
+	stored := []byte{0}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 1000; i++ {
+			// Commit, then invalidate, as writes do.
+			mu.Lock()
+			stored = []byte{byte(i)}
+			mu.Unlock()
+			c.InvalidateBlocks(1, 0, 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		fetch := func(first, count int64) (map[int64][]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return map[int64][]byte{0: stored}, nil
+		}
+		for i := 0; i < 1000; i++ {
+			if _, err := c.Read(1, 0, 1, fetch); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Whatever was cached last must be the last write.
+	if b, ok := c.Get(1, 0); ok && b[0] != stored[0] {
+		t.Fatalf("cached block %d, last write %d", b[0], stored[0])
+	}
+}
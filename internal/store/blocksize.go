@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Block size of file systems that do not configure one. Note that
+	// reading or writing will become slower if the block size is smaller.
+	defaultBlockSize = 1024
+
+	minBlockSize = 512
+	maxBlockSize = 4 << 20
+)
+
+// GetBlockSize returns the block size of the file system.
+func GetBlockSize(ctx context.Context, db *DB) (int64, error) {
+	value, err := GetSetting(ctx, db, settingBlockSize)
+	if err != nil || value == "" {
+		return defaultBlockSize, err
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || validBlockSize(size) != nil {
+		return 0, errors.Errorf("invalid block size %q", value)
+	}
+	return size, nil
+}
+
+// SetBlockSize records the block size of the file system. It fails if the
+// file system already stores data with a different block size, as existing
+// blocks are not rewritten.
+func SetBlockSize(ctx context.Context, db *DB, size int64) error {
+	if err := validBlockSize(size); err != nil {
+		return err
+	}
+	current, err := GetBlockSize(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current == size {
+		return nil
+	}
+	var hasData bool
+	q1 := "SELECT EXISTS (SELECT 1 FROM data_blocks)"
+	if err := db.QueryRowContext(ctx, q1).Scan(&hasData); err != nil {
+		return errors.Wrap(err, "failed to check for existing data")
+	}
+	if hasData {
+		return errors.Errorf("the file system already stores data in %d byte blocks", current)
+	}
+	if err := PutSetting(ctx, db, settingBlockSize, strconv.FormatInt(size, 10)); err != nil {
+		return err
+	}
+	return setSuperblockBlockSize(ctx, db, size)
+}
+
+func validBlockSize(size int64) error {
+	if size < minBlockSize || size > maxBlockSize || size%minBlockSize != 0 {
+		return fmt.Errorf("block size must be a multiple of %d between %d and %d", minBlockSize, minBlockSize, maxBlockSize)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+var (
+	// errDBBusy is returned when a statement waited too long for a slot.
+	errDBBusy = errors.New("timed out waiting for a free database statement slot")
+	// errDBOverloaded is returned while the circuit breaker is open.
+	errDBOverloaded = errors.New("database overloaded, statement rejected by the circuit breaker")
+)
+
+// queryBudget caps the number of SQL statements the file system runs
+// concurrently, so that hundreds of FUSE requests cannot pile up on the
+// database. It also trips a circuit breaker after a run of statements that
+// failed because the database is not keeping up: statements then fail right
+// away, and so do their operations with EIO, until a probe succeeds after a
+// cooldown.
+type queryBudget struct {
+	// Semaphore of the statements running, nil if they are not capped.
+	slots chan struct{}
+	// How long a statement may wait for a slot.
+	queueTimeout time.Duration
+	// Consecutive failures that open the breaker. Zero disables it.
+	threshold int
+	// How long the breaker stays open before a probe is let through.
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // Zero while closed.
+	probing   bool
+	rejected  uint64
+}
+
+// queryBudgetStats is a snapshot of the state of a queryBudget.
+type queryBudgetStats struct {
+	Running     int    `json:"running"`
+	MaxRunning  int    `json:"max_running"`
+	BreakerOpen bool   `json:"breaker_open"`
+	Rejected    uint64 `json:"rejected"`
+}
+
+func NewQueryBudget(maxStatements int, queueTimeout time.Duration, threshold int, cooldown time.Duration) *queryBudget {
+	b := &queryBudget{queueTimeout: queueTimeout, threshold: threshold, cooldown: cooldown}
+	if maxStatements > 0 {
+		b.slots = make(chan struct{}, maxStatements)
+	}
+	return b
+}
+
+// acquire waits for a slot to run a statement. The returned function must
+// be called with the outcome of the statement once it is done.
+func (b *queryBudget) acquire(ctx context.Context) (func(error), error) {
+	b.mu.Lock()
+	if !b.openUntil.IsZero() {
+		if b.probing || time.Now().Before(b.openUntil) {
+			b.rejected++
+			b.mu.Unlock()
+			return nil, errDBOverloaded
+		}
+		b.probing = true
+	}
+	b.mu.Unlock()
+
+	if b.slots != nil {
+		timer := time.NewTimer(b.queueTimeout)
+		defer timer.Stop()
+		select {
+		case b.slots <- struct{}{}:
+		case <-timer.C:
+			b.record(errDBBusy)
+			return nil, errDBBusy
+		case <-ctx.Done():
+			b.record(ctx.Err())
+			return nil, ctx.Err()
+		}
+	}
+	return func(err error) {
+		if b.slots != nil {
+			<-b.slots
+		}
+		b.record(err)
+	}, nil
+}
+
+// overloaded returns true if `err` shows that the database is unreachable
+// or not keeping up, as opposed to rejecting the statement.
+func overloaded(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case *pq.Error:
+		// insufficient_resources and operator_intervention, e.g.
+		// query_canceled or admin_shutdown.
+		return err.Code.Class() == "53" || err.Code.Class() == "57"
+	case net.Error:
+		return true
+	}
+	switch errors.Cause(err) {
+	case context.DeadlineExceeded, driver.ErrBadConn, errDBBusy, io.ErrUnexpectedEOF:
+		return true
+	}
+	return false
+}
+
+// record updates the breaker with the outcome of a statement.
+func (b *queryBudget) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.probing
+	b.probing = false
+	switch {
+	case overloaded(err):
+		b.failures++
+		if probe || (b.openUntil.IsZero() && b.failures >= b.threshold) {
+			b.openUntil = time.Now().Add(b.cooldown)
+			log.Printf("The database is overloaded or unreachable: %d consecutive statements failed, the last one with %q. "+
+				"Failing file system operations with EIO for %s.\n", b.failures, err, b.cooldown)
+		}
+	case err == context.Canceled:
+		// Says nothing about the database.
+	default:
+		if !b.openUntil.IsZero() {
+			log.Println("The database is responding again, resuming file system operations.")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+	}
+}
+
+// Stats returns a snapshot of the state of the budget.
+func (b *queryBudget) Stats() queryBudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return queryBudgetStats{
+		Running:     len(b.slots),
+		MaxRunning:  cap(b.slots),
+		BreakerOpen: !b.openUntil.IsZero(),
+		Rejected:    b.rejected,
+	}
+}
+
+// BudgetConnector opens connections whose statements are subject to a
+// queryBudget.
+type BudgetConnector struct {
+	driver.Connector
+	Budget *queryBudget
+}
+
+// Connect implements driver.Connector.
+func (c *BudgetConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &budgetConn{Conn: conn, budget: c.Budget}, nil
+}
+
+// budgetConn holds a slot of its budget while each of its statements runs,
+// including the statements of transactions. Queries hold their slot until
+// their rows are closed.
+type budgetConn struct {
+	driver.Conn
+	budget *queryBudget
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *budgetConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	release, err := c.budget.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		release(err)
+		return nil, err
+	}
+	return &budgetRows{Rows: rows, release: release}, nil
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *budgetConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	release, err := c.budget.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := execer.ExecContext(ctx, query, args)
+	release(err)
+	return res, err
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *budgetConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	release, err := c.budget.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tx driver.Tx
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	release(err)
+	return tx, err
+}
+
+// Ping implements driver.Pinger.
+func (c *budgetConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements driver.SessionResetter.
+func (c *budgetConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator.
+func (c *budgetConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// budgetRows releases the slot of their query once closed.
+type budgetRows struct {
+	driver.Rows
+	release func(error)
+	err     error
+}
+
+// Next implements driver.Rows.
+func (r *budgetRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+// Close implements driver.Rows.
+func (r *budgetRows) Close() error {
+	err := r.Rows.Close()
+	if r.release != nil {
+		r.release(r.err)
+		r.release = nil
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+func TestOverloaded(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"deadline", context.DeadlineExceeded, true},
+		{"bad connection", errors.Wrap(driver.ErrBadConn, "query"), true},
+		{"busy", errDBBusy, true},
+		{"connection lost", io.ErrUnexpectedEOF, true},
+		{"out of memory", &pq.Error{Code: "53200"}, true},
+		{"query canceled", &pq.Error{Code: "57014"}, true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, false},
+		{"canceled", context.Canceled, false},
+		{"no space", errNoSpace, false},
+	} {
+		if got := overloaded(tc.err); got != tc.want {
+			t.Errorf("overloaded(%s) = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQueryBudgetSlots(t *testing.T) {
+	b := NewQueryBudget(2, 20*time.Millisecond, 0, 0)
+	ctx := context.Background()
+	var releases []func(error)
+	for i := 0; i < 2; i++ {
+		release, err := b.acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	if s := b.Stats(); s.Running != 2 || s.MaxRunning != 2 {
+		t.Errorf("stats = %+v, want 2 of 2 running", s)
+	}
+	if _, err := b.acquire(ctx); err != errDBBusy {
+		t.Errorf("acquire past the cap returned %v, want errDBBusy", err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.acquire(canceled); err != context.Canceled {
+		t.Errorf("acquire with a canceled context returned %v", err)
+	}
+	releases[0](nil)
+	release, err := b.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire after a release returned %v", err)
+	}
+	release(nil)
+	releases[1](nil)
+	if s := b.Stats(); s.Running != 0 {
+		t.Errorf("%d statements still running", s.Running)
+	}
+}
+
+func TestQueryBudgetBreaker(t *testing.T) {
+	b := NewQueryBudget(0, 0, 3, 50*time.Millisecond)
+	ctx := context.Background()
+	fail := func(err error) {
+		t.Helper()
+		release, acquireErr := b.acquire(ctx)
+		if acquireErr != nil {
+			t.Fatalf("acquire returned %v", acquireErr)
+		}
+		release(err)
+	}
+
+	// Rejected statements and cancellations do not count, and a success
+	// resets the count.
+	fail(driver.ErrBadConn)
+	fail(driver.ErrBadConn)
+	fail(&pq.Error{Code: "23505"})
+	fail(driver.ErrBadConn)
+	fail(context.Canceled)
+	fail(driver.ErrBadConn)
+	if b.Stats().BreakerOpen {
+		t.Fatal("the breaker opened before 3 consecutive failures")
+	}
+	fail(driver.ErrBadConn)
+	if !b.Stats().BreakerOpen {
+		t.Fatal("the breaker did not open after 3 consecutive failures")
+	}
+	if _, err := b.acquire(ctx); err != errDBOverloaded {
+		t.Errorf("acquire with the breaker open returned %v", err)
+	}
+
+	// After the cooldown, a single probe goes through, and reopens the
+	// breaker if it fails.
+	time.Sleep(60 * time.Millisecond)
+	probe, err := b.acquire(ctx)
+	if err != nil {
+		t.Fatalf("probe returned %v", err)
+	}
+	if _, err := b.acquire(ctx); err != errDBOverloaded {
+		t.Errorf("second statement during the probe returned %v", err)
+	}
+	probe(context.DeadlineExceeded)
+	if _, err := b.acquire(ctx); err != errDBOverloaded {
+		t.Errorf("acquire after a failed probe returned %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	fail(nil)
+	if s := b.Stats(); s.BreakerOpen || s.Rejected != 3 {
+		t.Errorf("stats after a successful probe = %+v, want closed with 3 rejected", s)
+	}
+}
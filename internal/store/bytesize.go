@@ -0,0 +1,64 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ByteSize is a flag.Value holding a number of bytes. It accepts plain
+// numbers and numbers with a K, M or G suffix (powers of 1024).
+type ByteSize uint64
+
+func (b *ByteSize) String() string {
+	v := uint64(*b)
+	switch {
+	case v == 0:
+		return "0"
+	case v%(1<<30) == 0:
+		return strconv.FormatUint(v>>30, 10) + "G"
+	case v%(1<<20) == 0:
+		return strconv.FormatUint(v>>20, 10) + "M"
+	case v%(1<<10) == 0:
+		return strconv.FormatUint(v>>10, 10) + "K"
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+func (b *ByteSize) Set(s string) error {
+	str := strings.ToUpper(strings.TrimSuffix(strings.ToUpper(s), "B"))
+	shift := uint(0)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		shift = 10
+	case strings.HasSuffix(str, "M"):
+		shift = 20
+	case strings.HasSuffix(str, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		str = str[:len(str)-1]
+	}
+	v, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return errors.Errorf("invalid size %q", s)
+	}
+	*b = ByteSize(v << shift)
+	return nil
+}
+
+// HumanBytes formats `v` bytes with a binary unit suffix, e.g. 1.5K.
+func HumanBytes(v uint64) string {
+	const units = "KMGTPE"
+	if v < 1024 {
+		return strconv.FormatUint(v, 10)
+	}
+	f := float64(v)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return strconv.FormatFloat(f, 'f', 1, 64) + string(units[i])
+}
@@ -0,0 +1,274 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// How long directory entries stay in the entry cache. This bounds how stale
+// lookups can be when another mount modifies the same tree.
+const entryCacheTTL = time.Second
+
+type entryKey struct {
+	parent uint64
+	name   string
+}
+
+type cachedEntry struct {
+	node    FileNode
+	expires time.Time
+}
+
+// entryCache caches the result of looking up names in directories. It is
+// used by the fast lookup mode to prefetch whole directories, so that
+// looking up or stating many entries of the same directory does not take
+// one round trip to the database per entry.
+type entryCache struct {
+	settings *settings // Settings of the names cached.
+
+	mu      sync.Mutex
+	entries map[entryKey]cachedEntry
+}
+
+func newEntryCache(s *settings) *entryCache {
+	return &entryCache{settings: s, entries: make(map[entryKey]cachedEntry)}
+}
+
+// Get returns a copy of the cached node for `name` in `parent`.
+func (c *entryCache) Get(parent uint64, name string) (*FileNode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := entryKey{parent, c.settings.foldName(name)}
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	n := e.node
+	return &n, true
+}
+
+// Put caches a copy of `n` as the entry `n.Name` in `parent`.
+func (c *entryCache) Put(parent uint64, n *FileNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[entryKey{parent, c.settings.foldName(n.Name)}] = cachedEntry{
+		node:    *n,
+		expires: time.Now().Add(entryCacheTTL),
+	}
+}
+
+// Invalidate drops the cached entry for `name` in `parent`.
+func (c *entryCache) Invalidate(parent uint64, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, entryKey{parent, c.settings.foldName(name)})
+}
+
+// InvalidateInode drops every cached entry referring to `inode`, e.g. after
+// its attributes changed.
+func (c *entryCache) InvalidateInode(inode uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if e.node.Inode == inode {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Len returns the number of cached entries, including expired ones that
+// have not been dropped yet.
+func (c *entryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Purge drops all cached entries.
+func (c *entryCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[entryKey]cachedEntry)
+}
+
+// negativeCache remembers names that were looked up in directories and did
+// not exist, so that programs probing for files that are usually missing,
+// such as shells searching PATH or editors looking for swap files, do not
+// query the database every time. Entries are dropped when the name is
+// created through this mount, and expire after a short TTL to bound how
+// long names created by other mounts stay hidden.
+type negativeCache struct {
+	ttl      time.Duration
+	settings *settings // Settings of the names cached.
+
+	mu      sync.Mutex
+	entries map[entryKey]time.Time // Expiry of each missing name.
+}
+
+// Number of names above which expired missing names are dropped.
+const negativeCacheSize = 10000
+
+func newNegativeCache(s *settings, ttl time.Duration) *negativeCache {
+	return &negativeCache{ttl: ttl, settings: s, entries: make(map[entryKey]time.Time)}
+}
+
+// Missing returns true if `name` was recently found missing in `parent`.
+func (c *negativeCache) Missing(parent uint64, name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := entryKey{parent, c.settings.foldName(name)}
+	expires, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+// Put records that `name` does not exist in `parent`.
+func (c *negativeCache) Put(parent uint64, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= negativeCacheSize {
+		for key, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.entries[entryKey{parent, c.settings.foldName(name)}] = now.Add(c.ttl)
+}
+
+// Invalidate forgets that `name` was missing in `parent`.
+func (c *negativeCache) Invalidate(parent uint64, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, entryKey{parent, c.settings.foldName(name)})
+}
+
+// Len returns the number of missing names, including expired ones that have
+// not been dropped yet.
+func (c *negativeCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Purge forgets all missing names.
+func (c *negativeCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[entryKey]time.Time)
+}
+
+// dropCaches empties the entry and block caches.
+func (fs fileSystem) dropCaches() {
+	fs.epochs.AdvanceAll()
+	if fs.entries != nil {
+		fs.entries.Purge()
+	}
+	if fs.blocks != nil {
+		fs.blocks.Purge()
+	}
+	if fs.attrs != nil {
+		fs.attrs.Purge()
+	}
+	if fs.missing != nil {
+		fs.missing.Purge()
+	}
+}
+
+// invalidateEntry drops the cached entry for `name` in `parent`, or the
+// record that it is missing, if these are cached.
+func (fs fileSystem) invalidateEntry(parent uint64, name string) {
+	if fs.entries != nil {
+		fs.entries.Invalidate(parent, name)
+	}
+	if fs.attrs != nil {
+		fs.attrs.InvalidateEntry(parent, name)
+	}
+	if fs.missing != nil {
+		fs.missing.Invalidate(parent, name)
+	}
+}
+
+// invalidateInode drops the cached entries and prefetched attributes of
+// `inode`, if they are enabled.
+func (fs fileSystem) invalidateInode(inode uint64) {
+	if fs.entries != nil {
+		fs.entries.InvalidateInode(inode)
+	}
+	if fs.attrs != nil {
+		fs.attrs.Invalidate(inode)
+	}
+}
+
+// listDir returns the nodes of the entries of the directory `inode`, in the
+// order set for the mount. If attributes are prefetched, those of the
+// entries are cached on the way.
+func (fs fileSystem) listDir(ctx context.Context, inode uint64) ([]*FileNode, error) {
+	if fs.attrs == nil {
+		return ListNodesInDirOrdered(ctx, fs.db, inode, fs.dirOrder)
+	}
+	entries, err := ListDirAttrs(ctx, fs.db, inode, fs.dirOrder)
+	if err != nil {
+		return nil, err
+	}
+	fs.attrs.Put(inode, entries)
+	nodes := make([]*FileNode, len(entries))
+	for i := range entries {
+		nodes[i] = &entries[i].node
+	}
+	return nodes, nil
+}
+
+// prefetchedEntry returns the node of the entry `name` in `parent` if it was
+// prefetched by listing `parent`.
+func (fs fileSystem) prefetchedEntry(parent uint64, name string) (*FileNode, bool) {
+	if fs.attrs == nil {
+		return nil, false
+	}
+	return fs.attrs.Lookup(parent, name)
+}
+
+// prefetchedAttrs returns the attributes of `inode` if they were prefetched
+// by listing its directory.
+func (fs fileSystem) prefetchedAttrs(inode uint64) (dirAttrs, bool) {
+	if fs.attrs == nil {
+		return dirAttrs{}, false
+	}
+	return fs.attrs.Get(inode)
+}
+
+// lookupCached looks up `name` in the directory `parent` through the entry
+// cache. On a miss, all entries of the directory are fetched at once.
+func (fs fileSystem) lookupCached(ctx context.Context, parent uint64, name string) (*FileNode, error) {
+	if n, ok := fs.entries.Get(parent, name); ok {
+		return n, nil
+	}
+	nodes, err := ListNodesInDir(ctx, fs.db, parent)
+	if err != nil {
+		return nil, err
+	}
+	var found *FileNode
+	for _, n := range nodes {
+		fs.entries.Put(parent, n)
+		if n.Name == name {
+			found = n
+		}
+	}
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return found, nil
+}
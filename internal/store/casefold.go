@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// caseFoldStatements add the indexed name_fold column used to match names
+// of case-insensitive file systems. The unique index also prevents two
+// entries of a directory from differing only in case.
+var caseFoldStatements = []string{
+	`ALTER TABLE tree ADD COLUMN IF NOT EXISTS name_fold STRING AS (lower(name)) STORED`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS tree_name_fold_idx ON tree (parent, name_fold)`,
+}
+
+// SetCaseInsensitive makes the file system case-insensitive. It fails if
+// a directory already holds names that differ only in case. This cannot be
+// undone.
+func SetCaseInsensitive(ctx context.Context, db *DB) error {
+	for _, q := range caseFoldStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q (do names differ only in case?)", q)
+		}
+	}
+	return PutSetting(ctx, db, settingCaseInsensitive, "true")
+}
+
+// nameEquals returns the SQL condition matching the name column `column`,
+// e.g. "tree.name", against the expression `value`, e.g. "$2". Matches are
+// case-insensitive on case-insensitive file systems.
+func (s *settings) nameEquals(column, value string) string {
+	if s.caseInsensitive {
+		return column + "_fold = lower(" + value + ")"
+	}
+	return column + " = " + value
+}
+
+// foldName returns the key under which `name` is cached.
+func (s *settings) foldName(name string) string {
+	name = s.normName(name)
+	if s.caseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
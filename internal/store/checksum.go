@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"hash/crc32"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// File systems created with `sqlfs init -checksums` store the CRC-32C of
+// every data block in the checksum column of data_blocks. The column is
+// computed by the database when the block is written, so older binaries and
+// `sqlfs import` keep it up to date too, and reads compare it with the
+// checksum of the data they received: a block damaged at rest or on its way
+// from the database fails the read with EIO rather than being served.
+// Inline data is not checksummed. CockroachDB only, as Postgres has no
+// crc32c function.
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptBlock is returned when a data block does not match its
+// checksum.
+var errCorruptBlock = errors.New("data block does not match its checksum")
+
+// EnableChecksums adds the checksum column to the data blocks, computing
+// the checksums of the existing blocks.
+func EnableChecksums(ctx context.Context, db *DB) error {
+	q := "ALTER TABLE data_blocks ADD COLUMN IF NOT EXISTS checksum INT8 AS (crc32c(data)) STORED"
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "failed to add the checksum column")
+	}
+	return nil
+}
+
+// hasBlockChecksums returns whether the data blocks have checksums.
+func hasBlockChecksums(ctx context.Context, db *DB) (bool, error) {
+	return columnExists(ctx, db, "data_blocks", "checksum")
+}
+
+// checkingBlocks returns whether reads verify the checksums of data blocks.
+func (s *settings) checkingBlocks() bool {
+	return s.BlockChecksums && s.verifyChecksums
+}
+
+// blockColumns returns the columns of data_blocks scanned by scanBlock.
+func (s *settings) blockColumns() string {
+	if s.checkingBlocks() {
+		return "sequence, data, checksum"
+	}
+	return "sequence, data"
+}
+
+// scanBlock scans a row of blockColumns of the inode `inode` and verifies
+// the checksum of the block, if any.
+func (s *settings) scanBlock(rows *sql.Rows, inode uint64) (int64, []byte, error) {
+	var sequence int64
+	var data []byte
+	if !s.checkingBlocks() {
+		err := rows.Scan(&sequence, &data)
+		return sequence, data, err
+	}
+	var checksum sql.NullInt64
+	if err := rows.Scan(&sequence, &data, &checksum); err != nil {
+		return 0, nil, err
+	}
+	return sequence, data, verifyBlock(inode, sequence, data, checksum)
+}
+
+// verifyBlock returns errCorruptBlock, and logs the block, if `data` does
+// not match `checksum`. Blocks without a checksum, such as inline data,
+// always match.
+func verifyBlock(inode uint64, sequence int64, data []byte, checksum sql.NullInt64) error {
+	if !checksum.Valid {
+		return nil
+	}
+	if sum := crc32.Checksum(data, castagnoli); sum != uint32(checksum.Int64) {
+		// Sequences are one-based, block indexes zero-based.
+		log.Printf("CORRUPT: block %d of inode %d has checksum %08x, expected %08x\n",
+			sequence-1, inode, sum, uint32(checksum.Int64))
+		return errCorruptBlock
+	}
+	return nil
+}
+
+// ScrubBlocks verifies up to `limit` data blocks following `after` in the
+// order of their primary key, and returns the corrupt ones, the key of the
+// last block verified and the number of blocks verified. It returns the
+// zero key once every block was verified.
+func ScrubBlocks(ctx context.Context, db *DB, after BlockKey, limit int) ([]BlockKey, BlockKey, int, error) {
+	// Sequences are one-based.
+	q := `SELECT inode, sequence, data, checksum FROM data_blocks
+  WHERE (inode, sequence) > ($1, $2) ORDER BY inode, sequence LIMIT $3`
+	rows, err := db.QueryContext(ctx, q, after.Inode, after.Index+1, limit)
+	if err != nil {
+		return nil, BlockKey{}, 0, errors.Wrap(err, "failed to read data blocks")
+	}
+	defer rows.Close()
+
+	var corrupt []BlockKey
+	var last BlockKey
+	var count int
+	for rows.Next() {
+		var inode uint64
+		var sequence int64
+		var data []byte
+		var checksum sql.NullInt64
+		if err := rows.Scan(&inode, &sequence, &data, &checksum); err != nil {
+			return nil, BlockKey{}, 0, err
+		}
+		count++
+		last = BlockKey{Inode: inode, Index: sequence - 1}
+		if verifyBlock(inode, sequence, data, checksum) != nil {
+			corrupt = append(corrupt, last)
+		}
+	}
+	return corrupt, last, count, rows.Err()
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"hash/crc32"
+	"syscall"
+	"testing"
+)
+
+func TestVerifyBlock(t *testing.T) {
+	// The check value of CRC-32C.
+	if sum := crc32.Checksum([]byte("123456789"), castagnoli); sum != 0xe3069283 {
+		t.Fatalf("CRC-32C of 123456789 = %08x", sum)
+	}
+	data := []byte("123456789")
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		checksum sql.NullInt64
+		ok       bool
+	}{
+		{"match", data, sql.NullInt64{Int64: 0xe3069283, Valid: true}, true},
+		{"no checksum", data, sql.NullInt64{}, true},
+		{"empty", nil, sql.NullInt64{Int64: 0, Valid: true}, true},
+		{"flipped bit", []byte("123456788"), sql.NullInt64{Int64: 0xe3069283, Valid: true}, false},
+		{"truncated", data[:8], sql.NullInt64{Int64: 0xe3069283, Valid: true}, false},
+		{"wrong checksum", data, sql.NullInt64{Int64: 0xe3069284, Valid: true}, false},
+	} {
+		err := verifyBlock(2, 1, tc.data, tc.checksum)
+		if (err == nil) != tc.ok {
+			t.Errorf("verifyBlock(%s) returned %v", tc.name, err)
+		}
+		if err != nil && errnoOf(err) != syscall.EIO {
+			t.Errorf("verifyBlock(%s) returned %v, which is not EIO", tc.name, err)
+		}
+	}
+}
+
+func TestBlockColumns(t *testing.T) {
+	for _, tc := range []struct {
+		checksums, verify bool
+		want              string
+	}{
+		{false, true, "sequence, data"},
+		{true, true, "sequence, data, checksum"},
+		// -verify-checksums=false skips reading them.
+		{true, false, "sequence, data"},
+	} {
+		s := &settings{BlockChecksums: tc.checksums, verifyChecksums: tc.verify}
+		if got := s.blockColumns(); got != tc.want {
+			t.Errorf("blockColumns with checksums %t and verification %t = %q, want %q", tc.checksums, tc.verify, got, tc.want)
+		}
+	}
+}
+
+// TestDatabaseChecksums checks that the checksums computed by the database
+// are the ones verified on read. It needs SQLFS_TEST_DB (see openTestDB).
+func TestDatabaseChecksums(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB(openTestDB(t))
+	if err := EnableChecksums(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("123456789")
+	if _, err := db.ExecContext(ctx, "INSERT INTO data_blocks (inode, sequence, data) VALUES (2, 1, $1), (2, 2, $2)", data, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, last, count, err := ScrubBlocks(ctx, db, BlockKey{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 0 || count != 2 || last != (BlockKey{Inode: 2, Index: 1}) {
+		t.Errorf("ScrubBlocks = %v, %+v, %d", corrupt, last, count)
+	}
+	var checksum sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT checksum FROM data_blocks WHERE inode = 2 AND sequence = 1").Scan(&checksum); err != nil {
+		t.Fatal(err)
+	}
+	if uint32(checksum.Int64) != 0xe3069283 {
+		t.Errorf("database checksum = %08x, want e3069283", uint32(checksum.Int64))
+	}
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// How long appends stay in memory at most, which bounds what a crash of the
+// mount loses for applications that never call fsync(2).
+const appendFlushDelay = time.Second
+
+// How long committing a tail may take if the operations have no timeout, so
+// that a database that hangs does not hold the tails, and everything
+// waiting for them, forever.
+const appendCommitTimeout = 30 * time.Second
+
+// appendCoalescer keeps the small writes made at the end of files in memory,
+// in a tail per file, so that applications writing logs line by line do not
+// rewrite the last block of the file in a transaction per line. A tail is
+// committed once it reaches the end of the block it started in, so that
+// every commit but the first fills a whole block, as well as on fsync(2) and
+// close(2), after appendFlushDelay, and before anything else reads or
+// changes the data of the file.
+//
+// As with asynchronous writes, the node holds the size of the file
+// including its tail, and a tail that fails to commit is reported by the
+// next fsync(2) or close(2) of the file.
+type appendCoalescer struct {
+	settings *settings     // Block size of the files.
+	timeout  time.Duration // Of each commit of a tail.
+
+	mu       sync.Mutex
+	cond     *sync.Cond // Signaled whenever a tail is committed.
+	tails    map[uint64]*appendTail
+	flushing map[uint64]int // Number of tails being committed per inode.
+	bytes    int64
+	errs     map[uint64]error
+}
+
+// appendTail is the data appended to a file and not committed yet.
+type appendTail struct {
+	n      *FileNode
+	offset int64 // Where the tail starts in the file.
+	data   []byte
+	timer  *time.Timer
+}
+
+func newAppendCoalescer(s *settings) *appendCoalescer {
+	c := &appendCoalescer{
+		settings: s,
+		timeout:  appendCommitTimeout,
+		tails:    make(map[uint64]*appendTail),
+		flushing: make(map[uint64]int),
+		errs:     make(map[uint64]error),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Append keeps a copy of `data`, written at `offset` of `n`, in memory if
+// it continues the tail of `n`, or if it is smaller than a block and starts
+// a tail at the end of `n`. It returns whether the data was kept, and
+// whether the tail should be committed as it is full. Must be called with
+// the node lock held, before the size of `n` is updated.
+func (c *appendCoalescer) Append(n *FileNode, offset int64, data []byte) (kept, full bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.tails[n.Inode]
+	switch {
+	case t != nil && offset == t.offset+int64(len(t.data)):
+	case t == nil && uint64(offset) == n.Size && int64(len(data)) < c.settings.BlockSize:
+		t = &appendTail{n: n, offset: offset}
+		inode := n.Inode
+		t.timer = time.AfterFunc(appendFlushDelay, func() {
+			// Failures are reported by the next fsync(2) or close(2).
+			_ = c.Flush(inode)
+		})
+		c.tails[inode] = t
+	default:
+		return false, false
+	}
+	t.data = append(t.data, data...)
+	c.bytes += int64(len(data))
+	end := t.offset + int64(len(t.data))
+	return true, end/c.settings.BlockSize > t.offset/c.settings.BlockSize
+}
+
+// Flush commits the tail of `inode`, if any, and waits for the tails of it
+// being committed by others.
+func (c *appendCoalescer) Flush(inode uint64) error {
+	c.mu.Lock()
+	t := c.tails[inode]
+	if t != nil {
+		t.timer.Stop()
+		delete(c.tails, inode)
+		c.flushing[inode]++
+	}
+	c.mu.Unlock()
+
+	var err error
+	if t != nil {
+		// Flushes run from timers and for any request, so they have a
+		// deadline of their own.
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err = t.n.fs.commitWrite(ctx, t.n, t.offset, t.data)
+		cancel()
+		if err != nil {
+			log.Printf("failed to write the appends to inode %d: %s\n", inode, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t != nil {
+		c.bytes -= int64(len(t.data))
+		if c.flushing[inode]--; c.flushing[inode] == 0 {
+			delete(c.flushing, inode)
+		}
+		if err != nil && c.errs[inode] == nil {
+			c.errs[inode] = err
+		}
+		c.cond.Broadcast()
+	}
+	for c.flushing[inode] > 0 {
+		c.cond.Wait()
+	}
+	return err
+}
+
+// FlushAll commits every tail.
+func (c *appendCoalescer) FlushAll() {
+	c.mu.Lock()
+	inodes := make([]uint64, 0, len(c.tails))
+	for inode := range c.tails {
+		inodes = append(inodes, inode)
+	}
+	c.mu.Unlock()
+	for _, inode := range inodes {
+		_ = c.Flush(inode)
+	}
+}
+
+// Err returns and clears the error of the first tail of `inode` that failed
+// to commit since the last call.
+func (c *appendCoalescer) Err(inode uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.errs[inode]
+	delete(c.errs, inode)
+	return err
+}
+
+// Bytes returns the number of bytes appended and not committed yet.
+func (c *appendCoalescer) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// flushAppends commits the tail of `inode` kept in memory, if any.
+func (fs fileSystem) flushAppends(inode uint64) {
+	if fs.appends != nil {
+		_ = fs.appends.Flush(inode)
+	}
+}
+
+// syncAppends commits the tail of `inode` and returns the error of the first
+// tail of it that failed to commit since the last call.
+func (fs fileSystem) syncAppends(inode uint64) error {
+	if fs.appends == nil {
+		return nil
+	}
+	_ = fs.appends.Flush(inode)
+	return fs.appends.Err(inode)
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Files larger than this are not indexed.
+	maxIndexedSize = 1 << 20
+
+	// How long the indexer waits for writes to a file to settle before
+	// indexing it. Each write restarts the wait.
+	indexDelay = 2 * time.Second
+)
+
+// contentIndexStatements creates the optional full-text index over file
+// contents. It is only created by `sqlfs init -content-index`, as it
+// requires a CockroachDB version with TSVECTOR support.
+var contentIndexStatements = []string{
+	`CREATE TABLE IF NOT EXISTS file_text (
+  inode INT,
+  body  TSVECTOR NOT NULL,
+  PRIMARY KEY (inode),
+  INVERTED INDEX body_idx (body)
+)`,
+}
+
+// CreateContentIndex creates the tables holding the full-text index.
+func CreateContentIndex(ctx context.Context, db *DB) error {
+	for _, q := range contentIndexStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q", q)
+		}
+	}
+	return nil
+}
+
+// contentIndexer keeps the full-text index up to date with file contents.
+// Modified files are queued and indexed in the background once they have
+// not been written to for indexDelay, so that a file being written is only
+// indexed once.
+type contentIndexer struct {
+	db *DB
+
+	mu      sync.Mutex
+	pending map[uint64]time.Time // Inode to time of the last modification.
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newContentIndexer(db *DB) *contentIndexer {
+	x := &contentIndexer{
+		db:      db,
+		pending: make(map[uint64]time.Time),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go x.run()
+	return x
+}
+
+// Queue schedules `inode` to be (re)indexed. Inodes that no longer exist or
+// that are not text files are removed from the index.
+func (x *contentIndexer) Queue(inode uint64) {
+	x.mu.Lock()
+	x.pending[inode] = time.Now()
+	x.mu.Unlock()
+}
+
+func (x *contentIndexer) run() {
+	defer close(x.doneCh)
+	ticker := time.NewTicker(indexDelay / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			x.flush(time.Now().Add(-indexDelay))
+		case <-x.stopCh:
+			x.flush(time.Now())
+			return
+		}
+	}
+}
+
+// flush indexes all queued inodes last modified before `settled`.
+func (x *contentIndexer) flush(settled time.Time) {
+	var ready []uint64
+	x.mu.Lock()
+	for inode, t := range x.pending {
+		if !t.After(settled) {
+			ready = append(ready, inode)
+			delete(x.pending, inode)
+		}
+	}
+	x.mu.Unlock()
+
+	ctx := context.Background()
+	for _, inode := range ready {
+		if err := IndexContent(ctx, x.db, inode); err != nil {
+			log.Printf("failed to index inode %d: %s\n", inode, err)
+		}
+	}
+}
+
+// Close indexes all pending files and stops the background goroutine.
+func (x *contentIndexer) Close() {
+	close(x.stopCh)
+	<-x.doneCh
+}
+
+// indexContent queues `inode` for indexing if the content index is enabled.
+func (fs fileSystem) indexContent(inode uint64) {
+	if fs.index != nil {
+		fs.index.Queue(inode)
+	}
+}
+
+// isText returns true if `data` looks like text that is worth indexing.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// IndexContent updates the full-text index entry of `inode`. The entry is
+// removed if the inode no longer exists, is too large or is not a text file.
+func IndexContent(ctx context.Context, db *DB, inode uint64) error {
+	n, err := GetNodeByID(ctx, db, inode)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	var text []byte
+	if err == nil && n.IsRegular() && n.Size > 0 && n.Size <= maxIndexedSize {
+		var buf bytes.Buffer
+		if err := CopyData(ctx, db, n, &buf); err != nil {
+			return err
+		}
+		if isText(buf.Bytes()) {
+			text = buf.Bytes()
+		}
+	}
+
+	if text == nil {
+		_, err := db.ExecContext(ctx, "DELETE FROM file_text WHERE inode = $1", inode)
+		return err
+	}
+	q := "UPSERT INTO file_text (inode, body) VALUES ($1, to_tsvector('english', $2))"
+	_, err = db.ExecContext(ctx, q, inode, string(text))
+	return err
+}
+
+// searchResult is a file matching a full-text search.
+type searchResult struct {
+	Path string
+	Rank float64
+}
+
+// SearchContent returns up to `limit` files whose contents match `query`,
+// best matches first. Files that are no longer linked in the tree are
+// skipped.
+func SearchContent(ctx context.Context, db *DB, query string, limit int) ([]searchResult, error) {
+	q := `SELECT inode, ts_rank(body, plainto_tsquery('english', $1)) AS rank
+  FROM file_text WHERE body @@ plainto_tsquery('english', $1)
+  ORDER BY rank DESC, inode LIMIT $2`
+	rows, err := db.QueryContext(ctx, q, query, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not search file contents")
+	}
+	type match struct {
+		inode uint64
+		rank  float64
+	}
+	var matches []match
+	for rows.Next() {
+		var m match
+		if err := rows.Scan(&m.inode, &m.rank); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "failed to scan search result")
+		}
+		matches = append(matches, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var results []searchResult
+	for _, m := range matches {
+		path, err := NodePath(ctx, db, m.inode)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, searchResult{Path: path, Rank: m.rank})
+	}
+	return results, nil
+}
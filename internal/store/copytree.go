@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CopyTree copies the file or directory `src` to the entry `name` of the
+// directory `parent`, in a single transaction, and returns the number of
+// inodes created. The contents are copied by the database without going
+// through the client, so a tree is copied without reading it; they are not
+// shared though, as data blocks belong to a single inode. Files linked
+// several times below `src` stay linked together in the copy, and files of
+// the tree tiered to an object store make the copy fail, as an object
+// belongs to a single file too.
+func CopyTree(ctx context.Context, db *DB, src *FileNode, parent uint64, name string) (int, error) {
+	if err := db.validName(name); err != nil {
+		return 0, err
+	}
+	name = db.normName(name)
+	nodes := []*FileNode{src}
+	if src.IsDirectory() {
+		below, err := ListSubtree(ctx, db, src.Inode, 0)
+		if err != nil {
+			return 0, err
+		}
+		nodes = append(nodes, below...)
+	}
+	tiered, err := TableExists(ctx, db, "tiered_files")
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return 0, err
+	}
+	// New inode of each inode of the tree, and the number of links to it
+	// in the copy.
+	inodes := make(map[uint64]uint64)
+	links := make(map[uint64]uint32)
+	dirs := make(map[uint64]bool)
+	now := time.Now()
+	for i, n := range nodes {
+		entryParent, entryName := parent, name
+		if i > 0 {
+			entryParent = inodes[n.Parent]
+			entryName = path.Base(n.Name)
+		}
+		inode, ok := inodes[n.Inode]
+		if !ok {
+			if inode, err = copyInode(ctx, tx, n, tiered); err != nil {
+				_ = tx.Rollback()
+				return 0, err
+			}
+			inodes[n.Inode] = inode
+			dirs[inode] = n.IsDirectory()
+		}
+		links[inode]++
+		q := "INSERT INTO tree (inode, parent, name) VALUES ($1, $2, $3)"
+		if _, err := tx.ExecContext(ctx, q, inode, entryParent, entryName); err != nil {
+			_ = tx.Rollback()
+			if sqlState(err) == "23505" {
+				return 0, errors.Errorf("%s already exists", name)
+			}
+			return 0, errors.Wrapf(err, "failed to link inode %d in parent %d", inode, entryParent)
+		}
+	}
+	for inode, count := range links {
+		if dirs[inode] {
+			// Directories keep their count, as their whole tree is copied.
+			continue
+		}
+		q := "UPDATE inodes SET nlink = $2, ctime = $3 WHERE inode = $1"
+		if _, err := tx.ExecContext(ctx, q, inode, count, now); err != nil {
+			_ = tx.Rollback()
+			return 0, errors.Wrapf(err, "failed to set the link count of inode %d", inode)
+		}
+	}
+	if err := touchDir(ctx, tx, parent, now); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(links), nil
+}
+
+// copyInode copies the metadata, contents and extended attributes of `n`
+// to a new inode, and returns its number.
+func copyInode(ctx context.Context, tx *fsTx, n *FileNode, tiered bool) (uint64, error) {
+	if tiered && n.IsRegular() {
+		var object string
+		err := tx.QueryRowContext(ctx, "SELECT object FROM tiered_files WHERE inode = $1", n.Inode).Scan(&object)
+		if err == nil {
+			return 0, errors.Errorf("inode %d is tiered to %s and cannot be copied", n.Inode, object)
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+	inode, err := allocateInode(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	columns := inodeMetadataColumns
+	if tx.inlineDataSize > 0 {
+		columns += ", inline_data"
+	}
+	q1 := "INSERT INTO inodes (inode, " + columns + ") SELECT $2, " + columns + " FROM inodes WHERE inode = $1"
+	if _, err := tx.ExecContext(ctx, q1, n.Inode, inode); err != nil {
+		return 0, errors.Wrapf(err, "failed to copy inode %d", n.Inode)
+	}
+	q2 := "INSERT INTO data_blocks (inode, sequence, data) SELECT $2, sequence, data FROM data_blocks WHERE inode = $1"
+	if _, err := tx.ExecContext(ctx, q2, n.Inode, inode); err != nil {
+		return 0, errors.Wrapf(err, "failed to copy the data blocks of inode %d", n.Inode)
+	}
+	if tx.XattrsEnabled {
+		q3 := "INSERT INTO xattrs (inode, name, value) SELECT $2, name, value FROM xattrs WHERE inode = $1"
+		if _, err := tx.ExecContext(ctx, q3, n.Inode, inode); err != nil {
+			return 0, errors.Wrapf(err, "failed to copy the xattrs of inode %d", n.Inode)
+		}
+	}
+	return inode, nil
+}
@@ -0,0 +1,37 @@
+package store
+
+import "fmt"
+
+// dirOrder is the order in which the entries of a directory are listed.
+// Listings in a stable order let readers resume them at an offset, e.g. NFS
+// cookies or the offsets of getdents, without skipping or repeating entries
+// that did not change in the meantime.
+type dirOrder int
+
+const (
+	// dirOrderName lists entries by name, in byte order. This is backed by
+	// the tree_parent_name_idx index.
+	dirOrderName dirOrder = iota
+	// dirOrderInode lists entries by inode number, i.e. roughly in the order
+	// in which they were created.
+	dirOrderInode
+)
+
+func parseDirOrder(s string) (dirOrder, error) {
+	switch s {
+	case "name":
+		return dirOrderName, nil
+	case "inode":
+		return dirOrderInode, nil
+	}
+	return 0, fmt.Errorf("invalid directory order %q (must be name or inode)", s)
+}
+
+// orderBy returns the ORDER BY clause listing the entries of the tree table
+// in order `o`. Names break ties, since hard links share an inode.
+func (o dirOrder) orderBy() string {
+	if o == dirOrderInode {
+		return "ORDER BY tree.inode, tree.name"
+	}
+	return "ORDER BY tree.name"
+}
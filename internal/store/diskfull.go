@@ -0,0 +1,74 @@
+package store
+
+import (
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long writes fail right away with ENOSPC once the database reported
+// that its disk is full, before one is let through to find out whether
+// space was freed.
+const diskFullRetry = 5 * time.Second
+
+// Free space reported by Statfs while the database accepts writes. The
+// database does not tell how much space it has left, so this only keeps the
+// tools that check for free space before writing working.
+const nominalFreeBytes = 1 << 50
+
+// diskFullState tracks whether the database rejects writes as its disk is
+// full (SQLSTATE 53100), so that applications get ENOSPC, and df(1) no free
+// space, rather than EIO for every write.
+type diskFullState struct {
+	mu      sync.Mutex
+	full    bool
+	checked time.Time // When a write last hit the full disk.
+}
+
+// record updates the state with the outcome `err` of a write.
+func (d *diskFullState) record(err error) {
+	if d == nil || err != nil && errnoOf(err) != syscall.ENOSPC {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case err != nil && !d.full:
+		log.Println("The database is out of disk space, failing writes with ENOSPC.")
+	case err == nil && d.full:
+		log.Println("The database accepts writes again.")
+	}
+	d.full = err != nil
+	if d.full {
+		d.checked = time.Now()
+	}
+}
+
+// check returns errNoSpace if the disk is known to be full, except for a
+// write every diskFullRetry, which is let through to probe the database.
+func (d *diskFullState) check() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.full {
+		return nil
+	}
+	if time.Since(d.checked) < diskFullRetry {
+		return errNoSpace
+	}
+	d.checked = time.Now()
+	return nil
+}
+
+// Full returns true if the disk of the database is known to be full.
+func (d *diskFullState) Full() bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.full
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Failures of the storage layer are mapped to errno values in one place, so
+// that the FUSE handlers and the network servers report them alike:
+//   - a syscall.Errno or fuse.Errno, possibly wrapped, is returned as is;
+//   - sql.ErrNoRows, a row that vanished, is ENOENT;
+//   - errNoSpace, a write beyond the space the file system may use, is
+//     ENOSPC;
+//   - errHistorical, a change to a historical view, is EROFS;
+//   - errXattrExists and errNoXattr are EEXIST and ENODATA (ENOATTR on BSDs);
+//   - errors of the database with a SQLSTATE listed in sqlStateErrnos, such
+//     as a duplicate entry created concurrently by another mount, are mapped
+//     through it;
+//   - anything else, including queries that failed, is EIO.
+//
+// Nothing on the data path panics: a row that cannot be decoded fails the
+// operation that read it, rather than the whole mount.
+
+// errNoSpace is returned when a change would exceed the space the file
+// system may use.
+var errNoSpace = errors.New("no space left on the file system")
+
+// errnoOf returns the errno of `err`.
+func errnoOf(err error) syscall.Errno {
+	switch cause := errors.Cause(err).(type) {
+	case syscall.Errno:
+		return cause
+	case fuse.Errno:
+		return syscall.Errno(cause)
+	}
+	switch errors.Cause(err) {
+	case sql.ErrNoRows:
+		return syscall.ENOENT
+	case errNoSpace:
+		return syscall.ENOSPC
+	case errHistorical:
+		return syscall.EROFS
+	case errXattrExists:
+		return syscall.EEXIST
+	case errNoXattr:
+		return syscall.Errno(fuse.ErrNoXattr)
+	}
+	if errno, ok := sqlStateErrnos[sqlState(err)]; ok {
+		return errno
+	}
+	return syscall.EIO
+}
+
+// sqlStateErrnos maps the SQLSTATE codes of statements rejected by the
+// database to errno values.
+var sqlStateErrnos = map[string]syscall.Errno{
+	"23505": syscall.EEXIST,       // unique_violation
+	"23503": syscall.ENOENT,       // foreign_key_violation
+	"22001": syscall.ENAMETOOLONG, // string_data_right_truncation
+	"53100": syscall.ENOSPC,       // disk_full
+	"25006": syscall.EROFS,        // read_only_sql_transaction
+}
+
+// sqlState returns the SQLSTATE code of the database error wrapped in
+// `err`, or "". Errors of lib/pq are *pq.Error, and those of pgx have a
+// SQLState method.
+func sqlState(err error) string {
+	switch err := errors.Cause(err).(type) {
+	case *pq.Error:
+		return string(err.Code)
+	case interface{ SQLState() string }:
+		return err.SQLState()
+	}
+	return ""
+}
+
+// errnoFromErr is returned by handlers when an operation fails with `err`.
+// If the request was interrupted or timed out, the query was aborted and the
+// context error is returned instead: the FUSE server answers EINTR if the
+// kernel interrupted the request (e.g. Ctrl-C on a blocked read), and EIO
+// otherwise.
+func errnoFromErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if errno := errnoOf(err); errno != syscall.EIO {
+		return fuse.Errno(errno)
+	}
+	return fuse.EIO
+}
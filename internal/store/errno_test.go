@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// sqlStateError is a database error of a driver other than lib/pq, such as
+// pgx.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "SQLSTATE " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestErrnoOf(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want syscall.Errno
+	}{
+		{"errno", syscall.ENOTEMPTY, syscall.ENOTEMPTY},
+		{"wrapped errno", errors.Wrap(syscall.EXDEV, "rename"), syscall.EXDEV},
+		{"fuse errno", fuse.Errno(syscall.EPERM), syscall.EPERM},
+		{"wrapped fuse errno", errors.Wrapf(fuse.Errno(syscall.ENOTDIR), "lookup %s", "a"), syscall.ENOTDIR},
+		{"no rows", sql.ErrNoRows, syscall.ENOENT},
+		{"wrapped no rows", errors.Wrap(sql.ErrNoRows, "inode 42"), syscall.ENOENT},
+		{"no space", errNoSpace, syscall.ENOSPC},
+		{"historical", errors.WithMessage(errHistorical, "write"), syscall.EROFS},
+		{"xattr exists", errXattrExists, syscall.EEXIST},
+		{"no xattr", errNoXattr, syscall.Errno(fuse.ErrNoXattr)},
+		{"unique violation", &pq.Error{Code: "23505"}, syscall.EEXIST},
+		{"wrapped unique violation", errors.Wrap(&pq.Error{Code: "23505"}, "create"), syscall.EEXIST},
+		{"foreign key violation", &pq.Error{Code: "23503"}, syscall.ENOENT},
+		{"name too long", &pq.Error{Code: "22001"}, syscall.ENAMETOOLONG},
+		{"disk full", &pq.Error{Code: "53100"}, syscall.ENOSPC},
+		{"read-only transaction", &pq.Error{Code: "25006"}, syscall.EROFS},
+		{"other driver", errors.Wrap(sqlStateError("23505"), "create"), syscall.EEXIST},
+		// Other failures of the database, such as a retryable conflict or
+		// a syntax error, are I/O errors.
+		{"serialization failure", &pq.Error{Code: "40001"}, syscall.EIO},
+		{"syntax error", sqlStateError("42601"), syscall.EIO},
+		{"connection", errors.New("driver: bad connection"), syscall.EIO},
+	} {
+		if got := errnoOf(tc.err); got != tc.want {
+			t.Errorf("errnoOf(%s) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestErrnoFromErr(t *testing.T) {
+	ctx := context.Background()
+	if got := errnoFromErr(ctx, errors.Wrap(sql.ErrNoRows, "lookup")); got != fuse.Errno(syscall.ENOENT) {
+		t.Errorf("errnoFromErr(no rows) = %v, want ENOENT", got)
+	}
+	if got := errnoFromErr(ctx, errors.New("query failed")); got != fuse.EIO {
+		t.Errorf("errnoFromErr(query failed) = %v, want EIO", got)
+	}
+
+	// An interrupted request reports the context error, whatever the query
+	// failed with.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if got := errnoFromErr(canceled, &pq.Error{Code: "57014"}); got != context.Canceled {
+		t.Errorf("errnoFromErr of a canceled request = %v, want %v", got, context.Canceled)
+	}
+	expired, cancel := context.WithTimeout(ctx, 0)
+	defer cancel()
+	<-expired.Done()
+	if got := errnoFromErr(expired, sql.ErrNoRows); got != context.DeadlineExceeded {
+		t.Errorf("errnoFromErr of a request past its deadline = %v, want %v", got, context.DeadlineExceeded)
+	}
+}
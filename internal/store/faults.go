@@ -0,0 +1,258 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Fault injection makes chosen SQL statements of a mount fail or slow down,
+// so that the paths taken when the database misbehaves (transaction
+// retries, rollbacks, the circuit breaker and the invalidation of caches)
+// can be exercised on purpose. It is enabled with `sqlfs mount
+// -inject-faults`, and must never be used on a file system holding data
+// that matters.
+//
+// Faults are given as comma-separated rules KIND:RATE[:PATTERN]:
+//   - KIND is serialization (SQLSTATE 40001, which transactions retry),
+//     unavailable (57P03, which counts towards the circuit breaker), error
+//     (XX000, which aborts the operation with EIO) or latency=DURATION;
+//   - RATE is the probability that a matching statement is affected, e.g.
+//     0.05, or N > 1 to affect every N-th matching statement, which is
+//     deterministic;
+//   - PATTERN, if set, restricts the rule to the statements containing it,
+//     ignoring case, e.g. "UPSERT INTO data_blocks". Commits match COMMIT.
+//
+// The first rule that fires for a statement applies; latency rules delay
+// the statement and let later rules apply as well.
+
+// faultRule is a rule of fault injection.
+type faultRule struct {
+	spec    string
+	kind    string
+	latency time.Duration
+	prob    float64 // Probability of firing, if every is 0.
+	every   uint64  // Fire on every N-th matching statement.
+	pattern string  // Lower case.
+
+	matched, fired uint64
+}
+
+// faultStats is the number of statements a rule matched and affected.
+type faultStats struct {
+	Rule    string `json:"rule"`
+	Matched uint64 `json:"matched"`
+	Fired   uint64 `json:"fired"`
+}
+
+// faultInjector decides which statements fail.
+type faultInjector struct {
+	mu    sync.Mutex
+	rules []*faultRule
+	rng   *rand.Rand
+}
+
+// ParseFaultRules parses the rules of `spec`. Random rules draw from a
+// generator seeded with `seed`, so that a run can be replayed.
+func ParseFaultRules(spec string, seed int64) (*faultInjector, error) {
+	inj := &faultInjector{rng: rand.New(rand.NewSource(seed))}
+	for _, s := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(s), ":", 3)
+		if len(parts) < 2 {
+			return nil, errors.Errorf("invalid fault rule %q, expected KIND:RATE[:PATTERN]", s)
+		}
+		r := &faultRule{spec: strings.TrimSpace(s), kind: parts[0]}
+		switch {
+		case r.kind == "serialization", r.kind == "unavailable", r.kind == "error":
+		case strings.HasPrefix(r.kind, "latency="):
+			d, err := time.ParseDuration(strings.TrimPrefix(r.kind, "latency="))
+			if err != nil || d <= 0 {
+				return nil, errors.Errorf("invalid latency in fault rule %q", s)
+			}
+			r.kind, r.latency = "latency", d
+		default:
+			return nil, errors.Errorf("unknown fault %q, expected serialization, unavailable, error or latency=DURATION", r.kind)
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		switch {
+		case err != nil || rate <= 0:
+			return nil, errors.Errorf("invalid rate in fault rule %q", s)
+		case rate > 1:
+			if rate != float64(uint64(rate)) {
+				return nil, errors.Errorf("invalid rate in fault rule %q, expected a probability or a whole number", s)
+			}
+			r.every = uint64(rate)
+		default:
+			r.prob = rate
+		}
+		if len(parts) == 3 {
+			r.pattern = strings.ToLower(parts[2])
+		}
+		inj.rules = append(inj.rules, r)
+	}
+	return inj, nil
+}
+
+// inject applies the rules to the statement `query`, and returns the error
+// it must fail with, if any.
+func (inj *faultInjector) inject(ctx context.Context, query string) error {
+	lower := strings.ToLower(query)
+	var delay time.Duration
+	var err error
+	inj.mu.Lock()
+	for _, r := range inj.rules {
+		if r.pattern != "" && !strings.Contains(lower, r.pattern) {
+			continue
+		}
+		r.matched++
+		if r.every > 0 && r.matched%r.every != 0 || r.every == 0 && inj.rng.Float64() >= r.prob {
+			continue
+		}
+		r.fired++
+		if r.kind == "latency" {
+			delay += r.latency
+			continue
+		}
+		err = &pq.Error{Code: faultCodes[r.kind], Message: "fault injected by rule " + r.spec}
+		break
+	}
+	inj.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// SQLSTATE codes of the injected errors.
+var faultCodes = map[string]pq.ErrorCode{
+	"serialization": "40001", // serialization_failure
+	"unavailable":   "57P03", // cannot_connect_now
+	"error":         "XX000", // internal_error
+}
+
+// Stats returns the counters of each rule.
+func (inj *faultInjector) Stats() []faultStats {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	stats := make([]faultStats, len(inj.rules))
+	for i, r := range inj.rules {
+		stats[i] = faultStats{Rule: r.spec, Matched: r.matched, Fired: r.fired}
+	}
+	return stats
+}
+
+// FaultConnector opens connections whose statements are subject to a
+// faultInjector.
+type FaultConnector struct {
+	driver.Connector
+	Faults *faultInjector
+}
+
+// Connect implements driver.Connector.
+func (c *FaultConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, faults: c.Faults}, nil
+}
+
+// faultConn runs the statements, including those of transactions, that the
+// rules let through.
+type faultConn struct {
+	driver.Conn
+	faults *faultInjector
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *faultConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.faults.inject(ctx, query); err != nil {
+		return nil, err
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *faultConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.faults.inject(ctx, query); err != nil {
+		return nil, err
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *faultConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var err error
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &faultTx{Tx: tx, faults: c.faults}, nil
+}
+
+// Ping implements driver.Pinger.
+func (c *faultConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements driver.SessionResetter.
+func (c *faultConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator.
+func (c *faultConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// faultTx fails its commit when a rule matching COMMIT fires, rolling the
+// transaction back as a failed commit would.
+type faultTx struct {
+	driver.Tx
+	faults *faultInjector
+}
+
+// Commit implements driver.Tx.
+func (tx *faultTx) Commit() error {
+	if err := tx.faults.inject(context.Background(), "COMMIT"); err != nil {
+		_ = tx.Tx.Rollback()
+		return err
+	}
+	return tx.Tx.Commit()
+}
@@ -0,0 +1,21 @@
+package store
+
+import (
+	"os"
+	"time"
+)
+
+// nodeFileInfo adapts a FileNode to the os.FileInfo interface.
+type nodeFileInfo struct {
+	n *FileNode
+}
+
+func (fi nodeFileInfo) Name() string       { return fi.n.Name }
+func (fi nodeFileInfo) Size() int64        { return int64(fi.n.Size) }
+func (fi nodeFileInfo) Mode() os.FileMode  { return fi.n.Mode }
+func (fi nodeFileInfo) ModTime() time.Time { return fi.n.Mtime }
+func (fi nodeFileInfo) IsDir() bool        { return fi.n.IsDirectory() }
+func (fi nodeFileInfo) Sys() interface{}   { return fi.n }
+
+// FileInfo returns the os.FileInfo of the node.
+func (n *FileNode) FileInfo() os.FileInfo { return nodeFileInfo{n} }
@@ -0,0 +1,234 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FindFilter holds the predicates of `sqlfs find`. Zero values match
+// everything.
+type FindFilter struct {
+	Name       string      // Glob matched against the entry name.
+	Type       os.FileMode // One of os.ModeDir, os.ModeSymlink, or 0 for regular files.
+	HasType    bool
+	MinSize    uint64 // Inclusive.
+	MaxSize    uint64 // Inclusive, if HasMaxSize.
+	HasMaxSize bool
+	NewerMod   time.Time
+	OlderMod   time.Time
+}
+
+// FindPredicates are the predicates of `sqlfs find` as given on its command
+// line, which the query file takes too. Empty ones match everything.
+type FindPredicates struct {
+	Name  string // Glob, e.g. *.log.
+	Type  string // f (file), d (directory) or l (symlink).
+	Size  string // Larger (+N) or smaller (-N) than N bytes, e.g. +10M.
+	Mtime string // Modified more (+N) or less (-N) than N days ago.
+}
+
+// Filter returns the filter of the predicates, -mtime counting days back
+// from `now`.
+func (a FindPredicates) Filter(now time.Time) (FindFilter, error) {
+	var f FindFilter
+	f.Name = a.Name
+	switch a.Type {
+	case "":
+	case "f":
+		f.HasType, f.Type = true, 0
+	case "d":
+		f.HasType, f.Type = true, os.ModeDir
+	case "l":
+		f.HasType, f.Type = true, os.ModeSymlink
+	default:
+		return f, errors.Errorf("invalid type %q", a.Type)
+	}
+	if a.Size != "" {
+		var v ByteSize
+		if err := v.Set(strings.TrimLeft(a.Size, "+-")); err != nil {
+			return f, err
+		}
+		switch (a.Size)[0] {
+		case '+':
+			f.MinSize = uint64(v) + 1
+		case '-':
+			if v == 0 {
+				return f, errors.New("no file is smaller than 0 bytes")
+			}
+			f.HasMaxSize, f.MaxSize = true, uint64(v)-1
+		default:
+			f.MinSize = uint64(v)
+			f.HasMaxSize, f.MaxSize = true, uint64(v)
+		}
+	}
+	if a.Mtime != "" {
+		var days int
+		if _, err := fmt.Sscanf(strings.TrimLeft(a.Mtime, "+-"), "%d", &days); err != nil {
+			return f, errors.Errorf("invalid mtime %q", a.Mtime)
+		}
+		cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+		if (a.Mtime)[0] == '+' {
+			f.OlderMod = cutoff
+		} else {
+			f.NewerMod = cutoff
+		}
+	}
+	return f, nil
+}
+
+// parseFindArgs parses `args` as the command line of `sqlfs find`, e.g.
+// "-name *.log -size +1M dir", and returns its predicates and its arguments.
+func parseFindArgs(args []string) (FindPredicates, []string, error) {
+	var p FindPredicates
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			rest = append(rest, arg)
+			continue
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		value, hasValue := "", false
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+		var dest *string
+		switch name {
+		case "name":
+			dest = &p.Name
+		case "type":
+			dest = &p.Type
+		case "size":
+			dest = &p.Size
+		case "mtime":
+			dest = &p.Mtime
+		default:
+			return p, nil, errors.Errorf("unknown predicate %s", arg)
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return p, nil, errors.Errorf("missing value of %s", arg)
+			}
+			i++
+			value = args[i]
+		}
+		*dest = value
+	}
+	return p, rest, nil
+}
+
+// globToLike converts a shell glob to an SQL LIKE pattern that matches a
+// superset of the names matched by the glob. Character classes become a
+// single character wildcard, so results must still be checked with
+// path.Match.
+func globToLike(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				b.WriteString("[")
+				continue
+			}
+			b.WriteByte('_')
+			i += end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			fallthrough
+		default:
+			if c == '%' || c == '_' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// FindNodes returns the nodes below the directory `dir` that match `f`. The
+// predicates are evaluated by the database. The Name of each node is set to
+// its path relative to `dir`.
+func FindNodes(ctx context.Context, db *DB, dir uint64, f FindFilter) ([]*FileNode, error) {
+	var conds []string
+	args := []interface{}{dir}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.Name != "" {
+		if _, err := path.Match(f.Name, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", f.Name)
+		}
+		conds = append(conds, "subtree.name LIKE "+arg(globToLike(f.Name)))
+	}
+	if f.HasType {
+		if f.Type == 0 {
+			conds = append(conds, "inodes.mode & "+arg(uint32(os.ModeType))+" = 0")
+		} else {
+			conds = append(conds, "inodes.mode & "+arg(uint32(f.Type))+" != 0")
+		}
+	}
+	if f.MinSize > 0 {
+		conds = append(conds, "inodes.size >= "+arg(f.MinSize))
+	}
+	if f.HasMaxSize {
+		conds = append(conds, "inodes.size <= "+arg(f.MaxSize))
+	}
+	if !f.NewerMod.IsZero() {
+		conds = append(conds, "inodes.mtime > "+arg(f.NewerMod))
+	}
+	if !f.OlderMod.IsZero() {
+		conds = append(conds, "inodes.mtime < "+arg(f.OlderMod))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	q := `WITH RECURSIVE subtree (path, name, inode) AS (
+    SELECT name, name, inode FROM tree WHERE parent = $1
+  UNION ALL
+    SELECT subtree.path || '/' || tree.name, tree.name, tree.inode
+    FROM tree JOIN subtree ON tree.parent = subtree.inode
+  )
+  SELECT subtree.path, inodes.inode, ` + prefixColumns("inodes", inodeColumns) + `
+  FROM subtree JOIN inodes ON subtree.inode = inodes.inode ` + where + `
+  ORDER BY subtree.path`
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not search the tree")
+	}
+	defer rows.Close()
+
+	var nodes []*FileNode
+	for rows.Next() {
+		n := &FileNode{}
+		dest := append([]interface{}{&n.Name, &n.Inode}, inodeFields(n)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "failed to scan search result")
+		}
+		if f.Name != "" {
+			if ok, _ := path.Match(f.Name, path.Base(n.Name)); !ok {
+				continue
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
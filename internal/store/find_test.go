@@ -0,0 +1,59 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFindArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want FindPredicates
+		rest []string
+		ok   bool
+	}{
+		{nil, FindPredicates{}, nil, true},
+		{[]string{"dir"}, FindPredicates{}, []string{"dir"}, true},
+		{[]string{"-name", "*.log", "--type=f", "logs"}, FindPredicates{Name: "*.log", Type: "f"}, []string{"logs"}, true},
+		// Values may start with a dash, as with the flag package.
+		{[]string{"-size", "-1", "-mtime", "+3"}, FindPredicates{Size: "-1", Mtime: "+3"}, nil, true},
+		{[]string{"-bogus", "x"}, FindPredicates{}, nil, false},
+		{[]string{"-name"}, FindPredicates{}, nil, false},
+	} {
+		got, rest, err := parseFindArgs(tc.args)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseFindArgs(%q) returned error %v", tc.args, err)
+			continue
+		}
+		if tc.ok && (got != tc.want || !reflect.DeepEqual(rest, tc.rest)) {
+			t.Errorf("parseFindArgs(%q) = %+v, %q, want %+v, %q", tc.args, got, rest, tc.want, tc.rest)
+		}
+	}
+}
+
+func TestFindPredicatesSize(t *testing.T) {
+	for _, tc := range []struct {
+		size string
+		want FindFilter
+	}{
+		{"-1", FindFilter{HasMaxSize: true, MaxSize: 0}},
+		{"+0", FindFilter{MinSize: 1}},
+		{"0", FindFilter{HasMaxSize: true, MaxSize: 0}},
+		{"1K", FindFilter{MinSize: 1024, HasMaxSize: true, MaxSize: 1024}},
+		{"-1K", FindFilter{HasMaxSize: true, MaxSize: 1023}},
+		{"+1K", FindFilter{MinSize: 1025}},
+	} {
+		got, err := FindPredicates{Size: tc.size}.Filter(time.Now())
+		if err != nil {
+			t.Errorf("-size %s returned %v", tc.size, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("-size %s = %+v, want %+v", tc.size, got, tc.want)
+		}
+	}
+	if _, err := (FindPredicates{Size: "-0"}).Filter(time.Now()); err == nil {
+		t.Error("-size -0 succeeded")
+	}
+}
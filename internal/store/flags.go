@@ -0,0 +1,155 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"bazil.org/fuse"
+	fuseFS "bazil.org/fuse/fs"
+)
+
+// chflags(2) flags that are enforced. The user variants may be changed by
+// the owner of a file and the system ones only by root, but they restrict
+// changes to the file alike.
+const (
+	flagUserImmutable = 0x00000002 // UF_IMMUTABLE
+	flagUserAppend    = 0x00000004 // UF_APPEND
+	flagSysImmutable  = 0x00020000 // SF_IMMUTABLE
+	flagSysAppend     = 0x00040000 // SF_APPEND
+
+	flagsImmutable = flagUserImmutable | flagSysImmutable
+	flagsAppend    = flagUserAppend | flagSysAppend
+	flagsSystem    = flagSysImmutable | flagSysAppend
+)
+
+// flagNames are the names used by chflags(1) and ls -lo, followed by their
+// aliases.
+var flagNames = []struct {
+	name  string
+	alias string
+	flag  uint32
+}{
+	{"uchg", "uimmutable", flagUserImmutable},
+	{"uappnd", "uappend", flagUserAppend},
+	{"schg", "simmutable", flagSysImmutable},
+	{"sappnd", "sappend", flagSysAppend},
+}
+
+// ParseFlags applies the comma-separated chflags(1) names in `s` to
+// `flags`. A name prefixed with "no" clears the flag instead.
+func ParseFlags(s string, flags uint32) (uint32, error) {
+	for _, word := range strings.Split(s, ",") {
+		name := strings.TrimPrefix(word, "no")
+		clear := name != word
+		found := false
+		for _, f := range flagNames {
+			if name == f.name || name == f.alias {
+				if clear {
+					flags &^= f.flag
+				} else {
+					flags |= f.flag
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown flag %q", word)
+		}
+	}
+	return flags, nil
+}
+
+// FormatFlags returns the names of the flags set in `flags`, or "-" if
+// there are none. Unknown flags are shown in hexadecimal.
+func FormatFlags(flags uint32) string {
+	var names []string
+	for _, f := range flagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#x", flags))
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ",")
+}
+
+// immutable reports whether the node can neither be changed, renamed nor
+// removed, and, for a directory, whether entries can be added to it.
+func (n *FileNode) immutable() bool {
+	return n.Flags&flagsImmutable != 0
+}
+
+// appendOnly reports whether data can only be appended to the node, and
+// whether it can be renamed or removed. Entries can be added to an
+// append-only directory but not removed from it.
+func (n *FileNode) appendOnly() bool {
+	return n.Flags&flagsAppend != 0
+}
+
+// pinned reports whether the node cannot be renamed, removed or linked.
+func (n *FileNode) pinned() bool {
+	return n.Flags&(flagsImmutable|flagsAppend) != 0
+}
+
+// checkSetattr returns EPERM if the change of attributes `req` is not
+// allowed by the flags of the node. Flags themselves can always be
+// changed, so that they can be cleared, but the system ones only by root.
+// Must be called with the node locked.
+func (n *FileNode) checkSetattr(req *fuse.SetattrRequest) error {
+	if req.Valid.Flags() && (req.Flags^n.Flags)&flagsSystem != 0 && req.Uid != 0 {
+		return fuse.EPERM
+	}
+	changes := fuse.SetattrMode | fuse.SetattrUid | fuse.SetattrGid | fuse.SetattrSize |
+		fuse.SetattrAtime | fuse.SetattrMtime | fuse.SetattrCrtime
+	if req.Valid&changes != 0 && n.pinned() {
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// checkRename returns EPERM if the flags of the directories or entries
+// involved prevent renaming `oldName` in `oldDir` to `newName` in `newDir`.
+func (fs *fileSystem) checkRename(
+	ctx context.Context, oldDir *FileNode, oldName string, newDir fuseFS.Node, newName string,
+) error {
+	if oldDir.pinned() {
+		return fuse.EPERM
+	}
+	dir, ok := newDir.(*FileNode)
+	if ok && dir.immutable() {
+		return fuse.EPERM
+	}
+	old, err := GetNodeByName(ctx, fs.db, oldDir.Inode, oldName)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	if old.pinned() {
+		return fuse.EPERM
+	}
+	if !ok {
+		return nil
+	}
+	target, err := GetNodeByName(ctx, fs.db, dir.Inode, newName)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	// Replacing an entry removes it.
+	if dir.appendOnly() || target.pinned() {
+		return fuse.EPERM
+	}
+	return nil
+}
@@ -0,0 +1,1122 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fuseFS "bazil.org/fuse/fs"
+)
+
+type fileSystem struct {
+	db *DB
+
+	// Inode of the directory exposed as the root of the mount. This is
+	// RootInode unless a subdirectory of the tree is mounted.
+	root uint64
+
+	atimeMode atimeMode
+	atime     *atimeUpdater // nil if atimeMode is atimeNone
+
+	entries *entryCache // nil unless fast lookups are enabled
+
+	attrs *attrCache // nil unless directory listings prefetch attributes
+
+	heat *heatMap // nil unless accesses are recorded for the next warm-up
+
+	missing *negativeCache // nil unless missing names are cached
+
+	creates *createBatcher // nil unless the creation of small files is batched
+
+	dirOrder dirOrder // Order in which directories are listed.
+
+	// Number of blocks to prefetch for sequential reads, 0 to disable.
+	readahead int
+
+	blocks *blockCache // nil if the block cache is disabled
+
+	// Invalidations of the blocks of inodes, which drop the blocks read
+	// before them from the block cache and readahead windows.
+	epochs *epochTable
+
+	index *contentIndexer // nil unless contents are indexed for search
+
+	ops *opTracker // nil unless operations are tracked for the admin API
+
+	leases *leaseManager // nil unless writes take leases on their inodes
+
+	leader *leaderElection // nil unless background maintenance is elected
+
+	scrubber *blockScrubber // nil unless data blocks are scrubbed in the background
+
+	budget *queryBudget   // nil unless SQL statements go through a budget
+	faults *faultInjector // nil unless faults are injected into SQL statements
+
+	maintenance *maintenanceMode // nil if the mount cannot become read-only
+
+	locks    *inodeLocks    // Guards the attributes of fileNodes.
+	diskFull *diskFullState // Whether the disk of the database is full.
+
+	usage *usageCache // Stored size of inodes, reported as their blocks.
+
+	journal *journal // nil unless operations are journaled
+
+	writes *asyncWriter // nil unless writes are committed in the background
+
+	tasks *backgroundTasks // Outcome of the background tasks, for /readyz.
+
+	appends *appendCoalescer // nil unless small appends are kept in memory
+
+	// Whether the .sqlfs status directory is exposed at the root.
+	statusDir bool
+
+	// Whether the .query file is exposed at the root.
+	queryFile bool
+
+	snapshots *snapshotViews // nil unless the .snapshots directory is exposed
+
+	// How long entering maintenance mode through .sqlfs/read_only waits
+	// for the operations in flight.
+	quiesceTimeout time.Duration
+
+	// Whether open files bypass the kernel page cache, so that every read
+	// sees the changes made by other mounts.
+	directIO bool
+
+	// SELinux context reported for every node instead of the stored
+	// security.selinux attributes, unless empty.
+	securityLabel string
+
+	// Whether AppleDouble files are hidden and cannot be created. macOS
+	// only creates them if extended attributes are not supported.
+	noAppleDouble bool
+
+	// Permissions of the files and directories created through the mount,
+	// and bits cleared from them, overriding the modes given by callers.
+	fileMode, dirMode, umask PermFlag
+
+	// Translation of the owners of nodes between the database and the
+	// mount. Empty maps leave IDs as they are.
+	uids, gids IDMap
+
+	// Longest name and path accepted, in bytes. Paths are not checked if
+	// maxPathLen is 0.
+	maxNameLen int
+	maxPathLen int
+}
+
+const (
+	RootInode = 1
+
+	// Longest symlink target accepted, as PATH_MAX on Linux includes the
+	// terminating NUL.
+	maxSymlinkTarget = 4095
+)
+
+// Error types:
+//   ENOSYS  // Function not implemented
+//   ESTALE  // Stale NFS file handle
+//   ENOENT  // No such file or directory
+//   EIO     // I/O error
+//   EPERM   // Operation not permitted
+//   EINTR   // Interrupted system call
+//   ERANGE  // Math result not representable
+//   ENOTSUP // Not supported
+//   EEXIST  // File exists
+//   ENOATTR // Attribute not found
+//   ENOSPC  // No space left on device
+//   EROFS   // Read-only file system
+//
+// errnoFromErr maps the errors of the storage layer to these.
+
+// Obtains the fuseFS.Node for the file system root.
+// Root implements the fuseFS.FS interface.
+func (fs fileSystem) Root() (fuseFS.Node, error) {
+	if fs.root != 0 && fs.root != RootInode {
+		n, err := GetNodeByID(context.Background(), fs.db, fs.root)
+		if err != nil {
+			log.Printf("failed to load root inode %d: %s\n", fs.root, err)
+			return nil, fuse.EIO
+		}
+		n.fs = &fs
+		return n, nil
+	}
+	return &FileNode{
+		Inode: RootInode,
+		Mode:  os.ModeDir | 0555,
+		fs:    &fs,
+	}, nil
+}
+
+// Used to obtain file system metadata. (e.g. by `df`)
+// References:
+// - https://github.com/coreutils/coreutils/blob/master/src/df.c
+// - http://man7.org/linux/man-pages/man2/statfs.2.html
+// Statfs implements the fuseFS.FSStatfser interface.
+func (fs fileSystem) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	// resp.Bsize = 1024  // Optimal file system block size
+	resp.Bsize = uint32(fs.db.BlockSize) // Optimal file system block size
+	blockCount, err := CountDataBlocks(ctx, fs.db)
+	if err == nil {
+		resp.Blocks = uint64(blockCount) // Total data blocks in file system of size `Bsize` each.
+		// log.Printf("Blocks: %d", blockCount)
+	} else {
+		log.Println(err)
+	}
+	// The free space is nominal, and none once the database ran out of
+	// disk space.
+	if !fs.diskFull.Full() {
+		free := uint64(nominalFreeBytes / fs.db.BlockSize)
+		resp.Blocks += free
+		resp.Bfree = free  // Free blocks in file system.
+		resp.Bavail = free // Free blocks in file system for use by unprivileged users.
+	}
+
+	// Since we are using a SQL database, the total number of file nodes in
+	// the file system would be the maximum number that the `id` column could
+	// support. However, if we were to delete inodes, there would be "holes"
+	// in the list of available inode IDs. We will ignore that for now.
+	//
+	// Note that files like empty files, devices, fifos, sockets, and symlinks
+	// consume inodes, but don't consume blocks.
+	// References:
+	// - https://scoutapm.com/blog/understanding-disk-inodes
+	inodeCount, err := CountInodes(ctx, fs.db)
+	if err == nil {
+		resp.Files = uint64(inodeCount) // Total number of file nodes in file system.
+	} else {
+		log.Println(err)
+	}
+	// resp.Ffree = 200 // Free file nodes in file system.
+	resp.Namelen = uint32(fs.maxNameLen) // Maximum file name length
+
+	// Fragment size, smallest addressable data size in the file system.
+	// Usually the same as `Bsize` and is dependent on VFS.
+	// See https://stackoverflow.com/q/54823541/3281979 on Frsize vs Bsize.
+	resp.Frsize = resp.Bsize
+
+	return nil
+}
+
+// Triggered by unmounting. Usually used to free memory associated with the
+// FUSE system or allow file systems to flush writes to the disk before the
+// unmounting completes.
+//
+// There are two main types of devices: character device and block device.
+// Character devices communicate by sending and receiving single characters
+// whereas block devices communicate by sending blocks of data. In Linux
+// file systems, this will only be called for block devices.
+// Destroy implements the fuseFS.FSDestroyer interface.
+func (fs fileSystem) Destroy() {
+	log.Println("Destroy called")
+}
+
+// Picks a dynamic inode number when it would otherwise be 0. Every node
+// reports its stored inode number, so this is not expected to be called;
+// dynamic numbers are kept in the upper half of the range, which allocated
+// inode numbers never reach, so that they cannot collide.
+// GenerateInode implements the fuseFS.FSInodeGenerator interface.
+func (fs fileSystem) GenerateInode(parentInode uint64, name string) uint64 {
+	log.Printf("GenerateInode called - parentInode: %d, name %q\n", parentInode, name)
+	return fuseFS.GenerateDynamicInode(parentInode, name) | 1<<63
+}
+
+// Methods that are not implemented:
+//
+// Forget()
+// - Node will not receive further method calls. Not necessarily seen on
+//   unmount. Might be useful for caching.
+//
+// Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error
+// - Gets an extended attribute by the given name from the node.
+// - If there is no xattr by that name, returns fuse.ErrNoXattr.
+//
+// Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error
+// - Lists the extended attributes recorded for the node.
+//
+// Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error
+// - Sets an extended attribute with the given name and value for the node.
+//
+// Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error
+// - Removes an extended attribute for the name.
+// - If there is no xattr by that name, returns fuse.ErrNoXattr.
+//
+// Flush(ctx context.Context, req *fuse.FlushRequest) error
+// - Called each time the file or directory is closed.
+// - Because there can be multiple file descriptors referring to a single
+//   opened file, Flush can be called multiple times.
+//
+// Release(ctx context.Context, req *fuse.ReleaseRequest) error
+//
+// Access(ctx context.Context, req *fuse.AccessRequest) error
+//
+// Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fuseFS.Handle, error)
+//
+// Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error
+//
+type FileNode struct {
+	fs *fileSystem
+
+	// Values needed by fuse.Attr().
+	Valid     time.Duration // how long Attr can be cached
+	Inode     uint64        // inode number
+	Size      uint64        // size in bytes
+	Blocks    uint64        // size in 512-byte units
+	Atime     time.Time     // time of last access
+	Mtime     time.Time     // time of last modification
+	Ctime     time.Time     // time of last inode change
+	Crtime    time.Time     // time of creation (OS X only)
+	Mode      os.FileMode   // file mode
+	Nlink     uint32        // number of links (usually 1)
+	Uid       uint32        // owner uid
+	Gid       uint32        // group gid
+	Rdev      uint32        // device numbers
+	Flags     uint32        // chflags(2) flags (OS X only)
+	BlockSize uint32        // preferred blocksize for filesystem I/O
+
+	// Custom values used by filesystem.
+	SymlinkTarget string
+	// Incremented whenever the contents of the file change.
+	Generation uint64
+
+	// Directory entry through which the node was reached. These are stored
+	// in the tree table rather than with the inode, as hard links share the
+	// same inode.
+	Name   string
+	Parent uint64
+}
+
+// syncGeneration picks up the size of `updated`, the stored state of `n`,
+// if its contents were changed by another mount or command since `n` last
+// wrote or saw them, and drops the blocks of it that were cached. The
+// caller must hold the lock of `n`.
+func (n *FileNode) syncGeneration(updated *FileNode) {
+	if updated.Generation <= n.Generation {
+		return
+	}
+	n.Generation = updated.Generation
+	n.Size = updated.Size
+	n.fs.invalidateBlocks(n.Inode, 0, -1)
+}
+
+func (n *FileNode) IsRegular() bool {
+	return n.mode().IsRegular()
+}
+
+func (n *FileNode) IsDirectory() bool {
+	return n.mode().IsDir()
+}
+
+func (n *FileNode) IsSymlink() bool {
+	return n.mode()&os.ModeSymlink != 0
+}
+
+// Fsync waits for the writes of the file queued in the background, and
+// commits the appends to it kept in memory.
+// Fsync implements the fuseFS.NodeFsyncer interface.
+func (n *FileNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	// If we don't implement this, some applications like vim would not work.
+	if err := n.fs.syncCreate(n.Inode); err != nil {
+		return errnoFromErr(ctx, err)
+	}
+	if err := n.fs.syncWrites(n.Inode); err != nil {
+		return errnoFromErr(ctx, err)
+	}
+	return nil
+}
+
+// Fills `attr` with the standard metadata for the node.
+// Attr implements the fuseFS.Node interface.
+func (n *FileNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	var updated *FileNode
+	var stored uint64
+	var subdirs int
+	var err, storedErr, subdirsErr error
+	if cached, ok := n.fs.prefetchedAttrs(n.Inode); ok {
+		updated, stored, subdirs = &cached.node, cached.stored, cached.subdirs
+	} else if size, ok := n.fs.batchedSize(n.Inode); ok {
+		// The file is not stored yet, the node holds all its attributes.
+		stored, err = size, sql.ErrNoRows
+	} else {
+		updated, err = GetNodeByID(ctx, n.fs.db, n.Inode)
+		stored, storedErr = n.fs.storedBytes(ctx, n)
+		if n.IsDirectory() {
+			subdirs, subdirsErr = CountSubdirectories(ctx, n.fs.db, n.Inode)
+			if subdirsErr != nil {
+				log.Println(subdirsErr)
+			}
+		}
+	}
+
+	unlock := n.lock()
+	defer unlock()
+	if err == nil {
+		// Links and changes to the entries of a directory are made through
+		// other nodes, so pick up the times and link count they stored.
+		n.Nlink = updated.Nlink
+		if n.IsDirectory() && subdirsErr == nil {
+			// The "." entry and the entry in the parent, plus the ".." entry
+			// of each subdirectory.
+			n.Nlink = 2 + uint32(subdirs)
+		}
+		if updated.Mtime.After(n.Mtime) {
+			n.Mtime = updated.Mtime
+		}
+		if updated.Ctime.After(n.Ctime) {
+			n.Ctime = updated.Ctime
+		}
+		// Flags may be changed with `sqlfs chflags` while mounted.
+		n.Flags = updated.Flags
+		n.syncGeneration(updated)
+	}
+	attr.Inode = n.Inode
+	attr.Size = n.Size
+	if n.IsSymlink() {
+		attr.Size = uint64(len(n.SymlinkTarget))
+	}
+	// Blocks are 512-byte units of storage actually used, as for du(1).
+	attr.Blocks = (stored + 511) / 512
+	if storedErr != nil {
+		log.Println(storedErr)
+		attr.Blocks = n.Size / 512
+	}
+	attr.Atime = n.Atime
+	attr.Mtime = n.Mtime
+	attr.Ctime = n.Ctime
+	attr.Crtime = n.Crtime
+	attr.Mode = n.Mode
+	attr.Nlink = n.Nlink // How many entries using the same inode number.
+	attr.Uid = n.fs.uids.toLocal(n.Uid)
+	attr.Gid = n.fs.gids.toLocal(n.Gid)
+	attr.Rdev = n.Rdev
+	attr.Flags = n.Flags
+	attr.BlockSize = uint32(n.fs.db.BlockSize)
+	return nil
+}
+
+// Setattr sets the standard metadata for the receiver.
+// Note, this is also used to communicate changes in the size of
+// the file, outside of Writes.
+// req.Valid is a bitmask of what fields are actually being set.
+// For example, the method should not change the mode of the file
+// unless req.Valid.Mode() is true.
+// Setattr implements the fuseFS.NodeSetattrer interface.
+func (n *FileNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := n.fs.checkWritable(); err != nil {
+		return err
+	}
+	// Sizes only apply to regular files. Other attributes of symlinks are
+	// set on the link itself, as lchown(2) and lutimes(3) do.
+	if req.Valid.Size() && n.IsDirectory() {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if req.Valid.Size() && !n.IsRegular() {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if batched, err := n.fs.batchSetattr(n, req, resp); err != nil || batched {
+		if batched {
+			n.fs.record(ctx, &req.Header, JournalEntry{
+				Op: journalSetattr, Inode: n.Inode, Parent: n.Parent, Name: n.Name, Args: setattrArgs(req),
+			})
+		}
+		return err
+	}
+	if req.Valid.Size() {
+		n.fs.waitWrites(n.Inode)
+	}
+	unlock := n.lock()
+	defer unlock()
+	if err := n.checkSetattr(req); err != nil {
+		return err
+	}
+	if err := n.fs.leaseInode(ctx, n); err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	if req.Valid.Size() {
+		if err := recallTiered(ctx, n.fs.db, n); err != nil {
+			log.Println(err)
+			return errnoFromErr(ctx, err)
+		}
+	}
+	truncated := req.Valid.Size() && req.Size < n.Size
+	n.applySetattr(req, resp)
+	var err error
+	generation := n.Generation
+	if req.Valid.Size() {
+		err = TruncateData(ctx, n.fs.db, n, req.Size)
+		generation++
+	} else {
+		err = UpdateNode(ctx, n.fs.db, n)
+	}
+	// The contents were changed elsewhere since its blocks were cached.
+	truncated = truncated || n.Generation != generation
+	if err == nil && req.Valid.Mode() {
+		err = n.fs.chmodACL(ctx, n.Inode, n.Mode)
+	}
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalSetattr, Inode: n.Inode, Parent: n.Parent, Name: n.Name, Args: setattrArgs(req),
+	})
+	n.fs.invalidateInode(n.Inode)
+	if truncated {
+		n.fs.invalidateBlocks(n.Inode, 0, -1)
+		n.fs.indexContent(n.Inode)
+	}
+	return nil
+}
+
+// applySetattr sets the attributes of `n` requested by `req`, except for
+// the size, which is stored along with the data. The caller must hold the
+// lock of `n`.
+func (n *FileNode) applySetattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse) {
+	if req.Valid.Mode() {
+		// The file type cannot be changed.
+		mode := n.Mode&os.ModeType | req.Mode&^os.ModeType
+		n.setMode(mode)
+		resp.Attr.Mode = mode
+	}
+	if req.Valid.Uid() {
+		n.Uid = n.fs.uids.toStored(req.Uid)
+		resp.Attr.Uid = req.Uid
+	}
+	if req.Valid.Gid() {
+		n.Gid = n.fs.gids.toStored(req.Gid)
+		resp.Attr.Gid = req.Gid
+	}
+	// Every change bumps the change time, and changing the size also bumps
+	// the modification time unless it is set explicitly.
+	now := time.Now()
+	n.Ctime = now
+	if req.Valid.Size() {
+		if req.Size != n.Size {
+			n.Mtime = now
+		}
+		resp.Attr.Size = req.Size
+	}
+	if req.Valid.Atime() {
+		n.Atime = req.Atime
+		resp.Attr.Atime = req.Atime
+	}
+	if req.Valid.Mtime() {
+		n.Mtime = req.Mtime
+		resp.Attr.Mtime = req.Mtime
+	}
+	if req.Valid.Crtime() {
+		n.Crtime = req.Crtime
+		resp.Attr.Crtime = req.Crtime
+	}
+	if req.Valid.Flags() {
+		n.Flags = req.Flags
+		resp.Attr.Flags = req.Flags
+	}
+}
+
+// Symlink creates a new symbolic link in the receiver, which must be a directory.
+// Symlink implements the fuseFS.NodeSymlinker interface.
+func (n *FileNode) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fuseFS.Node, error) {
+	if n.fs == nil {
+		return nil, fuse.EIO
+	}
+	if err := n.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	if !n.IsDirectory() {
+		return nil, fuse.EIO
+	}
+	// The target is stored as given, relative or absolute, and is not
+	// required to exist.
+	if len(req.Target) > maxSymlinkTarget {
+		return nil, fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	if n.immutable() {
+		return nil, fuse.EPERM
+	}
+	if err := n.fs.checkName(ctx, n.Inode, req.NewName); err != nil {
+		return nil, err
+	}
+	newNode := &FileNode{
+		fs:            n.fs,
+		Name:          req.NewName,
+		Mode:          os.ModeSymlink | 0777, // lrwxrwxrwx, permissions of symlinks are ignored.
+		SymlinkTarget: req.Target,
+		Nlink:         1,
+	}
+	n.fs.setOwner(newNode, &req.Header)
+	if err := UpsertNode(ctx, n.fs.db, n.Inode, newNode); err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	n.fs.invalidateEntry(n.Inode, req.NewName)
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalCreate, Inode: newNode.Inode, Parent: n.Inode, Name: newNode.Name,
+		Args: map[string]interface{}{"mode": unixMode(newNode.Mode), "target": req.Target},
+	})
+	return newNode, nil
+}
+
+// This optional request will be called only for symbolic link nodes, and will
+// be used to retrieve the target path.
+// Readlink implements the fuseFS.NodeReadlinker interface.
+func (n *FileNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if !n.IsSymlink() {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	if n.SymlinkTarget != "" {
+		return n.SymlinkTarget, nil
+	}
+	// The node may have been built without its stored metadata.
+	stored, err := GetNodeByID(ctx, n.fs.db, n.Inode)
+	if err != nil {
+		log.Println(err)
+		return "", errnoFromErr(ctx, err)
+	}
+	return stored.SymlinkTarget, nil
+}
+
+// Used to create hardlinks.
+// Link implements the fuseFS.NodeLinker interface.
+func (n *FileNode) Link(ctx context.Context, req *fuse.LinkRequest, old fuseFS.Node) (fuseFS.Node, error) {
+	if n.fs == nil {
+		return nil, fuse.EIO
+	}
+	if err := n.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	if !n.IsDirectory() {
+		return nil, fuse.EIO
+	}
+	if err := n.fs.checkName(ctx, n.Inode, req.NewName); err != nil {
+		return nil, err
+	}
+	attr := &fuse.Attr{}
+	if err := old.Attr(ctx, attr); err != nil {
+		log.Printf("failed to get attr of old while linking: %s\n", err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	if n.immutable() || attr.Flags&(flagsImmutable|flagsAppend) != 0 {
+		return nil, fuse.EPERM
+	}
+	n.fs.settleCreates(attr.Inode)
+	newNode := &FileNode{
+		Inode: attr.Inode,
+		Name:  req.NewName,
+	}
+	// TODO(imjching): Should copy all the attributes and do an upsert.
+	if err := CreateLink(ctx, n.fs.db, n.Inode, newNode); err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	n.fs.invalidateEntry(n.Inode, req.NewName)
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalLink, Inode: attr.Inode, Parent: n.Inode, Name: req.NewName,
+	})
+	n.fs.invalidateInode(attr.Inode) // Link count changed.
+	var err error
+	newNode, err = GetNodeByID(ctx, n.fs.db, attr.Inode)
+	if err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	newNode.Name = req.NewName
+	newNode.fs = n.fs
+	return newNode, nil
+}
+
+// Remove implements the fuseFS.NodeRemover interface.
+func (n *FileNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if n.fs == nil {
+		return fuse.EIO
+	}
+	if err := n.fs.checkWritable(); err != nil {
+		return err
+	}
+	n.fs.settleCreates(n.Inode)
+	toRemove, err := GetNodeByName(ctx, n.fs.db, n.Inode, req.Name)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	if n.pinned() || toRemove.pinned() {
+		return fuse.EPERM
+	}
+
+	// Ensure that directory is not empty.
+	if req.Dir {
+		count, err := CountNodesInDir(ctx, n.fs.db, toRemove.Inode)
+		if err != nil {
+			log.Println(err)
+			return errnoFromErr(ctx, err)
+		}
+		if count > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY) // Directory is not empty.
+		}
+	}
+
+	n.fs.waitWrites(toRemove.Inode)
+	if err := RemoveNodeByName(ctx, n.fs.db, n.Inode, req.Name, toRemove.Inode); err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalUnlink, Inode: toRemove.Inode, Parent: n.Inode, Name: req.Name,
+	})
+	n.fs.invalidateEntry(n.Inode, req.Name)
+	n.fs.invalidateInode(toRemove.Inode) // Link count changed.
+	n.fs.invalidateBlocks(toRemove.Inode, 0, -1)
+	if toRemove.IsRegular() {
+		n.fs.indexContent(toRemove.Inode) // Drops the entry if it was the last link.
+	}
+	return nil
+}
+
+// Searches for a file named `name` in the current FileNode directory.
+// There's also another interface for Lookup:
+//     Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fuseFS.Node, error)
+//
+// Note: Will only be called for a directory.
+// Should return a fuseFS.Node based on `name`.
+// Lookup implements the fuseFS.NodeStringLookuper interface.
+func (n *FileNode) Lookup(ctx context.Context, name string) (fuseFS.Node, error) {
+	if n.fs == nil {
+		return nil, fuse.EIO
+	}
+	if !n.IsDirectory() {
+		return nil, fuse.EIO
+	}
+	if n.fs.maxNameLen > 0 && len(name) > n.fs.maxNameLen {
+		return nil, fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	if n.fs.noAppleDouble && isAppleDouble(name) {
+		return nil, fuse.ENOENT
+	}
+	if n.fs.isStatusDir(n.Inode, name) {
+		return &statusDirNode{fs: n.fs}, nil
+	}
+	if n.fs.isSnapshotsDir(n.Inode, name) {
+		return &snapshotsDirNode{fs: n.fs}, nil
+	}
+	if n.fs.isQueryFile(n.Inode, name) {
+		return &queryFileNode{fs: n.fs}, nil
+	}
+	if batched, ok := n.fs.batchedEntry(n.Inode, name); ok {
+		return batched, nil
+	}
+	if n.fs.missing != nil && n.fs.missing.Missing(n.Inode, name) {
+		return nil, fuse.ENOENT
+	}
+
+	var lookupNode *FileNode
+	var err error
+	if cached, ok := n.fs.prefetchedEntry(n.Inode, name); ok {
+		lookupNode = cached
+	} else if n.fs.entries != nil {
+		lookupNode, err = n.fs.lookupCached(ctx, n.Inode, name)
+	} else {
+		lookupNode, err = GetNodeByName(ctx, n.fs.db, n.Inode, name)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errnoFromErr(ctx, err)
+		}
+		if err == sql.ErrNoRows && n.fs.missing != nil {
+			n.fs.missing.Put(n.Inode, name)
+		}
+		return nil, fuse.ENOENT
+	}
+	lookupNode.fs = n.fs
+
+	// TODO(imjching): When returning fuseFS.Node, return the same instance.
+	// Will need to somewhat cache FileNode on first create to avoid spurious
+	// cache invalidation. Perhaps this is linked to the Forget() call.
+	return lookupNode, nil
+}
+
+// Mkdir implements the fuseFS.NodeMkdirer interface.
+func (n *FileNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fuseFS.Node, error) {
+	if n.fs == nil {
+		return nil, fuse.EIO
+	}
+	if err := n.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	if n.immutable() {
+		return nil, fuse.EPERM
+	}
+	if err := n.fs.checkName(ctx, n.Inode, req.Name); err != nil {
+		return nil, err
+	}
+	// req.Umask is not supported on OSX.
+	// See https://github.com/bazil/fuse/blob/65cc252bf6691cb3c7014bcb2c8dc29de91e3a7e/fuse.go#L1704-L1711.
+	newNode := &FileNode{
+		fs:   n.fs,
+		Name: req.Name,
+		Mode: n.fs.newMode(req.Mode),
+		// New directories have no entries in it except . and ..
+		Nlink: 2,
+	}
+	n.fs.setOwner(newNode, &req.Header)
+	acl, err := n.fs.inheritACL(ctx, n.Inode, newNode)
+	if err == nil {
+		err = UpsertNode(ctx, n.fs.db, n.Inode, newNode)
+	}
+	if err == nil {
+		err = n.fs.storeACL(ctx, newNode, acl)
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	n.fs.invalidateEntry(n.Inode, req.Name)
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalCreate, Inode: newNode.Inode, Parent: n.Inode, Name: newNode.Name,
+		Args: map[string]interface{}{"mode": unixMode(newNode.Mode)},
+	})
+	return newNode, nil
+}
+
+// Note: Will only be called for a file.
+// Asks to create and open a file (not a directory).
+// Create implements the fuseFS.NodeCreater interface.
+func (n *FileNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fuseFS.Node, fuseFS.Handle, error) {
+	if n.fs == nil {
+		return nil, nil, fuse.EIO
+	}
+	if err := n.fs.checkWritable(); err != nil {
+		return nil, nil, err
+	}
+	if n.immutable() {
+		return nil, nil, fuse.EPERM
+	}
+	if err := n.fs.checkName(ctx, n.Inode, req.Name); err != nil {
+		return nil, nil, err
+	}
+	// TODO(imjching): req.Flags corresponds to OpenFlags. Maybe this is useful
+	// for caching / in-memory buffer. Note that Fsync will be called before
+	// file system closes.
+	newNode := &FileNode{
+		fs:    n.fs,
+		Name:  req.Name,
+		Mode:  n.fs.newMode(req.Mode),
+		Nlink: 1,
+	}
+	n.fs.setOwner(newNode, &req.Header)
+	acl, err := n.fs.inheritACL(ctx, n.Inode, newNode)
+	if err == nil && acl == nil && n.fs.creates != nil {
+		err = n.fs.batchCreate(ctx, n.Inode, newNode)
+	} else if err == nil {
+		err = UpsertNode(ctx, n.fs.db, n.Inode, newNode)
+		if err == nil {
+			err = n.fs.storeACL(ctx, newNode, acl)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		// If we send back ENOSYS, FUSE will try mknod+open.
+		return nil, nil, errnoFromErr(ctx, err)
+	}
+	n.fs.invalidateEntry(n.Inode, req.Name)
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalCreate, Inode: newNode.Inode, Parent: n.Inode, Name: newNode.Name,
+		Args: map[string]interface{}{"mode": unixMode(newNode.Mode)},
+	})
+	if n.fs.directIO {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	return newNode, newFileHandle(newNode), nil
+}
+
+// Rename implements the fuseFS.NodeRenamer interface.
+func (n *FileNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fuseFS.Node) error {
+	if n.fs == nil {
+		return fuse.EIO
+	}
+	if err := n.fs.checkWritable(); err != nil {
+		return err
+	}
+	attr := &fuse.Attr{}
+	if err := newDir.Attr(ctx, attr); err != nil {
+		log.Printf("failed to get attr of newDir while renaming: %s\n", err)
+		return errnoFromErr(ctx, err)
+	}
+	n.fs.settleCreates(n.Inode)
+	n.fs.settleCreates(attr.Inode)
+	if err := n.fs.checkName(ctx, attr.Inode, req.NewName); err != nil {
+		return err
+	}
+	if err := n.fs.checkRename(ctx, n, req.OldName, newDir, req.NewName); err != nil {
+		return err
+	}
+	inode, err := RenameNode(ctx, n.fs.db, n.Inode, req.OldName, attr.Inode, req.NewName)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalRename, Inode: inode, Parent: n.Inode, Name: req.OldName,
+		Args: map[string]interface{}{"new_parent": attr.Inode, "new_name": req.NewName},
+	})
+	n.fs.invalidateEntry(n.Inode, req.OldName)
+	n.fs.invalidateEntry(attr.Inode, req.NewName)
+	return nil
+}
+
+// Mknod creates a node (file, device special, or named pipe. However, read
+// and write to these special files are not allowed in FUSE.
+//
+// Named pipes and sockets are only rendezvous points: once their type is
+// reported by Attr and ReadDirAll, the kernel opens them locally without
+// calling into the file system, so processes on the same host can use them
+// as usual. Device numbers are stored so that devices can be listed, but
+// FUSE mounts are nodev and the devices cannot be opened.
+//
+// Mknod implements the fuseFS.NodeMknoder interface.
+func (n *FileNode) Mknod(ctx context.Context, req *fuse.MknodRequest) (fuseFS.Node, error) {
+	if n.fs == nil {
+		return nil, fuse.EIO
+	}
+	if err := n.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	if n.immutable() {
+		return nil, fuse.EPERM
+	}
+	if err := n.fs.checkName(ctx, n.Inode, req.Name); err != nil {
+		return nil, err
+	}
+	newNode := &FileNode{
+		fs:    n.fs,
+		Name:  req.Name,
+		Mode:  n.fs.newMode(req.Mode),
+		Nlink: 1,
+	}
+	if req.Mode&os.ModeDevice != 0 {
+		newNode.Rdev = req.Rdev
+	}
+	n.fs.setOwner(newNode, &req.Header)
+	acl, err := n.fs.inheritACL(ctx, n.Inode, newNode)
+	if err == nil {
+		err = UpsertNode(ctx, n.fs.db, n.Inode, newNode)
+	}
+	if err == nil {
+		err = n.fs.storeACL(ctx, newNode, acl)
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	n.fs.invalidateEntry(n.Inode, req.Name)
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalCreate, Inode: newNode.Inode, Parent: n.Inode, Name: newNode.Name,
+		Args: map[string]interface{}{"mode": unixMode(newNode.Mode), "rdev": newNode.Rdev},
+	})
+	return newNode, nil
+}
+
+// Used to list available files in a directory. The listing starts with the
+// "." and ".." entries, which the kernel does not add by itself. The parent
+// of the root of the mount is outside of it, so ".." of the root refers to
+// the root itself.
+// Note: Will only be called for a directory.
+// ReadDirAll implements the fuseFS.HandleReadDirAller interface.
+func (n *FileNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	if n.fs == nil {
+		return nil, fuse.EIO
+	}
+	n.fs.settleCreates(n.Inode)
+	if n.fs.heat != nil {
+		n.fs.heat.Record(n.Inode)
+	}
+	nodes, err := n.fs.listDir(ctx, n.Inode)
+	if err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	parent := n.Inode
+	if n.Inode != RootInode && n.Inode != n.fs.root {
+		if parent, err = GetParentInode(ctx, n.fs.db, n.Inode); err != nil {
+			log.Println(err)
+			return nil, errnoFromErr(ctx, err)
+		}
+	}
+	entries := []fuse.Dirent{
+		{Inode: n.Inode, Name: ".", Type: fuse.DT_Dir},
+		{Inode: parent, Name: "..", Type: fuse.DT_Dir},
+	}
+	for _, node := range nodes {
+		if n.fs.noAppleDouble && isAppleDouble(node.Name) ||
+			n.fs.isStatusDir(n.Inode, node.Name) || n.fs.isSnapshotsDir(n.Inode, node.Name) ||
+			n.fs.isQueryFile(n.Inode, node.Name) {
+			continue
+		}
+		dirent := fuse.Dirent{
+			Inode: node.Inode,
+			Name:  node.Name,
+
+			// Provide a type to speed up operations and avoid additional Getattr calls.
+			Type: GetDirentTypeFromMode(node.Mode),
+		}
+		entries = append(entries, dirent)
+	}
+	if n.fs.isStatusDir(n.Inode, StatusDirName) {
+		entries = append(entries, fuse.Dirent{Inode: statusInode, Name: StatusDirName, Type: fuse.DT_Dir})
+	}
+	if n.fs.isSnapshotsDir(n.Inode, SnapshotsDirName) {
+		entries = append(entries, fuse.Dirent{Inode: snapshotsInode, Name: SnapshotsDirName, Type: fuse.DT_Dir})
+	}
+	if n.fs.isQueryFile(n.Inode, QueryFileName) {
+		entries = append(entries, fuse.Dirent{Inode: queryInode, Name: QueryFileName, Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+func GetDirentTypeFromMode(mode os.FileMode) fuse.DirentType {
+	// See list of available types here:
+	// https://github.com/bazil/fuse/blob/65cc252bf6691cb3c7014bcb2c8dc29de91e3a7e/fuse.go#L1868-L1886
+	// DT_Socket: socket
+	// DT_Link: symlink
+	// DT_File: regular file
+	// DT_Bloc: block device
+	// DT_Dir: directory
+	// DT_Char: char device
+	// DT_FIFO: named pipes
+	if mode&os.ModeDir != 0 {
+		return fuse.DT_Dir
+	}
+	if mode&os.ModeSymlink != 0 {
+		return fuse.DT_Link
+	}
+	// Character devices have both ModeDevice and ModeCharDevice set.
+	if mode&os.ModeCharDevice != 0 {
+		return fuse.DT_Char
+	}
+	if mode&os.ModeDevice != 0 {
+		return fuse.DT_Block
+	}
+	if mode&os.ModeNamedPipe != 0 {
+		return fuse.DT_FIFO
+	}
+	if mode&os.ModeSocket != 0 {
+		return fuse.DT_Socket
+	}
+	if mode&os.ModeType == 0 { // Same as IsRegular
+		return fuse.DT_File
+	}
+	return fuse.DT_Unknown
+}
+
+// Read is called whenever kernel attempt to read contents of the file.
+// req.Offset corresponds to bytes that are already read, and req.Size
+// corresponds to remaining bytes left to read. If we return a byte slice
+// that has length less than req.Size, Read will be called again by FUSE,
+// but with an updated offset.
+//
+// There is also a `ReadAll` method presumely supposed to read all the bytes
+// at once (?): ReadAll(ctx context.Context) ([]byte, error)
+//
+// TODO(imjching): Look into req.Flags and req.FileFlags. Concurrency?
+//
+// Read implements the fuseFS.HandleReader interface.
+func (n *FileNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	// Only fetch the blocks that cover the requested range.
+	n.fs.settleCreates(n.Inode)
+	n.fs.waitWrites(n.Inode)
+	size := n.snapshot().Size
+	first, last := n.fs.db.blockRange(req.Offset, req.Size, size)
+	blocks, err := n.fs.readBlocks(ctx, n.Inode, first, last-first)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	resp.Data = n.fs.db.assembleBlocks(blocks, req.Offset, req.Size, size)
+	n.fs.touchAtime(n)
+	return nil
+}
+
+// Write requests to write data into the handle at the given offset.
+// Store the amount of data written in resp.Size.
+//
+// Writes that grow the file are expected to update the file size
+// (as seen through Attr). Note that file size changes are
+// communicated also through Setattr.
+//
+// With asynchronous writes, the data is queued and committed in the
+// background unless the file was opened with O_SYNC; only the size and
+// times of the node are updated right away. The same goes for small
+// appends when they are coalesced.
+// Write implements the fuseFS.HandleWriter interface.
+func (n *FileNode) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if err := n.fs.checkWritable(); err != nil {
+		return err
+	}
+	if err := n.fs.diskFull.check(); err != nil {
+		return errnoFromErr(ctx, err)
+	}
+	batched, err := n.fs.batchWrite(n, req)
+	if err != nil {
+		return err
+	}
+	if batched {
+		n.fs.record(ctx, &req.Header, JournalEntry{
+			Op: journalWrite, Inode: n.Inode, Parent: n.Parent, Name: n.Name,
+			Args: map[string]interface{}{"offset": req.Offset, "length": len(req.Data)},
+		})
+		resp.Size = len(req.Data)
+		return nil
+	}
+	async := n.fs.writes != nil && req.FileFlags&fuse.OpenSync == 0
+	coalesce := n.fs.appends != nil && !async && req.FileFlags&fuse.OpenSync == 0
+	var full bool
+	unlock := n.lock()
+	if n.immutable() || n.appendOnly() && uint64(req.Offset) < n.Size {
+		unlock()
+		return fuse.EPERM
+	}
+	err = n.fs.leaseInode(ctx, n)
+	if err == nil {
+		err = recallTiered(ctx, n.fs.db, n)
+	}
+	if err == nil {
+		if coalesce {
+			coalesce, full = n.fs.appends.Append(n, req.Offset, req.Data)
+		}
+		if end := uint64(req.Offset) + uint64(len(req.Data)); (async || coalesce) && end > n.Size {
+			n.Size = end
+		}
+		now := time.Now()
+		n.Mtime = now
+		n.Ctime = now
+	}
+	unlock()
+	if err == nil {
+		if coalesce {
+			if full {
+				// Failures are reported by the next fsync(2) or close(2).
+				n.fs.flushAppends(n.Inode)
+			}
+		} else if async {
+			n.fs.writes.Enqueue(n, req.Offset, req.Data)
+		} else {
+			// Earlier writes queued through handles without O_SYNC go first.
+			n.fs.waitWrites(n.Inode)
+			err = n.fs.commitWrite(ctx, n, req.Offset, req.Data)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	n.fs.record(ctx, &req.Header, JournalEntry{
+		Op: journalWrite, Inode: n.Inode, Parent: n.Parent, Name: n.Name,
+		Args: map[string]interface{}{"offset": req.Offset, "length": len(req.Data)},
+	})
+	resp.Size = len(req.Data)
+	return nil
+}
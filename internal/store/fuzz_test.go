@@ -0,0 +1,218 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// The fuzz targets feed random and malformed inputs to the computations of
+// block ranges and to the decoding of contents read from the database, and
+// check the results against straightforward reference implementations. Their
+// seed corpus runs with the other tests; `go test -fuzz FuzzBlockRange`
+// explores more inputs of a target, and needs no database. Failing inputs are
+// saved under testdata/fuzz, which makes them part of the seed corpus.
+
+// The targets run with the settings of a new file system.
+var (
+	fuzzSettings = defaultSettings()
+	blockSize    = fuzzSettings.BlockSize
+)
+
+// fuzzEdges are offsets and sizes at the edges of blocks and of the range of
+// int64, which seed the targets taking them.
+var fuzzEdges = []int64{
+	0, 1, blockSize - 1, blockSize, blockSize + 1, 3*blockSize + 17,
+	math.MaxInt64 - blockSize, math.MaxInt64, -1, -blockSize, math.MinInt64,
+}
+
+// readEnd returns where a read ends, or -1 if it reads nothing.
+func readEnd(offset int64, size int, fileSize uint64) int64 {
+	if offset < 0 || size <= 0 || fileSize > math.MaxInt64 {
+		return -1
+	}
+	end := offset + int64(size)
+	if end < offset { // Overflow.
+		end = math.MaxInt64
+	}
+	if end > int64(fileSize) {
+		end = int64(fileSize)
+	}
+	if end <= offset {
+		return -1
+	}
+	return end
+}
+
+func FuzzBlockRange(f *testing.F) {
+	for _, offset := range fuzzEdges {
+		for _, size := range fuzzEdges {
+			f.Add(offset, int(size%(1<<24)), uint64(8*blockSize))
+			f.Add(offset, int(size%(1<<24)), uint64(math.MaxUint64))
+		}
+	}
+	f.Fuzz(func(t *testing.T, offset int64, size int, fileSize uint64) {
+		first, last := fuzzSettings.blockRange(offset, size, fileSize)
+		end := readEnd(offset, size, fileSize)
+		if end < 0 {
+			if first != last {
+				t.Fatalf("got blocks [%d, %d) for an empty read", first, last)
+			}
+			return
+		}
+		if first < 0 || first > last {
+			t.Fatalf("got invalid blocks [%d, %d)", first, last)
+		}
+		if first*blockSize > offset || offset-first*blockSize >= blockSize {
+			t.Fatalf("first block %d does not hold offset %d", first, offset)
+		}
+		if (last-1)*blockSize >= end || (last-1)*blockSize < end-blockSize {
+			t.Fatalf("last block %d does not end the read at %d", last, end)
+		}
+	})
+}
+
+// fuzzBlocks returns blocks -1 to len(lengths)-2, block i holding
+// lengths[i+1]/255 of a full block, so that 0 leaves a hole and values below
+// 255 store short blocks, as holes and partial tail blocks are stored.
+func fuzzBlocks(lengths []byte) map[int64][]byte {
+	blocks := make(map[int64][]byte)
+	for i, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		index := int64(i) - 1
+		b := make([]byte, int64(l)*blockSize/255)
+		for j := range b {
+			b[j] = byte((index*blockSize + int64(j)) % 251)
+		}
+		blocks[index] = b
+	}
+	return blocks
+}
+
+func FuzzAssembleBlocks(f *testing.F) {
+	f.Add(int64(0), 10, uint64(10), []byte{255, 255})
+	f.Add(int64(blockSize-3), 7, uint64(2*blockSize), []byte{255, 255, 255})
+	f.Add(int64(5), int(3*blockSize), uint64(4*blockSize), []byte{0, 255, 0, 128, 255})
+	f.Add(int64(blockSize+1), 100, uint64(blockSize+50), []byte{255, 255, 40})
+	f.Add(int64(-1), 10, uint64(10), []byte{255, 255})
+	f.Add(int64(math.MaxInt64), 10, uint64(math.MaxUint64), []byte{255})
+	f.Fuzz(func(t *testing.T, offset int64, size int, fileSize uint64, lengths []byte) {
+		// Keep the contents small enough to compare byte by byte.
+		if offset > 0 {
+			offset %= 8 * blockSize
+		}
+		size %= int(4 * blockSize)
+		fileSize %= uint64(8 * blockSize)
+		if len(lengths) > 10 {
+			lengths = lengths[:10]
+		}
+		blocks := fuzzBlocks(lengths)
+		got := fuzzSettings.assembleBlocks(blocks, offset, size, fileSize)
+
+		end := readEnd(offset, size, fileSize)
+		if end < 0 {
+			if len(got) != 0 {
+				t.Fatalf("read %d bytes, expected none", len(got))
+			}
+			return
+		}
+		want := make([]byte, end-offset)
+		for pos := offset; pos < end; pos++ {
+			if b := blocks[pos/blockSize]; pos%blockSize < int64(len(b)) {
+				want[pos-offset] = b[pos%blockSize]
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("read %d bytes that differ from the %d expected", len(got), len(want))
+		}
+	})
+}
+
+func FuzzSplitInline(f *testing.F) {
+	f.Add([]byte{}, int64(0), int64(1))
+	f.Add([]byte("small file"), int64(0), int64(1))
+	f.Add(bytes.Repeat([]byte("x"), int(blockSize)), int64(0), int64(2))
+	f.Add(bytes.Repeat([]byte("y"), int(2*blockSize+1)), int64(1), int64(3))
+	f.Add(bytes.Repeat([]byte("z"), maxInlineDataSize), int64(2), int64(0))
+	f.Fuzz(func(t *testing.T, inline []byte, first, count int64) {
+		if len(inline) > maxInlineDataSize {
+			inline = inline[:maxInlineDataSize]
+		}
+		if first < 0 {
+			first = -(first + 1)
+		}
+		if count < 0 {
+			count = -(count + 1)
+		}
+		first %= int64(len(inline))/blockSize + 3
+		count %= 4
+		blocks := make(map[int64][]byte)
+		fuzzSettings.splitInline(blocks, inline, first, count)
+		for i, b := range blocks {
+			if i < first || i >= first+count {
+				t.Fatalf("got block %d out of the range", i)
+			}
+			start := i * blockSize
+			if start >= int64(len(inline)) || !bytes.Equal(b, inline[start:start+int64(len(b))]) {
+				t.Fatalf("block %d differs from the inline data", i)
+			}
+			if int64(len(b)) != blockSize && start+int64(len(b)) != int64(len(inline)) {
+				t.Fatalf("block %d is short", i)
+			}
+		}
+	})
+}
+
+// FuzzDecodeLegacyInode decodes encodings of inodes, which must either fail
+// with an error or decode to an inode that encodes back to the same one.
+func FuzzDecodeLegacyInode(f *testing.F) {
+	for _, legacy := range []legacyInode{
+		{},
+		{Size: 11, Mtime: time.Unix(1546300800, 0).UTC(), Mode: 0644, Nlink: 1, Uid: 1000, Gid: 1000},
+		{Mode: os.ModeDir | 0755, Nlink: 2},
+		{Mode: os.ModeSymlink | 0777, Nlink: 1, SymlinkTarget: "../target"},
+		{Size: math.MaxInt64},
+		{Size: math.MaxInt64 + 1},
+	} {
+		data, err := json.Marshal(legacy)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(`{"Size": -1}`))
+	f.Add([]byte(`{"Mode": "rwx"}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`null`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		n, err := decodeLegacyInode(1, data)
+		if err != nil {
+			return
+		}
+		if n.Size > math.MaxInt64 {
+			t.Fatalf("decoded the invalid size %d", n.Size)
+		}
+		again, err := json.Marshal(legacyInode{
+			Size: n.Size, Atime: n.Atime, Mtime: n.Mtime, Ctime: n.Ctime, Crtime: n.Crtime,
+			Mode: n.Mode, Nlink: n.Nlink, Uid: n.Uid, Gid: n.Gid, Rdev: n.Rdev, Flags: n.Flags,
+			SymlinkTarget: n.SymlinkTarget,
+		})
+		if err != nil {
+			// Times beyond year 9999 decode but do not encode.
+			return
+		}
+		m, err := decodeLegacyInode(1, again)
+		if err != nil {
+			t.Fatalf("failed to decode %s, the encoding of %+v: %s", again, n, err)
+		}
+		if m.Size != n.Size || !m.Mtime.Equal(n.Mtime) || m.Mode != n.Mode || m.Nlink != n.Nlink ||
+			m.Uid != n.Uid || m.Gid != n.Gid || m.SymlinkTarget != n.SymlinkTarget {
+			t.Fatalf("decoded %+v, then %+v", n, m)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Every change to the contents of a file increments the generation of its
+// inode, in the transaction that changes the data blocks. Mounts compare the
+// generation they last saw to the stored one to detect that another mount
+// changed the file, and drop the blocks they cached. Files whose data was
+// written without bumping their generation, e.g. by an import or a
+// replication that was interrupted, are reported by `sqlfs fsck`.
+
+// errGenerationChanged is returned when the contents of a file changed
+// between the start of a transaction writing to it and its end.
+var errGenerationChanged = errors.New("the file was changed concurrently")
+
+// Number of times a transaction updating an inode is attempted when it
+// conflicts with a concurrent change to the same inode.
+const maxInodeTxAttempts = 5
+
+// updateInode runs `f`, which updates the inode of `n`, in a serializable
+// transaction. The transaction first picks up the size and generation of
+// `n` if its contents were changed since `n` last saw them, e.g. by another
+// mount, so that `f` does not write a stale size back. It is retried if it
+// conflicts with a concurrent change: concurrent writes to the same file are
+// then applied one after the other, the last one winning for the blocks
+// they both wrote, instead of interleaving.
+func updateInode(ctx context.Context, db *DB, n *FileNode, f func(tx *fsTx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := updateInodeOnce(ctx, db, n, f)
+		if err == nil || attempt == maxInodeTxAttempts || !retryableConflict(err) {
+			return err
+		}
+	}
+}
+
+func updateInodeOnce(ctx context.Context, db *DB, n *FileNode, f func(tx *fsTx) error) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	if err := loadGeneration(ctx, tx, n); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryableConflict returns true if `err` shows that a transaction lost a
+// race with a concurrent one, and may succeed if run again.
+func retryableConflict(err error) bool {
+	if errors.Cause(err) == errGenerationChanged {
+		return true
+	}
+	return sqlState(err) == "40001" // serialization_failure
+}
+
+// loadGeneration picks up the stored size and generation of `n` if they
+// changed since `n` last saw them. Inodes that do not exist yet are left
+// as they are.
+func loadGeneration(ctx context.Context, tx *fsTx, n *FileNode) error {
+	var generation, size uint64
+	q := "SELECT generation, size FROM inodes WHERE inode = $1"
+	err := tx.QueryRowContext(ctx, q, n.Inode).Scan(&generation, &size)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the generation of inode %d", n.Inode)
+	}
+	if generation != n.Generation {
+		n.Generation = generation
+		n.Size = size
+	}
+	return nil
+}
+
+// bumpGeneration increments the generation of `n` in the transaction that
+// changed its data, and stores the new generation in `n`. It fails with
+// errGenerationChanged if the stored generation is no longer the one of
+// `n`, i.e. if another transaction changed the data in the meantime.
+func bumpGeneration(ctx context.Context, tx *fsTx, n *FileNode) error {
+	q := "UPDATE inodes SET generation = generation + 1 WHERE inode = $1 AND generation = $2 RETURNING generation"
+	err := tx.QueryRowContext(ctx, q, n.Inode, n.Generation).Scan(&n.Generation)
+	if err == sql.ErrNoRows {
+		return errGenerationChanged
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to bump the generation of inode %d", n.Inode)
+	}
+	return nil
+}
+
+// putGeneration stores the generation of `n` as is, e.g. when copying it
+// from another database.
+func putGeneration(ctx context.Context, e execer, n *FileNode) error {
+	q := "UPDATE inodes SET generation = $2 WHERE inode = $1"
+	if _, err := e.ExecContext(ctx, q, n.Inode, n.Generation); err != nil {
+		return errors.Wrapf(err, "failed to write the generation of inode %d", n.Inode)
+	}
+	return nil
+}
+
+// HasGenerations returns true if the inodes table has the generation column.
+func HasGenerations(ctx context.Context, db *DB) (bool, error) {
+	return columnExists(ctx, db, "inodes", "generation")
+}
+
+// AddGenerations adds the generation column to the inodes of a file system
+// created before generations were introduced, and records the feature in the
+// superblock so that older binaries only read the file system, since their
+// writes would not bump generations. Files that already have data start at
+// generation 1, so that fsck does not report them. It can safely be resumed
+// if interrupted.
+func AddGenerations(ctx context.Context, db *DB) error {
+	q1 := "ALTER TABLE inodes ADD COLUMN IF NOT EXISTS generation INT NOT NULL DEFAULT 0"
+	if _, err := db.ExecContext(ctx, q1); err != nil {
+		return errors.Wrap(err, "failed to add the generation column")
+	}
+	q2 := `UPDATE inodes SET generation = 1
+  WHERE generation = 0 AND inode IN (SELECT DISTINCT inode FROM data_blocks)`
+	if _, err := db.ExecContext(ctx, q2); err != nil {
+		return errors.Wrap(err, "failed to initialize generations")
+	}
+	return addSuperblockFeature(ctx, db, featureGenerations)
+}
+
+// ListUngeneratedFiles calls `f` with the inode number of every regular file
+// that has data blocks or inline data but generation 0. Its data was written
+// outside of a transaction bumping its generation, e.g. by an import or a
+// replication that did not complete, so mounts may still serve stale cached
+// contents.
+func ListUngeneratedFiles(ctx context.Context, db *DB, f func(inode uint64) error) error {
+	hasData := "EXISTS (SELECT 1 FROM data_blocks WHERE data_blocks.inode = inodes.inode)"
+	if db.inlineDataSize > 0 {
+		hasData = "(" + hasData + " OR inline_data IS NOT NULL)"
+	}
+	q := `SELECT inode FROM inodes
+  WHERE generation = 0 AND mode & $1 = 0
+  AND ` + hasData + `
+  ORDER BY inode`
+	rows, err := db.QueryContext(ctx, q, uint32(os.ModeType))
+	if err != nil {
+		return errors.Wrap(err, "failed to list files without a generation")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var inode uint64
+		if err := rows.Scan(&inode); err != nil {
+			return err
+		}
+		if err := f(inode); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// BumpGeneration increments the generation of the node with Inode number
+// `inode`, so that mounts drop the blocks of it they cached.
+func BumpGeneration(ctx context.Context, db *DB, inode uint64) error {
+	q := "UPDATE inodes SET generation = generation + 1 WHERE inode = $1"
+	if _, err := db.ExecContext(ctx, q, inode); err != nil {
+		return errors.Wrapf(err, "failed to bump the generation of inode %d", inode)
+	}
+	return nil
+}
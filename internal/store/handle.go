@@ -0,0 +1,268 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	fuseFS "bazil.org/fuse/fs"
+)
+
+const (
+	// Number of consecutive sequential reads after which readahead kicks in.
+	readaheadTrigger = 2
+
+	// Upper bound on how long a background prefetch may take.
+	prefetchTimeout = 30 * time.Second
+)
+
+// fileHandle is an open regular file. It keeps per-open state, such as the
+// readahead window used to speed up sequential reads. All other operations
+// are handled by the embedded node.
+type fileHandle struct {
+	*FileNode
+
+	mu sync.Mutex
+	// Offset right after the last read, used to detect sequential reads.
+	lastEnd int64
+	// Number of sequential reads in a row.
+	sequential int
+	// Blocks that were prefetched, keyed by block index, and the epoch of
+	// the blocks of the inode they were read at: they are dropped once the
+	// blocks are invalidated, by a write through any handle or node, or
+	// once a change made elsewhere is noticed.
+	window      map[int64][]byte
+	windowEpoch uint64
+	// Index of the first block that has not been prefetched yet.
+	prefetchEnd int64
+	prefetching bool
+}
+
+func newFileHandle(n *FileNode) *fileHandle {
+	return &fileHandle{
+		FileNode: n,
+		window:   make(map[int64][]byte),
+	}
+}
+
+// Open is called for every open(2). Regular files get their own handle so
+// that the readahead state is not shared between readers. Handles do not
+// check the access mode they were opened with: with the writeback cache,
+// the kernel reads through write-only handles to fill partial pages, and
+// writes dirty pages back through any handle.
+// Open implements the fuseFS.NodeOpener interface.
+func (n *FileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fuseFS.Handle, error) {
+	if err := n.fs.checkOpen(ctx, n, req); err != nil {
+		return nil, err
+	}
+	if !n.IsRegular() {
+		return n, nil
+	}
+	if n.fs.heat != nil {
+		n.fs.heat.Record(n.Inode)
+	}
+	if req.Flags.IsWriteOnly() || req.Flags.IsReadWrite() {
+		if err := n.fs.checkWritable(); err != nil {
+			return nil, err
+		}
+		unlock := n.lock()
+		immutable, appendOnly := n.immutable(), n.appendOnly()
+		unlock()
+		if immutable || appendOnly && req.Flags&fuse.OpenAppend == 0 {
+			return nil, fuse.EPERM
+		}
+	}
+	if n.fs.directIO {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	return newFileHandle(n), nil
+}
+
+// Read serves reads from the readahead window when possible, and prefetches
+// the following blocks once a sequential read pattern is detected.
+// Read implements the fuseFS.HandleReader interface.
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.fs.settleCreates(h.Inode)
+	h.fs.waitWrites(h.Inode)
+	size := h.snapshot().Size
+	first, last := h.fs.db.blockRange(req.Offset, req.Size, size)
+
+	h.mu.Lock()
+	if h.windowEpoch != h.fs.blockEpoch(h.Inode) {
+		h.dropWindow(-1)
+	}
+	if req.Offset == h.lastEnd {
+		h.sequential++
+	} else {
+		h.sequential = 0
+		h.dropWindow(-1)
+	}
+	h.lastEnd = req.Offset + int64(req.Size)
+	blocks := make(map[int64][]byte, last-first)
+	for i := first; i < last; i++ {
+		if b, ok := h.window[i]; ok {
+			blocks[i] = b
+		}
+	}
+	h.dropWindow(first)
+	h.mu.Unlock()
+
+	if int64(len(blocks)) < last-first {
+		fetched, err := h.fs.readBlocks(ctx, h.Inode, first, last-first)
+		if err != nil {
+			log.Println(err)
+			return errnoFromErr(ctx, err)
+		}
+		for i, b := range fetched {
+			if _, ok := blocks[i]; !ok {
+				blocks[i] = b
+			}
+		}
+	}
+	resp.Data = h.fs.db.assembleBlocks(blocks, req.Offset, req.Size, size)
+	h.fs.touchAtime(h.FileNode)
+
+	if h.fs.readahead > 0 {
+		h.maybePrefetch(last, size)
+	}
+	return nil
+}
+
+// Write drops the readahead window before writing, as it may hold stale
+// blocks afterwards.
+// Write implements the fuseFS.HandleWriter interface.
+func (h *fileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	h.dropWindow(-1)
+	h.sequential = 0
+	h.mu.Unlock()
+	return h.FileNode.Write(ctx, req, resp)
+}
+
+// Flush is called on each close(2) of the handle, and reports the failure
+// of writes that were committed in the background.
+// Flush implements the fuseFS.HandleFlusher interface.
+func (h *fileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if err := h.fs.syncWrites(h.Inode); err != nil {
+		return errnoFromErr(ctx, err)
+	}
+	return nil
+}
+
+// dropWindow removes all prefetched blocks before the block index `keep`,
+// or every block if `keep` is negative. Must be called with h.mu held.
+func (h *fileHandle) dropWindow(keep int64) {
+	for i := range h.window {
+		if keep < 0 || i < keep {
+			delete(h.window, i)
+		}
+	}
+	if keep < 0 {
+		h.prefetchEnd = 0
+	}
+}
+
+// maybePrefetch fetches the next blocks after `next` of a file of `size`
+// bytes in the background if the handle is being read sequentially.
+func (h *fileHandle) maybePrefetch(next int64, size uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sequential < readaheadTrigger || h.prefetching {
+		return
+	}
+	start := next
+	if h.prefetchEnd > start {
+		start = h.prefetchEnd
+	}
+	end := next + int64(h.fs.readahead)
+	if maxBlocks := (int64(size) + h.fs.db.BlockSize - 1) / h.fs.db.BlockSize; end > maxBlocks {
+		end = maxBlocks
+	}
+	// Only refill once half of the window has been consumed.
+	if end-start < int64(h.fs.readahead)/2 || start >= end {
+		return
+	}
+	h.prefetching = true
+	go h.prefetch(start, end)
+}
+
+// prefetch reads the blocks [start, end) into the readahead window. The
+// contents of the file may have been changed by another mount or command
+// since they were last seen, which is checked first.
+func (h *fileHandle) prefetch(start, end int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	updated, err := GetNodeByID(ctx, h.fs.db, h.Inode)
+	var blocks map[int64][]byte
+	var epoch uint64
+	if err == nil {
+		unlock := h.lock()
+		h.syncGeneration(updated)
+		unlock()
+		epoch = h.fs.blockEpoch(h.Inode)
+		blocks, err = h.fs.readBlocks(ctx, h.Inode, start, end-start)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prefetching = false
+	if err != nil {
+		log.Printf("failed to prefetch blocks of inode %d: %s\n", h.Inode, err)
+		return
+	}
+	if h.fs.blockEpoch(h.Inode) != epoch {
+		// The blocks may have been read before a write.
+		return
+	}
+	if h.windowEpoch != epoch {
+		h.dropWindow(-1)
+		h.windowEpoch = epoch
+	}
+	for i, b := range blocks {
+		h.window[i] = b
+	}
+	h.prefetchEnd = end
+}
+
+// blockRange returns the half-open range of block indexes covering `size`
+// bytes at `offset` of a file of `fileSize` bytes.
+func (s *settings) blockRange(offset int64, size int, fileSize uint64) (first, last int64) {
+	end := offset + int64(size)
+	if end > int64(fileSize) || size > 0 && end < offset {
+		end = int64(fileSize)
+	}
+	if offset < 0 || offset >= end {
+		return 0, 0
+	}
+	first = offset / s.BlockSize
+	last = (end-1)/s.BlockSize + 1 // Rounded up, without overflowing.
+	return first, last
+}
+
+// assembleBlocks returns the `size` bytes at `offset` of a file of
+// `fileSize` bytes from its blocks. Missing blocks read as zeros.
+func (s *settings) assembleBlocks(blocks map[int64][]byte, offset int64, size int, fileSize uint64) []byte {
+	end := offset + int64(size)
+	if end > int64(fileSize) || size > 0 && end < offset {
+		end = int64(fileSize)
+	}
+	if offset < 0 || offset >= end {
+		return nil
+	}
+	data := make([]byte, end-offset)
+	for pos := offset; pos < end; {
+		i := pos / s.BlockSize
+		inBlock := pos % s.BlockSize
+		n := s.BlockSize - inBlock
+		if pos+n > end {
+			n = end - pos
+		}
+		if b := blocks[i]; int64(len(b)) > inBlock {
+			copy(data[pos-offset:pos-offset+n], b[inBlock:])
+		}
+		pos += n
+	}
+	return data
+}
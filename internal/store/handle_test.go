@@ -0,0 +1,28 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestFlushReportsWriteErrno(t *testing.T) {
+	w := &asyncWriter{
+		pending: make(map[uint64]*inodeWrites),
+		errs:    map[uint64]error{42: errNoSpace},
+	}
+	w.cond = sync.NewCond(&w.mu)
+	h := &fileHandle{FileNode: &FileNode{Inode: 42, fs: &fileSystem{writes: w}}}
+
+	err := h.Flush(context.Background(), &fuse.FlushRequest{})
+	if err != fuse.Errno(syscall.ENOSPC) {
+		t.Errorf("Flush after a write beyond the space returned %v, want ENOSPC", err)
+	}
+	// The error is reported once.
+	if err := h.Flush(context.Background(), &fuse.FlushRequest{}); err != nil {
+		t.Errorf("second Flush returned %v", err)
+	}
+}
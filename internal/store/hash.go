@@ -0,0 +1,138 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"io"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// The SHA-256 of the contents of every regular file can be read, in hex,
+// from its extended attribute sha256Xattr, e.g. with
+// `getfattr -n user.sqlfs.sha256 FILE`, and is printed by `sqlfs stat`, so that sync and dedup tools
+// can tell whether files changed without reading them. It is computed when
+// first asked for and, on file systems created with
+// `sqlfs init -file-hashes`, kept in the file_hashes table together with
+// the generation of the file it was computed for: as every change of the
+// contents bumps the generation, it stays valid until the file is next
+// written. The attribute cannot be set and is not listed, so that copying
+// the attributes of files does not try to.
+const sha256Xattr = "user.sqlfs.sha256"
+
+// fileHashStatements creates the table of the hashes of files. It is only
+// created by `sqlfs init -file-hashes`.
+var fileHashStatements = []string{
+	`CREATE TABLE IF NOT EXISTS file_hashes (
+  inode      INT,
+  generation INT NOT NULL,
+  sha256     BYTES NOT NULL,
+  PRIMARY KEY (inode)
+)`,
+}
+
+// Number of times the hash of a file is computed again if the file changes
+// while it is being read.
+const fileHashAttempts = 3
+
+var ErrHashUnavailable = errors.New("the hash of the file is not available")
+
+// CreateFileHashes creates the table keeping the hashes of files.
+func CreateFileHashes(ctx context.Context, db *DB) error {
+	for _, q := range fileHashStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q", q)
+		}
+	}
+	return nil
+}
+
+// FileHash returns the SHA-256 of the contents of the regular file `inode`.
+// It fails with ErrHashUnavailable for other nodes, and for tiered files
+// whose hash was not kept when they were tiered, if the object store holding
+// their contents is not known.
+func FileHash(ctx context.Context, db *DB, inode uint64) ([]byte, error) {
+	for attempt := 0; attempt < fileHashAttempts; attempt++ {
+		n, err := GetNodeByID(ctx, db, inode)
+		if err != nil {
+			return nil, err
+		}
+		if !n.IsRegular() {
+			return nil, ErrHashUnavailable
+		}
+		if db.fileHashesEnabled {
+			var sum []byte
+			q := "SELECT sha256 FROM file_hashes WHERE inode = $1 AND generation = $2"
+			err := db.QueryRowContext(ctx, q, inode, n.Generation).Scan(&sum)
+			if err == nil {
+				return sum, nil
+			}
+			if err != sql.ErrNoRows {
+				return nil, errors.Wrapf(err, "failed to read the hash of inode %d", inode)
+			}
+		}
+		if db.tieringEnabled && db.tierStore == nil {
+			_, err = GetTieredObject(ctx, db, inode)
+			if err == nil {
+				return nil, ErrHashUnavailable
+			}
+			if err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+
+		h := sha256.New()
+		if err := CopyData(ctx, db, n, h); err != nil {
+			return nil, err
+		}
+		sum := h.Sum(nil)
+		// The file may have been written while it was read.
+		stored, err := putFileHash(ctx, db, n, sum)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			return sum, nil
+		}
+	}
+	return nil, errors.Errorf("inode %d kept changing while it was hashed", inode)
+}
+
+// putFileHash keeps `sum` as the hash of `n` if the file is still at the
+// generation of `n`, and returns whether it is. Failing to keep the hash,
+// e.g. on a read-only view, only means it is computed again next time.
+func putFileHash(ctx context.Context, db *DB, n *FileNode, sum []byte) (bool, error) {
+	if db.fileHashesEnabled {
+		q := `UPSERT INTO file_hashes (inode, generation, sha256)
+  SELECT inode, generation, $3 FROM inodes WHERE inode = $1 AND generation = $2`
+		res, err := db.ExecContext(ctx, q, n.Inode, n.Generation, sum)
+		if err == nil {
+			count, err := res.RowsAffected()
+			return count > 0, err
+		}
+		log.Printf("failed to keep the hash of inode %d: %s\n", n.Inode, err)
+	}
+	var generation uint64
+	q := "SELECT generation FROM inodes WHERE inode = $1"
+	if err := db.QueryRowContext(ctx, q, n.Inode).Scan(&generation); err != nil {
+		return false, err
+	}
+	return generation == n.Generation, nil
+}
+
+// removeFileHash deletes the hash of the deleted `inode`.
+func removeFileHash(ctx context.Context, tx *fsTx, inode uint64) error {
+	if !tx.fileHashesEnabled {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM file_hashes WHERE inode = $1", inode)
+	return err
+}
+
+// hashingWriter computes the SHA-256 of what is written through it.
+func hashingWriter(w io.Writer) (io.Writer, func() []byte) {
+	h := sha256.New()
+	return io.MultiWriter(w, h), func() []byte { return h.Sum(nil) }
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long the readiness check waits for the database to answer.
+const healthPingTimeout = 2 * time.Second
+
+// The health endpoints of the admin API let supervisors such as Kubernetes
+// or systemd watchdogs act on the state of a mount:
+//
+//	GET /healthz  liveness: fails once the FUSE mount is lost and not back
+//	GET /readyz   readiness: fails while the mount cannot serve operations,
+//	              i.e. it is not mounted or unmounting, the database does not
+//	              answer, the circuit breaker is open or the database disk
+//	              is full
+//
+// Both answer 200 or 503 with the checks made. Checks that only degrade the
+// mount, such as a backlog of writes or a failing background task, are
+// reported without failing readiness.
+
+// Outcomes of health checks.
+const (
+	healthOK          = "ok"
+	healthDegraded    = "degraded"
+	healthUnavailable = "unavailable"
+)
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+func (r *healthReport) add(name, status, detail string) {
+	r.Checks = append(r.Checks, healthCheck{Name: name, Status: status, Detail: detail})
+	if status == healthUnavailable || status == healthDegraded && r.Status == healthOK {
+		r.Status = status
+	}
+}
+
+// backgroundTasks records the outcome of the last run of each background
+// task of a mount.
+type backgroundTasks struct {
+	mu   sync.Mutex
+	runs map[string]taskRun
+}
+
+type taskRun struct {
+	Last time.Time
+	Err  error
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	return &backgroundTasks{runs: make(map[string]taskRun)}
+}
+
+// report records that the task `name` just ran with the outcome `err`.
+func (t *backgroundTasks) report(name string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.runs[name] = taskRun{Last: time.Now(), Err: err}
+}
+
+// Runs returns the last run of each task.
+func (t *backgroundTasks) Runs() map[string]taskRun {
+	runs := make(map[string]taskRun)
+	if t == nil {
+		return runs
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, run := range t.runs {
+		runs[name] = run
+	}
+	return runs
+}
+
+// mountCheck adds the state of the FUSE mount to `r`.
+func (a *adminServer) mountCheck(r *healthReport) {
+	switch {
+	case a.mounted == nil:
+		r.add("mount", healthOK, "")
+	case a.fs.ops != nil && a.fs.ops.Draining():
+		r.add("mount", healthUnavailable, "unmounting")
+	case !a.mounted():
+		r.add("mount", healthUnavailable, "not mounted")
+	default:
+		r.add("mount", healthOK, a.mountpoint)
+	}
+}
+
+func (a *adminServer) liveness(ctx context.Context) healthReport {
+	r := healthReport{Status: healthOK}
+	a.mountCheck(&r)
+	return r
+}
+
+func (a *adminServer) readiness(ctx context.Context) healthReport {
+	r := healthReport{Status: healthOK}
+	a.mountCheck(&r)
+
+	pingCtx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	start := time.Now()
+	err := a.fs.db.PingContext(pingCtx)
+	cancel()
+	if err != nil {
+		r.add("database", healthUnavailable, err.Error())
+	} else {
+		r.add("database", healthOK, fmt.Sprintf("answered in %s", time.Since(start).Round(time.Millisecond)))
+	}
+	if a.fs.budget != nil {
+		if stats := a.fs.budget.Stats(); stats.BreakerOpen {
+			r.add("circuit_breaker", healthUnavailable, "open")
+		} else {
+			r.add("circuit_breaker", healthOK, "closed")
+		}
+	}
+	if a.fs.diskFull.Full() {
+		r.add("database_disk", healthUnavailable, "full")
+	} else {
+		r.add("database_disk", healthOK, "")
+	}
+
+	if a.fs.blocks != nil {
+		stats := a.fs.blocks.Stats()
+		r.add("block_cache", healthOK, fmt.Sprintf("%d of %d bytes used", stats.Bytes, stats.Capacity))
+	}
+	if a.fs.writes != nil {
+		queued := a.fs.writes.Queued()
+		status := healthOK
+		if queued >= a.fs.writes.budget {
+			// Writers wait for the backlog to be committed.
+			status = healthDegraded
+		}
+		r.add("async_writes", status, fmt.Sprintf("%d of %d bytes queued", queued, a.fs.writes.budget))
+	}
+
+	runs := a.fs.tasks.Runs()
+	names := make([]string, 0, len(runs))
+	for name := range runs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		run := runs[name]
+		if run.Err != nil {
+			r.add("task_"+name, healthDegraded, fmt.Sprintf("failed %s ago: %s", time.Since(run.Last).Round(time.Second), run.Err))
+		} else {
+			r.add("task_"+name, healthOK, fmt.Sprintf("ran %s ago", time.Since(run.Last).Round(time.Second)))
+		}
+	}
+	return r
+}
+
+// health serves the report of `check`, with the status 503 if the mount is
+// unavailable.
+func (a *adminServer) health(check func(ctx context.Context) healthReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := check(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == healthUnavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Number of inodes kept in a heat map file, the most accessed first.
+	heatMapSize = 10000
+	// How often the heat map of a mount is saved, so that a crash loses
+	// little of it.
+	heatMapSaveInterval = time.Minute
+)
+
+// heatMap counts the accesses of a mount to its files and directories, and
+// saves them to a file, from which the next mount warms up its hot set.
+// Each line of the file holds an inode and its count, most accessed first.
+// The counts of earlier mounts are halved when the file is loaded, so that
+// inodes that are no longer used fade out.
+type heatMap struct {
+	path string
+
+	mu     sync.Mutex
+	loaded map[uint64]uint64 // Halved counts of the file.
+	counts map[uint64]uint64 // Accesses of this mount.
+}
+
+// loadHeatMap reads the heat map file `path`, which need not exist yet.
+func loadHeatMap(path string) (*heatMap, error) {
+	h := &heatMap{path: path, loaded: make(map[uint64]uint64), counts: make(map[uint64]uint64)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open the heat map")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected an inode and a count", path, line)
+		}
+		inode, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: invalid inode", path, line)
+		}
+		count, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: invalid count", path, line)
+		}
+		if count /= 2; count > 0 {
+			h.loaded[inode] += count
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read the heat map")
+	}
+	return h, nil
+}
+
+// Record counts an access to `inode`.
+func (h *heatMap) Record(inode uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[inode]++
+}
+
+// Hot returns the inodes of the file, most accessed first.
+func (h *heatMap) Hot() []uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return sortByCount(h.loaded)
+}
+
+// sortByCount returns the inodes of `counts` by decreasing count.
+func sortByCount(counts map[uint64]uint64) []uint64 {
+	inodes := make([]uint64, 0, len(counts))
+	for inode := range counts {
+		inodes = append(inodes, inode)
+	}
+	sort.Slice(inodes, func(i, j int) bool {
+		a, b := counts[inodes[i]], counts[inodes[j]]
+		return a > b || a == b && inodes[i] < inodes[j]
+	})
+	return inodes
+}
+
+// Save replaces the file with the heatMapSize inodes most accessed, adding
+// the accesses of this mount to the loaded counts.
+func (h *heatMap) Save() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	merged := make(map[uint64]uint64, len(h.loaded)+len(h.counts))
+	for inode, count := range h.loaded {
+		merged[inode] = count
+	}
+	for inode, count := range h.counts {
+		merged[inode] += count
+	}
+	inodes := sortByCount(merged)
+	if len(inodes) > heatMapSize {
+		inodes = inodes[:heatMapSize]
+	}
+	var b strings.Builder
+	for _, inode := range inodes {
+		fmt.Fprintf(&b, "%d %d\n", inode, merged[inode])
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to save the heat map")
+	}
+	_, err = tmp.WriteString(b.String())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to save the heat map")
+	}
+	return nil
+}
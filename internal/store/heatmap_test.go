@@ -0,0 +1,71 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHeatMapSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heatmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "heat")
+
+	h, err := loadHeatMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hot := h.Hot(); len(hot) != 0 {
+		t.Fatalf("missing heat map has hot inodes %v", hot)
+	}
+	for inode, count := range map[uint64]int{3: 2, 5: 8, 7: 4, 9: 1} {
+		for i := 0; i < count; i++ {
+			h.Record(inode)
+		}
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts are halved when loaded, which drops inode 9.
+	h, err = loadHeatMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hot, want := h.Hot(), []uint64{5, 7, 3}; !reflect.DeepEqual(hot, want) {
+		t.Fatalf("hot inodes %v, want %v", hot, want)
+	}
+	for i := 0; i < 5; i++ {
+		h.Record(3)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+	h, err = loadHeatMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hot, want := h.Hot(), []uint64{3, 5, 7}; !reflect.DeepEqual(hot, want) {
+		t.Fatalf("hot inodes %v, want %v", hot, want)
+	}
+}
+
+func TestHeatMapInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "heatmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("1 2\nfoo\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := loadHeatMap(f.Name()); err == nil {
+		t.Fatal("loaded a heat map with an invalid line")
+	}
+}
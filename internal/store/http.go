@@ -0,0 +1,139 @@
+package store
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// httpServer serves the files of a tree over HTTP, straight from the
+// database. Ranges are read from the blocks they overlap only, and
+// conditional requests are answered from the inode metadata.
+type httpServer struct {
+	tree     *TreeFS
+	listings bool // Whether directories are listed.
+}
+
+func NewHTTPServer(db *DB, root *FileNode, listings bool) *httpServer {
+	return &httpServer{tree: &TreeFS{db: db, root: root}, listings: listings}
+}
+
+// etag identifies a version of the contents of `n`. Writes bump the
+// modification time, which is kept with nanosecond precision.
+func etag(n *FileNode) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, n.Inode, n.Size, n.Mtime.UnixNano())
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	tree := s.tree.WithContext(r.Context())
+	n, err := tree.resolve("open", name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case n.IsDirectory():
+		s.serveDir(w, r, tree, name, n)
+	case n.IsRegular():
+		w.Header().Set("ETag", etag(n))
+		// ServeContent handles ranges and conditional requests, and
+		// seeks to the start of each range before reading it.
+		http.ServeContent(w, r, n.Name, n.Mtime, &treeFile{t: tree, n: n})
+	default:
+		// Symbolic links are not followed, so that they cannot point
+		// outside of the served tree.
+		http.NotFound(w, r)
+	}
+}
+
+var dirListing = template.Must(template.New("dir").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.Modified}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+type dirListingEntry struct {
+	Name, Href, Size, Modified string
+}
+
+// serveDir lists the directory `n` at `name` if listings are enabled.
+// Paths of directories must end with a slash, so that relative links
+// resolve.
+func (s *httpServer) serveDir(w http.ResponseWriter, r *http.Request, tree *TreeFS, name string, n *FileNode) {
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	if !s.listings {
+		http.Error(w, "directory listings are disabled", http.StatusForbidden)
+		return
+	}
+	entries, err := tree.ReadDir(name)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Path    string
+		Entries []dirListingEntry
+	}{Path: r.URL.Path}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		entry := dirListingEntry{
+			Name:     e.Name(),
+			Href:     (&url.URL{Path: e.Name()}).String(),
+			Size:     fmt.Sprint(info.Size()),
+			Modified: info.ModTime().UTC().Format(http.TimeFormat),
+		}
+		if e.IsDir() {
+			entry.Name += "/"
+			entry.Href += "/"
+			entry.Size = "-"
+		}
+		data.Entries = append(data.Entries, entry)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Last-Modified", n.Mtime.UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := dirListing.Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+// idRange maps `count` consecutive IDs stored in the database, starting at
+// `stored`, to the IDs starting at `local` presented by the mount.
+type idRange struct {
+	stored, local, count uint32
+}
+
+// IDMap translates the user or group IDs of a mount, like idmapped mounts:
+// a tree created on one machine or user namespace can be presented with the
+// owners of another. IDs outside of every range are left as they are.
+type IDMap []idRange
+
+// setOwner makes the caller of the request `h` the owner of the new node `n`.
+func (fs fileSystem) setOwner(n *FileNode, h *fuse.Header) {
+	n.Uid = fs.uids.toStored(h.Uid)
+	n.Gid = fs.gids.toStored(h.Gid)
+}
+
+// toLocal returns the ID presented for the stored ID `id`.
+func (m IDMap) toLocal(id uint32) uint32 {
+	for _, r := range m {
+		if id >= r.stored && id-r.stored < r.count {
+			return r.local + (id - r.stored)
+		}
+	}
+	return id
+}
+
+// toStored returns the ID stored for the presented ID `id`.
+func (m IDMap) toStored(id uint32) uint32 {
+	for _, r := range m {
+		if id >= r.local && id-r.local < r.count {
+			return r.stored + (id - r.local)
+		}
+	}
+	return id
+}
+
+// String implements flag.Value.
+func (m *IDMap) String() string {
+	var parts []string
+	for _, r := range *m {
+		parts = append(parts, strconv.FormatUint(uint64(r.stored), 10)+":"+
+			strconv.FormatUint(uint64(r.local), 10)+":"+strconv.FormatUint(uint64(r.count), 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value. It accepts comma separated STORED:LOCAL or
+// STORED:LOCAL:COUNT ranges, and can be repeated.
+func (m *IDMap) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		r, err := parseIDRange(strings.Split(part, ":"))
+		if err != nil {
+			return errors.Wrapf(err, "invalid ID mapping %q", part)
+		}
+		if err := m.add(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseIDRange(fields []string) (idRange, error) {
+	if len(fields) != 2 && len(fields) != 3 {
+		return idRange{}, errors.New("expected STORED:LOCAL[:COUNT]")
+	}
+	var v [3]uint32
+	v[2] = 1
+	for i, f := range fields {
+		n, err := strconv.ParseUint(strings.TrimSpace(f), 10, 32)
+		if err != nil {
+			return idRange{}, err
+		}
+		v[i] = uint32(n)
+	}
+	if v[2] == 0 || uint64(v[0])+uint64(v[2]) > 1<<32 || uint64(v[1])+uint64(v[2]) > 1<<32 {
+		return idRange{}, errors.New("invalid count")
+	}
+	return idRange{stored: v[0], local: v[1], count: v[2]}, nil
+}
+
+// add appends `r`, which must not overlap the existing ranges on either
+// side, so that the mapping can be reversed.
+func (m *IDMap) add(r idRange) error {
+	for _, o := range *m {
+		if overlaps(r.stored, r.count, o.stored, o.count) || overlaps(r.local, r.count, o.local, o.count) {
+			return errors.Errorf("ID mapping %d:%d:%d overlaps another one", r.stored, r.local, r.count)
+		}
+	}
+	*m = append(*m, r)
+	return nil
+}
+
+func overlaps(a, aCount, b, bCount uint32) bool {
+	return uint64(a) < uint64(b)+uint64(bCount) && uint64(b) < uint64(a)+uint64(aCount)
+}
+
+// loadIDMapFile adds the mappings of the file at `path` to `uids` and
+// `gids`. Each line holds "u" or "g" followed by the first stored ID, the
+// first presented ID and the number of IDs, as in /proc/PID/uid_map.
+// Empty lines and lines starting with # are ignored.
+func loadIDMapFile(path string, uids, gids *IDMap) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var m *IDMap
+		switch fields[0] {
+		case "u":
+			m = uids
+		case "g":
+			m = gids
+		default:
+			return errors.Errorf("%s:%d: expected u or g", path, line)
+		}
+		r, err := parseIDRange(fields[1:])
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", path, line)
+		}
+		if err := m.add(r); err != nil {
+			return errors.Wrapf(err, "%s:%d", path, line)
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIDMapSet(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   string // In the form of String, or "" for an error.
+	}{
+		{[]string{"0:1000"}, "0:1000:1"},
+		{[]string{"0:1000:1", "1000:2000:65536"}, "0:1000:1,1000:2000:65536"},
+		{[]string{" 5 : 6 : 2 ,7:9"}, "5:6:2,7:9:1"},
+		{[]string{"4294967295:0:1"}, "4294967295:0:1"},
+		{[]string{"0"}, ""},
+		{[]string{"0:1:2:3"}, ""},
+		{[]string{"a:1"}, ""},
+		{[]string{"-1:1"}, ""},
+		{[]string{"0:1:0"}, ""},
+		{[]string{"4294967295:0:2"}, ""},
+		// Ranges may not overlap on either side, so that mapping back is
+		// unambiguous.
+		{[]string{"0:1000:10", "5:2000"}, ""},
+		{[]string{"0:1000:10", "100:1009"}, ""},
+		{[]string{"0:1000:10,10:1010:10"}, "0:1000:10,10:1010:10"},
+	} {
+		var m IDMap
+		var err error
+		for _, v := range tc.values {
+			if err = m.Set(v); err != nil {
+				break
+			}
+		}
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("Set(%q) = %s, want an error", tc.values, m.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) returned %v", tc.values, err)
+			continue
+		}
+		if got := m.String(); got != tc.want {
+			t.Errorf("Set(%q) = %s, want %s", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestIDMapTranslate(t *testing.T) {
+	var m IDMap
+	if err := m.Set("0:1000:1,1000:100000:65536"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ stored, local uint32 }{
+		{0, 1000},
+		{1000, 100000},
+		{1001, 100001},
+		{66535, 165535},
+		// IDs outside every range are left as they are, on both sides.
+		{66536, 66536},
+		{500, 500},
+	} {
+		if got := m.toLocal(tc.stored); got != tc.local {
+			t.Errorf("toLocal(%d) = %d, want %d", tc.stored, got, tc.local)
+		}
+		if got := m.toStored(tc.local); got != tc.stored {
+			t.Errorf("toStored(%d) = %d, want %d", tc.local, got, tc.stored)
+		}
+	}
+	// 1000 is both a stored ID and a presented one: it is presented as
+	// 100000, and presented 1000 is stored as 0.
+	if got := m.toStored(m.toLocal(1000)); got != 1000 {
+		t.Errorf("toStored(toLocal(1000)) = %d", got)
+	}
+}
+
+func TestLoadIDMapFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(text string) string {
+		path := filepath.Join(dir, "idmap")
+		if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	var uids, gids IDMap
+	path := write("# uid_map style\nu 0 1000 1\n\ng 0 1000 1\ng 100 2000 10\n")
+	if err := loadIDMapFile(path, &uids, &gids); err != nil {
+		t.Fatal(err)
+	}
+	if uids.String() != "0:1000:1" || gids.String() != "0:1000:1,100:2000:10" {
+		t.Errorf("loaded uids %s and gids %s", uids.String(), gids.String())
+	}
+
+	for text, want := range map[string]string{
+		"x 0 1000 1\n":             "idmap:1: expected u or g",
+		"u 0 1000 1\nu 0 2000\n":   "idmap:2",
+		"\n\ng 0\n":                "idmap:3",
+		"u 0 1000 1 extra\n":       "idmap:1",
+		"u 0 1000 4294967295\n":    "idmap:1",
+		"g 0 1000 1\ng 5 1000 1\n": "overlaps",
+	} {
+		var uids, gids IDMap
+		err := loadIDMapFile(write(text), &uids, &gids)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadIDMapFile(%q) returned %v, want %q", text, err, want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Importer bulk-loads nodes directly into the database, bypassing FUSE.
+// Nodes are written in batches of `batchSize` per transaction.
+type Importer struct {
+	ctx       context.Context
+	db        *DB
+	batchSize int
+
+	tx      *fsTx
+	pending int
+
+	// Inodes of the directories created or found so far, keyed by their
+	// path relative to the import destination.
+	Dirs map[string]uint64
+	// Nodes written so far that may be hard linked, keyed by path.
+	files map[string]*FileNode
+
+	// Counters reported at the end of the import.
+	Nodes int
+	Bytes uint64
+}
+
+func NewImporter(ctx context.Context, db *DB, dest uint64, batchSize int) *Importer {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &Importer{
+		ctx:       ctx,
+		db:        db,
+		batchSize: batchSize,
+		Dirs:      map[string]uint64{".": dest},
+		files:     make(map[string]*FileNode),
+	}
+}
+
+func (im *Importer) begin() error {
+	if im.tx != nil {
+		return nil
+	}
+	tx, err := im.db.BeginTx(im.ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	im.tx = tx
+	return nil
+}
+
+// done is called after every node, and commits the current batch once it
+// is full.
+func (im *Importer) done() error {
+	im.Nodes++
+	im.pending++
+	if im.pending < im.batchSize {
+		return nil
+	}
+	return im.Commit()
+}
+
+// Commit commits the current batch, if any.
+func (im *Importer) Commit() error {
+	if im.tx == nil {
+		return nil
+	}
+	err := im.tx.Commit()
+	im.tx = nil
+	im.pending = 0
+	return err
+}
+
+// Rollback aborts the current batch. Batches that were already committed
+// are kept.
+func (im *Importer) Rollback() {
+	if im.tx != nil {
+		_ = im.tx.Rollback()
+		im.tx = nil
+	}
+}
+
+// parentOf returns the inode of the directory containing `p`, which must
+// have been imported already.
+func (im *Importer) parentOf(p string) (uint64, error) {
+	dir := path.Dir(p)
+	parent, ok := im.Dirs[dir]
+	if !ok {
+		return 0, errors.Errorf("parent directory of %q was not imported", p)
+	}
+	return parent, nil
+}
+
+// AddDir creates the directory `p`, or reuses it if it already exists.
+func (im *Importer) AddDir(p string, n *FileNode) error {
+	if p == "." {
+		return nil
+	}
+	if err := im.begin(); err != nil {
+		return err
+	}
+	parent, err := im.parentOf(p)
+	if err != nil {
+		return err
+	}
+	n.Name = im.db.normName(path.Base(p))
+
+	var inode uint64
+	q := "SELECT inode FROM tree WHERE parent = $1 AND " + im.db.nameEquals("name", "$2")
+	err = im.tx.QueryRowContext(im.ctx, q, parent, n.Name).Scan(&inode)
+	switch {
+	case err == nil:
+		im.Dirs[p] = inode
+		return nil
+	case err != sql.ErrNoRows:
+		return errors.Wrapf(err, "failed to look up %q", p)
+	}
+
+	n.Nlink = 2
+	if err := im.insertNode(parent, n); err != nil {
+		return errors.Wrapf(err, "failed to create directory %q", p)
+	}
+	im.Dirs[p] = n.Inode
+	return im.done()
+}
+
+// AddFile creates the regular file, symlink or special file `p` with
+// contents read from `r`. `r` may be nil for empty files.
+func (im *Importer) AddFile(p string, n *FileNode, r io.Reader) error {
+	if err := im.begin(); err != nil {
+		return err
+	}
+	parent, err := im.parentOf(p)
+	if err != nil {
+		return err
+	}
+	n.Name = path.Base(p)
+	n.Nlink = 1
+	if err := im.insertNode(parent, n); err != nil {
+		return errors.Wrapf(err, "failed to create %q", p)
+	}
+	if r != nil && n.IsRegular() {
+		size, err := insertDataBlocks(im.ctx, im.tx, n.Inode, r)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write data of %q", p)
+		}
+		if err := bumpGeneration(im.ctx, im.tx, n); err != nil {
+			return err
+		}
+		im.Bytes += size
+	}
+	im.files[p] = n
+	return im.done()
+}
+
+// AddLink creates `p` as a hard link to the previously imported `target`.
+func (im *Importer) AddLink(p string, target string) error {
+	if err := im.begin(); err != nil {
+		return err
+	}
+	parent, err := im.parentOf(p)
+	if err != nil {
+		return err
+	}
+	n, ok := im.files[target]
+	if !ok {
+		return errors.Errorf("hard link target %q of %q was not imported", target, p)
+	}
+	if err := im.db.validName(path.Base(p)); err != nil {
+		return errors.Wrapf(err, "invalid name %q", p)
+	}
+	q1 := "INSERT INTO tree(inode, parent, name) VALUES ($1, $2, $3)"
+	if _, err := im.tx.ExecContext(im.ctx, q1, n.Inode, parent, im.db.normName(path.Base(p))); err != nil {
+		return errors.Wrapf(err, "failed to link %q", p)
+	}
+	n.Nlink++
+	if err := putInode(im.ctx, im.tx, n); err != nil {
+		return errors.Wrapf(err, "failed to update link count of %q", target)
+	}
+	return im.done()
+}
+
+func (im *Importer) insertNode(parent uint64, n *FileNode) error {
+	if err := im.db.validName(n.Name); err != nil {
+		return errors.Wrapf(err, "invalid name %q", n.Name)
+	}
+	n.Name = im.db.normName(n.Name)
+	if n.Ctime.IsZero() {
+		n.Ctime = time.Now()
+	}
+	inode, err := allocateInode(im.ctx, im.tx)
+	if err != nil {
+		return err
+	}
+	q1 := "INSERT INTO tree(inode, parent, name) VALUES ($1, $2, $3)"
+	if _, err := im.tx.ExecContext(im.ctx, q1, inode, parent, n.Name); err != nil {
+		return err
+	}
+	n.Inode = inode
+	n.Parent = parent
+	return putInode(im.ctx, im.tx, n)
+}
+
+// insertDataBlocks stores the contents of `r` as the data blocks of `inode`
+// and returns the number of bytes written. The blocks are streamed with
+// COPY, so only a batch of them is held in memory at a time.
+func insertDataBlocks(ctx context.Context, tx *fsTx, inode uint64, r io.Reader) (uint64, error) {
+	var size uint64
+	var batch [][]byte
+	for first := int64(0); ; first += int64(len(batch)) {
+		batch = batch[:0]
+		var err error
+		for int64(len(batch))*tx.BlockSize < importBatchSize && err == nil {
+			buf := make([]byte, tx.BlockSize)
+			var n int
+			n, err = io.ReadFull(r, buf)
+			if n > 0 {
+				batch = append(batch, buf[:n])
+				size += uint64(n)
+			}
+		}
+		if len(batch) > 0 {
+			if err := copyBlocks(ctx, tx, inode, first, batch); err != nil {
+				return size, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+// Number of bytes imported with each COPY.
+const importBatchSize = 4 << 20
+
+// NodeFromFileInfo creates a node with the metadata of a local file.
+func NodeFromFileInfo(fi os.FileInfo) *FileNode {
+	n := &FileNode{
+		Size:  uint64(fi.Size()),
+		Mode:  fi.Mode(),
+		Atime: fi.ModTime(),
+		Mtime: fi.ModTime(),
+		Ctime: fi.ModTime(),
+	}
+	if !n.IsRegular() {
+		n.Size = 0
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		n.Uid = st.Uid
+		n.Gid = st.Gid
+	}
+	return n
+}
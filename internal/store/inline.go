@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Small files make up most files of a typical tree, and reading or writing
+// one otherwise takes a query on the inodes table and another on the
+// data_blocks table. File systems created with `sqlfs init -inline-data`
+// store the contents of files of up to inlineDataSize bytes in the
+// inline_data column of their inode instead. A file whose data is inline
+// has no data blocks: once a write reaches past inlineDataSize, its inline
+// data is moved to data blocks in the same transaction, and the file stays
+// there for the rest of its life unless it is truncated to zero.
+
+// Upper bound on inlineDataSize, as inodes are read whole by most queries
+// on CockroachDB.
+const maxInlineDataSize = 64 << 10
+
+// EnableInlineData stores the contents of files of up to `size` bytes in
+// their inode from now on. Older binaries would not see inline data, so the
+// feature is recorded in the superblock as incompatible. It cannot be
+// undone.
+func EnableInlineData(ctx context.Context, db *DB, size int64) error {
+	if size <= 0 || size > maxInlineDataSize {
+		return errors.Errorf("the inline data size must be between 1 and %d bytes", maxInlineDataSize)
+	}
+	current, err := getInlineDataSize(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current != 0 && current != size {
+		return errors.Errorf("the file system already inlines files of up to %d bytes", current)
+	}
+	q := "ALTER TABLE inodes ADD COLUMN IF NOT EXISTS inline_data BYTES"
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "failed to add the inline_data column")
+	}
+	if err := PutSetting(ctx, db, settingInlineData, strconv.FormatInt(size, 10)); err != nil {
+		return err
+	}
+	return addIncompatFeature(ctx, db, featureInlineData)
+}
+
+// getInlineDataSize returns the size up to which files are inlined, or 0 if
+// inline data is disabled.
+func getInlineDataSize(ctx context.Context, db *DB) (int64, error) {
+	value, err := GetSetting(ctx, db, settingInlineData)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 || size > maxInlineDataSize {
+		return 0, errors.Errorf("invalid inline data size %q", value)
+	}
+	return size, nil
+}
+
+// inlineBlocksQuery returns `q`, a query of the blockColumns of data
+// blocks of the inode $1, preceded by the inline data of the inode as
+// sequence 0 if inline data is enabled.
+func (s *settings) inlineBlocksQuery(q string) string {
+	if s.inlineDataSize == 0 {
+		return q
+	}
+	columns := "0 AS sequence, inline_data AS data"
+	if s.checkingBlocks() {
+		// Inline data has no checksum.
+		columns += ", NULL::INT8 AS checksum"
+	}
+	return "SELECT " + columns + " FROM inodes WHERE inode = $1 AND inline_data IS NOT NULL UNION ALL " + q
+}
+
+// inlineLength returns the SQL expression of the number of bytes of inline
+// data of the inode in `table`, e.g. "inodes".
+func (s *settings) inlineLength(table string) string {
+	if s.inlineDataSize == 0 {
+		return "0"
+	}
+	return "COALESCE(length(" + table + ".inline_data), 0)"
+}
+
+// splitInline adds the blocks within [first, first+count) that hold the
+// inline data `inline` to `blocks`.
+func (s *settings) splitInline(blocks map[int64][]byte, inline []byte, first, count int64) {
+	for i := first; i < first+count && i*s.BlockSize < int64(len(inline)); i++ {
+		end := (i + 1) * s.BlockSize
+		if end > int64(len(inline)) {
+			end = int64(len(inline))
+		}
+		blocks[i] = inline[i*s.BlockSize : end]
+	}
+}
+
+// writeInlineTx writes `data` at `offset` of `n` into its inline data if
+// the file still fits in it, and returns true if it did. Files that outgrow
+// their inline data have it moved to data blocks, and false is returned so
+// that the write goes there too.
+func writeInlineTx(ctx context.Context, tx *fsTx, n *FileNode, offset int64, data []byte) (bool, error) {
+	var inline []byte
+	q1 := "SELECT inline_data FROM inodes WHERE inode = $1"
+	if err := tx.QueryRowContext(ctx, q1, n.Inode).Scan(&inline); err != nil && err != sql.ErrNoRows {
+		return false, errors.Wrapf(err, "failed to read the inline data of inode %d", n.Inode)
+	}
+	if inline == nil && n.Size > 0 {
+		// The data is already stored in blocks, or the file is a hole.
+		return false, nil
+	}
+
+	end := offset + int64(len(data))
+	if end > tx.inlineDataSize {
+		if inline == nil {
+			return false, nil
+		}
+		blocks := make(map[int64][]byte)
+		tx.splitInline(blocks, inline, 0, (int64(len(inline))+tx.BlockSize-1)/tx.BlockSize)
+		q2 := "UPSERT INTO data_blocks (inode, sequence, data) VALUES ($1, $2, $3)"
+		for i, b := range blocks {
+			if _, err := tx.ExecContext(ctx, q2, n.Inode, i+1, b); err != nil {
+				return false, errors.Wrapf(err, "failed to move the inline data of inode %d", n.Inode)
+			}
+		}
+		q3 := "UPDATE inodes SET inline_data = NULL WHERE inode = $1"
+		if _, err := tx.ExecContext(ctx, q3, n.Inode); err != nil {
+			return false, errors.Wrapf(err, "failed to move the inline data of inode %d", n.Inode)
+		}
+		return false, nil
+	}
+
+	if int64(len(inline)) < end {
+		grown := make([]byte, end)
+		copy(grown, inline)
+		inline = grown
+	}
+	copy(inline[offset:], data)
+	if uint64(end) > n.Size {
+		n.Size = uint64(end)
+	}
+	if err := putInode(ctx, tx, n); err != nil {
+		return false, err
+	}
+	// Same as bumpGeneration, storing the data on the way.
+	q4 := `UPDATE inodes SET inline_data = $3, generation = generation + 1
+  WHERE inode = $1 AND generation = $2 RETURNING generation`
+	err := tx.QueryRowContext(ctx, q4, n.Inode, n.Generation, inline).Scan(&n.Generation)
+	if err == sql.ErrNoRows {
+		return false, errGenerationChanged
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to write the inline data of inode %d", n.Inode)
+	}
+	return true, nil
+}
+
+// truncateInlineTx drops the inline data of `n` past `size`. Files
+// truncated to zero have none left, and may be inlined again.
+func truncateInlineTx(ctx context.Context, tx *fsTx, n *FileNode, size uint64) error {
+	q := `UPDATE inodes SET inline_data = CASE WHEN $2::INT = 0 THEN NULL ELSE substring(inline_data, 1, $2::INT) END
+  WHERE inode = $1 AND inline_data IS NOT NULL`
+	if _, err := tx.ExecContext(ctx, q, n.Inode, size); err != nil {
+		return errors.Wrapf(err, "failed to truncate the inline data of inode %d", n.Inode)
+	}
+	return nil
+}
+
+// removeInlineData drops the inline data of `inode`, if any, on a file
+// system with inline data enabled.
+func removeInlineData(ctx context.Context, e execer, inode uint64) error {
+	q := "UPDATE inodes SET inline_data = NULL WHERE inode = $1 AND inline_data IS NOT NULL"
+	if _, err := e.ExecContext(ctx, q, inode); err != nil {
+		return errors.Wrapf(err, "failed to remove the inline data of inode %d", inode)
+	}
+	return nil
+}
+
+// copyInlineData copies the inline data of `inode` from `src` to `dst`.
+func copyInlineData(ctx context.Context, src *sql.DB, dst execer, inode string) error {
+	var inline []byte
+	q1 := "SELECT inline_data FROM inodes WHERE inode = $1"
+	if err := src.QueryRowContext(ctx, q1, inode).Scan(&inline); err != nil {
+		return errors.Wrapf(err, "failed to read the inline data of inode %s", inode)
+	}
+	q2 := "UPDATE inodes SET inline_data = $2 WHERE inode = $1"
+	if _, err := dst.ExecContext(ctx, q2, inode, inline); err != nil {
+		return errors.Wrapf(err, "failed to write the inline data of inode %s", inode)
+	}
+	return nil
+}
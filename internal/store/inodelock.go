@@ -0,0 +1,80 @@
+package store
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// inodeLocks hands out one mutex per inode, shared by all the fileNodes of
+// that inode: the FUSE server may call handlers concurrently on the same
+// node, and hard links or repeated lookups give several nodes per inode.
+//
+// Ownership model: Inode, Name, Parent and SymlinkTarget never change once
+// a FileNode is returned to the FUSE server. All other attributes are
+// guarded by the lock of the inode, except that Mode may also be read
+// atomically through mode(). Handlers that update attributes hold the lock
+// until the update is written to the database, so that concurrent writes
+// to the same file are applied in order.
+type inodeLocks struct {
+	mu    sync.Mutex
+	locks map[uint64]*inodeLock
+}
+
+type inodeLock struct {
+	sync.Mutex
+	refs int // Number of holders and waiters.
+}
+
+func newInodeLocks() *inodeLocks {
+	return &inodeLocks{locks: make(map[uint64]*inodeLock)}
+}
+
+// Lock acquires the lock of `inode` and returns the function releasing it.
+// Locks are dropped from the table once nobody holds or waits for them.
+func (l *inodeLocks) Lock(inode uint64) (unlock func()) {
+	l.mu.Lock()
+	lock, ok := l.locks[inode]
+	if !ok {
+		lock = &inodeLock{}
+		l.locks[inode] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, inode)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// lock acquires the lock of the inode of `n`. Nodes that do not belong to a
+// mounted file system are not shared, and are not locked.
+func (n *FileNode) lock() (unlock func()) {
+	if n.fs == nil || n.fs.locks == nil {
+		return func() {}
+	}
+	return n.fs.locks.Lock(n.Inode)
+}
+
+// snapshot returns a copy of the attributes of `n`.
+func (n *FileNode) snapshot() FileNode {
+	unlock := n.lock()
+	defer unlock()
+	return *n
+}
+
+// mode returns the file mode of `n` without holding its lock.
+func (n *FileNode) mode() os.FileMode {
+	return os.FileMode(atomic.LoadUint32((*uint32)(&n.Mode)))
+}
+
+// setMode updates the file mode of `n`. The lock of `n` must be held.
+func (n *FileNode) setMode(mode os.FileMode) {
+	atomic.StoreUint32((*uint32)(&n.Mode), uint32(mode))
+}
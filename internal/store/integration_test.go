@@ -0,0 +1,235 @@
+//go:build integration
+// +build integration
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fs/fstestutil"
+	"github.com/pkg/errors"
+)
+
+// TestIntegration mounts a file system of a real database with fstestutil
+// and checks the common operations through the kernel, then checks what
+// they stored through the SQL layer. It is compiled in with
+// `go test -tags integration`, and needs SQLFS_TEST_DB (see openTestDB) and
+// a usable FUSE; scripts/integration.sh runs it against CockroachDB started
+// with Docker.
+func TestIntegration(t *testing.T) {
+	f, err := New(openTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := &integrationSuite{t: t, db: f.fs.db}
+	if err := f.fs.db.CheckWritableFormat(); err != nil {
+		t.Fatal(err)
+	}
+	conf := &fs.Config{Debug: f.fs.ops.debug, WithContext: f.fs.ops.withContext}
+	mnt, err := fstestutil.Mounted(f.fs, conf)
+	if err != nil {
+		t.Fatalf("failed to mount: %s", err)
+	}
+	s.dir = mnt.Dir
+	s.mounted()
+	mnt.Close()
+	s.stored()
+}
+
+type integrationSuite struct {
+	t   *testing.T
+	db  *DB
+	dir string // Where the file system is mounted.
+}
+
+// check fails the check `desc` if `err` is set.
+func (s *integrationSuite) check(desc string, err error) {
+	s.t.Helper()
+	if err != nil {
+		s.t.Errorf("%s: %s", desc, err)
+	}
+}
+
+// checkErrno checks that `err` wraps `want`.
+func (s *integrationSuite) checkErrno(desc string, err error, want syscall.Errno) {
+	s.t.Helper()
+	var got error
+	switch e := err.(type) {
+	case *os.PathError:
+		got = e.Err
+	case *os.LinkError:
+		got = e.Err
+	case *os.SyscallError:
+		got = e.Err
+	}
+	if got != want {
+		err = errors.Errorf("expected %s, got %v", want, err)
+	} else {
+		err = nil
+	}
+	s.check(desc, err)
+}
+
+// checkContents checks that the file at `path` holds `want`.
+func (s *integrationSuite) checkContents(desc, path string, want []byte) {
+	s.t.Helper()
+	got, err := ioutil.ReadFile(path)
+	if err == nil && !bytes.Equal(got, want) {
+		err = errors.Errorf("read %d bytes that differ from the %d expected", len(got), len(want))
+	}
+	s.check(desc, err)
+}
+
+// checkNlink checks the link count of `path`.
+func (s *integrationSuite) checkNlink(desc, path string, want uint64) {
+	s.t.Helper()
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if got := uint64(fi.Sys().(*syscall.Stat_t).Nlink); got != want {
+			err = errors.Errorf("expected %d links, got %d", want, got)
+		}
+	}
+	s.check(desc, err)
+}
+
+func (s *integrationSuite) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// mounted checks the operations through the mount.
+func (s *integrationSuite) mounted() {
+	p := s.path
+
+	// Create, read and write.
+	s.check("create", ioutil.WriteFile(p("file"), []byte("hello"), 0644))
+	s.checkContents("read", p("file"), []byte("hello"))
+	file, err := os.OpenFile(p("file"), os.O_RDWR, 0)
+	if err == nil {
+		_, err = file.WriteAt([]byte("J"), 0)
+		if err == nil {
+			_, err = file.WriteAt([]byte(" world"), 5)
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	s.check("overwrite and append", err)
+	s.checkContents("read after write", p("file"), []byte("Jello world"))
+	s.checkErrno("exclusive create of an existing file", openExcl(p("file")), syscall.EEXIST)
+
+	// Files spanning several blocks, written in one go and truncated.
+	big := make([]byte, 3*blockSize+17)
+	rand.Read(big)
+	s.check("write multiple blocks", ioutil.WriteFile(p("big"), big, 0644))
+	s.checkContents("read multiple blocks", p("big"), big)
+	s.check("truncate", os.Truncate(p("big"), blockSize+1))
+	s.checkContents("read after truncate", p("big"), big[:blockSize+1])
+	s.check("extend", os.Truncate(p("big"), 2*blockSize))
+	s.checkContents("read the hole after extend", p("big"),
+		append(append([]byte{}, big[:blockSize+1]...), make([]byte, blockSize-1)...))
+
+	// Directories.
+	s.check("mkdir", os.Mkdir(p("dir"), 0755))
+	s.check("nested mkdir", os.MkdirAll(p("dir/a/b"), 0755))
+	s.checkErrno("mkdir of an existing name", os.Mkdir(p("dir"), 0755), syscall.EEXIST)
+	s.checkErrno("rmdir of a non-empty directory", os.Remove(p("dir/a")), syscall.ENOTEMPTY)
+	s.checkNlink("link count of a directory", p("dir"), 3)
+
+	// Rename.
+	s.check("rename", os.Rename(p("file"), p("renamed")))
+	s.checkErrno("old name gone after rename", statErr(p("file")), syscall.ENOENT)
+	s.checkContents("read after rename", p("renamed"), []byte("Jello world"))
+	s.check("rename across directories", os.Rename(p("renamed"), p("dir/a/moved")))
+	s.check("create a file to replace", ioutil.WriteFile(p("victim"), []byte("old"), 0644))
+	s.check("rename over an existing file", os.Rename(p("dir/a/moved"), p("victim")))
+	s.checkContents("read the replacing file", p("victim"), []byte("Jello world"))
+	s.checkErrno("rename of a directory over a file", os.Rename(p("dir/a/b"), p("victim")), syscall.ENOTDIR)
+	s.check("rename of a directory", os.Rename(p("dir/a/b"), p("dir/b")))
+
+	// Hard links.
+	s.check("link", os.Link(p("victim"), p("dir/hard")))
+	s.checkNlink("link count after link", p("victim"), 2)
+	s.checkContents("read through the link", p("dir/hard"), []byte("Jello world"))
+	s.checkErrno("link of a directory", os.Link(p("dir"), p("dirlink")), syscall.EPERM)
+
+	// Symlinks.
+	s.check("symlink", os.Symlink("dir/hard", p("sym")))
+	target, err := os.Readlink(p("sym"))
+	if err == nil && target != "dir/hard" {
+		err = errors.Errorf("expected dir/hard, got %s", target)
+	}
+	s.check("readlink", err)
+	fi, err := os.Lstat(p("sym"))
+	if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		err = errors.Errorf("expected a symlink, got mode %s", fi.Mode())
+	}
+	s.check("lstat of a symlink", err)
+	s.checkContents("read through the symlink", p("sym"), []byte("Jello world"))
+
+	// Unlink.
+	s.check("unlink", os.Remove(p("dir/hard")))
+	s.checkErrno("unlinked name gone", statErr(p("dir/hard")), syscall.ENOENT)
+	s.checkNlink("link count after unlink", p("victim"), 1)
+	s.checkErrno("dangling symlink", statErr(p("sym")), syscall.ENOENT)
+	s.checkErrno("unlink of a missing name", os.Remove(p("missing")), syscall.ENOENT)
+	s.checkErrno("unlink of a directory", syscall.Unlink(p("dir")), syscall.EISDIR)
+
+	s.check("listing", fstestutil.CheckDir(s.dir, map[string]fstestutil.FileInfoCheck{
+		"big":    nil,
+		"dir":    nil,
+		"victim": nil,
+		"sym":    nil,
+	}))
+	s.check("listing of a subdirectory", fstestutil.CheckDir(p("dir"), map[string]fstestutil.FileInfoCheck{
+		"a": nil,
+		"b": nil,
+	}))
+}
+
+// stored checks through the SQL layer what the mount stored.
+func (s *integrationSuite) stored() {
+	ctx := context.Background()
+	n, err := ResolvePath(ctx, s.db, "/victim")
+	if err == nil {
+		var data []byte
+		if data, err = readData(ctx, s.db, n, 0, int(n.Size)); err == nil && string(data) != "Jello world" {
+			err = errors.Errorf("stored %q", data)
+		}
+	}
+	s.check("stored contents", err)
+	n, err = ResolvePath(ctx, s.db, "/big")
+	if err == nil && n.Size != uint64(2*blockSize) {
+		err = errors.Errorf("stored size %d", n.Size)
+	}
+	s.check("stored size", err)
+	_, err = ResolvePath(ctx, s.db, "/dir/hard")
+	if errors.Cause(err) != sql.ErrNoRows {
+		err = errors.Errorf("expected no entry, got %v", err)
+	} else {
+		err = nil
+	}
+	s.check("stored unlink", err)
+}
+
+func openExcl(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		f.Close()
+	}
+	return err
+}
+
+func statErr(path string) error {
+	_, err := os.Stat(path)
+	return err
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// TreeFS gives access to the tree stored in a database without mounting
+// it, e.g. to serve it with http.FileServer(http.FS(t)). It implements
+// io/fs.FS, ReadDirFS, ReadFileFS and StatFS, and the write methods of
+// os: WriteFile, Mkdir, MkdirAll, Remove and Rename.
+//
+// Contents of files moved to an object store by `sqlfs tier` are not
+// readable through a TreeFS. Writes fail with EROFS if the file system uses
+// features this binary can only read.
+type TreeFS struct {
+	db   *DB
+	root *FileNode
+	ctx  context.Context
+}
+
+var (
+	_ iofs.ReadDirFS  = (*TreeFS)(nil)
+	_ iofs.ReadFileFS = (*TreeFS)(nil)
+	_ iofs.StatFS     = (*TreeFS)(nil)
+)
+
+// NewTreeFS returns the tree stored in `db` from the directory `root` on.
+func NewTreeFS(db *sql.DB, root string) (*TreeFS, error) {
+	ctx := context.Background()
+	fsdb := NewDB(db)
+	if err := LoadFileSystem(ctx, fsdb); err != nil {
+		return nil, err
+	}
+	n, err := ResolvePath(ctx, fsdb, root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve %s", root)
+	}
+	if !n.IsDirectory() {
+		return nil, errors.Errorf("%s is not a directory", root)
+	}
+	return &TreeFS{db: fsdb, root: n, ctx: ctx}, nil
+}
+
+// WithContext returns a TreeFS whose queries use `ctx`.
+func (t *TreeFS) WithContext(ctx context.Context) *TreeFS {
+	c := *t
+	c.ctx = ctx
+	return &c
+}
+
+// pathError wraps the error of `op` on `name` as the os package does. The
+// errno of errors that have one is kept, so that errors.Is(err,
+// fs.ErrNotExist) and similar checks work.
+func pathError(op, name string, err error) error {
+	if errno := errnoOf(err); errno != syscall.EIO {
+		err = errno
+	}
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve returns the node at the slash-separated path `name`, which must
+// be valid as defined by fs.ValidPath.
+func (t *TreeFS) resolve(op, name string) (*FileNode, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	n := t.root
+	if name == "." {
+		return n, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		next, err := lookupNode(t.ctx, t.db, n, elem)
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// resolveParent returns the directory holding the entry at `name`.
+func (t *TreeFS) resolveParent(op, name string) (*FileNode, string, error) {
+	if !iofs.ValidPath(name) || name == "." {
+		return nil, "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	dir, err := t.resolve(op, path.Dir(name))
+	if err != nil {
+		return nil, "", err
+	}
+	return dir, path.Base(name), nil
+}
+
+// Open implements fs.FS.
+func (t *TreeFS) Open(name string) (iofs.File, error) {
+	n, err := t.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "." {
+		n = &FileNode{Inode: n.Inode, Name: ".", Mode: n.Mode, Mtime: n.Mtime}
+	}
+	return &treeFile{t: t, n: n}, nil
+}
+
+// Stat implements fs.StatFS.
+func (t *TreeFS) Stat(name string) (iofs.FileInfo, error) {
+	n, err := t.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return nodeFileInfo{n}, nil
+}
+
+// ReadDir implements fs.ReadDirFS. Entries are sorted by name.
+func (t *TreeFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	n, err := t.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDirectory() {
+		return nil, pathError("readdir", name, syscall.ENOTDIR)
+	}
+	nodes, err := ListNodesInDir(t.ctx, t.db, n.Inode)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	entries := make([]iofs.DirEntry, len(nodes))
+	for i, child := range nodes {
+		entries[i] = iofs.FileInfoToDirEntry(nodeFileInfo{child})
+	}
+	sortDirEntries(entries)
+	return entries, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (t *TreeFS) ReadFile(name string) ([]byte, error) {
+	n, err := t.resolve("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDirectory() {
+		return nil, pathError("read", name, syscall.EISDIR)
+	}
+	data, err := readData(t.ctx, t.db, n, 0, int(n.Size))
+	if err != nil {
+		return nil, pathError("read", name, err)
+	}
+	return data, nil
+}
+
+// WriteFile writes `data` to the file `name`, creating it with the
+// permissions `perm` if needed, as os.WriteFile does.
+func (t *TreeFS) WriteFile(name string, data []byte, perm iofs.FileMode) error {
+	if t.db.CheckWritableFormat() != nil {
+		return pathError("open", name, syscall.EROFS)
+	}
+	dir, base, err := t.resolveParent("open", name)
+	if err != nil {
+		return err
+	}
+	n, err := lookupNode(t.ctx, t.db, dir, base)
+	switch {
+	case err == syscall.ENOENT:
+		n, err = CreateNode(t.ctx, t.db, dir, base, perm.Perm(), uint32(os.Getuid()), uint32(os.Getgid()))
+	case err == nil && n.IsDirectory():
+		err = syscall.EISDIR
+	case err == nil:
+		err = setSize(t.ctx, t.db, n, 0)
+	}
+	if err == nil {
+		err = WriteData(t.ctx, t.db, n, 0, data)
+	}
+	if err != nil {
+		return pathError("open", name, err)
+	}
+	return nil
+}
+
+// Mkdir creates the directory `name`, as os.Mkdir does.
+func (t *TreeFS) Mkdir(name string, perm iofs.FileMode) error {
+	if t.db.CheckWritableFormat() != nil {
+		return pathError("mkdir", name, syscall.EROFS)
+	}
+	dir, base, err := t.resolveParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	mode := os.ModeDir | perm.Perm()
+	if _, err := CreateNode(t.ctx, t.db, dir, base, mode, uint32(os.Getuid()), uint32(os.Getgid())); err != nil {
+		return pathError("mkdir", name, err)
+	}
+	return nil
+}
+
+// MkdirAll creates the directory `name` and its missing parents, as
+// os.MkdirAll does.
+func (t *TreeFS) MkdirAll(name string, perm iofs.FileMode) error {
+	if !iofs.ValidPath(name) {
+		return &iofs.PathError{Op: "mkdir", Path: name, Err: iofs.ErrInvalid}
+	}
+	if name == "." {
+		return nil
+	}
+	if err := t.MkdirAll(path.Dir(name), perm); err != nil {
+		return err
+	}
+	err := t.Mkdir(name, perm)
+	if os.IsExist(err) {
+		if fi, statErr := t.Stat(name); statErr == nil && fi.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// Remove removes the file or empty directory `name`, as os.Remove does.
+func (t *TreeFS) Remove(name string) error {
+	if t.db.CheckWritableFormat() != nil {
+		return pathError("remove", name, syscall.EROFS)
+	}
+	dir, base, err := t.resolveParent("remove", name)
+	if err != nil {
+		return err
+	}
+	n, err := lookupNode(t.ctx, t.db, dir, base)
+	if err == nil {
+		err = removeNode(t.ctx, t.db, dir, base, n.IsDirectory())
+	}
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+// Rename moves `oldname` to `newname`, replacing it if it exists, as
+// os.Rename does.
+func (t *TreeFS) Rename(oldname, newname string) error {
+	if t.db.CheckWritableFormat() != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EROFS}
+	}
+	oldDir, oldBase, err := t.resolveParent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newDir, newBase, err := t.resolveParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	if err := renameNode(t.ctx, t.db, oldDir, oldBase, newDir, newBase, true); err != nil {
+		if errno := errnoOf(err); errno != syscall.EIO {
+			err = errno
+		}
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// treeFile is a file or directory opened with TreeFS.Open.
+type treeFile struct {
+	t      *TreeFS
+	n      *FileNode
+	offset int64
+	// Entries of a directory not returned by ReadDir yet, loaded on the
+	// first call.
+	entries []iofs.DirEntry
+	listed  bool
+}
+
+var (
+	_ iofs.ReadDirFile = (*treeFile)(nil)
+	_ io.ReaderAt      = (*treeFile)(nil)
+	_ io.Seeker        = (*treeFile)(nil)
+)
+
+func (f *treeFile) Stat() (iofs.FileInfo, error) { return nodeFileInfo{f.n}, nil }
+
+func (f *treeFile) Close() error { return nil }
+
+func (f *treeFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads from the blocks overlapping the requested range only.
+func (f *treeFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.n.IsDirectory() {
+		return 0, pathError("read", f.n.Name, syscall.EISDIR)
+	}
+	if off < 0 {
+		return 0, pathError("read", f.n.Name, syscall.EINVAL)
+	}
+	if uint64(off) >= f.n.Size {
+		return 0, io.EOF
+	}
+	data, err := readData(f.t.ctx, f.t.db, f.n, off, len(p))
+	if err != nil {
+		return 0, pathError("read", f.n.Name, err)
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *treeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.n.Size)
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.n.Name, syscall.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *treeFile) ReadDir(count int) ([]iofs.DirEntry, error) {
+	if !f.n.IsDirectory() {
+		return nil, pathError("readdir", f.n.Name, syscall.ENOTDIR)
+	}
+	if !f.listed {
+		nodes, err := ListNodesInDir(f.t.ctx, f.t.db, f.n.Inode)
+		if err != nil {
+			return nil, pathError("readdir", f.n.Name, err)
+		}
+		for _, child := range nodes {
+			f.entries = append(f.entries, iofs.FileInfoToDirEntry(nodeFileInfo{child}))
+		}
+		sortDirEntries(f.entries)
+		f.listed = true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func sortDirEntries(entries []iofs.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
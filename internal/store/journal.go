@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+// journalStatements creates the optional operations journal. It is only
+// created by `sqlfs init -journal`.
+var journalStatements = []string{
+	`CREATE TABLE IF NOT EXISTS ops_log (
+  id       INT DEFAULT unique_rowid(),
+  ts       TIMESTAMPTZ NOT NULL DEFAULT now(),
+  mount_id STRING NOT NULL,
+  uid      INT NOT NULL,
+  pid      INT NOT NULL,
+  op       STRING NOT NULL,
+  inode    INT NOT NULL,
+  parent   INT NOT NULL,
+  name     STRING NOT NULL,
+  args     JSONB,
+  PRIMARY KEY (id),
+  INDEX ts_idx (ts),
+  INDEX inode_idx (inode)
+)`,
+}
+
+// CreateJournal creates the table holding the operations journal.
+func CreateJournal(ctx context.Context, db *DB) error {
+	for _, q := range journalStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q", q)
+		}
+	}
+	return nil
+}
+
+// Journaled operations.
+const (
+	journalCreate  = "create"
+	journalLink    = "link"
+	journalUnlink  = "unlink"
+	journalRename  = "rename"
+	journalWrite   = "write"
+	journalSetattr = "setattr"
+)
+
+// JournalEntry is a mutating operation recorded in the ops_log table. The
+// entry `Name` in `Parent` is the one the operation went through, if any.
+// Args holds the parameters specific to the operation.
+type JournalEntry struct {
+	ID      int64                  `json:"id"`
+	Time    time.Time              `json:"ts"`
+	MountID string                 `json:"mount_id"`
+	Uid     uint32                 `json:"uid"`
+	Pid     uint32                 `json:"pid"`
+	Op      string                 `json:"op"`
+	Inode   uint64                 `json:"inode"`
+	Parent  uint64                 `json:"parent"`
+	Name    string                 `json:"name"`
+	Args    map[string]interface{} `json:"args,omitempty"`
+}
+
+// journal appends the mutating operations of a mount to the ops_log table,
+// for auditing and as a change log. Entries are written once the operation
+// succeeded, so an entry can be missing if the process dies in between.
+type journal struct {
+	db *DB
+	// Identifies the mount in the journal, as several mounts may share the
+	// database.
+	mountID string
+}
+
+func newJournal(db *DB) (*journal, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &journal{db: db, mountID: hex.EncodeToString(id)}, nil
+}
+
+// Append records `e`, done by the caller described by `hdr`.
+func (j *journal) Append(ctx context.Context, hdr *fuse.Header, e JournalEntry) error {
+	var args interface{}
+	if len(e.Args) > 0 {
+		data, err := json.Marshal(e.Args)
+		if err != nil {
+			return err
+		}
+		args = string(data)
+	}
+	q := `INSERT INTO ops_log (mount_id, uid, pid, op, inode, parent, name, args)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := j.db.ExecContext(ctx, q, j.mountID, hdr.Uid, hdr.Pid, e.Op, e.Inode, e.Parent, e.Name, args)
+	return errors.Wrapf(err, "failed to journal %s of inode %d", e.Op, e.Inode)
+}
+
+// record appends `e` to the journal if it is enabled. Failures are logged,
+// as the operation itself already succeeded.
+func (fs fileSystem) record(ctx context.Context, hdr *fuse.Header, e JournalEntry) {
+	if fs.journal == nil {
+		return
+	}
+	if err := fs.journal.Append(ctx, hdr, e); err != nil {
+		log.Println(err)
+	}
+}
+
+// ListJournal returns up to `limit` journal entries with an ID greater than
+// `after`, oldest first. With `last`, the most recent entries are returned
+// instead of the oldest ones.
+func ListJournal(ctx context.Context, db *DB, after int64, limit int, last bool) ([]JournalEntry, error) {
+	q := `SELECT id, ts, mount_id, uid, pid, op, inode, parent, name, COALESCE(args::STRING, '')
+  FROM ops_log WHERE id > $1 ORDER BY id LIMIT $2`
+	if last {
+		q = `SELECT * FROM (
+    SELECT id, ts, mount_id, uid, pid, op, inode, parent, name, COALESCE(args::STRING, '')
+    FROM ops_log WHERE id > $1 ORDER BY id DESC LIMIT $2
+  ) ORDER BY id`
+	}
+	rows, err := db.QueryContext(ctx, q, after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list journal entries")
+	}
+	defer rows.Close()
+
+	var entries []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		var args string
+		err := rows.Scan(&e.ID, &e.Time, &e.MountID, &e.Uid, &e.Pid, &e.Op, &e.Inode, &e.Parent, &e.Name, &args)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan journal entry")
+		}
+		if args != "" {
+			if err := json.Unmarshal([]byte(args), &e.Args); err != nil {
+				return nil, errors.Wrapf(err, "invalid arguments of journal entry %d", e.ID)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// setattrArgs returns the attributes changed by `req`, as journaled.
+func setattrArgs(req *fuse.SetattrRequest) map[string]interface{} {
+	args := make(map[string]interface{})
+	if req.Valid.Mode() {
+		args["mode"] = unixMode(req.Mode)
+	}
+	if req.Valid.Uid() {
+		args["uid"] = req.Uid
+	}
+	if req.Valid.Gid() {
+		args["gid"] = req.Gid
+	}
+	if req.Valid.Size() {
+		args["size"] = req.Size
+	}
+	if req.Valid.Atime() {
+		args["atime"] = req.Atime
+	}
+	if req.Valid.Mtime() {
+		args["mtime"] = req.Mtime
+	}
+	if req.Valid.Crtime() {
+		args["crtime"] = req.Crtime
+	}
+	if req.Valid.Flags() {
+		args["flags"] = req.Flags
+	}
+	return args
+}
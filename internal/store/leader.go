@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// leaderLease is the name of the lease held by the mount that runs the
+// background maintenance of the file system.
+const leaderLease = "leader"
+
+// leaderElection elects one of the mounts sharing a file system to run its
+// background maintenance, e.g. garbage collection, so that mounts do not
+// repeat each other's work or conflict. The leader holds a lease and renews
+// it; once it stops, e.g. because it was unmounted or hung, another mount
+// takes over within the lease TTL.
+type leaderElection struct {
+	leases *leaseManager
+	// Non-zero while this mount is the leader.
+	leading int32
+}
+
+func newLeaderElection(leases *leaseManager) *leaderElection {
+	return &leaderElection{leases: leases}
+}
+
+// Leading returns true if this mount is the leader.
+func (e *leaderElection) Leading() bool {
+	return atomic.LoadInt32(&e.leading) != 0
+}
+
+// run tries to become the leader now and whenever the lease may have been
+// freed, until ctx is canceled.
+func (e *leaderElection) run(ctx context.Context) {
+	ticker := time.NewTicker(e.leases.ttl / 3)
+	defer ticker.Stop()
+	for {
+		if !e.Leading() {
+			ok, err := e.leases.TryHold(ctx, leaderLease, func() {
+				atomic.StoreInt32(&e.leading, 0)
+				log.Println("This mount is no longer the leader, stopping background maintenance.")
+			})
+			if err != nil {
+				log.Println(err)
+			} else if ok {
+				atomic.StoreInt32(&e.leading, 1)
+				log.Println("This mount was elected leader, running background maintenance.")
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// GCResult reports what a garbage collection removed.
+type GCResult struct {
+	Inodes int   `json:"inodes"`
+	Blocks int64 `json:"blocks"`
+}
+
+// CollectGarbage removes inodes that no entry refers to and data blocks of
+// inodes that no longer exist. With `dryRun`, they are only counted.
+func CollectGarbage(ctx context.Context, db *DB, dryRun bool) (GCResult, error) {
+	var res GCResult
+	orphans, err := ListOrphanedInodes(ctx, db)
+	if err != nil {
+		return res, err
+	}
+	res.Inodes = len(orphans)
+	if dryRun {
+		count, err := CountOrphanedDataBlocks(ctx, db)
+		res.Blocks = int64(count)
+		return res, err
+	}
+
+	for _, inode := range orphans {
+		if err := RemoveInode(ctx, db, inode); err != nil {
+			return res, err
+		}
+	}
+	res.Blocks, err = RemoveOrphanedDataBlocks(ctx, db)
+	return res, err
+}
+
+// runBackgroundGC collects garbage every `interval` while this mount is the
+// leader, until ctx is canceled.
+func (fs fileSystem) runBackgroundGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if !fs.leader.Leading() || fs.readOnly() {
+			continue
+		}
+		res, err := CollectGarbage(ctx, fs.db, false)
+		fs.tasks.report("gc", err)
+		if err != nil {
+			log.Printf("background garbage collection failed: %s\n", err)
+			continue
+		}
+		if res.Inodes > 0 || res.Blocks > 0 {
+			log.Printf("Removed %d orphaned inode(s) and %d orphaned data block(s).\n", res.Inodes, res.Blocks)
+		}
+	}
+}
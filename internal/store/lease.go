@@ -0,0 +1,339 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// leaseManager takes leases stored in the leases table, so that mounts of
+// the same file system on several hosts take turns at something, e.g.
+// writing to a file. A lease is held by one mount until it expires, unless
+// the mount renews it: leases in use are renewed by a heartbeat, and the
+// others are released. The expiry is judged by the clock of the database,
+// so the clocks of the hosts do not need to agree.
+type leaseManager struct {
+	db *DB
+	// Identifies the mount in the leases table.
+	holder string
+	// How long a lease lasts without being renewed.
+	ttl time.Duration
+
+	mu   sync.Mutex
+	held map[string]*heldLease
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// heldLease is a lease held by this mount.
+type heldLease struct {
+	// Until when the lease is surely still held, going by the local clock.
+	valid time.Time
+	// Whether the lease was used since the last heartbeat.
+	used bool
+	// Whether the lease is renewed until the mount is closed, used or not.
+	pinned bool
+	// Called if a pinned lease is lost, nil if nothing needs to be done.
+	lost func()
+}
+
+// newLeaseManager starts renewing the leases taken by this mount every
+// third of `ttl`.
+func newLeaseManager(ctx context.Context, db *DB, ttl time.Duration) (*leaseManager, error) {
+	exists, err := TableExists(ctx, db, "leases")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("the leases table is missing, run `sqlfs init` to create it")
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	m := &leaseManager{
+		db:     db,
+		holder: fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(id)),
+		ttl:    ttl,
+		held:   make(map[string]*heldLease),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go m.heartbeat()
+	return m, nil
+}
+
+// exclusiveLease is the name of the lease held by a mount started with
+// -exclusive, the only one that may write to the file system.
+const exclusiveLease = "exclusive"
+
+// inodeLease is the name of the lease on writing to `inode`.
+func inodeLease(inode uint64) string {
+	return fmt.Sprintf("inode/%d", inode)
+}
+
+// Hold takes the lease `name` for as long as the mount lives, without
+// waiting if another mount holds it. `lost` is called if the lease cannot
+// be renewed in time.
+func (m *leaseManager) Hold(ctx context.Context, name string, lost func()) error {
+	ok, err := m.TryHold(ctx, name, lost)
+	if err != nil || ok {
+		return err
+	}
+	holder, expires, err := leaseHolder(ctx, m.db, name)
+	if err != nil {
+		return err
+	}
+	return errors.Errorf("lease %s is held by %s until %s", name, holder, expires.Format(time.RFC3339))
+}
+
+// TryHold is Hold, but returns false instead of an error if another mount
+// holds the lease.
+func (m *leaseManager) TryHold(ctx context.Context, name string, lost func()) (bool, error) {
+	ok, err := m.take(ctx, name)
+	if err != nil || !ok {
+		return false, err
+	}
+	m.mu.Lock()
+	if l, ok := m.held[name]; ok {
+		l.pinned = true
+		l.lost = lost
+	}
+	m.mu.Unlock()
+	return true, nil
+}
+
+// leaseHolder returns the mount holding the lease `name` and when the lease
+// expires, or an empty holder if the lease is free.
+func leaseHolder(ctx context.Context, db *DB, name string) (string, time.Time, error) {
+	var holder string
+	var expires time.Time
+	q := "SELECT holder, expires FROM leases WHERE name = $1 AND expires >= now()"
+	err := db.QueryRowContext(ctx, q, name).Scan(&holder, &expires)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "failed to read lease %s", name)
+	}
+	return holder, expires, nil
+}
+
+// checkNotExclusive fails if a mount started with -exclusive holds the file
+// system, before another mount writes to it. Databases created before leases
+// were added cannot have such mounts.
+func checkNotExclusive(ctx context.Context, db *DB) error {
+	exists, err := TableExists(ctx, db, "leases")
+	if err != nil || !exists {
+		return err
+	}
+	holder, expires, err := leaseHolder(ctx, db, exclusiveLease)
+	if err != nil || holder == "" {
+		return err
+	}
+	return errors.Errorf("the file system is mounted with -exclusive by %s (lease held until %s)",
+		holder, expires.Format(time.RFC3339))
+}
+
+// Acquire takes the lease `name`, waiting for another mount to release it
+// or for its lease to expire, until ctx is done or for up to twice the TTL.
+// It returns true unless the lease was surely held by this mount all along:
+// another mount may then have changed what the lease guards.
+func (m *leaseManager) Acquire(ctx context.Context, name string) (bool, error) {
+	m.mu.Lock()
+	if l, ok := m.held[name]; ok && time.Now().Before(l.valid) {
+		l.used = true
+		m.mu.Unlock()
+		return false, nil
+	}
+	m.mu.Unlock()
+
+	deadline := time.Now().Add(2 * m.ttl)
+	for {
+		ok, err := m.take(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, m.heldError(name)
+		}
+		select {
+		case <-time.After(m.ttl / 10):
+		case <-ctx.Done():
+			return false, m.heldError(name)
+		}
+	}
+}
+
+// take takes or renews the lease `name` if it is free, expired or already
+// held by this mount, and returns false if another mount holds it.
+func (m *leaseManager) take(ctx context.Context, name string) (bool, error) {
+	start := time.Now()
+	q := `INSERT INTO leases (name, holder, expires) VALUES ($1, $2, now() + $3 * INTERVAL '1 millisecond')
+  ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires = excluded.expires
+  WHERE leases.holder = excluded.holder OR leases.expires < now()
+  RETURNING holder`
+	var holder string
+	err := m.db.QueryRowContext(ctx, q, name, m.holder, m.ttl.Nanoseconds()/1e6).Scan(&holder)
+	if err == sql.ErrNoRows {
+		m.mu.Lock()
+		delete(m.held, name)
+		m.mu.Unlock()
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to take lease %s", name)
+	}
+	m.mu.Lock()
+	// The lease may have been granted as late as the statement returned,
+	// but surely not before it started.
+	m.held[name] = &heldLease{valid: start.Add(m.ttl), used: true}
+	m.mu.Unlock()
+	return true, nil
+}
+
+// heldError describes who holds the lease `name` that could not be taken.
+func (m *leaseManager) heldError(name string) error {
+	holder, expires, err := leaseHolder(context.Background(), m.db, name)
+	if err != nil || holder == "" {
+		return errors.Errorf("timed out waiting for lease %s", name)
+	}
+	return errors.Errorf("timed out waiting for lease %s, held by %s until %s", name, holder, expires.Format(time.RFC3339))
+}
+
+// heartbeat renews the leases used since the previous heartbeat, and
+// releases the others, until Close is called.
+func (m *leaseManager) heartbeat() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+		var renew, release []string
+		lost := make(map[string]func())
+		m.mu.Lock()
+		for name, l := range m.held {
+			if l.lost != nil {
+				lost[name] = l.lost
+			}
+			if l.used || l.pinned {
+				renew = append(renew, name)
+			} else {
+				release = append(release, name)
+				delete(m.held, name)
+			}
+			l.used = false
+		}
+		m.mu.Unlock()
+
+		for _, name := range release {
+			q := "DELETE FROM leases WHERE name = $1 AND holder = $2"
+			if _, err := m.db.Exec(q, name, m.holder); err != nil {
+				log.Printf("failed to release lease %s: %s\n", name, err)
+			}
+		}
+		for _, name := range renew {
+			ok, err := m.renew(name)
+			if err != nil {
+				log.Println(err)
+				// Retried at the next heartbeat, while the lease lasts.
+				if ok = !m.expired(name); ok {
+					continue
+				}
+			}
+			if !ok {
+				log.Printf("Lost lease %s, it expired before it could be renewed.\n", name)
+				if f := lost[name]; f != nil {
+					f()
+				}
+			}
+		}
+	}
+}
+
+// renew extends the lease `name` held by this mount, and returns false if
+// it was lost.
+func (m *leaseManager) renew(name string) (bool, error) {
+	start := time.Now()
+	q := `UPDATE leases SET expires = now() + $3 * INTERVAL '1 millisecond'
+  WHERE name = $1 AND holder = $2 AND expires >= now()`
+	res, err := m.db.Exec(q, name, m.holder, m.ttl.Nanoseconds()/1e6)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to renew lease %s", name)
+	}
+	renewed, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to renew lease %s", name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.held[name]
+	if !ok {
+		return renewed > 0, nil
+	}
+	if renewed == 0 {
+		delete(m.held, name)
+		return false, nil
+	}
+	l.valid = start.Add(m.ttl)
+	return true, nil
+}
+
+// expired forgets the lease `name` and returns true if it may have expired,
+// going by the local clock.
+func (m *leaseManager) expired(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.held[name]; ok && time.Now().Before(l.valid) {
+		return false
+	}
+	delete(m.held, name)
+	return true
+}
+
+// Close stops renewing leases and releases those held by this mount.
+func (m *leaseManager) Close() {
+	close(m.stop)
+	<-m.done
+	q := "DELETE FROM leases WHERE holder = $1"
+	if _, err := m.db.Exec(q, m.holder); err != nil {
+		log.Printf("failed to release leases: %s\n", err)
+	}
+}
+
+// leaseInode takes the write lease on `n` if writes are serialized across
+// mounts. If another mount held the lease before, the contents of `n` it
+// wrote are picked up so that they are not overwritten with stale ones. The
+// caller must hold the lock of `n`.
+func (fs fileSystem) leaseInode(ctx context.Context, n *FileNode) error {
+	if fs.leases == nil {
+		return nil
+	}
+	fresh, err := fs.leases.Acquire(ctx, inodeLease(n.Inode))
+	if err != nil || !fresh {
+		return err
+	}
+	updated, err := GetNodeByID(ctx, fs.db, n.Inode)
+	if err != nil {
+		return err
+	}
+	n.syncGeneration(updated)
+	return nil
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// maintenanceMode makes a live mount read-only, so that operators can
+// quiesce writes before schema migrations or backups without unmounting.
+// It is entered either for one mount through the admin API, or for every
+// mount through the read_only setting, which mounts poll.
+type maintenanceMode struct {
+	// Non-zero if set through the admin API.
+	local int32
+	// Non-zero if set in the database.
+	shared int32
+}
+
+// enabled returns true if mutating operations must fail with EROFS.
+func (m *maintenanceMode) enabled() bool {
+	return atomic.LoadInt32(&m.local) != 0 || atomic.LoadInt32(&m.shared) != 0
+}
+
+// set enters or leaves the maintenance mode of this mount. It returns true
+// if the mount was not read-only before.
+func (m *maintenanceMode) set(enabled bool) bool {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	was := m.enabled()
+	atomic.StoreInt32(&m.local, v)
+	return !was && enabled
+}
+
+// poll applies the read_only setting of `db` every `interval`, until ctx is
+// canceled. `quiesce` is called when the setting makes the mount read-only.
+// The outcome of each poll is reported to `tasks`.
+func (m *maintenanceMode) poll(ctx context.Context, db *DB, interval time.Duration, tasks *backgroundTasks, quiesce func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		value, err := GetSetting(ctx, db, SettingReadOnly)
+		tasks.report("maintenance_poll", err)
+		if err != nil {
+			log.Printf("failed to read the %s setting: %s\n", SettingReadOnly, err)
+			continue
+		}
+		var v int32
+		if value == "true" {
+			v = 1
+		}
+		if atomic.SwapInt32(&m.shared, v) == v {
+			continue
+		}
+		if v != 0 {
+			log.Println("The file system was put in maintenance mode, refusing writes.")
+			quiesce()
+		} else {
+			log.Println("The file system left maintenance mode, accepting writes again.")
+		}
+	}
+}
+
+// checkWritable fails with EROFS while the mount is in maintenance mode.
+func (fs fileSystem) checkWritable() error {
+	if fs.readOnly() {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
+
+// readOnly returns true while the mount is in maintenance mode.
+func (fs fileSystem) readOnly() bool {
+	return fs.maintenance != nil && fs.maintenance.enabled()
+}
+
+// quiesce waits up to `timeout` for the operations in flight, which may
+// have started writing before the mount became read-only, and writes the
+// pending updates to the database.
+func (fs fileSystem) quiesce(timeout time.Duration) {
+	if fs.ops != nil {
+		if n := fs.ops.Wait(timeout); n > 0 {
+			log.Printf("%d operations still in flight after %s\n", n, timeout)
+		}
+	}
+	fs.flush()
+}
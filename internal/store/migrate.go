@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// legacyInode is the JSON encoding of inode metadata stored in the
+// inodes.struct_data column by older versions.
+type legacyInode struct {
+	Size          uint64
+	Atime         time.Time
+	Mtime         time.Time
+	Ctime         time.Time
+	Crtime        time.Time
+	Mode          os.FileMode
+	Nlink         uint32
+	Uid           uint32
+	Gid           uint32
+	Rdev          uint32
+	Flags         uint32
+	SymlinkTarget string
+}
+
+// legacyColumns are added to the inodes table by the migration. They must
+// match the definition of the inodes table in schemaStatements.
+var legacyColumns = []string{
+	"size INT NOT NULL DEFAULT 0",
+	"atime TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01'",
+	"mtime TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01'",
+	"ctime TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01'",
+	"crtime TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01'",
+	"mode INT NOT NULL DEFAULT 0",
+	"nlink INT NOT NULL DEFAULT 0",
+	"uid INT NOT NULL DEFAULT 0",
+	"gid INT NOT NULL DEFAULT 0",
+	"rdev INT NOT NULL DEFAULT 0",
+	"flags INT NOT NULL DEFAULT 0",
+	"symlink_target STRING NOT NULL DEFAULT ''",
+	"generation INT NOT NULL DEFAULT 0",
+}
+
+// Number of inodes converted per transaction.
+const migrateBatchSize = 500
+
+// MigrateLegacyInodes converts inodes stored as JSON in struct_data into
+// typed columns, and drops the struct_data column once every inode has been
+// converted. It can safely be resumed if interrupted. It returns the number
+// of inodes converted.
+func MigrateLegacyInodes(ctx context.Context, db *DB) (int, error) {
+	for _, col := range legacyColumns {
+		q := "ALTER TABLE inodes ADD COLUMN IF NOT EXISTS " + col
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return 0, errors.Wrapf(err, "failed to add column %q", col)
+		}
+	}
+
+	total := 0
+	for {
+		converted, err := migrateLegacyBatch(ctx, db)
+		if err != nil {
+			return total, err
+		}
+		total += converted
+		if converted < migrateBatchSize {
+			break
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE inodes DROP COLUMN struct_data"); err != nil {
+		return total, errors.Wrap(err, "failed to drop column struct_data")
+	}
+	return total, nil
+}
+
+// decodeLegacyInode decodes the struct_data of `inode`. The column comes
+// from the database and may hold anything, so malformed contents are
+// reported as errors.
+func decodeLegacyInode(inode uint64, structData []byte) (*FileNode, error) {
+	var legacy legacyInode
+	if err := json.Unmarshal(structData, &legacy); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshall inode %d struct", inode)
+	}
+	if legacy.Size > math.MaxInt64 {
+		return nil, errors.Errorf("invalid size %d of inode %d", legacy.Size, inode)
+	}
+	return &FileNode{
+		Inode:         inode,
+		Size:          legacy.Size,
+		Atime:         legacy.Atime,
+		Mtime:         legacy.Mtime,
+		Ctime:         legacy.Ctime,
+		Crtime:        legacy.Crtime,
+		Mode:          legacy.Mode,
+		Nlink:         legacy.Nlink,
+		Uid:           legacy.Uid,
+		Gid:           legacy.Gid,
+		Rdev:          legacy.Rdev,
+		Flags:         legacy.Flags,
+		SymlinkTarget: legacy.SymlinkTarget,
+	}, nil
+}
+
+func migrateLegacyBatch(ctx context.Context, db *DB) (int, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return 0, err
+	}
+
+	q1 := "SELECT inode, struct_data FROM inodes WHERE struct_data IS NOT NULL LIMIT $1"
+	rows, err := tx.QueryContext(ctx, q1, migrateBatchSize)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	var nodes []*FileNode
+	for rows.Next() {
+		var inode uint64
+		var structData string
+		if err := rows.Scan(&inode, &structData); err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return 0, err
+		}
+		n, err := decodeLegacyInode(inode, []byte(structData))
+		if err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return 0, err
+		}
+		nodes = append(nodes, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	for _, n := range nodes {
+		if err := putInode(ctx, tx, n); err != nil {
+			_ = tx.Rollback()
+			return 0, errors.Wrapf(err, "failed to convert inode %d", n.Inode)
+		}
+		q2 := "UPDATE inodes SET struct_data = NULL WHERE inode = $1"
+		if _, err := tx.ExecContext(ctx, q2, n.Inode); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(nodes), tx.Commit()
+}
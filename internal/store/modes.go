@@ -0,0 +1,52 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// modeBits are the bits of an os.FileMode set by chmod(2).
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// PermFlag is an octal permission flag, such as 0644, implementing
+// flag.Value.
+type PermFlag struct {
+	mode os.FileMode
+	set  bool
+}
+
+func (p *PermFlag) String() string {
+	if p == nil || !p.set {
+		return ""
+	}
+	return fmt.Sprintf("%04o", unixMode(p.mode)&07777)
+}
+
+func (p *PermFlag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 07777 {
+		return fmt.Errorf("invalid mode %q, expected octal permissions such as 0644", s)
+	}
+	p.mode, p.set = fileModeFromUnix(uint32(v)), true
+	return nil
+}
+
+// Value returns the mode of the flag, and whether it was set.
+func (p *PermFlag) Value() (os.FileMode, bool) {
+	return p.mode, p.set
+}
+
+// newMode returns the mode to store for a node created with `mode`: the
+// permissions are replaced by the default of its type if one is set, and
+// the bits of the mount's umask are cleared.
+func (fs *fileSystem) newMode(mode os.FileMode) os.FileMode {
+	def := fs.fileMode
+	if mode.IsDir() {
+		def = fs.dirMode
+	}
+	if def.set {
+		mode = mode&^modeBits | def.mode
+	}
+	return mode &^ fs.umask.mode
+}
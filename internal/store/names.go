@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"log"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Default limits on names and paths, as NAME_MAX and PATH_MAX on Linux.
+const (
+	DefaultMaxNameLen = 255
+	DefaultMaxPathLen = 4096
+)
+
+// SetWindowsNames restricts new names to the ones that Windows accepts.
+// Existing names are not checked.
+func SetWindowsNames(ctx context.Context, db *DB) error {
+	return PutSetting(ctx, db, settingWindowsNames, "true")
+}
+
+// validName returns EINVAL if `name` cannot be the name of an entry: it is
+// empty, "." or "..", or contains a slash or a NUL byte. It is checked by
+// every function that stores names, whatever the protocol used.
+func (s *settings) validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return syscall.EINVAL
+	}
+	if s.windowsNames && !validWindowsName(name) {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// validWindowsName returns false if `name` contains a character reserved
+// by Windows, ends with a dot or a space, or is a reserved device name such
+// as CON or COM1, with or without an extension.
+func validWindowsName(name string) bool {
+	if strings.ContainsAny(name, `<>:"\|?*`) {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 {
+			return false
+		}
+	}
+	if last := name[len(name)-1]; last == '.' || last == ' ' {
+		return false
+	}
+	base := strings.ToUpper(name)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	base = strings.TrimRight(base, " ")
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return false
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) &&
+		base[3] >= '1' && base[3] <= '9' {
+		return false
+	}
+	return true
+}
+
+// checkName returns EINVAL if `name` is not a valid name, EPERM if it is the
+// status or snapshots directory or the query file, and ENAMETOOLONG if the
+// entry `name` of the directory `parent` would exceed the name or path
+// length limits of the mount. Both are counted in bytes. Paths are only
+// checked if a limit is set, as it takes a query to find the path of
+// `parent`.
+func (fs fileSystem) checkName(ctx context.Context, parent uint64, name string) error {
+	if fs.noAppleDouble && isAppleDouble(name) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	if fs.isStatusDir(parent, name) || fs.isSnapshotsDir(parent, name) || fs.isQueryFile(parent, name) {
+		return fuse.EPERM
+	}
+	if err := fs.db.validName(name); err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if fs.maxNameLen > 0 && len(name) > fs.maxNameLen {
+		return fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	if fs.maxPathLen <= 0 {
+		return nil
+	}
+	dir, err := NodePath(ctx, fs.db, parent)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	// The path includes the separator and the terminating NUL.
+	if len(dir)+1+len(name)+1 > fs.maxPathLen {
+		return fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		valid   bool // Without -windows-names.
+		windows bool // With -windows-names.
+	}{
+		{"readme.txt", true, true},
+		{".hidden", true, true},
+		{"...", true, false},
+		{"", false, false},
+		{".", false, false},
+		{"..", false, false},
+		{"a/b", false, false},
+		{"a\x00b", false, false},
+		{"a:b", true, false},
+		{"what?", true, false},
+		{`a\b`, true, false},
+		{"tab\there", true, false},
+		{"trailing ", true, false},
+		{"trailing.", true, false},
+		{"CON", true, false},
+		{"con.txt", true, false},
+		{"Aux .tar.gz", true, false},
+		{"COM1", true, false},
+		{"lpt9.log", true, false},
+		{"COM0", true, true},
+		{"COM10", true, true},
+		{"CONSOLE", true, true},
+		{"nul-device", true, true},
+	} {
+		for _, windows := range []bool{false, true} {
+			want := tc.valid
+			if windows {
+				want = tc.windows
+			}
+			err := (&settings{windowsNames: windows}).validName(tc.name)
+			if (err == nil) != want {
+				t.Errorf("validName(%q) with windows names %t returned %v", tc.name, windows, err)
+			}
+			if err != nil && err != syscall.EINVAL {
+				t.Errorf("validName(%q) returned %v, want EINVAL", tc.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,1133 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NFS version 3 (RFC 1813) and its MOUNT protocol, served over ONC RPC
+// (RFC 5531) on TCP. There is no portmapper, so clients must be given the
+// port of both services, which is the same, and must not use NLM locking:
+//
+//   mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,nolock host:/ /mnt
+//
+// File handles are the 8-byte inode number, so they stay valid across
+// restarts of the server.
+
+// ONC RPC.
+const (
+	rpcCall  = 0
+	rpcReply = 1
+
+	rpcMsgAccepted = 0
+
+	rpcSuccess      = 0
+	rpcProgUnavail  = 1
+	rpcProgMismatch = 2
+	rpcProcUnavail  = 3
+	rpcGarbageArgs  = 4
+
+	rpcAuthNone = 0
+	rpcAuthUnix = 1
+
+	// Largest RPC record accepted from clients.
+	rpcMaxRecord = 1 << 20
+)
+
+// Program numbers.
+const (
+	nfsProgram   = 100003
+	mountProgram = 100005
+)
+
+// MOUNT procedures.
+const (
+	mountProcNull    = 0
+	mountProcMnt     = 1
+	mountProcDump    = 2
+	mountProcUmnt    = 3
+	mountProcUmntAll = 4
+	mountProcExport  = 5
+)
+
+// NFS procedures.
+const (
+	nfsProcNull        = 0
+	nfsProcGetattr     = 1
+	nfsProcSetattr     = 2
+	nfsProcLookup      = 3
+	nfsProcAccess      = 4
+	nfsProcReadlink    = 5
+	nfsProcRead        = 6
+	nfsProcWrite       = 7
+	nfsProcCreate      = 8
+	nfsProcMkdir       = 9
+	nfsProcSymlink     = 10
+	nfsProcMknod       = 11
+	nfsProcRemove      = 12
+	nfsProcRmdir       = 13
+	nfsProcRename      = 14
+	nfsProcLink        = 15
+	nfsProcReaddir     = 16
+	nfsProcReaddirplus = 17
+	nfsProcFsstat      = 18
+	nfsProcFsinfo      = 19
+	nfsProcPathconf    = 20
+	nfsProcCommit      = 21
+)
+
+// nfsstat3 values.
+const (
+	nfs3OK             = 0
+	nfs3ErrPerm        = 1
+	nfs3ErrNoEnt       = 2
+	nfs3ErrIO          = 5
+	nfs3ErrAcces       = 13
+	nfs3ErrExist       = 17
+	nfs3ErrXDev        = 18
+	nfs3ErrNotDir      = 20
+	nfs3ErrIsDir       = 21
+	nfs3ErrInval       = 22
+	nfs3ErrFBig        = 27
+	nfs3ErrNoSpc       = 28
+	nfs3ErrROFS        = 30
+	nfs3ErrMLink       = 31
+	nfs3ErrNameTooLong = 63
+	nfs3ErrNotEmpty    = 66
+	nfs3ErrDQuot       = 69
+	nfs3ErrStale       = 70
+	nfs3ErrBadHandle   = 10001
+	nfs3ErrNotSync     = 10002
+	nfs3ErrNotSupp     = 10004
+	nfs3ErrTooSmall    = 10005
+	nfs3ErrServerFault = 10006
+	nfs3ErrBadType     = 10007
+)
+
+// nfsErrors maps errors of the storage layer to nfsstat3 values.
+var nfsErrors = map[syscall.Errno]uint32{
+	syscall.EPERM:        nfs3ErrPerm,
+	syscall.ENOENT:       nfs3ErrNoEnt,
+	syscall.EIO:          nfs3ErrIO,
+	syscall.EACCES:       nfs3ErrAcces,
+	syscall.EEXIST:       nfs3ErrExist,
+	syscall.EXDEV:        nfs3ErrXDev,
+	syscall.ENOTDIR:      nfs3ErrNotDir,
+	syscall.EISDIR:       nfs3ErrIsDir,
+	syscall.EINVAL:       nfs3ErrInval,
+	syscall.EFBIG:        nfs3ErrFBig,
+	syscall.ENOSPC:       nfs3ErrNoSpc,
+	syscall.EROFS:        nfs3ErrROFS,
+	syscall.EMLINK:       nfs3ErrMLink,
+	syscall.ENAMETOOLONG: nfs3ErrNameTooLong,
+	syscall.ENOTEMPTY:    nfs3ErrNotEmpty,
+	syscall.EDQUOT:       nfs3ErrDQuot,
+	syscall.ESTALE:       nfs3ErrStale,
+	syscall.ENOTSUP:      nfs3ErrNotSupp,
+}
+
+// ftype3 values.
+const (
+	nf3Reg  = 1
+	nf3Dir  = 2
+	nf3Blk  = 3
+	nf3Chr  = 4
+	nf3Lnk  = 5
+	nf3Sock = 6
+	nf3FIFO = 7
+)
+
+// ACCESS bits.
+const (
+	access3Read    = 0x1
+	access3Lookup  = 0x2
+	access3Modify  = 0x4
+	access3Extend  = 0x8
+	access3Delete  = 0x10
+	access3Execute = 0x20
+)
+
+const (
+	// Largest read or write served at once.
+	nfsMaxData = 64 * 1024
+
+	// Length of file handles, which hold an inode number.
+	nfsHandleSize = 8
+
+	// Value of stable_how for writes that reached the database.
+	nfsFileSync = 2
+
+	// Largest file name accepted.
+	nfsMaxName = 255
+
+	// Largest path accepted for MNT and SYMLINK.
+	nfsMaxPath = 1024
+
+	// The database has no fixed capacity, so this is reported as free.
+	nfsFreeBytes = 1 << 50
+	nfsFreeFiles = 1 << 32
+)
+
+// nfsServer serves NFS version 3 over TCP.
+type nfsServer struct {
+	db       *DB
+	root     *FileNode
+	rootPath string // Path of the exported directory in the tree.
+
+	// Write verifier, which changes when the server restarts.
+	verifier [8]byte
+}
+
+// rpcCallHeader holds the fields of an RPC call needed by the procedures.
+type rpcCallHeader struct {
+	xid              uint32
+	prog, vers, proc uint32
+	uid, gid         uint32 // From AUTH_UNIX credentials, 0 otherwise.
+}
+
+func NewNFSServer(db *DB, root *FileNode, rootPath string) *nfsServer {
+	s := &nfsServer{db: db, root: root, rootPath: rootPath}
+	binary.BigEndian.PutUint64(s.verifier[:], uint64(time.Now().UnixNano()))
+	return s
+}
+
+// Serve accepts connections on `l` until it is closed.
+func (s *nfsServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn handles the requests of a single client connection in order.
+func (s *nfsServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		record, err := readRecord(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("nfs: %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		reply := s.handleCall(record)
+		if reply == nil {
+			continue
+		}
+		if err := writeRecord(conn, reply); err != nil {
+			log.Printf("nfs: %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// readRecord reads a record made of one or more fragments, as framed by the
+// record marking standard of RPC over TCP.
+func readRecord(r io.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		marker := binary.BigEndian.Uint32(header[:])
+		size := marker &^ (1 << 31)
+		if len(record)+int(size) > rpcMaxRecord {
+			return nil, errors.Errorf("RPC record larger than %d bytes", rpcMaxRecord)
+		}
+		start := len(record)
+		record = append(record, make([]byte, size)...)
+		if _, err := io.ReadFull(r, record[start:]); err != nil {
+			return nil, err
+		}
+		if marker&(1<<31) != 0 {
+			return record, nil
+		}
+	}
+}
+
+func writeRecord(w io.Writer, record []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(record))|1<<31)
+	_, err := w.Write(append(header[:], record...))
+	return err
+}
+
+// handleCall processes a single RPC call and returns the reply, or nil if
+// the message is not a valid call.
+func (s *nfsServer) handleCall(record []byte) []byte {
+	r := &xdrReader{b: record}
+	var c rpcCallHeader
+	c.xid = r.uint32()
+	if r.uint32() != rpcCall || r.uint32() != 2 {
+		return nil
+	}
+	c.prog, c.vers, c.proc = r.uint32(), r.uint32(), r.uint32()
+	credFlavor := r.uint32()
+	cred := &xdrReader{b: r.opaque(400)}
+	r.uint32()    // Verifier flavor.
+	r.opaque(400) // Verifier body.
+	if r.err != nil {
+		return nil
+	}
+	if credFlavor == rpcAuthUnix {
+		cred.uint32()    // Stamp.
+		cred.string(255) // Machine name.
+		c.uid, c.gid = cred.uint32(), cred.uint32()
+	}
+
+	w := &xdrWriter{}
+	w.uint32(c.xid)
+	w.uint32(rpcReply)
+	w.uint32(rpcMsgAccepted)
+	w.uint32(rpcAuthNone)
+	w.uint32(0) // Empty verifier.
+	header := len(w.b)
+
+	var handler func(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter)
+	switch c.prog {
+	case mountProgram:
+		handler = s.mountProcs()[c.proc]
+	case nfsProgram:
+		handler = s.nfsProcs()[c.proc]
+	default:
+		w.uint32(rpcProgUnavail)
+		return w.b
+	}
+	if c.vers != 3 {
+		w.uint32(rpcProgMismatch)
+		w.uint32(3)
+		w.uint32(3)
+		return w.b
+	}
+	if handler == nil {
+		w.uint32(rpcProcUnavail)
+		return w.b
+	}
+	w.uint32(rpcSuccess)
+	handler(context.Background(), &c, r, w)
+	if r.err != nil {
+		w.b = w.b[:header]
+		w.uint32(rpcGarbageArgs)
+	}
+	return w.b
+}
+
+func (s *nfsServer) mountProcs() map[uint32]func(context.Context, *rpcCallHeader, *xdrReader, *xdrWriter) {
+	return map[uint32]func(context.Context, *rpcCallHeader, *xdrReader, *xdrWriter){
+		mountProcNull:    func(context.Context, *rpcCallHeader, *xdrReader, *xdrWriter) {},
+		mountProcMnt:     s.mnt,
+		mountProcDump:    func(_ context.Context, _ *rpcCallHeader, _ *xdrReader, w *xdrWriter) { w.bool(false) },
+		mountProcUmnt:    func(_ context.Context, _ *rpcCallHeader, r *xdrReader, _ *xdrWriter) { r.string(nfsMaxPath) },
+		mountProcUmntAll: func(context.Context, *rpcCallHeader, *xdrReader, *xdrWriter) {},
+		mountProcExport:  s.export,
+	}
+}
+
+func (s *nfsServer) nfsProcs() map[uint32]func(context.Context, *rpcCallHeader, *xdrReader, *xdrWriter) {
+	return map[uint32]func(context.Context, *rpcCallHeader, *xdrReader, *xdrWriter){
+		nfsProcNull:        func(context.Context, *rpcCallHeader, *xdrReader, *xdrWriter) {},
+		nfsProcGetattr:     s.getattr,
+		nfsProcSetattr:     s.setattr,
+		nfsProcLookup:      s.lookup,
+		nfsProcAccess:      s.access,
+		nfsProcReadlink:    s.readlink,
+		nfsProcRead:        s.read,
+		nfsProcWrite:       s.write,
+		nfsProcCreate:      s.create,
+		nfsProcMkdir:       s.mkdir,
+		nfsProcSymlink:     s.symlink,
+		nfsProcMknod:       s.mknod,
+		nfsProcRemove:      s.remove,
+		nfsProcRmdir:       s.rmdir,
+		nfsProcRename:      s.rename,
+		nfsProcLink:        s.link,
+		nfsProcReaddir:     s.readdir,
+		nfsProcReaddirplus: s.readdirplus,
+		nfsProcFsstat:      s.fsstat,
+		nfsProcFsinfo:      s.fsinfo,
+		nfsProcPathconf:    s.pathconf,
+		nfsProcCommit:      s.commit,
+	}
+}
+
+// nfsStatus converts an error of the storage layer to an nfsstat3 value.
+func nfsStatus(err error) uint32 {
+	errno := errnoOf(err)
+	if errno == syscall.EIO {
+		log.Printf("nfs: %s\n", err)
+	}
+	if status, ok := nfsErrors[errno]; ok {
+		return status
+	}
+	return nfs3ErrServerFault
+}
+
+func nfsHandle(inode uint64) []byte {
+	fh := make([]byte, nfsHandleSize)
+	binary.BigEndian.PutUint64(fh, inode)
+	return fh
+}
+
+// node reads a file handle from `r` and returns the node it refers to.
+// Handles are inode numbers, which clients can forge, so those of inodes
+// outside the exported directory are stale.
+func (s *nfsServer) node(ctx context.Context, r *xdrReader) (*FileNode, uint32) {
+	fh := r.opaque(64)
+	if r.err != nil {
+		return nil, nfs3ErrBadHandle
+	}
+	if len(fh) != nfsHandleSize {
+		return nil, nfs3ErrBadHandle
+	}
+	inode := binary.BigEndian.Uint64(fh)
+	below, err := IsBelow(ctx, s.db, inode, s.root.Inode)
+	if err != nil {
+		return nil, nfsStatus(err)
+	}
+	if !below {
+		return nil, nfs3ErrStale
+	}
+	n, err := getNode(ctx, s.db, inode)
+	if err != nil {
+		return nil, nfsStatus(err)
+	}
+	return n, nfs3OK
+}
+
+// diropargs reads a directory handle and a name from `r`.
+func (s *nfsServer) diropargs(ctx context.Context, r *xdrReader) (*FileNode, string, uint32) {
+	dir, status := s.node(ctx, r)
+	name := r.string(nfsMaxName + 1)
+	if status != nfs3OK {
+		return nil, "", status
+	}
+	if len(name) > nfsMaxName {
+		return nil, "", nfs3ErrNameTooLong
+	}
+	if name == "" || name == "." || name == ".." {
+		return nil, "", nfs3ErrInval
+	}
+	return dir, name, nfs3OK
+}
+
+// refresh reloads `n` after it was modified, for post-operation attributes.
+func (s *nfsServer) refresh(ctx context.Context, n *FileNode) *FileNode {
+	if n == nil {
+		return nil
+	}
+	updated, err := getNode(ctx, s.db, n.Inode)
+	if err != nil {
+		return nil
+	}
+	return updated
+}
+
+func nfsFileType(m os.FileMode) uint32 {
+	switch {
+	case m&os.ModeDir != 0:
+		return nf3Dir
+	case m&os.ModeSymlink != 0:
+		return nf3Lnk
+	case m&os.ModeNamedPipe != 0:
+		return nf3FIFO
+	case m&os.ModeSocket != 0:
+		return nf3Sock
+	case m&os.ModeCharDevice != 0:
+		return nf3Chr
+	case m&os.ModeDevice != 0:
+		return nf3Blk
+	}
+	return nf3Reg
+}
+
+func (w *xdrWriter) nfsTime(t time.Time) {
+	w.uint32(unixTime(t))
+	w.uint32(uint32(t.Nanosecond()))
+}
+
+func (s *nfsServer) fattr3(w *xdrWriter, n *FileNode) {
+	size := n.Size
+	if n.IsSymlink() {
+		size = uint64(len(n.SymlinkTarget))
+	}
+	w.uint32(nfsFileType(n.Mode))
+	w.uint32(unixMode(n.Mode) &^ unixIFMT)
+	w.uint32(n.Nlink)
+	w.uint32(n.Uid)
+	w.uint32(n.Gid)
+	w.uint64(size)
+	bs := uint64(s.db.BlockSize)
+	w.uint64((size + bs - 1) / bs * bs) // Used.
+	w.uint32(n.Rdev >> 8)               // Major.
+	w.uint32(n.Rdev & 0xff)             // Minor.
+	w.uint64(1)                         // File system ID.
+	w.uint64(n.Inode)
+	w.nfsTime(n.Atime)
+	w.nfsTime(n.Mtime)
+	w.nfsTime(n.Ctime)
+}
+
+// postOpAttr writes the attributes of `n`, which may be nil.
+func (s *nfsServer) postOpAttr(w *xdrWriter, n *FileNode) {
+	w.bool(n != nil)
+	if n != nil {
+		s.fattr3(w, n)
+	}
+}
+
+// wccData writes weak cache consistency data. Only the attributes after the
+// operation are sent.
+func (s *nfsServer) wccData(w *xdrWriter, after *FileNode) {
+	w.bool(false)
+	s.postOpAttr(w, after)
+}
+
+func (w *xdrWriter) postOpHandle(n *FileNode) {
+	w.bool(true)
+	w.opaque(nfsHandle(n.Inode))
+}
+
+// nfsSattr holds the attributes to set in SETATTR, CREATE and similar calls.
+type nfsSattr struct {
+	setMode, setUID, setGID, setSize bool
+	mode, uid, gid                   uint32
+	size                             uint64
+	atime, mtime                     *time.Time
+}
+
+func readSattr(r *xdrReader) nfsSattr {
+	var a nfsSattr
+	if a.setMode = r.bool(); a.setMode {
+		a.mode = r.uint32()
+	}
+	if a.setUID = r.bool(); a.setUID {
+		a.uid = r.uint32()
+	}
+	if a.setGID = r.bool(); a.setGID {
+		a.gid = r.uint32()
+	}
+	if a.setSize = r.bool(); a.setSize {
+		a.size = r.uint64()
+	}
+	readTime := func() *time.Time {
+		switch r.uint32() {
+		case 1: // SET_TO_SERVER_TIME
+			t := time.Now()
+			return &t
+		case 2: // SET_TO_CLIENT_TIME
+			t := time.Unix(int64(r.uint32()), int64(r.uint32()))
+			return &t
+		}
+		return nil
+	}
+	a.atime = readTime()
+	a.mtime = readTime()
+	return a
+}
+
+// apply sets the attributes in `a` on `n`.
+func (s *nfsServer) apply(ctx context.Context, n *FileNode, a nfsSattr) error {
+	if a.setSize {
+		if err := setSize(ctx, s.db, n, a.size); err != nil {
+			return err
+		}
+	}
+	if a.setMode {
+		n.Mode = n.Mode&os.ModeType | fileModeFromUnix(a.mode&07777)
+	}
+	if a.setUID {
+		n.Uid = a.uid
+	}
+	if a.setGID {
+		n.Gid = a.gid
+	}
+	if a.atime != nil {
+		n.Atime = *a.atime
+	}
+	if a.mtime != nil {
+		n.Mtime = *a.mtime
+	}
+	n.Ctime = time.Now()
+	return UpdateNode(ctx, s.db, n)
+}
+
+// owner returns the owner of new files created by the caller of `c`.
+func (c *rpcCallHeader) owner(a nfsSattr) (uint32, uint32) {
+	uid, gid := c.uid, c.gid
+	if a.setUID {
+		uid = a.uid
+	}
+	if a.setGID {
+		gid = a.gid
+	}
+	return uid, gid
+}
+
+func (s *nfsServer) mnt(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	p := r.string(nfsMaxPath)
+	if r.err != nil {
+		return
+	}
+	n, err := ResolvePath(ctx, s.db, path.Join(s.rootPath, cleanPath(p)))
+	if err != nil {
+		w.uint32(nfsStatus(err))
+		return
+	}
+	if !n.IsDirectory() {
+		w.uint32(nfs3ErrNotDir)
+		return
+	}
+	w.uint32(nfs3OK)
+	w.opaque(nfsHandle(n.Inode))
+	w.uint32(1) // Supported authentication flavors.
+	w.uint32(rpcAuthUnix)
+}
+
+func (s *nfsServer) export(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	w.bool(true)
+	w.string("/")
+	w.bool(false) // No group restrictions.
+	w.bool(false) // No more exports.
+}
+
+func (s *nfsServer) getattr(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	if r.err != nil {
+		return
+	}
+	w.uint32(status)
+	if status == nfs3OK {
+		s.fattr3(w, n)
+	}
+}
+
+func (s *nfsServer) setattr(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	a := readSattr(r)
+	var guard *time.Time
+	if r.bool() {
+		t := time.Unix(int64(r.uint32()), int64(r.uint32()))
+		guard = &t
+	}
+	if r.err != nil {
+		return
+	}
+	if status == nfs3OK && guard != nil && unixTime(n.Ctime) != unixTime(*guard) {
+		status = nfs3ErrNotSync
+	}
+	if status == nfs3OK {
+		if err := s.apply(ctx, n, a); err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	s.wccData(w, s.refresh(ctx, n))
+}
+
+func (s *nfsServer) lookup(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	dir, status := s.node(ctx, r)
+	name := r.string(nfsMaxName + 1)
+	if r.err != nil {
+		return
+	}
+	var n *FileNode
+	if status == nfs3OK {
+		var err error
+		switch {
+		case !dir.IsDirectory():
+			err = syscall.ENOTDIR
+		case name == ".":
+			n = dir
+		case name == "..":
+			// The parent of the exported directory is itself.
+			parent := dir.Inode
+			if dir.Inode != s.root.Inode && dir.Inode != RootInode {
+				parent, err = GetParentInode(ctx, s.db, dir.Inode)
+			}
+			if err == nil {
+				n, err = getNode(ctx, s.db, parent)
+			}
+		default:
+			n, err = lookupNode(ctx, s.db, dir, name)
+		}
+		if err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	if status != nfs3OK {
+		s.postOpAttr(w, dir)
+		return
+	}
+	w.opaque(nfsHandle(n.Inode))
+	s.postOpAttr(w, n)
+	s.postOpAttr(w, dir)
+}
+
+func (s *nfsServer) access(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	requested := r.uint32()
+	if r.err != nil {
+		return
+	}
+	w.uint32(status)
+	s.postOpAttr(w, n)
+	if status != nfs3OK {
+		return
+	}
+	// Like the FUSE mount, the server does not enforce permissions. Only
+	// report the operations that make sense for the type of file.
+	if n.IsDirectory() {
+		requested &^= access3Execute
+	} else {
+		requested &^= access3Lookup | access3Delete
+	}
+	w.uint32(requested)
+}
+
+func (s *nfsServer) readlink(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	if r.err != nil {
+		return
+	}
+	if status == nfs3OK && !n.IsSymlink() {
+		status = nfs3ErrInval
+	}
+	w.uint32(status)
+	s.postOpAttr(w, n)
+	if status == nfs3OK {
+		w.string(n.SymlinkTarget)
+	}
+}
+
+func (s *nfsServer) read(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	offset, count := r.uint64(), r.uint32()
+	if r.err != nil {
+		return
+	}
+	if status == nfs3OK && n.IsDirectory() {
+		status = nfs3ErrIsDir
+	}
+	var data []byte
+	if status == nfs3OK {
+		if count > nfsMaxData {
+			count = nfsMaxData
+		}
+		var err error
+		data, err = readData(ctx, s.db, n, int64(offset), int(count))
+		if err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	s.postOpAttr(w, n)
+	if status == nfs3OK {
+		w.uint32(uint32(len(data)))
+		w.bool(offset+uint64(len(data)) >= n.Size)
+		w.opaque(data)
+	}
+}
+
+func (s *nfsServer) write(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	offset := r.uint64()
+	r.uint32() // Count, which is the length of the data.
+	r.uint32() // Stable, all writes are stable.
+	data := r.opaque(nfsMaxData)
+	if r.err != nil {
+		return
+	}
+	if status == nfs3OK && n.IsDirectory() {
+		status = nfs3ErrIsDir
+	}
+	if status == nfs3OK {
+		if err := WriteData(ctx, s.db, n, int64(offset), data); err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	s.wccData(w, n)
+	if status == nfs3OK {
+		w.uint32(uint32(len(data)))
+		w.uint32(nfsFileSync)
+		w.fixed(s.verifier[:])
+	}
+}
+
+// writeCreated writes the result of a call that created `n` in `dir`.
+func (s *nfsServer) writeCreated(ctx context.Context, w *xdrWriter, dir, n *FileNode, err error) {
+	if err != nil {
+		w.uint32(nfsStatus(err))
+		s.wccData(w, s.refresh(ctx, dir))
+		return
+	}
+	w.uint32(nfs3OK)
+	w.postOpHandle(n)
+	s.postOpAttr(w, n)
+	s.wccData(w, s.refresh(ctx, dir))
+}
+
+func (s *nfsServer) create(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	dir, name, status := s.diropargs(ctx, r)
+	how := r.uint32()
+	var a nfsSattr
+	if how == 2 { // EXCLUSIVE
+		r.fixed(8) // Verifier.
+		a.mode = 0644
+	} else {
+		a = readSattr(r)
+	}
+	if r.err != nil {
+		return
+	}
+	if status != nfs3OK {
+		w.uint32(status)
+		s.wccData(w, dir)
+		return
+	}
+
+	n, err := lookupNode(ctx, s.db, dir, name)
+	switch {
+	case err == nil && how == 0: // UNCHECKED
+		if n.IsDirectory() {
+			err = syscall.EISDIR
+		} else if a.setSize {
+			err = setSize(ctx, s.db, n, a.size)
+		}
+	case err == nil:
+		err = syscall.EEXIST
+	case err == syscall.ENOENT:
+		mode := os.FileMode(0644)
+		if a.setMode || how == 2 {
+			mode = fileModeFromUnix(a.mode & 07777)
+		}
+		uid, gid := c.owner(a)
+		n, err = CreateNode(ctx, s.db, dir, name, mode, uid, gid)
+	}
+	s.writeCreated(ctx, w, dir, n, err)
+}
+
+func (s *nfsServer) mkdir(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	dir, name, status := s.diropargs(ctx, r)
+	a := readSattr(r)
+	if r.err != nil {
+		return
+	}
+	if status != nfs3OK {
+		w.uint32(status)
+		s.wccData(w, dir)
+		return
+	}
+	mode := os.FileMode(0755)
+	if a.setMode {
+		mode = fileModeFromUnix(a.mode & 07777)
+	}
+	uid, gid := c.owner(a)
+	n, err := CreateNode(ctx, s.db, dir, name, os.ModeDir|mode, uid, gid)
+	s.writeCreated(ctx, w, dir, n, err)
+}
+
+func (s *nfsServer) symlink(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	dir, name, status := s.diropargs(ctx, r)
+	a := readSattr(r)
+	target := r.string(nfsMaxPath)
+	if r.err != nil {
+		return
+	}
+	if status != nfs3OK {
+		w.uint32(status)
+		s.wccData(w, dir)
+		return
+	}
+	uid, gid := c.owner(a)
+	n, err := CreateNode(ctx, s.db, dir, name, os.ModeSymlink|0777, uid, gid)
+	if err == nil {
+		n.SymlinkTarget = target
+		err = UpdateNode(ctx, s.db, n)
+	}
+	s.writeCreated(ctx, w, dir, n, err)
+}
+
+func (s *nfsServer) mknod(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	dir, name, status := s.diropargs(ctx, r)
+	var mode os.FileMode
+	var a nfsSattr
+	var rdev uint32
+	switch r.uint32() {
+	case nf3Chr:
+		mode = os.ModeDevice | os.ModeCharDevice
+		a = readSattr(r)
+		rdev = r.uint32()<<8 | r.uint32()&0xff
+	case nf3Blk:
+		mode = os.ModeDevice
+		a = readSattr(r)
+		rdev = r.uint32()<<8 | r.uint32()&0xff
+	case nf3Sock:
+		mode = os.ModeSocket
+		a = readSattr(r)
+	case nf3FIFO:
+		mode = os.ModeNamedPipe
+		a = readSattr(r)
+	default:
+		status = nfs3ErrBadType
+	}
+	if r.err != nil {
+		return
+	}
+	if status != nfs3OK {
+		w.uint32(status)
+		s.wccData(w, dir)
+		return
+	}
+	uid, gid := c.owner(a)
+	n, err := CreateNode(ctx, s.db, dir, name, mode|fileModeFromUnix(a.mode&07777), uid, gid)
+	if err == nil && rdev != 0 {
+		n.Rdev = rdev
+		err = UpdateNode(ctx, s.db, n)
+	}
+	s.writeCreated(ctx, w, dir, n, err)
+}
+
+func (s *nfsServer) remove(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	s.removeEntry(ctx, r, w, false)
+}
+
+func (s *nfsServer) rmdir(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	s.removeEntry(ctx, r, w, true)
+}
+
+func (s *nfsServer) removeEntry(ctx context.Context, r *xdrReader, w *xdrWriter, isDir bool) {
+	dir, name, status := s.diropargs(ctx, r)
+	if r.err != nil {
+		return
+	}
+	if status == nfs3OK {
+		if err := removeNode(ctx, s.db, dir, name, isDir); err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	s.wccData(w, s.refresh(ctx, dir))
+}
+
+func (s *nfsServer) rename(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	fromDir, fromName, status := s.diropargs(ctx, r)
+	toDir, toName, toStatus := s.diropargs(ctx, r)
+	if r.err != nil {
+		return
+	}
+	if status == nfs3OK {
+		status = toStatus
+	}
+	if status == nfs3OK {
+		if err := renameNode(ctx, s.db, fromDir, fromName, toDir, toName, true); err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	s.wccData(w, s.refresh(ctx, fromDir))
+	s.wccData(w, s.refresh(ctx, toDir))
+}
+
+func (s *nfsServer) link(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	dir, name, dirStatus := s.diropargs(ctx, r)
+	if r.err != nil {
+		return
+	}
+	if status == nfs3OK {
+		status = dirStatus
+	}
+	if status == nfs3OK {
+		var err error
+		if n.IsDirectory() {
+			err = syscall.EISDIR
+		} else if _, err = lookupNode(ctx, s.db, dir, name); err == nil {
+			err = syscall.EEXIST
+		} else if err == syscall.ENOENT {
+			err = CreateLink(ctx, s.db, dir.Inode, &FileNode{Inode: n.Inode, Name: name})
+		}
+		if err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	s.postOpAttr(w, s.refresh(ctx, n))
+	s.wccData(w, s.refresh(ctx, dir))
+}
+
+func (s *nfsServer) readdir(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	s.listDir(ctx, r, w, false)
+}
+
+func (s *nfsServer) readdirplus(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	s.listDir(ctx, r, w, true)
+}
+
+// listDir implements READDIR and READDIRPLUS. Cookies are positions in the
+// directory sorted by name.
+func (s *nfsServer) listDir(ctx context.Context, r *xdrReader, w *xdrWriter, plus bool) {
+	dir, status := s.node(ctx, r)
+	cookie := r.uint64()
+	r.fixed(8) // Cookie verifier, not used.
+	if plus {
+		r.uint32() // Maximum size of the names and cookies only.
+	}
+	maxSize := r.uint32()
+	if r.err != nil {
+		return
+	}
+
+	var entries []*FileNode
+	if status == nfs3OK && !dir.IsDirectory() {
+		status = nfs3ErrNotDir
+	}
+	if status == nfs3OK {
+		var err error
+		entries, err = ListNodesInDir(ctx, s.db, dir.Inode)
+		if err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	if status != nfs3OK {
+		w.uint32(status)
+		s.postOpAttr(w, dir)
+		return
+	}
+
+	// Leave room for the attributes of the directory, the verifier and the
+	// end of the list.
+	budget := int(maxSize) - 128
+	list := &xdrWriter{}
+	i := int(cookie)
+	for ; i < len(entries); i++ {
+		entry := &xdrWriter{}
+		n := entries[i]
+		entry.bool(true)
+		entry.uint64(n.Inode)
+		entry.string(n.Name)
+		entry.uint64(uint64(i + 1))
+		if plus {
+			s.postOpAttr(entry, n)
+			entry.postOpHandle(n)
+		}
+		if len(list.b)+len(entry.b) > budget {
+			break
+		}
+		list.b = append(list.b, entry.b...)
+	}
+	if i == int(cookie) && i < len(entries) {
+		w.uint32(nfs3ErrTooSmall)
+		s.postOpAttr(w, dir)
+		return
+	}
+	w.uint32(nfs3OK)
+	s.postOpAttr(w, dir)
+	w.fixed(make([]byte, 8)) // Cookie verifier.
+	w.b = append(w.b, list.b...)
+	w.bool(false) // End of the list.
+	w.bool(i >= len(entries))
+}
+
+func (s *nfsServer) fsstat(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	if r.err != nil {
+		return
+	}
+	var blocks, inodes int
+	if status == nfs3OK {
+		var err error
+		if blocks, err = CountDataBlocks(ctx, s.db); err == nil {
+			inodes, err = CountInodes(ctx, s.db)
+		}
+		if err != nil {
+			status = nfsStatus(err)
+		}
+	}
+	w.uint32(status)
+	s.postOpAttr(w, n)
+	if status != nfs3OK {
+		return
+	}
+	used := uint64(blocks) * uint64(s.db.BlockSize)
+	w.uint64(used + nfsFreeBytes)
+	w.uint64(nfsFreeBytes)
+	w.uint64(nfsFreeBytes)
+	w.uint64(uint64(inodes) + nfsFreeFiles)
+	w.uint64(nfsFreeFiles)
+	w.uint64(nfsFreeFiles)
+	w.uint32(0) // Invariance, the values may change at any time.
+}
+
+func (s *nfsServer) fsinfo(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	if r.err != nil {
+		return
+	}
+	w.uint32(status)
+	s.postOpAttr(w, n)
+	if status != nfs3OK {
+		return
+	}
+	w.uint32(nfsMaxData)             // rtmax
+	w.uint32(nfsMaxData)             // rtpref
+	w.uint32(uint32(s.db.BlockSize)) // rtmult
+	w.uint32(nfsMaxData)             // wtmax
+	w.uint32(nfsMaxData)             // wtpref
+	w.uint32(uint32(s.db.BlockSize)) // wtmult
+	w.uint32(8192)                   // dtpref
+	w.uint64(1<<63 - 1)              // maxfilesize
+	w.uint32(0)                      // time_delta, timestamps have microsecond precision.
+	w.uint32(1000)
+	// FSF3_LINK | FSF3_SYMLINK | FSF3_HOMOGENEOUS | FSF3_CANSETTIME
+	w.uint32(0x1 | 0x2 | 0x8 | 0x10)
+}
+
+func (s *nfsServer) pathconf(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	if r.err != nil {
+		return
+	}
+	w.uint32(status)
+	s.postOpAttr(w, n)
+	if status != nfs3OK {
+		return
+	}
+	w.uint32(1<<31 - 1) // linkmax
+	w.uint32(nfsMaxName)
+	w.bool(true)  // no_trunc
+	w.bool(true)  // chown_restricted
+	w.bool(false) // case_insensitive
+	w.bool(true)  // case_preserving
+}
+
+func (s *nfsServer) commit(ctx context.Context, c *rpcCallHeader, r *xdrReader, w *xdrWriter) {
+	n, status := s.node(ctx, r)
+	r.uint64() // Offset.
+	r.uint32() // Count.
+	if r.err != nil {
+		return
+	}
+	// Writes are committed to the database before they are acknowledged.
+	w.uint32(status)
+	s.wccData(w, n)
+	if status == nfs3OK {
+		w.fixed(s.verifier[:])
+	}
+}
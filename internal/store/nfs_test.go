@@ -0,0 +1,202 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+// nfsHandleArg returns the XDR encoding of the file handle of `inode`, as
+// sent by clients.
+func nfsHandleArg(inode uint64) *xdrReader {
+	var w xdrWriter
+	w.opaque(nfsHandle(inode))
+	return &xdrReader{b: w.b}
+}
+
+func TestNFSHandleOutsideExport(t *testing.T) {
+	root := newTestRoot(t)
+	db := root.fs.db
+	ctx := context.Background()
+	mkdir := func(parent *FileNode, name string) *FileNode {
+		n, err := CreateNode(ctx, db, parent, name, os.ModeDir|0755, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	export := mkdir(root, "export")
+	inside := mkdir(mkdir(export, "a"), "b")
+	outside := mkdir(root, "outside")
+	secret, err := CreateNode(ctx, db, outside, "secret", 0600, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewNFSServer(db, export, "/export")
+	for _, tc := range []struct {
+		inode uint64
+		want  uint32
+	}{
+		{export.Inode, nfs3OK},
+		{inside.Inode, nfs3OK},
+		{outside.Inode, nfs3ErrStale},
+		{secret.Inode, nfs3ErrStale}, // A forged handle.
+		{RootInode, nfs3ErrStale},
+	} {
+		if _, status := s.node(ctx, nfsHandleArg(tc.inode)); status != tc.want {
+			t.Errorf("handle of inode %d has status %d, want %d", tc.inode, status, tc.want)
+		}
+	}
+}
+
+func TestRecordMarking(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeRecord(&buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if marker := binary.BigEndian.Uint32(buf.Bytes()); marker != 1<<31|5 {
+		t.Errorf("record marker = %#x", marker)
+	}
+	// Records may be sent in several fragments, the last one marked.
+	buf.Write([]byte{0, 0, 0, 2, 'a', 'b', 0x80, 0, 0, 1, 'c'})
+	for _, want := range []string{"hello", "abc"} {
+		record, err := readRecord(&buf)
+		if err != nil || string(record) != want {
+			t.Errorf("readRecord = %q, %v, want %q", record, err, want)
+		}
+	}
+	if _, err := readRecord(bytes.NewReader([]byte{0x80, 0, 0, 4, 'a'})); err == nil {
+		t.Error("reading a truncated record succeeded")
+	}
+	var huge [4]byte
+	binary.BigEndian.PutUint32(huge[:], 1<<31|(rpcMaxRecord+1))
+	if _, err := readRecord(bytes.NewReader(huge[:])); err == nil {
+		t.Error("reading a record over the maximum size succeeded")
+	}
+}
+
+// rpcCallArgs returns an RPC call of the procedure `proc` of `prog` with
+// AUTH_UNIX credentials, followed by `args`.
+func rpcCallArgs(prog, vers, proc uint32, args []byte) []byte {
+	var cred xdrWriter
+	cred.uint32(0)      // Stamp.
+	cred.string("host") // Machine name.
+	cred.uint32(1000)   // UID.
+	cred.uint32(100)    // GID.
+	cred.uint32(0)      // No other groups.
+
+	var w xdrWriter
+	w.uint32(42) // XID.
+	w.uint32(rpcCall)
+	w.uint32(2) // RPC version.
+	w.uint32(prog)
+	w.uint32(vers)
+	w.uint32(proc)
+	w.uint32(rpcAuthUnix)
+	w.opaque(cred.b)
+	w.uint32(rpcAuthNone)
+	w.opaque(nil)
+	w.fixed(args)
+	return w.b
+}
+
+func TestNFSHandleCall(t *testing.T) {
+	s := NewNFSServer(nil, nil, "/")
+	var shortHandle xdrWriter
+	shortHandle.opaque([]byte{1, 2, 3, 4})
+	for _, tc := range []struct {
+		name string
+		call []byte
+		want []uint32 // The reply after its verifier.
+	}{
+		{"null", rpcCallArgs(nfsProgram, 3, nfsProcNull, nil), []uint32{rpcSuccess}},
+		{"mount null", rpcCallArgs(mountProgram, 3, mountProcNull, nil), []uint32{rpcSuccess}},
+		{"mount dump", rpcCallArgs(mountProgram, 3, mountProcDump, nil), []uint32{rpcSuccess, 0}},
+		{"version 2", rpcCallArgs(nfsProgram, 2, nfsProcNull, nil), []uint32{rpcProgMismatch, 3, 3}},
+		{"other program", rpcCallArgs(100000, 2, 0, nil), []uint32{rpcProgUnavail}},
+		{"unknown procedure", rpcCallArgs(nfsProgram, 3, 22, nil), []uint32{rpcProcUnavail}},
+		{"bad handle", rpcCallArgs(nfsProgram, 3, nfsProcGetattr, shortHandle.b), []uint32{rpcSuccess, nfs3ErrBadHandle}},
+		{"no arguments", rpcCallArgs(nfsProgram, 3, nfsProcGetattr, nil), []uint32{rpcGarbageArgs}},
+	} {
+		reply := &xdrReader{b: s.handleCall(tc.call)}
+		if xid, kind, state := reply.uint32(), reply.uint32(), reply.uint32(); xid != 42 || kind != rpcReply || state != rpcMsgAccepted {
+			t.Errorf("%s: reply %d of kind %d in state %d", tc.name, xid, kind, state)
+			continue
+		}
+		reply.uint32()   // Verifier flavor.
+		reply.opaque(64) // Verifier body.
+		var got []uint32
+		for reply.err == nil && len(reply.b) > 0 {
+			got = append(got, reply.uint32())
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: reply = %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: reply = %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+
+	// Messages that are not calls get no reply.
+	notCall := rpcCallArgs(nfsProgram, 3, nfsProcNull, nil)
+	binary.BigEndian.PutUint32(notCall[4:], rpcReply)
+	for name, record := range map[string][]byte{"reply": notCall, "truncated": notCall[:20]} {
+		if reply := s.handleCall(record); reply != nil {
+			t.Errorf("%s: got a reply % x", name, reply)
+		}
+	}
+}
+
+func TestReadSattr(t *testing.T) {
+	var w xdrWriter
+	w.bool(true)
+	w.uint32(0640)
+	w.bool(false) // UID.
+	w.bool(true)
+	w.uint32(100)
+	w.bool(true)
+	w.uint64(1 << 33)
+	w.uint32(1) // Atime set to the server time.
+	w.uint32(2) // Mtime set to the client time.
+	w.uint32(1546300800)
+	w.uint32(5)
+	r := &xdrReader{b: w.b}
+	before := time.Now()
+	a := readSattr(r)
+	if r.err != nil || len(r.b) != 0 {
+		t.Fatalf("readSattr left %d bytes and error %v", len(r.b), r.err)
+	}
+	if !a.setMode || a.mode != 0640 || a.setUID || !a.setGID || a.gid != 100 || !a.setSize || a.size != 1<<33 {
+		t.Errorf("readSattr = %+v", a)
+	}
+	if a.atime == nil || a.atime.Before(before) {
+		t.Errorf("atime = %v, want the server time", a.atime)
+	}
+	if a.mtime == nil || !a.mtime.Equal(time.Unix(1546300800, 5)) {
+		t.Errorf("mtime = %v, want the client time", a.mtime)
+	}
+}
+
+func TestNFSFileType(t *testing.T) {
+	for mode, want := range map[os.FileMode]uint32{
+		0644:                              nf3Reg,
+		os.ModeDir | 0755:                 nf3Dir,
+		os.ModeSymlink | 0777:             nf3Lnk,
+		os.ModeNamedPipe:                  nf3FIFO,
+		os.ModeSocket:                     nf3Sock,
+		os.ModeDevice | os.ModeCharDevice: nf3Chr,
+		os.ModeDevice:                     nf3Blk,
+	} {
+		if got := nfsFileType(mode); got != want {
+			t.Errorf("nfsFileType(%s) = %d, want %d", mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// The tables of normtables.go are generated from the Unicode database of
+// the Python interpreter.
+//go:generate sh -c "python3 ../../scripts/gen_normtables.py | gofmt > normtables.go"
+
+// normForm is the Unicode normalization form that names are stored in.
+// macOS clients send names in NFD while Linux clients usually send NFC, so
+// without normalization the same name typed on both creates two entries.
+type normForm int
+
+const (
+	normNone normForm = iota
+	normNFC
+	normNFD
+)
+
+func ParseNormForm(s string) (normForm, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return normNone, nil
+	case "nfc":
+		return normNFC, nil
+	case "nfd":
+		return normNFD, nil
+	}
+	return normNone, errors.Errorf("unknown normalization form %q, expected nfc, nfd or none", s)
+}
+
+func (f normForm) String() string {
+	switch f {
+	case normNFC:
+		return "nfc"
+	case normNFD:
+		return "nfd"
+	}
+	return "none"
+}
+
+// SetNameNormalization sets the normalization form of new names. Existing
+// names are left as they are, and can only be found through their stored
+// form once names are normalized to a different form.
+func SetNameNormalization(ctx context.Context, db *DB, form normForm) error {
+	return PutSetting(ctx, db, settingNormalization, form.String())
+}
+
+// normName returns `name` in the normalization form of the file system.
+// Names are normalized by every function that stores or looks up names, so
+// that all forms of a name resolve to the same entry.
+func (s *settings) normName(name string) string {
+	if s.nameForm == normNone || isASCII(name) || !utf8.ValidString(name) {
+		return name
+	}
+	rs := decompose(name)
+	if s.nameForm == normNFC {
+		rs = compose(rs)
+	}
+	return string(rs)
+}
+
+// normNames normalizes every name of `names` in place.
+func (s *settings) normNames(names []string) []string {
+	for i, name := range names {
+		names[i] = s.normName(name)
+	}
+	return names
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Constants of the algorithmic decomposition of Hangul syllables.
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// decompose returns the canonical decomposition of `s`, that is its NFD
+// form, with combining marks in canonical order.
+func decompose(s string) []rune {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		if r >= hangulSBase && r < hangulSBase+hangulSCount {
+			i := r - hangulSBase
+			out = append(out, hangulLBase+i/hangulNCount, hangulVBase+(i%hangulNCount)/hangulTCount)
+			if t := i % hangulTCount; t != 0 {
+				out = append(out, hangulTBase+t)
+			}
+			continue
+		}
+		if d, ok := normDecomposition[r]; ok {
+			out = append(out, d...)
+			continue
+		}
+		out = append(out, r)
+	}
+
+	// Sort each run of combining marks by combining class.
+	for i := 0; i < len(out); {
+		if normCombiningClass[out[i]] == 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < len(out) && normCombiningClass[out[j]] != 0 {
+			j++
+		}
+		run := out[i:j]
+		sort.SliceStable(run, func(a, b int) bool {
+			return normCombiningClass[run[a]] < normCombiningClass[run[b]]
+		})
+		i = j
+	}
+	return out
+}
+
+// compose applies the canonical composition to the decomposed `rs`, which
+// turns its NFD form into its NFC form.
+func compose(rs []rune) []rune {
+	out := make([]rune, 0, len(rs))
+	starter := -1   // Index in out of the last starter.
+	lastClass := -1 // Combining class of the last rune after the starter.
+	for _, r := range rs {
+		class := int(normCombiningClass[r])
+		// A rune is blocked from the starter by any rune in between with
+		// the same or a higher combining class, or by a starter.
+		if starter >= 0 && (lastClass < 0 || (lastClass != 0 && lastClass < class)) {
+			if c, ok := composePair(out[starter], r); ok {
+				out[starter] = c
+				continue
+			}
+		}
+		if class == 0 {
+			starter = len(out)
+			lastClass = -1
+		} else {
+			lastClass = class
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// composePair returns the primary composite of `a` followed by `b`.
+func composePair(a, b rune) (rune, bool) {
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+b-hangulVBase)*hangulTCount, true
+	}
+	if a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 &&
+		b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + b - hangulTBase, true
+	}
+	c, ok := normComposition[[2]rune{a, b}]
+	return c, ok
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func normalize(form normForm, s string) string {
+	return (&settings{nameForm: form}).normName(s)
+}
+
+func TestNormName(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		nfc, nfd string
+	}{
+		{"ascii", "readme.txt", "readme.txt"},
+		{"precomposed", "caf\u00e9", "cafe\u0301"},
+		{"several marks", "\u1ea5", "a\u0302\u0301"},
+		// Combining marks are put in canonical order: below (220) before
+		// above (230), and a mark left over after composing stays apart.
+		{"mark order", "\u1ea1\u0301", "a\u0323\u0301"},
+		{"singleton", "\u00c5", "A\u030a"},
+		// Hangul syllables are decomposed and composed algorithmically.
+		{"hangul", "\ud55c\uae00", "\u1112\u1161\u11ab\u1100\u1173\u11af"},
+		{"hangul lv", "\uac00", "\u1100\u1161"},
+		// Composition exclusions are decomposed but never composed.
+		{"exclusion", "\u0915\u093c", "\u0915\u093c"},
+	} {
+		if got := normalize(normNFD, tc.nfc); got != tc.nfd {
+			t.Errorf("%s: NFD(%+q) = %+q, want %+q", tc.name, tc.nfc, got, tc.nfd)
+		}
+		if got := normalize(normNFC, tc.nfd); got != tc.nfc {
+			t.Errorf("%s: NFC(%+q) = %+q, want %+q", tc.name, tc.nfd, got, tc.nfc)
+		}
+		if got := normalize(normNFC, tc.nfc); got != tc.nfc {
+			t.Errorf("%s: NFC(%+q) = %+q, want it unchanged", tc.name, tc.nfc, got)
+		}
+		if got := normalize(normNFD, tc.nfd); got != tc.nfd {
+			t.Errorf("%s: NFD(%+q) = %+q, want it unchanged", tc.name, tc.nfd, got)
+		}
+	}
+	// Marks given out of order are reordered, and the singleton and the
+	// excluded composite are replaced in both forms.
+	for in, want := range map[string][2]string{
+		"a\u0301\u0323": {"\u1ea1\u0301", "a\u0323\u0301"},
+		"\u212b":        {"\u00c5", "A\u030a"},
+		"\u0958":        {"\u0915\u093c", "\u0915\u093c"},
+	} {
+		if got := normalize(normNFC, in); got != want[0] {
+			t.Errorf("NFC(%+q) = %+q, want %+q", in, got, want[0])
+		}
+		if got := normalize(normNFD, in); got != want[1] {
+			t.Errorf("NFD(%+q) = %+q, want %+q", in, got, want[1])
+		}
+	}
+
+	// Names are left as they are without a form, or if they are not UTF-8.
+	if got := normalize(normNone, "cafe\u0301"); got != "cafe\u0301" {
+		t.Errorf("normName without a form changed the name into %+q", got)
+	}
+	if invalid := "caf\xe9"; normalize(normNFD, invalid) != invalid {
+		t.Errorf("normName changed the invalid name %+q", invalid)
+	}
+}
+
+// TestNormRoundTrip checks that every rune with a decomposition in the
+// tables round-trips through both forms.
+func TestNormRoundTrip(t *testing.T) {
+	for r := range normDecomposition {
+		s := string(r)
+		nfc, nfd := normalize(normNFC, s), normalize(normNFD, s)
+		if got := normalize(normNFC, nfd); got != nfc {
+			t.Errorf("NFC(NFD(%U)) = %+q, want %+q", r, got, nfc)
+		}
+		if got := normalize(normNFD, nfc); got != nfd {
+			t.Errorf("NFD(NFC(%U)) = %+q, want %+q", r, got, nfd)
+		}
+		if nfd == s {
+			t.Errorf("%U has a decomposition but NFD leaves it as is", r)
+		}
+		if !utf8.ValidString(nfd) {
+			t.Errorf("NFD(%U) = %+q is not valid UTF-8", r, nfd)
+		}
+	}
+	for r, class := range normCombiningClass {
+		if class == 0 {
+			t.Errorf("%U has combining class 0 in the tables", r)
+		}
+	}
+}
+
+func TestParseNormForm(t *testing.T) {
+	for s, want := range map[string]normForm{"": normNone, "none": normNone, "NFC": normNFC, "nfd": normNFD} {
+		got, err := ParseNormForm(s)
+		if err != nil || got != want {
+			t.Errorf("ParseNormForm(%q) = %v, %v, want %v", s, got, err, want)
+		}
+		if again, _ := ParseNormForm(got.String()); again != got {
+			t.Errorf("%q does not parse back to %v", got.String(), got)
+		}
+	}
+	if _, err := ParseNormForm("nfkc"); err == nil {
+		t.Error("ParseNormForm(nfkc) succeeded")
+	}
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// objectStore holds the contents of tiered files as objects.
+type objectStore interface {
+	// Put stores `size` bytes read from `r` as the object `key`.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// GetRange returns `length` bytes of the object `key` at `offset`.
+	GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error)
+	// Delete removes the object `key`. Missing objects are not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// OpenObjectStore returns the object store at `rawURL`:
+//
+//	s3://BUCKET/PREFIX?endpoint=https://host&region=us-east-1
+//	file:///DIR
+//
+// S3 credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+// Any S3-compatible store works, e.g. MinIO, or GCS through its
+// interoperability endpoint (https://storage.googleapis.com) with HMAC keys.
+func OpenObjectStore(rawURL string) (objectStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return dirStore(u.Path), nil
+	case "s3":
+		q := u.Query()
+		s := &s3Store{
+			bucket:    u.Host,
+			prefix:    strings.TrimPrefix(u.Path, "/"),
+			endpoint:  q.Get("endpoint"),
+			region:    q.Get("region"),
+			accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			client:    &http.Client{Timeout: 10 * time.Minute},
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if s.endpoint == "" {
+			s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+		if s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+			return nil, errors.New("s3 object stores need a bucket, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return s, nil
+	}
+	return nil, errors.Errorf("unsupported object store %q (must be s3:// or file://)", rawURL)
+}
+
+// dirStore keeps objects as files in a local directory, e.g. a network
+// file system mount.
+type dirStore string
+
+func (d dirStore) path(key string) string {
+	return filepath.Join(string(d), filepath.FromSlash(key))
+}
+
+func (d dirStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (d dirStore) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+func (d dirStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// s3Store talks to an S3-compatible object store with path-style requests
+// signed with AWS Signature Version 4. Payloads are not signed, so that
+// uploads can be streamed.
+type s3Store struct {
+	bucket, prefix       string
+	endpoint, region     string
+	accessKey, secretKey string
+	client               *http.Client
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, key, r, size, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(resp.Body, length))
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object `key`, and returns the response
+// if it succeeded.
+func (s *s3Store) do(ctx context.Context, method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	objectPath := "/" + s.bucket + "/" + strings.TrimPrefix(s.prefix+"/"+key, "/")
+	u, err := url.Parse(strings.TrimSuffix(s.endpoint, "/") + objectPath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 && !(method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errors.Errorf("%s %s: %s: %s", method, objectPath, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to `req`.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		signed = append(signed, "range")
+	}
+	sort.Strings(signed)
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The functions below implement file system operations directly on the
+// database for the network servers of `sqlfs serve`, which do not go through
+// FUSE. Errors with a specific meaning are returned as syscall.Errno so that
+// every protocol can map them to its own status codes.
+
+// lookupNode returns the entry `name` of the directory `dir`.
+func lookupNode(ctx context.Context, db *DB, dir *FileNode, name string) (*FileNode, error) {
+	if !dir.IsDirectory() {
+		return nil, syscall.ENOTDIR
+	}
+	n, err := GetNodeByName(ctx, db, dir.Inode, name)
+	if err == sql.ErrNoRows {
+		return nil, syscall.ENOENT
+	}
+	return n, err
+}
+
+// CreateNode creates the entry `name` in the directory `dir`. Directories
+// start with a link count of 2 for their "." entry.
+func CreateNode(
+	ctx context.Context, db *DB, dir *FileNode, name string, mode os.FileMode, uid, gid uint32,
+) (*FileNode, error) {
+	if _, err := lookupNode(ctx, db, dir, name); err == nil {
+		return nil, syscall.EEXIST
+	} else if err != syscall.ENOENT {
+		return nil, err
+	}
+	now := time.Now()
+	n := &FileNode{
+		Name:   name,
+		Mode:   mode,
+		Nlink:  1,
+		Uid:    uid,
+		Gid:    gid,
+		Atime:  now,
+		Crtime: now,
+	}
+	if mode.IsDir() {
+		n.Nlink = 2
+	}
+	if err := UpsertNode(ctx, db, dir.Inode, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// removeNode removes the entry `name` of the directory `dir`. If `isDir` is
+// true the entry must be an empty directory, otherwise it must not be a
+// directory.
+func removeNode(ctx context.Context, db *DB, dir *FileNode, name string, isDir bool) error {
+	n, err := lookupNode(ctx, db, dir, name)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		if !n.IsDirectory() {
+			return syscall.ENOTDIR
+		}
+		count, err := CountNodesInDir(ctx, db, n.Inode)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return syscall.ENOTEMPTY
+		}
+	} else if n.IsDirectory() {
+		return syscall.EISDIR
+	}
+	return RemoveNodeByName(ctx, db, dir.Inode, name, n.Inode)
+}
+
+// renameNode moves the entry `oldName` of `oldDir` to `newName` in `newDir`.
+// If `replace` is true, an existing entry `newName` is removed first, as
+// rename(2) does. Otherwise EEXIST is returned.
+func renameNode(
+	ctx context.Context, db *DB, oldDir *FileNode, oldName string, newDir *FileNode, newName string, replace bool,
+) error {
+	n, err := lookupNode(ctx, db, oldDir, oldName)
+	if err != nil {
+		return err
+	}
+	existing, err := lookupNode(ctx, db, newDir, newName)
+	switch {
+	case err == syscall.ENOENT:
+	case err != nil:
+		return err
+	case existing.Inode == n.Inode:
+		return nil // Both names refer to the same file.
+	case !replace:
+		return syscall.EEXIST
+	case n.IsDirectory() && !existing.IsDirectory():
+		return syscall.ENOTDIR
+	case !n.IsDirectory() && existing.IsDirectory():
+		return syscall.EISDIR
+	default:
+		if err := removeNode(ctx, db, newDir, newName, existing.IsDirectory()); err != nil {
+			return err
+		}
+	}
+	_, err = RenameNode(ctx, db, oldDir.Inode, oldName, newDir.Inode, newName)
+	return err
+}
+
+// setSize truncates or extends the file `n` to `size` bytes.
+func setSize(ctx context.Context, db *DB, n *FileNode, size uint64) error {
+	if n.IsDirectory() {
+		return syscall.EISDIR
+	}
+	now := time.Now()
+	n.Mtime = now
+	n.Ctime = now
+	return TruncateData(ctx, db, n, size)
+}
+
+// readData returns up to `size` bytes of the file `n` at `offset`.
+func readData(ctx context.Context, db *DB, n *FileNode, offset int64, size int) ([]byte, error) {
+	first, last := db.blockRange(offset, size, n.Size)
+	if first == last {
+		return nil, nil
+	}
+	blocks, err := ReadBlocks(ctx, db, n.Inode, first, last-first)
+	if err != nil {
+		return nil, err
+	}
+	return db.assembleBlocks(blocks, offset, size, n.Size), nil
+}
+
+// getNode returns the node with Inode number `inode`. The root directory has
+// no row in the inodes table.
+func getNode(ctx context.Context, db *DB, inode uint64) (*FileNode, error) {
+	if inode == RootInode {
+		return ResolvePath(ctx, db, "/")
+	}
+	n, err := GetNodeByID(ctx, db, inode)
+	if err == sql.ErrNoRows {
+		return nil, syscall.ESTALE
+	}
+	return n, err
+}
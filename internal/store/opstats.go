@@ -0,0 +1,218 @@
+package store
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// How often Wait checks whether the operations it waits for are done.
+const drainPollInterval = 20 * time.Millisecond
+
+// opTracker counts FUSE operations and keeps track of the ones in flight.
+// It is fed by the debug hook of the FUSE server, which reports every
+// request and response.
+type opTracker struct {
+	// Non-zero if every request and response is logged.
+	verbose int32
+	// Non-zero if new requests are refused while shutting down.
+	draining int32
+	// Deadline of each request, relative to its start. Zero means none.
+	timeout time.Duration
+	// Delays requests over the rate limits.
+	throttle *throttle
+
+	mu       sync.Mutex
+	counts   map[string]uint64
+	errors   map[string]uint64
+	inFlight map[uint64]inFlightOp
+}
+
+// inFlightOp is a FUSE request that has not been answered yet.
+type inFlightOp struct {
+	ID    uint64    `json:"id"`
+	Op    string    `json:"op"`
+	Node  uint64    `json:"node"`
+	Pid   uint32    `json:"pid"`
+	Start time.Time `json:"start"`
+}
+
+// opStats is a snapshot of the counters of an opTracker.
+type opStats struct {
+	Counts   map[string]uint64 `json:"counts"`
+	Errors   map[string]uint64 `json:"errors"`
+	InFlight int               `json:"in_flight"`
+}
+
+func newOpTracker(timeout time.Duration) *opTracker {
+	return &opTracker{
+		timeout:  timeout,
+		throttle: newThrottle(),
+		counts:   make(map[string]uint64),
+		errors:   make(map[string]uint64),
+		inFlight: make(map[uint64]inFlightOp),
+	}
+}
+
+// debug implements fuseFS.Config.Debug. The messages are unexported types
+// of the FUSE package, so their fields are read through reflection.
+func (t *opTracker) debug(msg interface{}) {
+	if atomic.LoadInt32(&t.verbose) != 0 {
+		log.Println(msg)
+	}
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	op := v.FieldByName("Op")
+	header := v.FieldByName("Request")
+	if !op.IsValid() || !header.IsValid() {
+		return
+	}
+	if header.Kind() == reflect.Ptr {
+		if header.IsNil() {
+			return
+		}
+		header = header.Elem()
+	}
+	id := header.FieldByName("ID")
+	if !id.IsValid() {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if errno := v.FieldByName("Errno"); errno.IsValid() {
+		// A response.
+		delete(t.inFlight, id.Uint())
+		if errno.String() != "" || v.FieldByName("Error").String() != "" {
+			t.errors[op.String()]++
+		}
+		return
+	}
+	t.counts[op.String()]++
+	inFlight := inFlightOp{ID: id.Uint(), Op: op.String(), Start: time.Now()}
+	if node := header.FieldByName("Node"); node.IsValid() {
+		inFlight.Node = node.Uint()
+	}
+	if pid := header.FieldByName("Pid"); pid.IsValid() {
+		inFlight.Pid = uint32(pid.Uint())
+	}
+	t.inFlight[inFlight.ID] = inFlight
+}
+
+// withContext implements fuseFS.Config.WithContext. It sets the deadline of
+// the request, which aborts its queries once it expires. While draining, new
+// requests get a canceled context so that they fail without touching the
+// database. Requests over the rate limits are delayed here, before their
+// deadline starts.
+func (t *opTracker) withContext(ctx context.Context, req fuse.Request) context.Context {
+	if atomic.LoadInt32(&t.draining) != 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		return ctx
+	}
+	t.throttle.wait(req)
+	if t.timeout <= 0 {
+		return ctx
+	}
+	// The parent context is canceled once the request is answered, which
+	// releases the timer.
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	_ = cancel
+	return ctx
+}
+
+// Drain refuses new requests, and waits up to `timeout` for the requests in
+// flight to be answered. It returns the number of requests still in flight.
+func (t *opTracker) Drain(timeout time.Duration) int {
+	atomic.StoreInt32(&t.draining, 1)
+	return t.Wait(timeout)
+}
+
+// Wait waits up to `timeout` for the requests in flight to be answered,
+// ignoring the ones that come in meanwhile. It returns the number of
+// requests still in flight.
+func (t *opTracker) Wait(timeout time.Duration) int {
+	t.mu.Lock()
+	waiting := make(map[uint64]bool, len(t.inFlight))
+	for id := range t.inFlight {
+		waiting[id] = true
+	}
+	t.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		t.mu.Lock()
+		for id := range waiting {
+			if _, ok := t.inFlight[id]; !ok {
+				delete(waiting, id)
+			}
+		}
+		t.mu.Unlock()
+		if len(waiting) == 0 || time.Now().After(deadline) {
+			return len(waiting)
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// Draining returns true between Drain and Resume.
+func (t *opTracker) Draining() bool {
+	return atomic.LoadInt32(&t.draining) != 0
+}
+
+// Resume accepts new requests again after Drain.
+func (t *opTracker) Resume() {
+	atomic.StoreInt32(&t.draining, 0)
+}
+
+// SetVerbose enables or disables logging of every request and response.
+func (t *opTracker) SetVerbose(verbose bool) {
+	var v int32
+	if verbose {
+		v = 1
+	}
+	atomic.StoreInt32(&t.verbose, v)
+}
+
+// Verbose returns true if every request and response is logged.
+func (t *opTracker) Verbose() bool {
+	return atomic.LoadInt32(&t.verbose) != 0
+}
+
+// Stats returns a snapshot of the operation counters.
+func (t *opTracker) Stats() opStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := opStats{
+		Counts:   make(map[string]uint64, len(t.counts)),
+		Errors:   make(map[string]uint64, len(t.errors)),
+		InFlight: len(t.inFlight),
+	}
+	for op, count := range t.counts {
+		s.Counts[op] = count
+	}
+	for op, count := range t.errors {
+		s.Errors[op] = count
+	}
+	return s
+}
+
+// InFlight returns the operations in flight, oldest first.
+func (t *opTracker) InFlight() []inFlightOp {
+	t.mu.Lock()
+	ops := make([]inFlightOp, 0, len(t.inFlight))
+	for _, op := range t.inFlight {
+		ops = append(ops, op)
+	}
+	t.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Start.Before(ops[j].Start) })
+	return ops
+}
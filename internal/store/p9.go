@@ -0,0 +1,902 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 9P2000.L, the Linux dialect of the Plan 9 file protocol, as spoken by the
+// v9fs client of Linux, QEMU and WSL. See
+// https://github.com/chaos/diod/blob/master/protocol.md. Qid paths are inode
+// numbers.
+
+const p9Version = "9P2000.L"
+
+// Message types. Each reply is the request type plus one.
+const (
+	p9Tlerror      = 6
+	p9Tstatfs      = 8
+	p9Tlopen       = 12
+	p9Tlcreate     = 14
+	p9Tsymlink     = 16
+	p9Tmknod       = 18
+	p9Trename      = 20
+	p9Treadlink    = 22
+	p9Tgetattr     = 24
+	p9Tsetattr     = 26
+	p9Txattrwalk   = 30
+	p9Txattrcreate = 32
+	p9Treaddir     = 40
+	p9Tfsync       = 50
+	p9Tlock        = 52
+	p9Tgetlock     = 54
+	p9Tlink        = 70
+	p9Tmkdir       = 72
+	p9Trenameat    = 74
+	p9Tunlinkat    = 76
+	p9Tversion     = 100
+	p9Tauth        = 102
+	p9Tattach      = 104
+	p9Tflush       = 108
+	p9Twalk        = 110
+	p9Tread        = 116
+	p9Twrite       = 118
+	p9Tclunk       = 120
+	p9Tremove      = 122
+
+	p9Rlerror = p9Tlerror + 1
+)
+
+// Qid types.
+const (
+	p9QTDir     = 0x80
+	p9QTSymlink = 0x02
+	p9QTFile    = 0x00
+)
+
+// Bits of Tsetattr.
+const (
+	p9SetattrMode     = 0x1
+	p9SetattrUID      = 0x2
+	p9SetattrGID      = 0x4
+	p9SetattrSize     = 0x8
+	p9SetattrAtime    = 0x10
+	p9SetattrMtime    = 0x20
+	p9SetattrAtimeSet = 0x80
+	p9SetattrMtimeSet = 0x100
+)
+
+const (
+	// All fields of Rgetattr up to and including the number of blocks.
+	p9GetattrBasic = 0x7ff
+
+	// Linux open(2) flags, as sent in Tlopen.
+	p9OTrunc  = 0x200
+	p9OAppend = 0x400
+
+	// Flag of Tunlinkat for directories.
+	p9AtRemoveDir = 0x200
+
+	// Largest message size negotiated with clients.
+	p9MaxMsize = 1 << 20
+
+	// Size of the header of Rread and Twrite, including the count.
+	p9IOHeader = 4 + 1 + 2 + 4 + 4 + 8
+)
+
+// p9Errnos maps errors of the storage layer to Linux errno values, which is
+// what 9P2000.L clients expect regardless of the platform of the server.
+var p9Errnos = map[syscall.Errno]uint32{
+	syscall.EPERM:        1,
+	syscall.ENOENT:       2,
+	syscall.EIO:          5,
+	syscall.EBADF:        9,
+	syscall.EACCES:       13,
+	syscall.EBUSY:        16,
+	syscall.EEXIST:       17,
+	syscall.EXDEV:        18,
+	syscall.ENOTDIR:      20,
+	syscall.EISDIR:       21,
+	syscall.EINVAL:       22,
+	syscall.ENOSPC:       28,
+	syscall.EROFS:        30,
+	syscall.ENAMETOOLONG: 36,
+	syscall.ENOTEMPTY:    39,
+	syscall.ELOOP:        40,
+	syscall.ENOTSUP:      95,
+	syscall.ESTALE:       116,
+}
+
+// p9Server serves 9P2000.L.
+type p9Server struct {
+	db   *DB
+	root *FileNode // Exported directory.
+}
+
+// p9Conn holds the state of a single client connection.
+type p9Conn struct {
+	*p9Server
+	msize uint32
+	fids  map[uint32]*p9Fid
+}
+
+// p9Fid is a file referenced by the client.
+type p9Fid struct {
+	node   *FileNode
+	uid    uint32 // Owner of the files created through this fid.
+	open   bool
+	append bool
+}
+
+func NewP9Server(db *DB, root *FileNode) *p9Server {
+	return &p9Server{db: db, root: root}
+}
+
+// Serve accepts connections on `l` until it is closed.
+func (s *p9Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &p9Conn{p9Server: s, msize: p9MaxMsize, fids: make(map[uint32]*p9Fid)}
+		go c.serve(conn)
+	}
+}
+
+// serve handles the requests of the connection in order.
+func (c *p9Conn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var header [7]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err != io.EOF {
+				log.Printf("9p: %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		size := binary.LittleEndian.Uint32(header[:4])
+		if size < 7 || size > c.msize {
+			log.Printf("9p: %s: invalid message size %d\n", conn.RemoteAddr(), size)
+			return
+		}
+		body := make([]byte, size-7)
+		if _, err := io.ReadFull(r, body); err != nil {
+			log.Printf("9p: %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		typ, tag := header[4], binary.LittleEndian.Uint16(header[5:])
+
+		w := &p9Writer{}
+		err := c.handle(typ, &p9Reader{b: body}, w)
+		if err != nil {
+			w.b = nil
+			w.uint32(c.errno(err))
+			typ = p9Rlerror
+		} else {
+			typ++
+		}
+		reply := make([]byte, 7, 7+len(w.b))
+		binary.LittleEndian.PutUint32(reply, uint32(7+len(w.b)))
+		reply[4] = typ
+		binary.LittleEndian.PutUint16(reply[5:], tag)
+		if _, err := conn.Write(append(reply, w.b...)); err != nil {
+			log.Printf("9p: %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (c *p9Conn) errno(err error) uint32 {
+	errno := errnoOf(err)
+	if errno == syscall.EIO {
+		log.Printf("9p: %s\n", err)
+	}
+	if v, ok := p9Errnos[errno]; ok {
+		return v
+	}
+	return p9Errnos[syscall.EIO]
+}
+
+// handle processes a single request and writes the body of its reply to
+// `w`. Errors are reported to the client with Rlerror.
+func (c *p9Conn) handle(typ byte, r *p9Reader, w *p9Writer) error {
+	ctx := context.Background()
+	switch typ {
+	case p9Tversion:
+		return c.version(r, w)
+	case p9Tattach:
+		return c.attach(r, w)
+	case p9Tflush:
+		// Requests are handled in order, so the old one has completed.
+		r.uint16()
+		return r.err
+	case p9Twalk:
+		return c.walk(ctx, r, w)
+	case p9Tclunk:
+		fid := r.uint32()
+		if _, ok := c.fids[fid]; !ok {
+			return syscall.EBADF
+		}
+		delete(c.fids, fid)
+		return nil
+	case p9Tstatfs:
+		return c.statfs(ctx, r, w)
+	case p9Tlopen:
+		return c.lopen(ctx, r, w)
+	case p9Tlcreate:
+		return c.lcreate(ctx, r, w)
+	case p9Tsymlink:
+		return c.symlink(ctx, r, w)
+	case p9Tmknod:
+		return c.mknod(ctx, r, w)
+	case p9Tmkdir:
+		return c.mkdir(ctx, r, w)
+	case p9Treadlink:
+		f, err := c.fid(r.uint32())
+		if err != nil {
+			return err
+		}
+		if !f.node.IsSymlink() {
+			return syscall.EINVAL
+		}
+		w.string(f.node.SymlinkTarget)
+		return nil
+	case p9Tgetattr:
+		return c.getattr(ctx, r, w)
+	case p9Tsetattr:
+		return c.setattr(ctx, r, w)
+	case p9Treaddir:
+		return c.readdir(ctx, r, w)
+	case p9Tread:
+		return c.read(ctx, r, w)
+	case p9Twrite:
+		return c.write(ctx, r, w)
+	case p9Tfsync:
+		// Writes are committed to the database before they are acknowledged.
+		_, err := c.fid(r.uint32())
+		return err
+	case p9Tlock:
+		// Locks are advisory and not shared with other clients, so every
+		// lock is granted.
+		if _, err := c.fid(r.uint32()); err != nil {
+			return err
+		}
+		w.uint8(0) // P9_LOCK_SUCCESS
+		return nil
+	case p9Tgetlock:
+		if _, err := c.fid(r.uint32()); err != nil {
+			return err
+		}
+		r.uint8() // Type.
+		start, length, procID, clientID := r.uint64(), r.uint64(), r.uint32(), r.string()
+		w.uint8(2) // F_UNLCK, nothing conflicts.
+		w.uint64(start)
+		w.uint64(length)
+		w.uint32(procID)
+		w.string(clientID)
+		return r.err
+	case p9Tremove:
+		fid := r.uint32()
+		f, err := c.fid(fid)
+		if err != nil {
+			return err
+		}
+		delete(c.fids, fid) // Clunked even if the removal fails.
+		return c.removeNode(ctx, f.node)
+	case p9Tunlinkat:
+		dir, err := c.fid(r.uint32())
+		name, flags := r.string(), r.uint32()
+		if err != nil {
+			return err
+		}
+		return removeNode(ctx, c.db, dir.node, name, flags&p9AtRemoveDir != 0)
+	case p9Trename:
+		f, err := c.fid(r.uint32())
+		if err != nil {
+			return err
+		}
+		dir, err := c.fid(r.uint32())
+		name := r.string()
+		if err != nil {
+			return err
+		}
+		return c.rename(ctx, f.node, dir.node, name)
+	case p9Trenameat:
+		oldDir, err := c.fid(r.uint32())
+		oldName := r.string()
+		if err != nil {
+			return err
+		}
+		newDir, err := c.fid(r.uint32())
+		newName := r.string()
+		if err != nil {
+			return err
+		}
+		return renameNode(ctx, c.db, oldDir.node, oldName, newDir.node, newName, true)
+	case p9Tlink:
+		dir, err := c.fid(r.uint32())
+		if err != nil {
+			return err
+		}
+		f, err := c.fid(r.uint32())
+		name := r.string()
+		if err != nil {
+			return err
+		}
+		return c.link(ctx, dir.node, f.node, name)
+	case p9Tauth, p9Txattrwalk, p9Txattrcreate:
+		return syscall.ENOTSUP
+	}
+	return syscall.ENOTSUP
+}
+
+func (c *p9Conn) fid(fid uint32) (*p9Fid, error) {
+	f, ok := c.fids[fid]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return f, nil
+}
+
+func (c *p9Conn) version(r *p9Reader, w *p9Writer) error {
+	msize, version := r.uint32(), r.string()
+	if r.err != nil {
+		return r.err
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+	// A new version starts a new session.
+	c.fids = make(map[uint32]*p9Fid)
+	if version != p9Version {
+		version = "unknown"
+	}
+	w.uint32(c.msize)
+	w.string(version)
+	return nil
+}
+
+func (c *p9Conn) attach(r *p9Reader, w *p9Writer) error {
+	fid := r.uint32()
+	r.uint32() // afid, authentication is not supported.
+	r.string() // uname
+	r.string() // aname, the exported directory is always the root.
+	uid := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+	if _, ok := c.fids[fid]; ok {
+		return syscall.EBADF
+	}
+	c.fids[fid] = &p9Fid{node: c.root, uid: uid}
+	w.qid(c.root)
+	return nil
+}
+
+func (c *p9Conn) walk(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	fid, newFid := r.uint32(), r.uint32()
+	names := make([]string, r.uint16())
+	for i := range names {
+		names[i] = r.string()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	f, err := c.fid(fid)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.fids[newFid]; ok && newFid != fid {
+		return syscall.EBADF
+	}
+
+	n := f.node
+	var walked []*FileNode
+	for _, name := range names {
+		next, err := c.lookup(ctx, n, name)
+		if err != nil {
+			if len(walked) == 0 {
+				return err
+			}
+			break // A partial walk succeeds but does not create newFid.
+		}
+		walked = append(walked, next)
+		n = next
+	}
+	if len(walked) == len(names) {
+		c.fids[newFid] = &p9Fid{node: n, uid: f.uid}
+	}
+	w.uint16(uint16(len(walked)))
+	for _, n := range walked {
+		w.qid(n)
+	}
+	return nil
+}
+
+// lookup returns the entry `name` of `dir`, including "." and "..". The
+// parent of the exported directory is itself.
+func (c *p9Conn) lookup(ctx context.Context, dir *FileNode, name string) (*FileNode, error) {
+	switch name {
+	case ".":
+		return dir, nil
+	case "..":
+		if dir.Inode == c.root.Inode || dir.Inode == RootInode {
+			return c.root, nil
+		}
+		parent, err := GetParentInode(ctx, c.db, dir.Inode)
+		if err != nil {
+			return nil, err
+		}
+		if parent == c.root.Inode {
+			return c.root, nil
+		}
+		// The directory may have been moved out of the exported one
+		// since it was walked to.
+		below, err := IsBelow(ctx, c.db, parent, c.root.Inode)
+		if err != nil {
+			return nil, err
+		}
+		if !below {
+			return nil, syscall.ESTALE
+		}
+		return getNode(ctx, c.db, parent)
+	}
+	return lookupNode(ctx, c.db, dir, name)
+}
+
+func (c *p9Conn) statfs(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	if _, err := c.fid(r.uint32()); err != nil {
+		return err
+	}
+	blocks, err := CountDataBlocks(ctx, c.db)
+	if err != nil {
+		return err
+	}
+	inodes, err := CountInodes(ctx, c.db)
+	if err != nil {
+		return err
+	}
+	// The database has no fixed capacity, so plenty of space is reported
+	// as free.
+	free := nfsFreeBytes / uint64(c.db.BlockSize)
+	w.uint32(0x01021997) // V9FS_MAGIC
+	w.uint32(uint32(c.db.BlockSize))
+	w.uint64(uint64(blocks) + free)
+	w.uint64(free)
+	w.uint64(free)
+	w.uint64(uint64(inodes) + nfsFreeFiles)
+	w.uint64(nfsFreeFiles)
+	w.uint64(1) // File system ID.
+	w.uint32(nfsMaxName)
+	return nil
+}
+
+func (c *p9Conn) lopen(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	f, err := c.fid(r.uint32())
+	flags := r.uint32()
+	if err != nil {
+		return err
+	}
+	if f.open {
+		return syscall.EBADF
+	}
+	n, err := getNode(ctx, c.db, f.node.Inode)
+	if err != nil {
+		return err
+	}
+	n.Name, n.Parent = f.node.Name, f.node.Parent
+	if flags&p9OTrunc != 0 && n.IsRegular() {
+		if err := setSize(ctx, c.db, n, 0); err != nil {
+			return err
+		}
+	}
+	f.node = n
+	f.open = true
+	f.append = flags&p9OAppend != 0
+	w.qid(n)
+	w.uint32(0) // iounit, let the client use msize.
+	return nil
+}
+
+func (c *p9Conn) lcreate(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	f, err := c.fid(r.uint32())
+	name, flags, mode, gid := r.string(), r.uint32(), r.uint32(), r.uint32()
+	if err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	n, err := CreateNode(ctx, c.db, f.node, name, fileModeFromUnix(mode&07777), f.uid, gid)
+	if err != nil {
+		return err
+	}
+	// The fid now refers to the new, open file.
+	f.node = n
+	f.open = true
+	f.append = flags&p9OAppend != 0
+	w.qid(n)
+	w.uint32(0)
+	return nil
+}
+
+func (c *p9Conn) symlink(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	dir, err := c.fid(r.uint32())
+	name, target, gid := r.string(), r.string(), r.uint32()
+	if err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	n, err := CreateNode(ctx, c.db, dir.node, name, os.ModeSymlink|0777, dir.uid, gid)
+	if err != nil {
+		return err
+	}
+	n.SymlinkTarget = target
+	if err := UpdateNode(ctx, c.db, n); err != nil {
+		return err
+	}
+	w.qid(n)
+	return nil
+}
+
+func (c *p9Conn) mknod(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	dir, err := c.fid(r.uint32())
+	name, mode, major, minor, gid := r.string(), r.uint32(), r.uint32(), r.uint32(), r.uint32()
+	if err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	n, err := CreateNode(ctx, c.db, dir.node, name, fileModeFromUnix(mode), dir.uid, gid)
+	if err != nil {
+		return err
+	}
+	if rdev := major<<8 | minor&0xff; rdev != 0 {
+		n.Rdev = rdev
+		if err := UpdateNode(ctx, c.db, n); err != nil {
+			return err
+		}
+	}
+	w.qid(n)
+	return nil
+}
+
+func (c *p9Conn) mkdir(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	dir, err := c.fid(r.uint32())
+	name, mode, gid := r.string(), r.uint32(), r.uint32()
+	if err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	n, err := CreateNode(ctx, c.db, dir.node, name, os.ModeDir|fileModeFromUnix(mode&07777), dir.uid, gid)
+	if err != nil {
+		return err
+	}
+	w.qid(n)
+	return nil
+}
+
+func (c *p9Conn) getattr(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	f, err := c.fid(r.uint32())
+	r.uint64() // Requested fields, the basic ones are always returned.
+	if err != nil {
+		return err
+	}
+	n, err := getNode(ctx, c.db, f.node.Inode)
+	if err != nil {
+		return err
+	}
+	n.Name, n.Parent = f.node.Name, f.node.Parent
+	f.node = n
+
+	size := n.Size
+	if n.IsSymlink() {
+		size = uint64(len(n.SymlinkTarget))
+	}
+	w.uint64(p9GetattrBasic)
+	w.qid(n)
+	w.uint32(unixMode(n.Mode))
+	w.uint32(n.Uid)
+	w.uint32(n.Gid)
+	w.uint64(uint64(n.Nlink))
+	w.uint64(uint64(n.Rdev))
+	w.uint64(size)
+	w.uint64(uint64(c.db.BlockSize))
+	w.uint64((size + 511) / 512)
+	w.time(n.Atime)
+	w.time(n.Mtime)
+	w.time(n.Ctime)
+	w.time(n.Crtime)
+	w.uint64(0) // Generation.
+	w.uint64(0) // Data version.
+	return nil
+}
+
+func (c *p9Conn) setattr(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	f, err := c.fid(r.uint32())
+	valid, mode, uid, gid, size := r.uint32(), r.uint32(), r.uint32(), r.uint32(), r.uint64()
+	atime := time.Unix(int64(r.uint64()), int64(r.uint64()))
+	mtime := time.Unix(int64(r.uint64()), int64(r.uint64()))
+	if err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	n, err := getNode(ctx, c.db, f.node.Inode)
+	if err != nil {
+		return err
+	}
+	n.Name, n.Parent = f.node.Name, f.node.Parent
+	f.node = n
+
+	if valid&p9SetattrSize != 0 {
+		if err := setSize(ctx, c.db, n, size); err != nil {
+			return err
+		}
+	}
+	if valid&p9SetattrMode != 0 {
+		n.Mode = n.Mode&os.ModeType | fileModeFromUnix(mode&07777)
+	}
+	if valid&p9SetattrUID != 0 {
+		n.Uid = uid
+	}
+	if valid&p9SetattrGID != 0 {
+		n.Gid = gid
+	}
+	now := time.Now()
+	if valid&p9SetattrAtime != 0 {
+		if valid&p9SetattrAtimeSet == 0 {
+			atime = now
+		}
+		n.Atime = atime
+	}
+	if valid&p9SetattrMtime != 0 {
+		if valid&p9SetattrMtimeSet == 0 {
+			mtime = now
+		}
+		n.Mtime = mtime
+	}
+	n.Ctime = now
+	return UpdateNode(ctx, c.db, n)
+}
+
+// readdir lists a directory. Offsets are positions in the directory sorted
+// by name, after "." and "..".
+func (c *p9Conn) readdir(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	f, err := c.fid(r.uint32())
+	offset, count := r.uint64(), r.uint32()
+	if err != nil {
+		return err
+	}
+	if !f.open || !f.node.IsDirectory() {
+		return syscall.EBADF
+	}
+	entries, err := ListNodesInDir(ctx, c.db, f.node.Inode)
+	if err != nil {
+		return err
+	}
+	parent, err := c.lookup(ctx, f.node, "..")
+	if err != nil {
+		return err
+	}
+	dot, dotdot := *f.node, *parent
+	dot.Name, dotdot.Name = ".", ".."
+	entries = append([]*FileNode{&dot, &dotdot}, entries...)
+
+	if max := c.msize - p9IOHeader; count > max {
+		count = max
+	}
+	data := &p9Writer{}
+	for i := offset; i < uint64(len(entries)); i++ {
+		n := entries[i]
+		entry := &p9Writer{}
+		entry.qid(n)
+		entry.uint64(i + 1)
+		entry.uint8(uint8(GetDirentTypeFromMode(n.Mode)))
+		entry.string(n.Name)
+		if len(data.b)+len(entry.b) > int(count) {
+			break
+		}
+		data.b = append(data.b, entry.b...)
+	}
+	w.uint32(uint32(len(data.b)))
+	w.b = append(w.b, data.b...)
+	return nil
+}
+
+func (c *p9Conn) read(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	f, err := c.fid(r.uint32())
+	offset, count := r.uint64(), r.uint32()
+	if err != nil {
+		return err
+	}
+	if !f.open || f.node.IsDirectory() {
+		return syscall.EBADF
+	}
+	if max := c.msize - p9IOHeader; count > max {
+		count = max
+	}
+	data, err := readData(ctx, c.db, f.node, int64(offset), int(count))
+	if err != nil {
+		return err
+	}
+	w.uint32(uint32(len(data)))
+	w.b = append(w.b, data...)
+	return nil
+}
+
+func (c *p9Conn) write(ctx context.Context, r *p9Reader, w *p9Writer) error {
+	f, err := c.fid(r.uint32())
+	offset, count := r.uint64(), r.uint32()
+	data := r.fixed(int(count))
+	if err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if !f.open || f.node.IsDirectory() {
+		return syscall.EBADF
+	}
+	if f.append {
+		offset = f.node.Size
+	}
+	f.node.Mtime = time.Now()
+	if err := WriteData(ctx, c.db, f.node, int64(offset), data); err != nil {
+		return err
+	}
+	w.uint32(count)
+	return nil
+}
+
+// removeNode removes the entry through which `n` was reached.
+func (c *p9Conn) removeNode(ctx context.Context, n *FileNode) error {
+	if n.Inode == c.root.Inode || n.Name == "" {
+		return syscall.EBUSY
+	}
+	dir, err := getNode(ctx, c.db, n.Parent)
+	if err != nil {
+		return err
+	}
+	return removeNode(ctx, c.db, dir, n.Name, n.IsDirectory())
+}
+
+// rename moves the entry through which `n` was reached to `name` in `dir`.
+func (c *p9Conn) rename(ctx context.Context, n, dir *FileNode, name string) error {
+	if n.Inode == c.root.Inode || n.Name == "" {
+		return syscall.EBUSY
+	}
+	oldDir, err := getNode(ctx, c.db, n.Parent)
+	if err != nil {
+		return err
+	}
+	if err := renameNode(ctx, c.db, oldDir, n.Name, dir, name, true); err != nil {
+		return err
+	}
+	n.Name, n.Parent = name, dir.Inode
+	return nil
+}
+
+func (c *p9Conn) link(ctx context.Context, dir, n *FileNode, name string) error {
+	if n.IsDirectory() {
+		return syscall.EPERM
+	}
+	if _, err := lookupNode(ctx, c.db, dir, name); err == nil {
+		return syscall.EEXIST
+	} else if err != syscall.ENOENT {
+		return err
+	}
+	return CreateLink(ctx, c.db, dir.Inode, &FileNode{Inode: n.Inode, Name: name})
+}
+
+// p9Reader decodes the fields of a request. Decoding errors are sticky and
+// reported through err.
+type p9Reader struct {
+	b   []byte
+	err error
+}
+
+func (r *p9Reader) fixed(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errors.Wrap(syscall.EINVAL, "truncated 9P message")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *p9Reader) uint8() uint8 {
+	if b := r.fixed(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *p9Reader) uint16() uint16 {
+	if b := r.fixed(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *p9Reader) uint32() uint32 {
+	if b := r.fixed(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *p9Reader) uint64() uint64 {
+	if b := r.fixed(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *p9Reader) string() string {
+	return string(r.fixed(int(r.uint16())))
+}
+
+// p9Writer encodes the fields of a reply.
+type p9Writer struct {
+	b []byte
+}
+
+func (w *p9Writer) uint8(v uint8) {
+	w.b = append(w.b, v)
+}
+
+func (w *p9Writer) uint16(v uint16) {
+	w.b = append(w.b, byte(v), byte(v>>8))
+}
+
+func (w *p9Writer) uint32(v uint32) {
+	w.b = append(w.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (w *p9Writer) uint64(v uint64) {
+	w.uint32(uint32(v))
+	w.uint32(uint32(v >> 32))
+}
+
+func (w *p9Writer) string(v string) {
+	w.uint16(uint16(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *p9Writer) time(t time.Time) {
+	w.uint64(uint64(unixTime(t)))
+	w.uint64(uint64(t.Nanosecond()))
+}
+
+// qid writes the qid of `n`, which is identified by its inode number.
+func (w *p9Writer) qid(n *FileNode) {
+	switch {
+	case n.IsDirectory():
+		w.uint8(p9QTDir)
+	case n.IsSymlink():
+		w.uint8(p9QTSymlink)
+	default:
+		w.uint8(p9QTFile)
+	}
+	w.uint32(0) // Version.
+	w.uint64(n.Inode)
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestP9Codec(t *testing.T) {
+	var w p9Writer
+	w.uint8(7)
+	w.uint16(0x1234)
+	w.uint32(0xdeadbeef)
+	w.uint64(1<<40 | 3)
+	w.string("9P2000.L")
+	w.qid(&FileNode{Inode: 42, Mode: os.ModeDir | 0755})
+	// Integers are little-endian, strings prefixed with their length.
+	if w.b[1] != 0x34 || w.b[2] != 0x12 || len(w.b) != 1+2+4+8+2+8+13 {
+		t.Fatalf("encoded % x", w.b)
+	}
+
+	r := &p9Reader{b: w.b}
+	if r.uint8() != 7 || r.uint16() != 0x1234 || r.uint32() != 0xdeadbeef || r.uint64() != 1<<40|3 {
+		t.Error("integers did not round trip")
+	}
+	if s := r.string(); s != "9P2000.L" {
+		t.Errorf("string = %q", s)
+	}
+	if typ, version, path := r.uint8(), r.uint32(), r.uint64(); typ != p9QTDir || version != 0 || path != 42 {
+		t.Errorf("qid = %#x %d %d", typ, version, path)
+	}
+	if r.err != nil || len(r.b) != 0 {
+		t.Errorf("decoding left %d bytes and error %v", len(r.b), r.err)
+	}
+	r.uint8()
+	if errnoOf(r.err) != syscall.EINVAL {
+		t.Errorf("reading past the end returned %v, want EINVAL", r.err)
+	}
+}
+
+// p9Client exchanges messages with a p9Conn over a pipe.
+type p9Client struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+// call sends the request `typ` with the body `w` and returns the type and
+// body of the reply.
+func (c *p9Client) call(typ byte, body *p9Writer) (byte, *p9Reader) {
+	c.t.Helper()
+	c.tag++
+	msg := make([]byte, 7, 7+len(body.b))
+	binary.LittleEndian.PutUint32(msg, uint32(7+len(body.b)))
+	msg[4] = typ
+	binary.LittleEndian.PutUint16(msg[5:], c.tag)
+	if _, err := c.conn.Write(append(msg, body.b...)); err != nil {
+		c.t.Fatal(err)
+	}
+	var header [7]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if tag := binary.LittleEndian.Uint16(header[5:]); tag != c.tag {
+		c.t.Fatalf("reply has tag %d, want %d", tag, c.tag)
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(header[:])-7)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		c.t.Fatal(err)
+	}
+	return header[4], &p9Reader{b: reply}
+}
+
+// callErr sends a request expected to fail, and returns the errno of the
+// Rlerror reply.
+func (c *p9Client) callErr(typ byte, body *p9Writer) uint32 {
+	c.t.Helper()
+	rtyp, r := c.call(typ, body)
+	if rtyp != p9Rlerror {
+		c.t.Fatalf("request %d got reply %d, want Rlerror", typ, rtyp)
+	}
+	return r.uint32()
+}
+
+func TestP9Session(t *testing.T) {
+	root := &FileNode{Inode: RootInode, Mode: os.ModeDir | 0755}
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &p9Conn{p9Server: NewP9Server(nil, root), msize: p9MaxMsize, fids: make(map[uint32]*p9Fid)}
+	go c.serve(server)
+	p := &p9Client{t: t, conn: client}
+
+	// The message size is the smaller of both, and unknown versions are
+	// refused.
+	var w p9Writer
+	w.uint32(8192)
+	w.string("9P2000")
+	if typ, r := p.call(p9Tversion, &w); typ != p9Tversion+1 || r.uint32() != 8192 || r.string() != "unknown" {
+		t.Errorf("Tversion 9P2000 got reply %d", typ)
+	}
+	w = p9Writer{}
+	w.uint32(1 << 30)
+	w.string(p9Version)
+	if typ, r := p.call(p9Tversion, &w); typ != p9Tversion+1 || r.uint32() != 8192 || r.string() != p9Version {
+		t.Errorf("Tversion %s got reply %d", p9Version, typ)
+	}
+
+	attach := func(fid uint32) *p9Writer {
+		var w p9Writer
+		w.uint32(fid)
+		w.uint32(^uint32(0)) // No afid.
+		w.string("user")
+		w.string("")
+		w.uint32(1000)
+		return &w
+	}
+	if typ, r := p.call(p9Tattach, attach(1)); typ != p9Tattach+1 || r.uint8() != p9QTDir || r.uint32() != 0 || r.uint64() != RootInode {
+		t.Errorf("Tattach got reply %d", typ)
+	}
+	if errno := p.callErr(p9Tattach, attach(1)); errno != 9 {
+		t.Errorf("attaching to a fid in use failed with %d, want EBADF", errno)
+	}
+
+	fid := func(fid uint32) *p9Writer {
+		var w p9Writer
+		w.uint32(fid)
+		return &w
+	}
+	if errno := p.callErr(p9Treadlink, fid(1)); errno != 22 {
+		t.Errorf("Treadlink of a directory failed with %d, want EINVAL", errno)
+	}
+	if errno := p.callErr(p9Tfsync, fid(2)); errno != 9 {
+		t.Errorf("Tfsync of an unknown fid failed with %d, want EBADF", errno)
+	}
+	if errno := p.callErr(p9Tauth, fid(3)); errno != 95 {
+		t.Errorf("Tauth failed with %d, want ENOTSUP", errno)
+	}
+	if errno := p.callErr(p9Tflush, &p9Writer{}); errno != 22 {
+		t.Errorf("truncated Tflush failed with %d, want EINVAL", errno)
+	}
+
+	// Every lock is granted.
+	w = *fid(1)
+	w.uint8(1) // F_WRLCK.
+	w.uint64(0)
+	w.uint64(10)
+	w.uint32(123)
+	w.string("client")
+	if typ, r := p.call(p9Tgetlock, &w); typ != p9Tgetlock+1 || r.uint8() != 2 || r.uint64() != 0 || r.uint64() != 10 || r.uint32() != 123 || r.string() != "client" {
+		t.Errorf("Tgetlock got reply %d", typ)
+	}
+
+	if typ, _ := p.call(p9Tclunk, fid(1)); typ != p9Tclunk+1 {
+		t.Errorf("Tclunk got reply %d", typ)
+	}
+	if errno := p.callErr(p9Tclunk, fid(1)); errno != 9 {
+		t.Errorf("second Tclunk failed with %d, want EBADF", errno)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build integration
+// +build integration
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPjdfstest runs scripts/pjdfstest.sh on an empty database and fails for
+// each test file of scripts/pjdfstest.pass that no longer passes. Besides
+// SQLFS_TEST_DB (see openTestDB) and a usable FUSE, it needs PJDFSTEST_DIR,
+// a built checkout of pjdfstest, and root, since the tests change owners.
+func TestPjdfstest(t *testing.T) {
+	suite := os.Getenv("PJDFSTEST_DIR")
+	if suite == "" {
+		t.Skip("PJDFSTEST_DIR is not set")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("pjdfstest needs root")
+	}
+	dbURL := createTestDB(t)
+	bin := filepath.Join(t.TempDir(), "sqlfs")
+	if out, err := exec.Command("go", "build", "-o", bin, "../../sqlfs").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build sqlfs: %s\n%s", err, out)
+	}
+
+	cmd := exec.Command("../../scripts/pjdfstest.sh", suite, dbURL)
+	cmd.Env = append(os.Environ(), "SQLFS="+bin)
+	out, err := cmd.CombinedOutput()
+	s := bufio.NewScanner(bytes.NewReader(out))
+	var regressions int
+	for s.Scan() {
+		switch line := s.Text(); {
+		case strings.HasPrefix(line, "REGRESSION "):
+			t.Errorf("%s no longer passes", strings.TrimPrefix(line, "REGRESSION "))
+			regressions++
+		default:
+			t.Log(line)
+		}
+	}
+	if err != nil && regressions == 0 {
+		// The run itself failed, or the pass list is empty.
+		t.Fatalf("scripts/pjdfstest.sh failed: %s", err)
+	}
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A storage policy tags a directory with how the files below it are
+// stored, e.g. "tier=never,replicate=us-west1". It is kept in the extended
+// attribute policyXattr of the directory, and each key applies to the whole
+// subtree unless a subdirectory sets it again:
+//   - compress=none|zstd records the codec the contents should be stored
+//     with; it is only recorded, as contents are stored uncompressed;
+//   - tier=never keeps the files in the database, and tier=SCHEME, e.g.
+//     s3, only lets `sqlfs tier` move them to object stores of that scheme;
+//   - replicate=REGION makes `sqlfs policy -apply` home the data blocks of
+//     the files in that region of a multi-region cluster (see regions.go).
+const policyXattr = "trusted.sqlfs.policy"
+
+// Values accepted for the keys of a policy. An empty list accepts any
+// value.
+var policyKeys = map[string][]string{
+	"compress":  {"none", "zstd"},
+	"tier":      nil,
+	"replicate": nil,
+}
+
+// StoragePolicy maps the keys of a policy to their values.
+type StoragePolicy map[string]string
+
+// ParsePolicy parses comma-separated KEY=VALUE pairs.
+func ParsePolicy(s string) (StoragePolicy, error) {
+	p := make(StoragePolicy)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		eq := strings.IndexByte(pair, '=')
+		if eq <= 0 || eq == len(pair)-1 {
+			return nil, errors.Errorf("invalid policy %q, expected KEY=VALUE", pair)
+		}
+		key, value := pair[:eq], pair[eq+1:]
+		allowed, ok := policyKeys[key]
+		if !ok {
+			return nil, errors.Errorf("unknown policy key %q, expected compress, tier or replicate", key)
+		}
+		if len(allowed) > 0 && !containsString(allowed, value) {
+			return nil, errors.Errorf("invalid %s policy %q, expected one of %s", key, value, strings.Join(allowed, ", "))
+		}
+		p[key] = value
+	}
+	return p, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the policy as ParsePolicy expects it, with sorted keys.
+func (p StoragePolicy) String() string {
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + p[key]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Inherit returns the policy of a directory whose own policy is `own`,
+// below a directory with the policy `p`.
+func (p StoragePolicy) Inherit(own StoragePolicy) StoragePolicy {
+	merged := make(StoragePolicy, len(p)+len(own))
+	for key, value := range p {
+		merged[key] = value
+	}
+	for key, value := range own {
+		merged[key] = value
+	}
+	return merged
+}
+
+// GetPolicy returns the policy set on `inode` itself, nil if it has none.
+func GetPolicy(ctx context.Context, db *DB, inode uint64) (StoragePolicy, error) {
+	value, err := GetXattr(ctx, db, inode, policyXattr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the policy of inode %d", inode)
+	}
+	return ParsePolicy(string(value))
+}
+
+// PutPolicy sets the policy of the directory `inode`, or removes it if `p`
+// is empty.
+func PutPolicy(ctx context.Context, db *DB, inode uint64, p StoragePolicy) error {
+	if len(p) == 0 {
+		err := RemoveXattr(ctx, db, inode, policyXattr)
+		if err == errNoXattr {
+			return nil
+		}
+		return err
+	}
+	return SetXattr(ctx, db, inode, policyXattr, []byte(p.String()), 0)
+}
+
+// EffectivePolicy returns the policy applying to `inode`: the policies of
+// the directories above it, the nearest one taking precedence for each key,
+// and then its own. If a file has several links, the policies above all of
+// them apply.
+func EffectivePolicy(ctx context.Context, db *DB, inode uint64) (StoragePolicy, error) {
+	q := `WITH RECURSIVE up (inode, depth) AS (
+    SELECT $1::INT8, 0
+  UNION ALL
+    SELECT tree.parent, up.depth + 1
+    FROM up JOIN tree ON tree.inode = up.inode
+    WHERE up.inode != $2 AND up.depth < 4096
+  )
+  SELECT xattrs.value FROM up
+  JOIN xattrs ON xattrs.inode = up.inode AND xattrs.name = $3
+  ORDER BY up.depth DESC`
+	rows, err := db.QueryContext(ctx, q, inode, RootInode, policyXattr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the policies above inode %d", inode)
+	}
+	defer rows.Close()
+	p := make(StoragePolicy)
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		own, err := ParsePolicy(string(value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid policy above inode %d", inode)
+		}
+		p = p.Inherit(own)
+	}
+	return p, rows.Err()
+}
+
+// AllowsTier returns whether the policy lets files be moved to an object
+// store of the scheme `scheme`.
+func (p StoragePolicy) AllowsTier(scheme string) bool {
+	tier, ok := p["tier"]
+	return !ok || tier == scheme
+}
+
+// SetBlockRegion homes the data blocks of `inode` in `region`, returning
+// the number of blocks moved. The data_blocks table must be REGIONAL BY
+// ROW.
+func SetBlockRegion(ctx context.Context, db *DB, inode uint64, region string) (int64, error) {
+	q := "UPDATE data_blocks SET crdb_region = $2 WHERE inode = $1 AND crdb_region != $2"
+	res, err := db.ExecContext(ctx, q, inode, region)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to move the blocks of inode %d to %s", inode, region)
+	}
+	return res.RowsAffected()
+}
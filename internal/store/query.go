@@ -0,0 +1,232 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fuseFS "bazil.org/fuse/fs"
+	"github.com/pkg/errors"
+)
+
+// The query file is a file at the root of the mount that searches the tree
+// with the predicates of `sqlfs find`, evaluated by the database instead of
+// walking the mount. A query is written to it, and the paths of the
+// matching entries, relative to the root of the mount, are then read from
+// the same open file, one per line:
+//
+//	exec 3<>.query
+//	echo '-name *.log -size +10M var/log' >&3
+//	cat <&3
+//
+// A query is the flags and the optional directory of `sqlfs find`, the
+// whole mount by default, separated by spaces. The file cannot be seeked:
+// each write replaces the results with those of the new query, which are
+// then read from their start. Callers other than root only get the entries
+// they could find by listing the directories above them.
+//
+// It is not stored: it shadows an entry of the same name at the root, which
+// cannot be created through the mount.
+const QueryFileName = ".query"
+
+// Inode number of the query file, after those of the snapshots directory.
+const queryInode = statusInode | 1<<60
+
+// isQueryFile returns whether the entry `name` of the directory `parent` is
+// the query file.
+func (fs fileSystem) isQueryFile(parent uint64, name string) bool {
+	return fs.queryFile && name == QueryFileName && fs.isMountRoot(parent)
+}
+
+// queryFileNode is the query file.
+type queryFileNode struct {
+	fs *fileSystem
+}
+
+// Attr implements the fuseFS.Node interface.
+func (f *queryFileNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Inode = queryInode
+	attr.Mode = 0666
+	attr.Nlink = 1
+	attr.Mtime = time.Now()
+	attr.Ctime = attr.Mtime
+	attr.Atime = attr.Mtime
+	return nil
+}
+
+// Open implements the fuseFS.NodeOpener interface.
+func (f *queryFileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fuseFS.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO | fuse.OpenNonSeekable
+	return &queryHandle{fs: f.fs}, nil
+}
+
+// Setattr implements the fuseFS.NodeSetattrer interface, so that the file
+// can be opened with O_TRUNC, as shells do for `>`.
+func (f *queryFileNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return nil
+}
+
+// queryHandle is an open query file, holding the results of the last query
+// written to it. As the file cannot be seeked, reads ignore their offset
+// and continue where the previous one stopped.
+type queryHandle struct {
+	fs *fileSystem
+
+	mu      sync.Mutex
+	results []byte
+	read    int // Bytes of results already read.
+}
+
+// Write implements the fuseFS.HandleWriter interface.
+func (h *queryHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	results, err := h.fs.runQuery(ctx, strings.TrimSpace(string(req.Data)), &req.Header)
+	if err != nil {
+		if _, ok := err.(fuse.ErrorNumber); !ok {
+			log.Printf("%s: %s\n", QueryFileName, err)
+		}
+		return errnoFromErr(ctx, err)
+	}
+	h.mu.Lock()
+	h.results, h.read = results, 0
+	h.mu.Unlock()
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Read implements the fuseFS.HandleReader interface.
+func (h *queryHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	end := h.read + req.Size
+	if end > len(h.results) {
+		end = len(h.results)
+	}
+	resp.Data = h.results[h.read:end]
+	h.read = end
+	return nil
+}
+
+// runQuery runs `query` for the caller of `hdr`, and returns the paths of
+// the matching entries, one per line.
+func (fs *fileSystem) runQuery(ctx context.Context, query string, hdr *fuse.Header) ([]byte, error) {
+	predicates, args, err := parseFindArgs(strings.Fields(query))
+	if err != nil || len(args) > 1 {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	f, err := predicates.Filter(time.Now())
+	if err != nil {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	dirArg := ""
+	if len(args) == 1 {
+		dirArg = args[0]
+	}
+	names, err := splitPath(dirArg)
+	if err != nil {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+
+	// The directories from the root of the mount down to the one searched.
+	root := fs.root
+	if root == 0 {
+		root = RootInode
+	}
+	dir := &FileNode{Inode: root, Mode: os.ModeDir}
+	var chain []*FileNode
+	for _, name := range names {
+		if !dir.IsDirectory() {
+			return nil, fuse.Errno(syscall.ENOTDIR)
+		}
+		dir, err = GetNodeByName(ctx, fs.db, dir.Inode, name)
+		if err == sql.ErrNoRows {
+			return nil, fuse.ENOENT
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, dir)
+	}
+	if !dir.IsDirectory() {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	nodes, err := FindNodes(ctx, fs.db, dir.Inode, f)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Uid != 0 {
+		if nodes, err = fs.visibleNodes(ctx, dir, chain, nodes, hdr); err != nil {
+			return nil, err
+		}
+	}
+
+	var b bytes.Buffer
+	prefix := path.Join(names...)
+	for _, n := range nodes {
+		b.WriteString(path.Join(prefix, n.Name))
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// visibleNodes returns the nodes of `nodes`, found below `dir`, that the
+// caller of `hdr` may list and search every directory above of, from the
+// root of the mount down. `chain` holds the directories from the root of
+// the mount to `dir`, which is last, excluding the root itself.
+func (fs *fileSystem) visibleNodes(ctx context.Context, dir *FileNode, chain, nodes []*FileNode, hdr *fuse.Header) ([]*FileNode, error) {
+	allowed := make(map[uint64]bool)
+	permitted := func(d *FileNode) (bool, error) {
+		if ok, checked := allowed[d.Inode]; checked {
+			return ok, nil
+		}
+		acl, err := GetACL(ctx, fs.db, d.Inode, ACLAccessXattr)
+		if err != nil {
+			return false, err
+		}
+		ok := fs.checkAccess(d, acl, hdr, aclRead|aclExecute) == nil
+		allowed[d.Inode] = ok
+		return ok, nil
+	}
+	for _, d := range chain {
+		if ok, err := permitted(d); err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	// The directories below `dir`, by their path relative to it.
+	dirs, err := FindNodes(ctx, fs.db, dir.Inode, FindFilter{HasType: true, Type: os.ModeDir})
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*FileNode, len(dirs))
+	for _, d := range dirs {
+		byPath[d.Name] = d
+	}
+	var visible []*FileNode
+nodes:
+	for _, n := range nodes {
+		for p := path.Dir(n.Name); p != "."; p = path.Dir(p) {
+			d, ok := byPath[p]
+			if !ok {
+				// Moved away since the search.
+				continue nodes
+			}
+			ok, err := permitted(d)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to check the permissions of %s", p)
+			}
+			if !ok {
+				continue nodes
+			}
+		}
+		visible = append(visible, n)
+	}
+	return visible, nil
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// runQueryFile writes `query` to a new handle of the query file of `fs` as
+// `uid`, and returns what reads from it return.
+func runQueryFile(t *testing.T, fs *fileSystem, uid uint32, query string) (string, error) {
+	t.Helper()
+	ctx := context.Background()
+	h := &queryHandle{fs: fs}
+	req := &fuse.WriteRequest{Header: fuse.Header{Uid: uid}, Data: []byte(query + "\n")}
+	if err := h.Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+		return "", err
+	}
+	var out []byte
+	for {
+		// Offsets are ignored, as the file cannot be seeked.
+		resp := &fuse.ReadResponse{}
+		if err := h.Read(ctx, &fuse.ReadRequest{Offset: 12345, Size: 7}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) == 0 {
+			return string(out), nil
+		}
+		out = append(out, resp.Data...)
+	}
+}
+
+func TestQueryFileInvalid(t *testing.T) {
+	fs := &fileSystem{queryFile: true}
+	for _, query := range []string{
+		"-bogus",
+		"-type x",
+		"-size +lots",
+		"-mtime soon",
+		"dir other",
+		"../outside",
+	} {
+		if _, err := runQueryFile(t, fs, 0, query); err != fuse.Errno(syscall.EINVAL) {
+			t.Errorf("query %q returned %v, want EINVAL", query, err)
+		}
+	}
+}
+
+func TestQueryFile(t *testing.T) {
+	root := newTestRoot(t)
+	fs, db := root.fs, root.fs.db
+	fs.queryFile = true
+	ctx := context.Background()
+	mkdir := func(parent *FileNode, name string, mode os.FileMode) *FileNode {
+		n, err := CreateNode(ctx, db, parent, name, os.ModeDir|mode, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	create := func(parent *FileNode, name string) {
+		if _, err := CreateNode(ctx, db, parent, name, 0644, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logs := mkdir(root, "logs", 0755)
+	create(logs, "a.log")
+	create(logs, "b.txt")
+	private := mkdir(root, "private", 0700)
+	create(private, "c.log")
+	create(root, "d.log")
+
+	for _, tc := range []struct {
+		uid   uint32
+		query string
+		want  string
+	}{
+		{0, "-name *.log", "d.log\nlogs/a.log\nprivate/c.log\n"},
+		{0, "-name *.log logs", "logs/a.log\n"},
+		{0, "-type d", "logs\nprivate\n"},
+		{0, "-name *.none", ""},
+		// Entries below directories the caller cannot list are left out.
+		{1000, "-name *.log", "d.log\nlogs/a.log\n"},
+		{1000, "-name *.log private", ""},
+	} {
+		got, err := runQueryFile(t, fs, tc.uid, tc.query)
+		if err != nil || got != tc.want {
+			t.Errorf("query %q as uid %d = %q, %v, want %q", tc.query, tc.uid, got, err, tc.want)
+		}
+	}
+	if _, err := runQueryFile(t, fs, 0, "missing"); err != fuse.ENOENT {
+		t.Errorf("query of a missing directory returned %v, want ENOENT", err)
+	}
+	if _, err := runQueryFile(t, fs, 0, "d.log"); err != fuse.Errno(syscall.ENOTDIR) {
+		t.Errorf("query of a file returned %v, want ENOTDIR", err)
+	}
+
+	found, err := root.Lookup(ctx, QueryFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := found.(*queryFileNode); !ok {
+		t.Errorf("%s looked up as %T", QueryFileName, found)
+	}
+	if err := fs.checkName(ctx, root.Inode, QueryFileName); err != fuse.EPERM {
+		t.Errorf("creating %s returned %v, want EPERM", QueryFileName, err)
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Number of inodes and entries sampled by QuickCheck to estimate how many
+// are orphaned or dangling.
+const quickCheckSample = 10000
+
+// requiredColumns are the columns the file system reads and writes, by
+// table. They must match the definitions in schemaStatements.
+var requiredColumns = map[string][]string{
+	"tree":        {"inode", "parent", "name"},
+	"inodes":      append([]string{"inode"}, strings.Split(inodeColumns, ", ")...),
+	"data_blocks": {"inode", "sequence", "data"},
+}
+
+// QuickCheck runs a fast sanity pass over the file system before it is
+// mounted, in a few queries regardless of its size. It returns an error if
+// the file system is damaged in a way that mounting could make worse, and
+// warnings for damage that `sqlfs fsck` should look into but that does not
+// prevent mounting. Superblock mismatches are already refused when the
+// database is opened.
+func QuickCheck(ctx context.Context, db *DB) (warnings []string, err error) {
+	if err := checkColumns(ctx, db); err != nil {
+		return nil, err
+	}
+
+	// New inode numbers would collide with existing inodes.
+	var next, highest int64
+	q1 := "SELECT last_value FROM inode_seq"
+	if err := db.QueryRowContext(ctx, q1).Scan(&next); err != nil {
+		return nil, errors.Wrap(err, "failed to read inode_seq")
+	}
+	q2 := "SELECT COALESCE(MAX(inode), 0) FROM inodes"
+	if err := db.QueryRowContext(ctx, q2).Scan(&highest); err != nil {
+		return nil, errors.Wrap(err, "failed to read the highest inode")
+	}
+	if next < highest {
+		return nil, errors.Errorf("inode_seq (%d) is behind the highest inode (%d), so new files would overwrite existing ones", next, highest)
+	}
+
+	// The root directory has no row of its own and no entry refers to it.
+	var rootEntries int
+	q3 := "SELECT COUNT(*) FROM tree WHERE inode = $1"
+	if err := db.QueryRowContext(ctx, q3, RootInode).Scan(&rootEntries); err != nil {
+		return nil, errors.Wrap(err, "failed to check the root directory")
+	}
+	if rootEntries > 0 {
+		return nil, errors.Errorf("%d entries refer to the root directory", rootEntries)
+	}
+
+	sb, err := GetSuperblock(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if sb == nil {
+		warnings = append(warnings, "the file system has no superblock, run `sqlfs init` to add one")
+	}
+
+	var orphans int
+	q4 := `SELECT COUNT(*) FROM (SELECT inode FROM inodes LIMIT $1) AS sample
+  WHERE NOT EXISTS (SELECT 1 FROM tree WHERE tree.inode = sample.inode)`
+	if err := db.QueryRowContext(ctx, q4, quickCheckSample).Scan(&orphans); err != nil {
+		return nil, errors.Wrap(err, "failed to sample orphaned inodes")
+	}
+	if orphans > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d of up to %d sampled inodes are orphaned", orphans, quickCheckSample))
+	}
+
+	var dangling int
+	q5 := `SELECT COUNT(*) FROM (SELECT inode FROM tree LIMIT $1) AS sample
+  WHERE NOT EXISTS (SELECT 1 FROM inodes WHERE inodes.inode = sample.inode)`
+	if err := db.QueryRowContext(ctx, q5, quickCheckSample).Scan(&dangling); err != nil {
+		return nil, errors.Wrap(err, "failed to sample dangling entries")
+	}
+	if dangling > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d of up to %d sampled entries refer to missing inodes", dangling, quickCheckSample))
+	}
+	return warnings, nil
+}
+
+// checkColumns ensures that the tables of the file system have the columns
+// this binary uses, e.g. that they were not altered by hand or by another
+// version.
+func checkColumns(ctx context.Context, db *DB) error {
+	q := `SELECT table_name, column_name FROM information_schema.columns
+  WHERE table_catalog = current_database() AND table_schema = current_schema()`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the database schema")
+	}
+	defer rows.Close()
+
+	present := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return errors.Wrap(err, "failed to read the database schema")
+		}
+		present[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to read the database schema")
+	}
+	var missing []string
+	for table, columns := range requiredColumns {
+		for _, column := range columns {
+			if !present[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.Errorf("the database schema has drifted, missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
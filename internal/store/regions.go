@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// On a multi-region CockroachDB cluster, every path lookup reads the tree and
+// the inodes, so these are made GLOBAL tables: they can be read with low
+// latency from every region, at the cost of slower writes. Data blocks are
+// made REGIONAL BY ROW: each row is stored in the region of the node that
+// wrote it, i.e. the gateway the writing mount is connected to, so reading
+// back what a mount wrote stays within its region.
+
+// Tables made GLOBAL by SetMultiRegion.
+var globalTables = []string{"tree", "inodes", "xattrs", "settings", "superblock"}
+
+// SetMultiRegion adds `regions` to the database holding the file system, the
+// first one becoming its primary region, and places the tables as described
+// above. The regions must be those of the nodes of the cluster, as listed by
+// SHOW REGIONS FROM CLUSTER.
+func SetMultiRegion(ctx context.Context, db *DB, regions []string) error {
+	if len(regions) == 0 {
+		return errors.New("no regions given")
+	}
+	var name string
+	if err := db.QueryRowContext(ctx, "SELECT current_database()").Scan(&name); err != nil {
+		return errors.Wrap(err, "failed to read the name of the database")
+	}
+	database := pq.QuoteIdentifier(name)
+	statements := []string{"ALTER DATABASE " + database + " PRIMARY REGION " + pq.QuoteIdentifier(regions[0])}
+	for _, region := range regions[1:] {
+		statements = append(statements, "ALTER DATABASE "+database+" ADD REGION IF NOT EXISTS "+pq.QuoteIdentifier(region))
+	}
+	for _, table := range globalTables {
+		statements = append(statements, "ALTER TABLE "+table+" SET LOCALITY GLOBAL")
+	}
+	statements = append(statements, "ALTER TABLE data_blocks SET LOCALITY REGIONAL BY ROW")
+	for _, q := range statements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q", q)
+		}
+	}
+	return nil
+}
+
+// ParseRegions parses a comma-separated list of regions.
+func ParseRegions(s string) ([]string, error) {
+	var regions []string
+	for _, region := range strings.Split(s, ",") {
+		region = strings.TrimSpace(region)
+		if region == "" {
+			return nil, errors.Errorf("invalid list of regions %q", s)
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
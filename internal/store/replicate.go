@@ -0,0 +1,353 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// How often the changefeed reports that all changes up to a timestamp were
+// emitted.
+const replicateResolvedInterval = "10s"
+
+// cursorPattern matches the HLC timestamps reported as resolved, e.g.
+// "1546300800000000000.0000000001".
+var cursorPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// replicatedTable is a table whose rows are copied to the secondary as
+// they are, keyed by the columns `key`.
+type replicatedTable struct {
+	name string
+	key  []string
+
+	// create creates the table on the secondary. It is set for the tables
+	// only created by some options of `sqlfs init`, which are replicated if
+	// the primary has them.
+	create func(context.Context, *DB) error
+}
+
+// copiedTables are replicated row by row, in addition to the tree, the
+// inodes and the data blocks, which need special handling. Leases are not
+// replicated: they are held by the mounts of the primary, and would keep
+// the secondary from being mounted once it takes over. Snapshots are
+// replicated, but their timestamps are resolved against the history of the
+// secondary, which trails the primary by the replication lag.
+var copiedTables = []replicatedTable{
+	{name: "settings", key: []string{"name"}},
+	{name: "superblock", key: []string{"id"}},
+	{name: "xattrs", key: []string{"inode", "name"}},
+	{name: "tiered_files", key: []string{"inode"}, create: CreateTiering},
+	{name: "snapshots", key: []string{"name"}, create: CreateSnapshots},
+	{name: "ops_log", key: []string{"id"}, create: CreateJournal},
+	{name: "file_text", key: []string{"inode"}, create: CreateContentIndex},
+	{name: "file_hashes", key: []string{"inode"}, create: CreateFileHashes},
+}
+
+// replicator copies the file system from a primary database to a secondary
+// one, following a CockroachDB changefeed on the primary.
+//
+// Changefeed events only tell which rows changed: the current version of
+// each row is read back from the primary and written to the secondary, or
+// deleted from it if the row is gone. Events may therefore be applied out
+// of order or more than once, and the secondary converges to the primary.
+type replicator struct {
+	src, dst *DB
+
+	// Highest inode number written to the secondary, which keeps inode_seq
+	// ahead of it so that the secondary can take over.
+	maxInode uint64
+
+	// Whether the file system stores small files inline, in which case
+	// their data comes with the inodes rather than the data blocks.
+	inlineData bool
+
+	// Tables of copiedTables that the primary has, by name.
+	tables map[string]replicatedTable
+}
+
+// NewReplicator returns a replicator from `src` to `dst`, after creating
+// the schema of the file system on `dst`, including the optional tables
+// that `src` has.
+func NewReplicator(ctx context.Context, src, dst *DB) (*replicator, error) {
+	if err := createSchema(ctx, dst); err != nil {
+		return nil, err
+	}
+	inline, err := getInlineDataSize(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	if inline > 0 {
+		if err := EnableInlineData(ctx, dst, inline); err != nil {
+			return nil, err
+		}
+	}
+	r := &replicator{src: src, dst: dst, inlineData: inline > 0, tables: map[string]replicatedTable{}}
+	for _, t := range copiedTables {
+		if t.create != nil {
+			exists, err := TableExists(ctx, src, t.name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to check for table %s", t.name)
+			}
+			if !exists {
+				continue
+			}
+			if err := t.create(ctx, dst); err != nil {
+				return nil, err
+			}
+		}
+		r.tables[t.name] = t
+	}
+	return r, nil
+}
+
+// changefeedEvent is a row emitted by a core changefeed. Table and Key are
+// NULL for resolved timestamps.
+type changefeedEvent struct {
+	Table sql.NullString
+	Key   []byte
+	Value []byte
+}
+
+// Run replicates changes until `ctx` is canceled. Without a `cursor`, all
+// rows are copied first; otherwise replication resumes after the resolved
+// timestamp `cursor`. `resolved` is called with each new resolved
+// timestamp once all prior changes are applied to the secondary.
+func (r *replicator) Run(ctx context.Context, cursor string, resolved func(ts string) error) error {
+	tables := []string{"tree", "inodes", "data_blocks"}
+	for _, t := range copiedTables {
+		if _, ok := r.tables[t.name]; ok {
+			tables = append(tables, t.name)
+		}
+	}
+	q := "EXPERIMENTAL CHANGEFEED FOR " + strings.Join(tables, ", ") + " WITH resolved = '" + replicateResolvedInterval + "'"
+	if cursor != "" {
+		if !cursorPattern.MatchString(cursor) {
+			return errors.Errorf("invalid cursor %q", cursor)
+		}
+		q += ", cursor = '" + cursor + "'"
+	}
+	rows, err := r.src.QueryContext(ctx, q)
+	if err != nil {
+		return errors.Wrap(err, "failed to start the changefeed (is kv.rangefeed.enabled set?)")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e changefeedEvent
+		if err := rows.Scan(&e.Table, &e.Key, &e.Value); err != nil {
+			return errors.Wrap(err, "failed to scan changefeed event")
+		}
+		if !e.Table.Valid {
+			var msg struct {
+				Resolved string `json:"resolved"`
+			}
+			if err := json.Unmarshal(e.Value, &msg); err != nil {
+				return errors.Wrap(err, "failed to decode resolved timestamp")
+			}
+			if err := resolved(msg.Resolved); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.apply(ctx, e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// apply copies the row of `e` from the primary to the secondary.
+func (r *replicator) apply(ctx context.Context, e changefeedEvent) error {
+	key, err := decodeChangefeedKey(e.Key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode key %s of table %s", e.Key, e.Table.String)
+	}
+	switch {
+	case e.Table.String == "tree" && len(key) == 1:
+		return r.applyTree(ctx, key[0])
+	case e.Table.String == "inodes" && len(key) == 1:
+		return r.applyInode(ctx, key[0])
+	case e.Table.String == "data_blocks" && len(key) == 2:
+		return r.applyBlock(ctx, key[0], key[1])
+	}
+	if t, ok := r.tables[e.Table.String]; ok && len(key) == len(t.key) {
+		return r.applyRow(ctx, t, key)
+	}
+	return fmt.Errorf("unexpected changefeed key %s for table %s", e.Key, e.Table.String)
+}
+
+// decodeChangefeedKey decodes a changefeed key, a JSON array of the primary
+// key columns, into the text of each column. Numbers are kept as text, as
+// the hidden rowid of the tree table does not fit in a float64.
+func decodeChangefeedKey(b []byte) ([]string, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	key := make([]string, len(raw))
+	for i, v := range raw {
+		if len(v) > 0 && v[0] == '"' {
+			if err := json.Unmarshal(v, &key[i]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var n json.Number
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		if err := d.Decode(&n); err != nil {
+			return nil, err
+		}
+		key[i] = n.String()
+	}
+	return key, nil
+}
+
+// applyRow copies the row of `t` with the primary key `key` from the
+// primary to the secondary, or deletes it from the secondary if it is gone.
+// Column values are written back as the driver read them, the types of the
+// placeholders being those of the columns.
+func (r *replicator) applyRow(ctx context.Context, t replicatedTable, key []string) error {
+	var conds []string
+	args := make([]interface{}, len(key))
+	for i, c := range t.key {
+		conds = append(conds, fmt.Sprintf("%s = $%d", c, i+1))
+		args[i] = key[i]
+	}
+	where := strings.Join(conds, " AND ")
+
+	rows, err := r.src.QueryContext(ctx, "SELECT * FROM "+t.name+" WHERE "+where, args...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s row %v", t.name, key)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s row %v", t.name, key)
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return errors.Wrapf(err, "failed to read %s row %v", t.name, key)
+		}
+		_, err := r.dst.ExecContext(ctx, "DELETE FROM "+t.name+" WHERE "+where, args...)
+		return errors.Wrapf(err, "failed to delete %s row %v", t.name, key)
+	}
+	values := make([]interface{}, len(columns))
+	fields := make([]interface{}, len(columns))
+	placeholders := make([]string, len(columns))
+	for i := range values {
+		fields[i] = &values[i]
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	if err := rows.Scan(fields...); err != nil {
+		return errors.Wrapf(err, "failed to read %s row %v", t.name, key)
+	}
+	q := fmt.Sprintf("UPSERT INTO %s (%s) VALUES (%s)",
+		t.name, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	_, err = r.dst.ExecContext(ctx, q, values...)
+	return errors.Wrapf(err, "failed to write %s row %v", t.name, key)
+}
+
+func (r *replicator) applyTree(ctx context.Context, rowid string) error {
+	var inode, parent uint64
+	var name string
+	q1 := "SELECT inode, parent, name FROM tree WHERE rowid = $1"
+	err := r.src.QueryRowContext(ctx, q1, rowid).Scan(&inode, &parent, &name)
+	if err == sql.ErrNoRows {
+		q2 := "DELETE FROM tree WHERE rowid = $1"
+		_, err := r.dst.ExecContext(ctx, q2, rowid)
+		return errors.Wrapf(err, "failed to delete tree entry %s", rowid)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read tree entry %s", rowid)
+	}
+
+	tx, err := r.dst.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	// An entry with the same name may still exist on the secondary if it was
+	// removed or renamed on the primary and that event was not applied yet.
+	q3 := "DELETE FROM tree WHERE parent = $1 AND name = $2 AND rowid != $3"
+	if _, err := tx.ExecContext(ctx, q3, parent, name, rowid); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to replace tree entry %s", rowid)
+	}
+	q4 := "UPSERT INTO tree (rowid, inode, parent, name) VALUES ($1, $2, $3, $4)"
+	if _, err := tx.ExecContext(ctx, q4, rowid, inode, parent, name); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to write tree entry %s", rowid)
+	}
+	if inode > r.maxInode {
+		q5 := "SELECT setval('inode_seq', $1)"
+		if _, err := tx.ExecContext(ctx, q5, inode); err != nil {
+			_ = tx.Rollback()
+			return errors.Wrap(err, "failed to advance inode_seq")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if inode > r.maxInode {
+		r.maxInode = inode
+	}
+	return nil
+}
+
+func (r *replicator) applyInode(ctx context.Context, inode string) error {
+	n := &FileNode{}
+	q1 := "SELECT inode, " + inodeColumns + " FROM inodes WHERE inode = $1"
+	err := r.src.QueryRowContext(ctx, q1, inode).Scan(append([]interface{}{&n.Inode}, inodeFields(n)...)...)
+	if err == sql.ErrNoRows {
+		q2 := "DELETE FROM inodes WHERE inode = $1"
+		_, err := r.dst.ExecContext(ctx, q2, inode)
+		return errors.Wrapf(err, "failed to delete inode %s", inode)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read inode %s", inode)
+	}
+	if err := putInode(ctx, r.dst, n); err != nil {
+		return errors.Wrapf(err, "failed to write inode %s", inode)
+	}
+	if r.inlineData {
+		if err := copyInlineData(ctx, r.src.DB, r.dst, inode); err != nil {
+			return err
+		}
+	}
+	return putGeneration(ctx, r.dst, n)
+}
+
+func (r *replicator) applyBlock(ctx context.Context, inode, sequence string) error {
+	var data []byte
+	q1 := "SELECT data FROM data_blocks WHERE inode = $1 AND sequence = $2"
+	err := r.src.QueryRowContext(ctx, q1, inode, sequence).Scan(&data)
+	if err == sql.ErrNoRows {
+		q2 := "DELETE FROM data_blocks WHERE inode = $1 AND sequence = $2"
+		_, err := r.dst.ExecContext(ctx, q2, inode, sequence)
+		return errors.Wrapf(err, "failed to delete block %s of inode %s", sequence, inode)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block %s of inode %s", sequence, inode)
+	}
+	q3 := "UPSERT INTO data_blocks (inode, sequence, data) VALUES ($1, $2, $3)"
+	_, err = r.dst.ExecContext(ctx, q3, inode, sequence, data)
+	return errors.Wrapf(err, "failed to write block %s of inode %s", sequence, inode)
+}
+
+// LogResolved returns a resolved timestamp callback that logs progress.
+func LogResolved(next func(ts string) error) func(ts string) error {
+	return func(ts string) error {
+		log.Printf("Replicated all changes up to %s.\n", ts)
+		return next(ts)
+	}
+}
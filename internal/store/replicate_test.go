@@ -0,0 +1,30 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeChangefeedKey(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		want []string
+	}{
+		{`[412881036749406209]`, []string{"412881036749406209"}},
+		{`[7, 3]`, []string{"7", "3"}},
+		{`["block_size"]`, []string{"block_size"}},
+		{`[12, "user.comment"]`, []string{"12", "user.comment"}},
+	} {
+		got, err := decodeChangefeedKey([]byte(tc.key))
+		if err != nil {
+			t.Errorf("decodeChangefeedKey(%s): %v", tc.key, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("decodeChangefeedKey(%s) = %q, want %q", tc.key, got, tc.want)
+		}
+	}
+	if _, err := decodeChangefeedKey([]byte(`{"inode": 1}`)); err == nil {
+		t.Error("decodeChangefeedKey accepted an object")
+	}
+}
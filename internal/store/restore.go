@@ -0,0 +1,380 @@
+package store
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Number of rows written per transaction by restores.
+const restoreBatchRows = 500
+
+// restorer loads backups into a database, see backup.go. Backups are
+// restored in order, starting with a full backup: incremental backups
+// replace all the metadata, and only the data blocks that changed, removing
+// those they do not list.
+type restorer struct {
+	ctx context.Context
+	db  *DB
+
+	tx      *fsTx
+	pending int
+
+	header *BackupHeader
+	stage  string
+	// Inodes with blocks listed in an incremental backup: the blocks of the
+	// others are removed.
+	listed map[uint64]bool
+	// The inode whose blocks are being restored, and their sequences.
+	inode     uint64
+	sequences []int64
+
+	maxInode uint64
+	stats    BackupStats
+}
+
+// RestoreBackups loads the backups at `paths`, a full backup followed by
+// incremental backups each based on the one before, into the empty
+// database `db`.
+func RestoreBackups(ctx context.Context, db *DB, paths []string) (BackupStats, error) {
+	// The chain is checked before anything is written.
+	if _, err := CheckBackupChain(paths, false); err != nil {
+		return BackupStats{}, err
+	}
+
+	if err := createSchema(ctx, db); err != nil {
+		return BackupStats{}, err
+	}
+	var used bool
+	q := "SELECT EXISTS (SELECT 1 FROM tree) OR EXISTS (SELECT 1 FROM inodes)"
+	if err := db.QueryRowContext(ctx, q).Scan(&used); err != nil {
+		return BackupStats{}, err
+	}
+	if used {
+		return BackupStats{}, errors.New("the database already holds a file system, restore into an empty one")
+	}
+
+	rs := &restorer{ctx: ctx, db: db}
+	for _, path := range paths {
+		if err := rs.restore(path); err != nil {
+			rs.rollback()
+			return rs.stats, errors.Wrapf(err, "failed to restore %s", path)
+		}
+	}
+	if rs.maxInode > 0 {
+		if _, err := db.ExecContext(ctx, "SELECT setval('inode_seq', $1)", rs.maxInode); err != nil {
+			return rs.stats, errors.Wrap(err, "failed to advance inode_seq")
+		}
+	}
+	return rs.stats, nil
+}
+
+// restore loads the backup at `path`.
+func (rs *restorer) restore(path string) error {
+	r, h, err := OpenBackup(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rs.header = h
+	rs.stage = ""
+	rs.listed = make(map[uint64]bool)
+	rs.inode, rs.sequences = 0, nil
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case rec.Cursor != nil:
+			if rec.Cursor.Stage != rs.stage {
+				if err := rs.enterStage(rec.Cursor.Stage); err != nil {
+					return err
+				}
+			}
+		case rec.Setting != nil:
+			err = rs.restoreSetting(rec.Setting)
+		case rec.Inode != nil:
+			err = rs.restoreInode(rec.Inode)
+		case rec.Entry != nil:
+			e := rec.Entry
+			rs.stats.Entries++
+			err = rs.exec("INSERT INTO tree (inode, parent, name) VALUES ($1, $2, $3)", e.Inode, e.Parent, e.Name)
+		case rec.Xattr != nil:
+			x := rec.Xattr
+			rs.stats.Xattrs++
+			err = rs.exec("INSERT INTO xattrs (inode, name, value) VALUES ($1, $2, $3)", x.Inode, x.Name, x.Value)
+		case rec.Tiered != nil:
+			t := rec.Tiered
+			err = rs.exec("INSERT INTO tiered_files (inode, object, size) VALUES ($1, $2, $3)", t.Inode, t.Object, t.Size)
+		case rec.Block != nil:
+			err = rs.restoreBlock(rec.Block)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if r.cursor == nil || r.cursor.Stage != backupDone {
+		return errors.New("the backup is incomplete, resume it with `sqlfs backup -resume`")
+	}
+	return nil
+}
+
+// enterStage prepares the restore of the rows of the backup stage `stage`,
+// once those of the previous stage were all restored.
+func (rs *restorer) enterStage(stage string) error {
+	if err := rs.flush(); err != nil {
+		return err
+	}
+	rs.stage = stage
+	switch {
+	case stage == backupSettings && rs.header.Base == "":
+		return rs.restoreFeatures()
+	case stage == backupInodes && rs.header.Base == "":
+		// The settings are needed to restore the inodes.
+		return loadSettings(rs.ctx, rs.db)
+	case stage == backupInodes:
+		for _, table := range []string{"tree", "inodes", "xattrs", "tiered_files"} {
+			if table == "tiered_files" && !rs.hasTable(table) {
+				continue
+			}
+			if err := rs.clear(table); err != nil {
+				return err
+			}
+		}
+	case stage == backupDone && rs.header.Base != "":
+		if err := rs.trimBlocks(); err != nil {
+			return err
+		}
+		if err := rs.flush(); err != nil {
+			return err
+		}
+		return rs.removeUnlisted()
+	}
+	return nil
+}
+
+func (rs *restorer) hasTable(name string) bool {
+	for _, table := range rs.header.Tables {
+		if table == name {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreFeatures recreates the features of the file system in the header
+// of a full backup.
+func (rs *restorer) restoreFeatures() error {
+	creators := map[string]func(context.Context, *DB) error{
+		"tiered_files": CreateTiering,
+		"ops_log":      CreateJournal,
+		"snapshots":    CreateSnapshots,
+		"file_hashes":  CreateFileHashes,
+		"file_text":    CreateContentIndex,
+	}
+	for _, table := range rs.header.Tables {
+		if create, ok := creators[table]; ok {
+			if err := create(rs.ctx, rs.db); err != nil {
+				return err
+			}
+		}
+	}
+	if rs.header.Checksums {
+		if err := EnableChecksums(rs.ctx, rs.db); err != nil {
+			return err
+		}
+	}
+	if sb := rs.header.Superblock; sb != nil {
+		q := `UPDATE superblock SET uuid = $1, compat_features = $2, ro_compat_features = $3,
+  incompat_features = $4, created = $5 WHERE id = 1`
+		if _, err := rs.db.ExecContext(rs.ctx, q, sb.UUID, sb.Compat, sb.ROCompat, sb.Incompat, sb.Created); err != nil {
+			return errors.Wrap(err, "failed to write the superblock")
+		}
+	}
+	return nil
+}
+
+// restoreSetting applies a setting of a backup. The physical layout of the
+// tables, such as the sharding of the data blocks, is left as chosen when
+// the database was initialized, and the settings that shape the contents of
+// the file system are taken from the full backup only.
+func (rs *restorer) restoreSetting(s *backupSetting) error {
+	if rs.header.Base != "" {
+		switch s.Name {
+		case settingBlockSize, settingInlineData, settingCaseInsensitive, settingBlockShards, SettingReadOnly:
+			return nil
+		}
+		return PutSetting(rs.ctx, rs.db, s.Name, s.Value)
+	}
+	switch s.Name {
+	case settingBlockSize, settingInlineData:
+		size, err := strconv.ParseInt(s.Value, 10, 64)
+		if err != nil {
+			return errors.Errorf("invalid %s %q", s.Name, s.Value)
+		}
+		if s.Name == settingBlockSize {
+			return SetBlockSize(rs.ctx, rs.db, size)
+		}
+		return EnableInlineData(rs.ctx, rs.db, size)
+	case settingCaseInsensitive:
+		if s.Value == "true" {
+			return SetCaseInsensitive(rs.ctx, rs.db)
+		}
+		return nil
+	case settingBlockShards, SettingReadOnly:
+		return nil
+	}
+	return PutSetting(rs.ctx, rs.db, s.Name, s.Value)
+}
+
+func (rs *restorer) restoreInode(i *backupInode) error {
+	n := &i.Node
+	q := "UPSERT INTO inodes (inode, " + inodeColumns
+	values := "$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14"
+	args := append(inodeValues(n), n.Generation)
+	if rs.db.inlineDataSize > 0 {
+		q += ", inline_data"
+		values += ", $15"
+		args = append(args, i.Inline)
+	} else if i.Inline != nil {
+		return errors.Errorf("inode %d has inline data, which the file system does not store", n.Inode)
+	}
+	q += ") VALUES (" + values + ")"
+	if err := rs.exec(q, args...); err != nil {
+		return err
+	}
+	if n.Inode > rs.maxInode {
+		rs.maxInode = n.Inode
+	}
+	rs.stats.Inodes++
+	return nil
+}
+
+func (rs *restorer) restoreBlock(b *backupBlock) error {
+	if rs.header.Base != "" {
+		if b.Inode != rs.inode {
+			if err := rs.trimBlocks(); err != nil {
+				return err
+			}
+			rs.inode = b.Inode
+			rs.listed[b.Inode] = true
+		}
+		rs.sequences = append(rs.sequences, b.Sequence)
+	}
+	if b.Unchanged {
+		return nil
+	}
+	rs.stats.Blocks++
+	rs.stats.Bytes += int64(len(b.Data))
+	q := "UPSERT INTO data_blocks (inode, sequence, data) VALUES ($1, $2, $3)"
+	return rs.exec(q, b.Inode, b.Sequence, b.Data)
+}
+
+// trimBlocks removes the blocks of the inode whose blocks were last restored
+// that the incremental backup does not list.
+func (rs *restorer) trimBlocks() error {
+	if rs.inode == 0 {
+		return nil
+	}
+	q := "DELETE FROM data_blocks WHERE inode = $1 AND NOT (sequence = ANY ($2))"
+	err := rs.exec(q, rs.inode, pq.Array(rs.sequences))
+	rs.inode, rs.sequences = 0, nil
+	return err
+}
+
+// removeUnlisted removes the blocks of the inodes that have none listed in
+// the incremental backup: they were removed, truncated to nothing, or made
+// inline since its base.
+func (rs *restorer) removeUnlisted() error {
+	inodes, err := rs.blockInodes()
+	if err != nil {
+		return err
+	}
+	for _, inode := range inodes {
+		if rs.listed[inode] {
+			continue
+		}
+		if err := rs.exec("DELETE FROM data_blocks WHERE inode = $1", inode); err != nil {
+			return err
+		}
+	}
+	return rs.flush()
+}
+
+// blockInodes returns the inodes that have data blocks.
+func (rs *restorer) blockInodes() ([]uint64, error) {
+	rows, err := rs.db.QueryContext(rs.ctx, "SELECT DISTINCT inode FROM data_blocks")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the inodes with data blocks")
+	}
+	defer rows.Close()
+	var inodes []uint64
+	for rows.Next() {
+		var inode uint64
+		if err := rows.Scan(&inode); err != nil {
+			return nil, err
+		}
+		inodes = append(inodes, inode)
+	}
+	return inodes, rows.Err()
+}
+
+// clear deletes all rows of `table`, in batches.
+func (rs *restorer) clear(table string) error {
+	q := "DELETE FROM " + table + " LIMIT $1"
+	for {
+		res, err := rs.db.ExecContext(rs.ctx, q, restoreBatchRows)
+		if err != nil {
+			return errors.Wrapf(err, "failed to clear %s", table)
+		}
+		count, err := res.RowsAffected()
+		if err != nil || count == 0 {
+			return err
+		}
+	}
+}
+
+// exec runs `q` in the current transaction, committed every
+// restoreBatchRows statements.
+func (rs *restorer) exec(q string, args ...interface{}) error {
+	if rs.tx == nil {
+		tx, err := rs.db.BeginTx(rs.ctx, nil)
+		if err != nil {
+			return err
+		}
+		rs.tx = tx
+	}
+	if _, err := rs.tx.ExecContext(rs.ctx, q, args...); err != nil {
+		return errors.Wrapf(err, "failed to execute %q", q)
+	}
+	rs.pending++
+	if rs.pending >= restoreBatchRows {
+		return rs.flush()
+	}
+	return nil
+}
+
+// flush commits the current transaction.
+func (rs *restorer) flush() error {
+	if rs.tx == nil {
+		return nil
+	}
+	err := rs.tx.Commit()
+	rs.tx, rs.pending = nil, 0
+	return err
+}
+
+func (rs *restorer) rollback() {
+	if rs.tx != nil {
+		_ = rs.tx.Rollback()
+		rs.tx, rs.pending = nil, 0
+	}
+}
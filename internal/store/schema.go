@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/pkg/errors"
+)
+
+// schemaStatements creates the tables used by the file system in the
+// current database. This must be kept in sync with schema.sql, which
+// additionally sets up the database and its user.
+var schemaStatements = []string{
+	`CREATE SEQUENCE IF NOT EXISTS inode_seq START 2`,
+
+	`CREATE TABLE IF NOT EXISTS tree (
+  inode  INT NOT NULL,
+  parent INT NOT NULL,
+  name STRING NOT NULL,
+  UNIQUE (name, parent),
+  INDEX inode_idx (inode),
+  INDEX parent_idx (parent)
+)`,
+
+	// Backs listing directories by name, see dirOrder.
+	`CREATE INDEX IF NOT EXISTS tree_parent_name_idx ON tree (parent, name) STORING (inode)`,
+
+	`CREATE TABLE IF NOT EXISTS inodes (
+  inode          INT,
+  size           INT NOT NULL DEFAULT 0,
+  atime          TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  mtime          TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  ctime          TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  crtime         TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  mode           INT NOT NULL DEFAULT 0,
+  nlink          INT NOT NULL DEFAULT 0,
+  uid            INT NOT NULL DEFAULT 0,
+  gid            INT NOT NULL DEFAULT 0,
+  rdev           INT NOT NULL DEFAULT 0,
+  flags          INT NOT NULL DEFAULT 0,
+  symlink_target STRING NOT NULL DEFAULT '',
+  generation     INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (inode)
+)`,
+
+	`CREATE TABLE IF NOT EXISTS data_blocks (
+  inode    INT,
+  sequence INT,
+  data     BYTES,
+  PRIMARY KEY (inode, sequence)
+)`,
+
+	`CREATE TABLE IF NOT EXISTS settings (
+  name  STRING PRIMARY KEY,
+  value STRING NOT NULL
+)`,
+
+	`CREATE TABLE IF NOT EXISTS xattrs (
+  inode INT,
+  name  STRING,
+  value BYTES NOT NULL,
+  PRIMARY KEY (inode, name)
+)`,
+
+	`CREATE TABLE IF NOT EXISTS superblock (
+  id                 INT PRIMARY KEY CHECK (id = 1),
+  uuid               UUID NOT NULL,
+  block_size         INT NOT NULL,
+  compat_features    INT NOT NULL DEFAULT 0,
+  ro_compat_features INT NOT NULL DEFAULT 0,
+  incompat_features  INT NOT NULL DEFAULT 0,
+  schema_version     INT NOT NULL,
+  created            TIMESTAMPTZ NOT NULL
+)`,
+
+	`CREATE TABLE IF NOT EXISTS leases (
+  name    STRING PRIMARY KEY,
+  holder  STRING NOT NULL,
+  expires TIMESTAMPTZ NOT NULL
+)`,
+}
+
+// checkSchema ensures that the database uses the current schema. Databases
+// created by older versions store inodes as JSON and must be migrated with
+// `sqlfs migrate` first, and those created by newer versions may use a format
+// this binary does not understand.
+func checkSchema(ctx context.Context, db *DB) error {
+	legacy, err := HasLegacyInodes(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to check the database schema")
+	}
+	if legacy {
+		return errors.New("the database uses the legacy JSON inode format, run `sqlfs migrate` first")
+	}
+	generations, err := HasGenerations(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to check the database schema")
+	}
+	if !generations {
+		return errors.New("the inodes have no generation numbers, run `sqlfs migrate` first")
+	}
+	return checkSuperblock(ctx, db)
+}
+
+// LoadFileSystem ensures that `db` holds a file system using the current
+// schema, and loads its settings.
+func LoadFileSystem(ctx context.Context, db *DB) error {
+	if err := checkSchema(ctx, db); err != nil {
+		return err
+	}
+	return loadSettings(ctx, db)
+}
+
+// OpenFileSystem opens a pool of the connections made by `c`, and ensures
+// that the database holds a file system using the current schema.
+func OpenFileSystem(c driver.Connector) (*DB, error) {
+	db := NewDB(sql.OpenDB(c))
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := LoadFileSystem(context.Background(), db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// HasLegacyInodes returns true if the inodes table still has the struct_data
+// column holding JSON encoded metadata.
+func HasLegacyInodes(ctx context.Context, db *DB) (bool, error) {
+	return columnExists(ctx, db, "inodes", "struct_data")
+}
+
+// CreateSchema creates all tables needed by the file system if they do not
+// exist yet, and writes the superblock.
+func CreateSchema(ctx context.Context, db *sql.DB) error {
+	return createSchema(ctx, NewDB(db))
+}
+
+func createSchema(ctx context.Context, db *DB) error {
+	for _, q := range schemaStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q", q)
+		}
+	}
+	return createSuperblock(ctx, db)
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"hash/crc32"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Most blocks verified per query by the background scrubber.
+const scrubBatchBlocks = 1000
+
+// blockScrubber verifies the checksums of all data blocks in the
+// background, as `sqlfs scrub` does, at a limited rate so that it does not
+// compete with the mounts for the database. Damaged blocks are logged and
+// counted in the stats of the admin API and .sqlfs/stats. If a secondary
+// database kept up to date by `sqlfs replicate` is given, a damaged block is
+// replaced with the copy of the secondary when that copy matches the
+// checksum the block was written with.
+type blockScrubber struct {
+	db      *DB
+	replica *DB     // nil if damaged blocks are only reported
+	rate    float64 // Blocks verified per second.
+
+	mu    sync.Mutex
+	stats scrubStats
+}
+
+// scrubStats describes the progress of a blockScrubber.
+type scrubStats struct {
+	Passes   uint64     `json:"passes"`
+	Blocks   uint64     `json:"blocks_verified"`
+	Corrupt  uint64     `json:"corrupt_blocks"`
+	Repaired uint64     `json:"repaired_blocks"`
+	LastPass *time.Time `json:"last_pass,omitempty"`
+}
+
+func newBlockScrubber(db, replica *DB, rate float64) *blockScrubber {
+	return &blockScrubber{db: db, replica: replica, rate: rate}
+}
+
+// Stats returns the progress of the scrubber.
+func (s *blockScrubber) Stats() scrubStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// pass verifies every block once, unless `keepGoing` returns false or ctx
+// is canceled first.
+func (s *blockScrubber) pass(ctx context.Context, keepGoing func() bool) error {
+	batch := int(s.rate)
+	if batch < 1 {
+		batch = 1
+	} else if batch > scrubBatchBlocks {
+		batch = scrubBatchBlocks
+	}
+	pause := time.Duration(float64(batch) / s.rate * float64(time.Second))
+
+	var after BlockKey
+	for keepGoing() {
+		start := time.Now()
+		corrupt, last, count, err := ScrubBlocks(ctx, s.db, after, batch)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.stats.Blocks += uint64(count)
+		s.mu.Unlock()
+		for _, b := range corrupt {
+			repaired, err := s.repair(ctx, b)
+			if err != nil {
+				log.Printf("failed to repair block %d of inode %d: %s\n", b.Index, b.Inode, err)
+			} else if repaired {
+				log.Printf("Repaired block %d of inode %d from the secondary database.\n", b.Index, b.Inode)
+			}
+			s.mu.Lock()
+			s.stats.Corrupt++
+			if repaired {
+				s.stats.Repaired++
+			}
+			s.mu.Unlock()
+		}
+		if last == (BlockKey{}) {
+			now := time.Now()
+			s.mu.Lock()
+			s.stats.Passes++
+			s.stats.LastPass = &now
+			s.mu.Unlock()
+			return nil
+		}
+		after = last
+
+		select {
+		case <-time.After(pause - time.Since(start)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// repair replaces the block `b` with its copy on the secondary database, if
+// any, and returns whether it did. The copy must match the checksum stored
+// with the damaged block, which is that of the data originally written.
+func (s *blockScrubber) repair(ctx context.Context, b BlockKey) (bool, error) {
+	if s.replica == nil {
+		return false, nil
+	}
+	// Sequences are one-based.
+	var checksum int64
+	q1 := "SELECT checksum FROM data_blocks WHERE inode = $1 AND sequence = $2"
+	err := s.db.QueryRowContext(ctx, q1, b.Inode, b.Index+1).Scan(&checksum)
+	if err == sql.ErrNoRows {
+		// Removed since.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var data []byte
+	q2 := "SELECT data FROM data_blocks WHERE inode = $1 AND sequence = $2"
+	err = s.replica.QueryRowContext(ctx, q2, b.Inode, b.Index+1).Scan(&data)
+	if err == sql.ErrNoRows {
+		return false, errors.New("the block is missing from the secondary database")
+	}
+	if err != nil {
+		return false, err
+	}
+	if crc32.Checksum(data, castagnoli) != uint32(checksum) {
+		return false, errors.New("the copy of the secondary database does not match the checksum either")
+	}
+	// Only if the block was not rewritten meanwhile.
+	q3 := "UPDATE data_blocks SET data = $3 WHERE inode = $1 AND sequence = $2 AND checksum = $4"
+	res, err := s.db.ExecContext(ctx, q3, b.Inode, b.Index+1, data, checksum)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// runBackgroundScrub verifies all data blocks every `interval` while this
+// mount is the leader, until ctx is canceled.
+func (fs fileSystem) runBackgroundScrub(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		// Repairs are writes.
+		if !fs.leader.Leading() || fs.readOnly() {
+			continue
+		}
+		err := fs.scrubber.pass(ctx, fs.leader.Leading)
+		fs.tasks.report("scrub", err)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("background scrub failed: %s\n", err)
+		}
+	}
+}
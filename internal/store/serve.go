@@ -0,0 +1,38 @@
+package store
+
+import (
+	"fmt"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// serveFUSE mounts `filesys` at `mountpoint` with `options` and serves it
+// until it is unmounted or the FUSE connection fails. `onReady` is called
+// with the outcome of mounting.
+func serveFUSE(mountpoint string, filesys fileSystem, options []fuse.MountOption, onReady func(error)) error {
+	c, err := fuse.Mount(mountpoint, options...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fmt.Printf("FUSE Protocol: %s\n", c.Protocol())
+
+	go func() {
+		// The mount may complete asynchronously on OS X.
+		<-c.Ready
+		onReady(c.MountError)
+	}()
+	config := &fs.Config{
+		Debug:       filesys.ops.debug,
+		WithContext: filesys.ops.withContext,
+	}
+	if err := fs.New(c, config).Serve(filesys); err != nil {
+		return err
+	}
+
+	// check if the mount process has an error to report
+	<-c.Ready
+	return c.MountError
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the settings of a file system, chosen with `sqlfs init`.
+const (
+	settingBlockSize       = "block_size"
+	settingCaseInsensitive = "case_insensitive"
+	settingNormalization   = "normalization"
+	settingWindowsNames    = "windows_names"
+	settingBlockShards     = "block_shards"
+	settingInlineData      = "inline_data"
+	// Not chosen at init: set by `sqlfs maintenance` and polled by mounts.
+	SettingReadOnly = "read_only"
+	// Not chosen at init: recorded by `sqlfs tier`.
+	SettingTierStore = "tier_store"
+)
+
+// settings are the settings of a file system that its queries and the
+// layout of its data depend on. They are loaded when its database is
+// opened, and shared by the DB and the caches of the file system.
+type settings struct {
+	// Size of the data blocks, chosen with `sqlfs init -block-size`.
+	// Larger blocks store big files in far fewer rows, which suits
+	// Postgres, where each bytea value above 2KB is compressed and moved
+	// out of line by TOAST.
+	BlockSize int64
+	// Size up to which the contents of files are stored in their inode, or
+	// 0 if inline data is disabled.
+	inlineDataSize int64
+	// Whether names are matched regardless of case, as on macOS, for file
+	// systems created with `sqlfs init -case-insensitive`. Entries keep the
+	// case they were created with.
+	caseInsensitive bool
+	// Normalization form of names, chosen with `sqlfs init -normalize`.
+	nameForm normForm
+	// Whether names that Windows cannot represent are rejected, for file
+	// systems created with `sqlfs init -windows-names`, whose trees are
+	// meant to be served to Windows clients, e.g. over SMB or WebDAV.
+	windowsNames bool
+	// Whether data blocks have checksums, and whether reads verify them.
+	// Reads skip the verification e.g. to copy what is left of a damaged
+	// file (see `sqlfs mount -verify-checksums`).
+	BlockChecksums  bool
+	verifyChecksums bool
+	// Whether the optional tables exist. Databases created before they
+	// were added lack them until `sqlfs init` is run again.
+	XattrsEnabled     bool
+	fileHashesEnabled bool
+	tieringEnabled    bool
+	// Object store holding the tiered files, recorded by `sqlfs tier`,
+	// which mounts can override with -object-store. nil if none was
+	// recorded or given. All the readers and writers of contents go through
+	// it, so that tiered files are read from the store and recalled before
+	// they are modified, whichever program accesses them.
+	tierStore objectStore
+	// Ro-compat features of the file system that this binary does not
+	// support. They are set when the superblock is checked; the file system
+	// must then only be read.
+	unsupportedROCompat uint64
+}
+
+// defaultSettings returns the settings of a file system that configures
+// none, to be replaced with loadSettings.
+func defaultSettings() *settings {
+	return &settings{BlockSize: defaultBlockSize, verifyChecksums: true}
+}
+
+// loadSettings loads the settings of the file system in `db` into
+// db.settings.
+func loadSettings(ctx context.Context, db *DB) error {
+	size, err := GetBlockSize(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the block size")
+	}
+	fold, err := GetSetting(ctx, db, settingCaseInsensitive)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the settings")
+	}
+	norm, err := GetSetting(ctx, db, settingNormalization)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the settings")
+	}
+	form, err := ParseNormForm(norm)
+	if err != nil {
+		return err
+	}
+	windows, err := GetSetting(ctx, db, settingWindowsNames)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the settings")
+	}
+	xattrs, err := TableExists(ctx, db, "xattrs")
+	if err != nil {
+		return errors.Wrap(err, "failed to check the database schema")
+	}
+	inline, err := getInlineDataSize(ctx, db)
+	if err != nil {
+		return err
+	}
+	checksums, err := hasBlockChecksums(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to check the database schema")
+	}
+	hashes, err := TableExists(ctx, db, "file_hashes")
+	if err != nil {
+		return errors.Wrap(err, "failed to check the database schema")
+	}
+	tiering, err := TableExists(ctx, db, "tiered_files")
+	if err != nil {
+		return errors.Wrap(err, "failed to check the database schema")
+	}
+	var store objectStore
+	if tiering {
+		storeURL, err := GetSetting(ctx, db, SettingTierStore)
+		if err != nil {
+			return errors.Wrap(err, "failed to read the settings")
+		}
+		if storeURL != "" {
+			if store, err = OpenObjectStore(storeURL); err != nil {
+				return errors.Wrap(err, "failed to open the object store of tiered files")
+			}
+		}
+	}
+	db.BlockSize = size
+	db.caseInsensitive = fold == "true"
+	db.nameForm = form
+	db.windowsNames = windows == "true"
+	db.XattrsEnabled = xattrs
+	db.inlineDataSize = inline
+	db.BlockChecksums = checksums
+	db.fileHashesEnabled = hashes
+	db.tieringEnabled = tiering
+	db.tierStore = store
+	return nil
+}
+
+// GetSetting returns the value of the setting `name`, or "" if it is not
+// set. Databases created before the settings table was added have no
+// settings at all.
+func GetSetting(ctx context.Context, db *DB, name string) (string, error) {
+	exists, err := TableExists(ctx, db, "settings")
+	if err != nil || !exists {
+		return "", err
+	}
+
+	var value string
+	q := "SELECT value FROM settings WHERE name = $1"
+	err = db.QueryRowContext(ctx, q, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// TableExists returns true if the table `name` exists in the current
+// database.
+func TableExists(ctx context.Context, db *DB, name string) (bool, error) {
+	var count int
+	q := `SELECT COUNT(*) FROM information_schema.tables
+  WHERE table_catalog = current_database() AND table_name = $1`
+	if err := db.QueryRowContext(ctx, q, name).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// columnExists returns true if the table `table` of the current database
+// has the column `column`.
+func columnExists(ctx context.Context, db *DB, table, column string) (bool, error) {
+	var count int
+	q := `SELECT COUNT(*) FROM information_schema.columns
+  WHERE table_catalog = current_database() AND table_name = $1 AND column_name = $2`
+	if err := db.QueryRowContext(ctx, q, table, column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// PutSetting sets the setting `name` to `value`.
+func PutSetting(ctx context.Context, db *DB, name, value string) error {
+	q := "UPSERT INTO settings (name, value) VALUES ($1, $2)"
+	if _, err := db.ExecContext(ctx, q, name, value); err != nil {
+		return errors.Wrapf(err, "failed to set %s", name)
+	}
+	return nil
+}
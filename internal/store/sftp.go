@@ -0,0 +1,711 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SFTP version 3, as implemented by OpenSSH. See
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02.
+const sftpVersion = 3
+
+// Packet types.
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpReadlink = 19
+	sshFxpSymlink  = 20
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+)
+
+// Status codes.
+const (
+	sshFxOk               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxBadMessage       = 5
+	sshFxOpUnsupported    = 8
+)
+
+// Attribute flags.
+const (
+	sshFileXferAttrSize        = 0x1
+	sshFileXferAttrUIDGID      = 0x2
+	sshFileXferAttrPermissions = 0x4
+	sshFileXferAttrACModTime   = 0x8
+	sshFileXferAttrExtended    = 0x80000000
+)
+
+// Open flags.
+const (
+	sshFxfRead   = 0x1
+	sshFxfWrite  = 0x2
+	sshFxfAppend = 0x4
+	sshFxfCreat  = 0x8
+	sshFxfTrunc  = 0x10
+	sshFxfExcl   = 0x20
+)
+
+const (
+	// Largest packet accepted from clients. OpenSSH never sends more than
+	// 256K.
+	sftpMaxPacket = 256*1024 + 1024
+
+	// Largest read served at once.
+	sftpMaxRead = 64 * 1024
+
+	// Number of entries returned per READDIR.
+	sftpReaddirBatch = 100
+
+	// Maximum number of symbolic links followed by STAT.
+	sftpMaxSymlinks = 40
+)
+
+// sftpServer serves the SFTP protocol over a single stream. It is meant to
+// be run as an OpenSSH subsystem, which takes care of authentication and
+// encryption.
+type sftpServer struct {
+	db   *DB
+	root string // Path of the directory exposed as "/".
+
+	in  *bufio.Reader
+	out io.Writer
+
+	handles    map[string]*sftpHandle
+	nextHandle uint64
+}
+
+// sftpHandle is an open file or directory.
+type sftpHandle struct {
+	node  *FileNode
+	flags uint32 // sshFxf flags, for files.
+
+	// Remaining entries of a directory, loaded on the first READDIR.
+	entries []*FileNode
+	listed  bool
+}
+
+// sftpAttrs is the ATTRS structure of the protocol.
+type sftpAttrs struct {
+	flags        uint32
+	size         uint64
+	uid, gid     uint32
+	permissions  uint32
+	atime, mtime uint32
+}
+
+func NewSFTPServer(db *DB, root string, in io.Reader, out io.Writer) *sftpServer {
+	return &sftpServer{
+		db:      db,
+		root:    root,
+		in:      bufio.NewReader(in),
+		out:     out,
+		handles: make(map[string]*sftpHandle),
+	}
+}
+
+// Serve handles requests until the client closes the stream.
+func (s *sftpServer) Serve() error {
+	for {
+		typ, payload, err := s.readPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.handle(typ, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpServer) readPacket() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.in, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > sftpMaxPacket {
+		return 0, nil, errors.Errorf("invalid SFTP packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(s.in, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+func (s *sftpServer) writePacket(typ byte, payload []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)+1))
+	header[4] = typ
+	if _, err := s.out.Write(append(header[:], payload...)); err != nil {
+		return errors.Wrap(err, "failed to write SFTP response")
+	}
+	return nil
+}
+
+// handle dispatches a single request. Only errors writing the response are
+// returned; errors of the request itself are reported to the client.
+func (s *sftpServer) handle(typ byte, payload []byte) error {
+	r := &sftpReader{b: payload}
+	if typ == sshFxpInit {
+		w := &sftpWriter{}
+		w.uint32(sftpVersion)
+		return s.writePacket(sshFxpVersion, w.b)
+	}
+
+	id := r.uint32()
+	ctx := context.Background()
+	var resp *sftpWriter
+	var respType byte
+	var err error
+	switch typ {
+	case sshFxpOpen:
+		respType, resp, err = s.open(ctx, r.string(), r.uint32(), r.attrs())
+	case sshFxpClose:
+		err = s.close(r.string())
+	case sshFxpRead:
+		respType, resp, err = s.read(ctx, r.string(), r.uint64(), r.uint32())
+	case sshFxpWrite:
+		err = s.write(ctx, r.string(), r.uint64(), r.bytes())
+	case sshFxpLstat:
+		respType, resp, err = s.stat(ctx, r.string(), false)
+	case sshFxpStat:
+		respType, resp, err = s.stat(ctx, r.string(), true)
+	case sshFxpFstat:
+		respType, resp, err = s.fstat(ctx, r.string())
+	case sshFxpSetstat:
+		err = s.setstat(ctx, r.string(), r.attrs())
+	case sshFxpFsetstat:
+		err = s.fsetstat(ctx, r.string(), r.attrs())
+	case sshFxpOpendir:
+		respType, resp, err = s.opendir(ctx, r.string())
+	case sshFxpReaddir:
+		respType, resp, err = s.readdir(ctx, r.string())
+	case sshFxpRemove:
+		err = s.remove(ctx, r.string(), false)
+	case sshFxpRmdir:
+		err = s.remove(ctx, r.string(), true)
+	case sshFxpMkdir:
+		err = s.mkdir(ctx, r.string(), r.attrs())
+	case sshFxpRealpath:
+		respType, resp, err = s.realpath(r.string())
+	case sshFxpRename:
+		err = s.rename(ctx, r.string(), r.string())
+	case sshFxpReadlink:
+		respType, resp, err = s.readlink(ctx, r.string())
+	case sshFxpSymlink:
+		// OpenSSH sends the target first, contrary to the draft.
+		err = s.symlink(ctx, r.string(), r.string())
+	default:
+		return s.writeStatus(id, sshFxOpUnsupported, fmt.Sprintf("unsupported request type %d", typ))
+	}
+	if r.err != nil {
+		return s.writeStatus(id, sshFxBadMessage, "malformed request")
+	}
+	if err == io.EOF {
+		return s.writeStatus(id, sshFxEOF, "")
+	}
+	if err != nil {
+		code := uint32(sshFxFailure)
+		switch errnoOf(err) {
+		case syscall.ENOENT:
+			code = sshFxNoSuchFile
+		case syscall.EACCES, syscall.EPERM:
+			code = sshFxPermissionDenied
+		case syscall.EIO:
+			log.Printf("sftp: request type %d failed: %s\n", typ, err)
+		}
+		return s.writeStatus(id, code, errnoOf(err).Error())
+	}
+	if resp == nil {
+		return s.writeStatus(id, sshFxOk, "")
+	}
+	w := &sftpWriter{}
+	w.uint32(id)
+	w.b = append(w.b, resp.b...)
+	return s.writePacket(respType, w.b)
+}
+
+func (s *sftpServer) writeStatus(id, code uint32, msg string) error {
+	w := &sftpWriter{}
+	w.uint32(id)
+	w.uint32(code)
+	w.string(msg)
+	w.string("") // Language tag.
+	return s.writePacket(sshFxpStatus, w.b)
+}
+
+// cleanPath returns `p` as an absolute path within the served tree.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// resolve returns the node at `p`, following symbolic links in the last
+// component if `follow` is true.
+func (s *sftpServer) resolve(ctx context.Context, p string, follow bool) (*FileNode, error) {
+	p = cleanPath(p)
+	for i := 0; ; i++ {
+		n, err := ResolvePath(ctx, s.db, path.Join(s.root, p))
+		if err != nil {
+			return nil, err
+		}
+		if !follow || !n.IsSymlink() {
+			return n, nil
+		}
+		if i == sftpMaxSymlinks {
+			return nil, syscall.ELOOP
+		}
+		if path.IsAbs(n.SymlinkTarget) {
+			p = cleanPath(n.SymlinkTarget)
+		} else {
+			p = cleanPath(path.Join(path.Dir(p), n.SymlinkTarget))
+		}
+	}
+}
+
+// resolveParent returns the directory containing `p` and the last component
+// of `p`.
+func (s *sftpServer) resolveParent(ctx context.Context, p string) (*FileNode, string, error) {
+	p = cleanPath(p)
+	if p == "/" {
+		return nil, "", syscall.EPERM
+	}
+	dir, err := s.resolve(ctx, path.Dir(p), true)
+	if err != nil {
+		return nil, "", err
+	}
+	return dir, path.Base(p), nil
+}
+
+func (s *sftpServer) addHandle(h *sftpHandle) *sftpWriter {
+	s.nextHandle++
+	id := strconv.FormatUint(s.nextHandle, 10)
+	s.handles[id] = h
+	w := &sftpWriter{}
+	w.string(id)
+	return w
+}
+
+func (s *sftpServer) open(ctx context.Context, p string, flags uint32, attrs sftpAttrs) (byte, *sftpWriter, error) {
+	dir, name, err := s.resolveParent(ctx, p)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := lookupNode(ctx, s.db, dir, name)
+	switch {
+	case err == nil:
+		if flags&sshFxfCreat != 0 && flags&sshFxfExcl != 0 {
+			return 0, nil, syscall.EEXIST
+		}
+		if n.IsDirectory() {
+			return 0, nil, syscall.EISDIR
+		}
+		if flags&sshFxfTrunc != 0 {
+			if err := setSize(ctx, s.db, n, 0); err != nil {
+				return 0, nil, err
+			}
+		}
+	case err == syscall.ENOENT && flags&sshFxfCreat != 0:
+		mode := os.FileMode(0644)
+		if attrs.flags&sshFileXferAttrPermissions != 0 {
+			mode = os.FileMode(attrs.permissions & 07777).Perm()
+		}
+		n, err = CreateNode(ctx, s.db, dir, name, mode, attrs.uid, attrs.gid)
+		if err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, err
+	}
+	return sshFxpHandle, s.addHandle(&sftpHandle{node: n, flags: flags}), nil
+}
+
+func (s *sftpServer) close(handle string) error {
+	if _, ok := s.handles[handle]; !ok {
+		return syscall.EBADF
+	}
+	delete(s.handles, handle)
+	return nil
+}
+
+func (s *sftpServer) file(handle string) (*sftpHandle, error) {
+	h, ok := s.handles[handle]
+	if !ok || h.node.IsDirectory() {
+		return nil, syscall.EBADF
+	}
+	return h, nil
+}
+
+func (s *sftpServer) read(ctx context.Context, handle string, offset uint64, length uint32) (byte, *sftpWriter, error) {
+	h, err := s.file(handle)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > sftpMaxRead {
+		length = sftpMaxRead
+	}
+	data, err := readData(ctx, s.db, h.node, int64(offset), int(length))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) == 0 {
+		return 0, nil, io.EOF
+	}
+	w := &sftpWriter{}
+	w.bytes(data)
+	return sshFxpData, w, nil
+}
+
+func (s *sftpServer) write(ctx context.Context, handle string, offset uint64, data []byte) error {
+	h, err := s.file(handle)
+	if err != nil {
+		return err
+	}
+	if h.flags&sshFxfWrite == 0 {
+		return syscall.EBADF
+	}
+	if h.flags&sshFxfAppend != 0 {
+		offset = h.node.Size
+	}
+	h.node.Mtime = time.Now()
+	return WriteData(ctx, s.db, h.node, int64(offset), data)
+}
+
+func (s *sftpServer) stat(ctx context.Context, p string, follow bool) (byte, *sftpWriter, error) {
+	n, err := s.resolve(ctx, p, follow)
+	if err != nil {
+		return 0, nil, err
+	}
+	w := &sftpWriter{}
+	w.nodeAttrs(n)
+	return sshFxpAttrs, w, nil
+}
+
+func (s *sftpServer) fstat(ctx context.Context, handle string) (byte, *sftpWriter, error) {
+	h, ok := s.handles[handle]
+	if !ok {
+		return 0, nil, syscall.EBADF
+	}
+	w := &sftpWriter{}
+	w.nodeAttrs(h.node)
+	return sshFxpAttrs, w, nil
+}
+
+func (s *sftpServer) setstat(ctx context.Context, p string, attrs sftpAttrs) error {
+	n, err := s.resolve(ctx, p, true)
+	if err != nil {
+		return err
+	}
+	return s.applyAttrs(ctx, n, attrs)
+}
+
+func (s *sftpServer) fsetstat(ctx context.Context, handle string, attrs sftpAttrs) error {
+	h, ok := s.handles[handle]
+	if !ok {
+		return syscall.EBADF
+	}
+	return s.applyAttrs(ctx, h.node, attrs)
+}
+
+func (s *sftpServer) applyAttrs(ctx context.Context, n *FileNode, attrs sftpAttrs) error {
+	if attrs.flags&sshFileXferAttrSize != 0 {
+		if err := setSize(ctx, s.db, n, attrs.size); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sshFileXferAttrUIDGID != 0 {
+		n.Uid, n.Gid = attrs.uid, attrs.gid
+	}
+	if attrs.flags&sshFileXferAttrPermissions != 0 {
+		n.Mode = n.Mode&os.ModeType | fileModeFromUnix(attrs.permissions)&^os.ModeType
+	}
+	if attrs.flags&sshFileXferAttrACModTime != 0 {
+		n.Atime = time.Unix(int64(attrs.atime), 0)
+		n.Mtime = time.Unix(int64(attrs.mtime), 0)
+	}
+	n.Ctime = time.Now()
+	return UpdateNode(ctx, s.db, n)
+}
+
+func (s *sftpServer) opendir(ctx context.Context, p string) (byte, *sftpWriter, error) {
+	n, err := s.resolve(ctx, p, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !n.IsDirectory() {
+		return 0, nil, syscall.ENOTDIR
+	}
+	return sshFxpHandle, s.addHandle(&sftpHandle{node: n}), nil
+}
+
+func (s *sftpServer) readdir(ctx context.Context, handle string) (byte, *sftpWriter, error) {
+	h, ok := s.handles[handle]
+	if !ok || !h.node.IsDirectory() {
+		return 0, nil, syscall.EBADF
+	}
+	if !h.listed {
+		entries, err := ListNodesInDir(ctx, s.db, h.node.Inode)
+		if err != nil {
+			return 0, nil, err
+		}
+		h.entries = entries
+		h.listed = true
+	}
+	if len(h.entries) == 0 {
+		return 0, nil, io.EOF
+	}
+	batch := h.entries
+	if len(batch) > sftpReaddirBatch {
+		batch = batch[:sftpReaddirBatch]
+	}
+	h.entries = h.entries[len(batch):]
+
+	w := &sftpWriter{}
+	w.uint32(uint32(len(batch)))
+	for _, n := range batch {
+		w.string(n.Name)
+		w.string(longName(n))
+		w.nodeAttrs(n)
+	}
+	return sshFxpName, w, nil
+}
+
+// longName formats `n` like a line of `ls -l`, which clients show as is.
+func longName(n *FileNode) string {
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s",
+		lsMode(n.Mode), n.Nlink, n.Uid, n.Gid, n.Size, n.Mtime.Format("Jan _2 15:04"), n.Name)
+}
+
+func (s *sftpServer) remove(ctx context.Context, p string, isDir bool) error {
+	dir, name, err := s.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	return removeNode(ctx, s.db, dir, name, isDir)
+}
+
+func (s *sftpServer) mkdir(ctx context.Context, p string, attrs sftpAttrs) error {
+	dir, name, err := s.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0755)
+	if attrs.flags&sshFileXferAttrPermissions != 0 {
+		mode = os.FileMode(attrs.permissions).Perm()
+	}
+	_, err = CreateNode(ctx, s.db, dir, name, os.ModeDir|mode, attrs.uid, attrs.gid)
+	return err
+}
+
+func (s *sftpServer) realpath(p string) (byte, *sftpWriter, error) {
+	p = cleanPath(p)
+	w := &sftpWriter{}
+	w.uint32(1)
+	w.string(p)
+	w.string(p)
+	w.uint32(0) // No attributes.
+	return sshFxpName, w, nil
+}
+
+func (s *sftpServer) rename(ctx context.Context, oldPath, newPath string) error {
+	oldDir, oldName, err := s.resolveParent(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	newDir, newName, err := s.resolveParent(ctx, newPath)
+	if err != nil {
+		return err
+	}
+	return renameNode(ctx, s.db, oldDir, oldName, newDir, newName, false)
+}
+
+func (s *sftpServer) readlink(ctx context.Context, p string) (byte, *sftpWriter, error) {
+	n, err := s.resolve(ctx, p, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !n.IsSymlink() {
+		return 0, nil, syscall.EINVAL
+	}
+	w := &sftpWriter{}
+	w.uint32(1)
+	w.string(n.SymlinkTarget)
+	w.string(n.SymlinkTarget)
+	w.uint32(0) // No attributes.
+	return sshFxpName, w, nil
+}
+
+func (s *sftpServer) symlink(ctx context.Context, target, linkPath string) error {
+	dir, name, err := s.resolveParent(ctx, linkPath)
+	if err != nil {
+		return err
+	}
+	if _, err := lookupNode(ctx, s.db, dir, name); err == nil {
+		return syscall.EEXIST
+	} else if err != syscall.ENOENT {
+		return err
+	}
+	n := &FileNode{
+		Name:          name,
+		Mode:          os.ModeSymlink | 0777,
+		SymlinkTarget: target,
+		Nlink:         1,
+		Atime:         time.Now(),
+		Crtime:        time.Now(),
+	}
+	return UpsertNode(ctx, s.db, dir.Inode, n)
+}
+
+// sftpReader decodes the fields of a request. Decoding errors are sticky
+// and reported through err.
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sftpReader) bytes() []byte {
+	n := r.uint32()
+	if uint32(len(r.b)) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *sftpReader) attrs() sftpAttrs {
+	var a sftpAttrs
+	a.flags = r.uint32()
+	if a.flags&sshFileXferAttrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&sshFileXferAttrUIDGID != 0 {
+		a.uid, a.gid = r.uint32(), r.uint32()
+	}
+	if a.flags&sshFileXferAttrPermissions != 0 {
+		a.permissions = r.uint32()
+	}
+	if a.flags&sshFileXferAttrACModTime != 0 {
+		a.atime, a.mtime = r.uint32(), r.uint32()
+	}
+	if a.flags&sshFileXferAttrExtended != 0 {
+		// Extended attributes are ignored.
+		for count := r.uint32(); count > 0 && r.err == nil; count-- {
+			r.bytes()
+			r.bytes()
+		}
+	}
+	return a
+}
+
+// sftpWriter encodes the fields of a response.
+type sftpWriter struct {
+	b []byte
+}
+
+func (w *sftpWriter) uint32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *sftpWriter) uint64(v uint64) {
+	w.uint32(uint32(v >> 32))
+	w.uint32(uint32(v))
+}
+
+func (w *sftpWriter) bytes(v []byte) {
+	w.uint32(uint32(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *sftpWriter) string(v string) {
+	w.uint32(uint32(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *sftpWriter) nodeAttrs(n *FileNode) {
+	size := n.Size
+	if n.IsSymlink() {
+		size = uint64(len(n.SymlinkTarget))
+	}
+	w.uint32(sshFileXferAttrSize | sshFileXferAttrUIDGID | sshFileXferAttrPermissions | sshFileXferAttrACModTime)
+	w.uint64(size)
+	w.uint32(n.Uid)
+	w.uint32(n.Gid)
+	w.uint32(unixMode(n.Mode))
+	w.uint32(unixTime(n.Atime))
+	w.uint32(unixTime(n.Mtime))
+}
+
+// unixTime returns `t` in seconds since the epoch, clamped to the range of
+// an uint32.
+func unixTime(t time.Time) uint32 {
+	sec := t.Unix()
+	if sec < 0 {
+		return 0
+	}
+	if sec > 1<<32-1 {
+		return 1<<32 - 1
+	}
+	return uint32(sec)
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// sftpPacket returns the packet of type `typ` with the payload `w`.
+func sftpPacket(typ byte, w *sftpWriter) []byte {
+	packet := make([]byte, 5, 5+len(w.b))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(w.b)))
+	packet[4] = typ
+	return append(packet, w.b...)
+}
+
+// sftpRequest returns a request of type `typ` with the ID `id` followed by
+// the string arguments `args`.
+func sftpRequest(typ byte, id uint32, args ...string) []byte {
+	w := &sftpWriter{}
+	w.uint32(id)
+	for _, arg := range args {
+		w.string(arg)
+	}
+	return sftpPacket(typ, w)
+}
+
+// readSFTPPackets decodes the packets written by a server.
+func readSFTPPackets(t *testing.T, out []byte) ([]byte, []*sftpReader) {
+	t.Helper()
+	var types []byte
+	var payloads []*sftpReader
+	for len(out) > 0 {
+		if len(out) < 5 {
+			t.Fatalf("truncated packet % x", out)
+		}
+		n := binary.BigEndian.Uint32(out)
+		if uint32(len(out)-4) < n {
+			t.Fatalf("truncated packet % x", out)
+		}
+		types = append(types, out[4])
+		payloads = append(payloads, &sftpReader{b: out[5 : 4+n]})
+		out = out[4+n:]
+	}
+	return types, payloads
+}
+
+func TestSFTPSession(t *testing.T) {
+	var in bytes.Buffer
+	init := &sftpWriter{}
+	init.uint32(sftpVersion)
+	in.Write(sftpPacket(sshFxpInit, init))
+	in.Write(sftpRequest(sshFxpRealpath, 1, "a/./b/../c"))
+	in.Write(sftpRequest(sshFxpRealpath, 2, "../.."))
+	in.Write(sftpRequest(sshFxpClose, 3, "no such handle"))
+	in.Write(sftpRequest(200, 4))
+	in.Write(sftpRequest(sshFxpRealpath, 5)) // No path.
+	var out bytes.Buffer
+	if err := NewSFTPServer(nil, "/", &in, &out).Serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	types, payloads := readSFTPPackets(t, out.Bytes())
+	want := []byte{sshFxpVersion, sshFxpName, sshFxpName, sshFxpStatus, sshFxpStatus, sshFxpStatus}
+	if !bytes.Equal(types, want) {
+		t.Fatalf("replies of types %v, want %v", types, want)
+	}
+	if v := payloads[0].uint32(); v != sftpVersion {
+		t.Errorf("version %d", v)
+	}
+	for i, path := range map[int]string{1: "/a/c", 2: "/"} {
+		r := payloads[i]
+		if id, count, name := r.uint32(), r.uint32(), r.string(); id != uint32(i) || count != 1 || name != path {
+			t.Errorf("REALPATH %d = %d names, %q, want %q", id, count, name, path)
+		}
+	}
+	for i, code := range map[int]uint32{3: sshFxFailure, 4: sshFxOpUnsupported, 5: sshFxBadMessage} {
+		r := payloads[i]
+		if id, got := r.uint32(), r.uint32(); id != uint32(i) || got != code {
+			t.Errorf("request %d got status %d, want %d", id, got, code)
+		}
+	}
+}
+
+func TestSFTPInvalidPacket(t *testing.T) {
+	for name, packet := range map[string][]byte{
+		"empty":     {0, 0, 0, 0},
+		"too large": {0, 0x10, 0, 0, sshFxpInit},
+	} {
+		var out bytes.Buffer
+		if err := NewSFTPServer(nil, "/", bytes.NewReader(packet), &out).Serve(); err == nil {
+			t.Errorf("%s: Serve succeeded", name)
+		}
+	}
+	// A stream cut within a packet is an error, unlike one cut between
+	// packets.
+	packet := sftpRequest(sshFxpRealpath, 1, "/")
+	var out bytes.Buffer
+	if err := NewSFTPServer(nil, "/", bytes.NewReader(packet[:7]), &out).Serve(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Serve of a truncated packet returned %v", err)
+	}
+}
+
+func TestSFTPAttrs(t *testing.T) {
+	w := &sftpWriter{}
+	w.uint32(sshFileXferAttrSize | sshFileXferAttrPermissions | sshFileXferAttrACModTime | sshFileXferAttrExtended)
+	w.uint64(1 << 33)
+	w.uint32(0100640)
+	w.uint32(1)
+	w.uint32(2)
+	w.uint32(1) // One extended attribute, ignored.
+	w.string("name@example.com")
+	w.bytes([]byte{1, 2})
+	w.uint32(7) // What follows.
+	r := &sftpReader{b: w.b}
+	a := r.attrs()
+	if a != (sftpAttrs{flags: a.flags, size: 1 << 33, permissions: 0100640, atime: 1, mtime: 2}) {
+		t.Errorf("attrs = %+v", a)
+	}
+	if r.uint32() != 7 || r.err != nil {
+		t.Errorf("attrs did not consume the extended attributes: %v", r.err)
+	}
+
+	r = &sftpReader{b: w.b[:10]}
+	r.attrs()
+	if r.err != io.ErrUnexpectedEOF {
+		t.Errorf("attrs of a truncated request returned %v", r.err)
+	}
+
+	// Attributes sent to clients round trip.
+	n := &FileNode{Mode: os.ModeSymlink | 0777, SymlinkTarget: "target", Uid: 1000, Gid: 100,
+		Atime: time.Unix(1546300800, 0), Mtime: time.Unix(-1, 0)}
+	w = &sftpWriter{}
+	w.nodeAttrs(n)
+	a = (&sftpReader{b: w.b}).attrs()
+	if a.size != 6 || a.uid != 1000 || a.gid != 100 || a.permissions != unixMode(n.Mode) || a.atime != 1546300800 || a.mtime != 0 {
+		t.Errorf("attrs of %+v = %+v", n, a)
+	}
+}
+
+func TestUnixTime(t *testing.T) {
+	for _, tc := range []struct {
+		t    time.Time
+		want uint32
+	}{
+		{time.Unix(0, 0), 0},
+		{time.Unix(-5, 0), 0},
+		{time.Unix(1546300800, 999), 1546300800},
+		{time.Unix(1<<32, 0), 1<<32 - 1},
+	} {
+		if got := unixTime(tc.t); got != tc.want {
+			t.Errorf("unixTime(%d) = %d, want %d", tc.t.Unix(), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// The blocks of a file are contiguous in the primary key of data_blocks, so
+// writing a large file sends every write to the same range of CockroachDB,
+// which then becomes a hotspot. Hash sharding the primary key prefixes it
+// with a hidden column computed from the inode and sequence, spreading the
+// blocks of a file over `buckets` ranges. Reading a file then scans every
+// bucket, which CockroachDB does in parallel.
+
+// Limits on the number of buckets accepted by CockroachDB.
+const (
+	minBlockShards = 2
+	maxBlockShards = 2048
+)
+
+// ShardDataBlocks hash shards the primary key of the data_blocks table into
+// `buckets` buckets. Changing the primary key rewrites the table, so this is
+// best done when the file system is created with `sqlfs init`.
+func ShardDataBlocks(ctx context.Context, db *DB, buckets int) error {
+	if buckets < minBlockShards || buckets > maxBlockShards {
+		return errors.Errorf("the number of block shards must be between %d and %d", minBlockShards, maxBlockShards)
+	}
+	// Session settings only apply to the connection they are set on.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Required before CockroachDB v22.1, which removed the setting: failures
+	// are reported by the statement below if the setting was needed.
+	_, _ = conn.ExecContext(ctx, "SET experimental_enable_hash_sharded_indexes = true")
+	q := fmt.Sprintf(`ALTER TABLE data_blocks ALTER PRIMARY KEY
+  USING COLUMNS (inode, sequence) USING HASH WITH BUCKET_COUNT = %d`, buckets)
+	if _, err := conn.ExecContext(ctx, q); err != nil {
+		return errors.Wrap(err, "failed to shard the data blocks")
+	}
+	return PutSetting(ctx, db, settingBlockShards, strconv.Itoa(buckets))
+}
+
+// GetBlockShards returns the number of buckets the data blocks are sharded
+// into, or 0 if they are not sharded.
+func GetBlockShards(ctx context.Context, db *DB) (int, error) {
+	value, err := GetSetting(ctx, db, settingBlockShards)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	buckets, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s setting %q", settingBlockShards, value)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"log"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+const (
+	// How long to wait between attempts to unmount a busy mountpoint.
+	unmountRetryInterval = time.Second
+	// Number of attempts to unmount before waiting for another signal.
+	unmountAttempts = 30
+)
+
+// shutdown unmounts the file system gracefully. New operations are refused,
+// the operations in flight get up to `timeout` to complete, and the state
+// kept in memory is written to the database before unmounting. New
+// operations are accepted again if unmounting fails, e.g. because the
+// mountpoint is busy.
+func (fs fileSystem) shutdown(mountpoint string, timeout time.Duration) error {
+	if n := fs.ops.Drain(timeout); n > 0 {
+		log.Printf("%d operations still in flight after %s, unmounting anyway\n", n, timeout)
+	}
+	fs.flush()
+	if err := unmountWithRetry(mountpoint); err != nil {
+		fs.ops.Resume()
+		return err
+	}
+	return nil
+}
+
+// flush writes the batched creates, the coalesced appends, the queued
+// writes, the batched access times and the pending content index updates to
+// the database.
+func (fs fileSystem) flush() {
+	fs.flushCreates()
+	if fs.appends != nil {
+		fs.appends.FlushAll()
+	}
+	if fs.writes != nil {
+		fs.writes.WaitAll()
+	}
+	if fs.atime != nil {
+		fs.atime.flush()
+	}
+	if fs.index != nil {
+		fs.index.flush(time.Now())
+	}
+}
+
+// unmountWithRetry attempts to unmount `mountpoint`, retrying while the
+// mountpoint is busy. It returns the last error if all attempts failed.
+func unmountWithRetry(mountpoint string) error {
+	var err error
+	for i := 0; i < unmountAttempts; i++ {
+		if err = fuse.Unmount(mountpoint); err == nil {
+			return nil
+		}
+		log.Printf("Failed to unmount (attempt %d/%d): %s\n", i+1, unmountAttempts, err)
+		time.Sleep(unmountRetryInterval)
+	}
+	return err
+}
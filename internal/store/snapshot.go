@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+// A snapshot names a point in time of the file system. Taking one only
+// records the current timestamp of the cluster; the file system is read as
+// of that timestamp with CockroachDB's AS OF SYSTEM TIME, which works for as
+// long as the timestamp is within the garbage collection window of the
+// tables (gc.ttlseconds of their zone configuration). Nothing keeps the
+// versions of the rows a snapshot reads from being collected past that
+// window, so snapshots expire once it passes, and are reported as such.
+
+// snapshotTables are the tables read through snapshots.
+var snapshotTables = []string{"tree", "inodes", "data_blocks", "xattrs"}
+
+// gcTTLPattern finds the garbage collection window in the SQL of a zone
+// configuration.
+var gcTTLPattern = regexp.MustCompile(`gc\.ttlseconds = (\d+)`)
+
+// snapshotStatements creates the table of snapshots. It is only created by
+// `sqlfs init -snapshots`.
+var snapshotStatements = []string{
+	`CREATE TABLE IF NOT EXISTS snapshots (
+  name     STRING,
+  taken_at DECIMAL NOT NULL,
+  created  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (name)
+)`,
+}
+
+// CreateSnapshots creates the table holding the snapshots.
+func CreateSnapshots(ctx context.Context, db *DB) error {
+	for _, q := range snapshotStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q", q)
+		}
+	}
+	return nil
+}
+
+// snapshot is a named point in time of the file system.
+type snapshot struct {
+	Name string `json:"name"`
+	// HLC timestamp of the cluster, as accepted by AS OF SYSTEM TIME.
+	TakenAt string    `json:"taken_at"`
+	Created time.Time `json:"created"`
+	// When the garbage collection window of the tables passes the snapshot,
+	// given their current zone configurations.
+	Expires time.Time `json:"expires"`
+}
+
+// Expired returns true if the snapshot may no longer be readable at `now`.
+func (s snapshot) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// setExpiry sets when `s` expires, given the garbage collection window `ttl`.
+func (s *snapshot) setExpiry(ttl time.Duration) error {
+	t, err := hlcTime(s.TakenAt)
+	if err != nil {
+		return err
+	}
+	s.Expires = t.Add(ttl)
+	return nil
+}
+
+// snapshotTTL returns how long the tables read through snapshots keep the
+// old versions of their rows: the shortest of their garbage collection
+// windows.
+func snapshotTTL(ctx context.Context, db *DB) (time.Duration, error) {
+	var ttl time.Duration
+	for _, table := range snapshotTables {
+		var target, config string
+		if err := db.QueryRowContext(ctx, "SHOW ZONE CONFIGURATION FOR TABLE "+table).Scan(&target, &config); err != nil {
+			return 0, errors.Wrapf(err, "failed to read the zone configuration of %s", table)
+		}
+		d, err := parseGCTTL(config)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid zone configuration of %s", table)
+		}
+		if ttl == 0 || d < ttl {
+			ttl = d
+		}
+	}
+	return ttl, nil
+}
+
+// parseGCTTL returns the garbage collection window set by `config`, the SQL
+// of a zone configuration as returned by SHOW ZONE CONFIGURATION.
+func parseGCTTL(config string) (time.Duration, error) {
+	m := gcTTLPattern.FindStringSubmatch(config)
+	if m == nil {
+		return 0, errors.New("no gc.ttlseconds")
+	}
+	secs, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// CreateSnapshot records the current timestamp of the cluster as the
+// snapshot `name`. It fails with EEXIST if the name is taken.
+func CreateSnapshot(ctx context.Context, db *DB, name string) (snapshot, error) {
+	if err := db.validName(name); err != nil {
+		return snapshot{}, fuse.Errno(syscall.EINVAL)
+	}
+	s := snapshot{Name: name}
+	q := `INSERT INTO snapshots (name, taken_at) VALUES ($1, cluster_logical_timestamp())
+  RETURNING taken_at::STRING, created`
+	if err := db.QueryRowContext(ctx, q, name).Scan(&s.TakenAt, &s.Created); err != nil {
+		return snapshot{}, errors.Wrapf(err, "failed to create snapshot %q", name)
+	}
+	ttl, err := snapshotTTL(ctx, db)
+	if err != nil {
+		return s, err
+	}
+	return s, s.setExpiry(ttl)
+}
+
+// GetSnapshot returns the snapshot `name`, or sql.ErrNoRows if there is
+// none.
+func GetSnapshot(ctx context.Context, db *DB, name string) (snapshot, error) {
+	s := snapshot{Name: name}
+	q := "SELECT taken_at::STRING, created FROM snapshots WHERE name = $1"
+	if err := db.QueryRowContext(ctx, q, name).Scan(&s.TakenAt, &s.Created); err != nil {
+		return s, err
+	}
+	ttl, err := snapshotTTL(ctx, db)
+	if err != nil {
+		return s, err
+	}
+	return s, s.setExpiry(ttl)
+}
+
+// ListSnapshots returns the snapshots, oldest first.
+func ListSnapshots(ctx context.Context, db *DB) ([]snapshot, error) {
+	q := "SELECT name, taken_at::STRING, created FROM snapshots ORDER BY taken_at, name"
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshots")
+	}
+	defer rows.Close()
+	var snapshots []snapshot
+	for rows.Next() {
+		var s snapshot
+		if err := rows.Scan(&s.Name, &s.TakenAt, &s.Created); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	ttl, err := snapshotTTL(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		if err := snapshots[i].setExpiry(ttl); err != nil {
+			return nil, err
+		}
+	}
+	return snapshots, nil
+}
+
+// RemoveSnapshot forgets the snapshot `name`, or returns sql.ErrNoRows if
+// there is none.
+func RemoveSnapshot(ctx context.Context, db *DB, name string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM snapshots WHERE name = $1", name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove snapshot %q", name)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	fuseFS "bazil.org/fuse/fs"
+)
+
+// The snapshots directory is a read-only directory at the root of the mount
+// holding a directory per snapshot, with the contents of the root of the
+// mount as of that snapshot, as .zfs/snapshot does on ZFS:
+//
+//	cp .snapshots/before-upgrade/etc/app.conf etc/
+//
+// Each snapshot is read through its own pool of historical connections,
+// opened when the snapshot is first looked up (see asof.go). Nodes in
+// snapshots report the inode numbers they had, which are those of the live
+// files they became, so tools that look for hard links by inode number
+// should not be run across a snapshot and the live tree. The root of each
+// snapshot has a number of its own, as the root of the mount is above it.
+const SnapshotsDirName = ".snapshots"
+
+// Inode number of the snapshots directory, after those of the status
+// directory.
+const snapshotsInode = statusInode | 1<<61
+
+// snapshotRootInode returns the inode number reported for the root of the
+// snapshot `name`, in the range of the snapshots directory. It differs from
+// that of the root of the mount, which find(1) and du(1) would otherwise
+// take for a loop when walking the snapshots directory.
+func snapshotRootInode(name string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return snapshotsInode | h.Sum64()&(1<<60-1) | 1
+}
+
+// snapshotViews holds the views of the snapshots looked up through the
+// mount.
+type snapshotViews struct {
+	url string // Of the database.
+
+	mu    sync.Mutex
+	views map[string]*snapshotView
+}
+
+// snapshotView is the file system as of a snapshot.
+type snapshotView struct {
+	takenAt string
+	fs      *fileSystem
+}
+
+func newSnapshotViews(url string) *snapshotViews {
+	return &snapshotViews{url: url, views: make(map[string]*snapshotView)}
+}
+
+// view returns the file system as of `s`, based on the settings of `live`.
+// A snapshot that was removed and taken again under the same name gets a
+// new view.
+func (v *snapshotViews) view(live *fileSystem, s snapshot) (*fileSystem, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if view, ok := v.views[s.Name]; ok {
+		if view.takenAt == s.TakenAt {
+			return view.fs, nil
+		}
+		_ = view.fs.db.Close()
+		delete(v.views, s.Name)
+	}
+	connector, err := NewHistoricalConnector(v.url, s.TakenAt)
+	if err != nil {
+		return nil, err
+	}
+	fs := &fileSystem{
+		db:        &DB{DB: sql.OpenDB(connector), settings: live.db.settings},
+		root:      live.root,
+		atimeMode: atimeNone,
+		dirOrder:  live.dirOrder,
+		readahead: live.readahead,
+		ops:       live.ops,
+		locks:     newInodeLocks(),
+		epochs:    &epochTable{},
+		diskFull:  live.diskFull,
+		usage:     newUsageCache(),
+		tasks:     live.tasks,
+
+		maintenance: &maintenanceMode{local: 1},
+
+		directIO:      live.directIO,
+		securityLabel: live.securityLabel,
+		noAppleDouble: live.noAppleDouble,
+		uids:          live.uids,
+		gids:          live.gids,
+		maxNameLen:    live.maxNameLen,
+	}
+	v.views[s.Name] = &snapshotView{takenAt: s.TakenAt, fs: fs}
+	return fs, nil
+}
+
+// Close closes the connections of the views.
+func (v *snapshotViews) Close() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for name, view := range v.views {
+		_ = view.fs.db.Close()
+		delete(v.views, name)
+	}
+}
+
+// isSnapshotsDir returns whether the entry `name` of the directory `parent`
+// is the snapshots directory.
+func (fs fileSystem) isSnapshotsDir(parent uint64, name string) bool {
+	return fs.snapshots != nil && name == SnapshotsDirName && fs.isMountRoot(parent)
+}
+
+// snapshotsDirNode is the snapshots directory.
+type snapshotsDirNode struct {
+	fs *fileSystem
+}
+
+// Attr implements the fuseFS.Node interface.
+func (d *snapshotsDirNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Inode = snapshotsInode
+	attr.Mode = os.ModeDir | 0555
+	attr.Nlink = 2
+	attr.Mtime = time.Now()
+	attr.Ctime = attr.Mtime
+	attr.Atime = attr.Mtime
+	return nil
+}
+
+// Lookup implements the fuseFS.NodeStringLookuper interface.
+func (d *snapshotsDirNode) Lookup(ctx context.Context, name string) (fuseFS.Node, error) {
+	s, err := GetSnapshot(ctx, d.fs.db, name)
+	if err == sql.ErrNoRows {
+		return nil, fuse.ENOENT
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	if s.Expired(time.Now()) {
+		log.Printf("snapshot %q expired at %s, past the garbage collection window of the tables\n", name, s.Expires)
+		return nil, fuse.ENOENT
+	}
+	view, err := d.fs.snapshots.view(d.fs, s)
+	if err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	// Fails if the mounted subdirectory did not exist yet.
+	root, err := view.Root()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotRootNode{FileNode: root.(*FileNode), inode: snapshotRootInode(name)}, nil
+}
+
+// ReadDirAll implements the fuseFS.HandleReadDirAller interface.
+func (d *snapshotsDirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	snapshots, err := ListSnapshots(ctx, d.fs.db)
+	if err != nil {
+		log.Println(err)
+		return nil, errnoFromErr(ctx, err)
+	}
+	parent := d.fs.root
+	if parent == 0 {
+		parent = RootInode
+	}
+	entries := []fuse.Dirent{
+		{Inode: snapshotsInode, Name: ".", Type: fuse.DT_Dir},
+		{Inode: parent, Name: "..", Type: fuse.DT_Dir},
+	}
+	now := time.Now()
+	for _, s := range snapshots {
+		if s.Expired(now) {
+			continue
+		}
+		entries = append(entries, fuse.Dirent{Inode: snapshotRootInode(s.Name), Name: s.Name, Type: fuse.DT_Dir})
+	}
+	return entries, nil
+}
+
+// snapshotRootNode is the root of the mount as of a snapshot, which reports
+// the inode number of the snapshot rather than that of the root.
+type snapshotRootNode struct {
+	*FileNode
+	inode uint64
+}
+
+// Attr implements the fuseFS.Node interface.
+func (n *snapshotRootNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	if err := n.FileNode.Attr(ctx, attr); err != nil {
+		return err
+	}
+	attr.Inode = n.inode
+	return nil
+}
+
+// Open implements the fuseFS.NodeOpener interface. Directories are their
+// own handles, so the root is listed by ReadDirAll below.
+func (n *snapshotRootNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fuseFS.Handle, error) {
+	h, err := n.FileNode.Open(ctx, req, resp)
+	if h == fuseFS.Handle(n.FileNode) {
+		return n, err
+	}
+	return h, err
+}
+
+// ReadDirAll implements the fuseFS.HandleReadDirAller interface.
+func (n *snapshotRootNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries, err := n.FileNode.ReadDirAll(ctx)
+	for i := range entries {
+		switch entries[i].Name {
+		case ".":
+			entries[i].Inode = n.inode
+		case "..":
+			entries[i].Inode = snapshotsInode
+		}
+	}
+	return entries, err
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotRootInode(t *testing.T) {
+	seen := make(map[uint64]string)
+	for _, name := range []string{"a", "b", "before-upgrade", "2024-01-01"} {
+		inode := snapshotRootInode(name)
+		if inode&snapshotsInode != snapshotsInode || inode == snapshotsInode {
+			t.Errorf("snapshot %q has inode %#x, outside the range of the snapshots directory", name, inode)
+		}
+		if other, ok := seen[inode]; ok {
+			t.Errorf("snapshots %q and %q share inode %#x", name, other, inode)
+		}
+		seen[inode] = name
+		if snapshotRootInode(name) != inode {
+			t.Errorf("the inode of snapshot %q is not stable", name)
+		}
+	}
+}
+
+func TestParseGCTTL(t *testing.T) {
+	config := `ALTER TABLE data_blocks CONFIGURE ZONE USING
+	range_min_bytes = 134217728,
+	range_max_bytes = 536870912,
+	gc.ttlseconds = 14400,
+	num_replicas = 3`
+	ttl, err := parseGCTTL(config)
+	if err != nil || ttl != 4*time.Hour {
+		t.Errorf("parseGCTTL returned %v, %v, want 4h", ttl, err)
+	}
+	if _, err := parseGCTTL("ALTER RANGE default CONFIGURE ZONE USING num_replicas = 3"); err == nil {
+		t.Error("parseGCTTL succeeded without gc.ttlseconds")
+	}
+}
+
+func TestSnapshotExpiry(t *testing.T) {
+	s := snapshot{Name: "s", TakenAt: "1700000000000000000.0000000001"}
+	if err := s.setExpiry(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Unix(1700000000, 0)
+	if !s.Expires.Equal(taken.Add(time.Hour)) {
+		t.Errorf("snapshot expires at %s, want an hour after %s", s.Expires, taken)
+	}
+	if s.Expired(taken.Add(59 * time.Minute)) {
+		t.Error("snapshot expired within the window")
+	}
+	if !s.Expired(taken.Add(time.Hour)) {
+		t.Error("snapshot did not expire past the window")
+	}
+}
@@ -0,0 +1,1317 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// inodeMetadataColumns lists the metadata columns of the inodes table, in
+// the order in which they are written by inodeValues.
+const inodeMetadataColumns = "size, atime, mtime, ctime, crtime, mode, nlink, uid, gid, rdev, flags, symlink_target"
+
+// inodeColumns lists the columns of the inodes table scanned by inodeFields.
+// The generation is not written with the rest of the metadata, so that a
+// stale node cannot move it backwards, see bumpGeneration.
+const inodeColumns = inodeMetadataColumns + ", generation"
+
+const upsertInodeQuery = `UPSERT INTO inodes(inode, ` + inodeMetadataColumns + `)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+
+// inodeFields returns the scan destinations for inodeColumns.
+func inodeFields(n *FileNode) []interface{} {
+	return []interface{}{
+		&n.Size, &n.Atime, &n.Mtime, &n.Ctime, &n.Crtime, &n.Mode,
+		&n.Nlink, &n.Uid, &n.Gid, &n.Rdev, &n.Flags, &n.SymlinkTarget,
+		&n.Generation,
+	}
+}
+
+// inodeValues returns the arguments of upsertInodeQuery for `n`.
+func inodeValues(n *FileNode) []interface{} {
+	return []interface{}{
+		n.Inode, n.Size, n.Atime, n.Mtime, n.Ctime, n.Crtime, n.Mode,
+		n.Nlink, n.Uid, n.Gid, n.Rdev, n.Flags, n.SymlinkTarget,
+	}
+}
+
+// prefixColumns qualifies every column in the comma separated `columns`
+// with `table`.
+func prefixColumns(table, columns string) string {
+	parts := strings.Split(columns, ", ")
+	for i, c := range parts {
+		parts[i] = table + "." + c
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DB is the database of a file system, along with the settings of the
+// file system.
+type DB struct {
+	*sql.DB
+	*settings
+}
+
+// NewDB returns `db` with the default settings, for use until
+// LoadFileSystem loads those of its file system, e.g. to create the schema.
+func NewDB(db *sql.DB) *DB {
+	return &DB{DB: db, settings: defaultSettings()}
+}
+
+// BeginTx starts a transaction sharing the settings of `db`.
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*fsTx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &fsTx{Tx: tx, settings: db.settings}, nil
+}
+
+// fsTx is a transaction of a DB.
+type fsTx struct {
+	*sql.Tx
+	*settings
+}
+
+// execer is implemented by *DB and *fsTx, as by *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// allocateInode returns a new inode number. Inode numbers come from their
+// own sequence rather than from the rows of the tree, so a file keeps its
+// number for its whole life, across renames and hard links. They stay below
+// 2^63, which leaves the upper half to the dynamic inodes of the FUSE
+// library.
+func allocateInode(ctx context.Context, tx *fsTx) (uint64, error) {
+	var inode uint64
+	if err := tx.QueryRowContext(ctx, "SELECT nextval('inode_seq')").Scan(&inode); err != nil {
+		return 0, errors.Wrap(err, "failed to allocate an inode number")
+	}
+	return inode, nil
+}
+
+// putInode writes the metadata of `n` into the inodes table.
+func putInode(ctx context.Context, e execer, n *FileNode) error {
+	_, err := e.ExecContext(ctx, upsertInodeQuery, inodeValues(n)...)
+	return err
+}
+
+// touchDir sets the modification and change times of the directory `inode`
+// to `now`, after entries were added to or removed from it.
+func touchDir(ctx context.Context, e execer, inode uint64, now time.Time) error {
+	q := "UPDATE inodes SET mtime = $2, ctime = $2 WHERE inode = $1"
+	if _, err := e.ExecContext(ctx, q, inode, now); err != nil {
+		return errors.Wrapf(err, "failed to update times of directory %d", inode)
+	}
+	return nil
+}
+
+func CreateLink(ctx context.Context, db *DB, parent uint64, n *FileNode) error {
+	if err := db.validName(n.Name); err != nil {
+		return err
+	}
+	n.Name = db.normName(n.Name)
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+
+	q1 := "UPSERT INTO tree(inode, parent, name) VALUES ($1, $2, $3)"
+	if _, err := tx.ExecContext(ctx, q1, n.Inode, parent, n.Name); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to upsert row into tree in parent %d", parent)
+	}
+	toUpdate, err := GetNodeByID(ctx, db, n.Inode)
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to retrieve node for update %d", n.Inode)
+	}
+	now := time.Now()
+	toUpdate.Nlink += 1
+	toUpdate.Name = n.Name
+	toUpdate.Ctime = now
+	if err := putInode(ctx, tx, toUpdate); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to upsert into inodes for inode %d", n.Inode)
+	}
+	if err := touchDir(ctx, tx, parent, now); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func UpsertNode(ctx context.Context, db *DB, parent uint64, n *FileNode) error {
+	if err := db.validName(n.Name); err != nil {
+		return err
+	}
+	n.Name = db.normName(n.Name)
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	n.Mtime = now
+	n.Ctime = now
+	lastId, err := allocateInode(ctx, tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	q1 := "INSERT INTO tree(inode, parent, name) VALUES ($1, $2, $3)"
+	if _, err := tx.ExecContext(ctx, q1, lastId, parent, n.Name); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to upsert row into tree in parent %d", parent)
+	}
+	n.Inode = lastId
+	n.Parent = parent
+	if err := putInode(ctx, tx, n); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to upsert into inodes for inode %d", lastId)
+	}
+	if err := touchDir(ctx, tx, parent, now); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RenameNode moves the entry `oldName` of `oldParent` to `newName` in
+// `newParent`, and returns the inode of the entry. The change time of the
+// node and the times of both directories are updated in the same
+// transaction.
+func RenameNode(
+	ctx context.Context, db *DB,
+	oldParent uint64, oldName string, newParent uint64, newName string,
+) (uint64, error) {
+	if err := db.validName(newName); err != nil {
+		return 0, err
+	}
+	oldName, newName = db.normName(oldName), db.normName(newName)
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return 0, err
+	}
+
+	var inode uint64
+	q1 := "UPDATE tree SET name = $1, parent = $2 WHERE " + db.nameEquals("name", "$3") + " AND parent = $4 RETURNING inode"
+	err = tx.QueryRowContext(ctx, q1, newName, newParent, oldName, oldParent).Scan(&inode)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, errors.Wrapf(err, "failed to rename node")
+	}
+	now := time.Now()
+	q2 := "UPDATE inodes SET ctime = $2 WHERE inode = $1"
+	if _, err := tx.ExecContext(ctx, q2, inode, now); err != nil {
+		_ = tx.Rollback()
+		return 0, errors.Wrapf(err, "failed to update change time of inode %d", inode)
+	}
+	for _, dir := range []uint64{oldParent, newParent} {
+		if err := touchDir(ctx, tx, dir, now); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	return inode, tx.Commit()
+}
+
+func CountNodesInDir(ctx context.Context, db *DB, inode uint64) (int, error) {
+	var count int
+	q := "SELECT COUNT(*) FROM tree WHERE parent = $1"
+	if err := db.QueryRowContext(ctx, q, inode).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountSubdirectories returns the number of directories in the directory
+// `inode`.
+func CountSubdirectories(ctx context.Context, db *DB, inode uint64) (int, error) {
+	var count int
+	q := `SELECT COUNT(*) FROM tree JOIN inodes ON inodes.inode = tree.inode
+  WHERE tree.parent = $1 AND inodes.mode & $2 != 0`
+	if err := db.QueryRowContext(ctx, q, inode, int64(os.ModeDir)).Scan(&count); err != nil {
+		return 0, errors.Wrapf(err, "failed to count subdirectories of %d", inode)
+	}
+	return count, nil
+}
+
+// ListDirAttrs returns the attributes of all entries of the directory
+// `inode` in one query: their nodes, with the bytes stored for regular files
+// and the number of subdirectories of directories, listed in order `order`.
+func ListDirAttrs(ctx context.Context, db *DB, inode uint64, order dirOrder) ([]dirAttrs, error) {
+	q := `SELECT tree.inode, tree.name, ` + prefixColumns("inodes", inodeColumns) + `,
+    CASE WHEN inodes.mode & $2 = 0 THEN
+      (SELECT COALESCE(SUM(length(data)), 0) FROM data_blocks WHERE data_blocks.inode = tree.inode) + ` + db.inlineLength("inodes") + `
+    ELSE 0 END,
+    CASE WHEN inodes.mode & $3 != 0 THEN
+      (SELECT COUNT(*) FROM tree AS sub JOIN inodes AS subnode ON subnode.inode = sub.inode
+       WHERE sub.parent = tree.inode AND subnode.mode & $3 != 0)
+    ELSE 0 END
+  FROM tree JOIN inodes ON tree.inode = inodes.inode WHERE tree.parent = $1 ` + order.orderBy()
+	rows, err := db.QueryContext(ctx, q, inode, int64(os.ModeType), int64(os.ModeDir))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not query attributes of entries in directory inode %d", inode)
+	}
+	defer rows.Close()
+
+	var entries []dirAttrs
+	for rows.Next() {
+		e := dirAttrs{node: FileNode{Parent: inode}}
+		n := &e.node
+		dest := append([]interface{}{&n.Inode, &n.Name}, inodeFields(n)...)
+		if err := rows.Scan(append(dest, &e.stored, &e.subdirs)...); err != nil {
+			return nil, errors.Wrap(err, "failed to scan attributes")
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func CountInodes(ctx context.Context, db *DB) (int, error) {
+	var count int
+	q := "SELECT COUNT(*) FROM inodes"
+	if err := db.QueryRowContext(ctx, q).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func CountDataBlocks(ctx context.Context, db *DB) (int, error) {
+	var count int
+	q := "SELECT COUNT(*) FROM data_blocks"
+	if err := db.QueryRowContext(ctx, q).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ListNodesInDir obtains all nodes in the directory with Inode number `inode`,
+// sorted by name.
+func ListNodesInDir(ctx context.Context, db *DB, inode uint64) ([]*FileNode, error) {
+	return ListNodesInDirOrdered(ctx, db, inode, dirOrderName)
+}
+
+// ListNodesInDirOrdered is ListNodesInDir, listing the nodes in order `order`.
+func ListNodesInDirOrdered(ctx context.Context, db *DB, inode uint64, order dirOrder) ([]*FileNode, error) {
+	if inode != RootInode {
+		dir, err := GetNodeByID(ctx, db, inode)
+		if err != nil {
+			return nil, err
+		}
+		if !dir.IsDirectory() {
+			return nil, errors.New("ListNodesInDir can only be called on directories")
+		}
+	}
+
+	q := `SELECT tree.inode, tree.name, ` + prefixColumns("inodes", inodeColumns) + `
+  FROM tree JOIN inodes ON tree.inode = inodes.inode WHERE parent = $1 ` + order.orderBy()
+	rows, err := db.QueryContext(ctx, q, inode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not query entries in directory inode %d", inode)
+	}
+	defer rows.Close()
+
+	var nodes []*FileNode
+	for rows.Next() {
+		n := &FileNode{Parent: inode}
+		dest := append([]interface{}{&n.Inode, &n.Name}, inodeFields(n)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrapf(err, "failed to scan files in directory inode %d", inode)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// RemoveNodeByName removes the entry `name` referring to `inode` in
+// `parent`. The inode itself is removed once no entry refers to it anymore.
+// Data blocks of a removed inode are deleted in batches after the entry is
+// gone, so that removing a large file does not need one huge transaction.
+func RemoveNodeByName(ctx context.Context, db *DB, parent uint64, name string, inode uint64) error {
+	name = db.normName(name)
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	removed, err := unlinkEntry(ctx, tx, parent, name, inode)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if removed {
+		return RemoveDataBlocks(ctx, db, inode)
+	}
+	return nil
+}
+
+// unlinkEntry deletes the entry `name` in `parent`, and deletes `inode` if
+// nothing refers to it anymore. Otherwise the link count and change time of
+// `inode` are updated. It returns true if the inode was deleted, in which case its data
+// blocks must be removed by the caller.
+func unlinkEntry(ctx context.Context, tx *fsTx, parent uint64, name string, inode uint64) (bool, error) {
+	q1 := "DELETE FROM tree WHERE parent = $1 AND " + tx.nameEquals("name", "$2")
+	if _, err := tx.ExecContext(ctx, q1, parent, name); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if err := touchDir(ctx, tx, parent, now); err != nil {
+		return false, err
+	}
+
+	// Check if anything is still referencing inode.
+	var count int
+	q2 := "SELECT COUNT(*) FROM tree WHERE inode = $1"
+	if err := tx.QueryRowContext(ctx, q2, inode).Scan(&count); err != nil {
+		return false, err
+	}
+	// Directories cannot be hard linked, so the remaining entries are hard
+	// links to the same file.
+	if count > 0 {
+		q3 := "UPDATE inodes SET nlink = $2, ctime = $3 WHERE inode = $1"
+		if _, err := tx.ExecContext(ctx, q3, inode, count, now); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	q4 := "DELETE FROM inodes WHERE inode = $1"
+	if _, err := tx.ExecContext(ctx, q4, inode); err != nil {
+		return false, err
+	}
+	if err := removeXattrs(ctx, tx, inode); err != nil {
+		return false, err
+	}
+	if err := removeFileHash(ctx, tx, inode); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Number of rows deleted per transaction when removing data blocks or
+// whole subtrees.
+const removeBatchSize = 1000
+
+// RemoveDataBlocks deletes all data blocks of `inode` in batches, along with
+// its inline data.
+func RemoveDataBlocks(ctx context.Context, db *DB, inode uint64) error {
+	if db.inlineDataSize > 0 {
+		if err := removeInlineData(ctx, db, inode); err != nil {
+			return err
+		}
+	}
+	q := "DELETE FROM data_blocks WHERE inode = $1 LIMIT $2"
+	for {
+		res, err := db.ExecContext(ctx, q, inode, removeBatchSize)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove data blocks of inode %d", inode)
+		}
+		count, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if count < removeBatchSize {
+			return nil
+		}
+	}
+}
+
+// RemoveTree removes the entry `name` in `parent` along with everything below
+// it if it is a directory. Entries are removed deepest first in batched
+// transactions, so an interrupted removal never leaves detached subtrees
+// behind. It returns the number of entries removed.
+func RemoveTree(ctx context.Context, db *DB, parent uint64, name string) (int, error) {
+	name = db.normName(name)
+	q := `WITH RECURSIVE subtree (parent, name, inode, depth) AS (
+    SELECT parent, name, inode, 0 FROM tree WHERE parent = $1 AND ` + db.nameEquals("name", "$2") + `
+  UNION ALL
+    SELECT tree.parent, tree.name, tree.inode, subtree.depth + 1
+    FROM tree JOIN subtree ON tree.parent = subtree.inode
+  )
+  SELECT parent, name, inode FROM subtree ORDER BY depth DESC`
+	rows, err := db.QueryContext(ctx, q, parent, name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not list entries below %q", name)
+	}
+	var entries []treeEntry
+	for rows.Next() {
+		var e treeEntry
+		if err := rows.Scan(&e.Parent, &e.Name, &e.Inode); err != nil {
+			rows.Close()
+			return 0, errors.Wrapf(err, "failed to scan entries below %q", name)
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	removedCount := 0
+	for start := 0; start < len(entries); start += removeBatchSize {
+		end := start + removeBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err != nil {
+			return removedCount, err
+		}
+		var removed []uint64
+		for _, e := range entries[start:end] {
+			ok, err := unlinkEntry(ctx, tx, e.Parent, e.Name, e.Inode)
+			if err != nil {
+				_ = tx.Rollback()
+				return removedCount, errors.Wrapf(err, "failed to remove %q in parent %d", e.Name, e.Parent)
+			}
+			if ok {
+				removed = append(removed, e.Inode)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return removedCount, err
+		}
+		removedCount = end
+		for _, inode := range removed {
+			if err := RemoveDataBlocks(ctx, db, inode); err != nil {
+				return removedCount, err
+			}
+		}
+	}
+	return removedCount, nil
+}
+
+// WriteData stores `data` at `offset` in the contents of the file `n`. Only
+// the blocks overlapping the written range are rewritten; blocks that are
+// partially covered are merged with their existing contents. Gaps left
+// between the previous end of the file and `offset` are holes, which read
+// as zeros.
+func WriteData(ctx context.Context, db *DB, n *FileNode, offset int64, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	now := time.Now()
+	n.Mtime = now
+	n.Ctime = now
+	return writeBlocks(ctx, db, n, offset, data)
+}
+
+// writeBlocks is WriteData without updating the times of `n`, which callers
+// set beforehand.
+func writeBlocks(ctx context.Context, db *DB, n *FileNode, offset int64, data []byte) error {
+	if err := recallTiered(ctx, db, n); err != nil {
+		return err
+	}
+	return updateInode(ctx, db, n, func(tx *fsTx) error {
+		return writeBlocksTx(ctx, tx, n, offset, data)
+	})
+}
+
+func writeBlocksTx(ctx context.Context, tx *fsTx, n *FileNode, offset int64, data []byte) error {
+	if tx.inlineDataSize > 0 {
+		if inlined, err := writeInlineTx(ctx, tx, n, offset, data); inlined || err != nil {
+			return err
+		}
+	}
+
+	end := offset + int64(len(data))
+	first := offset / tx.BlockSize
+	last := (end + tx.BlockSize - 1) / tx.BlockSize
+
+	// Only the first and last blocks can be partially overwritten.
+	existing := make(map[int64][]byte)
+	q1 := "SELECT sequence, data FROM data_blocks WHERE inode = $1 AND sequence IN ($2, $3)"
+	rows, err := tx.QueryContext(ctx, q1, n.Inode, first+1, last)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sequence int64
+		var block []byte
+		if err := rows.Scan(&sequence, &block); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[sequence-1] = block
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Blocks past the last stored one are new and streamed with COPY, which
+	// avoids a round trip per block for large writes.
+	fresh := last
+	if last-first >= copyMinBlocks {
+		var stored int64
+		q := "SELECT COALESCE(MAX(sequence), 0) FROM data_blocks WHERE inode = $1"
+		if err := tx.QueryRowContext(ctx, q, n.Inode).Scan(&stored); err != nil {
+			return err
+		}
+		if stored > first {
+			fresh = stored
+		} else {
+			fresh = first
+		}
+	}
+
+	q2 := "UPSERT INTO data_blocks (inode, sequence, data) VALUES ($1, $2, $3)"
+	var copied [][]byte
+	for i := first; i < last; i++ {
+		blockStart := i * tx.BlockSize
+		from := offset - blockStart // Where the write starts within the block.
+		if from < 0 {
+			from = 0
+		}
+		to := end - blockStart // Where the write ends within the block.
+		if to > tx.BlockSize {
+			to = tx.BlockSize
+		}
+		block := existing[i]
+		if int64(len(block)) < to {
+			grown := make([]byte, to)
+			copy(grown, block)
+			block = grown
+		}
+		copy(block[from:to], data[blockStart+from-offset:])
+		if i >= fresh {
+			copied = append(copied, block)
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, q2, n.Inode, i+1, block); err != nil {
+			return err
+		}
+	}
+	if len(copied) > 0 {
+		if err := copyBlocks(ctx, tx, n.Inode, fresh, copied); err != nil {
+			return err
+		}
+	}
+
+	if uint64(end) > n.Size {
+		n.Size = uint64(end)
+	}
+	if err := putInode(ctx, tx, n); err != nil {
+		return err
+	}
+	return bumpGeneration(ctx, tx, n)
+}
+
+// Minimum number of blocks written at once for WriteData to look for new
+// blocks that can be inserted with COPY.
+const copyMinBlocks = 16
+
+// copyBlocks inserts `blocks` as the data blocks of `inode` starting at the
+// zero-based block index `first`, using the COPY protocol. The blocks must
+// not exist yet.
+func copyBlocks(ctx context.Context, tx *fsTx, inode uint64, first int64, blocks [][]byte) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("data_blocks", "inode", "sequence", "data"))
+	if err != nil {
+		return errors.Wrap(err, "failed to start copying data blocks")
+	}
+	for i, b := range blocks {
+		if _, err := stmt.ExecContext(ctx, inode, first+int64(i)+1, b); err != nil {
+			_ = stmt.Close()
+			return errors.Wrap(err, "failed to copy data blocks")
+		}
+	}
+	// Executing the statement without arguments ends the COPY.
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		_ = stmt.Close()
+		return errors.Wrap(err, "failed to copy data blocks")
+	}
+	return stmt.Close()
+}
+
+// TruncateData truncates or extends the file `n` to `size` bytes, dropping
+// its contents past `size`. The metadata of `n` is written in the same
+// transaction, so callers set its times beforehand.
+func TruncateData(ctx context.Context, db *DB, n *FileNode, size uint64) error {
+	if err := recallTiered(ctx, db, n); err != nil {
+		return err
+	}
+	return updateInode(ctx, db, n, func(tx *fsTx) error {
+		return truncateDataTx(ctx, tx, n, size)
+	})
+}
+
+func truncateDataTx(ctx context.Context, tx *fsTx, n *FileNode, size uint64) error {
+	if size < n.Size {
+		// Blocks are one-based, so the last block still in use is `keep`.
+		bs := uint64(tx.BlockSize)
+		keep := (size + bs - 1) / bs
+		q1 := "DELETE FROM data_blocks WHERE inode = $1 AND sequence > $2"
+		if _, err := tx.ExecContext(ctx, q1, n.Inode, keep); err != nil {
+			return err
+		}
+		if tail := size % bs; tail != 0 {
+			q2 := "UPDATE data_blocks SET data = substring(data, 1, $3) WHERE inode = $1 AND sequence = $2"
+			if _, err := tx.ExecContext(ctx, q2, n.Inode, keep, tail); err != nil {
+				return err
+			}
+		}
+		if tx.inlineDataSize > 0 {
+			if err := truncateInlineTx(ctx, tx, n, size); err != nil {
+				return err
+			}
+		}
+	}
+	n.Size = size
+	if err := putInode(ctx, tx, n); err != nil {
+		return err
+	}
+	return bumpGeneration(ctx, tx, n)
+}
+
+// ReadBlocks retrieves up to `count` data blocks of `inode` starting at the
+// zero-based block index `first`. Blocks are keyed by their index; missing
+// blocks are absent from the result. The blocks of tiered files are read
+// from the object store.
+func ReadBlocks(ctx context.Context, db *DB, inode uint64, first, count int64) (map[int64][]byte, error) {
+	// Sequences are one-based.
+	q := db.inlineBlocksQuery("SELECT " + db.blockColumns() + " FROM data_blocks WHERE inode = $1 AND sequence >= $2 AND sequence < $3")
+	rows, err := db.QueryContext(ctx, q, inode, first+1, first+count+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := make(map[int64][]byte, count)
+	for rows.Next() {
+		sequence, data, err := db.scanBlock(rows, inode)
+		if err != nil {
+			return nil, err
+		}
+		if sequence == 0 {
+			db.splitInline(blocks, data, first, count)
+			continue
+		}
+		blocks[sequence-1] = data
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return blocks, readTieredBlocks(ctx, db, inode, first, count, blocks)
+}
+
+// CopyData writes the contents of the file `n` to `w` one block at a time,
+// without holding the whole file in memory. Holes are written as zeros, and
+// the contents of tiered files read from the object store.
+func CopyData(ctx context.Context, db *DB, n *FileNode, w io.Writer) error {
+	var tiered *tieredObject
+	if db.tieringEnabled {
+		t, err := GetTieredObject(ctx, db, n.Inode)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			tiered = &t
+		}
+	}
+	q := db.inlineBlocksQuery("SELECT "+db.blockColumns()+" FROM data_blocks WHERE inode = $1") + " ORDER BY sequence"
+	rows, err := db.QueryContext(ctx, q, n.Inode)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var pos uint64
+	for rows.Next() && pos < n.Size {
+		sequence, block, err := db.scanBlock(rows, n.Inode)
+		if err != nil {
+			return err
+		}
+		var start uint64 // Inline data, sequence 0, starts the file.
+		if sequence > 0 {
+			start = uint64(sequence-1) * uint64(db.BlockSize)
+		}
+		if start > n.Size {
+			start = n.Size
+		}
+		if err := db.copyHole(ctx, w, tiered, pos, start); err != nil {
+			return err
+		}
+		pos = start
+		if uint64(len(block)) > n.Size-pos {
+			block = block[:n.Size-pos]
+		}
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+		pos += uint64(len(block))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return db.copyHole(ctx, w, tiered, pos, n.Size)
+}
+
+// copyHole writes the bytes [from, to) of a file that has no data blocks
+// there: zeros, unless the file is `tiered` and they are in its object.
+func (s *settings) copyHole(ctx context.Context, w io.Writer, tiered *tieredObject, from, to uint64) error {
+	if tiered != nil && from < tiered.Size && from < to {
+		if s.tierStore == nil {
+			return errNoTierStore(tiered.Inode)
+		}
+		end := to
+		if end > tiered.Size {
+			end = tiered.Size
+		}
+		chunkSize := uint64(recallChunkBlocks * s.BlockSize)
+		for from < end {
+			length := end - from
+			if length > chunkSize {
+				length = chunkSize
+			}
+			data, err := s.tierStore.GetRange(ctx, tiered.Object, int64(from), int64(length))
+			if err != nil {
+				return errors.Wrapf(err, "failed to read inode %d from the object store", tiered.Inode)
+			}
+			if uint64(len(data)) > length {
+				data = data[:length]
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				break
+			}
+			from += uint64(len(data))
+		}
+	}
+	if from >= to {
+		return nil
+	}
+	return s.writeZeros(w, to-from)
+}
+
+func (s *settings) writeZeros(w io.Writer, count uint64) error {
+	if count == 0 {
+		return nil
+	}
+	zeros := make([]byte, s.BlockSize)
+	for count > 0 {
+		chunk := count
+		if chunk > uint64(len(zeros)) {
+			chunk = uint64(len(zeros))
+		}
+		if _, err := w.Write(zeros[:chunk]); err != nil {
+			return err
+		}
+		count -= chunk
+	}
+	return nil
+}
+
+func UpdateNode(ctx context.Context, db *DB, n *FileNode) error {
+	return updateInode(ctx, db, n, func(tx *fsTx) error {
+		return putInode(ctx, tx, n)
+	})
+}
+
+// UpdateNodeAtime sets the access time of the node with Inode number `inode`
+// to `atime`, unless the stored access time is already more recent.
+func UpdateNodeAtime(ctx context.Context, db *DB, inode uint64, atime time.Time) error {
+	q := "UPDATE inodes SET atime = $2 WHERE inode = $1 AND atime < $2"
+	_, err := db.ExecContext(ctx, q, inode, atime)
+	return err
+}
+
+// GetNodeByName returns the node of the entry `name` in `parent`. The node
+// has the name of the entry, which differs from `name` by case if the file
+// system is case-insensitive.
+func GetNodeByName(ctx context.Context, db *DB, parent uint64, name string) (*FileNode, error) {
+	name = db.normName(name)
+	n := &FileNode{Name: name, Parent: parent}
+	q := `SELECT tree.name, inodes.inode, ` + prefixColumns("inodes", inodeColumns) + `
+  FROM tree JOIN inodes ON tree.inode = inodes.inode
+  WHERE tree.parent = $1 AND ` + db.nameEquals("tree.name", "$2") + ` LIMIT 1`
+	dest := append([]interface{}{&n.Name, &n.Inode}, inodeFields(n)...)
+	if err := db.QueryRowContext(ctx, q, parent, name).Scan(dest...); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// splitPath returns the components of `path`, ignoring empty and "."
+// components. Paths are always treated as absolute, and ".." is not allowed.
+func splitPath(path string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			return nil, errors.Errorf("path %q must not contain ..", path)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ResolvePathChain resolves `path` from the root of the tree in a single
+// query, and returns the nodes of every component of the path in order.
+// The root itself is not included.
+func ResolvePathChain(ctx context.Context, db *DB, path string) ([]*FileNode, error) {
+	names, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	// Walk down the tree one component at a time. Regular files never have
+	// children, so the walk stops early if a component is not a directory.
+	q := `WITH RECURSIVE chain (depth, inode) AS (
+    SELECT 0, $1::INT
+  UNION ALL
+    SELECT chain.depth + 1, tree.inode FROM chain JOIN tree
+    ON tree.parent = chain.inode AND ` + db.nameEquals("tree.name", "($2::STRING[])[chain.depth + 1]") + `
+    WHERE chain.depth < $3
+  )
+  SELECT chain.depth, chain.inode, ` + prefixColumns("inodes", inodeColumns) + `
+  FROM chain JOIN inodes ON chain.inode = inodes.inode
+  WHERE chain.depth > 0 ORDER BY chain.depth`
+	rows, err := db.QueryContext(ctx, q, RootInode, pq.Array(db.normNames(names)), len(names))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not resolve path %q", path)
+	}
+	defer rows.Close()
+
+	var chain []*FileNode
+	parent := uint64(RootInode)
+	for rows.Next() {
+		var depth int
+		n := &FileNode{}
+		dest := append([]interface{}{&depth, &n.Inode}, inodeFields(n)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrapf(err, "failed to scan path %q", path)
+		}
+		n.Name = names[depth-1]
+		n.Parent = parent
+		parent = n.Inode
+		chain = append(chain, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(chain) < len(names) {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to resolve %q in path %q", names[len(chain)], path)
+	}
+	return chain, nil
+}
+
+// ResolvePath resolves `path` from the root of the tree and returns the node
+// it refers to.
+func ResolvePath(ctx context.Context, db *DB, path string) (*FileNode, error) {
+	chain, err := ResolvePathChain(ctx, db, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return &FileNode{Inode: RootInode, Mode: os.ModeDir | 0555}, nil
+	}
+	return chain[len(chain)-1], nil
+}
+
+// GetNodeByID retrieves a node with Inode number `inode`.
+func GetNodeByID(ctx context.Context, db *DB, inode uint64) (*FileNode, error) {
+	n := &FileNode{Inode: inode}
+	const q = "SELECT " + inodeColumns + " FROM inodes WHERE inode = $1 LIMIT 1"
+	if err := db.QueryRowContext(ctx, q, inode).Scan(inodeFields(n)...); err != nil {
+		// sql.ErrNoRows if no rows found.
+		return nil, err
+	}
+	return n, nil
+}
+
+// treeEntry is a single row of the tree table, i.e. a directory entry.
+type treeEntry struct {
+	Parent uint64
+	Name   string
+	Inode  uint64
+}
+
+// ListDanglingEntries returns all directory entries that either refer to an
+// inode that does not exist, or that live in a parent directory that does
+// not exist.
+func ListDanglingEntries(ctx context.Context, db *DB) ([]treeEntry, error) {
+	q := `SELECT tree.parent, tree.name, tree.inode FROM tree
+  WHERE NOT EXISTS (SELECT 1 FROM inodes WHERE inodes.inode = tree.inode)
+  OR (tree.parent != $1 AND NOT EXISTS (SELECT 1 FROM inodes WHERE inodes.inode = tree.parent))`
+	rows, err := db.QueryContext(ctx, q, RootInode)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query dangling entries")
+	}
+	defer rows.Close()
+
+	var entries []treeEntry
+	for rows.Next() {
+		var e treeEntry
+		if err := rows.Scan(&e.Parent, &e.Name, &e.Inode); err != nil {
+			return nil, errors.Wrap(err, "failed to scan dangling entry")
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// RemoveEntry deletes the directory entry `name` in `parent` without
+// touching the inode it refers to.
+func RemoveEntry(ctx context.Context, db *DB, parent uint64, name string) error {
+	name = db.normName(name)
+	q := "DELETE FROM tree WHERE parent = $1 AND " + db.nameEquals("name", "$2")
+	if _, err := db.ExecContext(ctx, q, parent, name); err != nil {
+		return errors.Wrapf(err, "failed to remove entry %q in parent %d", name, parent)
+	}
+	return nil
+}
+
+// ListOrphanedInodes returns all inodes that are not referenced by any
+// directory entry.
+func ListOrphanedInodes(ctx context.Context, db *DB) ([]uint64, error) {
+	q := `SELECT inode FROM inodes
+  WHERE NOT EXISTS (SELECT 1 FROM tree WHERE tree.inode = inodes.inode)`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query orphaned inodes")
+	}
+	defer rows.Close()
+
+	var inodes []uint64
+	for rows.Next() {
+		var inode uint64
+		if err := rows.Scan(&inode); err != nil {
+			return nil, errors.Wrap(err, "failed to scan orphaned inode")
+		}
+		inodes = append(inodes, inode)
+	}
+	return inodes, rows.Err()
+}
+
+// RemoveInode deletes the inode `inode` and all of its data blocks.
+func RemoveInode(ctx context.Context, db *DB, inode uint64) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+
+	q1 := "DELETE FROM inodes WHERE inode = $1"
+	if _, err := tx.ExecContext(ctx, q1, inode); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to remove inode %d", inode)
+	}
+	q2 := "DELETE FROM data_blocks WHERE inode = $1"
+	if _, err := tx.ExecContext(ctx, q2, inode); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to remove data blocks of inode %d", inode)
+	}
+	if err := removeXattrs(ctx, tx, inode); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to remove extended attributes of inode %d", inode)
+	}
+	if err := removeFileHash(ctx, tx, inode); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrapf(err, "failed to remove the hash of inode %d", inode)
+	}
+	return tx.Commit()
+}
+
+// CountOrphanedDataBlocks returns the number of data blocks that belong to
+// an inode that does not exist.
+func CountOrphanedDataBlocks(ctx context.Context, db *DB) (int, error) {
+	var count int
+	q := `SELECT COUNT(*) FROM data_blocks
+  WHERE NOT EXISTS (SELECT 1 FROM inodes WHERE inodes.inode = data_blocks.inode)`
+	if err := db.QueryRowContext(ctx, q).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RemoveOrphanedDataBlocks deletes all data blocks that belong to an inode
+// that does not exist, and returns the number of blocks deleted.
+func RemoveOrphanedDataBlocks(ctx context.Context, db *DB) (int64, error) {
+	q := `DELETE FROM data_blocks
+  WHERE NOT EXISTS (SELECT 1 FROM inodes WHERE inodes.inode = data_blocks.inode)`
+	res, err := db.ExecContext(ctx, q)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to remove orphaned data blocks")
+	}
+	return res.RowsAffected()
+}
+
+// CountLinks returns the number of directory entries referring to each
+// inode.
+func CountLinks(ctx context.Context, db *DB) (map[uint64]uint32, error) {
+	q := "SELECT inode, COUNT(*) FROM tree GROUP BY inode"
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not count links")
+	}
+	defer rows.Close()
+
+	links := make(map[uint64]uint32)
+	for rows.Next() {
+		var inode uint64
+		var count uint32
+		if err := rows.Scan(&inode, &count); err != nil {
+			return nil, errors.Wrap(err, "failed to scan link count")
+		}
+		links[inode] = count
+	}
+	return links, rows.Err()
+}
+
+// DataExtents returns, for each inode that has data, the offset right after
+// the last byte stored in its data blocks or inline data.
+func DataExtents(ctx context.Context, db *DB) (map[uint64]uint64, error) {
+	q := "SELECT inode, MAX((sequence - 1) * $1 + length(data)) FROM data_blocks GROUP BY inode"
+	rows, err := db.QueryContext(ctx, q, db.BlockSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not compute data extents")
+	}
+	defer rows.Close()
+
+	extents := make(map[uint64]uint64)
+	for rows.Next() {
+		var inode, extent uint64
+		if err := rows.Scan(&inode, &extent); err != nil {
+			return nil, errors.Wrap(err, "failed to scan data extent")
+		}
+		extents[inode] = extent
+	}
+	if err := rows.Err(); err != nil || db.inlineDataSize == 0 {
+		return extents, err
+	}
+
+	q2 := "SELECT inode, length(inline_data) FROM inodes WHERE inline_data IS NOT NULL"
+	inline, err := db.QueryContext(ctx, q2)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not compute inline data extents")
+	}
+	defer inline.Close()
+	for inline.Next() {
+		var inode, extent uint64
+		if err := inline.Scan(&inode, &extent); err != nil {
+			return nil, errors.Wrap(err, "failed to scan data extent")
+		}
+		if extent > extents[inode] {
+			extents[inode] = extent
+		}
+	}
+	return extents, inline.Err()
+}
+
+// ListAllNodes calls `fn` for every inode stored in the database.
+func ListAllNodes(ctx context.Context, db *DB, fn func(n *FileNode) error) error {
+	q := "SELECT inode, " + inodeColumns + " FROM inodes ORDER BY inode"
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return errors.Wrap(err, "could not query inodes")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		n := &FileNode{}
+		if err := rows.Scan(append([]interface{}{&n.Inode}, inodeFields(n)...)...); err != nil {
+			return errors.Wrap(err, "failed to scan inode")
+		}
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func CountTreeEntries(ctx context.Context, db *DB) (int, error) {
+	var count int
+	q := "SELECT COUNT(*) FROM tree"
+	if err := db.QueryRowContext(ctx, q).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func SumDataBytes(ctx context.Context, db *DB) (uint64, error) {
+	var size uint64
+	q := "SELECT COALESCE(SUM(length(data)), 0) FROM data_blocks"
+	if db.inlineDataSize > 0 {
+		q = "SELECT (" + q + ") + (SELECT COALESCE(SUM(length(inline_data)), 0) FROM inodes)"
+	}
+	if err := db.QueryRowContext(ctx, q).Scan(&size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// diskUsage is the space used by a subtree.
+type diskUsage struct {
+	Name  string
+	Size  uint64 // Sum of the sizes of all inodes, counting hard links once.
+	Nodes int    // Number of distinct inodes.
+}
+
+// DiskUsage computes the space used below the directory `dir`, grouped by
+// each entry directly inside `dir`.
+func DiskUsage(ctx context.Context, db *DB, dir uint64) ([]diskUsage, error) {
+	q := `WITH RECURSIVE subtree (top, inode) AS (
+    SELECT name, inode FROM tree WHERE parent = $1
+  UNION ALL
+    SELECT subtree.top, tree.inode FROM tree JOIN subtree ON tree.parent = subtree.inode
+  )
+  SELECT top, COALESCE(SUM(size), 0), COUNT(*) FROM (
+    SELECT DISTINCT subtree.top, inodes.inode, inodes.size
+    FROM subtree JOIN inodes ON subtree.inode = inodes.inode
+  ) GROUP BY top ORDER BY top`
+	rows, err := db.QueryContext(ctx, q, dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not compute disk usage of inode %d", dir)
+	}
+	defer rows.Close()
+
+	var usage []diskUsage
+	for rows.Next() {
+		var u diskUsage
+		if err := rows.Scan(&u.Name, &u.Size, &u.Nodes); err != nil {
+			return nil, errors.Wrap(err, "failed to scan disk usage")
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// ListSubtree returns every node below the directory `dir` in a single
+// query, ordered by path. The Name of each node is set to its path relative
+// to `dir`. Only nodes up to `maxDepth` levels deep are returned, or all of
+// them if `maxDepth` is zero.
+func ListSubtree(ctx context.Context, db *DB, dir uint64, maxDepth int) ([]*FileNode, error) {
+	if maxDepth <= 0 {
+		maxDepth = math.MaxInt32
+	}
+	q := `WITH RECURSIVE subtree (path, parent, inode, depth) AS (
+    SELECT name, parent, inode, 1 FROM tree WHERE parent = $1
+  UNION ALL
+    SELECT subtree.path || '/' || tree.name, tree.parent, tree.inode, subtree.depth + 1
+    FROM tree JOIN subtree ON tree.parent = subtree.inode
+    WHERE subtree.depth < $2
+  )
+  SELECT subtree.path, subtree.parent, inodes.inode, ` + prefixColumns("inodes", inodeColumns) + `
+  FROM subtree JOIN inodes ON subtree.inode = inodes.inode ORDER BY subtree.path`
+	rows, err := db.QueryContext(ctx, q, dir, maxDepth)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list subtree of inode %d", dir)
+	}
+	defer rows.Close()
+
+	var nodes []*FileNode
+	for rows.Next() {
+		n := &FileNode{}
+		dest := append([]interface{}{&n.Name, &n.Parent, &n.Inode}, inodeFields(n)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrapf(err, "failed to scan subtree of inode %d", dir)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// StoredBytes returns the number of bytes stored in the data blocks and
+// inline data of `inode`, which excludes holes.
+func StoredBytes(ctx context.Context, db *DB, inode uint64) (uint64, error) {
+	var size uint64
+	q := "SELECT COALESCE(SUM(length(data)), 0) FROM data_blocks WHERE inode = $1"
+	if db.inlineDataSize > 0 {
+		q = "SELECT (" + q + ") + (SELECT " + db.inlineLength("inodes") + " FROM inodes WHERE inode = $1)"
+	}
+	if err := db.QueryRowContext(ctx, q, inode).Scan(&size); err != nil {
+		return 0, errors.Wrapf(err, "failed to compute stored size of inode %d", inode)
+	}
+	return size, nil
+}
+
+// CountNodeBlocks returns the number of data blocks stored for `inode`.
+func CountNodeBlocks(ctx context.Context, db *DB, inode uint64) (int, error) {
+	var count int
+	q := "SELECT COUNT(*) FROM data_blocks WHERE inode = $1"
+	if db.inlineDataSize > 0 {
+		// Inline data counts as a single block.
+		q = "SELECT (" + q + ") + (SELECT COUNT(*) FROM inodes WHERE inode = $1 AND inline_data IS NOT NULL)"
+	}
+	if err := db.QueryRowContext(ctx, q, inode).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// NodePath returns the absolute path of `inode` by walking up the tree. If
+// the inode has several hard links, the path of one of them is returned.
+// Returns sql.ErrNoRows if the inode is not linked from the root.
+func NodePath(ctx context.Context, db *DB, inode uint64) (string, error) {
+	if inode == RootInode {
+		return "/", nil
+	}
+	q := `WITH RECURSIVE up (parent, path) AS (
+    (SELECT parent, name FROM tree WHERE inode = $1 ORDER BY parent, name LIMIT 1)
+  UNION ALL
+    SELECT tree.parent, tree.name || '/' || up.path
+    FROM up JOIN tree ON tree.inode = up.parent
+    WHERE up.parent != $2
+  )
+  SELECT path FROM up WHERE parent = $2`
+	var path string
+	if err := db.QueryRowContext(ctx, q, inode, RootInode).Scan(&path); err != nil {
+		return "", err
+	}
+	return "/" + path, nil
+}
+
+// GetParentInode returns the directory containing `inode`. If the inode has
+// several hard links, the parent of one of them is returned.
+func GetParentInode(ctx context.Context, db *DB, inode uint64) (uint64, error) {
+	var parent uint64
+	q := "SELECT parent FROM tree WHERE inode = $1 ORDER BY parent LIMIT 1"
+	if err := db.QueryRowContext(ctx, q, inode).Scan(&parent); err != nil {
+		return 0, err
+	}
+	return parent, nil
+}
+
+// IsBelow returns true if `inode` is the directory `dir` or is found below
+// it, through any of its hard links. Inodes that are no longer linked are
+// below no directory.
+func IsBelow(ctx context.Context, db *DB, inode, dir uint64) (bool, error) {
+	if inode == dir || dir == RootInode {
+		return true, nil
+	}
+	// Walk up from the inode until reaching `dir` or the root. Every path
+	// component takes at least two bytes, which bounds the depth.
+	q := `WITH RECURSIVE up (depth, inode) AS (
+    SELECT 0, $1::INT
+  UNION ALL
+    SELECT up.depth + 1, tree.parent FROM up JOIN tree ON tree.inode = up.inode
+    WHERE up.inode != $2 AND up.depth < $3
+  )
+  SELECT EXISTS (SELECT 1 FROM up WHERE inode = $2)`
+	var below bool
+	if err := db.QueryRowContext(ctx, q, inode, dir, DefaultMaxPathLen/2).Scan(&below); err != nil {
+		return false, errors.Wrapf(err, "failed to find the directories above inode %d", inode)
+	}
+	return below, nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// BenchmarkInsertBlocks compares inserting the new blocks of a large write
+// with COPY, as WriteData does from copyMinBlocks blocks on, and with one
+// UPSERT per block. Each transaction is rolled back, so that the table does
+// not grow over the run. It needs SQLFS_TEST_DB (see openTestDB).
+func BenchmarkInsertBlocks(b *testing.B) {
+	db := NewDB(openTestDB(b))
+	blocks := make([][]byte, 128)
+	for i := range blocks {
+		blocks[i] = make([]byte, db.BlockSize)
+		for j := range blocks[i] {
+			blocks[i][j] = byte(i + j)
+		}
+	}
+	insert := map[string]func(ctx context.Context, tx *fsTx, inode uint64) error{
+		"copy": func(ctx context.Context, tx *fsTx, inode uint64) error {
+			return copyBlocks(ctx, tx, inode, 0, blocks)
+		},
+		"upsert": func(ctx context.Context, tx *fsTx, inode uint64) error {
+			q := "UPSERT INTO data_blocks (inode, sequence, data) VALUES ($1, $2, $3)"
+			for i, block := range blocks {
+				if _, err := tx.ExecContext(ctx, q, inode, i+1, block); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	for _, name := range []string{"copy", "upsert"} {
+		f := insert[name]
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			b.SetBytes(int64(len(blocks)) * db.BlockSize)
+			for i := 0; i < b.N; i++ {
+				tx, err := db.BeginTx(ctx, &sql.TxOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := f(ctx, tx, RootInode+uint64(i)+1); err != nil {
+					_ = tx.Rollback()
+					b.Fatal(err)
+				}
+				if err := tx.Rollback(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
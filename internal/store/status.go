@@ -0,0 +1,392 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fuseFS "bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"github.com/pkg/errors"
+)
+
+// The status directory is a read-only directory at the root of the mount
+// whose files are generated when they are opened, so that the state of a
+// mount can be inspected with cat(1) without the admin API:
+//
+//	.sqlfs/version     versions of the binary, of the on-disk format and of Go
+//	.sqlfs/stats       operation counters and cache statistics, as GET /stats
+//	.sqlfs/cache       sizes and hit rates of the caches
+//	.sqlfs/ops         operations in flight, as GET /ops
+//	.sqlfs/db_latency  round trips to the database, measured when opened
+//
+// Its control files act on the mount when written to, as the admin API
+// does. Only root may write to them:
+//
+//	.sqlfs/drop_caches  write 1 to drop the entry, attribute and block caches
+//	.sqlfs/flush        write 1 to write batched access times and index updates
+//	.sqlfs/read_only    1 while writes are refused; write 1 or 0 to change it
+//	.sqlfs/log_level    debug while every FUSE request is logged, else info
+//	.sqlfs/snapshot     write a name to take a snapshot (see snapshot.go)
+//
+// It is not stored: it shadows an entry of the same name at the root, which
+// cannot be created through the mount.
+const StatusDirName = ".sqlfs"
+
+// Inode numbers of the status directory and its files, in the upper half of
+// the range, which allocated inode numbers never reach, apart from the
+// dynamic inode numbers that have the next bit set.
+const statusInode = 1<<63 | 1<<62
+
+// Number of round trips measured by .sqlfs/db_latency.
+const statusPings = 3
+
+// statusFile is a file of the status directory. Files that cannot be read
+// have no `generate` function, and those that cannot be written no
+// `control` function.
+type statusFile struct {
+	name     string
+	generate func(ctx context.Context, fs *fileSystem) ([]byte, error)
+	control  func(ctx context.Context, fs *fileSystem, value string) error
+}
+
+var statusFiles = []statusFile{
+	{"version", statusVersion, nil},
+	{"stats", statusStats, nil},
+	{"cache", statusCache, nil},
+	{"ops", statusOps, nil},
+	{"db_latency", statusDBLatency, nil},
+	{"drop_caches", nil, controlDropCaches},
+	{"flush", nil, controlFlush},
+	{"read_only", statusReadOnly, controlReadOnly},
+	{"log_level", statusLogLevel, controlLogLevel},
+	{"snapshot", nil, controlSnapshot},
+}
+
+// isMountRoot returns whether `inode` is the root of the mount.
+func (fs fileSystem) isMountRoot(inode uint64) bool {
+	return inode == RootInode || inode == fs.root
+}
+
+// isStatusDir returns whether the entry `name` of the directory `parent` is
+// the status directory.
+func (fs fileSystem) isStatusDir(parent uint64, name string) bool {
+	return fs.statusDir && name == StatusDirName && fs.isMountRoot(parent)
+}
+
+// statusDirNode is the status directory.
+type statusDirNode struct {
+	fs *fileSystem
+}
+
+// Attr implements the fuseFS.Node interface.
+func (d *statusDirNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Inode = statusInode
+	attr.Mode = os.ModeDir | 0555
+	attr.Nlink = 2
+	attr.Mtime = time.Now()
+	attr.Ctime = attr.Mtime
+	attr.Atime = attr.Mtime
+	return nil
+}
+
+// Lookup implements the fuseFS.NodeStringLookuper interface.
+func (d *statusDirNode) Lookup(ctx context.Context, name string) (fuseFS.Node, error) {
+	for i, f := range statusFiles {
+		if f.name == name {
+			return &statusFileNode{fs: d.fs, file: f, inode: statusInode + 1 + uint64(i)}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// ReadDirAll implements the fuseFS.HandleReadDirAller interface.
+func (d *statusDirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	parent := d.fs.root
+	if parent == 0 {
+		parent = RootInode
+	}
+	entries := []fuse.Dirent{
+		{Inode: statusInode, Name: ".", Type: fuse.DT_Dir},
+		{Inode: parent, Name: "..", Type: fuse.DT_Dir},
+	}
+	for i, f := range statusFiles {
+		entries = append(entries, fuse.Dirent{Inode: statusInode + 1 + uint64(i), Name: f.name, Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+// statusFileNode is a file of the status directory. Its size is reported as
+// 0 since its contents are only generated when it is opened, and reads
+// bypass the page cache so that they are not cut to that size.
+type statusFileNode struct {
+	fs    *fileSystem
+	file  statusFile
+	inode uint64
+}
+
+// Attr implements the fuseFS.Node interface.
+func (f *statusFileNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Inode = f.inode
+	if f.file.generate != nil {
+		attr.Mode |= 0444
+	}
+	if f.file.control != nil {
+		attr.Mode |= 0200 // Owned by root.
+	}
+	attr.Nlink = 1
+	attr.Mtime = time.Now()
+	attr.Ctime = attr.Mtime
+	attr.Atime = attr.Mtime
+	return nil
+}
+
+// Open implements the fuseFS.NodeOpener interface.
+func (f *statusFileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fuseFS.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		if f.file.control == nil || req.Uid != 0 {
+			return nil, fuse.Errno(syscall.EACCES)
+		}
+		resp.Flags |= fuse.OpenDirectIO
+		return &controlHandle{fs: f.fs, file: f.file}, nil
+	}
+	if f.file.generate == nil {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	data, err := f.file.generate(ctx, f.fs)
+	if err != nil {
+		return nil, errnoFromErr(ctx, err)
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return &statusHandle{data: data}, nil
+}
+
+// statusHandle is an open file of the status directory, holding the
+// contents generated when it was opened.
+type statusHandle struct {
+	data []byte
+}
+
+// Read implements the fuseFS.HandleReader interface.
+func (h *statusHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	fuseutil.HandleRead(req, resp, h.data)
+	return nil
+}
+
+// controlHandle is a control file opened for writing. Each write is an
+// action, whose failure is returned to the writer.
+type controlHandle struct {
+	fs   *fileSystem
+	file statusFile
+}
+
+// Write implements the fuseFS.HandleWriter interface.
+func (h *controlHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	value := strings.TrimSpace(string(req.Data))
+	if err := h.file.control(ctx, h.fs, value); err != nil {
+		if _, ok := err.(fuse.ErrorNumber); !ok {
+			log.Printf("%s/%s: %s\n", StatusDirName, h.file.name, err)
+		}
+		return errnoFromErr(ctx, err)
+	}
+	log.Printf("%s/%s: %s by uid %d\n", StatusDirName, h.file.name, value, req.Uid)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func statusJSON(v interface{}) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func statusVersion(ctx context.Context, fs *fileSystem) ([]byte, error) {
+	version, revision := "(devel)", ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				revision = s.Value
+			}
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "sqlfs %s\n", version)
+	if revision != "" {
+		fmt.Fprintf(&b, "revision %s\n", revision)
+	}
+	fmt.Fprintf(&b, "schema %d\n", schemaVersion)
+	fmt.Fprintf(&b, "go %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return b.Bytes(), nil
+}
+
+func statusStats(ctx context.Context, fs *fileSystem) ([]byte, error) {
+	return statusJSON(fs.stats())
+}
+
+func statusCache(ctx context.Context, fs *fileSystem) ([]byte, error) {
+	var b bytes.Buffer
+	if fs.blocks != nil {
+		s := fs.blocks.Stats()
+		hitRate := 0.0
+		if s.Hits+s.Misses > 0 {
+			hitRate = float64(s.Hits) / float64(s.Hits+s.Misses)
+		}
+		fmt.Fprintf(&b, "block_cache_blocks %d\n", s.Blocks)
+		fmt.Fprintf(&b, "block_cache_bytes %d\n", s.Bytes)
+		fmt.Fprintf(&b, "block_cache_capacity %d\n", s.Capacity)
+		fmt.Fprintf(&b, "block_cache_hits %d\n", s.Hits)
+		fmt.Fprintf(&b, "block_cache_misses %d\n", s.Misses)
+		fmt.Fprintf(&b, "block_cache_hit_rate %.3f\n", hitRate)
+	}
+	if fs.entries != nil {
+		fmt.Fprintf(&b, "entry_cache_entries %d\n", fs.entries.Len())
+	}
+	if fs.attrs != nil {
+		fmt.Fprintf(&b, "attr_cache_inodes %d\n", fs.attrs.Len())
+	}
+	if fs.missing != nil {
+		fmt.Fprintf(&b, "negative_cache_entries %d\n", fs.missing.Len())
+	}
+	if b.Len() == 0 {
+		b.WriteString("no caches are enabled\n")
+	}
+	return b.Bytes(), nil
+}
+
+func statusOps(ctx context.Context, fs *fileSystem) ([]byte, error) {
+	ops := []inFlightOp{}
+	if fs.ops != nil {
+		ops = fs.ops.InFlight()
+	}
+	return statusJSON(ops)
+}
+
+func statusDBLatency(ctx context.Context, fs *fileSystem) ([]byte, error) {
+	var b bytes.Buffer
+	var min, max, total time.Duration
+	for i := 0; i < statusPings; i++ {
+		pingCtx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+		start := time.Now()
+		err := fs.db.PingContext(pingCtx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(&b, "error %s\n", err)
+			return b.Bytes(), nil
+		}
+		d := time.Since(start)
+		if i == 0 || d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		total += d
+	}
+	fmt.Fprintf(&b, "min %s\n", min.Round(time.Microsecond))
+	fmt.Fprintf(&b, "avg %s\n", (total / statusPings).Round(time.Microsecond))
+	fmt.Fprintf(&b, "max %s\n", max.Round(time.Microsecond))
+	return b.Bytes(), nil
+}
+
+// statusBool parses the value written to a control file taking 1 or 0.
+func statusBool(value string) (bool, error) {
+	switch value {
+	case "1":
+		return true, nil
+	case "0":
+		return false, nil
+	}
+	return false, fuse.Errno(syscall.EINVAL)
+}
+
+func controlDropCaches(ctx context.Context, fs *fileSystem, value string) error {
+	if value != "1" {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	fs.dropCaches()
+	return nil
+}
+
+func controlFlush(ctx context.Context, fs *fileSystem, value string) error {
+	if value != "1" {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	fs.flush()
+	return nil
+}
+
+func statusReadOnly(ctx context.Context, fs *fileSystem) ([]byte, error) {
+	if fs.readOnly() {
+		return []byte("1\n"), nil
+	}
+	return []byte("0\n"), nil
+}
+
+// controlReadOnly enters or leaves maintenance mode, as POST /read-only
+// does. Writing 0 does not lift the read-only setting of `sqlfs
+// maintenance`.
+func controlReadOnly(ctx context.Context, fs *fileSystem, value string) error {
+	enabled, err := statusBool(value)
+	if err != nil {
+		return err
+	}
+	if fs.maintenance == nil {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	if fs.maintenance.set(enabled) {
+		log.Println("Entered maintenance mode, refusing writes.")
+		// The write is itself an operation in flight, so only wait for
+		// the others in the background.
+		go fs.quiesce(fs.quiesceTimeout)
+	} else if !enabled {
+		log.Println("Left maintenance mode.")
+	}
+	return nil
+}
+
+func statusLogLevel(ctx context.Context, fs *fileSystem) ([]byte, error) {
+	if fs.ops != nil && fs.ops.Verbose() {
+		return []byte("debug\n"), nil
+	}
+	return []byte("info\n"), nil
+}
+
+func controlLogLevel(ctx context.Context, fs *fileSystem, value string) error {
+	if fs.ops == nil {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	switch value {
+	case "debug":
+		fs.ops.SetVerbose(true)
+	case "info":
+		fs.ops.SetVerbose(false)
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return nil
+}
+
+// controlSnapshot takes the snapshot `value`. The snapshots table is only
+// created by `sqlfs init -snapshots`.
+func controlSnapshot(ctx context.Context, fs *fileSystem, value string) error {
+	_, err := CreateSnapshot(ctx, fs.db, value)
+	if sqlState(errors.Cause(err)) == "42P01" { // undefined_table
+		log.Println(err)
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	return err
+}
@@ -0,0 +1,771 @@
+// Package store implements the file systems of sqlfs: their storage in a
+// SQL database, serving them with FUSE, NFS, 9P, SFTP and HTTP, and their
+// administration, e.g. backups and garbage collection.
+//
+// It is shared by the sqlfs package, which exposes mounting to other
+// programs, and the sqlfs command in internal/cli.
+//
+// Each FS keeps the settings of its file system, such as its block size, so
+// a process can serve several file systems at once.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+// FS is a file system stored in a database.
+type FS struct {
+	fs       fileSystem
+	subdir   string
+	atime    string
+	timeout  time.Duration
+	limits   throttleLimits
+	options  []fuse.MountOption
+	readOnly bool
+
+	objectStore     string        // Overrides the recorded store unless empty.
+	snapshotsURL    string        // Of the database, if snapshots are exposed.
+	warmPaths       []string      // Relative to the mount root.
+	warmAttrTTL     time.Duration // Of the attributes preloaded by warm-ups.
+	journal         bool
+	indexContent    bool
+	writeLeases     bool
+	exclusive       bool
+	leaseTTL        time.Duration
+	gcInterval      time.Duration
+	scrubInterval   time.Duration
+	scrubRate       float64
+	scrubReplica    *sql.DB
+	asyncWrites     int64
+	maintenancePoll time.Duration
+
+	leases *leaseManager      // nil unless a background task or writes need leases
+	cancel context.CancelFunc // Stops the background work.
+}
+
+// Option configures an FS created with New.
+type Option func(*FS) error
+
+// WithSubdir exposes the directory at `path` in the tree as the root of the
+// mount instead of the root directory.
+func WithSubdir(path string) Option {
+	return func(f *FS) error {
+		f.subdir = path
+		return nil
+	}
+}
+
+// WithAtimeMode sets how access times are updated: "strict", "relatime"
+// (the default) or "noatime".
+func WithAtimeMode(mode string) Option {
+	return func(f *FS) error {
+		f.atime = mode
+		return nil
+	}
+}
+
+// WithFastLookup prefetches whole directories into an entry cache on
+// lookups.
+func WithFastLookup() Option {
+	return func(f *FS) error {
+		f.fs.entries = newEntryCache(f.fs.db.settings)
+		return nil
+	}
+}
+
+// WithAttrPrefetch loads the attributes of all entries of a directory when
+// it is listed, and serves the lookups and attributes of its entries from
+// them for a moment.
+func WithAttrPrefetch() Option {
+	return func(f *FS) error {
+		f.fs.attrs = newAttrCache(f.fs.db.settings)
+		return nil
+	}
+}
+
+// WithNegativeCache remembers names found missing for `ttl`, unless they are
+// created through the file system.
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(f *FS) error {
+		if ttl < 0 {
+			return errors.Errorf("invalid negative cache TTL %s", ttl)
+		}
+		if ttl > 0 {
+			f.fs.missing = newNegativeCache(f.fs.db.settings, ttl)
+		}
+		return nil
+	}
+}
+
+// WithCreateBatching keeps the small files created through the file system
+// in memory for up to `window`, and commits them together.
+func WithCreateBatching(window time.Duration) Option {
+	return func(f *FS) error {
+		if window < 0 {
+			return errors.Errorf("invalid create batching window %s", window)
+		}
+		if window > 0 {
+			f.fs.creates = newCreateBatcher(f.fs.db, window)
+		}
+		return nil
+	}
+}
+
+// WithAppendCoalescing keeps the small writes made at the end of files in
+// memory until they fill a block, for up to a second. It has no effect on
+// the files written asynchronously, whose appends are merged anyway.
+// Committing them fails once it takes longer than the operation timeout,
+// and the failure is reported by the next fsync(2) or close(2).
+func WithAppendCoalescing() Option {
+	return func(f *FS) error {
+		f.fs.appends = newAppendCoalescer(f.fs.db.settings)
+		return nil
+	}
+}
+
+// WithDirOrder sets the order in which directories are listed: "name" (the
+// default) or "inode".
+func WithDirOrder(order string) Option {
+	return func(f *FS) error {
+		o, err := parseDirOrder(order)
+		if err != nil {
+			return err
+		}
+		f.fs.dirOrder = o
+		return nil
+	}
+}
+
+// WithBlockCache caches data blocks in up to `size` bytes of memory.
+func WithBlockCache(size int64) Option {
+	return func(f *FS) error {
+		if size < 0 {
+			return errors.Errorf("invalid block cache size %d", size)
+		}
+		if size > 0 {
+			f.fs.blocks = newBlockCache(size)
+		}
+		return nil
+	}
+}
+
+// WithOpTimeout fails file system operations with EIO if they take longer
+// than `timeout`, 30s by default. Zero disables the timeout.
+func WithOpTimeout(timeout time.Duration) Option {
+	return func(f *FS) error {
+		f.timeout = timeout
+		return nil
+	}
+}
+
+// WithRateLimits delays FUSE operations beyond `ops` per second, reads and
+// writes beyond `bytes` per second, and the operations of each user beyond
+// `uidOps` per second. Zero disables a limit.
+func WithRateLimits(ops float64, bytes int64, uidOps float64) Option {
+	return func(f *FS) error {
+		if ops < 0 || bytes < 0 || uidOps < 0 {
+			return errors.New("rate limits cannot be negative")
+		}
+		f.limits = throttleLimits{Ops: ops, Bytes: uint64(bytes), UIDOps: uidOps}
+		return nil
+	}
+}
+
+// WithReadOnly mounts the file system read-only. Access times are then
+// not updated.
+func WithReadOnly() Option {
+	return func(f *FS) error {
+		f.readOnly = true
+		return nil
+	}
+}
+
+// WithMountOptions passes FUSE mount options to the kernel, e.g.
+// fuse.AllowOther().
+func WithMountOptions(options ...fuse.MountOption) Option {
+	return func(f *FS) error {
+		f.options = append(f.options, options...)
+		return nil
+	}
+}
+
+// WithReadahead prefetches up to `blocks` data blocks for sequential reads.
+func WithReadahead(blocks int) Option {
+	return func(f *FS) error {
+		if blocks < 0 {
+			return errors.Errorf("invalid readahead %d", blocks)
+		}
+		f.fs.readahead = blocks
+		return nil
+	}
+}
+
+// WithDirectIO bypasses the kernel page cache, so that reads see the writes
+// of other mounts right away.
+func WithDirectIO() Option {
+	return func(f *FS) error {
+		f.fs.directIO = true
+		return nil
+	}
+}
+
+// WithMaxNameLen sets the longest file name accepted, in bytes.
+func WithMaxNameLen(n int) Option {
+	return func(f *FS) error {
+		if n <= 0 {
+			return errors.Errorf("invalid maximum name length %d", n)
+		}
+		f.fs.maxNameLen = n
+		return nil
+	}
+}
+
+// WithMaxPathLen sets the longest path accepted when creating or renaming,
+// in bytes. Checking it costs a query.
+func WithMaxPathLen(n int) Option {
+	return func(f *FS) error {
+		if n < 0 {
+			return errors.Errorf("invalid maximum path length %d", n)
+		}
+		f.fs.maxPathLen = n
+		return nil
+	}
+}
+
+// WithUIDMap presents stored user IDs as other IDs, and stores them back on
+// chown and create, according to the comma-separated STORED:LOCAL[:COUNT]
+// ranges of `mapping`.
+func WithUIDMap(mapping string) Option {
+	return func(f *FS) error {
+		return f.fs.uids.Set(mapping)
+	}
+}
+
+// WithGIDMap is WithUIDMap for group IDs.
+func WithGIDMap(mapping string) Option {
+	return func(f *FS) error {
+		return f.fs.gids.Set(mapping)
+	}
+}
+
+// WithIDMapFile adds the ID mappings of the file at `path`, with lines such
+// as `u 1000 2000 1`.
+func WithIDMapFile(path string) Option {
+	return func(f *FS) error {
+		return loadIDMapFile(path, &f.fs.uids, &f.fs.gids)
+	}
+}
+
+// WithFileMode gives the files created through the mount the permissions
+// `perm` instead of the ones requested.
+func WithFileMode(perm os.FileMode) Option {
+	return func(f *FS) error {
+		f.fs.fileMode = PermFlag{mode: perm & modeBits, set: true}
+		return nil
+	}
+}
+
+// WithDirMode is WithFileMode for directories.
+func WithDirMode(perm os.FileMode) Option {
+	return func(f *FS) error {
+		f.fs.dirMode = PermFlag{mode: perm & modeBits, set: true}
+		return nil
+	}
+}
+
+// WithUmask clears the permission bits `mask` from every file and directory
+// created through the mount.
+func WithUmask(mask os.FileMode) Option {
+	return func(f *FS) error {
+		f.fs.umask = PermFlag{mode: mask & modeBits, set: true}
+		return nil
+	}
+}
+
+// WithSecurityLabel reports the SELinux context `label` for every file
+// instead of the stored security.selinux attributes.
+func WithSecurityLabel(label string) Option {
+	return func(f *FS) error {
+		f.fs.securityLabel = label
+		return nil
+	}
+}
+
+// WithoutAppleDouble hides AppleDouble (._*) files and refuses to create
+// them, keeping resource forks and Finder info in extended attributes.
+func WithoutAppleDouble() Option {
+	return func(f *FS) error {
+		f.fs.noAppleDouble = true
+		f.options = append(f.options, fuse.NoAppleDouble()) // OS X only.
+		return nil
+	}
+}
+
+// WithStatusDir exposes the read-only status directory at the root of the
+// mount.
+func WithStatusDir() Option {
+	return func(f *FS) error {
+		f.fs.statusDir = true
+		return nil
+	}
+}
+
+// WithQueryFile exposes the file at the root of the mount that searches
+// the tree with the predicates of `sqlfs find`.
+func WithQueryFile() Option {
+	return func(f *FS) error {
+		f.fs.queryFile = true
+		return nil
+	}
+}
+
+// WithSnapshotsDir exposes the snapshots taken with `sqlfs snapshot` in a
+// read-only directory at the root of the mount, reading them through
+// historical connections to the database at `url`. It has no effect if the
+// file system has no snapshots table.
+func WithSnapshotsDir(url string) Option {
+	return func(f *FS) error {
+		f.snapshotsURL = url
+		return nil
+	}
+}
+
+// WithQuiesceTimeout sets how long making the file system read-only through
+// the status directory waits for the operations in flight, 10s by default.
+func WithQuiesceTimeout(timeout time.Duration) Option {
+	return func(f *FS) error {
+		f.fs.quiesceTimeout = timeout
+		return nil
+	}
+}
+
+// WithWarmPaths preloads the attributes below `paths`, relative to the
+// mount root, and fills the block cache with their files once the file
+// system is created.
+func WithWarmPaths(paths ...string) Option {
+	return func(f *FS) error {
+		f.warmPaths = append(f.warmPaths, paths...)
+		return nil
+	}
+}
+
+// WithHeatMap records the files and directories accessed most in the file
+// at `path`, and preloads those recorded by earlier runs like
+// WithWarmPaths.
+func WithHeatMap(path string) Option {
+	return func(f *FS) error {
+		heat, err := loadHeatMap(path)
+		if err != nil {
+			return err
+		}
+		f.fs.heat = heat
+		return nil
+	}
+}
+
+// WithWarmAttrTTL sets how long the attributes preloaded by WithWarmPaths
+// and WithHeatMap are kept, 1m by default.
+func WithWarmAttrTTL(ttl time.Duration) Option {
+	return func(f *FS) error {
+		if ttl <= 0 {
+			return errors.Errorf("invalid warm-up attribute TTL %s", ttl)
+		}
+		f.warmAttrTTL = ttl
+		return nil
+	}
+}
+
+// WithoutChecksumVerification lets reads return data blocks that do not
+// match their checksum instead of failing with EIO, e.g. to copy what is
+// left of damaged files.
+func WithoutChecksumVerification() Option {
+	return func(f *FS) error {
+		f.fs.db.verifyChecksums = false
+		return nil
+	}
+}
+
+// WithObjectStore reads the files moved by `sqlfs tier` from the object
+// store at `url`, e.g. s3://bucket/prefix, instead of the one recorded.
+func WithObjectStore(url string) Option {
+	return func(f *FS) error {
+		f.objectStore = url
+		return nil
+	}
+}
+
+// WithJournal records every mutating operation in the ops_log table, which
+// `sqlfs init -journal` creates.
+func WithJournal() Option {
+	return func(f *FS) error {
+		f.journal = true
+		return nil
+	}
+}
+
+// WithContentIndex maintains the full-text index used by `sqlfs search`,
+// which `sqlfs init -content-index` creates.
+func WithContentIndex() Option {
+	return func(f *FS) error {
+		f.indexContent = true
+		return nil
+	}
+}
+
+// WithWriteLeases takes a lease on each file before writing to it, so that
+// the file systems sharing a database on several hosts take turns.
+func WithWriteLeases() Option {
+	return func(f *FS) error {
+		f.writeLeases = true
+		return nil
+	}
+}
+
+// WithExclusive fails if another FS holds the file system exclusively, and
+// makes the FSs created later without WithReadOnly fail until this one is
+// closed.
+func WithExclusive() Option {
+	return func(f *FS) error {
+		f.exclusive = true
+		return nil
+	}
+}
+
+// WithLeaseTTL sets how long the leases of WithWriteLeases and
+// WithExclusive, and the leadership of background tasks, outlive a file
+// system that stopped renewing them, 15s by default.
+func WithLeaseTTL(ttl time.Duration) Option {
+	return func(f *FS) error {
+		if ttl <= 0 {
+			return errors.Errorf("invalid lease TTL %s", ttl)
+		}
+		f.leaseTTL = ttl
+		return nil
+	}
+}
+
+// WithBackgroundGC removes orphaned inodes and data blocks every
+// `interval`, on the one file system elected leader among those sharing
+// the database.
+func WithBackgroundGC(interval time.Duration) Option {
+	return func(f *FS) error {
+		if interval < 0 {
+			return errors.Errorf("invalid garbage collection interval %s", interval)
+		}
+		f.gcInterval = interval
+		return nil
+	}
+}
+
+// WithBackgroundScrub verifies the checksums of all data blocks every
+// `interval` at `rate` blocks per second, on the file system elected
+// leader, as `sqlfs scrub` does. Damaged blocks are repaired from `replica`
+// unless it is nil.
+func WithBackgroundScrub(interval time.Duration, rate float64, replica *sql.DB) Option {
+	return func(f *FS) error {
+		if interval < 0 {
+			return errors.Errorf("invalid scrub interval %s", interval)
+		}
+		if rate <= 0 {
+			return errors.Errorf("invalid scrub rate %g", rate)
+		}
+		f.scrubInterval, f.scrubRate, f.scrubReplica = interval, rate, replica
+		return nil
+	}
+}
+
+// WithAsyncWrites commits writes in the background, queuing up to `size`
+// bytes of data.
+func WithAsyncWrites(size int64) Option {
+	return func(f *FS) error {
+		if size < 0 {
+			return errors.Errorf("invalid asynchronous write queue size %d", size)
+		}
+		f.asyncWrites = size
+		return nil
+	}
+}
+
+// WithMaintenancePoll checks every `interval` whether `sqlfs maintenance`
+// made the file system read-only.
+func WithMaintenancePoll(interval time.Duration) Option {
+	return func(f *FS) error {
+		if interval < 0 {
+			return errors.Errorf("invalid maintenance poll interval %s", interval)
+		}
+		f.maintenancePoll = interval
+		return nil
+	}
+}
+
+// WithQueryBudget reports the budget the connections of the database go
+// through in the stats of the admin API.
+func WithQueryBudget(budget *queryBudget) Option {
+	return func(f *FS) error {
+		f.fs.budget = budget
+		return nil
+	}
+}
+
+// WithFaultInjector reports the faults injected into the connections of the
+// database in the stats of the admin API.
+func WithFaultInjector(faults *faultInjector) Option {
+	return func(f *FS) error {
+		f.fs.faults = faults
+		return nil
+	}
+}
+
+// New returns the file system stored in `db`, whose tables must have been
+// created with `sqlfs init` or CreateSchema. Its background work, such as
+// warming up its caches, starts right away and runs until it is closed.
+func New(db *sql.DB, opts ...Option) (*FS, error) {
+	f := &FS{
+		fs: fileSystem{
+			db:             NewDB(db),
+			locks:          newInodeLocks(),
+			epochs:         &epochTable{},
+			diskFull:       &diskFullState{},
+			usage:          newUsageCache(),
+			tasks:          newBackgroundTasks(),
+			maintenance:    &maintenanceMode{},
+			maxNameLen:     DefaultMaxNameLen,
+			quiesceTimeout: 10 * time.Second,
+		},
+		subdir:      "/",
+		atime:       "relatime",
+		timeout:     30 * time.Second,
+		warmAttrTTL: time.Minute,
+		leaseTTL:    15 * time.Second,
+		options: []fuse.MountOption{
+			fuse.FSName("sql-fs"),     // FreeBSD ignores this.
+			fuse.Subtype("sql-fs"),    // OS X and FreeBSD ignore this.
+			fuse.LocalVolume(),        // OS X only.
+			fuse.VolumeName("sql-fs"), // OS X only.
+		},
+	}
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+	mode, err := parseAtimeMode(f.atime)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if err := LoadFileSystem(ctx, f.fs.db); err != nil {
+		return nil, err
+	}
+	root, err := ResolvePath(ctx, f.fs.db, f.subdir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve %s", f.subdir)
+	}
+	if !root.IsDirectory() {
+		return nil, errors.Errorf("%s is not a directory", f.subdir)
+	}
+	if f.fs.db.CheckWritableFormat() != nil {
+		// Newer versions use features that writes would break.
+		f.readOnly = true
+	}
+	if f.readOnly {
+		f.options = append(f.options, fuse.ReadOnly())
+		mode = atimeNone
+	} else if !f.exclusive {
+		if err := checkNotExclusive(ctx, f.fs.db); err != nil {
+			return nil, err
+		}
+	}
+	if f.objectStore != "" {
+		if f.fs.db.tierStore, err = OpenObjectStore(f.objectStore); err != nil {
+			return nil, err
+		}
+	}
+	if f.scrubInterval > 0 && !f.readOnly && !f.fs.db.BlockChecksums {
+		return nil, errors.New("scrubbing needs data block checksums, see `sqlfs init -checksums`")
+	}
+	if f.snapshotsURL != "" {
+		ok, err := TableExists(ctx, f.fs.db, "snapshots")
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			f.fs.snapshots = newSnapshotViews(f.snapshotsURL)
+		}
+	}
+	f.fs.root = root.Inode
+	f.fs.atimeMode = mode
+	f.fs.ops = newOpTracker(f.timeout)
+	if f.fs.appends != nil && f.timeout > 0 {
+		f.fs.appends.timeout = f.timeout
+	}
+	f.fs.ops.throttle.SetLimits(f.limits)
+	if err := f.start(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// start sets up the parts of the file system that take resources or run in
+// the background, which Close releases.
+func (f *FS) start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	var err error
+	if f.journal {
+		if f.fs.journal, err = newJournal(f.fs.db); err != nil {
+			return err
+		}
+		log.Printf("Journaling operations with mount ID %s.\n", f.fs.journal.mountID)
+	}
+	if f.indexContent {
+		f.fs.index = newContentIndexer(f.fs.db)
+	}
+	if f.fs.atimeMode != atimeNone {
+		f.fs.atime = newAtimeUpdater(f.fs.db)
+	}
+	if !f.readOnly && f.scrubInterval > 0 {
+		var replica *DB
+		if f.scrubReplica != nil {
+			replica = NewDB(f.scrubReplica)
+		}
+		f.fs.scrubber = newBlockScrubber(f.fs.db, replica, f.scrubRate)
+	}
+	if !f.readOnly && (f.writeLeases || f.exclusive || f.gcInterval > 0 || f.fs.scrubber != nil) {
+		if f.leases, err = newLeaseManager(ctx, f.fs.db, f.leaseTTL); err != nil {
+			return err
+		}
+		if f.exclusive {
+			err := f.leases.Hold(ctx, exclusiveLease, func() {
+				log.Println("Lost the exclusive lease on the file system, refusing writes since another mount may now write to it.")
+				f.fs.maintenance.set(true)
+			})
+			if err != nil {
+				return errors.Wrap(err, "another mount holds the file system exclusively")
+			}
+		}
+		if f.writeLeases {
+			f.fs.leases = f.leases
+		}
+		if f.gcInterval > 0 || f.fs.scrubber != nil {
+			f.fs.leader = newLeaderElection(f.leases)
+			go f.fs.leader.run(ctx)
+			if f.gcInterval > 0 {
+				go f.fs.runBackgroundGC(ctx, f.gcInterval)
+			}
+			if f.fs.scrubber != nil {
+				go f.fs.runBackgroundScrub(ctx, f.scrubInterval)
+			}
+		}
+	}
+	if f.asyncWrites > 0 {
+		f.fs.writes = newAsyncWriter(f.asyncWrites)
+	}
+	if f.maintenancePoll > 0 {
+		go f.fs.maintenance.poll(ctx, f.fs.db, f.maintenancePoll, f.fs.tasks, func() {
+			f.fs.quiesce(f.fs.quiesceTimeout)
+		})
+	}
+	var hot []uint64
+	if f.fs.heat != nil {
+		hot = f.fs.heat.Hot()
+		go func() {
+			ticker := time.NewTicker(heatMapSaveInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := f.fs.heat.Save(); err != nil {
+						log.Println(err)
+					}
+				}
+			}
+		}()
+	}
+	if len(f.warmPaths) > 0 || len(hot) > 0 {
+		var paths []string
+		for _, p := range f.warmPaths {
+			paths = append(paths, path.Join(f.subdir, p))
+		}
+		if f.fs.attrs == nil {
+			f.fs.attrs = newAttrCache(f.fs.db.settings)
+		}
+		go func() {
+			err := f.fs.warmUp(ctx, paths, hot, f.warmAttrTTL)
+			f.fs.tasks.report("warmup", err)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("warming up failed: %s\n", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Mount mounts the file system at `mountpoint` and serves it until it is
+// unmounted, e.g. with Unmount.
+func (f *FS) Mount(mountpoint string) error {
+	return f.Serve(mountpoint, func(error) {})
+}
+
+// Serve is Mount, calling `onReady` with the outcome of mounting once the
+// kernel completed it.
+func (f *FS) Serve(mountpoint string, onReady func(error)) error {
+	return serveFUSE(mountpoint, f.fs, f.options, onReady)
+}
+
+// Draining returns true once Unmount started to wait for the operations in
+// flight, until it failed to unmount.
+func (f *FS) Draining() bool {
+	return f.fs.ops.Draining()
+}
+
+// Unmount waits up to `timeout` for the operations in flight, writes the
+// pending updates to the database and unmounts the file system mounted at
+// `mountpoint`.
+func (f *FS) Unmount(mountpoint string, timeout time.Duration) error {
+	return f.fs.shutdown(mountpoint, timeout)
+}
+
+// Close writes the pending updates to the database and stops the
+// background work of the file system. It does not close the database.
+func (f *FS) Close() error {
+	if f.cancel != nil {
+		f.cancel()
+	}
+	f.fs.flushCreates()
+	if f.fs.appends != nil {
+		f.fs.appends.FlushAll()
+	}
+	// Before the updaters below are closed, as queued writes update them.
+	if f.fs.writes != nil {
+		f.fs.writes.WaitAll()
+	}
+	if f.leases != nil {
+		f.leases.Close()
+	}
+	if f.fs.atime != nil {
+		f.fs.atime.Close()
+	}
+	if f.fs.index != nil {
+		f.fs.index.Close()
+	}
+	if f.fs.snapshots != nil {
+		f.fs.snapshots.Close()
+	}
+	if f.fs.heat != nil {
+		return f.fs.heat.Save()
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// schemaVersion is the version of the on-disk format written by this
+// binary. Version 0 stored inodes as JSON, see `sqlfs migrate`.
+const schemaVersion = 1
+
+// Features of the file system are recorded in three bitmaps of the
+// superblock, as in ext4, according to what a binary that does not know them
+// can safely do:
+//   - compat features can be ignored: the file system can be read and
+//     written as usual;
+//   - ro-compat features can be ignored when reading, but writing would
+//     leave data the feature relies on stale, so the file system must be
+//     used read-only;
+//   - incompat features change how data is stored, so the file system
+//     cannot be used at all.
+const (
+	featureCompression uint64 = 1 << iota // incompat
+	featureEncryption                     // incompat
+	featureDedup                          // incompat
+	featureInlineData                     // incompat
+)
+
+var IncompatFeatureNames = map[uint64]string{
+	featureCompression: "compression",
+	featureEncryption:  "encryption",
+	featureDedup:       "dedup",
+	featureInlineData:  "inline_data",
+}
+
+const (
+	// Inodes have a generation bumped with every change to their data.
+	featureGenerations uint64 = 1 << iota // ro-compat
+)
+
+var roCompatFeatureNames = map[uint64]string{
+	featureGenerations: "generations",
+}
+
+// The ro-compat and incompat features this binary knows how to read and
+// write. Unknown compat features need no check.
+const (
+	supportedROCompat uint64 = featureGenerations
+	supportedIncompat uint64 = featureInlineData
+)
+
+// defaultROCompat are the ro-compat features of new file systems.
+const defaultROCompat = featureGenerations
+
+// FormatFeatures returns the names of `features`, e.g. "compression,dedup".
+// Features without a name in `names` are shown by bit number.
+func FormatFeatures(features uint64, names map[uint64]string) string {
+	var list []string
+	for bit := uint(0); features != 0; bit++ {
+		f := uint64(1) << bit
+		if features&f == 0 {
+			continue
+		}
+		features &^= f
+		if name, ok := names[f]; ok {
+			list = append(list, name)
+		} else {
+			list = append(list, fmt.Sprintf("bit%d", bit))
+		}
+	}
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ",")
+}
+
+// CheckWritableFormat fails if the file system has ro-compat features this
+// binary does not support, before a command writes to it.
+func (s *settings) CheckWritableFormat() error {
+	if s.unsupportedROCompat != 0 {
+		return errors.Errorf("the file system uses features this binary can only read (%s); upgrade sqlfs to write to it",
+			FormatFeatures(s.unsupportedROCompat, roCompatFeatureNames))
+	}
+	return nil
+}
+
+// superblock describes the file system stored in a database. It is written
+// by `sqlfs init` and checked whenever the database is opened, so that a
+// binary refuses to use a file system whose format it does not understand
+// instead of corrupting it.
+type superblock struct {
+	UUID          string
+	BlockSize     int64
+	Compat        uint64
+	ROCompat      uint64
+	Incompat      uint64
+	SchemaVersion int
+	Created       time.Time
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// createSuperblock writes the superblock of a new file system, or of one
+// created before superblocks were added. Existing superblocks are kept.
+func createSuperblock(ctx context.Context, db *DB) error {
+	id, err := newUUID()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate the file system UUID")
+	}
+	size, err := GetBlockSize(ctx, db)
+	if err != nil {
+		return err
+	}
+	q := `INSERT INTO superblock (id, uuid, block_size, ro_compat_features, schema_version, created)
+  VALUES (1, $1, $2, $3, $4, now()) ON CONFLICT (id) DO NOTHING`
+	if _, err := db.ExecContext(ctx, q, id, size, defaultROCompat, schemaVersion); err != nil {
+		return errors.Wrap(err, "failed to write the superblock")
+	}
+	return nil
+}
+
+// GetSuperblock returns the superblock of the file system, or nil if the
+// file system was created before superblocks were added.
+func GetSuperblock(ctx context.Context, db *DB) (*superblock, error) {
+	exists, err := TableExists(ctx, db, "superblock")
+	if err != nil || !exists {
+		return nil, err
+	}
+	var sb superblock
+	q := `SELECT uuid, block_size, compat_features, ro_compat_features, incompat_features, schema_version, created
+  FROM superblock WHERE id = 1`
+	err = db.QueryRowContext(ctx, q).Scan(
+		&sb.UUID, &sb.BlockSize, &sb.Compat, &sb.ROCompat, &sb.Incompat, &sb.SchemaVersion, &sb.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the superblock")
+	}
+	return &sb, nil
+}
+
+// setSuperblockBlockSize records a new block size in the superblock, if
+// there is one.
+func setSuperblockBlockSize(ctx context.Context, db *DB, size int64) error {
+	exists, err := TableExists(ctx, db, "superblock")
+	if err != nil || !exists {
+		return err
+	}
+	q := "UPDATE superblock SET block_size = $1 WHERE id = 1"
+	if _, err := db.ExecContext(ctx, q, size); err != nil {
+		return errors.Wrap(err, "failed to update the superblock")
+	}
+	return nil
+}
+
+// addSuperblockFeature records the ro-compat `feature` in the superblock, if
+// there is one.
+func addSuperblockFeature(ctx context.Context, db *DB, feature uint64) error {
+	return setFeatureBit(ctx, db, "ro_compat_features", feature)
+}
+
+// addIncompatFeature records the incompat `feature` in the superblock, if
+// there is one.
+func addIncompatFeature(ctx context.Context, db *DB, feature uint64) error {
+	return setFeatureBit(ctx, db, "incompat_features", feature)
+}
+
+func setFeatureBit(ctx context.Context, db *DB, column string, feature uint64) error {
+	exists, err := TableExists(ctx, db, "superblock")
+	if err != nil || !exists {
+		return err
+	}
+	q := "UPDATE superblock SET " + column + " = " + column + " | $1 WHERE id = 1"
+	if _, err := db.ExecContext(ctx, q, feature); err != nil {
+		return errors.Wrap(err, "failed to update the superblock")
+	}
+	return nil
+}
+
+// checkSuperblock ensures that this binary can use the file system described
+// by the superblock, and records whether it may only read it. File systems
+// without one predate it and use the first version of the current format.
+func checkSuperblock(ctx context.Context, db *DB) error {
+	sb, err := GetSuperblock(ctx, db)
+	if err != nil || sb == nil {
+		return err
+	}
+	if sb.SchemaVersion > schemaVersion {
+		return errors.Errorf("the file system %s uses schema version %d, but this binary only supports up to version %d; upgrade sqlfs",
+			sb.UUID, sb.SchemaVersion, schemaVersion)
+	}
+	if unknown := sb.Incompat &^ supportedIncompat; unknown != 0 {
+		return errors.Errorf("the file system %s uses features this binary does not support (%s); upgrade sqlfs",
+			sb.UUID, FormatFeatures(unknown, IncompatFeatureNames))
+	}
+	size, err := GetBlockSize(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the block size")
+	}
+	if sb.BlockSize != size {
+		return errors.Errorf("the superblock of the file system %s records %d byte blocks, but the block_size setting %d byte blocks",
+			sb.UUID, sb.BlockSize, size)
+	}
+	db.unsupportedROCompat = sb.ROCompat &^ supportedROCompat
+	return nil
+}
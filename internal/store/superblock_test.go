@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFormatFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		features uint64
+		want     string
+	}{
+		{0, "none"},
+		{featureCompression, "compression"},
+		{featureInlineData | featureDedup, "dedup,inline_data"},
+		{featureEncryption | 1<<40, "encryption,bit40"},
+	} {
+		if got := FormatFeatures(tc.features, IncompatFeatureNames); got != tc.want {
+			t.Errorf("FormatFeatures(%#x) = %q, want %q", tc.features, got, tc.want)
+		}
+	}
+
+	// Each named feature has its own bit, and those this binary supports
+	// are named.
+	for _, tc := range []struct {
+		names     map[uint64]string
+		supported uint64
+	}{
+		{IncompatFeatureNames, supportedIncompat},
+		{roCompatFeatureNames, supportedROCompat},
+	} {
+		var seen uint64
+		for bit, name := range tc.names {
+			if bit == 0 || bit&(bit-1) != 0 || seen&bit != 0 {
+				t.Errorf("feature %s has the bits %#x", name, bit)
+			}
+			seen |= bit
+		}
+		if tc.supported&^seen != 0 {
+			t.Errorf("supported features %#x have no name", tc.supported&^seen)
+		}
+	}
+}
+
+func TestCheckWritableFormat(t *testing.T) {
+	s := defaultSettings()
+	if err := s.CheckWritableFormat(); err != nil {
+		t.Errorf("CheckWritableFormat without unknown features returned %v", err)
+	}
+	s.unsupportedROCompat = 1 << 5
+	if err := s.CheckWritableFormat(); err == nil || !strings.Contains(err.Error(), "bit5") {
+		t.Errorf("CheckWritableFormat with an unknown ro-compat feature returned %v", err)
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	v4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	a, err := newUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v4.MatchString(a) || a == b {
+		t.Errorf("newUUID returned %s then %s", a, b)
+	}
+}
+
+// TestCheckSuperblock checks that file systems with unknown features are
+// refused, or only opened for reading. It needs SQLFS_TEST_DB (see
+// openTestDB).
+func TestCheckSuperblock(t *testing.T) {
+	ctx := context.Background()
+	db := NewDB(openTestDB(t))
+	if err := checkSuperblock(ctx, db); err != nil {
+		t.Fatalf("checkSuperblock of a new file system returned %v", err)
+	}
+	sb, err := GetSuperblock(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.ROCompat != defaultROCompat || sb.Incompat != 0 || sb.SchemaVersion != schemaVersion {
+		t.Errorf("new superblock = %+v", sb)
+	}
+
+	if err := addSuperblockFeature(ctx, db, 1<<7); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSuperblock(ctx, db); err != nil {
+		t.Fatalf("checkSuperblock with an unknown ro-compat feature returned %v", err)
+	}
+	if err := db.CheckWritableFormat(); err == nil {
+		t.Error("a file system with an unknown ro-compat feature is writable")
+	}
+
+	if err := addIncompatFeature(ctx, db, featureDedup); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSuperblock(ctx, db); err == nil || !strings.Contains(err.Error(), "dedup") {
+		t.Errorf("checkSuperblock with an unsupported incompat feature returned %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func TestSymlinkTargets(t *testing.T) {
+	root := newTestRoot(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name, target string
+	}{
+		{"relative", "target"},
+		{"relative-dir", "dir/file"},
+		{"dot", "./file"},
+		{"parent", "../../outside/file"},
+		{"dotdot-inside", "a/../b/./c"},
+		{"trailing-slash", "dir/"},
+		{"absolute", "/etc/passwd"},
+		{"absolute-root", "/"},
+		{"absolute-dotdot", "/usr/../tmp//x"},
+		// Longer than a data block, and the longest target accepted.
+		{"long", strings.Repeat("a/", (maxSymlinkTarget-1)/2) + "b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &fuse.SymlinkRequest{NewName: tc.name, Target: tc.target}
+			created, err := root.Symlink(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := created.(*FileNode).Readlink(ctx, &fuse.ReadlinkRequest{})
+			if err != nil || got != tc.target {
+				t.Errorf("Readlink of the new link = %q, %v, want %q", got, err, tc.target)
+			}
+
+			// Targets are stored verbatim, neither resolved nor cleaned.
+			found, err := root.Lookup(ctx, tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link := found.(*FileNode)
+			got, err = link.Readlink(ctx, &fuse.ReadlinkRequest{})
+			if err != nil || got != tc.target {
+				t.Errorf("Readlink of the stored link = %q, %v, want %q", got, err, tc.target)
+			}
+			var attr fuse.Attr
+			if err := link.Attr(ctx, &attr); err != nil {
+				t.Fatal(err)
+			}
+			if attr.Mode != os.ModeSymlink|0777 {
+				t.Errorf("mode = %s, want %s", attr.Mode, os.ModeSymlink|0777)
+			}
+			if attr.Size != uint64(len(tc.target)) {
+				t.Errorf("size = %d, want %d", attr.Size, len(tc.target))
+			}
+		})
+	}
+}
+
+func TestSymlinkSetattr(t *testing.T) {
+	root := newTestRoot(t)
+	ctx := context.Background()
+	created, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "link", Target: "/nowhere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := created.(*FileNode)
+
+	// lchown and lutimes change the link itself, which has no target here.
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrUid | fuse.SetattrMtime, Uid: 1234, Mtime: mtime}
+	if err := link.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := root.Lookup(ctx, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attr fuse.Attr
+	if err := found.(*FileNode).Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Uid != 1234 || !attr.Mtime.Equal(mtime) {
+		t.Errorf("uid, mtime = %d, %s, want 1234, %s", attr.Uid, attr.Mtime, mtime)
+	}
+
+	req = &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 0}
+	if err := link.Setattr(ctx, req, &fuse.SetattrResponse{}); err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("truncating a symlink returned %v, want EINVAL", err)
+	}
+}
+
+func TestSymlinkTargetTooLong(t *testing.T) {
+	dir := &FileNode{fs: &fileSystem{}, Inode: RootInode, Mode: os.ModeDir | 0755}
+	req := &fuse.SymlinkRequest{NewName: "link", Target: strings.Repeat("a", maxSymlinkTarget+1)}
+	if _, err := dir.Symlink(context.Background(), req); err != fuse.Errno(syscall.ENAMETOOLONG) {
+		t.Errorf("Symlink with a %d byte target returned %v, want ENAMETOOLONG", len(req.Target), err)
+	}
+}
+
+func TestReadlinkNotSymlink(t *testing.T) {
+	file := &FileNode{fs: &fileSystem{}, Inode: 2, Mode: 0644}
+	if _, err := file.Readlink(context.Background(), &fuse.ReadlinkRequest{}); err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("Readlink of a regular file returned %v, want EINVAL", err)
+	}
+}
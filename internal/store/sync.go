@@ -0,0 +1,341 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Number of blocks of a local file compared with the database at a time.
+const syncChunkBlocks = 256
+
+// syncer makes a directory of the file system match a local directory tree,
+// as rsync does, but writing to the database directly. Files whose size and
+// modification time match are skipped, and only the blocks of the other
+// files that differ are written: they are compared with the checksums of
+// the stored blocks if the file system has them, and with the stored blocks
+// otherwise, which then have to be read.
+type syncer struct {
+	ctx context.Context
+	db  *DB
+	im  *Importer
+
+	dryRun bool
+	// Whether files whose size and modification time match are compared by
+	// hash as well.
+	checksum bool
+
+	// Nodes below the destination, keyed by their folded path relative to
+	// it, and the keys of those found locally.
+	remote map[string]*FileNode
+	seen   map[string]bool
+
+	Stats syncStats
+}
+
+type syncStats struct {
+	Created, Updated, Removed, Unchanged int
+	Blocks                               int64
+}
+
+func NewSyncer(ctx context.Context, db *DB, dest uint64, dryRun, checksum bool) (*syncer, error) {
+	nodes, err := ListSubtree(ctx, db, dest, 0)
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]*FileNode, len(nodes))
+	for _, n := range nodes {
+		remote[db.foldPath(n.Name)] = n
+	}
+	return &syncer{
+		ctx:      ctx,
+		db:       db,
+		im:       NewImporter(ctx, db, dest, 500),
+		dryRun:   dryRun,
+		checksum: checksum,
+		remote:   remote,
+		seen:     make(map[string]bool),
+	}, nil
+}
+
+// foldPath returns the key of the relative path `p` in syncer.remote.
+func (s *settings) foldPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = s.foldName(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// SyncDir syncs the local directory tree rooted at `root`.
+func (s *syncer) SyncDir(root string) error {
+	err := filepath.Walk(root, func(local string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, local)
+		if err != nil || rel == "." {
+			return err
+		}
+		return s.syncNode(local, filepath.ToSlash(rel), fi)
+	})
+	if err != nil {
+		s.im.Rollback()
+		return err
+	}
+	return s.im.Commit()
+}
+
+func (s *syncer) syncNode(local, p string, fi os.FileInfo) error {
+	key := s.db.foldPath(p)
+	s.seen[key] = true
+	n := NodeFromFileInfo(fi)
+	if n.IsSymlink() {
+		target, err := os.Readlink(local)
+		if err != nil {
+			return err
+		}
+		n.SymlinkTarget = target
+	}
+
+	existing := s.remote[key]
+	if existing != nil && (existing.Mode&os.ModeType != n.Mode&os.ModeType || existing.SymlinkTarget != n.SymlinkTarget) {
+		if err := s.remove(key); err != nil {
+			return err
+		}
+		existing = nil
+	}
+	if existing == nil {
+		s.Stats.Created++
+		if s.dryRun {
+			return nil
+		}
+	}
+	switch {
+	case fi.IsDir():
+		if existing != nil {
+			s.im.Dirs[p] = existing.Inode
+			return nil
+		}
+		return s.im.AddDir(p, n)
+	case n.IsRegular():
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if existing != nil {
+			return s.updateFile(existing, n, f)
+		}
+		return s.im.AddFile(p, n, f)
+	case existing != nil:
+		s.Stats.Unchanged++
+		return nil
+	}
+	return s.im.AddFile(p, n, nil)
+}
+
+// updateFile writes the blocks of the local file `f`, described by `n`,
+// that differ from those of the stored file `existing`.
+func (s *syncer) updateFile(existing, n *FileNode, f *os.File) error {
+	// The database keeps times to the microsecond.
+	same := existing.Size == n.Size && existing.Mtime.Equal(n.Mtime.Truncate(time.Microsecond))
+	if same && s.checksum {
+		var err error
+		if same, err = s.sameHash(existing, f); err != nil {
+			return err
+		}
+	}
+	if same && existing.Mode == n.Mode && existing.Uid == n.Uid && existing.Gid == n.Gid {
+		s.Stats.Unchanged++
+		return nil
+	}
+	s.Stats.Updated++
+	if s.dryRun {
+		return nil
+	}
+	if !same {
+		written, err := syncBlocks(s.ctx, s.db, existing, f)
+		s.Stats.Blocks += written
+		if err != nil {
+			return err
+		}
+		if existing.Size > n.Size {
+			if err := TruncateData(s.ctx, s.db, existing, n.Size); err != nil {
+				return err
+			}
+		}
+	}
+	existing.Mode = n.Mode
+	existing.Uid = n.Uid
+	existing.Gid = n.Gid
+	existing.Mtime = n.Mtime
+	existing.Ctime = time.Now()
+	return UpdateNode(s.ctx, s.db, existing)
+}
+
+// sameHash returns whether the local file `f` has the contents of the
+// stored file `existing`. Files whose hash cannot be computed are assumed
+// to match, as their size and modification time do.
+func (s *syncer) sameHash(existing *FileNode, f *os.File) (bool, error) {
+	sum, err := FileHash(s.ctx, s.db, existing.Inode)
+	if err == ErrHashUnavailable {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), sum), nil
+}
+
+// remove removes the stored node `key` and everything below it.
+func (s *syncer) remove(key string) error {
+	s.Stats.Removed++
+	for other := range s.remote {
+		if strings.HasPrefix(other, key+"/") {
+			// Not to be pruned again.
+			s.seen[other] = true
+		}
+	}
+	if s.dryRun {
+		return nil
+	}
+	n := s.remote[key]
+	// Entries created in the pending batch may be below `n`.
+	if err := s.im.Commit(); err != nil {
+		return err
+	}
+	_, err := RemoveTree(s.ctx, s.db, n.Parent, path.Base(n.Name))
+	return err
+}
+
+// Prune removes the stored nodes that were not found locally.
+func (s *syncer) Prune() error {
+	var keys []string
+	for key := range s.remote {
+		if !s.seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	// Parents sort before their children, which remove marks as seen.
+	sort.Strings(keys)
+	for _, key := range keys {
+		if s.seen[key] {
+			continue
+		}
+		if err := s.remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncBlocks writes the blocks of the file `n` that differ from those read
+// from `r`, and returns the number of blocks written. Blocks past the end
+// of `r` are left to the caller to truncate.
+func syncBlocks(ctx context.Context, db *DB, n *FileNode, r io.Reader) (int64, error) {
+	sums, err := blockSums(ctx, db, n.Inode)
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	buf := make([]byte, syncChunkBlocks*db.BlockSize)
+	for first := int64(0); ; first += syncChunkBlocks {
+		size, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return written, readErr
+		}
+		chunk := buf[:size]
+		count := (int64(size) + db.BlockSize - 1) / db.BlockSize
+
+		// Stored blocks are only read if some have no checksum.
+		var stored map[int64][]byte
+		for i := first; i < first+count; i++ {
+			if _, ok := sums[i]; !ok {
+				if stored, err = ReadBlocks(ctx, db, n.Inode, first, count); err != nil {
+					return written, err
+				}
+				break
+			}
+		}
+		block := func(i int64) []byte {
+			start := (i - first) * db.BlockSize
+			end := start + db.BlockSize
+			if end > int64(size) {
+				end = int64(size)
+			}
+			return chunk[start:end]
+		}
+		differs := func(i int64) bool {
+			if sum, ok := sums[i]; ok {
+				return crc32.Checksum(block(i), castagnoli) != sum
+			}
+			return !bytes.Equal(stored[i], block(i))
+		}
+
+		// Runs of differing blocks are written together.
+		for i := first; i < first+count; {
+			if !differs(i) {
+				i++
+				continue
+			}
+			end := i + 1
+			for end < first+count && differs(end) {
+				end++
+			}
+			from := (i - first) * db.BlockSize
+			to := (end - first) * db.BlockSize
+			if to > int64(size) {
+				to = int64(size)
+			}
+			if err := WriteData(ctx, db, n, i*db.BlockSize, chunk[from:to]); err != nil {
+				return written, err
+			}
+			written += end - i
+			i = end
+		}
+		if readErr != nil {
+			return written, nil
+		}
+	}
+}
+
+// blockSums returns the checksums of the data blocks of `inode`, keyed by
+// their zero-based index, or nil if blocks have no checksums.
+func blockSums(ctx context.Context, db *DB, inode uint64) (map[int64]uint32, error) {
+	if !db.BlockChecksums {
+		return nil, nil
+	}
+	q := "SELECT sequence, checksum FROM data_blocks WHERE inode = $1 AND checksum IS NOT NULL"
+	rows, err := db.QueryContext(ctx, q, inode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the checksums of inode %d", inode)
+	}
+	defer rows.Close()
+	sums := make(map[int64]uint32)
+	for rows.Next() {
+		var sequence, sum int64
+		if err := rows.Scan(&sequence, &sum); err != nil {
+			return nil, err
+		}
+		sums[sequence-1] = uint32(sum)
+	}
+	return sums, rows.Err()
+}
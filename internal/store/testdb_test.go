@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDBEnv names the environment variable holding the URL of the
+// CockroachDB cluster used by the tests that need a database, e.g.
+// "postgresql://root@localhost:26257?sslmode=disable". These tests are
+// skipped without it.
+const testDBEnv = "SQLFS_TEST_DB"
+
+// openTestDB returns a new database holding an empty file system, which is
+// dropped when the test ends.
+func openTestDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := pingDB(createTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := CreateSchema(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestDB creates a new, empty database, which is dropped when the test
+// ends, and returns its URL.
+func createTestDB(t testing.TB) string {
+	t.Helper()
+	rawURL := os.Getenv(testDBEnv)
+	if rawURL == "" {
+		t.Skipf("%s is not set", testDBEnv)
+	}
+	admin, err := pingDB(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("sqlfs_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		_ = admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP DATABASE " + name + " CASCADE"); err != nil {
+			t.Errorf("failed to drop %s: %s", name, err)
+		}
+		_ = admin.Close()
+	})
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Path = "/" + name
+	return u.String()
+}
+
+// pingDB connects to the database at `url` and ensures that it is reachable.
+func pingDB(url string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// newTestRoot returns the root directory of a file system created with New
+// in a new test database.
+func newTestRoot(t testing.TB, opts ...Option) *FileNode {
+	t.Helper()
+	f, err := New(openTestDB(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	root, err := f.fs.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root.(*FileNode)
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+// Number of per-user buckets kept before idle ones are dropped.
+const maxThrottledUsers = 1024
+
+// throttleLimits are the rates FUSE operations are throttled to. Zero means
+// unlimited.
+type throttleLimits struct {
+	Ops    float64 `json:"ops_per_sec"`
+	Bytes  uint64  `json:"bytes_per_sec"`
+	UIDOps float64 `json:"uid_ops_per_sec"`
+}
+
+func (l throttleLimits) unlimited() bool {
+	return l.Ops == 0 && l.Bytes == 0 && l.UIDOps == 0
+}
+
+// parseThrottleLimits parses limits of the form ops=100,bytes=10M,uid-ops=20,
+// where omitted limits are unlimited, or "off".
+func parseThrottleLimits(s string) (throttleLimits, error) {
+	var l throttleLimits
+	if s == "off" {
+		return l, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return l, errors.Errorf("invalid limit %q, expected NAME=VALUE", kv)
+		}
+		name, value := kv[:i], kv[i+1:]
+		var err error
+		switch name {
+		case "ops":
+			l.Ops, err = strconv.ParseFloat(value, 64)
+		case "bytes":
+			var b ByteSize
+			err = b.Set(value)
+			l.Bytes = uint64(b)
+		case "uid-ops":
+			l.UIDOps, err = strconv.ParseFloat(value, 64)
+		default:
+			return l, errors.Errorf("unknown limit %q, expected ops, bytes or uid-ops", name)
+		}
+		if err != nil || l.Ops < 0 || l.UIDOps < 0 {
+			return l, errors.Errorf("invalid value %q for limit %s", value, name)
+		}
+	}
+	return l, nil
+}
+
+// tokenBucket allows `rate` units per second on average, in bursts of up to
+// a second's worth. Units are taken ahead of time, so that a request larger
+// than the burst waits for the units it needs instead of starving.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// take takes `n` units and returns how long to wait before using them.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttle delays FUSE requests so that a runaway process on the mount
+// cannot saturate the database shared with other mounts. Limits can be
+// changed at runtime through the admin API, which also releases the
+// requests waiting under the old limits.
+type throttle struct {
+	mu     sync.Mutex
+	limits throttleLimits
+	ops    *tokenBucket
+	bytes  *tokenBucket
+	users  map[uint32]*tokenBucket
+	// Closed when the limits change.
+	changed chan struct{}
+
+	throttled map[string]uint64
+	delay     time.Duration
+}
+
+// throttleStats is a snapshot of the limits and counters of a throttle.
+type throttleStats struct {
+	Limits       throttleLimits    `json:"limits"`
+	Throttled    map[string]uint64 `json:"throttled"`
+	DelaySeconds float64           `json:"delay_seconds"`
+}
+
+func newThrottle() *throttle {
+	return &throttle{
+		changed:   make(chan struct{}),
+		throttled: make(map[string]uint64),
+	}
+}
+
+// SetLimits replaces the limits, starting with full buckets.
+func (t *throttle) SetLimits(l throttleLimits) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits = l
+	t.ops, t.bytes, t.users = nil, nil, nil
+	if l.Ops > 0 {
+		t.ops = newTokenBucket(l.Ops, now)
+	}
+	if l.Bytes > 0 {
+		t.bytes = newTokenBucket(float64(l.Bytes), now)
+	}
+	if l.UIDOps > 0 {
+		t.users = make(map[uint32]*tokenBucket)
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Limits returns the current limits.
+func (t *throttle) Limits() throttleLimits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limits
+}
+
+// wait blocks until `req` fits within the limits.
+func (t *throttle) wait(req fuse.Request) {
+	switch req.(type) {
+	case *fuse.ForgetRequest, *fuse.InterruptRequest, *fuse.DestroyRequest:
+		// Cheap, and delaying them would only hold resources longer.
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	if t.limits.unlimited() {
+		t.mu.Unlock()
+		return
+	}
+	var delay time.Duration
+	if t.ops != nil {
+		delay = t.ops.take(1, now)
+	}
+	if t.bytes != nil {
+		var n int
+		switch req := req.(type) {
+		case *fuse.ReadRequest:
+			n = req.Size
+		case *fuse.WriteRequest:
+			n = len(req.Data)
+		}
+		if d := t.bytes.take(float64(n), now); d > delay {
+			delay = d
+		}
+	}
+	if t.users != nil {
+		uid := req.Hdr().Uid
+		b, ok := t.users[uid]
+		if !ok {
+			t.pruneUsers(now)
+			b = newTokenBucket(t.limits.UIDOps, now)
+			t.users[uid] = b
+		}
+		if d := b.take(1, now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		t.mu.Unlock()
+		return
+	}
+	t.throttled[strings.TrimSuffix(reflect.TypeOf(req).Elem().Name(), "Request")]++
+	t.delay += delay
+	changed := t.changed
+	t.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-changed:
+	}
+}
+
+// pruneUsers drops the buckets of idle users once there are too many. Their
+// buckets would be full again anyway.
+func (t *throttle) pruneUsers(now time.Time) {
+	if len(t.users) < maxThrottledUsers {
+		return
+	}
+	for uid, b := range t.users {
+		if now.Sub(b.last).Seconds()*b.rate >= b.rate-b.tokens {
+			delete(t.users, uid)
+		}
+	}
+}
+
+// Stats returns a snapshot of the limits and of the throttled operations.
+func (t *throttle) Stats() throttleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := throttleStats{
+		Limits:       t.limits,
+		Throttled:    make(map[string]uint64, len(t.throttled)),
+		DelaySeconds: t.delay.Seconds(),
+	}
+	for op, count := range t.throttled {
+		s.Throttled[op] = count
+	}
+	return s
+}
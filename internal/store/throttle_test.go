@@ -0,0 +1,99 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func TestParseThrottleLimits(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want throttleLimits
+		ok   bool
+	}{
+		{"off", throttleLimits{}, true},
+		{"ops=100", throttleLimits{Ops: 100}, true},
+		{"ops=0.5,bytes=10M,uid-ops=20", throttleLimits{Ops: 0.5, Bytes: 10 << 20, UIDOps: 20}, true},
+		{"bytes=64K", throttleLimits{Bytes: 64 << 10}, true},
+		{"", throttleLimits{}, false},
+		{"ops", throttleLimits{}, false},
+		{"ops=-1", throttleLimits{}, false},
+		{"uid-ops=x", throttleLimits{}, false},
+		{"bytes=lots", throttleLimits{}, false},
+		{"iops=10", throttleLimits{}, false},
+	} {
+		got, err := parseThrottleLimits(tc.s)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseThrottleLimits(%q) returned error %v", tc.s, err)
+			continue
+		}
+		if tc.ok && got != tc.want {
+			t.Errorf("parseThrottleLimits(%q) = %+v, want %+v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, now)
+	// A second's worth is available as a burst.
+	for i := 0; i < 10; i++ {
+		if d := b.take(1, now); d != 0 {
+			t.Fatalf("take %d of the burst waits %s", i, d)
+		}
+	}
+	if d := b.take(1, now); d != 100*time.Millisecond {
+		t.Errorf("take past the burst waits %s, want 100ms", d)
+	}
+	// Tokens refill at the rate, up to the burst.
+	if d := b.take(1, now.Add(200*time.Millisecond)); d != 0 {
+		t.Errorf("take after the refill waits %s", d)
+	}
+	if d := b.take(20, now.Add(time.Hour)); d != time.Second {
+		t.Errorf("take of twice the burst waits %s, want 1s", d)
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	th := newThrottle()
+	write := &fuse.WriteRequest{Header: fuse.Header{Uid: 1000}, Data: make([]byte, 4096)}
+
+	// Without limits, nothing is throttled.
+	th.wait(write)
+	if s := th.Stats(); len(s.Throttled) != 0 {
+		t.Errorf("throttled %v without limits", s.Throttled)
+	}
+
+	th.SetLimits(throttleLimits{Bytes: 4096})
+	start := time.Now()
+	th.wait(write)
+	done := make(chan struct{})
+	go func() {
+		th.wait(write) // Waits a second for the bucket to refill...
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	th.SetLimits(throttleLimits{}) // ...unless the limits change.
+	select {
+	case <-done:
+	case <-time.After(time.Second / 2):
+		t.Fatal("a waiting request was not released when the limits changed")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("requests took %s", elapsed)
+	}
+	if s := th.Stats(); s.Throttled["Write"] != 1 || s.DelaySeconds <= 0 {
+		t.Errorf("stats = %+v, want one throttled write", s)
+	}
+
+	// Forgets are never throttled.
+	th.SetLimits(throttleLimits{Ops: 1})
+	for i := 0; i < 10; i++ {
+		th.wait(&fuse.ForgetRequest{})
+	}
+	if s := th.Stats(); s.Throttled["Forget"] != 0 {
+		t.Errorf("throttled %d forgets", s.Throttled["Forget"])
+	}
+}
@@ -0,0 +1,372 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tieringStatements creates the table of files whose contents were moved
+// to an object store. It is only created by `sqlfs init -tiering`.
+var tieringStatements = []string{
+	`CREATE TABLE IF NOT EXISTS tiered_files (
+  inode  INT,
+  object STRING NOT NULL,
+  size   INT NOT NULL,
+  PRIMARY KEY (inode)
+)`,
+}
+
+// CreateTiering creates the tables needed to tier files to an object store.
+func CreateTiering(ctx context.Context, db *DB) error {
+	for _, q := range tieringStatements {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return errors.Wrapf(err, "failed to execute %q", q)
+		}
+	}
+	return nil
+}
+
+// tieredObject is the object holding the contents of a tiered file.
+type tieredObject struct {
+	Inode  uint64
+	Object string
+	Size   uint64
+}
+
+// GetTieredObject returns the object holding the contents of `inode`, or
+// sql.ErrNoRows if the file is not tiered.
+func GetTieredObject(ctx context.Context, db *DB, inode uint64) (tieredObject, error) {
+	t := tieredObject{Inode: inode}
+	q := "SELECT object, size FROM tiered_files WHERE inode = $1"
+	err := db.QueryRowContext(ctx, q, inode).Scan(&t.Object, &t.Size)
+	return t, err
+}
+
+// ListTierCandidates returns the regular files of at least `minSize` bytes
+// that were not modified since `before` and are not tiered yet.
+func ListTierCandidates(ctx context.Context, db *DB, minSize uint64, before time.Time) ([]*FileNode, error) {
+	q := "SELECT inodes.inode, " + prefixColumns("inodes", inodeColumns) + ` FROM inodes
+  LEFT JOIN tiered_files ON tiered_files.inode = inodes.inode
+  WHERE tiered_files.inode IS NULL AND inodes.size >= $1 AND inodes.mtime < $2
+  ORDER BY inodes.inode`
+	rows, err := db.QueryContext(ctx, q, minSize, before)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list files to tier")
+	}
+	defer rows.Close()
+
+	var nodes []*FileNode
+	for rows.Next() {
+		n := &FileNode{}
+		if err := rows.Scan(append([]interface{}{&n.Inode}, inodeFields(n)...)...); err != nil {
+			return nil, err
+		}
+		if n.IsRegular() {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, rows.Err()
+}
+
+// ListOrphanedObjects returns the objects of tiered files that were removed.
+func ListOrphanedObjects(ctx context.Context, db *DB) ([]tieredObject, error) {
+	q := `SELECT tiered_files.inode, object, tiered_files.size FROM tiered_files
+  LEFT JOIN inodes ON inodes.inode = tiered_files.inode WHERE inodes.inode IS NULL`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list orphaned objects")
+	}
+	defer rows.Close()
+
+	var objects []tieredObject
+	for rows.Next() {
+		var t tieredObject
+		if err := rows.Scan(&t.Inode, &t.Object, &t.Size); err != nil {
+			return nil, err
+		}
+		objects = append(objects, t)
+	}
+	return objects, rows.Err()
+}
+
+// RemoveTieredObject forgets the object of `inode` and deletes it from
+// `store`.
+func RemoveTieredObject(ctx context.Context, db *DB, store objectStore, t tieredObject) error {
+	q := "DELETE FROM tiered_files WHERE inode = $1 AND object = $2"
+	if _, err := db.ExecContext(ctx, q, t.Inode, t.Object); err != nil {
+		return errors.Wrapf(err, "failed to forget object of inode %d", t.Inode)
+	}
+	return store.Delete(ctx, t.Object)
+}
+
+// SetTierStore records the object store at `rawURL` as the one holding the
+// tiered files of the file system in `db`, which can only change while no
+// file is tiered.
+func SetTierStore(ctx context.Context, db *DB, rawURL string) error {
+	current, err := GetSetting(ctx, db, SettingTierStore)
+	if err != nil || current == rawURL {
+		return err
+	}
+	var tiered bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM tiered_files)").Scan(&tiered); err != nil {
+		return errors.Wrap(err, "failed to check for tiered files")
+	}
+	if tiered {
+		return errors.Errorf("files are tiered to %s, the object store cannot be changed", current)
+	}
+	return PutSetting(ctx, db, SettingTierStore, rawURL)
+}
+
+// errNoTierStore is returned when accessing the contents of a tiered file
+// without knowing the object store holding them.
+func errNoTierStore(inode uint64) error {
+	return errors.Errorf("inode %d is tiered, but no object store is known (run `sqlfs tier` or mount with -object-store)", inode)
+}
+
+// TierFile moves the contents of the file `n` to `store`. The file is left
+// untouched if it is modified while it is being uploaded: its blocks are
+// only removed in the transaction that checks that it was not.
+func TierFile(ctx context.Context, db *DB, store objectStore, n *FileNode) error {
+	var generation uint64
+	q := "SELECT generation FROM inodes WHERE inode = $1"
+	if err := db.QueryRowContext(ctx, q, n.Inode).Scan(&generation); err != nil {
+		return errors.Wrapf(err, "failed to read the generation of inode %d", n.Inode)
+	}
+	key := fmt.Sprintf("inode-%d-%d", n.Inode, time.Now().UnixNano())
+	pr, pw := io.Pipe()
+	// Keep the hash of the contents, which can no longer be computed from
+	// the data blocks once they are removed.
+	w, sum := hashingWriter(pw)
+	go func() {
+		pw.CloseWithError(CopyData(ctx, db, n, w))
+	}()
+	if err := store.Put(ctx, key, pr, int64(n.Size)); err != nil {
+		_ = pr.CloseWithError(err)
+		return errors.Wrapf(err, "failed to upload inode %d", n.Inode)
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	err = tierFileTx(ctx, tx, n, generation, key)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		_ = tx.Rollback()
+	}
+	if err != nil {
+		if derr := store.Delete(ctx, key); derr != nil {
+			log.Printf("failed to delete object %s: %s\n", key, derr)
+		}
+		return err
+	}
+	if db.fileHashesEnabled {
+		if _, err := putFileHash(ctx, db, n, sum()); err != nil {
+			log.Printf("failed to keep the hash of inode %d: %s\n", n.Inode, err)
+		}
+	}
+	return nil
+}
+
+// tierFileTx replaces the contents of `n` with the object `key`, unless the
+// file changed since its contents were read at `generation`.
+func tierFileTx(ctx context.Context, tx *fsTx, n *FileNode, generation uint64, key string) error {
+	var size, current uint64
+	var mtime time.Time
+	q1 := "SELECT size, mtime, generation FROM inodes WHERE inode = $1"
+	if err := tx.QueryRowContext(ctx, q1, n.Inode).Scan(&size, &mtime, &current); err != nil {
+		return errors.Wrapf(err, "failed to read inode %d", n.Inode)
+	}
+	if size != n.Size || !mtime.Equal(n.Mtime) || current != generation {
+		return errors.Errorf("inode %d was modified while tiering", n.Inode)
+	}
+	q2 := "INSERT INTO tiered_files (inode, object, size) VALUES ($1, $2, $3)"
+	if _, err := tx.ExecContext(ctx, q2, n.Inode, key, n.Size); err != nil {
+		return err
+	}
+	if tx.inlineDataSize > 0 {
+		if err := removeInlineData(ctx, tx, n.Inode); err != nil {
+			return err
+		}
+	}
+	q3 := "DELETE FROM data_blocks WHERE inode = $1"
+	if _, err := tx.ExecContext(ctx, q3, n.Inode); err != nil {
+		return errors.Wrapf(err, "failed to remove data blocks of inode %d", n.Inode)
+	}
+	return nil
+}
+
+// Number of blocks in the chunks in which tiered files are copied back.
+const recallChunkBlocks = 256
+
+// RecallFile copies the contents of the tiered file `n` back into the
+// database, before it is modified. Each chunk is written in a transaction
+// that checks that the file is still tiered, and only fills what its blocks
+// are missing, so that concurrent recalls of the file agree; the last one
+// also forgets the object.
+func RecallFile(ctx context.Context, db *DB, store objectStore, n *FileNode, t tieredObject) error {
+	chunkSize := recallChunkBlocks * db.BlockSize
+	for offset := int64(0); ; offset += chunkSize {
+		var data []byte
+		if offset < int64(t.Size) {
+			var err error
+			if data, err = store.GetRange(ctx, t.Object, offset, chunkSize); err != nil {
+				return errors.Wrapf(err, "failed to download inode %d", n.Inode)
+			}
+		}
+		last := offset+chunkSize >= int64(t.Size)
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err != nil {
+			return err
+		}
+		tiered, err := recallChunkTx(ctx, tx, t, offset, data, last)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			_ = tx.Rollback()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to recall inode %d", n.Inode)
+		}
+		if !tiered || last {
+			break
+		}
+	}
+	return store.Delete(ctx, t.Object)
+}
+
+// recallChunkTx writes the blocks of `data`, the contents of the tiered file
+// `t` at `offset`, that the file does not have, and forgets the object if
+// `last`. It returns false if the file is no longer tiered.
+func recallChunkTx(ctx context.Context, tx *fsTx, t tieredObject, offset int64, data []byte, last bool) (bool, error) {
+	var size uint64
+	q1 := `SELECT inodes.size FROM tiered_files JOIN inodes ON inodes.inode = tiered_files.inode
+  WHERE tiered_files.inode = $1 AND tiered_files.object = $2`
+	err := tx.QueryRowContext(ctx, q1, t.Inode, t.Object).Scan(&size)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Bytes past the current size were truncated away.
+	if end := int64(size) - offset; end < int64(len(data)) {
+		if end < 0 {
+			end = 0
+		}
+		data = data[:end]
+	}
+	// Blocks written since the file was tiered override the object.
+	first := offset / tx.BlockSize
+	count := (int64(len(data)) + tx.BlockSize - 1) / tx.BlockSize
+	existing := make(map[int64][]byte)
+	q2 := "SELECT sequence, data FROM data_blocks WHERE inode = $1 AND sequence > $2 AND sequence <= $3"
+	rows, err := tx.QueryContext(ctx, q2, t.Inode, first, first+count)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var sequence int64
+		var block []byte
+		if err := rows.Scan(&sequence, &block); err != nil {
+			rows.Close()
+			return false, err
+		}
+		existing[sequence-1] = block
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	q3 := "UPSERT INTO data_blocks (inode, sequence, data) VALUES ($1, $2, $3)"
+	for i := first; i < first+count; i++ {
+		start := (i - first) * tx.BlockSize
+		end := start + tx.BlockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		block, ok := existing[i]
+		if ok && int64(len(block)) >= end-start {
+			continue
+		}
+		merged := append([]byte(nil), data[start:end]...)
+		copy(merged, block)
+		if _, err := tx.ExecContext(ctx, q3, t.Inode, i+1, merged); err != nil {
+			return false, err
+		}
+	}
+	if last {
+		q4 := "DELETE FROM tiered_files WHERE inode = $1 AND object = $2"
+		if _, err := tx.ExecContext(ctx, q4, t.Inode, t.Object); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// readTieredBlocks fills the blocks [first, first+count) of `inode` that are
+// missing from `blocks` from the object holding its contents, if the file
+// is tiered.
+func readTieredBlocks(ctx context.Context, db *DB, inode uint64, first, count int64, blocks map[int64][]byte) error {
+	if !db.tieringEnabled || int64(len(blocks)) == count {
+		return nil
+	}
+	t, err := GetTieredObject(ctx, db, inode)
+	if err == sql.ErrNoRows {
+		return nil // A sparse file.
+	}
+	if err != nil {
+		return err
+	}
+	// The file may have been extended since it was tiered.
+	if first*db.BlockSize >= int64(t.Size) {
+		return nil
+	}
+	if db.tierStore == nil {
+		return errNoTierStore(inode)
+	}
+	data, err := db.tierStore.GetRange(ctx, t.Object, first*db.BlockSize, count*db.BlockSize)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read inode %d from the object store", inode)
+	}
+	for i := first; i < first+count; i++ {
+		start := (i - first) * db.BlockSize
+		if _, ok := blocks[i]; ok || start >= int64(len(data)) {
+			continue
+		}
+		end := start + db.BlockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		blocks[i] = data[start:end]
+	}
+	return nil
+}
+
+// recallTiered copies the contents of `n` back into the database if it is
+// tiered, so that it can be modified. Every write and truncation of the
+// contents of a file goes through it.
+func recallTiered(ctx context.Context, db *DB, n *FileNode) error {
+	if !db.tieringEnabled {
+		return nil
+	}
+	t, err := GetTieredObject(ctx, db, n.Inode)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if db.tierStore == nil {
+		return errNoTierStore(n.Inode)
+	}
+	log.Printf("Recalling inode %d from the object store.\n", n.Inode)
+	return RecallFile(ctx, db, db.tierStore, n, t)
+}
@@ -0,0 +1,101 @@
+package store
+
+import "os"
+
+// File type and permission bits of st_mode, see stat(2). os.FileMode uses its
+// own layout, so modes are converted when talking to network protocols that
+// use the Unix one.
+const (
+	unixIFMT   = 0170000
+	unixIFSOCK = 0140000
+	unixIFLNK  = 0120000
+	unixIFREG  = 0100000
+	unixIFBLK  = 0060000
+	unixIFDIR  = 0040000
+	unixIFCHR  = 0020000
+	unixIFIFO  = 0010000
+
+	unixISUID = 04000
+	unixISGID = 02000
+	unixISVTX = 01000
+)
+
+// unixMode converts `m` to a Unix st_mode.
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m&os.ModeDir != 0:
+		mode |= unixIFDIR
+	case m&os.ModeSymlink != 0:
+		mode |= unixIFLNK
+	case m&os.ModeNamedPipe != 0:
+		mode |= unixIFIFO
+	case m&os.ModeSocket != 0:
+		mode |= unixIFSOCK
+	case m&os.ModeCharDevice != 0:
+		mode |= unixIFCHR
+	case m&os.ModeDevice != 0:
+		mode |= unixIFBLK
+	default:
+		mode |= unixIFREG
+	}
+	if m&os.ModeSetuid != 0 {
+		mode |= unixISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= unixISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= unixISVTX
+	}
+	return mode
+}
+
+// fileModeFromUnix converts the Unix st_mode `mode` to an os.FileMode.
+func fileModeFromUnix(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & unixIFMT {
+	case unixIFDIR:
+		m |= os.ModeDir
+	case unixIFLNK:
+		m |= os.ModeSymlink
+	case unixIFIFO:
+		m |= os.ModeNamedPipe
+	case unixIFSOCK:
+		m |= os.ModeSocket
+	case unixIFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case unixIFBLK:
+		m |= os.ModeDevice
+	}
+	if mode&unixISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&unixISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&unixISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// lsMode formats `m` like the first column of `ls -l`.
+func lsMode(m os.FileMode) string {
+	t := byte('-')
+	switch {
+	case m&os.ModeDir != 0:
+		t = 'd'
+	case m&os.ModeSymlink != 0:
+		t = 'l'
+	case m&os.ModeNamedPipe != 0:
+		t = 'p'
+	case m&os.ModeSocket != 0:
+		t = 's'
+	case m&os.ModeCharDevice != 0:
+		t = 'c'
+	case m&os.ModeDevice != 0:
+		t = 'b'
+	}
+	return string(t) + m.Perm().String()[1:]
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// How long the stored size of an inode is cached. Changes made through
+	// this mount invalidate it right away.
+	usageCacheTTL = 5 * time.Second
+	// Number of inodes above which expired entries are dropped.
+	usageCacheSize = 10000
+)
+
+// usageCache caches the number of bytes actually stored for each inode,
+// which is reported as the number of blocks in Attr. Holes take no space,
+// so this can be much less than the file size.
+type usageCache struct {
+	mu      sync.Mutex
+	entries map[uint64]cachedUsage
+}
+
+type cachedUsage struct {
+	bytes   uint64
+	expires time.Time
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{entries: make(map[uint64]cachedUsage)}
+}
+
+// Get returns the cached stored size of `inode`, if any.
+func (c *usageCache) Get(inode uint64) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[inode]
+	if !ok || time.Now().After(e.expires) {
+		return 0, false
+	}
+	return e.bytes, true
+}
+
+// Put caches the stored size of `inode`.
+func (c *usageCache) Put(inode uint64, bytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= usageCacheSize {
+		for i, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, i)
+			}
+		}
+	}
+	c.entries[inode] = cachedUsage{bytes: bytes, expires: now.Add(usageCacheTTL)}
+}
+
+// Invalidate drops the cached stored size of `inode`.
+func (c *usageCache) Invalidate(inode uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, inode)
+}
+
+// storedBytes returns the number of bytes stored in the data blocks of `n`.
+func (fs fileSystem) storedBytes(ctx context.Context, n *FileNode) (uint64, error) {
+	if !n.IsRegular() {
+		return 0, nil
+	}
+	if fs.usage != nil {
+		if bytes, ok := fs.usage.Get(n.Inode); ok {
+			return bytes, nil
+		}
+	}
+	bytes, err := StoredBytes(ctx, fs.db, n.Inode)
+	if err != nil {
+		return 0, err
+	}
+	if fs.usage != nil {
+		fs.usage.Put(n.Inode, bytes)
+	}
+	return bytes, nil
+}
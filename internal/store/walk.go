@@ -0,0 +1,28 @@
+package store
+
+import (
+	"context"
+	"path"
+)
+
+// WalkTree calls `fn` for every node below the directory `dir`, in depth
+// first order. `dirPath` is the path of `dir`, and the path passed to `fn`
+// is relative to it.
+func WalkTree(ctx context.Context, db *DB, dir *FileNode, dirPath string, fn func(p string, n *FileNode) error) error {
+	nodes, err := ListNodesInDir(ctx, db, dir.Inode)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		p := path.Join(dirPath, n.Name)
+		if err := fn(p, n); err != nil {
+			return err
+		}
+		if n.IsDirectory() {
+			if err := WalkTree(ctx, db, n, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Number of blocks read per query while warming up.
+const warmupChunkBlocks = 64
+
+// warmer fills the caches of a mount with a hot set.
+type warmer struct {
+	fs fileSystem
+	// How long the preloaded attributes are kept.
+	attrTTL time.Duration
+	// Bytes the block cache can hold.
+	budget int64
+
+	listed  map[uint64]bool // Directories whose attributes were preloaded.
+	entries int
+	warmed  int64
+}
+
+// warmUp fills the caches after the file system is mounted, so that the
+// first accesses to a known hot set do not all go to cold caches. The hot
+// set consists of the inodes of the heat map `hot`, most accessed first,
+// and of the trees at `paths`. The attributes of the entries of their
+// directories are preloaded into the attribute cache, where they are kept
+// for `attrTTL` unless they change through the mount, and the contents of
+// their regular files are read into the block cache until it is full.
+func (fs fileSystem) warmUp(ctx context.Context, paths []string, hot []uint64, attrTTL time.Duration) error {
+	start := time.Now()
+	w := &warmer{fs: fs, attrTTL: attrTTL, listed: make(map[uint64]bool)}
+	if fs.blocks != nil {
+		w.budget = fs.blocks.Stats().Capacity
+	}
+	for _, inode := range hot {
+		if err := w.warmInode(ctx, inode); err != nil {
+			return err
+		}
+	}
+	for _, p := range paths {
+		if err := w.warmPath(ctx, p); err != nil {
+			return err
+		}
+	}
+	log.Printf("Warmed up %d entries and %s of data in %s.\n",
+		w.entries, HumanBytes(uint64(w.warmed)), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// warmInode warms up the inode `inode` of the heat map, along with the
+// entries of its directory.
+func (w *warmer) warmInode(ctx context.Context, inode uint64) error {
+	n, err := GetNodeByID(ctx, w.fs.db, inode)
+	if err == sql.ErrNoRows {
+		return nil // Removed since the heat map was recorded.
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read inode %d", inode)
+	}
+	if n.IsDirectory() {
+		return w.listParent(ctx, inode)
+	}
+	parent, err := GetParentInode(ctx, w.fs.db, inode)
+	if err == sql.ErrNoRows {
+		return nil // Unlinked since the heat map was recorded.
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the parent of inode %d", inode)
+	}
+	if err := w.listParent(ctx, parent); err != nil {
+		return err
+	}
+	return w.readFile(ctx, n)
+}
+
+// warmPath warms up the tree at `p`, directory by directory.
+func (w *warmer) warmPath(ctx context.Context, p string) error {
+	n, err := ResolvePath(ctx, w.fs.db, p)
+	if errors.Cause(err) == sql.ErrNoRows {
+		log.Printf("Not warming up %s: %s\n", p, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n.Parent != 0 {
+		if err := w.listParent(ctx, n.Parent); err != nil {
+			return err
+		}
+	}
+	if !n.IsDirectory() {
+		return w.readFile(ctx, n)
+	}
+	dirs := []uint64{n.Inode}
+	for len(dirs) > 0 {
+		entries, err := w.listDir(ctx, dirs[0])
+		if err != nil {
+			return err
+		}
+		dirs = dirs[1:]
+		for i := range entries {
+			n := &entries[i].node
+			if n.IsDirectory() {
+				dirs = append(dirs, n.Inode)
+			} else if err := w.readFile(ctx, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listParent preloads the attributes of the entries of the directory
+// `dir`, containing an entry of the hot set, unless it was listed already.
+func (w *warmer) listParent(ctx context.Context, dir uint64) error {
+	if w.listed[dir] {
+		return nil
+	}
+	_, err := w.listDir(ctx, dir)
+	return err
+}
+
+// listDir returns the entries of the directory `dir`, and preloads their
+// attributes unless the attribute cache is full.
+func (w *warmer) listDir(ctx context.Context, dir uint64) ([]dirAttrs, error) {
+	w.listed[dir] = true
+	entries, err := ListDirAttrs(ctx, w.fs.db, dir, w.fs.dirOrder)
+	if err != nil {
+		return nil, err
+	}
+	w.entries += len(entries)
+	if w.fs.attrs != nil && w.fs.attrs.Len()+len(entries) <= attrCacheSize {
+		w.fs.attrs.PutFor(dir, entries, w.attrTTL)
+	}
+	return entries, nil
+}
+
+// readFile reads the contents of `n` into the block cache, if it is a
+// regular file and the cache is not full yet.
+func (w *warmer) readFile(ctx context.Context, n *FileNode) error {
+	if !n.IsRegular() {
+		return nil
+	}
+	for first := int64(0); first*w.fs.db.BlockSize < int64(n.Size) && w.warmed < w.budget; first += warmupChunkBlocks {
+		blocks, err := w.fs.readBlocks(ctx, n.Inode, first, warmupChunkBlocks)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read inode %d", n.Inode)
+		}
+		for _, b := range blocks {
+			w.warmed += int64(len(b))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/pkg/errors"
+)
+
+// Limits of extended attributes, as on Linux.
+const (
+	maxXattrName  = 255
+	maxXattrValue = 64 << 10
+)
+
+// Flags of setxattr(2), which have different values on macOS.
+var xattrCreate, xattrReplace uint32 = 1, 2
+
+func init() {
+	if runtime.GOOS == "darwin" {
+		xattrCreate, xattrReplace = 2, 4
+	}
+}
+
+// selinuxXattr holds the SELinux security context of a node. Other
+// security.* attributes, such as security.capability or security.ima, are
+// stored like any other.
+const selinuxXattr = "security.selinux"
+
+var (
+	errXattrExists = errors.New("extended attribute already exists")
+	errNoXattr     = errors.New("no such extended attribute")
+)
+
+// GetXattr returns the value of the extended attribute `name` of `inode`,
+// or sql.ErrNoRows if it is not set.
+func GetXattr(ctx context.Context, db *DB, inode uint64, name string) ([]byte, error) {
+	var value []byte
+	q := "SELECT value FROM xattrs WHERE inode = $1 AND name = $2"
+	err := db.QueryRowContext(ctx, q, inode, name).Scan(&value)
+	return value, err
+}
+
+// ListXattrs returns the names of the extended attributes of `inode`.
+func ListXattrs(ctx context.Context, db *DB, inode uint64) ([]string, error) {
+	q := "SELECT name FROM xattrs WHERE inode = $1 ORDER BY name"
+	rows, err := db.QueryContext(ctx, q, inode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list extended attributes of inode %d", inode)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// SetXattr sets the extended attribute `name` of `inode` to `value`. With
+// xattrCreate in `flags`, it fails with errXattrExists if the attribute is
+// already set, and with xattrReplace, with errNoXattr if it is not.
+func SetXattr(ctx context.Context, db *DB, inode uint64, name string, value []byte, flags uint32) error {
+	var q string
+	switch {
+	case flags&xattrCreate != 0:
+		q = "INSERT INTO xattrs (inode, name, value) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	case flags&xattrReplace != 0:
+		q = "UPDATE xattrs SET value = $3 WHERE inode = $1 AND name = $2"
+	default:
+		q = "UPSERT INTO xattrs (inode, name, value) VALUES ($1, $2, $3)"
+	}
+	res, err := db.ExecContext(ctx, q, inode, name, value)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set extended attribute %q of inode %d", name, inode)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 && flags&xattrCreate != 0 {
+		return errXattrExists
+	}
+	if count == 0 {
+		return errNoXattr
+	}
+	return nil
+}
+
+// RemoveXattr removes the extended attribute `name` of `inode`, and fails
+// with errNoXattr if it is not set.
+func RemoveXattr(ctx context.Context, db *DB, inode uint64, name string) error {
+	q := "DELETE FROM xattrs WHERE inode = $1 AND name = $2"
+	res, err := db.ExecContext(ctx, q, inode, name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove extended attribute %q of inode %d", name, inode)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNoXattr
+	}
+	return nil
+}
+
+// removeXattrs deletes the extended attributes of the deleted `inode`.
+func removeXattrs(ctx context.Context, tx *fsTx, inode uint64) error {
+	if !tx.XattrsEnabled {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM xattrs WHERE inode = $1", inode)
+	return err
+}
+
+// xattrError converts the errors of the functions above to the errors
+// expected by the kernel.
+func xattrError(ctx context.Context, err error) error {
+	switch err {
+	case sql.ErrNoRows, errNoXattr:
+		return fuse.ErrNoXattr
+	case errXattrExists:
+		return fuse.Errno(syscall.EEXIST)
+	}
+	log.Println(err)
+	return errnoFromErr(ctx, err)
+}
+
+// checkXattrName returns an error if `name` cannot be used as the name of
+// an extended attribute.
+func checkXattrName(name string) error {
+	if name == "" || len(name) > maxXattrName {
+		return fuse.ERANGE
+	}
+	if strings.IndexByte(name, 0) >= 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return nil
+}
+
+// Getxattr implements the fuseFS.NodeGetxattrer interface.
+func (n *FileNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if req.Name == sha256Xattr {
+		return n.getSHA256(ctx, resp)
+	}
+	if !n.fs.db.XattrsEnabled {
+		return fuse.ENOTSUP
+	}
+	if err := checkXattrName(req.Name); err != nil {
+		return err
+	}
+	if req.Name == selinuxXattr && n.fs.securityLabel != "" {
+		// Contexts are stored with their terminating NUL.
+		resp.Xattr = append([]byte(n.fs.securityLabel), 0)
+		return nil
+	}
+	if _, ok := n.fs.batchedSize(n.Inode); ok {
+		// The kernel checks security.capability before every write, which
+		// must not commit the batch. Batched files have no attributes.
+		return fuse.ErrNoXattr
+	}
+	if req.Name == resourceForkXattr {
+		return n.getResourceFork(ctx, req, resp)
+	}
+	value, err := GetXattr(ctx, n.fs.db, n.Inode, req.Name)
+	if err != nil {
+		return xattrError(ctx, err)
+	}
+	if isACLXattr(req.Name) {
+		if value, err = n.fs.localACL(value); err != nil {
+			log.Println(err)
+			return errnoFromErr(ctx, err)
+		}
+	}
+	resp.Xattr = value
+	return nil
+}
+
+// Listxattr implements the fuseFS.NodeListxattrer interface.
+func (n *FileNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if !n.fs.db.XattrsEnabled {
+		return fuse.ENOTSUP
+	}
+	n.fs.settleCreates(n.Inode)
+	names, err := ListXattrs(ctx, n.fs.db, n.Inode)
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	for _, name := range names {
+		if name != selinuxXattr || n.fs.securityLabel == "" {
+			resp.Append(name)
+		}
+	}
+	if n.fs.securityLabel != "" {
+		resp.Append(selinuxXattr)
+	}
+	return nil
+}
+
+// Setxattr implements the fuseFS.NodeSetxattrer interface.
+func (n *FileNode) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if !n.fs.db.XattrsEnabled {
+		return fuse.ENOTSUP
+	}
+	n.fs.settleCreates(n.Inode)
+	if err := n.fs.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkXattrName(req.Name); err != nil {
+		return err
+	}
+	if len(req.Xattr) > maxXattrValue && req.Name != resourceForkXattr {
+		return fuse.Errno(syscall.E2BIG)
+	}
+	if req.Name == selinuxXattr && n.fs.securityLabel != "" {
+		// As with the context= mount option, relabeling is not supported.
+		return fuse.ENOTSUP
+	}
+	if req.Name == sha256Xattr {
+		return fuse.EPERM
+	}
+	unlock := n.lock()
+	pinned := n.pinned()
+	unlock()
+	if pinned {
+		return fuse.EPERM
+	}
+	if isACLXattr(req.Name) {
+		return n.setACLXattr(ctx, req)
+	}
+	if req.Name == finderInfoXattr || req.Name == resourceForkXattr {
+		return n.setAppleXattr(ctx, req)
+	}
+	if req.Name == policyXattr {
+		if !n.IsDirectory() {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		if _, err := ParsePolicy(string(req.Xattr)); err != nil {
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+	if err := SetXattr(ctx, n.fs.db, n.Inode, req.Name, req.Xattr, req.Flags); err != nil {
+		return xattrError(ctx, err)
+	}
+	return nil
+}
+
+// Removexattr implements the fuseFS.NodeRemovexattrer interface.
+func (n *FileNode) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if !n.fs.db.XattrsEnabled {
+		return fuse.ENOTSUP
+	}
+	n.fs.settleCreates(n.Inode)
+	if err := n.fs.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkXattrName(req.Name); err != nil {
+		return err
+	}
+	if req.Name == selinuxXattr && n.fs.securityLabel != "" {
+		return fuse.ENOTSUP
+	}
+	if req.Name == sha256Xattr {
+		return fuse.EPERM
+	}
+	unlock := n.lock()
+	pinned := n.pinned()
+	unlock()
+	if pinned {
+		return fuse.EPERM
+	}
+	if isACLXattr(req.Name) && !n.ownedBy(&req.Header) {
+		return fuse.EPERM
+	}
+	if err := RemoveXattr(ctx, n.fs.db, n.Inode, req.Name); err != nil {
+		return xattrError(ctx, err)
+	}
+	return nil
+}
+
+// getSHA256 returns the SHA-256 of the contents of the file, in hex, once
+// the writes made through the mount are committed.
+func (n *FileNode) getSHA256(ctx context.Context, resp *fuse.GetxattrResponse) error {
+	n.fs.settleCreates(n.Inode)
+	n.fs.waitWrites(n.Inode)
+	sum, err := FileHash(ctx, n.fs.db, n.Inode)
+	if err == ErrHashUnavailable {
+		return fuse.ErrNoXattr
+	}
+	if err != nil {
+		log.Println(err)
+		return errnoFromErr(ctx, err)
+	}
+	resp.Xattr = []byte(hex.EncodeToString(sum))
+	return nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// xdrReader decodes XDR data as used by ONC RPC, see RFC 4506. Decoding
+// errors are sticky and reported through err.
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *xdrReader) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// fixed reads fixed length opaque data of `n` bytes.
+func (r *xdrReader) fixed(n int) []byte {
+	padded := (n + 3) &^ 3
+	if r.err != nil || len(r.b) < padded {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[padded:]
+	return v
+}
+
+// opaque reads variable length opaque data of at most `max` bytes.
+func (r *xdrReader) opaque(max int) []byte {
+	n := r.uint32()
+	if r.err == nil && n > uint32(max) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return nil
+	}
+	return r.fixed(int(n))
+}
+
+func (r *xdrReader) string(max int) string {
+	return string(r.opaque(max))
+}
+
+// xdrWriter encodes XDR data.
+type xdrWriter struct {
+	b []byte
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	w.uint32(uint32(v >> 32))
+	w.uint32(uint32(v))
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) fixed(v []byte) {
+	w.b = append(w.b, v...)
+	if pad := (4 - len(v)%4) % 4; pad > 0 {
+		w.b = append(w.b, make([]byte, pad)...)
+	}
+}
+
+func (w *xdrWriter) opaque(v []byte) {
+	w.uint32(uint32(len(v)))
+	w.fixed(v)
+}
+
+func (w *xdrWriter) string(v string) {
+	w.opaque([]byte(v))
+}
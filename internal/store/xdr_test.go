@@ -0,0 +1,74 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestXDRRoundTrip(t *testing.T) {
+	var w xdrWriter
+	w.uint32(0xdeadbeef)
+	w.uint64(1<<40 | 7)
+	w.bool(true)
+	w.bool(false)
+	w.opaque([]byte{1, 2, 3, 4, 5})
+	w.string("")
+	w.string("abc")
+	w.fixed([]byte{9, 9})
+
+	// Opaque data and strings are padded to four bytes.
+	if len(w.b) != 4+8+4+4+(4+8)+4+(4+4)+4 {
+		t.Fatalf("encoded %d bytes: % x", len(w.b), w.b)
+	}
+	r := &xdrReader{b: w.b}
+	if v := r.uint32(); v != 0xdeadbeef {
+		t.Errorf("uint32 = %#x", v)
+	}
+	if v := r.uint64(); v != 1<<40|7 {
+		t.Errorf("uint64 = %#x", v)
+	}
+	if !r.bool() || r.bool() {
+		t.Error("bools did not round trip")
+	}
+	if v := r.opaque(5); !bytes.Equal(v, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("opaque = %v", v)
+	}
+	if v := r.string(10); v != "" {
+		t.Errorf("empty string = %q", v)
+	}
+	if v := r.string(3); v != "abc" {
+		t.Errorf("string = %q", v)
+	}
+	if v := r.fixed(2); !bytes.Equal(v, []byte{9, 9}) {
+		t.Errorf("fixed = %v", v)
+	}
+	if r.err != nil || len(r.b) != 0 {
+		t.Errorf("decoding left %d bytes and error %v", len(r.b), r.err)
+	}
+}
+
+func TestXDRErrors(t *testing.T) {
+	var w xdrWriter
+	w.string("too long")
+	w.uint32(1)
+	for _, tc := range []struct {
+		name   string
+		decode func(r *xdrReader)
+	}{
+		{"over the maximum", func(r *xdrReader) { r.string(4) }},
+		{"short", func(r *xdrReader) { r.b = r.b[:6]; r.opaque(64) }},
+		{"missing padding", func(r *xdrReader) { r.b = r.b[:11]; r.opaque(64) }},
+		{"short integer", func(r *xdrReader) { r.b = r.b[:3]; r.uint32() }},
+	} {
+		r := &xdrReader{b: w.b}
+		tc.decode(r)
+		if r.err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: error = %v", tc.name, r.err)
+		}
+		// Errors are sticky.
+		if r.uint32(); r.err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: error after the next read = %v", tc.name, r.err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package sqlfs
+
+import (
+	"context"
+	"database/sql"
+	iofs "io/fs"
+
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+// TreeFS gives access to the tree stored in a database without mounting
+// it, e.g. to serve it with http.FileServer(http.FS(t)). It implements
+// io/fs.FS, ReadDirFS, ReadFileFS and StatFS, and the write methods of
+// os: WriteFile, Mkdir, MkdirAll, Remove and Rename.
+//
+// Contents of files moved to an object store by `sqlfs tier` are not
+// readable through a TreeFS. Writes fail with EROFS if the file system uses
+// features this binary can only read.
+type TreeFS struct {
+	t *store.TreeFS
+}
+
+var (
+	_ iofs.ReadDirFS  = (*TreeFS)(nil)
+	_ iofs.ReadFileFS = (*TreeFS)(nil)
+	_ iofs.StatFS     = (*TreeFS)(nil)
+)
+
+// NewTreeFS returns the tree stored in `db` from the directory `root` on.
+func NewTreeFS(db *sql.DB, root string) (*TreeFS, error) {
+	t, err := store.NewTreeFS(db, root)
+	if err != nil {
+		return nil, err
+	}
+	return &TreeFS{t: t}, nil
+}
+
+// WithContext returns a TreeFS whose queries use `ctx`.
+func (t *TreeFS) WithContext(ctx context.Context) *TreeFS {
+	return &TreeFS{t: t.t.WithContext(ctx)}
+}
+
+// Open implements fs.FS.
+func (t *TreeFS) Open(name string) (iofs.File, error) { return t.t.Open(name) }
+
+// Stat implements fs.StatFS.
+func (t *TreeFS) Stat(name string) (iofs.FileInfo, error) { return t.t.Stat(name) }
+
+// ReadDir implements fs.ReadDirFS. Entries are sorted by name.
+func (t *TreeFS) ReadDir(name string) ([]iofs.DirEntry, error) { return t.t.ReadDir(name) }
+
+// ReadFile implements fs.ReadFileFS.
+func (t *TreeFS) ReadFile(name string) ([]byte, error) { return t.t.ReadFile(name) }
+
+// WriteFile writes `data` to the file `name`, creating it with the
+// permissions `perm` if needed, as os.WriteFile does.
+func (t *TreeFS) WriteFile(name string, data []byte, perm iofs.FileMode) error {
+	return t.t.WriteFile(name, data, perm)
+}
+
+// Mkdir creates the directory `name`, as os.Mkdir does.
+func (t *TreeFS) Mkdir(name string, perm iofs.FileMode) error { return t.t.Mkdir(name, perm) }
+
+// MkdirAll creates the directory `name` and its missing parents, as
+// os.MkdirAll does.
+func (t *TreeFS) MkdirAll(name string, perm iofs.FileMode) error { return t.t.MkdirAll(name, perm) }
+
+// Remove removes the file or empty directory `name`, as os.Remove does.
+func (t *TreeFS) Remove(name string) error { return t.t.Remove(name) }
+
+// Rename moves `oldname` to `newname`, replacing it if it exists, as
+// os.Rename does.
+func (t *TreeFS) Rename(oldname, newname string) error { return t.t.Rename(oldname, newname) }
@@ -0,0 +1,352 @@
+// Package sqlfs implements a POSIX-style file system stored in a SQL
+// database and served with FUSE.
+//
+// Programs can embed the file system with New and Mount:
+//
+//	db, err := sql.Open("postgres", "postgres://roacher@localhost:26257/sqlfs?sslmode=disable")
+//	...
+//	fsys, err := sqlfs.New(db, sqlfs.WithFastLookup())
+//	...
+//	defer fsys.Close()
+//	err = fsys.Mount("/mnt/sqlfs") // Returns once unmounted.
+//
+// NewTreeFS gives access to the stored tree without mounting it. The
+// sqlfs command offers the administration of file systems, e.g. `sqlfs
+// fsck` and `sqlfs backup`, which this package does not.
+//
+// Each FS keeps the settings of its file system, such as its block size, so
+// a process can serve several file systems at once.
+package sqlfs
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/imjching/sql-fs/internal/store"
+)
+
+// FS is a file system stored in a database.
+type FS struct {
+	f *store.FS
+}
+
+// Option configures an FS created with New.
+type Option store.Option
+
+// New returns the file system stored in `db`, whose tables must have been
+// created with `sqlfs init` or CreateSchema. Its background work, such as
+// warming up its caches, starts right away and runs until it is closed.
+func New(db *sql.DB, opts ...Option) (*FS, error) {
+	storeOpts := make([]store.Option, len(opts))
+	for i, o := range opts {
+		storeOpts[i] = store.Option(o)
+	}
+	f, err := store.New(db, storeOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{f: f}, nil
+}
+
+// CreateSchema creates all tables needed by the file system if they do not
+// exist yet, and writes the superblock.
+func CreateSchema(ctx context.Context, db *sql.DB) error {
+	return store.CreateSchema(ctx, db)
+}
+
+// Mount mounts the file system at `mountpoint` and serves it until it is
+// unmounted, e.g. with Unmount.
+func (f *FS) Mount(mountpoint string) error {
+	return f.f.Mount(mountpoint)
+}
+
+// Serve is Mount, calling `onReady` with the outcome of mounting once the
+// kernel completed it.
+func (f *FS) Serve(mountpoint string, onReady func(error)) error {
+	return f.f.Serve(mountpoint, onReady)
+}
+
+// Unmount waits up to `timeout` for the operations in flight, writes the
+// pending updates to the database and unmounts the file system mounted at
+// `mountpoint`.
+func (f *FS) Unmount(mountpoint string, timeout time.Duration) error {
+	return f.f.Unmount(mountpoint, timeout)
+}
+
+// Close writes the pending updates to the database and stops the
+// background work of the file system. It does not close the database.
+func (f *FS) Close() error {
+	return f.f.Close()
+}
+
+// WithSubdir exposes the directory at `path` in the tree as the root of the
+// mount instead of the root directory.
+func WithSubdir(path string) Option {
+	return Option(store.WithSubdir(path))
+}
+
+// WithAtimeMode sets how access times are updated: "strict", "relatime"
+// (the default) or "noatime".
+func WithAtimeMode(mode string) Option {
+	return Option(store.WithAtimeMode(mode))
+}
+
+// WithFastLookup prefetches whole directories into an entry cache on
+// lookups.
+func WithFastLookup() Option {
+	return Option(store.WithFastLookup())
+}
+
+// WithAttrPrefetch loads the attributes of all entries of a directory when
+// it is listed, and serves the lookups and attributes of its entries from
+// them for a moment.
+func WithAttrPrefetch() Option {
+	return Option(store.WithAttrPrefetch())
+}
+
+// WithNegativeCache remembers names found missing for `ttl`, unless they are
+// created through the file system.
+func WithNegativeCache(ttl time.Duration) Option {
+	return Option(store.WithNegativeCache(ttl))
+}
+
+// WithCreateBatching keeps the small files created through the file system
+// in memory for up to `window`, and commits them together.
+func WithCreateBatching(window time.Duration) Option {
+	return Option(store.WithCreateBatching(window))
+}
+
+// WithAppendCoalescing keeps the small writes made at the end of files in
+// memory until they fill a block, for up to a second. It has no effect on
+// the files written asynchronously, whose appends are merged anyway.
+// Committing them fails once it takes longer than the operation timeout,
+// and the failure is reported by the next fsync(2) or close(2).
+func WithAppendCoalescing() Option {
+	return Option(store.WithAppendCoalescing())
+}
+
+// WithDirOrder sets the order in which directories are listed: "name" (the
+// default) or "inode".
+func WithDirOrder(order string) Option {
+	return Option(store.WithDirOrder(order))
+}
+
+// WithBlockCache caches data blocks in up to `size` bytes of memory.
+func WithBlockCache(size int64) Option {
+	return Option(store.WithBlockCache(size))
+}
+
+// WithOpTimeout fails file system operations with EIO if they take longer
+// than `timeout`, 30s by default. Zero disables the timeout.
+func WithOpTimeout(timeout time.Duration) Option {
+	return Option(store.WithOpTimeout(timeout))
+}
+
+// WithRateLimits delays FUSE operations beyond `ops` per second, reads and
+// writes beyond `bytes` per second, and the operations of each user beyond
+// `uidOps` per second. Zero disables a limit.
+func WithRateLimits(ops float64, bytes int64, uidOps float64) Option {
+	return Option(store.WithRateLimits(ops, bytes, uidOps))
+}
+
+// WithReadOnly mounts the file system read-only. Access times are then
+// not updated.
+func WithReadOnly() Option {
+	return Option(store.WithReadOnly())
+}
+
+// WithMountOptions passes FUSE mount options to the kernel, e.g.
+// fuse.AllowOther().
+func WithMountOptions(options ...fuse.MountOption) Option {
+	return Option(store.WithMountOptions(options...))
+}
+
+// WithReadahead prefetches up to `blocks` data blocks for sequential reads.
+func WithReadahead(blocks int) Option {
+	return Option(store.WithReadahead(blocks))
+}
+
+// WithDirectIO bypasses the kernel page cache, so that reads see the writes
+// of other mounts right away.
+func WithDirectIO() Option {
+	return Option(store.WithDirectIO())
+}
+
+// WithMaxNameLen sets the longest file name accepted, in bytes.
+func WithMaxNameLen(n int) Option {
+	return Option(store.WithMaxNameLen(n))
+}
+
+// WithMaxPathLen sets the longest path accepted when creating or renaming,
+// in bytes. Checking it costs a query.
+func WithMaxPathLen(n int) Option {
+	return Option(store.WithMaxPathLen(n))
+}
+
+// WithUIDMap presents stored user IDs as other IDs, and stores them back on
+// chown and create, according to the comma-separated STORED:LOCAL[:COUNT]
+// ranges of `mapping`.
+func WithUIDMap(mapping string) Option {
+	return Option(store.WithUIDMap(mapping))
+}
+
+// WithGIDMap is WithUIDMap for group IDs.
+func WithGIDMap(mapping string) Option {
+	return Option(store.WithGIDMap(mapping))
+}
+
+// WithIDMapFile adds the ID mappings of the file at `path`, with lines such
+// as `u 1000 2000 1`.
+func WithIDMapFile(path string) Option {
+	return Option(store.WithIDMapFile(path))
+}
+
+// WithFileMode gives the files created through the mount the permissions
+// `perm` instead of the ones requested.
+func WithFileMode(perm os.FileMode) Option {
+	return Option(store.WithFileMode(perm))
+}
+
+// WithDirMode is WithFileMode for directories.
+func WithDirMode(perm os.FileMode) Option {
+	return Option(store.WithDirMode(perm))
+}
+
+// WithUmask clears the permission bits `mask` from every file and directory
+// created through the mount.
+func WithUmask(mask os.FileMode) Option {
+	return Option(store.WithUmask(mask))
+}
+
+// WithSecurityLabel reports the SELinux context `label` for every file
+// instead of the stored security.selinux attributes.
+func WithSecurityLabel(label string) Option {
+	return Option(store.WithSecurityLabel(label))
+}
+
+// WithoutAppleDouble hides AppleDouble (._*) files and refuses to create
+// them, keeping resource forks and Finder info in extended attributes.
+func WithoutAppleDouble() Option {
+	return Option(store.WithoutAppleDouble())
+}
+
+// WithStatusDir exposes the read-only status directory at the root of the
+// mount.
+func WithStatusDir() Option {
+	return Option(store.WithStatusDir())
+}
+
+// WithQueryFile exposes the file at the root of the mount that searches
+// the tree with the predicates of `sqlfs find`.
+func WithQueryFile() Option {
+	return Option(store.WithQueryFile())
+}
+
+// WithSnapshotsDir exposes the snapshots taken with `sqlfs snapshot` in a
+// read-only directory at the root of the mount, reading them through
+// historical connections to the database at `url`. It has no effect if the
+// file system has no snapshots table.
+func WithSnapshotsDir(url string) Option {
+	return Option(store.WithSnapshotsDir(url))
+}
+
+// WithQuiesceTimeout sets how long making the file system read-only through
+// the status directory waits for the operations in flight, 10s by default.
+func WithQuiesceTimeout(timeout time.Duration) Option {
+	return Option(store.WithQuiesceTimeout(timeout))
+}
+
+// WithWarmPaths preloads the attributes below `paths`, relative to the
+// mount root, and fills the block cache with their files once the file
+// system is created.
+func WithWarmPaths(paths ...string) Option {
+	return Option(store.WithWarmPaths(paths...))
+}
+
+// WithHeatMap records the files and directories accessed most in the file
+// at `path`, and preloads those recorded by earlier runs like
+// WithWarmPaths.
+func WithHeatMap(path string) Option {
+	return Option(store.WithHeatMap(path))
+}
+
+// WithWarmAttrTTL sets how long the attributes preloaded by WithWarmPaths
+// and WithHeatMap are kept, 1m by default.
+func WithWarmAttrTTL(ttl time.Duration) Option {
+	return Option(store.WithWarmAttrTTL(ttl))
+}
+
+// WithoutChecksumVerification lets reads return data blocks that do not
+// match their checksum instead of failing with EIO, e.g. to copy what is
+// left of damaged files.
+func WithoutChecksumVerification() Option {
+	return Option(store.WithoutChecksumVerification())
+}
+
+// WithObjectStore reads the files moved by `sqlfs tier` from the object
+// store at `url`, e.g. s3://bucket/prefix, instead of the one recorded.
+func WithObjectStore(url string) Option {
+	return Option(store.WithObjectStore(url))
+}
+
+// WithJournal records every mutating operation in the ops_log table, which
+// `sqlfs init -journal` creates.
+func WithJournal() Option {
+	return Option(store.WithJournal())
+}
+
+// WithContentIndex maintains the full-text index used by `sqlfs search`,
+// which `sqlfs init -content-index` creates.
+func WithContentIndex() Option {
+	return Option(store.WithContentIndex())
+}
+
+// WithWriteLeases takes a lease on each file before writing to it, so that
+// the file systems sharing a database on several hosts take turns.
+func WithWriteLeases() Option {
+	return Option(store.WithWriteLeases())
+}
+
+// WithExclusive fails if another FS holds the file system exclusively, and
+// makes the FSs created later without WithReadOnly fail until this one is
+// closed.
+func WithExclusive() Option {
+	return Option(store.WithExclusive())
+}
+
+// WithLeaseTTL sets how long the leases of WithWriteLeases and
+// WithExclusive, and the leadership of background tasks, outlive a file
+// system that stopped renewing them, 15s by default.
+func WithLeaseTTL(ttl time.Duration) Option {
+	return Option(store.WithLeaseTTL(ttl))
+}
+
+// WithBackgroundGC removes orphaned inodes and data blocks every
+// `interval`, on the one file system elected leader among those sharing
+// the database.
+func WithBackgroundGC(interval time.Duration) Option {
+	return Option(store.WithBackgroundGC(interval))
+}
+
+// WithBackgroundScrub verifies the checksums of all data blocks every
+// `interval` at `rate` blocks per second, on the file system elected
+// leader, as `sqlfs scrub` does. Damaged blocks are repaired from `replica`
+// unless it is nil.
+func WithBackgroundScrub(interval time.Duration, rate float64, replica *sql.DB) Option {
+	return Option(store.WithBackgroundScrub(interval, rate, replica))
+}
+
+// WithAsyncWrites commits writes in the background, queuing up to `size`
+// bytes of data.
+func WithAsyncWrites(size int64) Option {
+	return Option(store.WithAsyncWrites(size))
+}
+
+// WithMaintenancePoll checks every `interval` whether `sqlfs maintenance`
+// made the file system read-only.
+func WithMaintenancePoll(interval time.Duration) Option {
+	return Option(store.WithMaintenancePoll(interval))
+}
@@ -3,7 +3,7 @@ CREATE DATABASE IF NOT EXISTS sqlfs;
 CREATE SEQUENCE IF NOT EXISTS sqlfs.inode_seq START 2;
 
 CREATE TABLE IF NOT EXISTS sqlfs.tree (
-  inode  INT DEFAULT nextval('inode_seq'),
+  inode  INT NOT NULL,
   parent INT NOT NULL,
   name STRING NOT NULL,
   UNIQUE (name, parent),
@@ -11,9 +11,23 @@ CREATE TABLE IF NOT EXISTS sqlfs.tree (
   INDEX parent_idx (parent)
 );
 
+CREATE INDEX IF NOT EXISTS tree_parent_name_idx ON sqlfs.tree (parent, name) STORING (inode);
+
 CREATE TABLE IF NOT EXISTS sqlfs.inodes (
-  inode INT,
-  struct_data STRING,
+  inode          INT,
+  size           INT NOT NULL DEFAULT 0,
+  atime          TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  mtime          TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  ctime          TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  crtime         TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01',
+  mode           INT NOT NULL DEFAULT 0,
+  nlink          INT NOT NULL DEFAULT 0,
+  uid            INT NOT NULL DEFAULT 0,
+  gid            INT NOT NULL DEFAULT 0,
+  rdev           INT NOT NULL DEFAULT 0,
+  flags          INT NOT NULL DEFAULT 0,
+  symlink_target STRING NOT NULL DEFAULT '',
+  generation     INT NOT NULL DEFAULT 0,
   PRIMARY KEY (inode)
 );
 
@@ -24,5 +38,37 @@ CREATE TABLE IF NOT EXISTS sqlfs.data_blocks (
   PRIMARY KEY (inode, sequence)
 );
 
+CREATE TABLE IF NOT EXISTS sqlfs.settings (
+  name  STRING PRIMARY KEY,
+  value STRING NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sqlfs.xattrs (
+  inode INT,
+  name  STRING,
+  value BYTES NOT NULL,
+  PRIMARY KEY (inode, name)
+);
+
+CREATE TABLE IF NOT EXISTS sqlfs.superblock (
+  id                 INT PRIMARY KEY CHECK (id = 1),
+  uuid               UUID NOT NULL,
+  block_size         INT NOT NULL,
+  compat_features    INT NOT NULL DEFAULT 0,
+  ro_compat_features INT NOT NULL DEFAULT 0,
+  incompat_features  INT NOT NULL DEFAULT 0,
+  schema_version     INT NOT NULL,
+  created            TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sqlfs.leases (
+  name    STRING PRIMARY KEY,
+  holder  STRING NOT NULL,
+  expires TIMESTAMPTZ NOT NULL
+);
+
+INSERT INTO sqlfs.superblock (id, uuid, block_size, ro_compat_features, schema_version, created)
+  VALUES (1, gen_random_uuid(), 1024, 1, 1, now()) ON CONFLICT (id) DO NOTHING;
+
 GRANT ALL ON DATABASE sqlfs TO roacher;
 GRANT ALL ON TABLE sqlfs.* TO roacher;
@@ -0,0 +1,143 @@
+#!/bin/sh
+#
+# Mounts a scratch sql-fs file system and checks the behavior of common
+# operations through fusefs, without any CI infrastructure. Written for
+# FreeBSD, where the tools used differ from Linux (getextattr instead of
+# getfattr, stat -f instead of stat -c), but also runs on Linux.
+#
+# Usage: scripts/freebsd-smoke.sh [DB_URL]
+#
+# DB_URL must point to an empty, existing database, e.g.
+# postgresql://root@localhost:26257/sqlfs_smoke?sslmode=disable. The
+# binary is taken from bin/sqlfs, so run `make` first. On FreeBSD, load the
+# kernel module with `kldload fusefs` and run as root or with the
+# vfs.usermount sysctl set to 1.
+
+set -u
+
+db=${1:-postgresql://root@localhost:26257/sqlfs_smoke?sslmode=disable}
+sqlfs=${SQLFS:-$(pwd)/bin/sqlfs}
+mnt=$(mktemp -d -t sqlfs-smoke.XXXXXX)
+os=$(uname -s)
+failures=0
+
+pass() { echo "ok   $1"; }
+fail() { echo "FAIL $1"; failures=$((failures + 1)); }
+
+# check DESCRIPTION COMMAND... runs COMMAND and reports whether it succeeded.
+check() {
+	desc=$1
+	shift
+	if "$@" >/dev/null 2>&1; then pass "$desc"; else fail "$desc"; fi
+}
+
+# check_fails DESCRIPTION COMMAND... expects COMMAND to fail.
+check_fails() {
+	desc=$1
+	shift
+	if "$@" >/dev/null 2>&1; then fail "$desc"; else pass "$desc"; fi
+}
+
+# check_eq DESCRIPTION EXPECTED ACTUAL
+check_eq() {
+	if [ "$2" = "$3" ]; then pass "$1"; else fail "$1: expected '$2', got '$3'"; fi
+}
+
+file_size() {
+	case $os in
+	FreeBSD|Darwin) stat -f %z "$1" ;;
+	*) stat -c %s "$1" ;;
+	esac
+}
+
+file_mode() {
+	case $os in
+	FreeBSD|Darwin) stat -f %Lp "$1" ;;
+	*) stat -c %a "$1" ;;
+	esac
+}
+
+link_count() {
+	case $os in
+	FreeBSD|Darwin) stat -f %l "$1" ;;
+	*) stat -c %h "$1" ;;
+	esac
+}
+
+set_xattr() {
+	case $os in
+	FreeBSD) setextattr user "$2" "$3" "$1" ;;
+	Darwin) xattr -w "user.$2" "$3" "$1" ;;
+	*) setfattr -n "user.$2" -v "$3" "$1" ;;
+	esac
+}
+
+get_xattr() {
+	case $os in
+	FreeBSD) getextattr -q user "$2" "$1" ;;
+	Darwin) xattr -p "user.$2" "$1" ;;
+	*) getfattr --only-values -n "user.$2" "$1" ;;
+	esac
+}
+
+cleanup() {
+	umount "$mnt" 2>/dev/null || fusermount -u "$mnt" 2>/dev/null
+	[ -n "${pid:-}" ] && wait "$pid" 2>/dev/null
+	rmdir "$mnt"
+}
+trap cleanup EXIT
+
+"$sqlfs" init -db "$db" || exit 1
+"$sqlfs" mount -db "$db" "$mnt" &
+pid=$!
+for i in 1 2 3 4 5 6 7 8 9 10; do
+	mount | grep -q "$mnt" && break
+	sleep 1
+done
+if ! mount | grep -q "$mnt"; then
+	echo "the file system was not mounted"
+	exit 1
+fi
+
+cd "$mnt" || exit 1
+
+check "mkdir" mkdir dir
+check "nested mkdir" mkdir -p dir/a/b/c
+check "create file" sh -c 'echo hello > dir/file'
+check_eq "read file" "hello" "$(cat dir/file)"
+check "append" sh -c 'echo world >> dir/file'
+check_eq "size after append" 12 "$(file_size dir/file)"
+check "truncate" truncate -s 3 dir/file
+check_eq "read after truncate" "hel" "$(cat dir/file)"
+check "extend" truncate -s 5000 dir/file
+check_eq "size after extend" 5000 "$(file_size dir/file)"
+check "write large file" dd if=/dev/zero of=big bs=64k count=32
+check_eq "size of large file" 2097152 "$(file_size big)"
+check "chmod" chmod 640 dir/file
+check_eq "mode after chmod" 640 "$(file_mode dir/file)"
+check "rename" mv dir/file dir/renamed
+check_fails "old name gone" test -e dir/file
+check "rename across directories" mv dir/renamed dir/a/renamed
+check "symlink" ln -s a/renamed dir/link
+check_eq "readlink" "a/renamed" "$(readlink dir/link)"
+check "hard link" ln dir/a/renamed dir/hard
+check_eq "link count" 2 "$(link_count dir/hard)"
+check "mkfifo" mkfifo dir/fifo
+check "fifo type" test -p dir/fifo
+check_fails "rmdir non-empty" rmdir dir/a
+check "rm" rm dir/hard
+check_eq "link count after rm" 1 "$(link_count dir/a/renamed)"
+check "xattr set" set_xattr dir/a/renamed color blue
+check_eq "xattr get" "blue" "$(get_xattr dir/a/renamed color)"
+check_eq "readdir" "a fifo link" "$(ls dir | tr '\n' ' ' | sed 's/ $//')"
+check "rm -r" rm -r dir
+check_fails "tree removed" test -e dir
+check "df" df "$mnt"
+
+cd / || exit 1
+echo
+if [ "$failures" -ne 0 ]; then
+	echo "$failures check(s) failed"
+	exit 1
+fi
+echo "all checks passed"
@@ -0,0 +1,77 @@
+#!/usr/bin/env python3
+"""Generates internal/store/normtables.go, the Unicode tables used to normalize file
+names to NFC or NFD. The tables follow the Unicode version of the Python
+interpreter running this script.
+
+Usage: go generate ./internal/store, or
+python3 scripts/gen_normtables.py | gofmt > internal/store/normtables.go
+"""
+
+import sys
+import unicodedata
+
+HANGUL_FIRST, HANGUL_LAST = 0xAC00, 0xD7A3
+
+
+def canonical_decomposition(c):
+    d = unicodedata.decomposition(c)
+    if not d or d.startswith("<"):
+        return None
+    return [chr(int(x, 16)) for x in d.split()]
+
+
+def full_decomposition(c):
+    d = canonical_decomposition(c)
+    if d is None:
+        return [c]
+    out = []
+    for x in d:
+        out.extend(full_decomposition(x))
+    return out
+
+
+def main():
+    decomp, ccc, compose = {}, {}, {}
+    for cp in range(0x110000):
+        if HANGUL_FIRST <= cp <= HANGUL_LAST or 0xD800 <= cp <= 0xDFFF:
+            continue
+        c = chr(cp)
+        cls = unicodedata.combining(c)
+        if cls:
+            ccc[cp] = cls
+        d = canonical_decomposition(c)
+        if d is None:
+            continue
+        decomp[cp] = [ord(x) for x in full_decomposition(c)]
+        # Primary composites are the pairs that NFC recomposes.
+        if len(d) == 2 and unicodedata.normalize("NFC", "".join(d)) == c:
+            compose[(ord(d[0]), ord(d[1]))] = cp
+
+    w = sys.stdout.write
+    w("// Code generated by scripts/gen_normtables.py; DO NOT EDIT.\n\n")
+    w("package store\n\n")
+    w("// Unicode version of the normalization tables.\n")
+    w('const normUnicodeVersion = "%s"\n\n' % unicodedata.unidata_version)
+
+    w("// normDecomposition maps runes to their full canonical decomposition.\n")
+    w("var normDecomposition = map[rune][]rune{\n")
+    for cp in sorted(decomp):
+        w("\t0x%X: {%s},\n" % (cp, ", ".join("0x%X" % x for x in decomp[cp])))
+    w("}\n\n")
+
+    w("// normCombiningClass maps runes to their non-zero canonical combining class.\n")
+    w("var normCombiningClass = map[rune]uint8{\n")
+    items = sorted(ccc.items())
+    for i in range(0, len(items), 8):
+        w("\t" + " ".join("0x%X: %d," % kv for kv in items[i:i + 8]) + "\n")
+    w("}\n\n")
+
+    w("// normComposition maps pairs of runes to their primary composite.\n")
+    w("var normComposition = map[[2]rune]rune{\n")
+    for (a, b), cp in sorted(compose.items()):
+        w("\t{0x%X, 0x%X}: 0x%X,\n" % (a, b, cp))
+    w("}\n")
+
+
+if __name__ == "__main__":
+    main()
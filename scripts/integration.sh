@@ -0,0 +1,39 @@
+#!/bin/sh
+#
+# Runs the integration tests (`go test -tags integration`) against
+# CockroachDB started with Docker: they mount a file system with
+# fstestutil, exercise create, read, write, rename, unlink, link and symlink
+# through the kernel, and check what was stored through the SQL layer.
+#
+# Usage: scripts/integration.sh
+#
+# Set DB_URL to the URL of an existing CockroachDB cluster instead of
+# starting one, e.g. postgresql://root@localhost:26257?sslmode=disable; the
+# tests create and drop databases of their own.
+# Set PJDFSTEST_DIR to a built checkout of pjdfstest to also run it and
+# compare its outcome with scripts/pjdfstest.pass (TestPjdfstest, see
+# scripts/pjdfstest.sh), which needs root.
+# FUSE must be usable by the current user (/dev/fuse and fusermount).
+
+set -eu
+
+container=
+
+cleanup() {
+	[ -n "$container" ] && docker rm -f "$container" >/dev/null 2>&1
+	return 0
+}
+trap cleanup EXIT
+
+if [ -z "${DB_URL:-}" ]; then
+	container=$(docker run -d -P cockroachdb/cockroach:latest start-single-node --insecure)
+	port=$(docker port "$container" 26257/tcp | head -n 1 | sed 's/.*://')
+	DB_URL="postgresql://root@localhost:$port?sslmode=disable"
+	for i in $(seq 30); do
+		docker exec "$container" ./cockroach sql --insecure -e 'SELECT 1' >/dev/null 2>&1 && break
+		[ "$i" -eq 30 ] && { echo "the database did not start" >&2; exit 1; }
+		sleep 1
+	done
+fi
+
+SQLFS_TEST_DB=$DB_URL go test -tags integration -run 'Integration|Pjdfstest' -v ./internal/store
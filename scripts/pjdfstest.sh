@@ -0,0 +1,109 @@
+#!/bin/sh
+#
+# Runs the POSIX compliance tests of pjdfstest on a scratch sql-fs mount and
+# compares the outcome of each test file with scripts/pjdfstest.pass, the
+# list of test files known to pass. A listed test that fails is a
+# regression, and makes the script exit with status 1; tests that pass but
+# are not listed yet are reported, so that the list can be extended.
+#
+# Usage: scripts/pjdfstest.sh [-update] PJDFSTEST_DIR [DB_URL]
+#
+# PJDFSTEST_DIR is a built checkout of https://github.com/pjd/pjdfstest
+# (autoreconf -ifs && ./configure && make). DB_URL must point to an empty,
+# existing database, e.g.
+# postgresql://root@localhost:26257/sqlfs_pjdfstest?sslmode=disable. The
+# tests change owners and switch users, so run as root. The binary is taken
+# from bin/sqlfs, so run `make` first. With -update, the pass list is
+# rewritten from the outcome of this run instead.
+
+set -u
+
+update=false
+if [ "${1:-}" = "-update" ]; then
+	update=true
+	shift
+fi
+if [ $# -lt 1 ]; then
+	sed -n '/^# Usage/,/^$/p' "$0" | sed 's/^# \{0,1\}//' >&2
+	exit 2
+fi
+
+suite=$(cd "$1" && pwd) || exit 2
+db=${2:-postgresql://root@localhost:26257/sqlfs_pjdfstest?sslmode=disable}
+sqlfs=${SQLFS:-$(pwd)/bin/sqlfs}
+passlist=$(cd "$(dirname "$0")" && pwd)/pjdfstest.pass
+mnt=$(mktemp -d -t sqlfs-pjdfstest.XXXXXX)
+results=$(mktemp -t sqlfs-pjdfstest-results.XXXXXX)
+
+cleanup() {
+	cd /
+	umount "$mnt" 2>/dev/null || fusermount -u "$mnt" 2>/dev/null
+	[ -n "${pid:-}" ] && wait "$pid" 2>/dev/null
+	rmdir "$mnt"
+	rm -f "$results"
+}
+trap cleanup EXIT
+
+"$sqlfs" init -db "$db" || exit 1
+"$sqlfs" mount -db "$db" -allow-other "$mnt" &
+pid=$!
+for i in 1 2 3 4 5 6 7 8 9 10; do
+	mount | grep -q "$mnt" && break
+	sleep 1
+done
+if ! mount | grep -q "$mnt"; then
+	echo "the file system was not mounted"
+	exit 1
+fi
+
+# Each test file runs in a directory of its own, so that a test that leaves
+# files behind does not affect the next ones.
+cd "$suite/tests" || exit 1
+for test in */*.t; do
+	dir="$mnt/$(echo "$test" | tr '/.' '__')"
+	mkdir "$dir" || exit 1
+	if (cd "$dir" && prove "$suite/tests/$test") >/dev/null 2>&1; then
+		echo "pass $test" >>"$results"
+	else
+		echo "fail $test" >>"$results"
+	fi
+done
+
+# Summary per category, e.g. rename: 18/21.
+echo "Passing test files per category:"
+awk '{ split($2, p, "/"); total[p[1]]++; if ($1 == "pass") passed[p[1]]++ }
+	END { for (c in total) printf "  %-12s %d/%d\n", c ":", passed[c], total[c] }' "$results" | sort
+
+if $update; then
+	{
+		echo "# Test files of pjdfstest that pass on sql-fs, maintained with"
+		echo "# scripts/pjdfstest.sh -update."
+		grep '^pass ' "$results" | cut -c6- | sort
+	} >"$passlist"
+	echo "Updated $passlist."
+	exit 0
+fi
+
+# An empty list would let every run pass, record one with -update first.
+if ! grep -qv '^#' "$passlist"; then
+	echo "$passlist lists no test files, record it with -update"
+	exit 1
+fi
+
+regressions=0
+for test in $(grep -v '^#' "$passlist"); do
+	if ! grep -qx "pass $test" "$results"; then
+		echo "REGRESSION $test"
+		regressions=$((regressions + 1))
+	fi
+done
+for test in $(grep '^pass ' "$results" | cut -c6-); do
+	if ! grep -qx "$test" "$passlist"; then
+		echo "newly passing $test (add it with -update)"
+	fi
+done
+if [ "$regressions" -ne 0 ]; then
+	echo "$regressions test file(s) of the pass list failed"
+	exit 1
+fi
+echo "All test files of the pass list passed."